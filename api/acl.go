@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// MiddlewareACL is the factory name of the network acl middleware
+const MiddlewareACL = "acl"
+
+// routeGroups are the path prefixes of the route groups by name
+var routeGroups = map[string]string{
+	"order":     v1Prefix,
+	"customer":  customerPrefix,
+	"draft":     draftPrefix,
+	"schedule":  schedulePrefix,
+	"host":      hostPrefix,
+	"warehouse": warehousePrefix,
+	"track":     trackPrefix,
+	"agent":     agentPrefix,
+	"admin":     adminPrefix,
+}
+
+// aclRule is a rule of the acl with its networks parsed
+type aclRule struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newACLRule(rule config.ACLRule) (*aclRule, error) {
+	allow, deny, err := rule.Networks()
+	if err != nil {
+		return nil, err
+	}
+	return &aclRule{allow: allow, deny: deny}, nil
+}
+
+// check returns why ip is refused, "" when it passes
+func (a *aclRule) check(ip net.IP) string {
+	for _, network := range a.deny {
+		if network.Contains(ip) {
+			return "denied " + network.String()
+		}
+	}
+	if len(a.allow) == 0 {
+		return ""
+	}
+	for _, network := range a.allow {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	return "not allowed"
+}
+
+// NetworkACL refuses with 403 the requests whose client does not pass the
+// lists of every route or those of the group of its route, such as keeping
+// the admin api to the ranges of the office and the vpn. Every refusal is
+// logged with the client, the route group and the rule.
+type NetworkACL struct {
+	global *aclRule
+	groups map[string]*aclRule
+}
+
+// NewNetworkACL returns the network acl of cfg
+func NewNetworkACL(cfg config.ACLConfig) (*NetworkACL, error) {
+	global, err := newACLRule(cfg.ACLRule)
+	if err != nil {
+		return nil, err
+	}
+	acl := &NetworkACL{global: global, groups: make(map[string]*aclRule, len(cfg.Groups))}
+	for group, rule := range cfg.Groups {
+		if _, ok := routeGroups[group]; !ok {
+			names := make([]string, 0, len(routeGroups))
+			for name := range routeGroups {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown acl route group %q, one of %s", group, strings.Join(names, ", "))
+		}
+		if acl.groups[group], err = newACLRule(rule); err != nil {
+			return nil, fmt.Errorf("acl of group %s %v", group, err)
+		}
+	}
+	return acl, nil
+}
+
+// routeGroup returns the name of the route group of path, "" for none
+func routeGroup(path string) string {
+	for name, prefix := range routeGroups {
+		if strings.HasPrefix(path, "/"+prefix+"/") {
+			return name
+		}
+	}
+	return ""
+}
+
+func (a *NetworkACL) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	client := clientIP(r)
+	group := routeGroup(r.URL.Path)
+	reason := "not an ip address"
+	if ip := net.ParseIP(client); ip != nil {
+		reason = a.global.check(ip)
+		if rule, ok := a.groups[group]; ok && reason == "" {
+			reason = rule.check(ip)
+		}
+	}
+	if reason == "" {
+		next(w, r)
+		return
+	}
+
+	aclDenied.WithLabelValues(group).Inc()
+	LoggerFromContext(r.Context()).WithFields(logging.Fields{"acl_group": group, "acl_reason": reason}).Warnf("refused %s %s from %s by the network acl", r.Method, r.URL.Path, client)
+	writeErrorCode(w, r, CodeACLDenied, "forbidden by the network acl")
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/omnom-nom/order/config"
+)
+
+func TestNetworkACL(t *testing.T) {
+	cfg := config.ACLConfig{
+		Enabled: true,
+		ACLRule: config.ACLRule{Deny: []string{"192.0.2.0/24"}},
+		Groups: map[string]config.ACLRule{
+			"admin": {Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.6.6.6"}},
+		},
+	}
+	acl, err := NewNetworkACL(cfg)
+	if err != nil {
+		t.Fatalf("NewNetworkACL() = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		remote   string
+		clientIP string
+		allowed  bool
+	}{
+		{name: "order route from anywhere", path: "/v1/order/o-1", remote: "198.51.100.1:4000", allowed: true},
+		{name: "globally denied", path: "/v1/order/o-1", remote: "192.0.2.10:4000"},
+		{name: "globally denied on the admin routes", path: "/v1/admin/jobs", remote: "192.0.2.10:4000"},
+		{name: "admin route from the allowed range", path: "/v1/admin/jobs", remote: "10.1.2.3:4000", allowed: true},
+		{name: "admin route from an allowed ipv6 range", path: "/v1/admin/jobs", remote: "[2001:db8::5]:4000", allowed: true},
+		{name: "admin route from another range", path: "/v1/admin/jobs", remote: "198.51.100.1:4000"},
+		{name: "admin route from a denied address of the range", path: "/v1/admin/jobs", remote: "10.6.6.6:4000"},
+		{name: "resolved client ip preferred to the peer", path: "/v1/admin/jobs", remote: "10.1.2.3:4000", clientIP: "198.51.100.1"},
+		{name: "peer that is not an ip address", path: "/v1/order/o-1", remote: "pipe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.RemoteAddr = tt.remote
+			if tt.clientIP != "" {
+				r = r.WithContext(WithClientIP(r.Context(), tt.clientIP))
+			}
+			w := httptest.NewRecorder()
+			reached := false
+			acl.ServeHTTP(w, r, func(http.ResponseWriter, *http.Request) { reached = true })
+			if reached != tt.allowed {
+				t.Fatalf("request allowed = %t, want %t", reached, tt.allowed)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestNewNetworkACLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ACLConfig
+	}{
+		{name: "unknown route group", cfg: config.ACLConfig{Groups: map[string]config.ACLRule{"orders": {}}}},
+		{name: "invalid global range", cfg: config.ACLConfig{ACLRule: config.ACLRule{Allow: []string{"10.0.0.0/33"}}}},
+		{name: "invalid group address", cfg: config.ACLConfig{Groups: map[string]config.ACLRule{"admin": {Deny: []string{"office"}}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewNetworkACL(tt.cfg); err == nil {
+				t.Fatal("NewNetworkACL() returned no error")
+			}
+		})
+	}
+}
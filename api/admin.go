@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/omnom-nom/apiserver"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// MiddlewareAdminGuard is the factory name of the middleware guarding the admin api
+const MiddlewareAdminGuard = "admin-guard"
+
+// isAdminPath reports whether path is a route of the admin api. Admin routes
+// change or describe the instance answering rather than the orders, so they
+// are neither sent to the leader nor refused while the service is read only.
+func isAdminPath(path string) bool {
+	return strings.HasPrefix(path, "/"+adminPrefix+"/")
+}
+
+type adminListenerKey struct{}
+
+// withAdminListener marks the requests received on the admin listen address
+func withAdminListener(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminListenerKey{}, true)))
+	})
+}
+
+// AdminGuard serves the admin routes to the requests allowed by the admin
+// settings only. With an admin listen address the admin routes are served on
+// it alone, and only they are; with a token they require it as bearer token.
+type AdminGuard struct {
+	cfg config.AdminConfig
+}
+
+// NewAdminGuard returns the middleware guarding the admin api with cfg
+func NewAdminGuard(cfg config.AdminConfig) *AdminGuard {
+	return &AdminGuard{cfg: cfg}
+}
+
+func (g *AdminGuard) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	admin := isAdminPath(r.URL.Path)
+	viaAdminListener := r.Context().Value(adminListenerKey{}) != nil
+	switch {
+	case g.cfg.ListenAddress != "" && admin != viaAdminListener:
+		http.NotFound(w, r)
+		return
+	case admin && g.cfg.ListenAddress == "" && g.cfg.Token == "":
+		// the admin api is disabled
+		http.NotFound(w, r)
+		return
+	case admin && g.cfg.Token != "" && !validBearer(r, g.cfg.Token):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="order admin"`)
+		writeErrorCode(w, r, CodeInvalidAdminToken, "invalid admin token")
+		return
+	}
+	next(w, r)
+}
+
+func validBearer(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+type configStoreKey struct{}
+
+// WithConfigStore returns a copy of ctx carrying store
+func WithConfigStore(ctx context.Context, store *config.Store) context.Context {
+	return context.WithValue(ctx, configStoreKey{}, store)
+}
+
+// ConfigStoreFromContext returns the configuration store stored in ctx, or nil
+func ConfigStoreFromContext(ctx context.Context) *config.Store {
+	store, _ := ctx.Value(configStoreKey{}).(*config.Store)
+	return store
+}
+
+// updateConfig applies change to a copy of the current configuration of the
+// store of ctx and makes it current. Only the settings reloaded on SIGHUP can
+// be changed, and the next reload replaces them with those of the files.
+func updateConfig(ctx context.Context, change func(cfg *config.Config)) (*config.Config, error) {
+	store := ConfigStoreFromContext(ctx)
+	if store == nil {
+		return nil, ErrNotSupported
+	}
+	next := *store.Current()
+	change(&next)
+	if err := store.Set(&next); err != nil {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	return store.Current(), nil
+}
+
+// maintenanceState is the body of the maintenance routes
+type maintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// GetMaintenance tells whether the instance refuses writes for maintenance
+func GetMaintenance(w http.ResponseWriter, r *http.Request) {
+	gatekeeper := ConfigFromContext(r.Context()).Gatekeeper
+	writeJSON(w, r, http.StatusOK, &maintenanceState{Enabled: gatekeeper.ReadOnly, Message: gatekeeper.Message})
+}
+
+// SetMaintenance puts the instance in or out of maintenance mode, in which the
+// gatekeeper refuses the requests that may modify state with the message of the body
+func SetMaintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceState
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	cfg, err := updateConfig(r.Context(), func(cfg *config.Config) {
+		cfg.Gatekeeper = config.GatekeeperConfig{ReadOnly: req.Enabled, Message: req.Message}
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, &maintenanceState{Enabled: cfg.Gatekeeper.ReadOnly, Message: cfg.Gatekeeper.Message})
+}
+
+// logLevelState is the response of the log level routes, modules are those
+// with their own level
+type logLevelState struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+func newLogLevelState(cfg *config.Config) *logLevelState {
+	state := &logLevelState{Level: cfg.Level().String()}
+	for module, level := range cfg.ModuleLevels() {
+		if state.Modules == nil {
+			state.Modules = map[string]string{}
+		}
+		state.Modules[module] = level.String()
+	}
+	return state
+}
+
+// logLevelChange is the body of SetLogLevel
+type logLevelChange struct {
+	Level  string `json:"level"`
+	Module string `json:"module,omitempty"`
+}
+
+// GetLogLevel returns the log level of the instance and of the modules with their own
+func GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, newLogLevelState(ConfigFromContext(r.Context())))
+}
+
+// SetLogLevel changes the log level of the instance, or of the module of the
+// body. An empty level makes the module log at the level of the instance again.
+func SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevelChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	var level logging.Level
+	if req.Module == "" || req.Level != "" {
+		var err error
+		if level, err = logging.ParseLevel(req.Level); err != nil {
+			writeError(w, r, &ValidationError{Field: "level", Reason: err.Error()})
+			return
+		}
+	}
+	cfg, err := updateConfig(r.Context(), func(cfg *config.Config) {
+		if req.Module == "" {
+			cfg.LogLevel = level.String()
+			return
+		}
+		// the map is shared with the current configuration
+		levels := make(map[string]string, len(cfg.LogLevels)+1)
+		for module, name := range cfg.LogLevels {
+			levels[module] = name
+		}
+		if req.Level == "" {
+			delete(levels, req.Module)
+		} else {
+			levels[req.Module] = level.String()
+		}
+		cfg.LogLevels = levels
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newLogLevelState(cfg))
+}
+
+// routeInfo describes a route of the service
+type routeInfo struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// routeTable describes the routes of the service sorted by path, and
+// routeNames matches requests to them. They are built in init as routes
+// refers to ListRoutes.
+var (
+	routeTable []routeInfo
+	routeNames *routeMatcher
+)
+
+func init() {
+	routeTable = describeRoutes(routes)
+	routeNames = newRouteMatcher(routes)
+}
+
+func describeRoutes(routes map[string][]apiserver.Route) []routeInfo {
+	var infos []routeInfo
+	for prefix, group := range routes {
+		for _, route := range group {
+			infos = append(infos, routeInfo{Name: route.Name, Method: route.Method, Path: "/" + prefix + "/" + route.Path})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Path != infos[j].Path {
+			return infos[i].Path < infos[j].Path
+		}
+		return infos[i].Method < infos[j].Method
+	})
+	return infos
+}
+
+// ListRoutes returns the routes served by the service sorted by path
+func ListRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, routeTable)
+}
+
+// RouteName returns the name of the route of the service r is for, false
+// when it matches none
+func RouteName(r *http.Request) (string, bool) {
+	name, _, ok := routeNames.match(r)
+	return name, ok
+}
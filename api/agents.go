@@ -0,0 +1,446 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareAgentAuth is the factory name of the middleware checking the
+// signatures of the requests of the warehouse agents
+const MiddlewareAgentAuth = "agent-auth"
+
+// headers of a signed agent request, besides the X-Host-Id header naming the
+// host whose key signed it
+const (
+	// AgentTimestampHeader is the unix time the request was signed at
+	AgentTimestampHeader = "X-Agent-Timestamp"
+	// AgentSignatureHeader is "sha256=" followed by AgentSignature of the request
+	AgentSignatureHeader = "X-Agent-Signature"
+)
+
+// ErrInvalidAgentSignature is returned for agent and host requests that are
+// not signed with the key of a registered host, or signed too long ago
+var ErrInvalidAgentSignature = errors.New("invalid agent signature")
+
+// maxAgentBodySize is the largest body of an agent request, read whole to
+// check its signature
+const maxAgentBodySize = 10 << 20
+
+// maxConfirmationIDLength is the longest confirmation id accepted
+const maxConfirmationIDLength = 128
+
+// AgentSignature returns the hex HMAC-SHA256 of
+// "<timestamp>.<method>.<request uri>.<body>" with the key of a host. Agents
+// compute it for each request, the request uri being the path with the query.
+func AgentSignature(key string, timestamp int64, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d.%s.%s.", timestamp, method, uri)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isAgentPath reports whether path is a route of the agent api
+func isAgentPath(path string) bool {
+	return strings.HasPrefix(path, "/"+agentPrefix+"/")
+}
+
+// AgentGuard serves the agent routes to the requests signed with the key the
+// admin api issued the host of their X-Host-Id header, within the max
+// skew of the clock of the service. The host is read at every request, so a
+// rotated key or a deregistered host is refused at once.
+type AgentGuard struct {
+	store   HostStore
+	maxSkew time.Duration
+}
+
+// NewAgentGuard returns the middleware checking the agent requests with the
+// keys of the hosts of store as set in cfg
+func NewAgentGuard(store HostStore, cfg config.AgentsConfig) *AgentGuard {
+	return &AgentGuard{store: store, maxSkew: cfg.MaxSkew.Duration}
+}
+
+func (g *AgentGuard) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !isAgentPath(r.URL.Path) {
+		next(w, r)
+		return
+	}
+	id, err := g.authenticate(r, time.Now())
+	switch {
+	case errors.Is(err, ErrInvalidAgentSignature):
+		LoggerFromContext(r.Context()).Warnf("refused %s %s of host %q: %v", r.Method, r.URL.Path, r.Header.Get(HostHeader), err)
+		writeErrorCode(w, r, CodeInvalidAgentSignature, ErrInvalidAgentSignature.Error())
+	case err != nil:
+		writeError(w, r, err)
+	default:
+		next(w, r.WithContext(withAgentHost(r.Context(), id)))
+	}
+}
+
+// authenticate returns the id of the host that signed r at now, or
+// ErrInvalidAgentSignature with the reason. The body of r is read and put back.
+func (g *AgentGuard) authenticate(r *http.Request, now time.Time) (string, error) {
+	host, err := verifyHostSignature(r, now, g.maxSkew, g.store.GetHost)
+	if err != nil {
+		return "", err
+	}
+	return host.ID, nil
+}
+
+// verifyHostSignature returns the host, read with lookup, whose key signed r
+// within maxSkew of now, or ErrInvalidAgentSignature with the reason, which
+// wraps ErrHostNotFound when the host is not registered. The body of r is read
+// and put back.
+func verifyHostSignature(r *http.Request, now time.Time, maxSkew time.Duration, lookup func(context.Context, string) (*Host, error)) (*Host, error) {
+	id := r.Header.Get(HostHeader)
+	if id == "" {
+		return nil, fmt.Errorf("%w: no %s header", ErrInvalidAgentSignature, HostHeader)
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(AgentTimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed %s header", ErrInvalidAgentSignature, AgentTimestampHeader)
+	}
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, fmt.Errorf("%w: signed %s away from the clock", ErrInvalidAgentSignature, skew.Round(time.Second))
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get(AgentSignatureHeader), "sha256=")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed %s header", ErrInvalidAgentSignature, AgentSignatureHeader)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAgentBodySize+1))
+	if err != nil {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	if len(body) > maxAgentBodySize {
+		return nil, &ValidationError{Field: "body", Reason: fmt.Sprintf("must be at most %d bytes", maxAgentBodySize)}
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	host, err := lookup(r.Context(), id)
+	if errors.Is(err, ErrHostNotFound) {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidAgentSignature, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if host.Key == "" {
+		return nil, fmt.Errorf("%w: host has no agent key", ErrInvalidAgentSignature)
+	}
+	expected := AgentSignature(host.Key, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, fmt.Errorf("%w: signature does not match", ErrInvalidAgentSignature)
+	}
+	return host, nil
+}
+
+type agentHostKey struct{}
+
+// withAgentHost returns a copy of ctx of a request signed by the host with id
+func withAgentHost(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, agentHostKey{}, id)
+}
+
+// agentHostFromContext returns the id of the host that signed the request of
+// ctx, "" when it is not an authenticated agent request
+func agentHostFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(agentHostKey{}).(string)
+	return id
+}
+
+// ConfirmationType is the step of the fulfillment of an order an agent confirms
+type ConfirmationType string
+
+// the steps of fulfillment
+const (
+	ConfirmationPick ConfirmationType = "pick"
+	ConfirmationPack ConfirmationType = "pack"
+	ConfirmationShip ConfirmationType = "ship"
+)
+
+// Known reports whether t is a step of fulfillment
+func (t ConfirmationType) Known() bool {
+	return t == ConfirmationPick || t == ConfirmationPack || t == ConfirmationShip
+}
+
+// ConfirmedItem is a quantity of a SKU picked or packed
+type ConfirmedItem struct {
+	SKU      string `json:"sku" dynamodbav:"sku"`
+	Quantity int    `json:"quantity" dynamodbav:"quantity"`
+}
+
+// Confirmation is a pick, pack or shipment of an order an agent confirmed
+type Confirmation struct {
+	// ID is chosen by the agent, so that a confirmation sent again, such as
+	// when an agent retries a batch, is recorded once per order
+	ID          string           `json:"id" dynamodbav:"confirmationId"`
+	Type        ConfirmationType `json:"type" dynamodbav:"type"`
+	WarehouseID string           `json:"warehouseId" dynamodbav:"warehouseId"`
+	// HostID is the host of the agent that confirmed
+	HostID string `json:"hostId" dynamodbav:"hostId"`
+	// Items are those picked or packed, all those the warehouse ships when
+	// empty
+	Items []ConfirmedItem `json:"items,omitempty" dynamodbav:"items,omitempty"`
+	// ShipmentID is the shipment a ship confirmation added, or the shipment
+	// with its tracking number the order had already
+	ShipmentID string `json:"shipmentId,omitempty" dynamodbav:"shipmentId,omitempty"`
+	// OccurredAt is the time the agent confirmed, earlier than ReceivedAt by
+	// the time it was offline
+	OccurredAt time.Time `json:"occurredAt" dynamodbav:"occurredAt"`
+	ReceivedAt time.Time `json:"receivedAt" dynamodbav:"receivedAt"`
+}
+
+// confirmation returns the confirmation of o with id, or nil
+func (o *Order) confirmation(id string) *Confirmation {
+	for i := range o.Confirmations {
+		if o.Confirmations[i].ID == id {
+			return &o.Confirmations[i]
+		}
+	}
+	return nil
+}
+
+// confirmationRequest is the body of ConfirmFulfillment and an entry of
+// BatchConfirmFulfillment
+type confirmationRequest struct {
+	ID          string           `json:"id"`
+	Type        ConfirmationType `json:"type"`
+	OrderID     string           `json:"orderId"`
+	WarehouseID string           `json:"warehouseId"`
+	Items       []ConfirmedItem  `json:"items,omitempty"`
+	// Carrier and TrackingNumber name the parcel of a ship confirmation
+	Carrier        string `json:"carrier,omitempty"`
+	TrackingNumber string `json:"trackingNumber,omitempty"`
+	// OccurredAt is the time of the confirmation on the agent, the time it is
+	// received when empty
+	OccurredAt time.Time `json:"occurredAt,omitempty"`
+}
+
+// validate checks req received at now, with the clock of the agent up to
+// maxSkew ahead
+func (req *confirmationRequest) validate(now time.Time, maxSkew time.Duration) error {
+	switch {
+	case req.ID == "":
+		return &ValidationError{Field: "id", Reason: "is required"}
+	case len(req.ID) > maxConfirmationIDLength:
+		return &ValidationError{Field: "id", Reason: fmt.Sprintf("must be at most %d characters", maxConfirmationIDLength)}
+	case !req.Type.Known():
+		return &ValidationError{Field: "type", Reason: fmt.Sprintf("unknown confirmation type %q, only pick, pack or ship", req.Type)}
+	case req.OrderID == "":
+		return &ValidationError{Field: "orderId", Reason: "is required"}
+	case req.WarehouseID == "":
+		return &ValidationError{Field: "warehouseId", Reason: "is required"}
+	case req.OccurredAt.After(now.Add(maxSkew)):
+		return &ValidationError{Field: "occurredAt", Reason: "must not be in the future"}
+	}
+	for i, item := range req.Items {
+		if item.SKU == "" {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].sku", i), Reason: "is required"}
+		}
+		if item.Quantity <= 0 {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].quantity", i), Reason: "must be positive"}
+		}
+	}
+	if req.Type == ConfirmationShip {
+		if req.Carrier == "" {
+			return &ValidationError{Field: "carrier", Reason: "is required"}
+		}
+		if req.TrackingNumber == "" {
+			return &ValidationError{Field: "trackingNumber", Reason: "is required"}
+		}
+	}
+	return nil
+}
+
+// confirm records the confirmation of req by the host with hostID, received at
+// now, in its order, adding the shipment of a ship confirmation, and holds the
+// lock of the order meanwhile. It returns the confirmation already recorded
+// with the id of req, and true, when req was sent before.
+func confirm(ctx context.Context, repo Repository, hostID string, req *confirmationRequest, now time.Time) (*Confirmation, bool, error) {
+	ctx, unlock, err := lockOrder(ctx, req.OrderID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer unlock()
+
+	order, err := repo.GetOrder(ctx, req.OrderID)
+	if err != nil {
+		return nil, false, err
+	}
+	if recorded := order.confirmation(req.ID); recorded != nil {
+		return recorded, true, nil
+	}
+	if order.Status == StatusCancelled {
+		return nil, false, ErrNotShippable
+	}
+	if order.Routing != nil && !order.Routing.routes(req.WarehouseID) {
+		return nil, false, &ValidationError{Field: "warehouseId", Reason: "is not a warehouse the order is routed to"}
+	}
+	skus := make(map[string]bool, len(order.Items))
+	for _, item := range order.Items {
+		skus[item.SKU] = true
+	}
+	for i, item := range req.Items {
+		if !skus[item.SKU] {
+			return nil, false, &ValidationError{Field: fmt.Sprintf("items[%d].sku", i), Reason: "is not an item of the order"}
+		}
+	}
+
+	confirmation := Confirmation{
+		ID:          req.ID,
+		Type:        req.Type,
+		WarehouseID: req.WarehouseID,
+		HostID:      hostID,
+		Items:       req.Items,
+		OccurredAt:  req.OccurredAt.UTC(),
+		ReceivedAt:  now,
+	}
+	if confirmation.OccurredAt.IsZero() {
+		confirmation.OccurredAt = now
+	}
+	if req.Type == ConfirmationShip {
+		if shipment := order.shipmentByTracking(req.Carrier, req.TrackingNumber); shipment != nil {
+			confirmation.ShipmentID = shipment.ID
+		} else {
+			if !order.Shippable() {
+				return nil, false, ErrNotShippable
+			}
+			shipment := newShipment(req.Carrier, req.TrackingNumber, req.WarehouseID, confirmation.OccurredAt)
+			order.Shipments = append(order.Shipments, shipment)
+			confirmation.ShipmentID = shipment.ID
+		}
+	}
+	order.Confirmations = append(order.Confirmations, confirmation)
+	order.UpdatedAt = now
+	if err := repo.UpdateOrder(ctx, order); err != nil {
+		return nil, false, err
+	}
+	LoggerFromContext(ctx).Infof("host %s confirmed the %s of order %s at warehouse %s", hostID, req.Type, order.ID, req.WarehouseID)
+	return &confirmation, false, nil
+}
+
+// countConfirmation counts a confirmation of type t with result
+func countConfirmation(t ConfirmationType, result string) {
+	if !t.Known() {
+		t = "unknown"
+	}
+	agentConfirmations.WithLabelValues(string(t), result).Inc()
+}
+
+// confirmRequest validates and records req for the agent request of ctx
+func confirmRequest(ctx context.Context, req *confirmationRequest) (*Confirmation, bool, error) {
+	hostID := agentHostFromContext(ctx)
+	if hostID == "" {
+		return nil, false, ErrNotSupported
+	}
+	now := time.Now().UTC()
+	if err := req.validate(now, ConfigFromContext(ctx).Agents.MaxSkew.Duration); err != nil {
+		countConfirmation(req.Type, "rejected")
+		return nil, false, err
+	}
+	confirmation, duplicate, err := confirm(ctx, RepositoryFromContext(ctx), hostID, req, now)
+	switch {
+	case err != nil:
+		countConfirmation(req.Type, "rejected")
+	case duplicate:
+		countConfirmation(req.Type, "duplicate")
+	default:
+		countConfirmation(req.Type, "recorded")
+	}
+	return confirmation, duplicate, err
+}
+
+// ConfirmFulfillment records the pick, pack or shipment of the body, signed
+// by a warehouse agent, in its order. It answers 201 with the confirmation,
+// or 200 with the one recorded before when the agent sends it again.
+func ConfirmFulfillment(w http.ResponseWriter, r *http.Request) {
+	var req confirmationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	confirmation, duplicate, err := confirmRequest(r.Context(), &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	status := http.StatusCreated
+	if duplicate {
+		status = http.StatusOK
+	}
+	writeJSON(w, r, status, confirmation)
+}
+
+// batchConfirmationRequest is the body of BatchConfirmFulfillment
+type batchConfirmationRequest struct {
+	Confirmations []confirmationRequest `json:"confirmations"`
+}
+
+// batchConfirmationResult is the outcome of one confirmation of a batch, in
+// request order
+type batchConfirmationResult struct {
+	ID           string        `json:"id"`
+	Status       int           `json:"status"`
+	Confirmation *Confirmation `json:"confirmation,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Code         ErrorCode     `json:"code,omitempty"`
+}
+
+// BatchConfirmFulfillment records up to MaxBatchSize confirmations an agent
+// kept while offline, in the order of the body, and reports the outcome of
+// each like ConfirmFulfillment. The response is 200 even when some failed,
+// the agent sends those again, see the per item status.
+func BatchConfirmFulfillment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req batchConfirmationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := checkBatchSize(len(req.Confirmations)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if agentHostFromContext(ctx) == "" {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+
+	results := make([]batchConfirmationResult, len(req.Confirmations))
+	recorded := 0
+	for i := range req.Confirmations {
+		results[i].ID = req.Confirmations[i].ID
+		confirmation, duplicate, err := confirmRequest(ctx, &req.Confirmations[i])
+		if err != nil {
+			kind := errorKindOf(err)
+			message := err.Error()
+			if kind.code == CodeInternal {
+				LoggerFromContext(ctx).Errorf("batch confirmation %d failed: %v", i, err)
+				message = "internal error"
+			}
+			results[i].Status, results[i].Error, results[i].Code = kind.status, message, kind.code
+			continue
+		}
+		results[i].Status, results[i].Confirmation = http.StatusCreated, confirmation
+		if duplicate {
+			results[i].Status = http.StatusOK
+		} else {
+			recorded++
+		}
+	}
+
+	LoggerFromContext(ctx).Infof("batch recorded %d of %d confirmations", recorded, len(results))
+	writeJSON(w, r, http.StatusOK, &batchResponse{Results: results})
+}
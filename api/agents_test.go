@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// hostStoreWith returns a host store keeping hosts with their keys
+func hostStoreWith(t *testing.T, hosts ...*Host) HostStore {
+	t.Helper()
+	repo := NewMemoryRepository()
+	if err := EnableHosts(repo, ""); err != nil {
+		t.Fatal(err)
+	}
+	store, _ := findHostStore(repo)
+	for _, host := range hosts {
+		if err := store.PutHost(context.Background(), host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+// signedRequest returns a request of host with body signed with key at timestamp
+func signedRequest(method, uri, host, key string, timestamp int64, body string) *http.Request {
+	r := httptest.NewRequest(method, uri, strings.NewReader(body))
+	r.Header.Set(HostHeader, host)
+	r.Header.Set(AgentTimestampHeader, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(AgentSignatureHeader, "sha256="+AgentSignature(key, timestamp, method, uri, []byte(body)))
+	return r
+}
+
+func TestAgentGuardAuthenticate(t *testing.T) {
+	const key = "0123456789abcdef"
+	store := hostStoreWith(t,
+		&Host{ID: "wh-berlin-01", Key: key},
+		&Host{ID: "wh-paris-01"},
+	)
+	guard := NewAgentGuard(store, config.AgentsConfig{MaxSkew: config.Duration{Duration: 5 * time.Minute}})
+	now := time.Unix(1714554720, 0)
+	uri := "/" + agentPrefix + "/confirmations"
+	body := `{"id": "scan-8f2c", "type": "pick"}`
+
+	tests := []struct {
+		name    string
+		request func() *http.Request
+		valid   bool
+	}{
+		{
+			name: "valid signature",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Unix(), body)
+			},
+			valid: true,
+		},
+		{
+			name: "clock a bit ahead",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Add(4*time.Minute).Unix(), body)
+			},
+			valid: true,
+		},
+		{
+			name: "tampered body",
+			request: func() *http.Request {
+				r := signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Unix(), body)
+				r.Body = httptest.NewRequest(http.MethodPost, uri, strings.NewReader(`{"id": "scan-8f2c", "type": "ship"}`)).Body
+				return r
+			},
+		},
+		{
+			name: "tampered query",
+			request: func() *http.Request {
+				r := signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Unix(), body)
+				r.URL.RawQuery = "dryRun=true"
+				return r
+			},
+		},
+		{
+			name: "stale timestamp",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Add(-6*time.Minute).Unix(), body)
+			},
+		},
+		{
+			name: "timestamp signed over",
+			request: func() *http.Request {
+				r := signedRequest(http.MethodPost, uri, "wh-berlin-01", key, now.Add(-time.Hour).Unix(), body)
+				r.Header.Set(AgentTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+				return r
+			},
+		},
+		{
+			name: "key of another host",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, uri, "wh-paris-01", key, now.Unix(), body)
+			},
+		},
+		{
+			name: "unknown host",
+			request: func() *http.Request {
+				return signedRequest(http.MethodPost, uri, "wh-madrid-01", key, now.Unix(), body)
+			},
+		},
+		{
+			name: "unsigned",
+			request: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, uri, strings.NewReader(body))
+				r.Header.Set(HostHeader, "wh-berlin-01")
+				return r
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := guard.authenticate(tt.request(), now)
+			if tt.valid {
+				if err != nil || id != "wh-berlin-01" {
+					t.Fatalf("authenticate = %q, %v, want wh-berlin-01", id, err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrInvalidAgentSignature) {
+				t.Fatalf("authenticate = %q, %v, want ErrInvalidAgentSignature", id, err)
+			}
+		})
+	}
+}
+
+func TestAgentGuardRotatedKey(t *testing.T) {
+	const oldKey, newKey = "0123456789abcdef", "fedcba9876543210"
+	store := hostStoreWith(t, &Host{ID: "wh-berlin-01", Key: oldKey})
+	guard := NewAgentGuard(store, config.AgentsConfig{MaxSkew: config.Duration{Duration: 5 * time.Minute}})
+	now := time.Now()
+	uri := "/" + agentPrefix + "/confirmations"
+
+	if _, err := guard.authenticate(signedRequest(http.MethodPost, uri, "wh-berlin-01", oldKey, now.Unix(), "{}"), now); err != nil {
+		t.Fatalf("before rotation: %v", err)
+	}
+	if err := store.PutHost(context.Background(), &Host{ID: "wh-berlin-01", Key: newKey}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := guard.authenticate(signedRequest(http.MethodPost, uri, "wh-berlin-01", oldKey, now.Unix(), "{}"), now); !errors.Is(err, ErrInvalidAgentSignature) {
+		t.Errorf("previous key after rotation: %v, want ErrInvalidAgentSignature", err)
+	}
+	if _, err := guard.authenticate(signedRequest(http.MethodPost, uri, "wh-berlin-01", newKey, now.Unix(), "{}"), now); err != nil {
+		t.Errorf("new key after rotation: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+// Package apitest provides repositories and servers for testing code against the order api
+// without AWS credentials. Tests run against the in-memory repository unless
+// ORDER_TEST_DB_ENDPOINT points at a DynamoDB Local instance.
+package apitest
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/orderclient"
+)
+
+// EnvDbEndpoint names the DynamoDB Local endpoint used by NewRepository, e.g. http://localhost:8000
+const EnvDbEndpoint = "ORDER_TEST_DB_ENDPOINT"
+
+// NewRepository returns an empty repository that is discarded when the test ends.
+// With EnvDbEndpoint set it creates uniquely named tables in DynamoDB Local.
+func NewRepository(t testing.TB) api.Repository {
+	t.Helper()
+
+	endpoint := os.Getenv(EnvDbEndpoint)
+	if endpoint == "" {
+		return api.NewMemoryRepository()
+	}
+
+	cfg := Config()
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano())
+	cfg.Db.Endpoint = endpoint
+	cfg.Db.AccessKeyID = "local"
+	cfg.Db.SecretAccessKey = "local"
+	cfg.Db.OrdersTable = "test_orders_" + suffix
+	cfg.Db.MigrationsTable = "test_order_migrations_" + suffix
+	cfg.Db.OutboxTable = "test_order_outbox_" + suffix
+	cfg.Db.WebhooksTable = "test_order_webhooks_" + suffix
+	cfg.Db.ReturnsTable = "test_order_returns_" + suffix
+	cfg.Db.CustomersTable = "test_order_customers_" + suffix
+	cfg.Db.DraftsTable = "test_order_drafts_" + suffix
+	cfg.Db.SchedulesTable = "test_order_schedules_" + suffix
+	cfg.Db.JobsTable = "test_order_jobs_" + suffix
+	cfg.Db.LeasesTable = "test_order_leases_" + suffix
+	cfg.Db.MembersTable = "test_order_members_" + suffix
+	cfg.Db.HostsTable = "test_order_hosts_" + suffix
+	cfg.Db.QuotasTable = "test_order_quotas_" + suffix
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db, err := api.NewDb(ctx, cfg)
+	if err != nil {
+		t.Fatalf("failed to create dynamodb local client: %v", err)
+	}
+	if err := db.Migrate(ctx, &cfg.Db); err != nil {
+		t.Fatalf("failed to create dynamodb local tables: %v", err)
+	}
+
+	t.Cleanup(func() {
+		for _, table := range []string{cfg.Db.OrdersTable, cfg.Db.MigrationsTable, cfg.Db.OutboxTable, cfg.Db.WebhooksTable, cfg.Db.ReturnsTable, cfg.Db.CustomersTable, cfg.Db.DraftsTable,
+			cfg.Db.SchedulesTable, cfg.Db.JobsTable, cfg.Db.LeasesTable, cfg.Db.MembersTable, cfg.Db.HostsTable, cfg.Db.QuotasTable} {
+			if _, err := db.DeleteTable(context.Background(), &dynamodb.DeleteTableInput{TableName: aws.String(table)}); err != nil {
+				t.Logf("failed to delete table %s: %v", table, err)
+			}
+		}
+	})
+
+	return api.NewDynamoRepository(db, cfg.Db.OrdersTable)
+}
+
+// Config returns the default configuration with rate limiting and request timeouts
+// disabled, suitable for tests
+func Config() *config.Config {
+	cfg := config.Default()
+	cfg.ListenAddress = "127.0.0.1:0"
+	cfg.Timeouts.Request = config.Duration{}
+	cfg.RateLimit.Enabled = false
+	return cfg
+}
+
+// NewServer serves the order routes from repo on a local httptest server closed when the test ends
+func NewServer(t testing.TB, repo api.Repository) *httptest.Server {
+	t.Helper()
+	return newServer(t, repo, Config())
+}
+
+// ServeInProcess serves the order routes from repo with cfg, Config when nil,
+// on an httptest server on a free loopback port, and returns a client of it
+// and its base url. The server is closed when the test ends.
+func ServeInProcess(t testing.TB, repo api.Repository, cfg *config.Config) (*orderclient.Client, string) {
+	t.Helper()
+
+	if cfg == nil {
+		cfg = Config()
+	}
+	server := newServer(t, repo, cfg)
+	client, err := orderclient.New(
+		orderclient.WithBaseURL(server.URL),
+		orderclient.WithHTTPClient(server.Client()),
+		orderclient.WithAdminToken(cfg.Admin.Token),
+	)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return client, server.URL
+}
+
+func newServer(t testing.TB, repo api.Repository, cfg *config.Config) *httptest.Server {
+	t.Helper()
+
+	svc, err := api.NewService(repo, config.NewStore(cfg, nil))
+	if err != nil {
+		t.Fatalf("failed to create service: %v", err)
+	}
+	handler, err := svc.Handler()
+	if err != nil {
+		t.Fatalf("failed to create handler: %v", err)
+	}
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
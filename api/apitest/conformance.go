@@ -0,0 +1,272 @@
+package apitest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/money"
+)
+
+// RunConformance checks that the repositories returned by newRepo behave like
+// every other storage backend. Each subtest gets a fresh, empty repository.
+func RunConformance(t *testing.T, newRepo func(t testing.TB) api.Repository) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo api.Repository)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateDuplicate", testCreateDuplicate},
+		{"GetMissing", testGetMissing},
+		{"Update", testUpdate},
+		{"UpdateMissing", testUpdateMissing},
+		{"UpdateConflict", testUpdateConflict},
+		{"UpdateUnmodifiedSince", testUpdateUnmodifiedSince},
+		{"Delete", testDelete},
+		{"DeleteUnmodifiedSince", testDeleteUnmodifiedSince},
+		{"ListFilters", testListFilters},
+		{"ListPages", testListPages},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newRepo(t))
+		})
+	}
+}
+
+var conformanceEpoch = time.Date(2019, 2, 1, 12, 0, 0, 0, time.UTC)
+
+// NewOrder returns a valid pending order whose creation time is n minutes after a fixed epoch
+func NewOrder(id, customerID string, n int) *api.Order {
+	created := conformanceEpoch.Add(time.Duration(n) * time.Minute)
+	order := &api.Order{
+		ID:         id,
+		CustomerID: customerID,
+		Status:     api.StatusPending,
+		Items:      []api.LineItem{{SKU: "sku-1", Name: "widget", Quantity: 2, UnitPrice: money.New(450, "USD")}},
+		Currency:   "USD",
+		CreatedAt:  created,
+		UpdatedAt:  created,
+	}
+	order.ComputeTotal()
+	return order
+}
+
+func mustCreate(t *testing.T, repo api.Repository, orders ...*api.Order) {
+	t.Helper()
+	for _, order := range orders {
+		if err := repo.CreateOrder(context.Background(), order); err != nil {
+			t.Fatalf("CreateOrder(%s): %v", order.ID, err)
+		}
+	}
+}
+
+func testCreateAndGet(t *testing.T, repo api.Repository) {
+	order := NewOrder("o-1", "c-1", 0)
+	order.ShippingAddress = &api.Address{Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"}
+	mustCreate(t, repo, order)
+
+	got, err := repo.GetOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got.ID != order.ID || got.CustomerID != order.CustomerID || got.Status != order.Status ||
+		got.Total != order.Total || len(got.Items) != 1 || !got.CreatedAt.Equal(order.CreatedAt) {
+		t.Errorf("GetOrder returned %+v, want %+v", got, order)
+	}
+	if got.ShippingAddress == nil || *got.ShippingAddress != *order.ShippingAddress {
+		t.Errorf("GetOrder returned address %+v, want %+v", got.ShippingAddress, order.ShippingAddress)
+	}
+}
+
+func testCreateDuplicate(t *testing.T, repo api.Repository) {
+	mustCreate(t, repo, NewOrder("o-1", "c-1", 0))
+
+	if err := repo.CreateOrder(context.Background(), NewOrder("o-1", "c-2", 1)); !errors.Is(err, api.ErrOrderExists) {
+		t.Errorf("CreateOrder of a duplicate returned %v, want %v", err, api.ErrOrderExists)
+	}
+}
+
+func testGetMissing(t *testing.T, repo api.Repository) {
+	if _, err := repo.GetOrder(context.Background(), "missing"); !errors.Is(err, api.ErrOrderNotFound) {
+		t.Errorf("GetOrder of a missing order returned %v, want %v", err, api.ErrOrderNotFound)
+	}
+}
+
+func testUpdate(t *testing.T, repo api.Repository) {
+	order := NewOrder("o-1", "c-1", 0)
+	mustCreate(t, repo, order)
+
+	order.Status = api.StatusPaid
+	order.UpdatedAt = order.UpdatedAt.Add(time.Hour)
+	if err := repo.UpdateOrder(context.Background(), order); err != nil {
+		t.Fatalf("UpdateOrder: %v", err)
+	}
+
+	got, err := repo.GetOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got.Status != api.StatusPaid || !got.UpdatedAt.Equal(order.UpdatedAt) || got.Version != 1 || order.Version != 1 {
+		t.Errorf("GetOrder after update returned %+v, want %+v", got, order)
+	}
+}
+
+func testUpdateConflict(t *testing.T, repo api.Repository) {
+	mustCreate(t, repo, NewOrder("o-1", "c-1", 0))
+
+	first, err := repo.GetOrder(context.Background(), "o-1")
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	second, err := repo.GetOrder(context.Background(), "o-1")
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+
+	first.Status = api.StatusCancelled
+	if err := repo.UpdateOrder(context.Background(), first); err != nil {
+		t.Fatalf("first UpdateOrder: %v", err)
+	}
+	second.Status = api.StatusShipped
+	if err := repo.UpdateOrder(context.Background(), second); !errors.Is(err, api.ErrVersionConflict) {
+		t.Errorf("stale UpdateOrder returned %v, want %v", err, api.ErrVersionConflict)
+	}
+
+	got, err := repo.GetOrder(context.Background(), "o-1")
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got.Status != api.StatusCancelled {
+		t.Errorf("stale update overwrote the order, status is %s", got.Status)
+	}
+}
+
+func testUpdateUnmodifiedSince(t *testing.T, repo api.Repository) {
+	order := NewOrder("o-1", "c-1", 0)
+	mustCreate(t, repo, order)
+	created := order.UpdatedAt
+
+	before := api.WithUnmodifiedSince(context.Background(), created.Add(-time.Second))
+	order.Status = api.StatusPaid
+	if err := repo.UpdateOrder(before, order); !errors.Is(err, api.ErrPreconditionFailed) {
+		t.Fatalf("UpdateOrder of an order modified since returned %v, want %v", err, api.ErrPreconditionFailed)
+	}
+
+	order.UpdatedAt = created.Add(time.Hour)
+	if err := repo.UpdateOrder(api.WithUnmodifiedSince(context.Background(), created), order); err != nil {
+		t.Fatalf("UpdateOrder of an order not modified since: %v", err)
+	}
+	got, err := repo.GetOrder(context.Background(), order.ID)
+	if err != nil {
+		t.Fatalf("GetOrder: %v", err)
+	}
+	if got.Status != api.StatusPaid {
+		t.Errorf("conditional update did not write the order, status is %s", got.Status)
+	}
+}
+
+func testUpdateMissing(t *testing.T, repo api.Repository) {
+	if err := repo.UpdateOrder(context.Background(), NewOrder("missing", "c-1", 0)); !errors.Is(err, api.ErrOrderNotFound) {
+		t.Errorf("UpdateOrder of a missing order returned %v, want %v", err, api.ErrOrderNotFound)
+	}
+}
+
+func testDelete(t *testing.T, repo api.Repository) {
+	mustCreate(t, repo, NewOrder("o-1", "c-1", 0))
+
+	if err := repo.DeleteOrder(context.Background(), "o-1"); err != nil {
+		t.Fatalf("DeleteOrder: %v", err)
+	}
+	if _, err := repo.GetOrder(context.Background(), "o-1"); !errors.Is(err, api.ErrOrderNotFound) {
+		t.Errorf("GetOrder after delete returned %v, want %v", err, api.ErrOrderNotFound)
+	}
+	if err := repo.DeleteOrder(context.Background(), "o-1"); !errors.Is(err, api.ErrOrderNotFound) {
+		t.Errorf("second DeleteOrder returned %v, want %v", err, api.ErrOrderNotFound)
+	}
+}
+
+func testDeleteUnmodifiedSince(t *testing.T, repo api.Repository) {
+	order := NewOrder("o-1", "c-1", 0)
+	mustCreate(t, repo, order)
+
+	before := api.WithUnmodifiedSince(context.Background(), order.UpdatedAt.Add(-time.Second))
+	if err := repo.DeleteOrder(before, order.ID); !errors.Is(err, api.ErrPreconditionFailed) {
+		t.Fatalf("DeleteOrder of an order modified since returned %v, want %v", err, api.ErrPreconditionFailed)
+	}
+	if err := repo.DeleteOrder(api.WithUnmodifiedSince(context.Background(), order.UpdatedAt), order.ID); err != nil {
+		t.Fatalf("DeleteOrder of an order not modified since: %v", err)
+	}
+	if _, err := repo.GetOrder(context.Background(), order.ID); !errors.Is(err, api.ErrOrderNotFound) {
+		t.Errorf("GetOrder after delete returned %v, want %v", err, api.ErrOrderNotFound)
+	}
+}
+
+func testListFilters(t *testing.T, repo api.Repository) {
+	paid := NewOrder("o-3", "c-1", 2)
+	paid.Status = api.StatusPaid
+	mustCreate(t, repo, NewOrder("o-1", "c-1", 0), NewOrder("o-2", "c-2", 1), paid)
+
+	tests := []struct {
+		opts api.ListOptions
+		want []string
+	}{
+		{api.ListOptions{CustomerID: "c-1"}, []string{"o-3", "o-1"}},
+		{api.ListOptions{CustomerID: "c-2"}, []string{"o-2"}},
+		{api.ListOptions{Status: api.StatusPaid}, []string{"o-3"}},
+		{api.ListOptions{CustomerID: "c-1", Status: api.StatusPending}, []string{"o-1"}},
+		{api.ListOptions{CustomerID: "c-3"}, nil},
+	}
+	for _, tt := range tests {
+		orders, _, err := repo.ListOrders(context.Background(), tt.opts)
+		if err != nil {
+			t.Fatalf("ListOrders(%+v): %v", tt.opts, err)
+		}
+		if got := orderIDs(orders); got != fmt.Sprint(tt.want) {
+			t.Errorf("ListOrders(%+v) returned %s, want %v", tt.opts, got, tt.want)
+		}
+	}
+}
+
+func testListPages(t *testing.T, repo api.Repository) {
+	for i := 0; i < 5; i++ {
+		mustCreate(t, repo, NewOrder(fmt.Sprintf("o-%d", i), "c-1", i))
+	}
+
+	var seen []*api.Order
+	opts := api.ListOptions{CustomerID: "c-1", Limit: 2}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("ListOrders did not stop paging")
+		}
+		orders, next, err := repo.ListOrders(context.Background(), opts)
+		if err != nil {
+			t.Fatalf("ListOrders: %v", err)
+		}
+		if len(orders) > 2 {
+			t.Fatalf("ListOrders returned %d orders, limit is 2", len(orders))
+		}
+		seen = append(seen, orders...)
+		if next == "" {
+			break
+		}
+		opts.PageToken = next
+	}
+
+	if got, want := orderIDs(seen), "[o-4 o-3 o-2 o-1 o-0]"; got != want {
+		t.Errorf("paging returned %s, want %s", got, want)
+	}
+}
+
+func orderIDs(orders []*api.Order) string {
+	var ids []string
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+	}
+	return fmt.Sprint(ids)
+}
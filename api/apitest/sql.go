@@ -0,0 +1,90 @@
+package apitest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/api"
+)
+
+// EnvPostgresDSN names the postgres database used by NewPostgresRepository
+const EnvPostgresDSN = "ORDER_TEST_POSTGRES_DSN"
+
+// NewSQLiteRepository returns a migrated repository in a temporary sqlite database
+func NewSQLiteRepository(t testing.TB) api.Repository {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "order-sqlite")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	repo, err := api.NewSQLiteRepository(filepath.Join(dir, "orders.db"))
+	if err != nil {
+		t.Fatalf("failed to open sqlite repository: %v", err)
+	}
+	return migrated(t, repo)
+}
+
+// NewPostgresRepository returns a migrated repository in a fresh schema of the
+// database named by EnvPostgresDSN, the test is skipped when it is unset
+func NewPostgresRepository(t testing.TB) api.Repository {
+	t.Helper()
+
+	dsn := os.Getenv(EnvPostgresDSN)
+	if dsn == "" {
+		t.Skipf("%s is not set", EnvPostgresDSN)
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("failed to open postgres: %v", err)
+	}
+	schema := fmt.Sprintf("order_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	})
+
+	// lib/pq passes unknown parameters on as run-time settings
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	repo, err := api.NewPostgresRepository(dsn)
+	if err != nil {
+		t.Fatalf("failed to open postgres repository: %v", err)
+	}
+	return migrated(t, repo)
+}
+
+func migrated(t testing.TB, repo api.Repository) api.Repository {
+	t.Helper()
+
+	if closer, ok := repo.(io.Closer); ok {
+		t.Cleanup(func() { closer.Close() })
+	}
+	if migrator, ok := repo.(api.Migrator); ok {
+		if err := migrator.Migrate(context.Background()); err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+	}
+	return repo
+}
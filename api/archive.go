@@ -0,0 +1,327 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// ErrOrderArchived is returned when changing an order that was moved to the archive
+var ErrOrderArchived = errors.New("order is archived and can no longer be changed")
+
+// Archive keeps the orders moved out of the repository
+type Archive interface {
+	// PutOrders stores orders, marked archived, together
+	PutOrders(ctx context.Context, orders []*Order) error
+	// GetOrder returns the archived order with id, or ErrOrderNotFound
+	GetOrder(ctx context.Context, id string) (*Order, error)
+	// CustomerOrderIDs returns the ids of the archived orders of a customer
+	CustomerOrderIDs(ctx context.Context, customerID string) ([]string, error)
+	// ReplaceOrder replaces an archived order in place, such as with its
+	// personal data erased, or fails with ErrOrderNotFound
+	ReplaceOrder(ctx context.Context, order *Order) error
+}
+
+// archiveEntry locates an archived order within its archive object
+type archiveEntry struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// s3Archive writes each batch of orders as one JSON lines object, for analytics,
+// and a small index object per order naming the bytes of its line, for reads
+type s3Archive struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3Archive returns an archive in the bucket of cfg, with the region and
+// credentials of the database
+func NewS3Archive(ctx context.Context, cfg *config.Config) (Archive, error) {
+	archive := cfg.Retention.Archive
+	client, err := newS3Client(ctx, cfg, archive.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Archive{client: client, bucket: archive.Bucket, prefix: archive.Prefix}, nil
+}
+
+// newS3Client returns an s3 client with the region and credentials of the
+// database, talking to endpoint when it is set
+func newS3Client(ctx context.Context, cfg *config.Config, endpoint string) (*s3.Client, error) {
+	awsConfig, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+			o.UsePathStyle = true
+		}
+	}), nil
+}
+
+func (a *s3Archive) indexKey(id string) string {
+	return a.prefix + "index/" + id + ".json"
+}
+
+// customerPrefix is the prefix of the index objects of the orders of a
+// customer, which repeat those of indexKey
+func (a *s3Archive) customerPrefix(customerID string) string {
+	return a.prefix + "customers/" + customerID + "/"
+}
+
+// PutOrders writes the batch object before the index objects, so an order is
+// only found once all of it is stored
+func (a *s3Archive) PutOrders(ctx context.Context, orders []*Order) error {
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%sbatches/%s/%s.jsonl", a.prefix, now.Format("2006/01/02"), newID())
+
+	var buf bytes.Buffer
+	entries := make([]archiveEntry, len(orders))
+	for i, order := range orders {
+		archived := *order
+		archived.ArchivedAt = &now
+		line, err := json.Marshal(&archived)
+		if err != nil {
+			return err
+		}
+		entries[i] = archiveEntry{Key: key, Offset: int64(buf.Len()), Length: int64(len(line))}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	_, err := a.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(buf.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive %s: %v", key, err)
+	}
+
+	for i, order := range orders {
+		data, err := json.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+		keys := []string{a.indexKey(order.ID)}
+		if order.CustomerID != "" {
+			keys = append(keys, a.customerPrefix(order.CustomerID)+order.ID+".json")
+		}
+		for _, index := range keys {
+			_, err = a.client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:      aws.String(a.bucket),
+				Key:         aws.String(index),
+				Body:        bytes.NewReader(data),
+				ContentType: aws.String("application/json"),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to index archived order %s: %v", order.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// entry returns the location of the archived order with id, or ErrOrderNotFound
+func (a *s3Archive) entry(ctx context.Context, id string) (*archiveEntry, error) {
+	index, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.indexKey(id)),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer index.Body.Close()
+	var entry archiveEntry
+	if err := json.NewDecoder(index.Body).Decode(&entry); err != nil {
+		return nil, fmt.Errorf("failed to read index of archived order %s: %v", id, err)
+	}
+	return &entry, nil
+}
+
+func (a *s3Archive) GetOrder(ctx context.Context, id string) (*Order, error) {
+	entry, err := a.entry(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	out, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(entry.Key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", entry.Offset, entry.Offset+entry.Length-1)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	order := &Order{}
+	if err := json.NewDecoder(out.Body).Decode(order); err != nil {
+		return nil, fmt.Errorf("failed to read archived order %s: %v", id, err)
+	}
+	return order, nil
+}
+
+// CustomerOrderIDs lists the customer index objects, the orders archived
+// before they were written are not found
+func (a *s3Archive) CustomerOrderIDs(ctx context.Context, customerID string) ([]string, error) {
+	var ids []string
+	pages := s3.NewListObjectsV2Paginator(a.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(a.customerPrefix(customerID)),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the archived orders of customer %s: %v", customerID, err)
+		}
+		for _, object := range page.Contents {
+			ids = append(ids, strings.TrimSuffix(path.Base(aws.ToString(object.Key)), ".json"))
+		}
+	}
+	return ids, nil
+}
+
+// ReplaceOrder rewrites the batch object of the order with its line replaced,
+// padded with spaces to its length so the index objects of the batch still
+// locate their lines. The replacement can not be longer than the order, and
+// two replacements within one batch at the same time may lose one.
+func (a *s3Archive) ReplaceOrder(ctx context.Context, order *Order) error {
+	entry, err := a.entry(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	if int64(len(line)) > entry.Length {
+		return fmt.Errorf("archived order %s can not be replaced by a longer one", order.ID)
+	}
+
+	out, err := a.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(entry.Key),
+	})
+	if err != nil {
+		return err
+	}
+	batch, err := io.ReadAll(out.Body)
+	out.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read archive %s: %v", entry.Key, err)
+	}
+	if entry.Offset+entry.Length > int64(len(batch)) {
+		return fmt.Errorf("archive %s does not hold order %s", entry.Key, order.ID)
+	}
+	copy(batch[entry.Offset:], line)
+	copy(batch[entry.Offset+int64(len(line)):entry.Offset+entry.Length], bytes.Repeat([]byte(" "), int(entry.Length)-len(line)))
+
+	_, err = a.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(a.bucket),
+		Key:         aws.String(entry.Key),
+		Body:        bytes.NewReader(batch),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write archive %s: %v", entry.Key, err)
+	}
+	return nil
+}
+
+// archivedRepository reads the orders missing from the repository through from
+// the archive. Archived orders are read-only.
+type archivedRepository struct {
+	Repository
+	archive Archive
+}
+
+// NewArchivedRepository returns repo falling back to archive for the orders it does not hold
+func NewArchivedRepository(repo Repository, archive Archive) Repository {
+	return &archivedRepository{Repository: repo, archive: archive}
+}
+
+// Unwrap returns the repository in front of the archive
+func (a *archivedRepository) Unwrap() Repository {
+	return a.Repository
+}
+
+func (a *archivedRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := a.Repository.GetOrder(ctx, id)
+	if errors.Is(err, ErrOrderNotFound) {
+		return a.archive.GetOrder(ctx, id)
+	}
+	return order, err
+}
+
+func (a *archivedRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	if order.ArchivedAt != nil {
+		return ErrOrderArchived
+	}
+	return a.Repository.UpdateOrder(ctx, order)
+}
+
+// BatchGetOrders reads the orders missing from the repository from the archive
+func (a *archivedRepository) BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error) {
+	orders, err := batchGetOrders(ctx, a.Repository, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, ok := orders[id]; ok {
+			continue
+		}
+		order, err := a.archive.GetOrder(ctx, id)
+		if errors.Is(err, ErrOrderNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		orders[id] = order
+	}
+	return orders, nil
+}
+
+// BatchCreateOrders keeps the bulk operation of the decorated repository
+func (a *archivedRepository) BatchCreateOrders(ctx context.Context, orders []*Order) []error {
+	return batchCreateOrders(ctx, a.Repository, orders)
+}
+
+// SearchOrders keeps the native search of the decorated repository, archived
+// orders are not searched
+func (a *archivedRepository) SearchOrders(ctx context.Context, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error) {
+	return searchOrders(ctx, a.Repository, query, limit, pageToken)
+}
+
+// findArchive returns the archive repo reads orders through from
+func findArchive(repo Repository) (Archive, bool) {
+	var archive Archive
+	found := eachLayer(repo, func(r Repository) bool {
+		a, ok := r.(*archivedRepository)
+		if ok {
+			archive = a.archive
+		}
+		return ok
+	})
+	return archive, found
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// MaxBatchSize is the maximum number of orders or ids in one batch request
+const MaxBatchSize = 100
+
+// batchCreateRequest is the body of BatchCreateOrders
+type batchCreateRequest struct {
+	Orders []createOrderRequest `json:"orders"`
+}
+
+// batchCreateResult is the outcome of one order of a batch create, in request order
+type batchCreateResult struct {
+	Index  int       `json:"index"`
+	Status int       `json:"status"`
+	Order  *Order    `json:"order,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Code   ErrorCode `json:"code,omitempty"`
+}
+
+// batchStatusRequest is the body of BatchOrderStatus
+type batchStatusRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// batchStatusResult is the status of one order of a batch status query, in request order
+type batchStatusResult struct {
+	ID     string               `json:"id"`
+	Status int                  `json:"status"`
+	Order  *orderStatusResponse `json:"order,omitempty"`
+	Error  string               `json:"error,omitempty"`
+	Code   ErrorCode            `json:"code,omitempty"`
+}
+
+type batchResponse struct {
+	Results interface{} `json:"results"`
+}
+
+func checkBatchSize(n int) error {
+	if n == 0 {
+		return &ValidationError{Field: "batch", Reason: "is empty"}
+	}
+	if n > MaxBatchSize {
+		return &ValidationError{Field: "batch", Reason: fmt.Sprintf("has %d entries, the maximum is %d", n, MaxBatchSize)}
+	}
+	return nil
+}
+
+// BatchCreateOrders creates up to MaxBatchSize orders and reports the outcome of each.
+// The response is 200 even when some orders failed, see the per item status.
+func BatchCreateOrders(w http.ResponseWriter, r *http.Request) {
+	var req batchCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := checkBatchSize(len(req.Orders)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := make([]batchCreateResult, len(req.Orders))
+	var valid []*Order
+	var validIndex []int
+	for i := range req.Orders {
+		results[i].Index = i
+		order, err := req.Orders[i].newOrder(r.Context())
+		if err != nil {
+			results[i].Status, results[i].Error, results[i].Code = http.StatusBadRequest, err.Error(), CodeValidationFailed
+			continue
+		}
+		valid = append(valid, order)
+		validIndex = append(validIndex, i)
+	}
+
+	errs := batchCreateOrders(r.Context(), RepositoryFromContext(r.Context()), valid)
+	for j, err := range errs {
+		i := validIndex[j]
+		if err != nil {
+			LoggerFromContext(r.Context()).Errorf("batch create of order %d failed: %v", i, err)
+			results[i].Status, results[i].Error, results[i].Code = http.StatusInternalServerError, "internal error", CodeInternal
+			continue
+		}
+		results[i].Status, results[i].Order = http.StatusCreated, valid[j]
+	}
+
+	LoggerFromContext(r.Context()).Infof("batch created %d of %d orders", countCreated(results), len(results))
+	writeJSON(w, r, http.StatusOK, &batchResponse{Results: results})
+}
+
+func countCreated(results []batchCreateResult) int {
+	n := 0
+	for _, result := range results {
+		if result.Status == http.StatusCreated {
+			n++
+		}
+	}
+	return n
+}
+
+// BatchOrderStatus returns the status of up to MaxBatchSize orders
+func BatchOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var req batchStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := checkBatchSize(len(req.IDs)); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	orders, err := batchGetOrders(r.Context(), RepositoryFromContext(r.Context()), req.IDs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := make([]batchStatusResult, len(req.IDs))
+	for i, id := range req.IDs {
+		results[i].ID = id
+		order, ok := orders[id]
+		if !ok {
+			results[i].Status, results[i].Error, results[i].Code = http.StatusNotFound, ErrOrderNotFound.Error(), CodeOrderNotFound
+			continue
+		}
+		results[i].Status = http.StatusOK
+		results[i].Order = &orderStatusResponse{ID: order.ID, Status: order.Status, StatusText: statusText(r.Context(), order.Status), UpdatedAt: order.UpdatedAt}
+	}
+	writeJSON(w, r, http.StatusOK, &batchResponse{Results: results})
+}
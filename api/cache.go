@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// Cache stores serialized values with an expiry
+type Cache interface {
+	// Get returns the value of key and whether it was found
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// redisCache is a Cache backed by redis
+type redisCache struct {
+	client *redis.Client
+}
+
+// NewRedisCache returns a cache in the redis server configured in cfg
+func NewRedisCache(cfg *config.CacheConfig) Cache {
+	return &redisCache{client: redis.NewClient(&redis.Options{
+		Addr:     cfg.RedisAddress,
+		Password: cfg.RedisPassword,
+		DB:       cfg.RedisDB,
+	})}
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return c.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, key).Err()
+}
+
+// cachedRepository reads orders through a cache and invalidates them on every write.
+// Cache failures are logged and fall back to the repository.
+type cachedRepository struct {
+	Repository
+	cache Cache
+	ttl   time.Duration
+}
+
+// NewCachedRepository returns repo with GetOrder served from cache for up to ttl
+func NewCachedRepository(repo Repository, cache Cache, ttl time.Duration) Repository {
+	return &cachedRepository{Repository: repo, cache: cache, ttl: ttl}
+}
+
+// Unwrap returns the cached repository
+func (c *cachedRepository) Unwrap() Repository {
+	return c.Repository
+}
+
+func orderCacheKey(id string) string {
+	return "order:" + id
+}
+
+// GetOrder reads through the cache, except under an order lock, where the
+// change of the previous holder is read from the repository
+func (c *cachedRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	if lockTokenFromContext(ctx) > 0 {
+		return c.Repository.GetOrder(ctx, id)
+	}
+	data, found, err := c.cache.Get(ctx, orderCacheKey(id))
+	switch {
+	case err != nil:
+		cacheRequests.WithLabelValues("error").Inc()
+		repositoryLogger(ctx).Warnf("order cache get failed: %v", err)
+	case found:
+		order := &Order{}
+		if err := json.Unmarshal(data, order); err == nil {
+			cacheRequests.WithLabelValues("hit").Inc()
+			return order, nil
+		}
+		cacheRequests.WithLabelValues("error").Inc()
+	default:
+		cacheRequests.WithLabelValues("miss").Inc()
+	}
+
+	order, err := c.Repository.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err := json.Marshal(order); err == nil {
+		if err := c.cache.Set(ctx, orderCacheKey(id), data, c.ttl); err != nil {
+			repositoryLogger(ctx).Warnf("order cache set failed: %v", err)
+		}
+	}
+	return order, nil
+}
+
+func (c *cachedRepository) invalidate(ctx context.Context, id string) {
+	if err := c.cache.Delete(ctx, orderCacheKey(id)); err != nil {
+		repositoryLogger(ctx).Warnf("order cache invalidation of %s failed: %v", id, err)
+	}
+}
+
+func (c *cachedRepository) CreateOrder(ctx context.Context, order *Order) error {
+	err := c.Repository.CreateOrder(ctx, order)
+	c.invalidate(ctx, order.ID)
+	return err
+}
+
+func (c *cachedRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	err := c.Repository.UpdateOrder(ctx, order)
+	c.invalidate(ctx, order.ID)
+	return err
+}
+
+func (c *cachedRepository) DeleteOrder(ctx context.Context, id string) error {
+	err := c.Repository.DeleteOrder(ctx, id)
+	c.invalidate(ctx, id)
+	return err
+}
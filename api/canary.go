@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"strconv"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareCanary is the factory name of the canary middleware
+const MiddlewareCanary = "canary"
+
+// the variants of the canary metrics
+const (
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+// canaryVariantHeader names the implementation that answered a request of a
+// route with a canary
+const canaryVariantHeader = "X-Canary-Variant"
+
+// canaryHandlers are the alternate implementations of the handlers of routes
+// by the name of their route, rolled out by canary.routes
+var canaryHandlers = map[string]http.HandlerFunc{
+	"CreateOrder": CreateOrderCanary,
+}
+
+// Canary sends the share of the requests of a route set in canary.routes, and
+// those asking for it with the canary header, to the alternate implementation
+// of its handler in canaryHandlers, and counts the requests by variant. It has
+// to be the last middleware as the canary answers in place of the route.
+type Canary struct {
+	store *config.Store
+}
+
+// NewCanary returns the canary middleware following the canary settings in
+// store
+func NewCanary(store *config.Store) *Canary {
+	return &Canary{store: store}
+}
+
+// variant returns the variant of the request r of a route rolled out to
+// percent of the requests
+func (c *Canary) variant(r *http.Request, cfg *config.CanaryConfig, percent float64) string {
+	if cfg.Header != "" {
+		if value := r.Header.Get(cfg.Header); value != "" {
+			if canary, err := strconv.ParseBool(value); err == nil {
+				if canary {
+					return variantCanary
+				}
+				return variantStable
+			}
+		}
+	}
+	if percent > 0 && rand.Float64()*100 < percent {
+		return variantCanary
+	}
+	return variantStable
+}
+
+func (c *Canary) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	name, ok := RouteName(r)
+	if !ok {
+		next(w, r)
+		return
+	}
+	handler, ok := canaryHandlers[name]
+	if !ok {
+		next(w, r)
+		return
+	}
+	cfg := c.store.Current().Canary
+	percent, ok := cfg.Routes[name]
+	if !ok {
+		next(w, r)
+		return
+	}
+
+	variant := c.variant(r, &cfg, percent)
+	w.Header().Set(canaryVariantHeader, variant)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	if variant == variantCanary {
+		handler(sw, r)
+	} else {
+		next(sw, r)
+	}
+	canaryRequests.WithLabelValues(name, variant, strconv.Itoa(sw.status)).Inc()
+}
+
+// CreateOrderCanary is the rewrite of CreateOrder without the grpc gateway. It
+// takes the whole createOrderRequest, tenders, purchase order and priority
+// included, and answers with the order as the other hand written routes do.
+func CreateOrderCanary(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req createOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	order, err := createOrder(ctx, RepositoryFromContext(ctx), &req, "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	if order.DuplicateOf != "" {
+		w.Header().Set("X-Duplicate-Of", order.DuplicateOf)
+	}
+	writeJSON(w, r, http.StatusCreated, order)
+}
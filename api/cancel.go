@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/money"
+)
+
+// CancelReason is the reason code of a cancellation
+type CancelReason string
+
+const (
+	CancelCustomerRequest CancelReason = "customer_request"
+	CancelPaymentFailed   CancelReason = "payment_failed"
+	CancelOutOfStock      CancelReason = "out_of_stock"
+	CancelFraudSuspected  CancelReason = "fraud_suspected"
+	CancelDuplicate       CancelReason = "duplicate"
+	CancelOther           CancelReason = "other"
+)
+
+var cancelReasons = map[CancelReason]bool{
+	CancelCustomerRequest: true,
+	CancelPaymentFailed:   true,
+	CancelOutOfStock:      true,
+	CancelFraudSuspected:  true,
+	CancelDuplicate:       true,
+	CancelOther:           true,
+}
+
+// maxCancelNoteLength is the longest note accepted with a cancellation
+const maxCancelNoteLength = 500
+
+// RefundStatus is the state of the refund of a cancelled order
+type RefundStatus string
+
+const (
+	// RefundNone marks a cancellation of an order that was not paid
+	RefundNone     RefundStatus = "none"
+	RefundPending  RefundStatus = "pending"
+	RefundRefunded RefundStatus = "refunded"
+	// RefundFailed marks a refund that is attempted again when the order is cancelled again
+	RefundFailed RefundStatus = "failed"
+)
+
+// RefundHook refunds amount of the payment of order, all of it for a cancelled
+// order and part of it for a return. A refund may be requested again when an
+// earlier call failed, calls with the same idempotency key refund only once.
+type RefundHook interface {
+	Refund(ctx context.Context, order *Order, amount money.Money, idempotencyKey string) error
+}
+
+// logRefundHook only logs refunds, it is used until a payment provider is configured
+type logRefundHook struct{}
+
+func (logRefundHook) Refund(ctx context.Context, order *Order, amount money.Money, idempotencyKey string) error {
+	LoggerFromContext(ctx).Infof("refund of %s for order %s", amount, order.ID)
+	return nil
+}
+
+type refundHookKey struct{}
+
+// WithRefundHook returns a copy of ctx carrying hook
+func WithRefundHook(ctx context.Context, hook RefundHook) context.Context {
+	return context.WithValue(ctx, refundHookKey{}, hook)
+}
+
+// RefundHookFromContext returns the refund hook stored in ctx, falling back to logging refunds
+func RefundHookFromContext(ctx context.Context) RefundHook {
+	if hook, ok := ctx.Value(refundHookKey{}).(RefundHook); ok && hook != nil {
+		return hook
+	}
+	return logRefundHook{}
+}
+
+// cancelOrderRequest is the body of CancelOrder
+type cancelOrderRequest struct {
+	Reason CancelReason `json:"reason"`
+	Note   string       `json:"note,omitempty"`
+}
+
+func (req *cancelOrderRequest) validate() error {
+	if !cancelReasons[req.Reason] {
+		return &ValidationError{Field: "reason", Reason: fmt.Sprintf("unknown reason code %q", req.Reason)}
+	}
+	if len(req.Note) > maxCancelNoteLength {
+		return &ValidationError{Field: "note", Reason: fmt.Sprintf("must have at most %d characters", maxCancelNoteLength)}
+	}
+	return nil
+}
+
+// CancelOrder cancels the order named in the path with the reason code and note
+// of the body and refunds it if it was paid. Orders that have shipped can not be
+// cancelled; cancelling a cancelled order retries a failed refund.
+func CancelOrder(w http.ResponseWriter, r *http.Request) {
+	var req cancelOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+
+	if err := req.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["orderId"]
+	ctx, unlock, err := lockOrder(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, id)
+	if err == nil {
+		err = checkPreconditions(r, order)
+	}
+	if err == nil {
+		order, err = cancelLockedOrder(withPreconditions(ctx, r), repo, order, &req)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	writeJSON(w, r, http.StatusOK, order)
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/omnom-nom/apiserver"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareCapacity is the factory name of the middleware attributing the
+// DynamoDB capacity consumed by requests to their routes
+const MiddlewareCapacity = "capacity"
+
+const (
+	capacityRead  = "read"
+	capacityWrite = "write"
+
+	// backgroundRoute is the route of the calls made outside of requests, by
+	// the workers and jobs
+	backgroundRoute = "background"
+	// unmatchedRoute is the route of the requests matching none
+	unmatchedRoute = "unmatched"
+)
+
+type capacityRouteKey struct{}
+
+// withCapacityRoute returns a copy of ctx whose DynamoDB calls consume
+// capacity for route
+func withCapacityRoute(ctx context.Context, route string) context.Context {
+	return context.WithValue(ctx, capacityRouteKey{}, route)
+}
+
+// capacityRouteFromContext returns the route the DynamoDB calls of ctx
+// consume capacity for, backgroundRoute outside of requests
+func capacityRouteFromContext(ctx context.Context) string {
+	if route, ok := ctx.Value(capacityRouteKey{}).(string); ok {
+		return route
+	}
+	return backgroundRoute
+}
+
+// CapacityRoutes gives every request the name of its route, which the
+// capacity consumed by its DynamoDB calls is attributed to
+type CapacityRoutes struct {
+	routes *routeMatcher
+}
+
+// NewCapacityRoutes returns the middleware naming the routes of the requests
+func NewCapacityRoutes(routes map[string][]apiserver.Route) *CapacityRoutes {
+	return &CapacityRoutes{routes: newRouteMatcher(routes)}
+}
+
+func (c *CapacityRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	route, _, ok := c.routes.match(r)
+	if !ok {
+		route = unmatchedRoute
+	}
+	next(w, r.WithContext(withCapacityRoute(r.Context(), route)))
+}
+
+// capacityKey is what consumed capacity is added up by
+type capacityKey struct {
+	route     string
+	operation string
+	table     string
+}
+
+// capacityUnits are the read and write units consumed for a key
+type capacityUnits struct {
+	read  float64
+	write float64
+}
+
+// capacityTotals adds up the capacity consumed by the DynamoDB calls of the
+// instance since it started or was reset
+type capacityTotals struct {
+	mu    sync.Mutex
+	since time.Time
+	units map[capacityKey]*capacityUnits
+}
+
+// consumedTotals is the capacity consumed by the calls of the instance, alongside
+// the capacityConsumed metric which outlives the instance
+var consumedTotals = &capacityTotals{since: time.Now(), units: make(map[capacityKey]*capacityUnits)}
+
+func (t *capacityTotals) add(key capacityKey, kind string, units float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total, ok := t.units[key]
+	if !ok {
+		total = &capacityUnits{}
+		t.units[key] = total
+	}
+	if kind == capacityRead {
+		total.read += units
+	} else {
+		total.write += units
+	}
+}
+
+// snapshot returns a copy of the totals and the time they were started at
+func (t *capacityTotals) snapshot() (time.Time, map[capacityKey]capacityUnits) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	units := make(map[capacityKey]capacityUnits, len(t.units))
+	for key, total := range t.units {
+		units[key] = *total
+	}
+	return t.since, units
+}
+
+func (t *capacityTotals) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.since = time.Now()
+	t.units = make(map[capacityKey]*capacityUnits)
+}
+
+// addCapacityMiddleware adds the middleware asking every DynamoDB call of the
+// client for its consumed capacity and adding it up by route, operation and
+// table
+func addCapacityMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordCapacity", recordCapacity), middleware.After)
+}
+
+func recordCapacity(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	returnConsumedCapacity(in.Parameters)
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	kind := capacityWrite
+	if isReadInput(in.Parameters) {
+		kind = capacityRead
+	}
+	route := capacityRouteFromContext(ctx)
+	operation := middleware.GetOperationName(ctx)
+	for _, c := range consumedCapacities(out.Result) {
+		if c.CapacityUnits == nil {
+			continue
+		}
+		table := aws.ToString(c.TableName)
+		capacityConsumed.WithLabelValues(route, operation, table, kind).Add(*c.CapacityUnits)
+		consumedTotals.add(capacityKey{route: route, operation: operation, table: table}, kind, *c.CapacityUnits)
+	}
+	return out, metadata, err
+}
+
+// capacityUsage is the capacity consumed for a route, operation and table,
+// those the usage is not grouped by are left out
+type capacityUsage struct {
+	Route      string  `json:"route,omitempty"`
+	Operation  string  `json:"operation,omitempty"`
+	Table      string  `json:"table,omitempty"`
+	ReadUnits  float64 `json:"readUnits"`
+	WriteUnits float64 `json:"writeUnits"`
+	Cost       float64 `json:"cost"`
+}
+
+// capacityResponse is the capacity consumed by the instance answering and its
+// estimated cost
+type capacityResponse struct {
+	Since          time.Time        `json:"since"`
+	ReadUnitPrice  float64          `json:"readUnitPrice"`
+	WriteUnitPrice float64          `json:"writeUnitPrice"`
+	ReadUnits      float64          `json:"readUnits"`
+	WriteUnits     float64          `json:"writeUnits"`
+	Cost           float64          `json:"cost"`
+	Usage          []*capacityUsage `json:"usage"`
+}
+
+// capacityCost returns the estimated cost of units at the prices of cfg
+func capacityCost(cfg config.CapacityConfig, read, write float64) float64 {
+	return read/1e6*cfg.ReadUnitPrice + write/1e6*cfg.WriteUnitPrice
+}
+
+// GetCapacity returns the DynamoDB capacity consumed by the instance
+// answering since it started or was reset, with its estimated cost, the
+// costliest first. ?by=route, operation or table groups it by that alone.
+func GetCapacity(w http.ResponseWriter, r *http.Request) {
+	cfg := ConfigFromContext(r.Context()).Capacity
+	if !cfg.Enabled {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	by := r.URL.Query().Get("by")
+	switch by {
+	case "", "route", "operation", "table":
+	default:
+		writeError(w, r, &ValidationError{Field: "by", Reason: "must be route, operation or table"})
+		return
+	}
+
+	since, units := consumedTotals.snapshot()
+	resp := &capacityResponse{Since: since.UTC(), ReadUnitPrice: cfg.ReadUnitPrice, WriteUnitPrice: cfg.WriteUnitPrice, Usage: []*capacityUsage{}}
+	groups := make(map[capacityKey]*capacityUsage)
+	for key, total := range units {
+		switch by {
+		case "route":
+			key = capacityKey{route: key.route}
+		case "operation":
+			key = capacityKey{operation: key.operation}
+		case "table":
+			key = capacityKey{table: key.table}
+		}
+		usage, ok := groups[key]
+		if !ok {
+			usage = &capacityUsage{Route: key.route, Operation: key.operation, Table: key.table}
+			groups[key] = usage
+			resp.Usage = append(resp.Usage, usage)
+		}
+		usage.ReadUnits += total.read
+		usage.WriteUnits += total.write
+		resp.ReadUnits += total.read
+		resp.WriteUnits += total.write
+	}
+	for _, usage := range resp.Usage {
+		usage.Cost = capacityCost(cfg, usage.ReadUnits, usage.WriteUnits)
+	}
+	resp.Cost = capacityCost(cfg, resp.ReadUnits, resp.WriteUnits)
+	sort.Slice(resp.Usage, func(i, j int) bool {
+		a, b := resp.Usage[i], resp.Usage[j]
+		if a.Cost != b.Cost {
+			return a.Cost > b.Cost
+		}
+		if a.Route != b.Route {
+			return a.Route < b.Route
+		}
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		return a.Table < b.Table
+	})
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// ResetCapacity forgets the capacity consumed by the instance answering, the
+// metrics keep counting
+func ResetCapacity(w http.ResponseWriter, r *http.Request) {
+	if !ConfigFromContext(r.Context()).Capacity.Enabled {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	consumedTotals.reset()
+	LoggerFromContext(r.Context()).Info("consumed capacity reset")
+	w.WriteHeader(http.StatusNoContent)
+}
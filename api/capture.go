@@ -0,0 +1,157 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/omnom-nom/order/capture"
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareCapture is the factory name of the middleware recording requests
+// and responses
+const MiddlewareCapture = "capture"
+
+// Capture records the requests of the routes in its configuration and their
+// responses to files, with the credentials and the configured body fields
+// redacted. The admin api, health check and metrics are not recorded.
+type Capture struct {
+	cfg       config.CaptureConfig
+	routes    map[string]bool
+	recorder  *capture.Recorder
+	sanitizer *capture.Sanitizer
+}
+
+// NewCapture returns the middleware recording requests to the directory of cfg
+func NewCapture(cfg config.CaptureConfig) (*Capture, error) {
+	recorder, err := capture.NewRecorder(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{cfg: cfg, recorder: recorder, sanitizer: capture.NewSanitizer(cfg.RedactFields)}
+	if len(cfg.Routes) > 0 {
+		c.routes = make(map[string]bool, len(cfg.Routes))
+		for _, route := range cfg.Routes {
+			c.routes[route] = true
+		}
+	}
+	return c, nil
+}
+
+// isCaptureExemptPath reports whether the requests for path are never recorded
+func isCaptureExemptPath(path string) bool {
+	switch path {
+	case "/" + v1Prefix + "/healthcheck", "/" + v1Prefix + "/metrics":
+		return true
+	}
+	return isAdminPath(path)
+}
+
+func (c *Capture) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	route, ok := RouteName(r)
+	if !ok || isCaptureExemptPath(r.URL.Path) || (c.routes != nil && !c.routes[route]) || rand.Float64() >= c.cfg.SampleRate {
+		next(w, r)
+		return
+	}
+
+	// the body is read up to the limit and handed on whole
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, int64(c.cfg.MaxBodyBytes)+1))
+		if err != nil {
+			writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	cw := &captureWriter{ResponseWriter: w, status: http.StatusOK, limit: c.cfg.MaxBodyBytes}
+	start := time.Now()
+	next(cw, r)
+
+	e := &capture.Exchange{
+		Time:       start.UTC(),
+		RequestID:  RequestIDFromContext(r.Context()),
+		Route:      route,
+		DurationMs: time.Since(start).Milliseconds(),
+		Request: capture.Request{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: c.sanitizer.Header(r.Header),
+		},
+		Response: capture.Response{
+			Status: cw.status,
+			Header: c.sanitizer.Header(cw.Header()),
+		},
+	}
+	e.Request.Body, e.Request.BodyOmitted = c.body(body)
+	e.Response.Body, e.Response.BodyOmitted = c.body(cw.body.Bytes())
+	if cw.overflow {
+		e.Response.Body, e.Response.BodyOmitted = nil, true
+	}
+	if err := c.recorder.Write(e); err != nil {
+		LoggerFromContext(r.Context()).Errorf("failed to record %s %s: %v", r.Method, route, err)
+	}
+}
+
+// body returns the sanitized json of data, and whether a body was left out
+// as it is not json or larger than the limit
+func (c *Capture) body(data []byte) ([]byte, bool) {
+	if len(data) == 0 {
+		return nil, false
+	}
+	if len(data) > c.cfg.MaxBodyBytes {
+		return nil, true
+	}
+	body, ok := c.sanitizer.Body(data)
+	return body, !ok
+}
+
+// captureWriter keeps the status and the body of a response up to limit
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	limit       int
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	if !w.overflow {
+		if w.body.Len()+len(p) > w.limit {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the writer w records, for http.ResponseController
+func (w *captureWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// MiddlewareClientIP is the factory name of the middleware resolving the
+	// address of the client behind trusted proxies
+	MiddlewareClientIP = "client-ip"
+
+	// ForwardedHeader is the standard header of the proxies a request went through
+	ForwardedHeader = "Forwarded"
+	// ForwardedForHeader lists the addresses a request was forwarded for, the client first
+	ForwardedForHeader = "X-Forwarded-For"
+	// RealIPHeader carries the address of the client a proxy saw
+	RealIPHeader = "X-Real-IP"
+)
+
+type clientIPKey struct{}
+
+// WithClientIP returns a copy of ctx carrying the ip address of the client
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIPFromContext returns the ip address of the client stored in ctx, or ""
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// ClientIP resolves the address of the client of a request from the headers of
+// the proxies it went through, as long as they are trusted: walking the
+// addresses from the closest hop, the first one that is not a trusted proxy is
+// the client. The headers of a peer that is not trusted are ignored, it is
+// the client.
+type ClientIP struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIP returns the middleware believing the proxies of trusted
+func NewClientIP(trusted []*net.IPNet) *ClientIP {
+	return &ClientIP{trusted: trusted}
+}
+
+func (c *ClientIP) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(w, r.WithContext(WithClientIP(r.Context(), c.resolve(r))))
+}
+
+// resolve returns the ip address of the client of r
+func (c *ClientIP) resolve(r *http.Request) string {
+	peer := peerIP(r)
+	if ip := net.ParseIP(peer); ip == nil || !c.isTrusted(ip) {
+		return peer
+	}
+
+	hops := forwardedFor(r.Header)
+	if len(hops) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(RealIPHeader))); ip != nil {
+			return ip.String()
+		}
+		return peer
+	}
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHop(hops[i])
+		if ip == nil {
+			// an obfuscated or unknown hop, the closest trusted one is kept
+			break
+		}
+		client = ip.String()
+		if !c.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
+
+func (c *ClientIP) isTrusted(ip net.IP) bool {
+	for _, network := range c.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the addresses a request was forwarded for, the client
+// first, from the Forwarded header or else from X-Forwarded-For
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values(ForwardedHeader) {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(name, "for") {
+					hops = append(hops, strings.Trim(value, `"`))
+				}
+			}
+		}
+	}
+	if len(hops) > 0 {
+		return hops
+	}
+	for _, value := range header.Values(ForwardedForHeader) {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseHop returns the ip address of a hop, which may carry a port, nil for
+// an obfuscated identifier or "unknown"
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	// an ipv6 address in brackets without a port
+	return net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+}
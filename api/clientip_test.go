@@ -0,0 +1,147 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%q) = %v", cidr, err)
+		}
+		networks[i] = network
+	}
+	return networks
+}
+
+func TestClientIPResolve(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8", "fd00::/8")
+	tests := []struct {
+		name   string
+		peer   string
+		header http.Header
+		want   string
+	}{
+		{
+			name: "untrusted peer without headers",
+			peer: "203.0.113.7:5000",
+			want: "203.0.113.7",
+		},
+		{
+			name:   "untrusted peer forwarding for another address",
+			peer:   "203.0.113.7:5000",
+			header: http.Header{ForwardedForHeader: {"198.51.100.1"}},
+			want:   "203.0.113.7",
+		},
+		{
+			name:   "trusted peer forwarding for the client",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedForHeader: {"198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "chain of trusted proxies",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedForHeader: {"198.51.100.1, 10.0.0.9", "10.0.0.3"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "spoofed first hop behind an untrusted hop",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedForHeader: {"192.0.2.66, 198.51.100.1"}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "every hop trusted",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedForHeader: {"10.0.0.4, 10.0.0.3"}},
+			want:   "10.0.0.4",
+		},
+		{
+			name:   "forwarded header with ports and quotes",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedHeader: {`for="[2001:db8::1]:4711";proto=https, for=10.0.0.3`}},
+			want:   "2001:db8::1",
+		},
+		{
+			name: "forwarded header preferred over x-forwarded-for",
+			peer: "10.0.0.2:5000",
+			header: http.Header{
+				ForwardedHeader:    {"for=198.51.100.1"},
+				ForwardedForHeader: {"198.51.100.2"},
+			},
+			want: "198.51.100.1",
+		},
+		{
+			name:   "obfuscated hop keeps the closest trusted one",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{ForwardedHeader: {"for=_hidden, for=10.0.0.3"}},
+			want:   "10.0.0.3",
+		},
+		{
+			name:   "real ip of a trusted peer",
+			peer:   "[fd00::2]:5000",
+			header: http.Header{RealIPHeader: {" 198.51.100.1 "}},
+			want:   "198.51.100.1",
+		},
+		{
+			name:   "invalid real ip",
+			peer:   "10.0.0.2:5000",
+			header: http.Header{RealIPHeader: {"client"}},
+			want:   "10.0.0.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/order/o-1", nil)
+			r.RemoteAddr = tt.peer
+			for name, values := range tt.header {
+				for _, value := range values {
+					r.Header.Add(name, value)
+				}
+			}
+			var got string
+			NewClientIP(trusted).ServeHTTP(httptest.NewRecorder(), r, func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIPFromContext(r.Context())
+			})
+			if got != tt.want {
+				t.Fatalf("client ip = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseHop(t *testing.T) {
+	tests := []struct {
+		hop  string
+		want string
+	}{
+		{hop: "198.51.100.1", want: "198.51.100.1"},
+		{hop: "198.51.100.1:8080", want: "198.51.100.1"},
+		{hop: "2001:db8::1", want: "2001:db8::1"},
+		{hop: "[2001:db8::1]", want: "2001:db8::1"},
+		{hop: "[2001:db8::1]:8080", want: "2001:db8::1"},
+		{hop: "unknown"},
+		{hop: "_hidden"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.hop, func(t *testing.T) {
+			ip := parseHop(tt.hop)
+			if tt.want == "" {
+				if ip != nil {
+					t.Fatalf("parseHop(%q) = %v, want nil", tt.hop, ip)
+				}
+				return
+			}
+			if ip == nil || ip.String() != tt.want {
+				t.Fatalf("parseHop(%q) = %v, want %s", tt.hop, ip, tt.want)
+			}
+		})
+	}
+}
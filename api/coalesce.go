@@ -0,0 +1,175 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"golang.org/x/sync/singleflight"
+)
+
+// MiddlewareCoalescing is the factory name of the middleware coalescing
+// identical concurrent GET requests
+const MiddlewareCoalescing = "coalescing"
+
+// coalescedHeader marks the responses shared from the execution of an
+// identical request
+const coalescedHeader = "X-Coalesced"
+
+// coalescedKeyHeaders are the request headers the responses may vary with,
+// which identical requests have the same values of
+var coalescedKeyHeaders = []string{"Authorization", "X-Api-Key", "X-Tenant-Id", "Accept", "Accept-Language", "If-None-Match", "X-Canary"}
+
+// coalescedExemptRoutes are the GET routes never coalesced, as they stream
+// their response or answer for the instance
+var coalescedExemptRoutes = map[string]bool{
+	"HealthCheck":    true,
+	"Metrics":        true,
+	"ExportOrders":   true,
+	"WatchOrder":     true,
+	"GetOrderStream": true,
+}
+
+// Coalescing runs the handler once for the identical GET requests in flight at
+// the same time, those for the same path and query by the same caller, and
+// answers them all with its response, sparing the database the reads of the
+// retries of the clients when it slows down. The handler runs detached from
+// the request that started it, within the request timeout, so that the others
+// still get the response when its caller goes away.
+type Coalescing struct {
+	group   singleflight.Group
+	routes  map[string]bool
+	headers []string
+	maxBody int
+	timeout time.Duration
+}
+
+// NewCoalescing returns the middleware coalescing requests as set in cfg,
+// keying them on the experiments header too when experiments are enabled
+func NewCoalescing(cfg *config.Config) *Coalescing {
+	c := &Coalescing{
+		headers: coalescedKeyHeaders,
+		maxBody: cfg.Coalescing.MaxBodyBytes,
+		timeout: cfg.Timeouts.Request.Duration,
+	}
+	if cfg.Experiments.Enabled {
+		c.headers = append(append([]string{}, coalescedKeyHeaders...), cfg.Experiments.Header)
+	}
+	if len(cfg.Coalescing.Routes) > 0 {
+		c.routes = make(map[string]bool, len(cfg.Coalescing.Routes))
+		for _, route := range cfg.Coalescing.Routes {
+			c.routes[route] = true
+		}
+	}
+	return c
+}
+
+// key returns the key of the requests identical to r
+func (c *Coalescing) key(r *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s", r.Method, r.URL.Path, r.URL.RawQuery)
+	for _, name := range c.headers {
+		fmt.Fprintf(h, "\x00%q", r.Header.Values(name))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bufferedResponse is the response of a coalesced execution of a handler
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+// writeTo writes the response to w
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.WriteHeader(b.status)
+	_, _ = w.Write(b.body.Bytes())
+}
+
+// coalescedPanic carries the panic of a coalesced execution to its callers
+type coalescedPanic struct {
+	value interface{}
+}
+
+func (c *Coalescing) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	route, ok := RouteName(r)
+	if !ok || r.Method != http.MethodGet || coalescedExemptRoutes[route] || isAdminPath(r.URL.Path) || streamingPaths[r.URL.Path] || (c.routes != nil && !c.routes[route]) {
+		next(w, r)
+		return
+	}
+
+	ctx := r.Context()
+	// leader is set when the request runs the handler for the others, which
+	// singleflight reports as shared too
+	leader := false
+	results := c.group.DoChan(c.key(r), func() (interface{}, error) {
+		leader = true
+		return c.execute(r, next), nil
+	})
+	select {
+	case res := <-results:
+		if p, ok := res.Val.(*coalescedPanic); ok {
+			panic(p.value)
+		}
+		resp := res.Val.(*bufferedResponse)
+		if res.Shared && !leader {
+			if resp.body.Len() > c.maxBody {
+				next(w, r)
+				return
+			}
+			coalescedRequests.WithLabelValues(route).Inc()
+			w.Header().Set(coalescedHeader, "true")
+		}
+		resp.writeTo(w)
+	case <-ctx.Done():
+		// the caller went away, the execution goes on for the others
+	}
+}
+
+// execute runs next for r detached from its caller and returns its response,
+// or the panic of next to raise in the callers
+func (c *Coalescing) execute(r *http.Request, next http.HandlerFunc) (res interface{}) {
+	ctx := context.WithoutCancel(r.Context())
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			res = &coalescedPanic{value: p}
+		}
+	}()
+	resp := &bufferedResponse{header: http.Header{}}
+	next(resp, r.WithContext(ctx))
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp
+}
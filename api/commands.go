@@ -0,0 +1,266 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// order command types
+const (
+	CommandCreate = "create"
+	CommandCancel = "cancel"
+)
+
+// Command is an order command received from the command queue
+type Command struct {
+	Type string `json:"type"`
+	// OrderID names the order of the command. It is optional for create, where it
+	// makes a redelivered command create the order only once.
+	OrderID string `json:"orderId,omitempty"`
+	// Order is the order to create
+	Order *createOrderRequest `json:"order,omitempty"`
+	// Reason is the reason code of a cancel, other when empty
+	Reason CancelReason `json:"reason,omitempty"`
+	Note   string       `json:"note,omitempty"`
+}
+
+// commandHandler executes a command with the repository of the service
+type commandHandler func(ctx context.Context, repo Repository, cmd *Command) error
+
+// commandHandlers maps command types to their handler, a command of another type is dead-lettered
+var commandHandlers = map[string]commandHandler{
+	CommandCreate: func(ctx context.Context, repo Repository, cmd *Command) error {
+		if cmd.Order == nil {
+			return &ValidationError{Field: "order", Reason: "is required"}
+		}
+		_, err := createOrder(ctx, repo, cmd.Order, cmd.OrderID)
+		if errors.Is(err, ErrOrderExists) && cmd.OrderID != "" {
+			// created by an earlier delivery of the command
+			return nil
+		}
+		return err
+	},
+	CommandCancel: func(ctx context.Context, repo Repository, cmd *Command) error {
+		if cmd.OrderID == "" {
+			return &ValidationError{Field: "orderId", Reason: "is required"}
+		}
+		reason := cmd.Reason
+		if reason == "" {
+			reason = CancelOther
+		}
+		_, err := cancelOrder(ctx, repo, cmd.OrderID, &cancelOrderRequest{Reason: reason, Note: cmd.Note})
+		return err
+	},
+}
+
+// errUnknownCommand is returned for commands without a handler
+var errUnknownCommand = errors.New("unknown command type")
+
+// isPermanent reports whether a command failing with err would fail again
+func isPermanent(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr) ||
+		errors.Is(err, errUnknownCommand) ||
+		errors.Is(err, ErrOrderNotFound) ||
+		errors.Is(err, ErrOrderExists) ||
+		errors.Is(err, ErrNotCancellable)
+}
+
+// CommandWorker processes order commands from an SQS queue with a pool of workers.
+// Failed commands are retried by SQS after the visibility timeout, commands that
+// fail permanently or MaxReceives times are moved to the dead letter queue.
+type CommandWorker struct {
+	client *sqs.Client
+	repo   Repository
+	cfg    config.SQSConfig
+	logger logging.Logger
+}
+
+// NewCommandWorker returns a worker for the command queue of cfg executing commands on repo
+func NewCommandWorker(ctx context.Context, cfg *config.Config, repo Repository, logger logging.Logger) (*CommandWorker, error) {
+	awsConfig, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := sqs.NewFromConfig(awsConfig, func(o *sqs.Options) {
+		if cfg.Commands.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Commands.Endpoint)
+		}
+	})
+	return &CommandWorker{
+		client: client,
+		repo:   repo,
+		cfg:    cfg.Commands,
+		logger: logger,
+	}, nil
+}
+
+// Run processes commands until ctx is done and the commands in progress have finished
+func (w *CommandWorker) Run(ctx context.Context) {
+	messages := make(chan types.Message)
+	var wg sync.WaitGroup
+	for i := 0; i < w.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for m := range messages {
+				w.handle(ctx, m)
+			}
+		}()
+	}
+
+	w.receive(ctx, messages)
+	close(messages)
+	wg.Wait()
+}
+
+// receive long polls the queue and hands messages to the workers until ctx is done
+func (w *CommandWorker) receive(ctx context.Context, messages chan<- types.Message) {
+	batch := w.cfg.Concurrency
+	if batch > 10 {
+		// the maximum of one ReceiveMessage call
+		batch = 10
+	}
+
+	for ctx.Err() == nil {
+		out, err := w.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(w.cfg.QueueURL),
+			MaxNumberOfMessages: int32(batch),
+			WaitTimeSeconds:     int32(w.cfg.WaitTime.Seconds()),
+			VisibilityTimeout:   int32(w.cfg.VisibilityTimeout.Seconds()),
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{
+				types.MessageSystemAttributeNameApproximateReceiveCount,
+			},
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			w.logger.Errorf("failed to receive commands: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		for _, m := range out.Messages {
+			select {
+			case messages <- m:
+			case <-ctx.Done():
+				// the message becomes visible again after its timeout
+				return
+			}
+		}
+	}
+}
+
+// handle processes one message and deletes, dead-letters or leaves it for a retry
+func (w *CommandWorker) handle(ctx context.Context, m types.Message) {
+	logger := w.logger.WithField("message_id", aws.ToString(m.MessageId))
+
+	stop := w.extendVisibility(ctx, m.ReceiptHandle)
+	cmd, err := w.process(WithLogger(ctx, logger), m)
+	stop()
+
+	receives, _ := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	switch {
+	case err == nil:
+		commandsProcessed.WithLabelValues(cmd, "ok").Inc()
+		w.delete(ctx, logger, m)
+	case isPermanent(err) || receives >= w.cfg.MaxReceives:
+		commandsProcessed.WithLabelValues(cmd, "dead").Inc()
+		logger.Warnf("dead-lettering %s command after %d attempts: %v", cmd, receives, err)
+		w.deadLetter(ctx, logger, m, err)
+	default:
+		commandsProcessed.WithLabelValues(cmd, "retry").Inc()
+		logger.Warnf("%s command failed, it will be retried: %v", cmd, err)
+	}
+}
+
+// process decodes and executes the command of m and returns its type
+func (w *CommandWorker) process(ctx context.Context, m types.Message) (string, error) {
+	var cmd Command
+	if err := json.Unmarshal([]byte(aws.ToString(m.Body)), &cmd); err != nil {
+		return "invalid", &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	handler, ok := commandHandlers[cmd.Type]
+	if !ok {
+		return "invalid", fmt.Errorf("%w %q", errUnknownCommand, cmd.Type)
+	}
+	return cmd.Type, handler(ctx, w.repo, &cmd)
+}
+
+// extendVisibility keeps the message hidden from other consumers while it is
+// processed, until the returned func is called
+func (w *CommandWorker) extendVisibility(ctx context.Context, receiptHandle *string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(w.cfg.VisibilityTimeout.Duration / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if _, err := w.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          aws.String(w.cfg.QueueURL),
+				ReceiptHandle:     receiptHandle,
+				VisibilityTimeout: int32(w.cfg.VisibilityTimeout.Seconds()),
+			}); err != nil && ctx.Err() == nil {
+				w.logger.Warnf("failed to extend command visibility: %v", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (w *CommandWorker) delete(ctx context.Context, logger logging.Logger, m types.Message) {
+	if _, err := w.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(w.cfg.QueueURL),
+		ReceiptHandle: m.ReceiptHandle,
+	}); err != nil {
+		// the command will be received again, cancel and create with an order id are safe to repeat
+		logger.Errorf("failed to delete command: %v", err)
+	}
+}
+
+// deadLetter moves m to the dead letter queue with the error as a message attribute
+func (w *CommandWorker) deadLetter(ctx context.Context, logger logging.Logger, m types.Message, cause error) {
+	if w.cfg.DeadLetterQueueURL == "" {
+		logger.Errorf("dropping command without a dead letter queue: %s", aws.ToString(m.Body))
+		w.delete(ctx, logger, m)
+		return
+	}
+
+	if _, err := w.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(w.cfg.DeadLetterQueueURL),
+		MessageBody: m.Body,
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"error": {DataType: aws.String("String"), StringValue: aws.String(cause.Error())},
+		},
+	}); err != nil {
+		// keep the command in the queue, it is dead-lettered on its next receive
+		logger.Errorf("failed to dead-letter command: %v", err)
+		return
+	}
+	w.delete(ctx, logger, m)
+}
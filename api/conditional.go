@@ -0,0 +1,101 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// checkPreconditions returns ErrPreconditionFailed unless order meets the
+// preconditions of r: the If-Match header, or without it the
+// If-Unmodified-Since header, as RFC 9110 has it
+func checkPreconditions(r *http.Request, order *Order) error {
+	if r.Header.Get("If-Match") != "" {
+		return checkIfMatch(r, order)
+	}
+	if since, ok := ifUnmodifiedSince(r); ok && modifiedSince(order.UpdatedAt, since) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// hasPreconditions reports whether r has an If-Match or If-Unmodified-Since
+// header
+func hasPreconditions(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-Unmodified-Since") != ""
+}
+
+// ifUnmodifiedSince returns the time of the If-Unmodified-Since header of r,
+// false without one or when it is not an http date, which is ignored
+func ifUnmodifiedSince(r *http.Request) (time.Time, bool) {
+	value := strings.TrimSpace(r.Header.Get("If-Unmodified-Since"))
+	if value == "" {
+		return time.Time{}, false
+	}
+	since, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return since.UTC(), true
+}
+
+// setLastModified sets the Last-Modified header to the updatedAt of an order,
+// the date its changes compare to with If-Unmodified-Since
+func setLastModified(w http.ResponseWriter, updatedAt time.Time) {
+	if !updatedAt.IsZero() {
+		w.Header().Set("Last-Modified", updatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+type unmodifiedSinceKey struct{}
+
+// withPreconditions returns a copy of ctx with the If-Unmodified-Since date
+// of r, when it counts, for the repository to write the order only if it was
+// not modified since
+func withPreconditions(ctx context.Context, r *http.Request) context.Context {
+	if r.Header.Get("If-Match") != "" {
+		return ctx
+	}
+	if since, ok := ifUnmodifiedSince(r); ok {
+		return WithUnmodifiedSince(ctx, since)
+	}
+	return ctx
+}
+
+// WithUnmodifiedSince returns a copy of ctx making the next UpdateOrder or
+// DeleteOrder fail with ErrPreconditionFailed when the stored order was
+// modified after since, to the second
+func WithUnmodifiedSince(ctx context.Context, since time.Time) context.Context {
+	return context.WithValue(ctx, unmodifiedSinceKey{}, since.UTC())
+}
+
+// withoutPreconditions returns a copy of ctx for the writes following the one
+// the preconditions of the request were for
+func withoutPreconditions(ctx context.Context) context.Context {
+	if _, ok := unmodifiedSinceFromContext(ctx); !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, unmodifiedSinceKey{}, nil)
+}
+
+// unmodifiedSinceFromContext returns the date the order written with ctx must
+// not have been modified since, false without one
+func unmodifiedSinceFromContext(ctx context.Context) (time.Time, bool) {
+	since, ok := ctx.Value(unmodifiedSinceKey{}).(time.Time)
+	return since, ok
+}
+
+// modifiedSince reports whether updatedAt is after since, to the second of
+// http dates
+func modifiedSince(updatedAt, since time.Time) bool {
+	return updatedAt.Truncate(time.Second).After(since)
+}
+
+// unmodifiedSinceBound returns the stored updatedAt of the orders not modified
+// since sort before. The dates are stored in UTC as RFC 3339 with the
+// fraction of the seconds trimmed, so the date of the next second without its
+// zone sorts after those of the second since and before.
+func unmodifiedSinceBound(since time.Time) string {
+	return since.Add(time.Second).UTC().Format("2006-01-02T15:04:05")
+}
@@ -0,0 +1,426 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/cron"
+	"github.com/omnom-nom/order/inventory"
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/pricing"
+	"github.com/omnom-nom/order/redact"
+	"github.com/omnom-nom/order/tracking"
+)
+
+const (
+	// MiddlewareInjector is the factory name of the dependency injection middleware
+	MiddlewareInjector = "injector"
+	// RequestIDHeader carries the request id in and out of the service
+	RequestIDHeader = "X-Request-Id"
+	// TenantHeader names the tenant a request is made for, which has to be
+	// the tenant its api key authenticates
+	TenantHeader = "X-Tenant-Id"
+)
+
+// maxRequestIDLength is the longest request id taken from a client
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	dbKey contextKey = iota
+	repositoryKey
+	configKey
+	requestIDKey
+	tenantKey
+)
+
+// Injector places the shared dependencies of the service into every request context
+type Injector struct {
+	repo     Repository
+	logger   logging.Logger
+	config   *config.Store
+	refunds  RefundHook
+	payments *Payments
+	stock    inventory.Client
+	pricing  *pricing.Engine
+	fraud    *FraudScreen
+	router   *Router
+	sagas    *SagaCoordinator
+	carriers map[string]tracking.Carrier
+	jobs     *jobs.Pool
+	members  *cluster.Membership
+	locks    *OrderLocks
+	drain    *Drain
+	slow     *SlowRequests
+	redactor *redact.Redactor
+	tasks    *cron.Runner
+	letters  *DeadLetterQueue
+	sla      *SLAWatchdog
+	tracker  *Tracker
+	docs     *Documents
+	cursors  *PageCursors
+	gateway  http.Handler
+}
+
+// NewInjector returns the middleware injecting repository, logger and the current config into requests
+func NewInjector(repo Repository, logger logging.Logger, store *config.Store) *Injector {
+	if logger == nil {
+		logger = logging.Default().Module(logging.ModuleAPIServer)
+	}
+	return &Injector{repo: repo, logger: logger, config: store}
+}
+
+// WithRefundHook makes the injector give requests hook to refund cancelled orders
+func (i *Injector) WithRefundHook(hook RefundHook) *Injector {
+	i.refunds = hook
+	return i
+}
+
+// WithPayments makes the injector give requests p to take payments of new orders
+func (i *Injector) WithPayments(p *Payments) *Injector {
+	i.payments = p
+	return i
+}
+
+// WithInventory makes the injector give requests client to reserve the stock of new orders
+func (i *Injector) WithInventory(client inventory.Client) *Injector {
+	i.stock = client
+	return i
+}
+
+// WithFraud makes the injector give requests screen to screen new orders
+func (i *Injector) WithFraud(screen *FraudScreen) *Injector {
+	i.fraud = screen
+	return i
+}
+
+// WithRouter makes the injector give requests router to route confirmed orders
+func (i *Injector) WithRouter(router *Router) *Injector {
+	i.router = router
+	return i
+}
+
+// WithSagas makes the injector give requests coordinator to place new orders as sagas
+func (i *Injector) WithSagas(coordinator *SagaCoordinator) *Injector {
+	i.sagas = coordinator
+	return i
+}
+
+// WithPricing makes the injector give requests engine to price orders
+func (i *Injector) WithPricing(engine *pricing.Engine) *Injector {
+	i.pricing = engine
+	return i
+}
+
+// WithCarriers makes the injector give requests the tracking carriers by name
+func (i *Injector) WithCarriers(carriers map[string]tracking.Carrier) *Injector {
+	i.carriers = carriers
+	return i
+}
+
+// WithJobs makes the injector give requests pool to run background jobs
+func (i *Injector) WithJobs(pool *jobs.Pool) *Injector {
+	i.jobs = pool
+	return i
+}
+
+// WithMembership makes the injector give requests the cluster membership
+func (i *Injector) WithMembership(membership *cluster.Membership) *Injector {
+	i.members = membership
+	return i
+}
+
+// WithOrderLocks makes the injector give requests locks to serialize the changes of an order
+func (i *Injector) WithOrderLocks(locks *OrderLocks) *Injector {
+	i.locks = locks
+	return i
+}
+
+// WithDrain makes the injector give requests the drain of the instance
+func (i *Injector) WithDrain(drain *Drain) *Injector {
+	i.drain = drain
+	return i
+}
+
+// WithSlowRequests makes the injector give requests the slow requests of the instance
+func (i *Injector) WithSlowRequests(slow *SlowRequests) *Injector {
+	i.slow = slow
+	return i
+}
+
+// WithRedactor makes the injector give requests r to redact personal data
+func (i *Injector) WithRedactor(r *redact.Redactor) *Injector {
+	i.redactor = r
+	return i
+}
+
+// WithTasks makes the injector give requests the background tasks of the service
+func (i *Injector) WithTasks(tasks *cron.Runner) *Injector {
+	i.tasks = tasks
+	return i
+}
+
+// WithDeadLetters makes the injector give requests the dead letter queue
+func (i *Injector) WithDeadLetters(letters *DeadLetterQueue) *Injector {
+	i.letters = letters
+	return i
+}
+
+// WithSLA makes the injector give requests the sla watchdog
+func (i *Injector) WithSLA(watchdog *SLAWatchdog) *Injector {
+	i.sla = watchdog
+	return i
+}
+
+// WithTracker makes the injector give requests tracker to serve the public
+// tracking of orders
+func (i *Injector) WithTracker(tracker *Tracker) *Injector {
+	i.tracker = tracker
+	return i
+}
+
+// WithPageCursors makes the injector give requests cursors to seal the page
+// tokens of the order listings
+func (i *Injector) WithPageCursors(cursors *PageCursors) *Injector {
+	i.cursors = cursors
+	return i
+}
+
+// WithDocuments makes the injector give requests docs to render the documents
+// of orders
+func (i *Injector) WithDocuments(docs *Documents) *Injector {
+	i.docs = docs
+	return i
+}
+
+// WithGateway makes the injector give requests the handler of the routes
+// generated from order.proto
+func (i *Injector) WithGateway(gateway http.Handler) *Injector {
+	i.gateway = gateway
+	return i
+}
+
+func (i *Injector) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	requestID := r.Header.Get(RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = newID()
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+
+	cfg := i.config.Current()
+	tenant, ok := requestTenant(&cfg.Tenants, r.Header.Get(APIKeyHeader), r.Header.Get(TenantHeader))
+	if !ok {
+		writeErrorCode(w, r, CodeTenantForbidden, fmt.Sprintf("the api key of the request does not authenticate the tenant of the %s header", TenantHeader))
+		return
+	}
+
+	ctx := r.Context()
+	ctx = WithRepository(ctx, i.repo)
+	if p, ok := i.repo.(dbProvider); ok {
+		ctx = WithDb(ctx, p.Db())
+	}
+	ctx = WithConfig(ctx, cfg)
+	ctx = WithConfigStore(ctx, i.config)
+	if i.refunds != nil {
+		ctx = WithRefundHook(ctx, i.refunds)
+	}
+	if i.payments != nil {
+		ctx = WithPayments(ctx, i.payments)
+	}
+	if i.stock != nil {
+		ctx = WithInventory(ctx, i.stock)
+	}
+	if i.pricing != nil {
+		ctx = WithPricing(ctx, i.pricing)
+	}
+	if i.fraud != nil {
+		ctx = WithFraud(ctx, i.fraud)
+	}
+	if i.router != nil {
+		ctx = WithRouter(ctx, i.router)
+	}
+	if i.sagas != nil {
+		ctx = WithSagas(ctx, i.sagas)
+	}
+	if i.carriers != nil {
+		ctx = WithCarriers(ctx, i.carriers)
+	}
+	if i.jobs != nil {
+		ctx = WithJobs(ctx, i.jobs)
+	}
+	if i.members != nil {
+		ctx = WithMembership(ctx, i.members)
+	}
+	if i.locks != nil {
+		ctx = WithOrderLocks(ctx, i.locks)
+	}
+	if i.slow != nil {
+		ctx = WithSlowRequests(ctx, i.slow)
+	}
+	if i.redactor != nil {
+		ctx = WithRedactor(ctx, i.redactor)
+	}
+	if i.tasks != nil {
+		ctx = WithTasks(ctx, i.tasks)
+	}
+	if i.letters != nil {
+		ctx = WithDeadLetters(ctx, i.letters)
+	}
+	if i.sla != nil {
+		ctx = WithSLA(ctx, i.sla)
+	}
+	if i.tracker != nil {
+		ctx = WithTracker(ctx, i.tracker)
+	}
+	if i.docs != nil {
+		ctx = WithDocuments(ctx, i.docs)
+	}
+	if i.cursors != nil {
+		ctx = WithPageCursors(ctx, i.cursors)
+	}
+	if i.gateway != nil {
+		ctx = withGateway(ctx, i.gateway)
+	}
+	if i.drain != nil {
+		ctx = WithDrain(ctx, i.drain)
+		if i.drain.Draining() {
+			// clients open their next connection to an instance in rotation
+			w.Header().Set("Connection", "close")
+		}
+	}
+	ctx = WithRequestID(ctx, requestID)
+	ctx = WithClientIP(ctx, clientIP(r))
+	fields := logging.Fields{logging.RequestIDKey: requestID, logging.ClientIPKey: clientIP(r)}
+	if tenant != "" {
+		fields[logging.TenantIDKey] = tenant
+		ctx = WithTenant(ctx, tenant)
+	}
+	// the routes of one order log its id
+	if id := mux.Vars(r)["orderId"]; id != "" {
+		fields[logging.OrderIDKey] = id
+	}
+	ctx = WithLogger(ctx, i.logger.WithFields(fields))
+
+	next(w, r.WithContext(ctx))
+}
+
+// validRequestID reports whether id, taken from a client, is short and of
+// letters, digits, dots, dashes, underscores and colons only, so that it can
+// be logged and sent back as it is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '-', c == '_', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestTenant returns the tenant the api key of a request authenticates,
+// "" for none, and false when the request claims another tenant
+func requestTenant(tenants *config.TenantsConfig, apiKey, claimed string) (string, bool) {
+	tenant := tenants.Tenant(apiKey)
+	return tenant, claimed == "" || claimed == tenant
+}
+
+// newID returns a random 128 bit hex id
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithDb returns a copy of ctx carrying db
+func WithDb(ctx context.Context, db *ApiDb) context.Context {
+	return context.WithValue(ctx, dbKey, db)
+}
+
+// DbFromContext returns the db stored in ctx, or nil
+func DbFromContext(ctx context.Context) *ApiDb {
+	db, _ := ctx.Value(dbKey).(*ApiDb)
+	return db
+}
+
+// dbProvider is implemented by repositories backed by an ApiDb
+type dbProvider interface {
+	Db() *ApiDb
+}
+
+// WithRepository returns a copy of ctx carrying repo
+func WithRepository(ctx context.Context, repo Repository) context.Context {
+	return context.WithValue(ctx, repositoryKey, repo)
+}
+
+// RepositoryFromContext returns the repository stored in ctx, or nil
+func RepositoryFromContext(ctx context.Context) Repository {
+	repo, _ := ctx.Value(repositoryKey).(Repository)
+	return repo
+}
+
+// WithLogger returns a copy of ctx carrying logger
+func WithLogger(ctx context.Context, logger logging.Logger) context.Context {
+	return logging.NewContext(ctx, logger)
+}
+
+// LoggerFromContext returns the logger stored in ctx, falling back to the default logger
+func LoggerFromContext(ctx context.Context) logging.Logger {
+	return logging.FromContext(ctx)
+}
+
+// repositoryLogger returns the logger of ctx for the repository module
+func repositoryLogger(ctx context.Context) logging.Logger {
+	return LoggerFromContext(ctx).Module(logging.ModuleRepository)
+}
+
+// WithConfig returns a copy of ctx carrying config
+func WithConfig(ctx context.Context, cfg *config.Config) context.Context {
+	return context.WithValue(ctx, configKey, cfg)
+}
+
+// ConfigFromContext returns the config stored in ctx, falling back to the defaults
+func ConfigFromContext(ctx context.Context) *config.Config {
+	if cfg, ok := ctx.Value(configKey).(*config.Config); ok && cfg != nil {
+		return cfg
+	}
+	return config.Default()
+}
+
+// WithRequestID returns a copy of ctx carrying the request id
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestIDFromContext returns the request id stored in ctx, or ""
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithTenant returns a copy of ctx carrying the tenant the request is made for,
+// which the caller has authenticated
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// TenantFromContext returns the tenant stored in ctx, or ""
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
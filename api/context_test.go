@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// injectedRequest serves a request with header through an injector of cfg and
+// returns the response and the context the next handler got, nil when refused
+func injectedRequest(t *testing.T, cfg *config.Config, header http.Header) (*httptest.ResponseRecorder, *http.Request) {
+	t.Helper()
+	injector := NewInjector(NewMemoryRepository(), nil, config.NewStore(cfg, nil))
+	r := httptest.NewRequest(http.MethodGet, "/"+v1Prefix+"/list", nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	var served *http.Request
+	injector.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {
+		served = r
+	})
+	return w, served
+}
+
+func TestInjectorRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		kept bool
+	}{
+		{name: "uuid", id: "0f8fad5b-d9cb-469f-a165-70867728950e", kept: true},
+		{name: "dotted with colons", id: "lb:edge-1.req_42", kept: true},
+		{name: "none", id: ""},
+		{name: "newline", id: "abc\nlevel=error msg=forged"},
+		{name: "space", id: "abc def"},
+		{name: "too long", id: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, served := injectedRequest(t, config.Default(), http.Header{RequestIDHeader: {tt.id}})
+			if served == nil {
+				t.Fatalf("request refused with %d", w.Code)
+			}
+			got := w.Header().Get(RequestIDHeader)
+			if got != RequestIDFromContext(served.Context()) {
+				t.Errorf("response id %q, context id %q", got, RequestIDFromContext(served.Context()))
+			}
+			if tt.kept && got != tt.id {
+				t.Errorf("request id = %q, want %q", got, tt.id)
+			}
+			if !tt.kept && (got == tt.id || !validRequestID(got)) {
+				t.Errorf("request id = %q, want a new one", got)
+			}
+		})
+	}
+}
+
+func TestInjectorTenant(t *testing.T) {
+	cfg := config.Default()
+	cfg.Tenants.Keys = map[string][]string{
+		"acme":   {"acme-key-0123456789", "acme-key-rotated-01"},
+		"globex": {"globex-key-0123456789"},
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		tenant string
+		status int
+	}{
+		{name: "no key", status: http.StatusOK},
+		{name: "key of a tenant", header: http.Header{APIKeyHeader: {"acme-key-0123456789"}}, tenant: "acme", status: http.StatusOK},
+		{name: "second key of a tenant", header: http.Header{APIKeyHeader: {"acme-key-rotated-01"}}, tenant: "acme", status: http.StatusOK},
+		{name: "unknown key", header: http.Header{APIKeyHeader: {"made-up-key-0123456"}}, status: http.StatusOK},
+		{name: "claims its own tenant", header: http.Header{APIKeyHeader: {"globex-key-0123456789"}, TenantHeader: {"globex"}}, tenant: "globex", status: http.StatusOK},
+		{name: "claims another tenant", header: http.Header{APIKeyHeader: {"globex-key-0123456789"}, TenantHeader: {"acme"}}, status: http.StatusForbidden},
+		{name: "claims a tenant without a key", header: http.Header{TenantHeader: {"acme"}}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, served := injectedRequest(t, cfg, tt.header)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if served == nil {
+				if tt.status == http.StatusOK {
+					t.Fatal("request refused")
+				}
+				return
+			}
+			if got := TenantFromContext(served.Context()); got != tt.tenant {
+				t.Errorf("tenant = %q, want %q", got, tt.tenant)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/payments"
+)
+
+// maxPurchaseOrder bounds the length of purchase order numbers
+const maxPurchaseOrder = 64
+
+// PaymentTerms are the net terms of the invoice of an order paid on account
+type PaymentTerms struct {
+	// Days is the number of days after the order its invoice is due
+	Days  int       `json:"days" dynamodbav:"days"`
+	DueAt time.Time `json:"dueAt" dynamodbav:"dueAt"`
+}
+
+// purchaseOrderPatterns caches the compiled purchase order patterns of the
+// configuration
+var purchaseOrderPatterns sync.Map
+
+// validatePurchaseOrder checks the purchase order number of a new order against
+// the pattern of the configuration of ctx
+func validatePurchaseOrder(ctx context.Context, number string) error {
+	if number == "" {
+		return nil
+	}
+	if len(number) > maxPurchaseOrder {
+		return &ValidationError{Field: "purchaseOrder", Reason: fmt.Sprintf("must be at most %d characters", maxPurchaseOrder)}
+	}
+	pattern := ConfigFromContext(ctx).Payments.Credit.PurchaseOrderPattern
+	if pattern == "" {
+		return nil
+	}
+	re, ok := purchaseOrderPatterns.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid purchase order pattern: %v", err)
+		}
+		re, _ = purchaseOrderPatterns.LoadOrStore(pattern, compiled)
+	}
+	if !re.(*regexp.Regexp).MatchString(number) {
+		return &ValidationError{Field: "purchaseOrder", Reason: fmt.Sprintf("must match %s", pattern)}
+	}
+	return nil
+}
+
+// checkCredit checks that the credit line of the customer of the new order,
+// paid on account, covers what its tenders leave, and sets the net terms of
+// its invoice. The order has to name its purchase order when the
+// configuration or the credit line requires one.
+func (p *Payments) checkCredit(ctx context.Context, order *Order) error {
+	if p.Credit == nil {
+		return &ValidationError{Field: "paymentMethod", Reason: "orders can not be paid on account"}
+	}
+	cfg := ConfigFromContext(ctx).Payments.Credit
+	line, err := p.Credit.CreditLine(ctx, order.CustomerID)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(line.Currency, order.Currency) {
+		return &ValidationError{Field: "currency", Reason: fmt.Sprintf("the credit line of the customer is in %s", line.Currency)}
+	}
+	available := line.Available()
+	if order.cardAmount().Cmp(available) > 0 {
+		return fmt.Errorf("%w: %s is left of the credit line", payments.ErrCreditLimitExceeded, available)
+	}
+	if order.PurchaseOrder == "" && (cfg.RequirePurchaseOrder || line.PurchaseOrderRequired) {
+		return &ValidationError{Field: "purchaseOrder", Reason: "is required to pay on account"}
+	}
+	days := line.TermsDays
+	if days <= 0 {
+		days = cfg.TermsDays
+	}
+	order.Terms = &PaymentTerms{Days: days, DueAt: order.CreatedAt.AddDate(0, 0, days)}
+	return nil
+}
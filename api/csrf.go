@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareCSRF is the factory name of the middleware checking the csrf
+// token of the admin requests
+const MiddlewareCSRF = "csrf"
+
+// CSRF protects the admin api used by a browser from the requests another site
+// makes it send, with a double submit cookie: the requests that may change
+// state have to carry the token of the cookie in a header as well, which a
+// page of another site can not read. The requests with an Authorization
+// header, which a browser does not add by itself, are not checked.
+type CSRF struct {
+	cfg config.CSRFConfig
+}
+
+// NewCSRF returns the middleware checking the csrf token of cfg
+func NewCSRF(cfg config.CSRFConfig) *CSRF {
+	return &CSRF{cfg: cfg}
+}
+
+// isSafeMethod reports whether requests of method do not change state
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+func (c *CSRF) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !isAdminPath(r.URL.Path) || isSafeMethod(r.Method) || r.Header.Get("Authorization") != "" {
+		next(w, r)
+		return
+	}
+	cookie, err := r.Cookie(c.cfg.CookieName)
+	token := r.Header.Get(c.cfg.HeaderName)
+	if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		LoggerFromContext(r.Context()).Warnf("refused %s %s without a valid csrf token", r.Method, r.URL.Path)
+		writeErrorCode(w, r, CodeInvalidCSRFToken, "missing or invalid csrf token, get one from /"+adminPrefix+"/csrf")
+		return
+	}
+	next(w, r)
+}
+
+// csrfToken is the response of IssueCSRFToken
+type csrfToken struct {
+	Token string `json:"token"`
+	// Header is the header to send the token in
+	Header string `json:"header"`
+}
+
+// IssueCSRFToken sets the csrf cookie to a new token and returns the token,
+// which the admin requests that may change state send again in the csrf
+// header. The cookie is not readable by scripts, the page keeps the token.
+func IssueCSRFToken(w http.ResponseWriter, r *http.Request) {
+	cfg := ConfigFromContext(r.Context()).Admin.CSRF
+	if !cfg.Enabled {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.CookieName,
+		Value:    token,
+		Path:     "/" + adminPrefix + "/",
+		MaxAge:   int(cfg.TTL.Seconds()),
+		Secure:   cfg.Secure,
+		HttpOnly: true,
+		SameSite: sameSiteMode(cfg.SameSite),
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, http.StatusOK, &csrfToken{Token: token, Header: cfg.HeaderName})
+}
+
+// sameSiteMode returns the http SameSite mode of a configured one
+func sameSiteMode(mode string) http.SameSite {
+	switch mode {
+	case config.SameSiteLax:
+		return http.SameSiteLaxMode
+	case config.SameSiteNone:
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteStrictMode
+}
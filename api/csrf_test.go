@@ -0,0 +1,123 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+var csrfTestConfig = config.CSRFConfig{
+	Enabled:    true,
+	CookieName: "csrf_token",
+	HeaderName: "X-CSRF-Token",
+	SameSite:   config.SameSiteStrict,
+	Secure:     true,
+	TTL:        config.Duration{Duration: time.Hour},
+}
+
+func TestCSRF(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		cookie        string
+		header        string
+		authorization string
+		allowed       bool
+	}{
+		{name: "safe admin request", method: http.MethodGet, path: "/v1/admin/jobs", allowed: true},
+		{name: "head admin request", method: http.MethodHead, path: "/v1/admin/jobs", allowed: true},
+		{name: "request outside the admin api", method: http.MethodPost, path: "/v1/order", allowed: true},
+		{name: "matching cookie and header", method: http.MethodPost, path: "/v1/admin/jobs", cookie: "t0k3n", header: "t0k3n", allowed: true},
+		{name: "authorization header", method: http.MethodDelete, path: "/v1/admin/jobs/j-1", authorization: "Bearer key", allowed: true},
+		{name: "no token", method: http.MethodPost, path: "/v1/admin/jobs"},
+		{name: "cookie without header", method: http.MethodPut, path: "/v1/admin/jobs", cookie: "t0k3n"},
+		{name: "header without cookie", method: http.MethodPatch, path: "/v1/admin/jobs", header: "t0k3n"},
+		{name: "mismatched tokens", method: http.MethodDelete, path: "/v1/admin/jobs/j-1", cookie: "t0k3n", header: "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: csrfTestConfig.CookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				r.Header.Set(csrfTestConfig.HeaderName, tt.header)
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			reached := false
+			NewCSRF(csrfTestConfig).ServeHTTP(w, r, func(http.ResponseWriter, *http.Request) { reached = true })
+			if reached != tt.allowed {
+				t.Fatalf("request allowed = %t, want %t", reached, tt.allowed)
+			}
+			if !tt.allowed && w.Code != http.StatusForbidden {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestIssueCSRFToken(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Admin.CSRF = csrfTestConfig
+	r := httptest.NewRequest(http.MethodGet, "/v1/admin/csrf", nil)
+	r = r.WithContext(WithConfig(r.Context(), cfg))
+	w := httptest.NewRecorder()
+	IssueCSRFToken(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var body csrfToken
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode the token: %v", err)
+	}
+	if body.Token == "" || body.Header != csrfTestConfig.HeaderName {
+		t.Fatalf("token = %+v, want a token sent in %s", body, csrfTestConfig.HeaderName)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+	cookie := cookies[0]
+	if cookie.Name != csrfTestConfig.CookieName || cookie.Value != body.Token {
+		t.Errorf("cookie %s=%s, want %s=%s", cookie.Name, cookie.Value, csrfTestConfig.CookieName, body.Token)
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie is http only %t, secure %t, same site %v", cookie.HttpOnly, cookie.Secure, cookie.SameSite)
+	}
+
+	// the issued token passes the check
+	post := httptest.NewRequest(http.MethodPost, "/v1/admin/jobs", nil)
+	post.AddCookie(cookie)
+	post.Header.Set(body.Header, body.Token)
+	reached := false
+	NewCSRF(csrfTestConfig).ServeHTTP(httptest.NewRecorder(), post, func(http.ResponseWriter, *http.Request) { reached = true })
+	if !reached {
+		t.Fatal("the issued token was refused")
+	}
+}
+
+func TestSameSiteMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		want http.SameSite
+	}{
+		{mode: config.SameSiteStrict, want: http.SameSiteStrictMode},
+		{mode: config.SameSiteLax, want: http.SameSiteLaxMode},
+		{mode: config.SameSiteNone, want: http.SameSiteNoneMode},
+		{mode: "", want: http.SameSiteStrictMode},
+	}
+	for _, tt := range tests {
+		if got := sameSiteMode(tt.mode); got != tt.want {
+			t.Errorf("sameSiteMode(%q) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+var (
+	// ErrInvalidPageToken is returned for page tokens that were not issued by
+	// the service, were changed or are used with other filters than those of
+	// the listing that issued them
+	ErrInvalidPageToken = errors.New("invalid page token")
+	// ErrPageTokenExpired is returned for page tokens past their ttl, the
+	// listing starts again from its first page
+	ErrPageTokenExpired = errors.New("page token expired")
+)
+
+// PageCursors seal the page tokens of the repositories, such as the
+// LastEvaluatedKey of DynamoDB, into the cursors returned to the clients. A
+// cursor is encrypted and authenticated with AES-GCM by a key derived from the
+// secret of the configuration, with the hash of the filters of its listing and
+// its expiry, so clients can neither read nor forge one and any instance with
+// the same secret continues the listing.
+type PageCursors struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+}
+
+// NewPageCursors returns the page cursors of cfg
+func NewPageCursors(cfg *config.CursorsConfig) (*PageCursors, error) {
+	key := sha256.Sum256([]byte(cfg.Secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &PageCursors{aead: aead, ttl: cfg.TTL.Duration}, nil
+}
+
+type pageCursorsKey struct{}
+
+// WithPageCursors returns a copy of ctx sealing page tokens with cursors
+func WithPageCursors(ctx context.Context, cursors *PageCursors) context.Context {
+	return context.WithValue(ctx, pageCursorsKey{}, cursors)
+}
+
+// PageCursorsFromContext returns the page cursors stored in ctx, or nil when
+// the page tokens are returned as they are
+func PageCursorsFromContext(ctx context.Context) *PageCursors {
+	cursors, _ := ctx.Value(pageCursorsKey{}).(*PageCursors)
+	return cursors
+}
+
+// pageCursor is the sealed content of a cursor
+type pageCursor struct {
+	Token     string `json:"t"`
+	Filter    string `json:"f"`
+	ExpiresAt int64  `json:"e"`
+}
+
+// pageFilter returns the hash of the filters of a listing, terms, which the
+// cursors of the listing are bound to
+func pageFilter(terms ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(terms, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// seal returns the cursor of the page token of the listing with filter issued
+// at now
+func (c *PageCursors) seal(token, filter string, now time.Time) (string, error) {
+	data, err := json.Marshal(&pageCursor{Token: token, Filter: filter, ExpiresAt: now.Add(c.ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(c.aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+// open returns the page token of cursor, or ErrInvalidPageToken when it was
+// not sealed by c or for another filter than filter, and ErrPageTokenExpired
+// when it expired at now
+func (c *PageCursors) open(cursor, filter string, now time.Time) (string, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrInvalidPageToken
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	data, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrInvalidPageToken
+	}
+	var page pageCursor
+	if err := json.Unmarshal(data, &page); err != nil || page.Filter != filter {
+		return "", ErrInvalidPageToken
+	}
+	if !now.Before(time.Unix(page.ExpiresAt, 0)) {
+		return "", ErrPageTokenExpired
+	}
+	return page.Token, nil
+}
+
+// openPageToken returns the page token of the repository of the cursor of a
+// client for the listing with filter, the cursor itself when ctx seals no page
+// tokens
+func openPageToken(ctx context.Context, cursor, filter string) (string, error) {
+	cursors := PageCursorsFromContext(ctx)
+	if cursors == nil || cursor == "" {
+		return cursor, nil
+	}
+	return cursors.open(cursor, filter, time.Now())
+}
+
+// sealPageToken returns the cursor returned to the client of the page token
+// of the repository for the listing with filter, the token itself when ctx
+// seals no page tokens
+func sealPageToken(ctx context.Context, token, filter string) (string, error) {
+	cursors := PageCursorsFromContext(ctx)
+	if cursors == nil || token == "" {
+		return token, nil
+	}
+	return cursors.seal(token, filter, time.Now())
+}
+
+// listOrdersPage returns a page of the orders of repo listed with opts, whose
+// page token is the cursor of the client, and the cursor of the next page. The
+// page is sorted by the keys of opts the repository could not sort by.
+func listOrdersPage(ctx context.Context, repo Repository, opts ListOptions) ([]*Order, string, error) {
+	filter := pageFilter("list", opts.CustomerID, string(opts.Status))
+	if opts.Sort != nil {
+		filter = pageFilter("list", opts.CustomerID, string(opts.Status), sortTerm(opts.Sort))
+		if opts.Fields != nil {
+			opts.Fields = append(append([]string{}, opts.Fields...), sortFields(opts.Sort)...)
+		}
+	}
+	token, err := openPageToken(ctx, opts.PageToken, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	opts.PageToken = token
+	orders, next, err := repo.ListOrders(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	sortOrders(orders, opts.Sort)
+	next, err = sealPageToken(ctx, next, filter)
+	if err != nil {
+		return nil, "", err
+	}
+	return orders, next, nil
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+func newTestPageCursors(t *testing.T, secret string) *PageCursors {
+	t.Helper()
+	cursors, err := NewPageCursors(&config.CursorsConfig{Enabled: true, Secret: secret, TTL: config.Duration{Duration: time.Hour}})
+	if err != nil {
+		t.Fatalf("NewPageCursors: %v", err)
+	}
+	return cursors
+}
+
+func TestPageCursorsSealOpen(t *testing.T) {
+	cursors := newTestPageCursors(t, "secret")
+	now := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	filter := pageFilter("list", "c-1", "")
+
+	cursor, err := cursors.seal(`{"id":"o-42"}`, filter, now)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if strings.Contains(cursor, "o-42") {
+		t.Errorf("cursor %s shows the page token", cursor)
+	}
+	token, err := cursors.open(cursor, filter, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if token != `{"id":"o-42"}` {
+		t.Errorf("open returned %q, want the sealed token", token)
+	}
+
+	// another instance with the same secret continues the listing
+	if _, err := newTestPageCursors(t, "secret").open(cursor, filter, now); err != nil {
+		t.Errorf("open with the same secret: %v", err)
+	}
+}
+
+func TestPageCursorsOpenInvalid(t *testing.T) {
+	cursors := newTestPageCursors(t, "secret")
+	now := time.Date(2024, 1, 15, 9, 30, 0, 0, time.UTC)
+	filter := pageFilter("list", "c-1", "")
+	cursor, err := cursors.seal("token", filter, now)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	// the first character holds six bits of the nonce, the last may hold
+	// padding bits only
+	tampered := []byte(cursor)
+	if tampered[0] == 'A' {
+		tampered[0] = 'B'
+	} else {
+		tampered[0] = 'A'
+	}
+
+	tests := []struct {
+		name    string
+		cursors *PageCursors
+		cursor  string
+		filter  string
+		now     time.Time
+		err     error
+	}{
+		{"not base64", cursors, "not a cursor!", filter, now, ErrInvalidPageToken},
+		{"too short", cursors, "AAAA", filter, now, ErrInvalidPageToken},
+		{"tampered", cursors, string(tampered), filter, now, ErrInvalidPageToken},
+		{"other secret", newTestPageCursors(t, "other"), cursor, filter, now, ErrInvalidPageToken},
+		{"other filter", cursors, cursor, pageFilter("list", "c-2", ""), now, ErrInvalidPageToken},
+		{"expired", cursors, cursor, filter, now.Add(time.Hour), ErrPageTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.cursors.open(tt.cursor, tt.filter, tt.now); !errors.Is(err, tt.err) {
+				t.Errorf("open returned %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
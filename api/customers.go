@@ -0,0 +1,345 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrCustomerNotFound is returned when no customer has the requested id
+var ErrCustomerNotFound = errors.New("customer not found")
+
+// maxCustomerAddresses is the number of addresses kept per customer
+const maxCustomerAddresses = 20
+
+// CustomerAddress is an address in the address book of a customer
+type CustomerAddress struct {
+	ID string `json:"id" dynamodbav:"addressId"`
+	Address
+	// Default marks the address orders ship to unless they name another
+	Default bool `json:"default,omitempty" dynamodbav:"default,omitempty"`
+}
+
+// Customer is a customer placing orders, the orders name it by CustomerID
+type Customer struct {
+	ID        string            `json:"id" dynamodbav:"customerId"`
+	Name      string            `json:"name" dynamodbav:"name"`
+	Email     string            `json:"email" dynamodbav:"email"`
+	Phone     string            `json:"phone,omitempty" dynamodbav:"phone,omitempty"`
+	Addresses []CustomerAddress `json:"addresses" dynamodbav:"addresses"`
+	CreatedAt time.Time         `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time         `json:"updatedAt" dynamodbav:"updatedAt"`
+	// Sealed holds the email and addresses while the customer is stored with
+	// encryption, they are opened when it is read
+	Sealed *SealedFields `json:"sealed,omitempty" dynamodbav:"sealed,omitempty"`
+	// ErasedAt is set once the personal data of the customer is erased
+	ErasedAt *time.Time `json:"erasedAt,omitempty" dynamodbav:"erasedAt,omitempty"`
+	// Notifications are the notifications the customer chose to receive, nil
+	// for the default ones
+	Notifications *NotificationPreferences `json:"notifications,omitempty" dynamodbav:"notifications,omitempty"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// CustomerStore is implemented by repositories keeping customers, which they do
+// once EnableCustomers is called.
+type CustomerStore interface {
+	// CreateCustomer stores a new customer
+	CreateCustomer(ctx context.Context, customer *Customer) error
+	// GetCustomer returns the customer with id, or ErrCustomerNotFound
+	GetCustomer(ctx context.Context, id string) (*Customer, error)
+	// UpdateCustomer replaces a customer if its stored version equals
+	// customer.Version, incrementing customer.Version. It fails with
+	// ErrCustomerNotFound or ErrVersionConflict.
+	UpdateCustomer(ctx context.Context, customer *Customer) error
+}
+
+// CustomerBatchStore is implemented by the customer stores with a native bulk
+// read. The stores without it are read one customer at a time.
+type CustomerBatchStore interface {
+	// BatchGetCustomers returns the customers found among ids, keyed by id
+	BatchGetCustomers(ctx context.Context, ids []string) (map[string]*Customer, error)
+}
+
+// batchGetCustomers reads customers with the bulk operation of store when it
+// has one
+func batchGetCustomers(ctx context.Context, store CustomerStore, ids []string) (map[string]*Customer, error) {
+	if batch, ok := store.(CustomerBatchStore); ok {
+		return batch.BatchGetCustomers(ctx, ids)
+	}
+	customers := map[string]*Customer{}
+	for _, id := range ids {
+		if _, ok := customers[id]; ok {
+			continue
+		}
+		customer, err := store.GetCustomer(ctx, id)
+		if errors.Is(err, ErrCustomerNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		customers[id] = customer
+	}
+	return customers, nil
+}
+
+// customersEnabler is implemented by repositories able to keep customers
+type customersEnabler interface {
+	enableCustomers(table string)
+}
+
+// EnableCustomers makes repo keep customers, in table for the backends that keep
+// them in a separate table
+func EnableCustomers(repo Repository, table string) error {
+	enabler, ok := repo.(customersEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support customers", repo)
+	}
+	enabler.enableCustomers(table)
+	return nil
+}
+
+// findCustomerStore returns the customer store of repo or of the repository it decorates
+func findCustomerStore(repo Repository) (CustomerStore, bool) {
+	var store CustomerStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(CustomerStore)
+		return ok
+	})
+	return store, found
+}
+
+// customerStoreFromContext returns the customer store of the request repository or ErrNotSupported
+func customerStoreFromContext(ctx context.Context) (CustomerStore, error) {
+	store, ok := findCustomerStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// createCustomerRequest is the body of CreateCustomer
+type createCustomerRequest struct {
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Phone     string    `json:"phone,omitempty"`
+	Addresses []Address `json:"addresses,omitempty"`
+}
+
+// newCustomer returns the validated customer described by req, its first
+// address is the default
+func (req *createCustomerRequest) newCustomer() (*Customer, error) {
+	if req.Name == "" {
+		return nil, &ValidationError{Field: "name", Reason: "is required"}
+	}
+	if _, err := mail.ParseAddress(req.Email); err != nil {
+		return nil, &ValidationError{Field: "email", Reason: "must be an email address"}
+	}
+	if len(req.Addresses) > maxCustomerAddresses {
+		return nil, &ValidationError{Field: "addresses", Reason: fmt.Sprintf("at most %d addresses are kept", maxCustomerAddresses)}
+	}
+
+	now := time.Now().UTC()
+	customer := &Customer{
+		ID:        newID(),
+		Name:      req.Name,
+		Email:     req.Email,
+		Phone:     req.Phone,
+		Addresses: []CustomerAddress{},
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}
+	for i, address := range req.Addresses {
+		if err := validateAddress(fmt.Sprintf("addresses[%d]", i), &address); err != nil {
+			return nil, err
+		}
+		customer.Addresses = append(customer.Addresses, CustomerAddress{ID: newID(), Address: address, Default: i == 0})
+	}
+	return customer, nil
+}
+
+// validateAddress checks the fields of an address an order can ship to
+func validateAddress(field string, a *Address) error {
+	switch {
+	case a.Line1 == "":
+		return &ValidationError{Field: field + ".line1", Reason: "is required"}
+	case a.City == "":
+		return &ValidationError{Field: field + ".city", Reason: "is required"}
+	case a.PostalCode == "":
+		return &ValidationError{Field: field + ".postalCode", Reason: "is required"}
+	case a.Country == "":
+		return &ValidationError{Field: field + ".country", Reason: "is required"}
+	}
+	return nil
+}
+
+// addAddressRequest is the body of AddCustomerAddress
+type addAddressRequest struct {
+	Address
+	Default bool `json:"default,omitempty"`
+}
+
+// CreateCustomer stores the customer described by the body with a new id
+func CreateCustomer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := customerStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req createCustomerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	customer, err := req.newCustomer()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := store.CreateCustomer(ctx, customer); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("created customer %s", customer.ID)
+	writeJSON(w, r, http.StatusCreated, customer)
+}
+
+// GetCustomer returns the customer named in the path
+func GetCustomer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := customerStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	customer, err := store.GetCustomer(ctx, mux.Vars(r)["customerId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, customer)
+}
+
+// AddCustomerAddress adds the address of the body to the customer named in the
+// path. The first address, or one added as default, becomes the default.
+func AddCustomerAddress(w http.ResponseWriter, r *http.Request) {
+	var req addAddressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := validateAddress("address", &req.Address); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	updateCustomer(w, r, func(customer *Customer) error {
+		if len(customer.Addresses) >= maxCustomerAddresses {
+			return &ValidationError{Field: "addresses", Reason: fmt.Sprintf("at most %d addresses are kept", maxCustomerAddresses)}
+		}
+		isDefault := req.Default || len(customer.Addresses) == 0
+		if isDefault {
+			for i := range customer.Addresses {
+				customer.Addresses[i].Default = false
+			}
+		}
+		customer.Addresses = append(customer.Addresses, CustomerAddress{ID: newID(), Address: req.Address, Default: isDefault})
+		return nil
+	})
+}
+
+// DeleteCustomerAddress removes the address named in the path from the customer.
+// When it was the default the first remaining address becomes the default.
+func DeleteCustomerAddress(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["addressId"]
+	updateCustomer(w, r, func(customer *Customer) error {
+		for i, address := range customer.Addresses {
+			if address.ID != id {
+				continue
+			}
+			customer.Addresses = append(customer.Addresses[:i], customer.Addresses[i+1:]...)
+			if address.Default && len(customer.Addresses) > 0 {
+				customer.Addresses[0].Default = true
+			}
+			return nil
+		}
+		return &ValidationError{Field: "addressId", Reason: fmt.Sprintf("customer has no address %q", id)}
+	})
+}
+
+// updateCustomer applies change to the customer named in the path and writes it
+func updateCustomer(w http.ResponseWriter, r *http.Request, change func(*Customer) error) {
+	ctx := r.Context()
+	store, err := customerStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	customer, err := store.GetCustomer(ctx, mux.Vars(r)["customerId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := change(customer); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customer.UpdatedAt = time.Now().UTC()
+	if err := store.UpdateCustomer(ctx, customer); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, customer)
+}
+
+// ListCustomerOrders returns a page of the orders of the customer id in the path,
+// newest first, from the customer id index. The customer does not need to be
+// stored, so the orders placed before customers were kept are found as well. The
+// status query parameter filters them, limit and pageToken page them and
+// fields selects the fields of the orders returned, expand embeds their
+// related resources and sort orders them.
+func ListCustomerOrders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	params := r.URL.Query()
+	limit, err := pageLimit(params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	shape, err := parseOrderShape(params, orderAttributes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	keys, err := parseSort(params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	orders, next, err := listOrdersPage(ctx, RepositoryFromContext(ctx), ListOptions{
+		CustomerID: mux.Vars(r)["customerId"],
+		Status:     Status(params.Get("status")),
+		Limit:      limit,
+		PageToken:  params.Get("pageToken"),
+		Fields:     shape.readFields(),
+		Sort:       keys,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOrders(w, r, orders, next, shape)
+}
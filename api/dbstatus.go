@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareDbStatus is the factory name of the database status middleware
+const MiddlewareDbStatus = "db-status"
+
+// Pinger is implemented by repositories that can check their database
+type Pinger interface {
+	// Ping returns an error unless the database answers
+	Ping(ctx context.Context) error
+}
+
+// findPinger returns the pinger of repo or of the repository it decorates
+func findPinger(repo Repository) (Pinger, bool) {
+	var pinger Pinger
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		pinger, ok = r.(Pinger)
+		return ok
+	})
+	return pinger, found
+}
+
+// DbStatus refuses the requests that may modify state with 503 while the
+// database is unhealthy: its last check failed or was slower than the max
+// latency. A check is reused for the ttl, the first request after it checks
+// again while the others use the last one. Reads are let through, the order
+// cache serves those it holds when the database fails them.
+type DbStatus struct {
+	pinger Pinger
+	cfg    config.DbStatusConfig
+
+	mu       sync.Mutex
+	checked  time.Time
+	checking bool
+	err      error
+}
+
+// NewDbStatus returns the middleware checking the database with pinger as set in cfg
+func NewDbStatus(pinger Pinger, cfg config.DbStatusConfig) *DbStatus {
+	return &DbStatus{pinger: pinger, cfg: cfg}
+}
+
+// Err returns why the database is unhealthy, nil when it is healthy
+func (d *DbStatus) Err(ctx context.Context) error {
+	d.mu.Lock()
+	if d.checking || time.Since(d.checked) < d.cfg.TTL.Duration {
+		err := d.err
+		d.mu.Unlock()
+		return err
+	}
+	d.checking = true
+	d.mu.Unlock()
+
+	err := d.check(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if (err == nil) != (d.err == nil) {
+		if err != nil {
+			LoggerFromContext(ctx).Errorf("database is unhealthy, refusing writes: %v", err)
+		} else {
+			LoggerFromContext(ctx).Info("database is healthy again")
+		}
+	}
+	d.err = err
+	d.checked = time.Now()
+	d.checking = false
+	return err
+}
+
+func (d *DbStatus) check(ctx context.Context) error {
+	// the check outlives a request cancelled meanwhile, others rely on it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.cfg.Timeout.Duration)
+	defer cancel()
+	start := time.Now()
+	err := d.pinger.Ping(ctx)
+	latency := time.Since(start)
+	dbStatusLatency.Observe(latency.Seconds())
+	switch {
+	case err != nil:
+		dbHealthy.Set(0)
+		return err
+	case d.cfg.MaxLatency.Duration > 0 && latency > d.cfg.MaxLatency.Duration:
+		dbHealthy.Set(0)
+		return fmt.Errorf("database answered in %s, above %s", latency.Round(time.Millisecond), d.cfg.MaxLatency.Duration)
+	}
+	dbHealthy.Set(1)
+	return nil
+}
+
+func (d *DbStatus) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isReadOnlyMethod(r.Method) || isAdminPath(r.URL.Path) || d.Err(r.Context()) == nil {
+		next(w, r)
+		return
+	}
+	retry := int(d.cfg.TTL.Seconds())
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeErrorCode(w, r, CodeDatabaseUnavailable, "the database is unavailable, retry later")
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// dbUsage adds up the DynamoDB calls of a request: their number, duration and
+// consumed capacity. Its reads may run in parallel, as hedged reads do.
+type dbUsage struct {
+	// queryThreshold is the duration above which a call is logged, 0 never
+	queryThreshold time.Duration
+
+	mu       sync.Mutex
+	calls    int
+	duration time.Duration
+	capacity float64
+}
+
+type dbUsageKey struct{}
+
+// withDbUsage returns a copy of ctx whose DynamoDB calls are added to usage
+func withDbUsage(ctx context.Context, usage *dbUsage) context.Context {
+	return context.WithValue(ctx, dbUsageKey{}, usage)
+}
+
+// dbUsageFromContext returns the usage the DynamoDB calls of ctx are added to, or nil
+func dbUsageFromContext(ctx context.Context) *dbUsage {
+	usage, _ := ctx.Value(dbUsageKey{}).(*dbUsage)
+	return usage
+}
+
+func (u *dbUsage) add(duration time.Duration, capacity float64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.calls++
+	u.duration += duration
+	u.capacity += capacity
+}
+
+// totals returns the number, the duration and the consumed capacity of the calls
+func (u *dbUsage) totals() (int, time.Duration, float64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.calls, u.duration, u.capacity
+}
+
+// addDbUsageMiddleware adds the middleware recording the DynamoDB calls of
+// the contexts carrying a dbUsage to the stack of the client. Only those
+// calls ask for their consumed capacity. It runs after the operation name is
+// set.
+func addDbUsageMiddleware(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("RecordDbUsage", recordDbUsage), middleware.After)
+}
+
+func recordDbUsage(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	usage := dbUsageFromContext(ctx)
+	if usage == nil {
+		return next.HandleInitialize(ctx, in)
+	}
+	returnConsumedCapacity(in.Parameters)
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	duration := time.Since(start)
+	usage.add(duration, consumedCapacity(out.Result))
+	if usage.queryThreshold > 0 && duration > usage.queryThreshold {
+		repositoryLogger(ctx).WithField("duration_ms", duration.Milliseconds()).
+			Warnf("slow dynamodb %s took %s", middleware.GetOperationName(ctx), duration.Round(time.Millisecond))
+	}
+	return out, metadata, err
+}
+
+// returnConsumedCapacity asks the call of the input params for its total
+// consumed capacity, unless it asks already
+func returnConsumedCapacity(params interface{}) {
+	var field *types.ReturnConsumedCapacity
+	switch input := params.(type) {
+	case *dynamodb.GetItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.PutItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.UpdateItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.DeleteItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.QueryInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.ScanInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.BatchGetItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.BatchWriteItemInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.TransactGetItemsInput:
+		field = &input.ReturnConsumedCapacity
+	case *dynamodb.TransactWriteItemsInput:
+		field = &input.ReturnConsumedCapacity
+	default:
+		return
+	}
+	if *field == "" {
+		*field = types.ReturnConsumedCapacityTotal
+	}
+}
+
+// isReadInput reports whether the call of the input params consumes read
+// capacity, the others consume write capacity
+func isReadInput(params interface{}) bool {
+	switch params.(type) {
+	case *dynamodb.GetItemInput, *dynamodb.QueryInput, *dynamodb.ScanInput,
+		*dynamodb.BatchGetItemInput, *dynamodb.TransactGetItemsInput:
+		return true
+	}
+	return false
+}
+
+// consumedCapacity returns the capacity units consumed by the call of the
+// output result, 0 for the calls that do not tell
+func consumedCapacity(result interface{}) float64 {
+	var units float64
+	for _, c := range consumedCapacities(result) {
+		if c.CapacityUnits != nil {
+			units += *c.CapacityUnits
+		}
+	}
+	return units
+}
+
+// consumedCapacities returns the capacity consumed by the call of the output
+// result by table
+func consumedCapacities(result interface{}) []types.ConsumedCapacity {
+	var consumed []types.ConsumedCapacity
+	switch output := result.(type) {
+	case *dynamodb.GetItemOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.PutItemOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.UpdateItemOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.DeleteItemOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.QueryOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.ScanOutput:
+		consumed = singleCapacity(output.ConsumedCapacity)
+	case *dynamodb.BatchGetItemOutput:
+		consumed = output.ConsumedCapacity
+	case *dynamodb.BatchWriteItemOutput:
+		consumed = output.ConsumedCapacity
+	case *dynamodb.TransactGetItemsOutput:
+		consumed = output.ConsumedCapacity
+	case *dynamodb.TransactWriteItemsOutput:
+		consumed = output.ConsumedCapacity
+	}
+	return consumed
+}
+
+func singleCapacity(c *types.ConsumedCapacity) []types.ConsumedCapacity {
+	if c == nil {
+		return nil
+	}
+	return []types.ConsumedCapacity{*c}
+}
@@ -0,0 +1,422 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/logging"
+)
+
+var (
+	// ErrDeadLetterNotFound is returned when no dead letter has the requested id
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	// ErrReplayFailed is returned when the publisher of a dead letter failed it again
+	ErrReplayFailed = errors.New("replay of the dead letter failed")
+)
+
+// the publishers whose failed events are dead-lettered
+const (
+	PublisherWebhooks      = "webhooks"
+	PublisherKafka         = "kafka"
+	PublisherNotifications = "notifications"
+)
+
+const (
+	// defaultDeadLetterLimit is the number of dead letters listed or replayed
+	// in bulk unless the request asks for fewer
+	defaultDeadLetterLimit = 100
+	// maxDeadLetterLimit bounds the dead letters listed or replayed in bulk
+	maxDeadLetterLimit = 1000
+)
+
+// DeadLetter is an event a publisher failed to deliver, kept for inspection and
+// replay. Its id is derived from the failed delivery, an event failing again
+// after a replay replaces its letter.
+type DeadLetter struct {
+	ID string `json:"id" dynamodbav:"letterId"`
+	// Publisher is the publisher that failed the event, webhooks, kafka or
+	// notifications
+	Publisher string       `json:"publisher" dynamodbav:"publisher"`
+	Event     *OutboxEvent `json:"event" dynamodbav:"event"`
+	// SubscriptionID and DeliveryID name the dead webhook delivery, DeliveryID
+	// the channel of a dead notification
+	SubscriptionID string    `json:"subscriptionId,omitempty" dynamodbav:"subscriptionId,omitempty"`
+	DeliveryID     string    `json:"deliveryId,omitempty" dynamodbav:"deliveryId,omitempty"`
+	Attempts       int       `json:"attempts" dynamodbav:"attempts"`
+	LastError      string    `json:"lastError" dynamodbav:"lastError"`
+	FailedAt       time.Time `json:"failedAt" dynamodbav:"failedAt"`
+	// Replays counts the replays of the letter that failed
+	Replays int `json:"replays,omitempty" dynamodbav:"replays,omitempty"`
+}
+
+// DeadLetterStore is implemented by repositories that keep dead letters. Its
+// methods fail with ErrNotSupported until EnableDeadLetters is called.
+type DeadLetterStore interface {
+	// SaveDeadLetter stores letter, replacing the letter with the same id
+	SaveDeadLetter(ctx context.Context, letter *DeadLetter) error
+	// GetDeadLetter returns the letter with id, or ErrDeadLetterNotFound
+	GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error)
+	// DeleteDeadLetter removes the letter with id, or fails with ErrDeadLetterNotFound
+	DeleteDeadLetter(ctx context.Context, id string) error
+	// ListDeadLetters returns up to limit letters, oldest first, only those of
+	// publisher unless it is empty
+	ListDeadLetters(ctx context.Context, publisher string, limit int) ([]*DeadLetter, error)
+}
+
+// deadLettersEnabler is implemented by repositories able to keep dead letters
+type deadLettersEnabler interface {
+	enableDeadLetters(table string)
+}
+
+// EnableDeadLetters makes repo keep dead letters, in table for the backends
+// that keep them in a separate table
+func EnableDeadLetters(repo Repository, table string) error {
+	enabler, ok := repo.(deadLettersEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support dead letters", repo)
+	}
+	enabler.enableDeadLetters(table)
+	return nil
+}
+
+// findDeadLetterStore returns the dead letter store of repo or of the repository it decorates
+func findDeadLetterStore(repo Repository) (DeadLetterStore, bool) {
+	var store DeadLetterStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(DeadLetterStore)
+		return ok
+	})
+	return store, found
+}
+
+// sortDeadLetters orders letters by the time they failed, oldest first
+func sortDeadLetters(letters []*DeadLetter) {
+	sort.Slice(letters, func(i, j int) bool {
+		if !letters[i].FailedAt.Equal(letters[j].FailedAt) {
+			return letters[i].FailedAt.Before(letters[j].FailedAt)
+		}
+		return letters[i].ID < letters[j].ID
+	})
+}
+
+// replayFunc delivers the event of a dead letter again
+type replayFunc func(ctx context.Context, letter *DeadLetter) error
+
+// DeadLetterQueue keeps the events the publishers failed to deliver and hands
+// them back to their publishers on replay
+type DeadLetterQueue struct {
+	store  DeadLetterStore
+	logger logging.Logger
+
+	mu        sync.RWMutex
+	replayers map[string]replayFunc
+}
+
+// NewDeadLetterQueue returns a queue keeping its letters in store
+func NewDeadLetterQueue(store DeadLetterStore, logger logging.Logger) *DeadLetterQueue {
+	return &DeadLetterQueue{store: store, logger: logger, replayers: map[string]replayFunc{}}
+}
+
+// handle makes the letters of publisher replay with replay
+func (q *DeadLetterQueue) handle(publisher string, replay replayFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.replayers[publisher] = replay
+}
+
+// Add keeps letter
+func (q *DeadLetterQueue) Add(ctx context.Context, letter *DeadLetter) error {
+	if err := q.store.SaveDeadLetter(ctx, letter); err != nil {
+		return err
+	}
+	deadLetters.WithLabelValues(letter.Publisher).Inc()
+	q.logger.Warnf("dead-lettered %s event %s of order %s for %s after %d attempts: %s",
+		letter.Event.Type, letter.Event.ID, letter.Event.OrderID, letter.Publisher, letter.Attempts, letter.LastError)
+	return nil
+}
+
+// Replay hands the letter with id back to its publisher and removes it once
+// delivered. A replay failing again is counted in the letter, which is kept.
+func (q *DeadLetterQueue) Replay(ctx context.Context, id string) error {
+	letter, err := q.store.GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	q.mu.RLock()
+	replay, ok := q.replayers[letter.Publisher]
+	q.mu.RUnlock()
+	if !ok {
+		// the publisher is not enabled on this instance
+		return fmt.Errorf("%w: publisher %s is not enabled", ErrNotSupported, letter.Publisher)
+	}
+
+	if err := replay(ctx, letter); err != nil {
+		letter.Replays++
+		letter.LastError = err.Error()
+		if saveErr := q.store.SaveDeadLetter(ctx, letter); saveErr != nil {
+			q.logger.Errorf("failed to record the replay of dead letter %s: %v", id, saveErr)
+		}
+		return fmt.Errorf("%w: %v", ErrReplayFailed, err)
+	}
+	err = q.store.DeleteDeadLetter(ctx, id)
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		// replayed concurrently
+		err = nil
+	}
+	return err
+}
+
+// Publisher returns publisher, named name, dead-lettering the events it fails
+// to publish maxAttempts times in a row, and replays the letters of name with
+// it. A dead-lettered event counts as published, so the outbox relay moves on
+// to the later events of its order.
+func (q *DeadLetterQueue) Publisher(name string, publisher EventPublisher, maxAttempts int) EventPublisher {
+	q.handle(name, func(ctx context.Context, letter *DeadLetter) error {
+		return publisher.Publish(ctx, letter.Event)
+	})
+	return &deadLetteringPublisher{
+		name:        name,
+		publisher:   publisher,
+		queue:       q,
+		maxAttempts: maxAttempts,
+		failures:    map[string]int{},
+	}
+}
+
+// deadLetteringPublisher counts the failed attempts of every event and
+// dead-letters the events failing too often
+type deadLetteringPublisher struct {
+	name        string
+	publisher   EventPublisher
+	queue       *DeadLetterQueue
+	maxAttempts int
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func (p *deadLetteringPublisher) Publish(ctx context.Context, event *OutboxEvent) error {
+	err := p.publisher.Publish(ctx, event)
+	p.mu.Lock()
+	if err == nil {
+		delete(p.failures, event.ID)
+		p.mu.Unlock()
+		return nil
+	}
+	p.failures[event.ID]++
+	attempts := p.failures[event.ID]
+	if attempts < p.maxAttempts {
+		p.mu.Unlock()
+		return err
+	}
+	delete(p.failures, event.ID)
+	p.mu.Unlock()
+
+	letter := &DeadLetter{
+		ID:        p.name + "-" + event.ID,
+		Publisher: p.name,
+		Event:     event,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		FailedAt:  time.Now().UTC(),
+	}
+	if addErr := p.queue.Add(ctx, letter); addErr != nil {
+		p.queue.logger.Errorf("failed to dead-letter event %s: %v", event.ID, addErr)
+		return err
+	}
+	return nil
+}
+
+type deadLettersKey struct{}
+
+// WithDeadLetters returns a copy of ctx carrying the dead letter queue
+func WithDeadLetters(ctx context.Context, queue *DeadLetterQueue) context.Context {
+	return context.WithValue(ctx, deadLettersKey{}, queue)
+}
+
+// DeadLettersFromContext returns the dead letter queue stored in ctx, or nil
+func DeadLettersFromContext(ctx context.Context) *DeadLetterQueue {
+	queue, _ := ctx.Value(deadLettersKey{}).(*DeadLetterQueue)
+	return queue
+}
+
+// deadLettersFromRequest returns the dead letter queue of r, or ErrNotSupported
+func deadLettersFromRequest(r *http.Request) (*DeadLetterQueue, error) {
+	queue := DeadLettersFromContext(r.Context())
+	if queue == nil {
+		return nil, ErrNotSupported
+	}
+	return queue, nil
+}
+
+// deadLetterLimit returns the limit query parameter of r, defaultDeadLetterLimit
+// when it is missing
+func deadLetterLimit(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("limit")
+	if raw == "" {
+		return defaultDeadLetterLimit, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit <= 0 || limit > maxDeadLetterLimit {
+		return 0, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", maxDeadLetterLimit)}
+	}
+	return limit, nil
+}
+
+// deadLettersResponse lists dead letters
+type deadLettersResponse struct {
+	DeadLetters []*DeadLetter `json:"deadLetters"`
+}
+
+// ListDeadLetters returns the oldest dead letters, of the publisher query
+// parameter if given, up to limit
+func ListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	queue, err := deadLettersFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	limit, err := deadLetterLimit(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	letters, err := queue.store.ListDeadLetters(r.Context(), r.URL.Query().Get("publisher"), limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if letters == nil {
+		letters = []*DeadLetter{}
+	}
+	writeJSON(w, r, http.StatusOK, &deadLettersResponse{DeadLetters: letters})
+}
+
+// GetDeadLetter returns the dead letter named in the path with its event
+func GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	queue, err := deadLettersFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	letter, err := queue.store.GetDeadLetter(r.Context(), mux.Vars(r)["letterId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, letter)
+}
+
+// DeleteDeadLetter discards the dead letter named in the path
+func DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	queue, err := deadLettersFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["letterId"]
+	if err := queue.store.DeleteDeadLetter(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(r.Context()).Infof("discarded dead letter %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReplayDeadLetter hands the dead letter named in the path back to its
+// publisher, it is removed once delivered
+func ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	queue, err := deadLettersFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	id := mux.Vars(r)["letterId"]
+	if err := queue.Replay(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(r.Context()).Infof("replayed dead letter %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// replayDeadLettersRequest is the body of ReplayDeadLetters
+type replayDeadLettersRequest struct {
+	// IDs are the letters to replay, without them the oldest letters of
+	// Publisher, or of every publisher, are replayed up to Limit
+	IDs       []string `json:"ids,omitempty"`
+	Publisher string   `json:"publisher,omitempty"`
+	Limit     int      `json:"limit,omitempty"`
+}
+
+// failedReplay is a letter whose replay failed
+type failedReplay struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// replayDeadLettersResponse is the outcome of ReplayDeadLetters
+type replayDeadLettersResponse struct {
+	Replayed int            `json:"replayed"`
+	Failed   []failedReplay `json:"failed"`
+}
+
+// ReplayDeadLetters replays the dead letters named in the body, or the oldest
+// ones of a publisher, one after another, and reports those that failed
+func ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	queue, err := deadLettersFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req replayDeadLettersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.Limit < 0 || req.Limit > maxDeadLetterLimit || len(req.IDs) > maxDeadLetterLimit {
+		writeError(w, r, &ValidationError{Field: "limit", Reason: fmt.Sprintf("at most %d letters are replayed at a time", maxDeadLetterLimit)})
+		return
+	}
+
+	ids := req.IDs
+	if len(ids) == 0 {
+		limit := req.Limit
+		if limit == 0 {
+			limit = defaultDeadLetterLimit
+		}
+		letters, err := queue.store.ListDeadLetters(ctx, req.Publisher, limit)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		for _, letter := range letters {
+			ids = append(ids, letter.ID)
+		}
+	}
+
+	res := &replayDeadLettersResponse{Failed: []failedReplay{}}
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := queue.Replay(ctx, id); err != nil {
+			res.Failed = append(res.Failed, failedReplay{ID: id, Error: err.Error()})
+			continue
+		}
+		res.Replayed++
+	}
+	LoggerFromContext(ctx).Infof("replayed %d dead letters, %d failed", res.Replayed, len(res.Failed))
+	writeJSON(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// debugEnabled answers 404 unless the debug routes of the admin api are enabled
+func debugEnabled(w http.ResponseWriter, r *http.Request) bool {
+	if !ConfigFromContext(r.Context()).Admin.Debug {
+		http.NotFound(w, r)
+		return false
+	}
+	return true
+}
+
+// PprofCmdline serves the command line of the process
+func PprofCmdline(w http.ResponseWriter, r *http.Request) {
+	if debugEnabled(w, r) {
+		pprof.Cmdline(w, r)
+	}
+}
+
+// PprofProfile serves a cpu profile of the seconds query parameter, 30 by default
+func PprofProfile(w http.ResponseWriter, r *http.Request) {
+	if debugEnabled(w, r) {
+		pprof.Profile(w, r)
+	}
+}
+
+// PprofSymbol serves the function names of program counters
+func PprofSymbol(w http.ResponseWriter, r *http.Request) {
+	if debugEnabled(w, r) {
+		pprof.Symbol(w, r)
+	}
+}
+
+// PprofTrace serves an execution trace of the seconds query parameter, 1 by default
+func PprofTrace(w http.ResponseWriter, r *http.Request) {
+	if debugEnabled(w, r) {
+		pprof.Trace(w, r)
+	}
+}
+
+// DebugVars serves the expvar variables, memstats and cmdline included
+func DebugVars(w http.ResponseWriter, r *http.Request) {
+	if debugEnabled(w, r) {
+		expvar.Handler().ServeHTTP(w, r)
+	}
+}
+
+// PprofIndex serves the profile named in the path, or the list of profiles.
+// pprof.Index reads the name from the path after /debug/pprof/, which the
+// admin routes prefix.
+func PprofIndex(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled(w, r) {
+		return
+	}
+	req := r.Clone(r.Context())
+	req.URL.Path = "/debug/pprof/" + mux.Vars(r)["profile"]
+	pprof.Index(w, req)
+}
+
+// DumpGoroutines writes the stacks of all goroutines as text
+func DumpGoroutines(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := runtimepprof.Lookup("goroutine").WriteTo(w, 2); err != nil {
+		LoggerFromContext(r.Context()).Errorf("failed to dump goroutines: %s", err)
+	}
+}
+
+// DumpHeap writes a heap profile taken after a garbage collection, for go tool pprof
+func DumpHeap(w http.ResponseWriter, r *http.Request) {
+	if !debugEnabled(w, r) {
+		return
+	}
+	runtime.GC()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="heap-%s.pb.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	if err := runtimepprof.WriteHeapProfile(w); err != nil {
+		LoggerFromContext(r.Context()).Errorf("failed to dump the heap: %s", err)
+	}
+}
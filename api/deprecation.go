@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareDeprecation is the factory name of the deprecation middleware
+const MiddlewareDeprecation = "deprecation"
+
+// Deprecation marks a route as deprecated in its RouteDoc
+type Deprecation struct {
+	// Since is when the route was deprecated
+	Since time.Time
+	// Sunset is when the route stops being served, zero while it is not
+	// decided
+	Sunset time.Time
+	// Successor is the path of the route replacing it, if any
+	Successor string
+}
+
+// deprecationResponse is the deprecation of a route in routeDocResponse
+type deprecationResponse struct {
+	Since     time.Time  `json:"since"`
+	Sunset    *time.Time `json:"sunset,omitempty"`
+	Successor string     `json:"successor,omitempty"`
+}
+
+// newDeprecationResponse returns d as returned by GetRouteDoc
+func newDeprecationResponse(d *Deprecation) *deprecationResponse {
+	res := &deprecationResponse{Since: d.Since, Successor: d.Successor}
+	if !d.Sunset.IsZero() {
+		sunset := d.Sunset
+		res.Sunset = &sunset
+	}
+	return res
+}
+
+// routeDeprecation returns the deprecation of the route with name, nil when it
+// is not deprecated
+func routeDeprecation(name string) *Deprecation {
+	if doc, ok := routeDocs[name]; ok {
+		return doc.Deprecation
+	}
+	return nil
+}
+
+// Deprecations adds the Deprecation, Sunset and Link headers to the responses
+// of the deprecated routes and counts their requests. With
+// deprecations.enforceSunset the requests past the sunset of their route are
+// answered with 410 Gone.
+type Deprecations struct {
+	store *config.Store
+}
+
+// NewDeprecations returns the deprecation middleware following the
+// deprecations settings in store
+func NewDeprecations(store *config.Store) *Deprecations {
+	return &Deprecations{store: store}
+}
+
+func (d *Deprecations) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	name, ok := RouteName(r)
+	if !ok {
+		next(w, r)
+		return
+	}
+	deprecation := routeDeprecation(name)
+	if deprecation == nil {
+		next(w, r)
+		return
+	}
+	deprecatedRequests.WithLabelValues(name).Inc()
+
+	// RFC 9745 and RFC 8594
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecation.Since.Unix()))
+	links := []string{fmt.Sprintf(`</%s/docs/%s>; rel="deprecation"`, v1Prefix, name)}
+	if deprecation.Successor != "" {
+		links = append(links, fmt.Sprintf(`<%s>; rel="successor-version"`, deprecation.Successor))
+	}
+	w.Header().Add("Link", strings.Join(links, ", "))
+	if !deprecation.Sunset.IsZero() {
+		w.Header().Set("Sunset", deprecation.Sunset.UTC().Format(http.TimeFormat))
+		if d.store.Current().Deprecations.EnforceSunset && time.Now().After(deprecation.Sunset) {
+			writeErrorCode(w, r, CodeRouteRetired, fmt.Sprintf("the route was retired on %s", deprecation.Sunset.UTC().Format(time.RFC3339)))
+			return
+		}
+	}
+	next(w, r)
+}
@@ -0,0 +1,344 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+
+	orderproto "github.com/omnom-nom/order/proto"
+)
+
+// ErrRouteNotFound is returned when no route has the requested name
+var ErrRouteNotFound = errors.New("route not found")
+
+// RouteDoc documents a route of routes with what it does, examples of its body
+// and response and the codes of the errors it answers with
+type RouteDoc struct {
+	Summary     string
+	Description string
+	// Request is an example body, nil for the routes without one
+	Request json.RawMessage
+	// Status is the http status of Response, 200 when 0
+	Status   int
+	Response json.RawMessage
+	// Errors are the codes of the errors particular to the route, besides
+	// those of every route such as VALIDATION_FAILED
+	Errors []ErrorCode
+	// Deprecation is set once the route is deprecated
+	Deprecation *Deprecation
+}
+
+// status returns the http status of the response of the route
+func (d *RouteDoc) status() int {
+	if d.Status == 0 {
+		return http.StatusOK
+	}
+	return d.Status
+}
+
+// exampleOrder is the order of the examples of the docs
+const exampleOrder = `{
+  "id": "5f2c8a1e9b7d4c3a",
+  "customerId": "cust-42",
+  "status": "pending",
+  "items": [{"sku": "pizza-margherita", "name": "Margherita", "quantity": 2, "unitPrice": 9.5}],
+  "shippingAddress": {"line1": "Hauptstrasse 1", "city": "Berlin", "postalCode": "10115", "country": "DE"},
+  "currency": "EUR",
+  "total": 19,
+  "priority": "standard",
+  "createdAt": "2026-10-16T12:00:00Z",
+  "updatedAt": "2026-10-16T12:00:00Z",
+  "version": 1
+}`
+
+// exampleGatewayOrder is exampleOrder as the routes of the grpc gateway write
+// it, with the fields of order.proto and 64 bit integers as strings
+const exampleGatewayOrder = `{
+  "id": "5f2c8a1e9b7d4c3a",
+  "customerId": "cust-42",
+  "status": "pending",
+  "items": [{"sku": "pizza-margherita", "name": "Margherita", "quantity": 2, "unitPrice": 9.5}],
+  "shippingAddress": {"line1": "Hauptstrasse 1", "city": "Berlin", "postalCode": "10115", "country": "DE"},
+  "total": 19,
+  "createdAt": "2026-10-16T12:00:00Z",
+  "updatedAt": "2026-10-16T12:00:00Z",
+  "version": "1",
+  "currency": "EUR"
+}`
+
+// exampleFulfillment is the fulfillment of the examples of the docs
+const exampleFulfillment = `{
+  "orderId": "5f2c8a1e9b7d4c3a",
+  "status": "paid",
+  "strategy": "nearest",
+  "routedAt": "2026-10-16T12:00:01Z",
+  "warehouses": [{"warehouseId": "wh-berlin", "items": [{"sku": "pizza-margherita", "quantity": 2}]}]
+}`
+
+// routeDocs are the docs of the routes by name. GetRouteDoc serves them and
+// OpenAPI adds them to the operations of the generated document.
+var routeDocs = map[string]*RouteDoc{
+	"CreateOrder": {
+		Summary: "Create an order",
+		Description: "Creates a pending order of the items of the body, priced with the pricing engine, " +
+			"and takes its payment with the payment method while payments are enabled.",
+		Request: json.RawMessage(`{
+  "customerId": "cust-42",
+  "items": [{"sku": "pizza-margherita", "quantity": 2}],
+  "shippingAddress": {"line1": "Hauptstrasse 1", "city": "Berlin", "postalCode": "10115", "country": "DE"},
+  "currency": "EUR",
+  "paymentMethod": "pm_card_visa"
+}`),
+		Status:   http.StatusCreated,
+		Response: json.RawMessage(exampleGatewayOrder),
+		Errors:   []ErrorCode{CodeOrderExists, CodeDuplicateOrder, CodeOutOfStock, CodePaymentDeclined, CodeOrderRejected},
+	},
+	"GetOrder": {
+		Summary:     "Read an order",
+		Description: "Returns the order named in the path with its version as ETag.",
+		Response:    json.RawMessage(exampleGatewayOrder),
+		Errors:      []ErrorCode{CodeOrderNotFound},
+	},
+	"OrderStatus": {
+		Summary: "Read or wait for the status of an order",
+		Description: "Returns the status of the order named in the path. With a wait duration like wait=30s " +
+			"the request is held until the status differs from the status query parameter or the wait expires.",
+		Response: json.RawMessage(`{"id": "5f2c8a1e9b7d4c3a", "status": "paid", "statusText": "Bezahlt", "updatedAt": "2026-10-16T12:00:00Z"}`),
+		Errors:   []ErrorCode{CodeOrderNotFound},
+	},
+	"CancelOrder": {
+		Summary: "Cancel an order",
+		Description: "Cancels the order named in the path with a reason code and refunds it if it was paid. " +
+			"Cancelling a cancelled order retries a failed refund.",
+		Request:  json.RawMessage(`{"reason": "customer_request", "note": "ordered twice"}`),
+		Response: json.RawMessage(exampleOrder),
+		Errors:   []ErrorCode{CodeOrderNotFound, CodeOrderNotCancellable, CodeOrderLocked, CodePreconditionFailed},
+	},
+	"GetFulfillment": {
+		Summary:     "Read the routing of an order",
+		Description: "Returns the warehouses the order named in the path is routed to and the items each of them ships.",
+		Response:    json.RawMessage(exampleFulfillment),
+		Errors:      []ErrorCode{CodeOrderNotFound},
+	},
+	"RouteOrder": {
+		Summary: "Route an order again",
+		Description: "Routes a pending or paid order to the warehouses again, with the strategy of the optional body " +
+			"or that of the configuration for the priority of the order.",
+		Request:  json.RawMessage(`{"strategy": "stock"}`),
+		Response: json.RawMessage(exampleFulfillment),
+		Errors:   []ErrorCode{CodeOrderNotFound, CodeOrderUnroutable, CodeOrderNotShippable, CodeNotSupported},
+	},
+	"UpgradePriority": {
+		Summary: "Raise the priority of an order",
+		Description: "Raises the priority of a pending, paid or held order within the upgrade window " +
+			"and routes it again with the strategy of its new priority.",
+		Request:  json.RawMessage(`{"priority": "rush"}`),
+		Response: json.RawMessage(strings.Replace(exampleOrder, `"standard"`, `"rush"`, 1)),
+		Errors:   []ErrorCode{CodeOrderNotFound, CodePriorityNotUpgradable, CodeOrderLocked, CodePreconditionFailed},
+	},
+	"ListErrorCodes": {
+		Summary:     "List the error codes",
+		Description: "Returns the catalog of the codes of the error responses with the http status and grpc code of each.",
+		Response:    json.RawMessage(`{"errors": [{"code": "ORDER_NOT_FOUND", "status": 404, "grpcCode": "NotFound", "description": "The order does not exist."}]}`),
+	},
+	"GetRouteDoc": {
+		Summary:     "Document a route",
+		Description: "Returns the docs of the route named in the path, with the examples and errors of the routes documented.",
+		Response: json.RawMessage(`{
+  "name": "UpgradePriority",
+  "method": "POST",
+  "path": "/v1/order/{orderId}/priority",
+  "summary": "Raise the priority of an order",
+  "request": {"priority": "rush"},
+  "status": 200,
+  "errors": [{"code": "PRIORITY_NOT_UPGRADABLE", "status": 409, "grpcCode": "FailedPrecondition", "description": "The priority of the order can not be raised to the one asked for."}]
+}`),
+		Errors: []ErrorCode{CodeNotFound},
+	},
+}
+
+// catalogEntry returns the entry of the error catalog of code
+func catalogEntry(code ErrorCode) *errorCatalogEntry {
+	for _, kind := range errorCatalog {
+		if kind.code == code {
+			return &errorCatalogEntry{Code: kind.code, Status: kind.status, GRPCCode: kind.grpc.String(), Description: kind.description}
+		}
+	}
+	return nil
+}
+
+// routeDocResponse is the body of GetRouteDoc
+type routeDocResponse struct {
+	Name        string          `json:"name"`
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Summary     string          `json:"summary,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Request     json.RawMessage `json:"request,omitempty"`
+	// Status and Response are left out of the routes without docs
+	Status   int                  `json:"status,omitempty"`
+	Response json.RawMessage      `json:"response,omitempty"`
+	Errors   []*errorCatalogEntry `json:"errors,omitempty"`
+	// Deprecation is set for the deprecated routes
+	Deprecation *deprecationResponse `json:"deprecation,omitempty"`
+}
+
+// newRouteDocResponse returns the docs of the route described by info
+func newRouteDocResponse(info routeInfo) *routeDocResponse {
+	res := &routeDocResponse{Name: info.Name, Method: info.Method, Path: info.Path}
+	doc, ok := routeDocs[info.Name]
+	if !ok {
+		return res
+	}
+	res.Summary, res.Description = doc.Summary, doc.Description
+	if doc.Deprecation != nil {
+		res.Deprecation = newDeprecationResponse(doc.Deprecation)
+	}
+	res.Request, res.Status, res.Response = doc.Request, doc.status(), doc.Response
+	for _, code := range doc.Errors {
+		if entry := catalogEntry(code); entry != nil {
+			res.Errors = append(res.Errors, entry)
+		}
+	}
+	return res
+}
+
+// GetRouteDoc returns the method, path and docs of the route named in the
+// path, as listed by ListRoutes. The routes without docs are answered with
+// their method and path only.
+func GetRouteDoc(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["routeName"]
+	for _, info := range routeTable {
+		if info.Name == name {
+			writeJSON(w, r, http.StatusOK, newRouteDocResponse(info))
+			return
+		}
+	}
+	writeError(w, r, ErrRouteNotFound)
+}
+
+// pathParam matches the parameters of the paths of routes and of the OpenAPI
+// document, whose names differ such as {id} and {orderId}
+var pathParam = regexp.MustCompile(`{[^}]+}`)
+
+// openAPI is the OpenAPI document served, built once from the generated one
+var openAPI struct {
+	once sync.Once
+	doc  []byte
+}
+
+// openAPIDocument returns the generated OpenAPI document with the docs of
+// routeDocs added to its operations, and the operations of the documented
+// routes it lacks. It is the generated document when it can not be parsed.
+func openAPIDocument() []byte {
+	openAPI.once.Do(func() {
+		openAPI.doc = orderproto.OpenAPI
+		var doc map[string]interface{}
+		if err := json.Unmarshal(orderproto.OpenAPI, &doc); err != nil {
+			return
+		}
+		paths, _ := doc["paths"].(map[string]interface{})
+		if paths == nil {
+			paths = map[string]interface{}{}
+			doc["paths"] = paths
+		}
+		for _, info := range routeTable {
+			if routeDoc, ok := routeDocs[info.Name]; ok {
+				documentOperation(paths, info, routeDoc)
+			}
+		}
+		if b, err := json.Marshal(doc); err == nil {
+			openAPI.doc = b
+		}
+	})
+	return openAPI.doc
+}
+
+// documentOperation adds doc to the operation of the route described by info
+// in paths, adding the operation when paths lacks it
+func documentOperation(paths map[string]interface{}, info routeInfo, doc *RouteDoc) {
+	key := info.Path
+	for path := range paths {
+		if pathParam.ReplaceAllString(path, "{}") == pathParam.ReplaceAllString(info.Path, "{}") {
+			key = path
+			break
+		}
+	}
+	item, _ := paths[key].(map[string]interface{})
+	if item == nil {
+		item = map[string]interface{}{}
+		paths[key] = item
+	}
+	method := strings.ToLower(info.Method)
+	op, _ := item[method].(map[string]interface{})
+	if op == nil {
+		op = map[string]interface{}{"operationId": info.Name}
+		var params []interface{}
+		for _, param := range pathParam.FindAllString(key, -1) {
+			params = append(params, map[string]interface{}{
+				"name": strings.Trim(param, "{}"), "in": "path", "required": true, "type": "string",
+			})
+		}
+		if doc.Request != nil {
+			params = append(params, map[string]interface{}{
+				"name": "body", "in": "body", "required": true, "schema": map[string]interface{}{"type": "object"},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		item[method] = op
+	}
+	if doc.Summary != "" {
+		op["summary"] = doc.Summary
+	}
+	if doc.Description != "" {
+		op["description"] = doc.Description
+	}
+	if doc.Deprecation != nil {
+		op["deprecated"] = true
+	}
+	if doc.Request != nil {
+		params, _ := op["parameters"].([]interface{})
+		for _, p := range params {
+			if param, ok := p.(map[string]interface{}); ok && param["in"] == "body" {
+				param["x-examples"] = map[string]interface{}{"application/json": doc.Request}
+			}
+		}
+	}
+
+	responses, _ := op["responses"].(map[string]interface{})
+	if responses == nil {
+		responses = map[string]interface{}{}
+		op["responses"] = responses
+	}
+	status := strconv.Itoa(doc.status())
+	res, _ := responses[status].(map[string]interface{})
+	if res == nil {
+		res = map[string]interface{}{"description": http.StatusText(doc.status())}
+		responses[status] = res
+	}
+	if doc.Response != nil {
+		res["examples"] = map[string]interface{}{"application/json": doc.Response}
+	}
+
+	// the error responses list the codes of their status
+	codes := map[string][]string{}
+	for _, code := range doc.Errors {
+		if entry := catalogEntry(code); entry != nil {
+			s := strconv.Itoa(entry.Status)
+			codes[s] = append(codes[s], string(entry.Code)+": "+entry.Description)
+		}
+	}
+	for s, lines := range codes {
+		if _, ok := responses[s]; !ok {
+			responses[s] = map[string]interface{}{"description": strings.Join(lines, "\n")}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/documents"
+	"github.com/omnom-nom/order/money"
+)
+
+// ErrDocumentNotFound is returned when a document store has no document with
+// the requested key
+var ErrDocumentNotFound = errors.New("document not found")
+
+// DocumentStore keeps the rendered documents of orders
+type DocumentStore interface {
+	// GetDocument returns the document stored with key, or ErrDocumentNotFound
+	GetDocument(ctx context.Context, key string) ([]byte, error)
+	// PutDocument stores the document body of contentType with key
+	PutDocument(ctx context.Context, key, contentType string, body []byte) error
+}
+
+// s3DocumentStore keeps documents as the objects of their keys under a prefix
+type s3DocumentStore struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewS3DocumentStore returns a document store in the bucket of the document
+// storage of cfg, with the region and credentials of the database
+func NewS3DocumentStore(ctx context.Context, cfg *config.Config) (DocumentStore, error) {
+	storage := cfg.Documents.Storage
+	client, err := newS3Client(ctx, cfg, storage.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3DocumentStore{client: client, bucket: storage.Bucket, prefix: storage.Prefix}, nil
+}
+
+func (s *s3DocumentStore) GetDocument(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	var noSuchKey *s3types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, ErrDocumentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document %s: %v", key, err)
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (s *s3DocumentStore) PutDocument(ctx context.Context, key, contentType string, body []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.prefix + key),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write document %s: %v", key, err)
+	}
+	return nil
+}
+
+// Documents renders the invoices and packing slips of orders, keeping them in
+// its store when it has one. A stored document is served as it was rendered,
+// so a version of an order keeps its invoice whatever the templates and
+// branding later become.
+type Documents struct {
+	renderer *documents.Renderer
+	store    DocumentStore
+}
+
+// NewDocuments returns the documents of the templates and branding of cfg
+func NewDocuments(cfg *config.DocumentsConfig) (*Documents, error) {
+	renderer, err := documents.NewRenderer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Documents{renderer: renderer}, nil
+}
+
+// WithStore keeps the rendered documents in store
+func (d *Documents) WithStore(store DocumentStore) *Documents {
+	d.store = store
+	return d
+}
+
+type documentsKey struct{}
+
+// WithDocuments returns a copy of ctx carrying docs
+func WithDocuments(ctx context.Context, docs *Documents) context.Context {
+	return context.WithValue(ctx, documentsKey{}, docs)
+}
+
+// DocumentsFromContext returns the documents stored in ctx, or nil when they
+// are not rendered
+func DocumentsFromContext(ctx context.Context) *Documents {
+	docs, _ := ctx.Value(documentsKey{}).(*Documents)
+	return docs
+}
+
+// documentKey is the key of the document of a version of order in format
+func documentKey(order *Order, document, format string) string {
+	return order.ID + "/" + document + "-" + strconv.FormatInt(order.Version, 10) + "." + format
+}
+
+// Document returns the document of order in format, the stored one when the
+// store has it
+func (d *Documents) Document(ctx context.Context, order *Order, document, format string) ([]byte, error) {
+	key := documentKey(order, document, format)
+	if d.store != nil {
+		body, err := d.store.GetDocument(ctx, key)
+		if err == nil {
+			documentsServed.WithLabelValues(document, format, "stored").Inc()
+			return body, nil
+		}
+		if !errors.Is(err, ErrDocumentNotFound) {
+			return nil, err
+		}
+	}
+	body, err := d.renderer.Render(format, order.TenantID, newDocumentData(order, document, time.Now().UTC()))
+	if err != nil {
+		return nil, err
+	}
+	documentsServed.WithLabelValues(document, format, "rendered").Inc()
+	if d.store != nil {
+		if err := d.store.PutDocument(ctx, key, documents.ContentType(format), body); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// newDocumentData returns what the templates of document render of order
+// issued at now
+func newDocumentData(order *Order, document string, now time.Time) *documents.Data {
+	data := &documents.Data{
+		Document:      document,
+		OrderID:       order.ID,
+		Status:        string(order.Status),
+		PlacedAt:      order.CreatedAt,
+		IssuedAt:      now,
+		CustomerID:    order.CustomerID,
+		PurchaseOrder: order.PurchaseOrder,
+		Total:         order.Total.String(),
+	}
+	if order.Terms != nil {
+		data.TermsDays, data.DueAt = order.Terms.Days, order.Terms.DueAt
+		data.AmountDue = order.cardAmount().String()
+	}
+	if a := order.ShippingAddress; a != nil {
+		city := strings.Join(strings.Fields(a.PostalCode+" "+a.City+" "+a.State), " ")
+		for _, line := range []string{a.Name, a.Line1, a.Line2, city, a.Country} {
+			if line != "" {
+				data.ShippingAddress = append(data.ShippingAddress, line)
+			}
+		}
+	}
+	subtotal := money.New(0, order.Currency)
+	for _, item := range order.Items {
+		total := item.UnitPrice.Mul(int64(item.Quantity))
+		subtotal = subtotal.Add(total)
+		line := documents.Item{SKU: item.SKU, Name: item.Name, Quantity: item.Quantity}
+		if document == documents.Invoice {
+			line.UnitPrice, line.Total = item.UnitPrice.String(), total.String()
+		}
+		data.Items = append(data.Items, line)
+	}
+	data.Subtotal = subtotal.String()
+	if p := order.Pricing; p != nil {
+		amount := func(v money.Money) string {
+			if v.IsZero() {
+				return ""
+			}
+			return v.String()
+		}
+		data.Subtotal = p.Subtotal.String()
+		data.Discount = amount(p.Discount)
+		data.Shipping = amount(p.Shipping)
+		data.Tax = amount(p.Tax)
+		data.TaxRate = math.Round(p.TaxRate*10000) / 100
+	}
+	for _, shipment := range order.Shipments {
+		data.Shipments = append(data.Shipments, documents.Shipment{Carrier: shipment.Carrier, TrackingNumber: shipment.TrackingNumber})
+	}
+	return data
+}
+
+// documentFormat returns the format of the document requested by r, from the
+// format parameter or else the Accept header
+func documentFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case documents.FormatHTML, documents.FormatPDF:
+		return format, nil
+	case "":
+		if strings.Contains(r.Header.Get("Accept"), documents.ContentType(documents.FormatPDF)) {
+			return documents.FormatPDF, nil
+		}
+		return documents.FormatHTML, nil
+	default:
+		return "", &ValidationError{Field: "format", Reason: fmt.Sprintf("must be %s or %s", documents.FormatHTML, documents.FormatPDF)}
+	}
+}
+
+// GetInvoice returns the invoice of the order named in the path, as html or pdf
+func GetInvoice(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, documents.Invoice)
+}
+
+// GetPackingSlip returns the packing slip of the order named in the path, as
+// html or pdf
+func GetPackingSlip(w http.ResponseWriter, r *http.Request) {
+	serveDocument(w, r, documents.PackingSlip)
+}
+
+// serveDocument writes document of the order named in the path
+func serveDocument(w http.ResponseWriter, r *http.Request, document string) {
+	ctx := r.Context()
+	docs := DocumentsFromContext(ctx)
+	if docs == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	format, err := documentFormat(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	order, err := RepositoryFromContext(ctx).GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := docs.Document(ctx, order, document, format)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", documents.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s-%s.%s"`, document, order.ID, format))
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,398 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	// ErrDraftNotFound is returned when no draft has the requested id or it expired
+	ErrDraftNotFound = errors.New("draft not found")
+	// ErrDraftCheckedOut is returned when changing a draft that became an order
+	ErrDraftCheckedOut = errors.New("draft was checked out")
+)
+
+// DraftStatus is the state of a draft order
+type DraftStatus string
+
+const (
+	DraftOpen DraftStatus = "open"
+	// DraftCheckedOut marks a draft converted into the order OrderID
+	DraftCheckedOut DraftStatus = "checked_out"
+)
+
+// Draft is a draft order, or cart, of a customer. It is changed and quoted until
+// it is checked out into an order, and expires when it is left untouched.
+type Draft struct {
+	ID              string      `json:"id" dynamodbav:"draftId"`
+	CustomerID      string      `json:"customerId" dynamodbav:"customerId"`
+	Status          DraftStatus `json:"status" dynamodbav:"status"`
+	Items           []LineItem  `json:"items" dynamodbav:"items"`
+	ShippingAddress *Address    `json:"shippingAddress,omitempty" dynamodbav:"shippingAddress,omitempty"`
+	DiscountCodes   []string    `json:"discountCodes,omitempty" dynamodbav:"discountCodes,omitempty"`
+	// OrderID is the order the draft was checked out into
+	OrderID   string    `json:"orderId,omitempty" dynamodbav:"orderId,omitempty"`
+	CreatedAt time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	// ExpiresAt is the unix time the draft expires at, DynamoDB deletes it after
+	ExpiresAt int64 `json:"expiresAt" dynamodbav:"expiresAt"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// Expired reports whether the draft expired at now
+func (d *Draft) Expired(now time.Time) bool {
+	return d.ExpiresAt > 0 && d.ExpiresAt <= now.Unix()
+}
+
+// touch sets the update time of d to now and keeps it for ttl from now
+func (d *Draft) touch(now time.Time, ttl time.Duration) {
+	d.UpdatedAt = now
+	d.ExpiresAt = now.Add(ttl).Unix()
+}
+
+// document returns the editable fields of d
+func (d *Draft) document() *orderDocument {
+	return &orderDocument{Items: d.Items, ShippingAddress: d.ShippingAddress, DiscountCodes: d.DiscountCodes}
+}
+
+// DraftStore is implemented by repositories keeping draft orders, which they do
+// once EnableDrafts is called.
+type DraftStore interface {
+	// CreateDraft stores a new draft
+	CreateDraft(ctx context.Context, draft *Draft) error
+	// GetDraft returns the draft with id, or ErrDraftNotFound when there is none
+	// or it expired
+	GetDraft(ctx context.Context, id string) (*Draft, error)
+	// UpdateDraft replaces a draft if its stored version equals draft.Version,
+	// incrementing draft.Version. It fails with ErrDraftNotFound or
+	// ErrVersionConflict.
+	UpdateDraft(ctx context.Context, draft *Draft) error
+	// DeleteDraft removes the draft with id, or fails with ErrDraftNotFound
+	DeleteDraft(ctx context.Context, id string) error
+}
+
+// draftsEnabler is implemented by repositories able to keep drafts
+type draftsEnabler interface {
+	enableDrafts(table string)
+}
+
+// EnableDrafts makes repo keep drafts, in table for the backends that keep them
+// in a separate table
+func EnableDrafts(repo Repository, table string) error {
+	enabler, ok := repo.(draftsEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support drafts", repo)
+	}
+	enabler.enableDrafts(table)
+	return nil
+}
+
+// findDraftStore returns the draft store of repo or of the repository it decorates
+func findDraftStore(repo Repository) (DraftStore, bool) {
+	var store DraftStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(DraftStore)
+		return ok
+	})
+	return store, found
+}
+
+// draftStoreFromContext returns the draft store of the request repository or ErrNotSupported
+func draftStoreFromContext(ctx context.Context) (DraftStore, error) {
+	store, ok := findDraftStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// validateDraft checks the contents of a draft, which may still be empty
+func validateDraft(doc *orderDocument) error {
+	if len(doc.Items) > 0 {
+		if err := validateItems(doc.Items); err != nil {
+			return err
+		}
+	}
+	if doc.ShippingAddress != nil {
+		return validateAddress("shippingAddress", doc.ShippingAddress)
+	}
+	return nil
+}
+
+// createDraftRequest is the body of CreateDraft
+type createDraftRequest struct {
+	CustomerID      string     `json:"customerId"`
+	Items           []LineItem `json:"items,omitempty"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	DiscountCodes   []string   `json:"discountCodes,omitempty"`
+}
+
+// checkoutRequest is the body of CheckoutDraft
+type checkoutRequest struct {
+	// PaymentMethod is the token of the payment method at the payment provider,
+	// required while payments are enabled
+	PaymentMethod string `json:"paymentMethod,omitempty"`
+	// AllowDuplicate places the order even if it repeats a recent order of the
+	// customer
+	AllowDuplicate bool `json:"allowDuplicate,omitempty"`
+}
+
+// CreateDraft stores the draft described by the body with a new id
+func CreateDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req createDraftRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.CustomerID == "" {
+		writeError(w, r, &ValidationError{Field: "customerId", Reason: "is required"})
+		return
+	}
+	draft := &Draft{
+		ID:              newID(),
+		CustomerID:      req.CustomerID,
+		Status:          DraftOpen,
+		Items:           req.Items,
+		ShippingAddress: req.ShippingAddress,
+		DiscountCodes:   req.DiscountCodes,
+		Version:         1,
+	}
+	if draft.Items == nil {
+		draft.Items = []LineItem{}
+	}
+	if err := validateDraft(draft.document()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	draft.CreatedAt = now
+	draft.touch(now, ConfigFromContext(ctx).Drafts.TTL.Duration)
+
+	if err := store.CreateDraft(ctx, draft); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("created draft %s", draft.ID)
+	writeJSON(w, r, http.StatusCreated, draft)
+}
+
+// GetDraft returns the draft named in the path
+func GetDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	draft, err := store.GetDraft(ctx, mux.Vars(r)["draftId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, draft)
+}
+
+// EditDraft applies the JSON Merge Patch or JSON Patch of the body to the items,
+// shippingAddress and discountCodes of the open draft named in the path, which
+// keeps the draft for another drafts.ttl
+func EditDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPatchBody))
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	patch, err := parsePatch(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	draft, err := store.GetDraft(ctx, mux.Vars(r)["draftId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if draft.Status != DraftOpen {
+		writeError(w, r, ErrDraftCheckedOut)
+		return
+	}
+	doc, err := applyPatch(draft.document(), patch)
+	if err == nil {
+		err = validateDraft(doc)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	draft.Items, draft.ShippingAddress, draft.DiscountCodes = doc.Items, doc.ShippingAddress, doc.DiscountCodes
+	if draft.Items == nil {
+		draft.Items = []LineItem{}
+	}
+	draft.touch(time.Now().UTC(), ConfigFromContext(ctx).Drafts.TTL.Duration)
+	if err := store.UpdateDraft(ctx, draft); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, draft)
+}
+
+// QuoteDraft returns the price breakdown of the draft named in the path
+func QuoteDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	draft, err := store.GetDraft(ctx, mux.Vars(r)["draftId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := validateItems(draft.Items); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	currency, err := orderCurrency(ctx, "")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	breakdown, err := quote(ctx, currency, draft.Items, draft.ShippingAddress, draft.DiscountCodes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, breakdown)
+}
+
+// DeleteDraft abandons the draft named in the path
+func DeleteDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["draftId"]
+	if err := store.DeleteDraft(ctx, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("deleted draft %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CheckoutDraft converts the draft named in the path into an order paid with the
+// payment method of the body
+func CheckoutDraft(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := draftStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var req checkoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+
+	order, err := checkoutDraft(ctx, RepositoryFromContext(ctx), store, mux.Vars(r)["draftId"], &req)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	writeJSON(w, r, http.StatusCreated, order)
+}
+
+// checkoutDraft converts the draft with id into an order. The draft is marked
+// checked out, with the id of its order, before the order is created, so a
+// concurrent change or checkout of the draft fails with ErrVersionConflict and a
+// draft never becomes two orders. Checking out a checked out draft returns its
+// order, creating it if an earlier checkout stopped before it did. When no order
+// is placed, e.g. the items are out of stock or the payment is declined, the
+// draft is open again.
+func checkoutDraft(ctx context.Context, repo Repository, store DraftStore, id string, req *checkoutRequest) (*Order, error) {
+	draft, err := store.GetDraft(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if draft.Status == DraftCheckedOut {
+		order, err := repo.GetOrder(ctx, draft.OrderID)
+		if !errors.Is(err, ErrOrderNotFound) {
+			return order, err
+		}
+	} else {
+		draft.Status = DraftCheckedOut
+		draft.OrderID = newID()
+		draft.UpdatedAt = time.Now().UTC()
+		if err := store.UpdateDraft(ctx, draft); err != nil {
+			return nil, err
+		}
+	}
+
+	order, err := createOrder(ctx, repo, &createOrderRequest{
+		CustomerID:      draft.CustomerID,
+		Items:           draft.Items,
+		ShippingAddress: draft.ShippingAddress,
+		DiscountCodes:   draft.DiscountCodes,
+		PaymentMethod:   req.PaymentMethod,
+		AllowDuplicate:  req.AllowDuplicate,
+	}, draft.OrderID)
+	if errors.Is(err, ErrOrderExists) {
+		order, err = repo.GetOrder(ctx, draft.OrderID)
+	}
+	if err != nil {
+		reopenDraft(ctx, repo, store, draft)
+		return nil, err
+	}
+	LoggerFromContext(ctx).Infof("checked out draft %s into order %s", draft.ID, order.ID)
+	return order, nil
+}
+
+// reopenDraft opens a draft whose checkout failed again, unless its order was
+// placed after all
+func reopenDraft(ctx context.Context, repo Repository, store DraftStore, draft *Draft) {
+	order, err := repo.GetOrder(ctx, draft.OrderID)
+	if err == nil && order.Status != StatusCancelled {
+		return
+	}
+	if err != nil && !errors.Is(err, ErrOrderNotFound) {
+		LoggerFromContext(ctx).Errorf("failed to read order %s of draft %s: %v", draft.OrderID, draft.ID, err)
+		return
+	}
+	draft.Status = DraftOpen
+	draft.OrderID = ""
+	draft.UpdatedAt = time.Now().UTC()
+	if err := store.UpdateDraft(ctx, draft); err != nil {
+		LoggerFromContext(ctx).Errorf("failed to reopen draft %s: %v", draft.ID, err)
+	}
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Drain takes an instance out of rotation before it is stopped: while it is
+// draining its health check fails, so load balancers stop sending it new
+// requests, and it goes on serving the requests that still reach it, closing
+// their connections after the response.
+type Drain struct {
+	mu sync.Mutex
+	// since is the start of the drain, zero while the instance is in rotation
+	since time.Time
+}
+
+// drainState is the body of the drain routes
+type drainState struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// Start starts draining the instance, it keeps the start of a drain in progress
+func (d *Drain) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		d.since = time.Now().UTC()
+	}
+}
+
+// Stop puts the instance back in rotation
+func (d *Drain) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.since = time.Time{}
+}
+
+// Draining reports whether the instance is draining
+func (d *Drain) Draining() bool {
+	return d.state().Draining
+}
+
+func (d *Drain) state() drainState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.since.IsZero() {
+		return drainState{}
+	}
+	since := d.since
+	return drainState{Draining: true, Since: &since}
+}
+
+type drainKey struct{}
+
+// WithDrain returns a copy of ctx carrying drain
+func WithDrain(ctx context.Context, drain *Drain) context.Context {
+	return context.WithValue(ctx, drainKey{}, drain)
+}
+
+// DrainFromContext returns the drain of the instance stored in ctx, or nil
+func DrainFromContext(ctx context.Context) *Drain {
+	drain, _ := ctx.Value(drainKey{}).(*Drain)
+	return drain
+}
+
+// GetDrain returns whether the instance answering is draining and since when
+func GetDrain(w http.ResponseWriter, r *http.Request) {
+	writeDrain(w, r, nil)
+}
+
+// StartDrain makes the instance answering fail its health check until the drain is stopped
+func StartDrain(w http.ResponseWriter, r *http.Request) {
+	writeDrain(w, r, (*Drain).Start)
+}
+
+// StopDrain puts the instance answering back in rotation
+func StopDrain(w http.ResponseWriter, r *http.Request) {
+	writeDrain(w, r, (*Drain).Stop)
+}
+
+// writeDrain applies change, when not nil, to the drain of the request and writes its state
+func writeDrain(w http.ResponseWriter, r *http.Request, change func(d *Drain)) {
+	drain := DrainFromContext(r.Context())
+	if drain == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	if change != nil {
+		change(drain)
+		LoggerFromContext(r.Context()).Infof("draining changed to %t", drain.Draining())
+	}
+	state := drain.state()
+	writeJSON(w, r, http.StatusOK, &state)
+}
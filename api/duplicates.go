@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// ErrDuplicateOrder is returned when a new order repeats a recent order of its
+// customer while suspected duplicates are blocked
+var ErrDuplicateOrder = errors.New("order repeats a recent order of the customer")
+
+// maxDuplicateCandidates is the number of recent orders of the customer a new
+// order is compared with
+const maxDuplicateCandidates = 20
+
+// duplicateOfHeader is the grpc header metadata naming the order a new order
+// is suspected to repeat, the gateway answers it as X-Duplicate-Of
+const duplicateOfHeader = "x-duplicate-of"
+
+// sameItems reports whether a and b hold the same quantities of the same SKUs,
+// in any order
+func sameItems(a, b []LineItem) bool {
+	quantities := map[string]int{}
+	for _, item := range a {
+		quantities[item.SKU] += item.Quantity
+	}
+	for _, item := range b {
+		quantities[item.SKU] -= item.Quantity
+	}
+	for _, quantity := range quantities {
+		if quantity != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// repeats reports whether order repeats other: the same customer, items and
+// total, other being neither order itself nor cancelled
+func (o *Order) repeats(other *Order) bool {
+	return other.ID != o.ID && other.CustomerID == o.CustomerID && other.Status != StatusCancelled &&
+		other.Currency == o.Currency && other.Total.Cmp(o.Total) == 0 && sameItems(other.Items, o.Items)
+}
+
+// findDuplicate returns the most recent order the new order repeats among
+// those its customer placed within window, or nil
+func findDuplicate(ctx context.Context, repo Repository, order *Order, window time.Duration) (*Order, error) {
+	// the orders of a customer are listed newest first
+	orders, _, err := repo.ListOrders(ctx, ListOptions{CustomerID: order.CustomerID, Limit: maxDuplicateCandidates})
+	if err != nil {
+		return nil, err
+	}
+	since := order.CreatedAt.Add(-window)
+	for _, other := range orders {
+		if other.CreatedAt.Before(since) {
+			break
+		}
+		if order.repeats(other) {
+			return other, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkDuplicate flags order as repeating a recent order of its customer, or
+// refuses it with ErrDuplicateOrder, as the action of cfg says. An order
+// whose recent orders can not be read is let through.
+func checkDuplicate(ctx context.Context, repo Repository, order *Order, cfg *config.DuplicatesConfig) error {
+	duplicate, err := findDuplicate(ctx, repo, order, cfg.Window.Duration)
+	if err != nil {
+		LoggerFromContext(ctx).Warnf("failed to look for duplicates of order %s: %v", order.ID, err)
+		return nil
+	}
+	if duplicate == nil {
+		return nil
+	}
+	duplicateOrders.WithLabelValues(cfg.Action).Inc()
+	if cfg.Action == config.DuplicateActionBlock {
+		LoggerFromContext(ctx).Infof("refused order of customer %s repeating order %s", order.CustomerID, duplicate.ID)
+		return fmt.Errorf("%w: %s", ErrDuplicateOrder, duplicate.ID)
+	}
+	LoggerFromContext(ctx).Warnf("order %s of customer %s repeats order %s", order.ID, order.CustomerID, duplicate.ID)
+	order.DuplicateOf = duplicate.ID
+	return nil
+}
@@ -0,0 +1,296 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/payments"
+)
+
+var (
+	// ErrNotEditable is returned when editing an order that has shipped, is closed
+	// or whose payment is still being settled
+	ErrNotEditable = errors.New("order can no longer be edited")
+	// ErrUnsupportedPatch is returned for a PATCH body that is neither a JSON Merge
+	// Patch nor a JSON Patch
+	ErrUnsupportedPatch = errors.New("patch must be application/merge-patch+json or application/json-patch+json")
+)
+
+// content types of the patches EditOrder applies
+const (
+	ContentTypeMergePatch = "application/merge-patch+json"
+	ContentTypeJSONPatch  = "application/json-patch+json"
+)
+
+const (
+	// maxOrderEdits is the number of edits kept per order, the oldest are dropped
+	maxOrderEdits = 50
+	// maxPatchBody bounds the patches read by EditOrder
+	maxPatchBody = 1 << 20
+)
+
+// FieldChange is the value of a field of an order before and after an edit
+type FieldChange struct {
+	Field  string          `json:"field" dynamodbav:"field"`
+	Before json.RawMessage `json:"before" dynamodbav:"before"`
+	After  json.RawMessage `json:"after" dynamodbav:"after"`
+}
+
+// OrderEdit is the audit record of an edit of an order
+type OrderEdit struct {
+	// Version is the version of the order the edit produced
+	Version     int64         `json:"version" dynamodbav:"version"`
+	EditedAt    time.Time     `json:"editedAt" dynamodbav:"editedAt"`
+	RequestID   string        `json:"requestId,omitempty" dynamodbav:"requestId,omitempty"`
+	ClientIP    string        `json:"clientIp,omitempty" dynamodbav:"clientIp,omitempty"`
+	Changes     []FieldChange `json:"changes" dynamodbav:"changes"`
+	TotalBefore money.Money   `json:"totalBefore" dynamodbav:"totalBefore"`
+	TotalAfter  money.Money   `json:"totalAfter" dynamodbav:"totalAfter"`
+	// Refund is the state of the refund of a paid order whose total went down
+	Refund RefundStatus `json:"refund,omitempty" dynamodbav:"refund,omitempty"`
+}
+
+// Editable reports whether the items and shipping address of the order may still
+// change: until it ships, and not while its payment is being settled
+func (o *Order) Editable() bool {
+	if !o.Cancellable() || len(o.Shipments) > 0 {
+		return false
+	}
+	return o.Payment == nil || o.Payment.Status == payments.StatusCaptured
+}
+
+// orderDocument is the part of an order a patch edits, patches changing any other
+// field are rejected
+type orderDocument struct {
+	Items           []LineItem `json:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	DiscountCodes   []string   `json:"discountCodes,omitempty"`
+}
+
+// document returns the editable fields of o
+func (o *Order) document() *orderDocument {
+	doc := &orderDocument{Items: o.Items, ShippingAddress: o.ShippingAddress}
+	if o.Pricing != nil {
+		for _, discount := range o.Pricing.Discounts {
+			doc.DiscountCodes = append(doc.DiscountCodes, discount.Code)
+		}
+	}
+	return doc
+}
+
+// orderPatch applies a patch to the json of an orderDocument
+type orderPatch func(doc []byte) ([]byte, error)
+
+// parsePatch returns the patch of body, a JSON Merge Patch (RFC 7386) or a JSON
+// Patch (RFC 6902) by contentType. Plain json is taken as a merge patch.
+func parsePatch(contentType string, body []byte) (orderPatch, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, ErrUnsupportedPatch
+	}
+	switch mediaType {
+	case ContentTypeMergePatch, "application/json":
+		return func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}, nil
+	case ContentTypeJSONPatch:
+		patch, err := jsonpatch.DecodePatch(body)
+		if err != nil {
+			return nil, &ValidationError{Field: "body", Reason: err.Error()}
+		}
+		return patch.Apply, nil
+	}
+	return nil, ErrUnsupportedPatch
+}
+
+// applyPatch returns the document patch makes of doc, with its address validated
+func applyPatch(doc *orderDocument, patch orderPatch) (*orderDocument, error) {
+	original, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := patch(original)
+	if err != nil {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+
+	var edited orderDocument
+	dec := json.NewDecoder(bytes.NewReader(patched))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&edited); err != nil {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	if edited.ShippingAddress != nil {
+		if err := validateAddress("shippingAddress", edited.ShippingAddress); err != nil {
+			return nil, err
+		}
+	}
+	return &edited, nil
+}
+
+// diffDocuments returns the fields that differ between before and after
+func diffDocuments(before, after *orderDocument) ([]FieldChange, error) {
+	fields := []struct {
+		name          string
+		before, after interface{}
+	}{
+		{"items", before.Items, after.Items},
+		{"shippingAddress", before.ShippingAddress, after.ShippingAddress},
+		{"discountCodes", before.DiscountCodes, after.DiscountCodes},
+	}
+	var changes []FieldChange
+	for _, f := range fields {
+		b, err := json.Marshal(f.before)
+		if err != nil {
+			return nil, err
+		}
+		a, err := json.Marshal(f.after)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(a, b) {
+			changes = append(changes, FieldChange{Field: f.name, Before: b, After: a})
+		}
+	}
+	return changes, nil
+}
+
+// editOrder applies patch to the items, shipping address and discount codes of
+// order, re-prices it, swaps its stock reservation for the new items, routes it
+// again if it was routed and records the edit. A paid order may not cost more than was paid, when it costs less the
+// difference is refunded with the refund hook of ctx.
+func editOrder(ctx context.Context, repo Repository, order *Order, patch orderPatch) (*Order, error) {
+	if !order.Editable() {
+		return nil, ErrNotEditable
+	}
+	before := order.document()
+	after, err := applyPatch(before, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateItems(after.Items); err != nil {
+		return nil, err
+	}
+	changes, err := diffDocuments(before, after)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return order, nil
+	}
+
+	paid := needsRefund(order)
+	previous := order.Items
+	edit := OrderEdit{
+		Version:     order.Version + 1,
+		EditedAt:    time.Now().UTC(),
+		RequestID:   RequestIDFromContext(ctx),
+		ClientIP:    ClientIPFromContext(ctx),
+		Changes:     changes,
+		TotalBefore: order.Total,
+	}
+	redactEdit(RedactorFromContext(ctx), &edit)
+	order.Items = after.Items
+	order.ShippingAddress = after.ShippingAddress
+	// the prices of the patched items are read without the currency of the order
+	if err := order.SetCurrency(order.Currency); err != nil {
+		return nil, err
+	}
+	if err := priceOrder(ctx, order, after.DiscountCodes); err != nil {
+		return nil, err
+	}
+	edit.TotalAfter = order.Total
+	refund := edit.TotalBefore.Sub(edit.TotalAfter)
+	if paid && refund.IsNegative() {
+		return nil, &ValidationError{Field: "items", Reason: fmt.Sprintf("the edit raises the total of the paid order by %s", refund.Mul(-1))}
+	}
+	if paid && !refund.IsZero() {
+		edit.Refund = RefundPending
+	}
+
+	itemsChanged := false
+	for _, change := range changes {
+		itemsChanged = itemsChanged || change.Field == "items"
+	}
+	if itemsChanged {
+		if err := swapReservation(ctx, order, previous, order.Items); err != nil {
+			return nil, err
+		}
+	}
+	routed := order.Routing != nil
+	if routed {
+		routeConfirmed(ctx, repo, order)
+	}
+	order.Edits = append(order.Edits, edit)
+	if len(order.Edits) > maxOrderEdits {
+		order.Edits = order.Edits[len(order.Edits)-maxOrderEdits:]
+	}
+	order.UpdatedAt = edit.EditedAt
+	if err := repo.UpdateOrder(WithEventType(ctx, EventOrderEdited), order); err != nil {
+		if itemsChanged {
+			if swapErr := swapReservation(ctx, order, order.Items, previous); swapErr != nil {
+				LoggerFromContext(ctx).Errorf("failed to restore the stock reservation of order %s: %v", order.ID, swapErr)
+			}
+		}
+		return nil, err
+	}
+	LoggerFromContext(ctx).Infof("edited order %s: total %s -> %s", order.ID, edit.TotalBefore, edit.TotalAfter)
+	if routed {
+		queueRouting(ctx, order)
+	}
+
+	if edit.Refund != RefundPending {
+		return order, nil
+	}
+	last := &order.Edits[len(order.Edits)-1]
+	last.Refund = RefundRefunded
+	if err := RefundHookFromContext(ctx).Refund(ctx, order, refund, fmt.Sprintf("%s-edit-%d", order.ID, edit.Version)); err != nil {
+		LoggerFromContext(ctx).Errorf("failed to refund %s of edited order %s: %v", refund, order.ID, err)
+		last.Refund = RefundFailed
+	}
+	return saveOrder(ctx, repo, order)
+}
+
+// EditOrder applies the JSON Merge Patch or JSON Patch of the body to the items,
+// shippingAddress and discountCodes of the order named in the path, honouring
+// If-Match and If-Unmodified-Since. Orders are editable until they ship.
+func EditOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPatchBody))
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	patch, err := parsePatch(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err == nil {
+		err = checkPreconditions(r, order)
+	}
+	if err == nil {
+		order, err = editOrder(withPreconditions(ctx, r), repo, order, patch)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	writeJSON(w, r, http.StatusOK, order)
+}
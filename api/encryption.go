@@ -0,0 +1,602 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	kmstypes "github.com/aws/aws-sdk-go-v2/service/kms/types"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/jobs"
+)
+
+// ErrSealedFields is returned when the sealed fields of a record can not be opened
+var ErrSealedFields = errors.New("sealed fields can not be opened")
+
+// SealedFields are the sensitive fields of a record encrypted with AES-GCM by
+// a data key, which is stored wrapped by a KMS key. The id of the record is
+// authenticated with them, so they can not be moved to another record.
+type SealedFields struct {
+	// KeyID is the KMS key that wrapped the data key
+	KeyID   string `json:"keyId" dynamodbav:"keyId"`
+	DataKey []byte `json:"dataKey" dynamodbav:"dataKey"`
+	Nonce   []byte `json:"nonce" dynamodbav:"nonce"`
+	Data    []byte `json:"data" dynamodbav:"data"`
+}
+
+// DataKeys generates the data keys sealing records and unwraps them to open
+// the records again
+type DataKeys interface {
+	// GenerateDataKey returns a new 256 bit data key, plain and wrapped, and
+	// the id of the key wrapping it
+	GenerateDataKey(ctx context.Context) (plain, wrapped []byte, keyID string, err error)
+	// Decrypt returns the plain data key of a wrapped one
+	Decrypt(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// kmsDataKeys are the data keys of a KMS key
+type kmsDataKeys struct {
+	client *kms.Client
+	keyID  string
+}
+
+// NewKMSDataKeys returns the data keys wrapped by the KMS key of cfg
+func NewKMSDataKeys(ctx context.Context, cfg *config.Config) (DataKeys, error) {
+	awsConfig, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	client := kms.NewFromConfig(awsConfig, func(o *kms.Options) {
+		if cfg.Encryption.Region != "" {
+			o.Region = cfg.Encryption.Region
+		}
+		if cfg.Encryption.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Encryption.Endpoint)
+		}
+	})
+	return &kmsDataKeys{client: client, keyID: cfg.Encryption.KeyID}, nil
+}
+
+func (k *kmsDataKeys) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	out, err := k.client.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(k.keyID),
+		KeySpec: kmstypes.DataKeySpecAes256,
+	})
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return out.Plaintext, out.CiphertextBlob, aws.ToString(out.KeyId), nil
+}
+
+// Decrypt unwraps a data key with whichever key wrapped it, so the records
+// sealed before a rotation are still opened
+func (k *kmsDataKeys) Decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := k.client.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// dataKey is a data key, plain and wrapped
+type dataKey struct {
+	plain   []byte
+	wrapped []byte
+	keyID   string
+	created time.Time
+}
+
+// Sealer seals and opens the sensitive fields of records. A data key seals the
+// records written for the reuse time of the configuration, and the unwrapped
+// data keys are kept, up to the cache size, so most records are sealed and
+// opened without calling KMS.
+type Sealer struct {
+	keys      DataKeys
+	reuse     time.Duration
+	cacheSize int
+
+	mu      sync.Mutex
+	current *dataKey
+	// unwrapped are the plain data keys by wrapped data key
+	unwrapped map[string][]byte
+}
+
+// NewSealer returns the sealer of the data keys keys with the reuse time and
+// cache size of cfg
+func NewSealer(keys DataKeys, cfg config.EncryptionConfig) *Sealer {
+	return &Sealer{keys: keys, reuse: cfg.DataKeyReuse.Duration, cacheSize: cfg.DataKeyCacheSize, unwrapped: map[string][]byte{}}
+}
+
+// dataKey returns the data key sealing the records written now
+func (s *Sealer) dataKey(ctx context.Context) (*dataKey, error) {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	if current != nil && time.Since(current.created) < s.reuse {
+		return current, nil
+	}
+
+	plain, wrapped, keyID, err := s.keys.GenerateDataKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a data key: %v", err)
+	}
+	key := &dataKey{plain: plain, wrapped: wrapped, keyID: keyID, created: time.Now()}
+	s.mu.Lock()
+	s.current = key
+	s.cacheLocked(wrapped, plain)
+	s.mu.Unlock()
+	return key, nil
+}
+
+// cacheLocked keeps the plain data key of wrapped, dropping another one when
+// the cache is full
+func (s *Sealer) cacheLocked(wrapped, plain []byte) {
+	if len(s.unwrapped) >= s.cacheSize {
+		for key := range s.unwrapped {
+			delete(s.unwrapped, key)
+			break
+		}
+	}
+	s.unwrapped[string(wrapped)] = plain
+}
+
+// unwrap returns the plain data key of wrapped
+func (s *Sealer) unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	s.mu.Lock()
+	plain, ok := s.unwrapped[string(wrapped)]
+	s.mu.Unlock()
+	if ok {
+		return plain, nil
+	}
+
+	plain, err := s.keys.Decrypt(ctx, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decrypt the data key: %v", ErrSealedFields, err)
+	}
+	s.mu.Lock()
+	s.cacheLocked(wrapped, plain)
+	s.mu.Unlock()
+	return plain, nil
+}
+
+// Seal returns the fields, marshalled to json, sealed for the record id
+func (s *Sealer) Seal(ctx context.Context, id string, fields interface{}) (*SealedFields, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	key, err := s.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key.plain)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &SealedFields{
+		KeyID:   key.keyID,
+		DataKey: key.wrapped,
+		Nonce:   nonce,
+		Data:    aead.Seal(nil, nonce, data, []byte(id)),
+	}, nil
+}
+
+// Open unmarshals the fields sealed for the record id into fields
+func (s *Sealer) Open(ctx context.Context, id string, sealed *SealedFields, fields interface{}) error {
+	plain, err := s.unwrap(ctx, sealed.DataKey)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return err
+	}
+	data, err := aead.Open(nil, sealed.Nonce, sealed.Data, []byte(id))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSealedFields, err)
+	}
+	return json.Unmarshal(data, fields)
+}
+
+// KeyID returns the id of the key wrapping the data key of the records
+// written now
+func (s *Sealer) KeyID(ctx context.Context) (string, error) {
+	key, err := s.dataKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	return key.keyID, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealedOrderFields are the fields of an order stored sealed
+type sealedOrderFields struct {
+	ShippingAddress *Address `json:"shippingAddress,omitempty"`
+	PaymentID       string   `json:"paymentId,omitempty"`
+}
+
+// sealOrder replaces the sensitive fields of order with their sealed form and
+// returns the function putting them back
+func sealOrder(ctx context.Context, s *Sealer, order *Order) (func(), error) {
+	fields := sealedOrderFields{ShippingAddress: order.ShippingAddress}
+	if order.Payment != nil {
+		fields.PaymentID = order.Payment.ID
+	}
+	if fields.ShippingAddress == nil && fields.PaymentID == "" {
+		return func() {}, nil
+	}
+	sealed, err := s.Seal(ctx, order.ID, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	payment := order.Payment
+	order.ShippingAddress, order.Sealed = nil, sealed
+	if payment != nil {
+		stored := *payment
+		stored.ID = ""
+		order.Payment = &stored
+	}
+	return func() {
+		order.ShippingAddress, order.Payment, order.Sealed = fields.ShippingAddress, payment, nil
+	}, nil
+}
+
+// openOrder puts the sealed fields of order back in place
+func openOrder(ctx context.Context, s *Sealer, order *Order) error {
+	if order == nil || order.Sealed == nil {
+		return nil
+	}
+	var fields sealedOrderFields
+	if err := s.Open(ctx, order.ID, order.Sealed, &fields); err != nil {
+		return fmt.Errorf("order %s: %w", order.ID, err)
+	}
+	order.ShippingAddress, order.Sealed = fields.ShippingAddress, nil
+	if order.Payment != nil {
+		payment := *order.Payment
+		payment.ID = fields.PaymentID
+		order.Payment = &payment
+	}
+	return nil
+}
+
+// encryptedRepository stores the addresses and payment ids of orders sealed,
+// and opens them when the orders are read. It is placed above the cache and
+// the archive, which only hold the sealed form.
+type encryptedRepository struct {
+	Repository
+	sealer *Sealer
+}
+
+// NewEncryptedRepository returns repo storing the sensitive fields of orders,
+// and of customers when it keeps them, sealed by sealer
+func NewEncryptedRepository(repo Repository, sealer *Sealer) Repository {
+	e := &encryptedRepository{Repository: repo, sealer: sealer}
+	if store, ok := findCustomerStore(repo); ok {
+		return &encryptedCustomerRepository{encryptedRepository: e, store: store}
+	}
+	return e
+}
+
+// Unwrap returns the repository storing the sealed orders
+func (e *encryptedRepository) Unwrap() Repository {
+	return e.Repository
+}
+
+func (e *encryptedRepository) CreateOrder(ctx context.Context, order *Order) error {
+	restore, err := sealOrder(ctx, e.sealer, order)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return e.Repository.CreateOrder(ctx, order)
+}
+
+func (e *encryptedRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := e.Repository.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := openOrder(ctx, e.sealer, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (e *encryptedRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	restore, err := sealOrder(ctx, e.sealer, order)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return e.Repository.UpdateOrder(ctx, order)
+}
+
+func (e *encryptedRepository) ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error) {
+	orders, next, err := e.Repository.ListOrders(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, order := range orders {
+		if err := openOrder(ctx, e.sealer, order); err != nil {
+			return nil, "", err
+		}
+	}
+	return orders, next, nil
+}
+
+// BatchCreateOrders keeps the bulk operation of the decorated repository
+func (e *encryptedRepository) BatchCreateOrders(ctx context.Context, orders []*Order) []error {
+	errs := make([]error, len(orders))
+	sealed := make([]*Order, 0, len(orders))
+	index := make([]int, 0, len(orders))
+	for i, order := range orders {
+		restore, err := sealOrder(ctx, e.sealer, order)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		defer restore()
+		sealed = append(sealed, order)
+		index = append(index, i)
+	}
+	for i, err := range batchCreateOrders(ctx, e.Repository, sealed) {
+		errs[index[i]] = err
+	}
+	return errs
+}
+
+// BatchGetOrders keeps the bulk operation of the decorated repository
+func (e *encryptedRepository) BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error) {
+	orders, err := batchGetOrders(ctx, e.Repository, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range orders {
+		if err := openOrder(ctx, e.sealer, order); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+// openingOutbox returns outbox with the orders of its events opened, the
+// events are recorded with the orders as they are stored
+func (e *encryptedRepository) openingOutbox(outbox Outbox) Outbox {
+	return &openingOutbox{Outbox: outbox, sealer: e.sealer}
+}
+
+// findEncryption returns the layer of repo sealing the sensitive fields
+func findEncryption(repo Repository) (*encryptedRepository, bool) {
+	var encrypted *encryptedRepository
+	found := eachLayer(repo, func(r Repository) bool {
+		switch layer := r.(type) {
+		case *encryptedRepository:
+			encrypted = layer
+		case *encryptedCustomerRepository:
+			encrypted = layer.encryptedRepository
+		}
+		return encrypted != nil
+	})
+	return encrypted, found
+}
+
+// belowEncryption returns the repository below the layer of repo sealing the
+// sensitive fields, which reads and writes orders as they are stored, or
+// repo without one
+func belowEncryption(repo Repository) Repository {
+	if encrypted, ok := findEncryption(repo); ok {
+		return encrypted.Repository
+	}
+	return repo
+}
+
+// openingOutbox opens the orders of the events of an outbox
+type openingOutbox struct {
+	Outbox
+	sealer *Sealer
+}
+
+func (o *openingOutbox) PendingEvents(ctx context.Context, limit int) ([]*OutboxEvent, error) {
+	events, err := o.Outbox.PendingEvents(ctx, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		var order Order
+		if json.Unmarshal(event.Payload, &order) != nil || order.Sealed == nil {
+			continue
+		}
+		if err := openOrder(ctx, o.sealer, &order); err != nil {
+			return nil, err
+		}
+		payload, err := json.Marshal(&order)
+		if err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+	}
+	return events, nil
+}
+
+// sealedCustomerFields are the fields of a customer stored sealed
+type sealedCustomerFields struct {
+	Email     string            `json:"email,omitempty"`
+	Addresses []CustomerAddress `json:"addresses,omitempty"`
+}
+
+// encryptedCustomerRepository also stores the emails and address books of
+// customers sealed
+type encryptedCustomerRepository struct {
+	*encryptedRepository
+	store CustomerStore
+}
+
+// sealCustomer replaces the sensitive fields of customer with their sealed
+// form and returns the function putting them back
+func (e *encryptedCustomerRepository) sealCustomer(ctx context.Context, customer *Customer) (func(), error) {
+	fields := sealedCustomerFields{Email: customer.Email, Addresses: customer.Addresses}
+	sealed, err := e.sealer.Seal(ctx, customer.ID, &fields)
+	if err != nil {
+		return nil, err
+	}
+	customer.Email, customer.Addresses, customer.Sealed = "", nil, sealed
+	return func() {
+		customer.Email, customer.Addresses, customer.Sealed = fields.Email, fields.Addresses, nil
+	}, nil
+}
+
+func (e *encryptedCustomerRepository) CreateCustomer(ctx context.Context, customer *Customer) error {
+	restore, err := e.sealCustomer(ctx, customer)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return e.store.CreateCustomer(ctx, customer)
+}
+
+func (e *encryptedCustomerRepository) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	customer, err := e.store.GetCustomer(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.openCustomer(ctx, customer); err != nil {
+		return nil, err
+	}
+	return customer, nil
+}
+
+// BatchGetCustomers keeps the bulk operation of the decorated store
+func (e *encryptedCustomerRepository) BatchGetCustomers(ctx context.Context, ids []string) (map[string]*Customer, error) {
+	customers, err := batchGetCustomers(ctx, e.store, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, customer := range customers {
+		if err := e.openCustomer(ctx, customer); err != nil {
+			return nil, err
+		}
+	}
+	return customers, nil
+}
+
+// openCustomer puts the sealed fields of customer back in place
+func (e *encryptedCustomerRepository) openCustomer(ctx context.Context, customer *Customer) error {
+	if customer.Sealed == nil {
+		return nil
+	}
+	var fields sealedCustomerFields
+	if err := e.sealer.Open(ctx, customer.ID, customer.Sealed, &fields); err != nil {
+		return fmt.Errorf("customer %s: %w", customer.ID, err)
+	}
+	customer.Email, customer.Addresses, customer.Sealed = fields.Email, fields.Addresses, nil
+	return nil
+}
+
+func (e *encryptedCustomerRepository) UpdateCustomer(ctx context.Context, customer *Customer) error {
+	restore, err := e.sealCustomer(ctx, customer)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	return e.store.UpdateCustomer(ctx, customer)
+}
+
+// ResealJob is the type of the jobs sealing the orders again with the current
+// KMS key after a rotation
+const ResealJob jobs.Type = "reseal"
+
+// ResealResult is the result of a reseal job
+type ResealResult struct {
+	KeyID    string `json:"keyId"`
+	Orders   int    `json:"orders"`
+	Resealed int    `json:"resealed"`
+}
+
+// NewResealJob returns the function of the reseal jobs, writing the orders of
+// repo sealed with another key than the current one again. Their version is
+// incremented and an OrderUpdated event recorded, as for any update.
+func NewResealJob(repo Repository) (jobs.Func, error) {
+	encrypted, ok := findEncryption(repo)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return func(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+		keyID, err := encrypted.sealer.KeyID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res := &ResealResult{KeyID: keyID}
+		opts := ListOptions{Limit: DefaultPageSize}
+		for ctx.Err() == nil {
+			orders, next, err := encrypted.Repository.ListOrders(ctx, opts)
+			if err != nil {
+				return res, err
+			}
+			for _, order := range orders {
+				res.Orders++
+				if order.Sealed == nil || order.Sealed.KeyID == keyID {
+					continue
+				}
+				if err := openOrder(ctx, encrypted.sealer, order); err != nil {
+					return res, err
+				}
+				err := encrypted.UpdateOrder(ctx, order)
+				if err != nil && !errors.Is(err, ErrVersionConflict) {
+					return res, err
+				}
+				if err == nil {
+					res.Resealed++
+				}
+			}
+			report(int64(res.Orders), 0)
+			if next == "" {
+				return res, nil
+			}
+			opts.PageToken = next
+		}
+		return res, ctx.Err()
+	}, nil
+}
+
+// StartReseal queues a job sealing the orders again with the current KMS key,
+// answered to be followed with GetJob
+func StartReseal(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pool, err := jobsFromContext(ctx)
+	if err == nil && !ConfigFromContext(ctx).Encryption.Enabled {
+		err = ErrNotSupported
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	job, err := pool.Enqueue(ctx, ResealJob, struct{}{})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", jobLocation(job.ID))
+	writeJSON(w, r, http.StatusAccepted, job)
+}
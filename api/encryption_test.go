@@ -0,0 +1,226 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/payments"
+)
+
+// fakeDataKeys wraps the data keys by keeping them, it counts the calls made
+// as KMS would be called
+type fakeDataKeys struct {
+	mu        sync.Mutex
+	keyID     string
+	plain     map[string][]byte
+	generated int
+	decrypted int
+	err       error
+}
+
+func newFakeDataKeys(keyID string) *fakeDataKeys {
+	return &fakeDataKeys{keyID: keyID, plain: map[string][]byte{}}
+}
+
+func (f *fakeDataKeys) GenerateDataKey(ctx context.Context) ([]byte, []byte, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, nil, "", f.err
+	}
+	plain, wrapped := make([]byte, 32), make([]byte, 16)
+	rand.Read(plain)
+	rand.Read(wrapped)
+	f.plain[string(wrapped)] = plain
+	f.generated++
+	return plain, wrapped, f.keyID, nil
+}
+
+func (f *fakeDataKeys) Decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.decrypted++
+	if f.err != nil {
+		return nil, f.err
+	}
+	plain, ok := f.plain[string(wrapped)]
+	if !ok {
+		return nil, errors.New("invalid ciphertext")
+	}
+	return plain, nil
+}
+
+type sealedTestFields struct {
+	Email string `json:"email"`
+}
+
+func TestSealerOpen(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		id     string
+		tamper func(sealed *SealedFields)
+		err    bool
+	}{
+		{name: "same record", id: "o-1"},
+		{name: "another record", id: "o-2", err: true},
+		{name: "tampered data", id: "o-1", tamper: func(sealed *SealedFields) { sealed.Data[0] ^= 0xff }, err: true},
+		{name: "tampered nonce", id: "o-1", tamper: func(sealed *SealedFields) { sealed.Nonce[0] ^= 0xff }, err: true},
+		{name: "unknown data key", id: "o-1", tamper: func(sealed *SealedFields) { sealed.DataKey = []byte("forged") }, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealer := NewSealer(newFakeDataKeys("key-1"), config.EncryptionConfig{DataKeyCacheSize: 10})
+			sealed, err := sealer.Seal(ctx, "o-1", &sealedTestFields{Email: "jo@example.com"})
+			if err != nil {
+				t.Fatalf("Seal() = %v", err)
+			}
+			if sealed.KeyID != "key-1" {
+				t.Errorf("key id = %q, want key-1", sealed.KeyID)
+			}
+			if bytes.Contains(sealed.Data, []byte("jo@example.com")) {
+				t.Fatal("the sealed data holds the plain fields")
+			}
+			if tt.tamper != nil {
+				tt.tamper(sealed)
+			}
+
+			var fields sealedTestFields
+			err = sealer.Open(ctx, tt.id, sealed, &fields)
+			if tt.err {
+				if !errors.Is(err, ErrSealedFields) {
+					t.Fatalf("Open() = %v, want %v", err, ErrSealedFields)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open() = %v", err)
+			}
+			if fields.Email != "jo@example.com" {
+				t.Fatalf("email = %q, want jo@example.com", fields.Email)
+			}
+		})
+	}
+}
+
+func TestSealerDataKeys(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		reuse     time.Duration
+		seals     int
+		generated int
+	}{
+		{name: "reused data key", reuse: time.Hour, seals: 3, generated: 1},
+		{name: "data key per record", seals: 3, generated: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newFakeDataKeys("key-1")
+			sealer := NewSealer(keys, config.EncryptionConfig{DataKeyReuse: config.Duration{Duration: tt.reuse}, DataKeyCacheSize: 10})
+			var sealed []*SealedFields
+			for i := 0; i < tt.seals; i++ {
+				s, err := sealer.Seal(ctx, "o-1", &sealedTestFields{Email: "jo@example.com"})
+				if err != nil {
+					t.Fatalf("Seal() = %v", err)
+				}
+				sealed = append(sealed, s)
+			}
+			if keys.generated != tt.generated {
+				t.Errorf("generated %d data keys, want %d", keys.generated, tt.generated)
+			}
+
+			// another instance unwraps every data key once
+			other := NewSealer(keys, config.EncryptionConfig{DataKeyCacheSize: 10})
+			for round := 0; round < 2; round++ {
+				for _, s := range sealed {
+					var fields sealedTestFields
+					if err := other.Open(ctx, "o-1", s, &fields); err != nil {
+						t.Fatalf("Open() = %v", err)
+					}
+				}
+			}
+			if keys.decrypted != tt.generated {
+				t.Errorf("decrypted %d data keys, want %d", keys.decrypted, tt.generated)
+			}
+		})
+	}
+}
+
+func TestSealerKMSErrors(t *testing.T) {
+	ctx := context.Background()
+	keys := newFakeDataKeys("key-1")
+	sealer := NewSealer(keys, config.EncryptionConfig{DataKeyReuse: config.Duration{Duration: time.Hour}, DataKeyCacheSize: 10})
+	sealed, err := sealer.Seal(ctx, "o-1", &sealedTestFields{Email: "jo@example.com"})
+	if err != nil {
+		t.Fatalf("Seal() = %v", err)
+	}
+
+	keys.err = errors.New("kms unavailable")
+	if _, err := NewSealer(keys, config.EncryptionConfig{}).Seal(ctx, "o-2", &sealedTestFields{}); err == nil {
+		t.Error("Seal() without a data key returned no error")
+	}
+	var fields sealedTestFields
+	if err := NewSealer(keys, config.EncryptionConfig{DataKeyCacheSize: 10}).Open(ctx, "o-1", sealed, &fields); !errors.Is(err, ErrSealedFields) {
+		t.Errorf("Open() without the data key = %v, want %v", err, ErrSealedFields)
+	}
+	// the cached data key still opens the record
+	if err := sealer.Open(ctx, "o-1", sealed, &fields); err != nil {
+		t.Errorf("Open() with the cached data key = %v", err)
+	}
+}
+
+func TestEncryptedRepository(t *testing.T) {
+	ctx := context.Background()
+	address := &Address{Name: "Jo", Line1: "1 Main St", City: "Springfield", PostalCode: "12345", Country: "US"}
+	tests := []struct {
+		name    string
+		address *Address
+		payment *payments.Payment
+		sealed  bool
+	}{
+		{name: "address and payment", address: address, payment: &payments.Payment{Provider: "stripe", ID: "pi_1"}, sealed: true},
+		{name: "address only", address: address, sealed: true},
+		{name: "payment only", payment: &payments.Payment{Provider: "stripe", ID: "pi_1"}, sealed: true},
+		{name: "nothing to seal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryRepository()
+			repo := NewEncryptedRepository(store, NewSealer(newFakeDataKeys("key-1"), config.EncryptionConfig{DataKeyCacheSize: 10}))
+			order := &Order{ID: "o-1", Status: StatusPending, ShippingAddress: tt.address, Payment: tt.payment}
+			if err := repo.CreateOrder(ctx, order); err != nil {
+				t.Fatalf("CreateOrder() = %v", err)
+			}
+			if order.ShippingAddress != tt.address || order.Payment != tt.payment || order.Sealed != nil {
+				t.Fatal("CreateOrder() did not restore the fields of the order")
+			}
+
+			stored, err := store.GetOrder(ctx, "o-1")
+			if err != nil {
+				t.Fatalf("GetOrder() of the store = %v", err)
+			}
+			if got := stored.Sealed != nil; got != tt.sealed {
+				t.Fatalf("stored order sealed = %t, want %t", got, tt.sealed)
+			}
+			if tt.sealed && (stored.ShippingAddress != nil || stored.Payment != nil && stored.Payment.ID != "") {
+				t.Fatalf("stored order holds its sensitive fields: %+v", stored)
+			}
+
+			got, err := repo.GetOrder(ctx, "o-1")
+			if err != nil {
+				t.Fatalf("GetOrder() = %v", err)
+			}
+			if got.Sealed != nil || !reflect.DeepEqual(got.ShippingAddress, tt.address) || !reflect.DeepEqual(got.Payment, tt.payment) {
+				t.Fatalf("GetOrder() = address %+v, payment %+v, want %+v, %+v", got.ShippingAddress, got.Payment, tt.address, tt.payment)
+			}
+		})
+	}
+}
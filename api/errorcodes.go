@@ -0,0 +1,345 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/omnom-nom/order/inventory"
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/payments"
+	"github.com/omnom-nom/order/routing"
+	"github.com/omnom-nom/order/tracking"
+)
+
+// ErrorCode is the machine readable code of an error returned to clients, in
+// the code field of the error responses besides the message meant for people.
+// Codes are stable: a code keeps its meaning and is never reused.
+type ErrorCode string
+
+// errorDomain is the domain of the ErrorInfo details of the grpc errors
+const errorDomain = "order.omnom-nom"
+
+// the codes of the errors returned to clients
+const (
+	CodeValidationFailed       ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidPageToken       ErrorCode = "INVALID_PAGE_TOKEN"
+	CodePageTokenExpired       ErrorCode = "PAGE_TOKEN_EXPIRED"
+	CodeOrderNotFound          ErrorCode = "ORDER_NOT_FOUND"
+	CodeSubscriptionNotFound   ErrorCode = "SUBSCRIPTION_NOT_FOUND"
+	CodeReturnNotFound         ErrorCode = "RETURN_NOT_FOUND"
+	CodeCustomerNotFound       ErrorCode = "CUSTOMER_NOT_FOUND"
+	CodeShipmentNotFound       ErrorCode = "SHIPMENT_NOT_FOUND"
+	CodeDraftNotFound          ErrorCode = "DRAFT_NOT_FOUND"
+	CodeScheduleNotFound       ErrorCode = "SCHEDULE_NOT_FOUND"
+	CodeJobNotFound            ErrorCode = "JOB_NOT_FOUND"
+	CodeHostNotFound           ErrorCode = "HOST_NOT_FOUND"
+	CodeDeadLetterNotFound     ErrorCode = "DEAD_LETTER_NOT_FOUND"
+	CodeSagaNotFound           ErrorCode = "SAGA_NOT_FOUND"
+	CodeWarehouseNotFound      ErrorCode = "WAREHOUSE_NOT_FOUND"
+	CodeTrackingNotFound       ErrorCode = "TRACKING_NOT_FOUND"
+	CodeGiftCardNotFound       ErrorCode = "GIFT_CARD_NOT_FOUND"
+	CodeNotFound               ErrorCode = "NOT_FOUND"
+	CodeOrderExists            ErrorCode = "ORDER_EXISTS"
+	CodeDuplicateOrder         ErrorCode = "DUPLICATE_ORDER"
+	CodeVersionConflict        ErrorCode = "VERSION_CONFLICT"
+	CodeOrderNotCancellable    ErrorCode = "ORDER_NOT_CANCELLABLE"
+	CodeInvalidStateTransition ErrorCode = "INVALID_STATE_TRANSITION"
+	CodeOrderNotReturnable     ErrorCode = "ORDER_NOT_RETURNABLE"
+	CodeOutOfStock             ErrorCode = "OUT_OF_STOCK"
+	CodeOrderUnroutable        ErrorCode = "ORDER_UNROUTABLE"
+	CodeOrderNotShippable      ErrorCode = "ORDER_NOT_SHIPPABLE"
+	CodePriorityNotUpgradable  ErrorCode = "PRIORITY_NOT_UPGRADABLE"
+	CodeOrderNotEditable       ErrorCode = "ORDER_NOT_EDITABLE"
+	CodeDraftCheckedOut        ErrorCode = "DRAFT_CHECKED_OUT"
+	CodeScheduleFinished       ErrorCode = "SCHEDULE_FINISHED"
+	CodeOrderArchived          ErrorCode = "ORDER_ARCHIVED"
+	CodeJobConflict            ErrorCode = "JOB_CONFLICT"
+	CodeJobFinished            ErrorCode = "JOB_FINISHED"
+	CodeOrderLocked            ErrorCode = "ORDER_LOCKED"
+	CodeOrderLockLost          ErrorCode = "ORDER_LOCK_LOST"
+	CodeOrderNotHeld           ErrorCode = "ORDER_NOT_HELD"
+	CodeOrderBeingPlaced       ErrorCode = "ORDER_BEING_PLACED"
+	CodeUnsupportedPatch       ErrorCode = "UNSUPPORTED_PATCH"
+	CodePreconditionFailed     ErrorCode = "PRECONDITION_FAILED"
+	CodePaymentDeclined        ErrorCode = "PAYMENT_DECLINED"
+	CodeInsufficientBalance    ErrorCode = "INSUFFICIENT_BALANCE"
+	CodeNoCreditLine           ErrorCode = "NO_CREDIT_LINE"
+	CodeCreditLimitExceeded    ErrorCode = "CREDIT_LIMIT_EXCEEDED"
+	CodeOrderRejected          ErrorCode = "ORDER_REJECTED"
+	CodeInvalidSignature       ErrorCode = "INVALID_SIGNATURE"
+	CodeNotSupported           ErrorCode = "NOT_SUPPORTED"
+	CodeReplayFailed           ErrorCode = "REPLAY_FAILED"
+	CodeRequestCancelled       ErrorCode = "REQUEST_CANCELLED"
+	CodeRequestTimeout         ErrorCode = "REQUEST_TIMEOUT"
+	CodeInvalidAdminToken      ErrorCode = "INVALID_ADMIN_TOKEN"
+	CodeInvalidCSRFToken       ErrorCode = "INVALID_CSRF_TOKEN"
+	CodeTenantForbidden        ErrorCode = "TENANT_FORBIDDEN"
+	CodeACLDenied              ErrorCode = "ACL_DENIED"
+	CodeHostNotRegistered      ErrorCode = "HOST_NOT_REGISTERED"
+	CodeInvalidAgentSignature  ErrorCode = "INVALID_AGENT_SIGNATURE"
+	CodeRateLimited            ErrorCode = "RATE_LIMITED"
+	CodeQuotaExceeded          ErrorCode = "QUOTA_EXCEEDED"
+	CodeReadOnly               ErrorCode = "READ_ONLY"
+	CodeRouteRetired           ErrorCode = "ROUTE_RETIRED"
+	CodeDatabaseUnavailable    ErrorCode = "DATABASE_UNAVAILABLE"
+	CodeLeaderUnavailable      ErrorCode = "LEADER_UNAVAILABLE"
+	CodeInternal               ErrorCode = "INTERNAL"
+)
+
+// errorKind is an entry of the error catalog: a code with the http status and
+// grpc code it is returned with, and the errors it is returned for
+type errorKind struct {
+	code        ErrorCode
+	status      int
+	grpc        codes.Code
+	description string
+	// errs are the errors the code is returned for, matched with errors.Is
+	errs []error
+	// match matches the errors of a type instead
+	match func(err error) bool
+}
+
+// matches reports whether err is returned with the code of k
+func (k *errorKind) matches(err error) bool {
+	if k.match != nil && k.match(err) {
+		return true
+	}
+	for _, target := range k.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorCatalog is every error code returned to clients. The errors of the
+// handlers are looked up in order, the entries without errors are written by
+// the middleware.
+var errorCatalog = []*errorKind{
+	{code: CodeOrderNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The order does not exist, or no longer does.", errs: []error{ErrOrderNotFound}},
+	{code: CodeSubscriptionNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The webhook subscription does not exist.", errs: []error{ErrSubscriptionNotFound}},
+	{code: CodeReturnNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The return does not exist.", errs: []error{ErrReturnNotFound}},
+	{code: CodeCustomerNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The customer does not exist.", errs: []error{ErrCustomerNotFound}},
+	{code: CodeShipmentNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The shipment does not exist.", errs: []error{ErrShipmentNotFound}},
+	{code: CodeDraftNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The draft order does not exist or expired.", errs: []error{ErrDraftNotFound}},
+	{code: CodeScheduleNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The order schedule does not exist.", errs: []error{ErrScheduleNotFound}},
+	{code: CodeJobNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The background job does not exist.", errs: []error{jobs.ErrNotFound}},
+	{code: CodeHostNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The host is not registered.", errs: []error{ErrHostNotFound}},
+	{code: CodeDeadLetterNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The dead letter does not exist.", errs: []error{ErrDeadLetterNotFound}},
+	{code: CodeSagaNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The saga does not exist.", errs: []error{ErrSagaNotFound}},
+	{code: CodeWarehouseNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The warehouse does not exist.", errs: []error{ErrWarehouseNotFound}},
+	{code: CodeTrackingNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The tracking token is malformed, expired or its order no longer exists.", errs: []error{ErrInvalidTrackingToken}},
+	{code: CodeGiftCardNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "A gift card of the order is unknown, or its customer has no store credit.", errs: []error{payments.ErrGiftCardNotFound}},
+	{code: CodeOrderExists, status: http.StatusConflict, grpc: codes.AlreadyExists,
+		description: "An order with the id already exists.", errs: []error{ErrOrderExists}},
+	{code: CodeDuplicateOrder, status: http.StatusConflict, grpc: codes.AlreadyExists,
+		description: "The order repeats a recent order of the customer, allowDuplicate creates it all the same.", errs: []error{ErrDuplicateOrder}},
+	{code: CodeVersionConflict, status: http.StatusConflict, grpc: codes.Aborted,
+		description: "The order was changed by another request meanwhile, read it again and retry.", errs: []error{ErrVersionConflict}},
+	{code: CodeOrderNotCancellable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order is past the statuses it can be cancelled in.", errs: []error{ErrNotCancellable}},
+	{code: CodeInvalidStateTransition, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The status can not change to the one asked for from the current one.", errs: []error{ErrInvalidTransition}},
+	{code: CodeOrderNotReturnable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "Only delivered orders can be returned.", errs: []error{ErrNotReturnable}},
+	{code: CodeOutOfStock, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "Items of the order are out of stock.", errs: []error{inventory.ErrOutOfStock}},
+	{code: CodeOrderUnroutable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "No warehouses hold enough stock of the items of the order to ship them.", errs: []error{routing.ErrUnroutable}},
+	{code: CodeOrderNotShippable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order can not be shipped in its status.", errs: []error{ErrNotShippable}},
+	{code: CodePriorityNotUpgradable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The priority of the order can not be raised to the one asked for.", errs: []error{ErrPriorityNotUpgradable}},
+	{code: CodeOrderNotEditable, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order can no longer be edited.", errs: []error{ErrNotEditable}},
+	{code: CodeDraftCheckedOut, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The draft order was checked out already.", errs: []error{ErrDraftCheckedOut}},
+	{code: CodeScheduleFinished, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order schedule is cancelled or completed.", errs: []error{ErrScheduleFinished}},
+	{code: CodeOrderArchived, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order is archived and can no longer be changed.", errs: []error{ErrOrderArchived}},
+	{code: CodeJobConflict, status: http.StatusConflict, grpc: codes.Aborted,
+		description: "The background job was changed by another request meanwhile.", errs: []error{jobs.ErrConflict}},
+	{code: CodeJobFinished, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The background job already finished.", errs: []error{jobs.ErrFinished}},
+	{code: CodeOrderLocked, status: http.StatusConflict, grpc: codes.Aborted,
+		description: "Another request is changing the order, retry later.", errs: []error{ErrOrderLocked}},
+	{code: CodeOrderLockLost, status: http.StatusConflict, grpc: codes.Aborted,
+		description: "The change took longer than the lock of the order, retry.", errs: []error{ErrLockLost}},
+	{code: CodeOrderNotHeld, status: http.StatusConflict, grpc: codes.FailedPrecondition,
+		description: "The order is not held for a fraud review.", errs: []error{ErrNotHeld}},
+	{code: CodeOrderBeingPlaced, status: http.StatusConflict, grpc: codes.Aborted,
+		description: "The order is being placed by another request.", errs: []error{ErrSagaExists}},
+	{code: CodeUnsupportedPatch, status: http.StatusUnsupportedMediaType, grpc: codes.InvalidArgument,
+		description: "The patch is neither a JSON merge patch nor a JSON patch.", errs: []error{ErrUnsupportedPatch}},
+	{code: CodePreconditionFailed, status: http.StatusPreconditionFailed, grpc: codes.FailedPrecondition,
+		description: "The order does not match the If-Match version, was modified after If-Unmodified-Since or does not meet the precondition of the request.", errs: []error{ErrPreconditionFailed}},
+	{code: CodePaymentDeclined, status: http.StatusPaymentRequired, grpc: codes.FailedPrecondition,
+		description: "The payment provider declined the payment, the order is cancelled.", errs: []error{ErrPaymentDeclined}},
+	{code: CodeInsufficientBalance, status: http.StatusPaymentRequired, grpc: codes.FailedPrecondition,
+		description: "A gift card or the store credit has less than the amount to take off it.", errs: []error{payments.ErrInsufficientBalance}},
+	{code: CodeNoCreditLine, status: http.StatusPaymentRequired, grpc: codes.FailedPrecondition,
+		description: "The customer has no credit line to pay the order on account.", errs: []error{payments.ErrNoCreditLine}},
+	{code: CodeCreditLimitExceeded, status: http.StatusPaymentRequired, grpc: codes.FailedPrecondition,
+		description: "The order exceeds what is left of the credit line of the customer.", errs: []error{payments.ErrCreditLimitExceeded}},
+	{code: CodeOrderRejected, status: http.StatusForbidden, grpc: codes.PermissionDenied,
+		description: "The fraud screening rejected the order.", errs: []error{ErrOrderRejected}},
+	{code: CodeInvalidSignature, status: http.StatusUnauthorized, grpc: codes.Unauthenticated,
+		description: "The signature of the webhook is missing or invalid.", errs: []error{payments.ErrInvalidSignature, tracking.ErrInvalidSignature}},
+	{code: CodeNotSupported, status: http.StatusNotImplemented, grpc: codes.Unimplemented,
+		description: "The feature is not enabled or not supported by the storage backend.", errs: []error{ErrNotSupported}},
+	{code: CodeReplayFailed, status: http.StatusBadGateway, grpc: codes.Unavailable,
+		description: "The replay of the dead letter to its publisher failed.", errs: []error{ErrReplayFailed}},
+	{code: CodeInvalidPageToken, status: http.StatusBadRequest, grpc: codes.InvalidArgument,
+		description: "The page token was not issued by the service, was changed or belongs to a listing with other filters.", errs: []error{ErrInvalidPageToken}},
+	{code: CodePageTokenExpired, status: http.StatusBadRequest, grpc: codes.InvalidArgument,
+		description: "The page token expired, list again from the first page.", errs: []error{ErrPageTokenExpired}},
+	{code: CodeValidationFailed, status: http.StatusBadRequest, grpc: codes.InvalidArgument,
+		description: "A field of the request is invalid, the message names it.", match: func(err error) bool {
+			var validationErr *ValidationError
+			return errors.As(err, &validationErr)
+		}},
+	{code: CodeRequestCancelled, status: 499, grpc: codes.Canceled,
+		description: "The client cancelled the request.", errs: []error{context.Canceled}},
+	{code: CodeRequestTimeout, status: http.StatusGatewayTimeout, grpc: codes.DeadlineExceeded,
+		description: "The request took longer than its timeout.", errs: []error{context.DeadlineExceeded}},
+	{code: CodeNotFound, status: http.StatusNotFound, grpc: codes.NotFound,
+		description: "The route does not exist.", errs: []error{ErrRouteNotFound}},
+	{code: CodeInvalidAdminToken, status: http.StatusUnauthorized, grpc: codes.Unauthenticated,
+		description: "The bearer token of the admin api is missing or invalid."},
+	{code: CodeInvalidCSRFToken, status: http.StatusForbidden, grpc: codes.PermissionDenied,
+		description: "The csrf token of the admin api is missing or invalid."},
+	{code: CodeTenantForbidden, status: http.StatusForbidden, grpc: codes.PermissionDenied,
+		description: "The X-Tenant-Id header names another tenant than the one the api key of the request authenticates."},
+	{code: CodeACLDenied, status: http.StatusForbidden, grpc: codes.PermissionDenied,
+		description: "The network acl does not allow the client on the route."},
+	{code: CodeHostNotRegistered, status: http.StatusForbidden, grpc: codes.PermissionDenied,
+		description: "The host calling is not registered or missed its heartbeats."},
+	{code: CodeInvalidAgentSignature, status: http.StatusUnauthorized, grpc: codes.Unauthenticated,
+		description: "The agent request is not signed with the key of a registered host, or was signed too far from the time of the service.", errs: []error{ErrInvalidAgentSignature}},
+	{code: CodeRateLimited, status: http.StatusTooManyRequests, grpc: codes.ResourceExhausted,
+		description: "The client sends requests faster than the rate limit, retry after Retry-After."},
+	{code: CodeQuotaExceeded, status: http.StatusTooManyRequests, grpc: codes.ResourceExhausted,
+		description: "The consumer used up its daily or monthly quota, retry after Retry-After."},
+	{code: CodeReadOnly, status: http.StatusServiceUnavailable, grpc: codes.Unavailable,
+		description: "The service is read only, writes are refused."},
+	{code: CodeRouteRetired, status: http.StatusGone, grpc: codes.Unimplemented,
+		description: "The deprecated route is past its sunset and no longer served."},
+	{code: CodeDatabaseUnavailable, status: http.StatusServiceUnavailable, grpc: codes.Unavailable,
+		description: "The database is unavailable, writes are refused, retry later."},
+	{code: CodeLeaderUnavailable, status: http.StatusServiceUnavailable, grpc: codes.Unavailable,
+		description: "The write can not reach the leader of the cluster, retry after Retry-After."},
+	{code: CodeInternal, status: http.StatusInternalServerError, grpc: codes.Internal,
+		description: "The request failed on the server."},
+}
+
+// errorKinds is the catalog by code
+var errorKinds = func() map[ErrorCode]*errorKind {
+	kinds := make(map[ErrorCode]*errorKind, len(errorCatalog))
+	for _, kind := range errorCatalog {
+		kinds[kind.code] = kind
+	}
+	return kinds
+}()
+
+// errorKindOf returns the entry of the catalog err is returned with, the one
+// of internal errors for the errors it does not know
+func errorKindOf(err error) *errorKind {
+	for _, kind := range errorCatalog {
+		if kind.matches(err) {
+			return kind
+		}
+	}
+	return errorKinds[CodeInternal]
+}
+
+// writeErrorCode writes message as the error response of code, with its status
+func writeErrorCode(w http.ResponseWriter, r *http.Request, code ErrorCode, message string) {
+	writeJSON(w, r, errorKinds[code].status, newErrorResponse(r.Context(), code, message))
+}
+
+// grpcStatus returns the grpc status of message with the code of kind, which
+// it carries in ErrorInfo details, and the message in the locale of ctx in
+// LocalizedMessage details when it has one
+func grpcStatus(ctx context.Context, kind *errorKind, message string) error {
+	st := status.New(kind.grpc, message)
+	info := &errdetails.ErrorInfo{Reason: string(kind.code), Domain: errorDomain}
+	detailed, err := st.WithDetails(info)
+	if localized := localize(ctx, "error."+string(kind.code), ""); localized != "" {
+		detailed, err = st.WithDetails(info, &errdetails.LocalizedMessage{Locale: LocaleFromContext(ctx), Message: localized})
+	}
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// grpcErrorCode returns the code of the ErrorInfo details of st, or the code
+// of the errors of its grpc code for the errors made by the gateway itself
+func grpcErrorCode(st *status.Status) ErrorCode {
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == errorDomain {
+			return ErrorCode(info.Reason)
+		}
+	}
+	switch st.Code() {
+	case codes.InvalidArgument:
+		return CodeValidationFailed
+	case codes.NotFound:
+		return CodeNotFound
+	case codes.Unimplemented:
+		return CodeNotSupported
+	case codes.Canceled:
+		return CodeRequestCancelled
+	case codes.DeadlineExceeded:
+		return CodeRequestTimeout
+	}
+	return CodeInternal
+}
+
+// errorCatalogEntry describes an error code to clients
+type errorCatalogEntry struct {
+	Code        ErrorCode `json:"code"`
+	Status      int       `json:"status"`
+	GRPCCode    string    `json:"grpcCode"`
+	Description string    `json:"description"`
+}
+
+// errorCatalogResponse is the catalog of the error codes
+type errorCatalogResponse struct {
+	Errors []*errorCatalogEntry `json:"errors"`
+}
+
+// ListErrorCodes returns the catalog of the codes of the error responses, with
+// the http status and grpc code each is returned with and what it means
+func ListErrorCodes(w http.ResponseWriter, r *http.Request) {
+	res := &errorCatalogResponse{Errors: make([]*errorCatalogEntry, 0, len(errorCatalog))}
+	for _, kind := range errorCatalog {
+		res.Errors = append(res.Errors, &errorCatalogEntry{
+			Code:        kind.code,
+			Status:      kind.status,
+			GRPCCode:    kind.grpc.String(),
+			Description: kind.description,
+		})
+	}
+	writeJSON(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/logging"
+)
+
+const (
+	// subscriberBuffer is the number of events queued for a subscriber of the bus
+	subscriberBuffer = 256
+	// publishTimeout bounds the wait of a write for subscribers with the Block policy
+	publishTimeout = 5 * time.Second
+)
+
+// publishingRepository publishes every successful order write to an event bus, so
+// integrations subscribe to the bus instead of being called from the handlers.
+// Unlike the outbox the events are lost when the process stops.
+type publishingRepository struct {
+	Repository
+	bus *events.Bus
+}
+
+// NewPublishingRepository returns repo publishing its order writes to bus
+func NewPublishingRepository(repo Repository, bus *events.Bus) Repository {
+	return &publishingRepository{Repository: repo, bus: bus}
+}
+
+// Unwrap returns the decorated repository
+func (p *publishingRepository) Unwrap() Repository {
+	return p.Repository
+}
+
+// Bus returns the bus the writes are published to
+func (p *publishingRepository) Bus() *events.Bus {
+	return p.bus
+}
+
+func (p *publishingRepository) publish(ctx context.Context, eventType events.Type, order *Order) {
+	event, err := newOutboxEvent(eventType, order)
+	if err != nil {
+		LoggerFromContext(ctx).Errorf("failed to create %s event of order %s: %v", eventType, order.ID, err)
+		return
+	}
+	p.publishEvent(ctx, event)
+}
+
+func (p *publishingRepository) publishEvent(ctx context.Context, event *events.Event) {
+	// a cancelled request must not keep the event from the subscribers
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	p.bus.Publish(ctx, event)
+}
+
+func (p *publishingRepository) CreateOrder(ctx context.Context, order *Order) error {
+	if err := p.Repository.CreateOrder(ctx, order); err != nil {
+		return err
+	}
+	p.publish(ctx, EventOrderCreated, order)
+	return nil
+}
+
+func (p *publishingRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	if err := p.Repository.UpdateOrder(ctx, order); err != nil {
+		return err
+	}
+	p.publish(ctx, eventTypeFromContext(ctx, EventOrderUpdated), order)
+	return nil
+}
+
+func (p *publishingRepository) DeleteOrder(ctx context.Context, id string) error {
+	if err := p.Repository.DeleteOrder(ctx, id); err != nil {
+		return err
+	}
+	p.publishEvent(ctx, newDeleteEvent(ctx, id))
+	return nil
+}
+
+// BatchCreateOrders keeps the bulk operation of the decorated repository
+func (p *publishingRepository) BatchCreateOrders(ctx context.Context, orders []*Order) []error {
+	errs := batchCreateOrders(ctx, p.Repository, orders)
+	for i, err := range errs {
+		if err == nil {
+			p.publish(ctx, EventOrderCreated, orders[i])
+		}
+	}
+	return errs
+}
+
+// BatchGetOrders keeps the bulk operation of the decorated repository
+func (p *publishingRepository) BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error) {
+	return batchGetOrders(ctx, p.Repository, ids)
+}
+
+// SearchOrders keeps the native search of the decorated repository
+func (p *publishingRepository) SearchOrders(ctx context.Context, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error) {
+	return searchOrders(ctx, p.Repository, query, limit, pageToken)
+}
+
+// the return methods publish the writes of the return store of the decorated repository
+
+func (p *publishingRepository) returnStore() (ReturnStore, error) {
+	store, ok := findReturnStore(p.Repository)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+func (p *publishingRepository) publishReturn(ctx context.Context, eventType events.Type, ret *Return) {
+	event, err := newReturnEvent(ctx, eventType, ret)
+	if err != nil {
+		LoggerFromContext(ctx).Errorf("failed to create %s event of return %s: %v", eventType, ret.ID, err)
+		return
+	}
+	p.publishEvent(ctx, event)
+}
+
+func (p *publishingRepository) CreateReturn(ctx context.Context, ret *Return) error {
+	store, err := p.returnStore()
+	if err != nil {
+		return err
+	}
+	if err := store.CreateReturn(ctx, ret); err != nil {
+		return err
+	}
+	p.publishReturn(ctx, events.ReturnRequested, ret)
+	return nil
+}
+
+func (p *publishingRepository) GetReturn(ctx context.Context, orderID, id string) (*Return, error) {
+	store, err := p.returnStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.GetReturn(ctx, orderID, id)
+}
+
+func (p *publishingRepository) ListReturns(ctx context.Context, orderID string) ([]*Return, error) {
+	store, err := p.returnStore()
+	if err != nil {
+		return nil, err
+	}
+	return store.ListReturns(ctx, orderID)
+}
+
+func (p *publishingRepository) UpdateReturn(ctx context.Context, ret *Return, eventType events.Type) error {
+	store, err := p.returnStore()
+	if err != nil {
+		return err
+	}
+	if err := store.UpdateReturn(ctx, ret, eventType); err != nil {
+		return err
+	}
+	p.publishReturn(ctx, eventType, ret)
+	return nil
+}
+
+// busProvider is implemented by repositories publishing to an event bus
+type busProvider interface {
+	Bus() *events.Bus
+}
+
+// findBus returns the event bus of repo or of the repository it decorates
+func findBus(repo Repository) (*events.Bus, bool) {
+	var bus *events.Bus
+	found := eachLayer(repo, func(r Repository) bool {
+		provider, ok := r.(busProvider)
+		if ok {
+			bus = provider.Bus()
+		}
+		return ok
+	})
+	return bus, found
+}
+
+// subscribePublisher hands the events of bus to publisher, once and without
+// retries, logging the failures with logger. It is used for the publishers when the outbox is disabled.
+func subscribePublisher(bus *events.Bus, name string, publisher EventPublisher, logger logging.Logger) *events.Subscription {
+	return bus.Subscribe(events.SubscribeOptions{
+		Name:   name,
+		Buffer: subscriberBuffer,
+		Policy: events.Block,
+	}, func(ctx context.Context, event *events.Event) {
+		if err := publisher.Publish(ctx, event); err != nil {
+			logger.Errorf("failed to publish %s event %s of order %s: %v", event.Type, event.ID, event.OrderID, err)
+		}
+	})
+}
+
+// subscribeMetrics counts the events of bus and the events its subscribers drop
+func subscribeMetrics(bus *events.Bus) *events.Subscription {
+	bus.OnDrop(func(subscriber string, event *events.Event) {
+		eventsDropped.WithLabelValues(subscriber).Inc()
+	})
+	return bus.Subscribe(events.SubscribeOptions{
+		Name:   "metrics",
+		Buffer: subscriberBuffer,
+		Policy: events.DropOldest,
+	}, func(ctx context.Context, event *events.Event) {
+		orderEvents.WithLabelValues(string(event.Type)).Inc()
+	})
+}
+
+// watchOrder returns a channel signalled when an event of order id is published
+// to the bus of repo, and the func ending the watch. The channel never fires when
+// repo has no bus; watchers keep polling for the writes of other instances anyway.
+func watchOrder(repo Repository, id string) (<-chan struct{}, func()) {
+	bus, ok := findBus(repo)
+	if !ok {
+		return nil, func() {}
+	}
+	changed := make(chan struct{}, 1)
+	sub := bus.Subscribe(events.SubscribeOptions{
+		Name:   "watch-" + id,
+		Buffer: subscriberBuffer,
+		Policy: events.DropOldest,
+	}, func(ctx context.Context, event *events.Event) {
+		if event.OrderID != id {
+			return
+		}
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	return changed, sub.Unsubscribe
+}
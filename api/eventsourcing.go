@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/events"
+)
+
+// the kinds of the entries of an order stream, which prefix their keys
+const (
+	streamEvent    = "event"
+	streamSnapshot = "snapshot"
+)
+
+// StreamEvent is an entry of the append-only event stream of an order, recorded
+// with every write of the order in the same transaction
+type StreamEvent struct {
+	OrderID string      `json:"orderId" dynamodbav:"orderId"`
+	Type    events.Type `json:"type" dynamodbav:"type"`
+	// Version is the version of the order after the event, or after its last
+	// write plus one for a delete
+	Version int64 `json:"version" dynamodbav:"version"`
+	// Patch is the JSON merge patch turning the order before the event into
+	// the order after it, the whole order for a create and none for a delete
+	Patch      json.RawMessage `json:"patch,omitempty" dynamodbav:"patch,omitempty"`
+	RequestID  string          `json:"requestId,omitempty" dynamodbav:"requestId,omitempty"`
+	RecordedAt time.Time       `json:"recordedAt" dynamodbav:"recordedAt"`
+	// Key orders the entries of the stream
+	Key string `json:"-" dynamodbav:"sk"`
+}
+
+// removed reports whether the event removed the order from the database, as
+// a delete or an archiving did, rather than changed it. A soft delete is a
+// change recorded as OrderDeleted too.
+func (e *StreamEvent) removed() bool {
+	return e.Patch == nil
+}
+
+// Snapshot is the whole order as it was after the event with the same key, so
+// the order is replayed from it rather than from its first event
+type Snapshot struct {
+	OrderID string          `json:"orderId" dynamodbav:"orderId"`
+	Version int64           `json:"version" dynamodbav:"version"`
+	Order   json.RawMessage `json:"order" dynamodbav:"order"`
+	TakenAt time.Time       `json:"takenAt" dynamodbav:"takenAt"`
+	Key     string          `json:"-" dynamodbav:"sk"`
+}
+
+// eventKey returns the key of the event the snapshot was taken after
+func (s *Snapshot) eventKey() string {
+	return streamEvent + strings.TrimPrefix(s.Key, streamSnapshot)
+}
+
+// EventStore is implemented by repositories keeping the event streams of the
+// orders. Its methods fail with ErrNotSupported until EnableEventSourcing is
+// called.
+type EventStore interface {
+	// LatestSnapshot returns the latest snapshot of the order with id taken at
+	// or before until, or of all when until is zero, or nil when there is none
+	LatestSnapshot(ctx context.Context, id string, until time.Time) (*Snapshot, error)
+	// ReadEvents returns the events of the order with id after the snapshot
+	// after, or all of them when it is nil, oldest first
+	ReadEvents(ctx context.Context, id string, after *Snapshot) ([]*StreamEvent, error)
+	// CompactStream replaces the stream of the order with id by a snapshot of
+	// the order as stored, dropping its history
+	CompactStream(ctx context.Context, id string) error
+}
+
+// eventSourcingEnabler is implemented by repositories able to keep event streams
+type eventSourcingEnabler interface {
+	enableEventSourcing(table string, snapshotEvery int)
+}
+
+// EnableEventSourcing makes repo record every order write in the event stream
+// of the order, in table for the backends that keep the streams in a separate
+// table, with a snapshot every snapshotEvery versions of an order
+func EnableEventSourcing(repo Repository, table string, snapshotEvery int) error {
+	enabler, ok := repo.(eventSourcingEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support event sourcing", repo)
+	}
+	enabler.enableEventSourcing(table, snapshotEvery)
+	return nil
+}
+
+// findEventStore returns the event store of repo or of the repository it decorates
+func findEventStore(repo Repository) (EventStore, bool) {
+	var store EventStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(EventStore)
+		return ok
+	})
+	return store, found
+}
+
+// streamKey returns the key of an entry of kind of the stream of an order
+// created at createdAt, which sorts the entries by the orders with the id and
+// then by version
+func streamKey(kind string, createdAt time.Time, version int64) string {
+	return fmt.Sprintf("%s#%020d#%010d", kind, createdAt.UnixNano(), version)
+}
+
+// newStreamEvent returns the event of the write turning prev into next, prev
+// is nil for a create and next for a delete
+func newStreamEvent(ctx context.Context, eventType events.Type, prev, next *Order) (*StreamEvent, error) {
+	event := &StreamEvent{Type: eventType, RequestID: RequestIDFromContext(ctx), RecordedAt: time.Now().UTC()}
+	switch {
+	case next == nil:
+		event.OrderID, event.Version = prev.ID, prev.Version+1
+		event.Key = streamKey(streamEvent, prev.CreatedAt, event.Version)
+		return event, nil
+	case prev == nil:
+		patch, err := json.Marshal(next)
+		if err != nil {
+			return nil, err
+		}
+		event.Patch = patch
+	default:
+		before, err := json.Marshal(prev)
+		if err != nil {
+			return nil, err
+		}
+		after, err := json.Marshal(next)
+		if err != nil {
+			return nil, err
+		}
+		patch, err := jsonpatch.CreateMergePatch(before, after)
+		if err != nil {
+			return nil, err
+		}
+		event.Patch = patch
+	}
+	event.OrderID, event.Version = next.ID, next.Version
+	event.Key = streamKey(streamEvent, next.CreatedAt, next.Version)
+	return event, nil
+}
+
+// newSnapshot returns the snapshot of next recorded with event, or nil when
+// none is due at its version
+func newSnapshot(next *Order, event *StreamEvent, snapshotEvery int) (*Snapshot, error) {
+	if next == nil || snapshotEvery <= 0 || next.Version == 0 || next.Version%int64(snapshotEvery) != 0 {
+		return nil, nil
+	}
+	return takeSnapshot(next, event.RecordedAt)
+}
+
+// takeSnapshot returns the snapshot of order taken at
+func takeSnapshot(order *Order, at time.Time) (*Snapshot, error) {
+	b, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{
+		OrderID: order.ID,
+		Version: order.Version,
+		Order:   b,
+		TakenAt: at,
+		Key:     streamKey(streamSnapshot, order.CreatedAt, order.Version),
+	}, nil
+}
+
+// replayOrder returns the order with id as it was at until, or as it is when
+// until is zero, replaying its events from its latest snapshot before. It
+// fails with ErrOrderNotFound when the order did not exist then.
+func replayOrder(ctx context.Context, store EventStore, id string, until time.Time) (*Order, error) {
+	snapshot, err := store.LatestSnapshot(ctx, id, until)
+	if err != nil {
+		return nil, err
+	}
+	var state []byte
+	if snapshot != nil {
+		state = snapshot.Order
+	}
+	events, err := store.ReadEvents(ctx, id, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	for _, event := range events {
+		if !until.IsZero() && event.RecordedAt.After(until) {
+			break
+		}
+		switch {
+		case event.removed():
+			state = nil
+		case event.Type == EventOrderCreated:
+			state = event.Patch
+		case state == nil:
+			// the order was written before its stream was started, the state
+			// is known from its first snapshot on
+			continue
+		default:
+			if state, err = jsonpatch.MergePatch(state, event.Patch); err != nil {
+				return nil, fmt.Errorf("failed to replay event %s of order %s: %v", event.Key, id, err)
+			}
+		}
+	}
+	if state == nil {
+		return nil, ErrOrderNotFound
+	}
+	order := &Order{}
+	if err := json.Unmarshal(state, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// eventStoreFromRequest returns the event store of the repository of r, or
+// ErrNotSupported when orders are not event sourced
+func eventStoreFromRequest(r *http.Request) (EventStore, error) {
+	store, ok := findEventStore(RepositoryFromContext(r.Context()))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// orderStreamResponse lists the events of the stream of an order
+type orderStreamResponse struct {
+	Events []*StreamEvent `json:"events"`
+}
+
+// GetOrderStream returns the events of the stream of the order named in the
+// path, oldest first. The changes are shown as stored, sealed fields stay sealed.
+func GetOrderStream(w http.ResponseWriter, r *http.Request) {
+	store, err := eventStoreFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx, id := r.Context(), mux.Vars(r)["orderId"]
+	events, err := store.ReadEvents(ctx, id, nil)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(events) == 0 {
+		// the stream of an erased order is compacted to a snapshot
+		snapshot, err := store.LatestSnapshot(ctx, id, time.Time{})
+		if err == nil && snapshot == nil {
+			err = ErrOrderNotFound
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, &orderStreamResponse{Events: events})
+}
+
+// GetOrderAsOf returns the order named in the path as it was at the time query
+// parameter, replayed from its stream
+func GetOrderAsOf(w http.ResponseWriter, r *http.Request) {
+	store, err := eventStoreFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	at, err := time.Parse(time.RFC3339, r.URL.Query().Get("time"))
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "time", Reason: "must be an RFC 3339 time"})
+		return
+	}
+	ctx := r.Context()
+	order, err := replayOrder(ctx, store, mux.Vars(r)["orderId"], at)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if encrypted, ok := findEncryption(RepositoryFromContext(ctx)); ok {
+		if err := openOrder(ctx, encrypted.sealer, order); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, order)
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/omnom-nom/order/payments"
+)
+
+// the related resources the expand query parameter embeds in orders
+const (
+	expandCustomer  = "customer"
+	expandShipments = "shipments"
+	expandPayments  = "payments"
+)
+
+// expandedField is the json field of an order holding its expansions
+const expandedField = "expanded"
+
+// expansionFields are the json fields of the order each expansion is read
+// from
+var expansionFields = map[string][]string{
+	expandCustomer:  {"customerId"},
+	expandShipments: {"shipments"},
+	expandPayments:  {"payment", "tenders", "ledger"},
+}
+
+// parseExpand returns the related resources to embed in the orders named by
+// the expand query parameter of params, a comma separated list
+func parseExpand(params url.Values) ([]string, error) {
+	value := strings.TrimSpace(params.Get("expand"))
+	if value == "" {
+		return nil, nil
+	}
+	selected := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := expansionFields[name]; !ok {
+			return nil, &ValidationError{Field: "expand", Reason: fmt.Sprintf("%q can not be expanded, only customer, shipments and payments", name)}
+		}
+		selected[name] = true
+	}
+	expand := make([]string, 0, len(selected))
+	for name := range selected {
+		expand = append(expand, name)
+	}
+	sort.Strings(expand)
+	return expand, nil
+}
+
+// orderPayments is the payments expansion of an order
+type orderPayments struct {
+	// Payment is the card payment, nil when the order was not paid by card
+	Payment *payments.Payment `json:"payment"`
+	Tenders []Tender          `json:"tenders"`
+	Ledger  []LedgerEntry     `json:"ledger"`
+}
+
+// orderExpansions are the related resources of the orders of a response
+type orderExpansions struct {
+	expand []string
+	// customers are the customers of the orders by id
+	customers map[string]*Customer
+}
+
+// loadExpansions reads the related resources of orders named in expand which
+// are not part of the orders, those of all the orders at once
+func loadExpansions(ctx context.Context, orders []*Order, expand []string) (*orderExpansions, error) {
+	e := &orderExpansions{expand: expand}
+	for _, name := range expand {
+		if name != expandCustomer {
+			continue
+		}
+		store, err := customerStoreFromContext(ctx)
+		if errors.Is(err, ErrNotSupported) {
+			// without customers kept the orders have none to embed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0, len(orders))
+		for _, order := range orders {
+			if order.CustomerID != "" {
+				ids = append(ids, order.CustomerID)
+			}
+		}
+		if e.customers, err = batchGetCustomers(ctx, store, ids); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// of returns the expansions of order by name, customer null when the customer
+// is not kept
+func (e *orderExpansions) of(order *Order) map[string]interface{} {
+	expanded := make(map[string]interface{}, len(e.expand))
+	for _, name := range e.expand {
+		switch name {
+		case expandCustomer:
+			expanded[name] = e.customers[order.CustomerID]
+		case expandShipments:
+			shipments := order.Shipments
+			if shipments == nil {
+				shipments = []Shipment{}
+			}
+			expanded[name] = shipments
+		case expandPayments:
+			p := &orderPayments{Payment: order.Payment, Tenders: order.Tenders, Ledger: order.Ledger}
+			if p.Tenders == nil {
+				p.Tenders = []Tender{}
+			}
+			if p.Ledger == nil {
+				p.Ledger = []LedgerEntry{}
+			}
+			expanded[name] = p
+		}
+	}
+	return expanded
+}
+
+// expandGatewayOrders adds the expansions named in expand to the json orders
+// of the gateway, reading the orders again whole, all at once
+func expandGatewayOrders(ctx context.Context, orders []map[string]json.RawMessage, expand []string) error {
+	ids := make([]string, 0, len(orders))
+	for _, order := range orders {
+		var id string
+		if err := json.Unmarshal(order["id"], &id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	found, err := batchGetOrders(ctx, RepositoryFromContext(ctx), ids)
+	if err != nil {
+		return err
+	}
+	read := make([]*Order, 0, len(found))
+	for _, id := range ids {
+		if order, ok := found[id]; ok {
+			read = append(read, order)
+		}
+	}
+	expansions, err := loadExpansions(ctx, read, expand)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		// an order deleted since it was listed is embedded nothing
+		order, ok := found[id]
+		if !ok {
+			order = &Order{ID: id}
+		}
+		if orders[i][expandedField], err = json.Marshal(expansions.of(order)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// MiddlewareExperiments is the factory name of the middleware assigning the
+// callers to the variants of the experiments
+const MiddlewareExperiments = "experiments"
+
+// experimentsHeader lists the variants the caller is assigned to in the
+// responses, as experiment=variant pairs
+const experimentsHeader = "X-Experiments"
+
+// variant is a variant of an experiment and its weight
+type variant struct {
+	name   string
+	weight int
+}
+
+// Experiments assigns customers to the variants of the experiments of its
+// configuration. A customer is always assigned the same variant of an
+// experiment, picked by the hash of the experiment and the customer in
+// proportion to the weights of the variants, as long as they do not change.
+type Experiments struct {
+	header string
+	// experiments are the variants of each experiment sorted by name
+	experiments map[string][]variant
+	names       []string
+}
+
+// NewExperiments returns the experiments of cfg
+func NewExperiments(cfg *config.ExperimentsConfig) *Experiments {
+	e := &Experiments{header: cfg.Header, experiments: make(map[string][]variant, len(cfg.Experiments))}
+	for name, weights := range cfg.Experiments {
+		variants := make([]variant, 0, len(weights))
+		for v, weight := range weights {
+			variants = append(variants, variant{name: v, weight: weight})
+		}
+		sort.Slice(variants, func(i, j int) bool { return variants[i].name < variants[j].name })
+		e.experiments[name] = variants
+		e.names = append(e.names, name)
+	}
+	sort.Strings(e.names)
+	return e
+}
+
+// assign returns the variant of the experiment with name customerID is
+// assigned to, false when there is no such experiment
+func (e *Experiments) assign(name, customerID string) (string, bool) {
+	variants, ok := e.experiments[name]
+	if !ok || customerID == "" {
+		return "", false
+	}
+	total := 0
+	for _, v := range variants {
+		total += v.weight
+	}
+	sum := sha256.Sum256([]byte(name + "\x00" + customerID))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range variants {
+		if bucket < v.weight {
+			return v.name, true
+		}
+		bucket -= v.weight
+	}
+	return variants[len(variants)-1].name, true
+}
+
+func (e *Experiments) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	customerID := strings.TrimSpace(r.Header.Get(e.header))
+	if customerID != "" && len(e.names) > 0 {
+		pairs := make([]string, 0, len(e.names))
+		for _, name := range e.names {
+			v, _ := e.assign(name, customerID)
+			pairs = append(pairs, name+"="+v)
+		}
+		w.Header().Set(experimentsHeader, strings.Join(pairs, ", "))
+	}
+	next(w, r.WithContext(WithExperiments(r.Context(), e, customerID)))
+}
+
+// experimentsState is the experiments of a request and the customer of its
+// caller, with the experiments the request was exposed to
+type experimentsState struct {
+	experiments *Experiments
+	customerID  string
+
+	mu      sync.Mutex
+	exposed map[string]bool
+}
+
+type experimentsKey struct{}
+
+// WithExperiments returns a copy of ctx assigning customerID, the customer of
+// the caller or empty, to the variants of experiments
+func WithExperiments(ctx context.Context, experiments *Experiments, customerID string) context.Context {
+	return context.WithValue(ctx, experimentsKey{}, &experimentsState{experiments: experiments, customerID: customerID})
+}
+
+// ExperimentVariant returns the variant of the experiment with name the
+// caller of ctx is assigned to, false when experiments are not enabled, there
+// is no such experiment or the request names no customer. The first call for
+// an experiment logs the exposure of the customer to its variant.
+func ExperimentVariant(ctx context.Context, name string) (string, bool) {
+	state, _ := ctx.Value(experimentsKey{}).(*experimentsState)
+	if state == nil {
+		return "", false
+	}
+	return ExperimentVariantFor(ctx, name, state.customerID)
+}
+
+// ExperimentVariantFor returns the variant of the experiment with name
+// customerID is assigned to like ExperimentVariant, for the requests naming
+// their customer in their body rather than the experiments header
+func ExperimentVariantFor(ctx context.Context, name, customerID string) (string, bool) {
+	state, _ := ctx.Value(experimentsKey{}).(*experimentsState)
+	if state == nil {
+		return "", false
+	}
+	v, ok := state.experiments.assign(name, customerID)
+	if !ok {
+		return "", false
+	}
+	state.mu.Lock()
+	key := name + "\x00" + customerID
+	exposed := state.exposed[key]
+	if !exposed {
+		if state.exposed == nil {
+			state.exposed = map[string]bool{}
+		}
+		state.exposed[key] = true
+	}
+	state.mu.Unlock()
+	if !exposed {
+		experimentExposures.WithLabelValues(name, v).Inc()
+		LoggerFromContext(ctx).WithFields(logging.Fields{"experiment": name, "variant": v, "customerId": customerID}).Info("experiment exposure")
+	}
+	return v, true
+}
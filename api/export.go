@@ -0,0 +1,542 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/redact"
+)
+
+// exportPageSize is the number of orders read from the repository, and flushed
+// to the client, at a time
+const exportPageSize = 500
+
+// export formats
+const (
+	ExportCSV  = "csv"
+	ExportJSON = "json"
+)
+
+// trailers of an export, sent after the last row
+const (
+	trailerExportCount = "X-Export-Count"
+	trailerExportError = "X-Export-Error"
+)
+
+// exportColumn is a column of an export and how to read it from an order,
+// a nil value is an empty cell
+type exportColumn struct {
+	name  string
+	value func(o *Order) interface{}
+}
+
+// pricingValue returns a field of the price breakdown of an order, nil when it has none
+func pricingValue(field func(o *Order) money.Money) func(o *Order) interface{} {
+	return func(o *Order) interface{} {
+		if o.Pricing == nil {
+			return nil
+		}
+		return field(o)
+	}
+}
+
+// paymentValue returns a field of the payment of an order, nil when it has none
+func paymentValue(field func(o *Order) interface{}) func(o *Order) interface{} {
+	return func(o *Order) interface{} {
+		if o.Payment == nil {
+			return nil
+		}
+		return field(o)
+	}
+}
+
+// exportColumns are the columns of an export, in their default order
+var exportColumns = []exportColumn{
+	{"id", func(o *Order) interface{} { return o.ID }},
+	{"customerId", func(o *Order) interface{} { return o.CustomerID }},
+	{"status", func(o *Order) interface{} { return string(o.Status) }},
+	{"createdAt", func(o *Order) interface{} { return o.CreatedAt.UTC().Format(time.RFC3339) }},
+	{"updatedAt", func(o *Order) interface{} { return o.UpdatedAt.UTC().Format(time.RFC3339) }},
+	{"quantity", func(o *Order) interface{} {
+		quantity := 0
+		for _, item := range o.Items {
+			quantity += item.Quantity
+		}
+		return quantity
+	}},
+	{"subtotal", pricingValue(func(o *Order) money.Money { return o.Pricing.Subtotal })},
+	{"discount", pricingValue(func(o *Order) money.Money { return o.Pricing.Discount })},
+	{"shipping", pricingValue(func(o *Order) money.Money { return o.Pricing.Shipping })},
+	{"tax", pricingValue(func(o *Order) money.Money { return o.Pricing.Tax })},
+	{"total", func(o *Order) interface{} { return o.Total }},
+	{"paymentProvider", paymentValue(func(o *Order) interface{} { return o.Payment.Provider })},
+	{"paymentId", paymentValue(func(o *Order) interface{} { return o.Payment.ID })},
+	{"paymentStatus", paymentValue(func(o *Order) interface{} { return string(o.Payment.Status) })},
+	{"currency", func(o *Order) interface{} { return o.Currency }},
+	{"paid", paymentValue(func(o *Order) interface{} { return o.Payment.Amount })},
+	{"refunded", paymentValue(func(o *Order) interface{} { return o.Payment.Refunded })},
+}
+
+// parseExportColumns returns the columns named in the comma separated list, all
+// columns when it is empty
+func parseExportColumns(list string) ([]exportColumn, error) {
+	if list == "" {
+		return exportColumns, nil
+	}
+	var columns []exportColumn
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, c := range exportColumns {
+			if c.name == name {
+				columns = append(columns, c)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &ValidationError{Field: "columns", Reason: fmt.Sprintf("unknown column %q", name)}
+		}
+	}
+	return columns, nil
+}
+
+// exportRequest is an export parsed from the query parameters of ExportOrders
+type exportRequest struct {
+	format  string
+	columns []exportColumn
+	query   *SearchQuery
+}
+
+// parseExportRequest reads the format, columns, from, to, status and customer
+// query parameters. from is inclusive and to exclusive, both dates or RFC3339 times.
+func parseExportRequest(params url.Values) (*exportRequest, error) {
+	req := &exportRequest{format: params.Get("format"), query: &SearchQuery{}}
+	switch req.format {
+	case "":
+		req.format = ExportCSV
+	case ExportCSV, ExportJSON:
+	default:
+		return nil, &ValidationError{Field: "format", Reason: "must be csv or json"}
+	}
+
+	columns, err := parseExportColumns(params.Get("columns"))
+	if err != nil {
+		return nil, err
+	}
+	req.columns = columns
+
+	var from, to time.Time
+	for _, bound := range []struct {
+		name string
+		op   string
+		t    *time.Time
+	}{{"from", ">=", &from}, {"to", "<", &to}} {
+		value := params.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		t, err := parseSearchTime(value)
+		if err != nil {
+			return nil, &ValidationError{Field: bound.name, Reason: "must be a date or an RFC3339 time"}
+		}
+		*bound.t = t
+		req.query.Created = append(req.query.Created, SearchCondition{Op: bound.op, Value: formatSQLTime(t)})
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return nil, &ValidationError{Field: "to", Reason: "must be after from"}
+	}
+	req.query.Status = Status(params.Get("status"))
+	req.query.CustomerID = params.Get("customer")
+	return req, nil
+}
+
+// redactColumns leaves out the columns r drops and redacts the values of
+// those it redacts
+func (req *exportRequest) redactColumns(r *redact.Redactor) {
+	columns := make([]exportColumn, 0, len(req.columns))
+	for _, c := range req.columns {
+		if r.Drops(c.name) {
+			continue
+		}
+		if r.Redacts(c.name) {
+			name, value := c.name, c.value
+			c.value = func(o *Order) interface{} {
+				redacted, _ := r.Value(name, value(o))
+				return redacted
+			}
+		}
+		columns = append(columns, c)
+	}
+	req.columns = columns
+}
+
+// contentType is the media type of the export
+func (req *exportRequest) contentType() string {
+	if req.format == ExportCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// fileName names the export started at now
+func (req *exportRequest) fileName(now time.Time) string {
+	name := "orders-" + now.UTC().Format("20060102-150405")
+	if req.format == ExportCSV {
+		return name + ".csv"
+	}
+	return name + ".jsonl"
+}
+
+// writer returns the writer of the rows of the export to out
+func (req *exportRequest) writer(out io.Writer) exportWriter {
+	if req.format == ExportCSV {
+		return &csvExportWriter{w: csv.NewWriter(out), columns: req.columns}
+	}
+	return &jsonExportWriter{enc: json.NewEncoder(out), columns: req.columns}
+}
+
+// exportWriter writes the rows of one export format
+type exportWriter interface {
+	WriteHeader() error
+	WriteRow(order *Order) error
+	// Flush writes the buffered rows to the underlying writer
+	Flush() error
+}
+
+type csvExportWriter struct {
+	w       *csv.Writer
+	columns []exportColumn
+}
+
+func (e *csvExportWriter) WriteHeader() error {
+	names := make([]string, len(e.columns))
+	for i, c := range e.columns {
+		names[i] = c.name
+	}
+	return e.w.Write(names)
+}
+
+func (e *csvExportWriter) WriteRow(order *Order) error {
+	record := make([]string, len(e.columns))
+	for i, c := range e.columns {
+		switch v := c.value(order).(type) {
+		case nil:
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case money.Money:
+			// the decimal number of major units, as in the JSON export
+			number, _ := v.MarshalJSON()
+			record[i] = string(number)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExportWriter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExportWriter writes one JSON object of the columns per line
+type jsonExportWriter struct {
+	enc     *json.Encoder
+	columns []exportColumn
+}
+
+func (e *jsonExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (e *jsonExportWriter) WriteRow(order *Order) error {
+	row := make(map[string]interface{}, len(e.columns))
+	for _, c := range e.columns {
+		row[c.name] = c.value(order)
+	}
+	return e.enc.Encode(row)
+}
+
+func (e *jsonExportWriter) Flush() error {
+	return nil
+}
+
+// writeExport writes the header and the orders of req to rows, a repository page
+// at a time followed by flush and a report of the number of orders written
+func writeExport(ctx context.Context, repo Repository, req *exportRequest, rows exportWriter, flush func() error, report func(count int)) (int, error) {
+	count := 0
+	err := rows.WriteHeader()
+	pageToken := ""
+	for err == nil {
+		var orders []*Order
+		orders, pageToken, err = searchOrders(ctx, repo, req.query, exportPageSize, pageToken)
+		if err != nil {
+			break
+		}
+		for _, order := range orders {
+			if err = rows.WriteRow(order); err != nil {
+				break
+			}
+			count++
+		}
+		if err == nil {
+			err = flush()
+		}
+		report(count)
+		if pageToken == "" {
+			break
+		}
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	return count, err
+}
+
+// ExportOrders streams the orders created between the from and to query
+// parameters as csv or JSON lines, newest first. The rows are written a
+// repository page at a time with chunked transfer encoding and gzip compressed
+// when the client accepts it. As the status is sent before the first row, the
+// number of exported orders, or the error that ended the export early, follows
+// the rows in a trailer.
+func ExportOrders(w http.ResponseWriter, r *http.Request) {
+	req, err := parseExportRequest(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx := r.Context()
+	logger := LoggerFromContext(ctx)
+	redactor := RedactorFromContext(ctx)
+	req.redactColumns(redactor)
+
+	header := w.Header()
+	header.Set("Content-Type", req.contentType())
+	header.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, req.fileName(time.Now())))
+	header.Set("Trailer", trailerExportCount+", "+trailerExportError)
+	header.Add("Vary", "Accept-Encoding")
+
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		header.Set("Content-Encoding", "gzip")
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	rows := req.writer(out)
+	w.WriteHeader(http.StatusOK)
+
+	// flush sends the rows written so far to the client
+	flush := func() error {
+		if err := rows.Flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+
+	count, err := writeExport(ctx, RepositoryFromContext(ctx), req, rows, flush, func(int) {})
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+
+	header.Set(trailerExportCount, strconv.Itoa(count))
+	if err != nil {
+		logger.Errorf("export failed after %d orders: %v", count, err)
+		header.Set(trailerExportError, redactor.Text(err.Error()))
+		return
+	}
+	logger.Infof("exported %d orders", count)
+}
+
+// exportURLExpiry is the validity of the download link of an export job, the
+// longest s3 allows
+const exportURLExpiry = 7 * 24 * time.Hour
+
+// ExportJob is the type of the jobs exporting orders to s3
+const ExportJob jobs.Type = "export"
+
+// exportParams are the params of an export job, the query of its request
+type exportParams struct {
+	Query string `json:"query"`
+}
+
+// ExportResult is the result of an export job
+type ExportResult struct {
+	Orders int    `json:"orders"`
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key,omitempty"`
+	// URL downloads the export until URLExpiresAt
+	URL          string     `json:"url,omitempty"`
+	URLExpiresAt *time.Time `json:"urlExpiresAt,omitempty"`
+}
+
+// StartExport queues a job exporting the orders selected by the query parameters
+// of ExportOrders to a gzip compressed file in the jobs bucket, for exports too
+// large to stream. It is answered to be followed with GetJob, whose result
+// links the file.
+func StartExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pool, err := jobsFromContext(ctx)
+	if err == nil && ConfigFromContext(ctx).Jobs.Bucket == "" {
+		err = ErrNotSupported
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if _, err := parseExportRequest(r.URL.Query()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	job, err := pool.Enqueue(ctx, ExportJob, &exportParams{Query: r.URL.RawQuery})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", jobLocation(job.ID))
+	writeJSON(w, r, http.StatusAccepted, job)
+}
+
+// s3Exporter runs the export jobs, writing their files to s3
+type s3Exporter struct {
+	repo    Repository
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+	prefix  string
+	// redactor redacts the columns of the exports
+	redactor *redact.Redactor
+}
+
+// NewExportJob returns the function of the export jobs, reading orders from
+// repo and writing them to the jobs bucket of cfg
+func NewExportJob(ctx context.Context, cfg *config.Config, repo Repository) (jobs.Func, error) {
+	e, err := newS3Exporter(ctx, cfg, repo)
+	if err != nil {
+		return nil, err
+	}
+	return e.run, nil
+}
+
+// newS3Exporter returns the exporter of repo to the jobs bucket of cfg
+func newS3Exporter(ctx context.Context, cfg *config.Config, repo Repository) (*s3Exporter, error) {
+	client, err := newS3Client(ctx, cfg, cfg.Jobs.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Exporter{
+		repo:     repo,
+		client:   client,
+		presign:  s3.NewPresignClient(client),
+		bucket:   cfg.Jobs.Bucket,
+		prefix:   cfg.Jobs.Prefix,
+		redactor: redact.New(cfg.Redaction),
+	}, nil
+}
+
+// run writes the export of job to a temporary file, which is uploaded once complete
+func (e *s3Exporter) run(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+	var params exportParams
+	if err := job.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	query, err := url.ParseQuery(params.Query)
+	if err != nil {
+		return nil, err
+	}
+	req, err := parseExportRequest(query)
+	if err != nil {
+		return nil, err
+	}
+	req.redactColumns(e.redactor)
+
+	file, err := os.CreateTemp("", "order-export-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	rows := req.writer(gz)
+	count, err := writeExport(ctx, e.repo, req, rows, rows.Flush, func(n int) { report(int64(n), 0) })
+	if err == nil {
+		err = gz.Close()
+	}
+	res := &ExportResult{Orders: count}
+	if err != nil {
+		return res, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return res, err
+	}
+
+	name := req.fileName(job.CreatedAt) + ".gz"
+	key := e.prefix + job.ID + "/" + name
+	if err := e.upload(ctx, key, name, "application/gzip", file); err != nil {
+		return res, err
+	}
+	res.Bucket, res.Key = e.bucket, key
+	download, expires, err := e.link(ctx, key)
+	if err != nil {
+		return res, err
+	}
+	res.URL, res.URLExpiresAt = download, &expires
+	LoggerFromContext(ctx).Infof("exported %d orders to %s", count, key)
+	return res, nil
+}
+
+// upload writes body to key of the jobs bucket, downloaded as name
+func (e *s3Exporter) upload(ctx context.Context, key, name, contentType string, body io.Reader) error {
+	_, err := e.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(e.bucket),
+		Key:                aws.String(key),
+		Body:               body,
+		ContentType:        aws.String(contentType),
+		ContentDisposition: aws.String(fmt.Sprintf(`attachment; filename="%s"`, name)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write export %s: %v", key, err)
+	}
+	return nil
+}
+
+// link returns the link downloading key of the jobs bucket until it expires
+func (e *s3Exporter) link(ctx context.Context, key string) (string, time.Time, error) {
+	presigned, err := e.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(e.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(exportURLExpiry))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to sign the link of export %s: %v", key, err)
+	}
+	return presigned.URL, time.Now().UTC().Add(exportURLExpiry), nil
+}
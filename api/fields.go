@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+// orderAttributes maps the json fields of Order to their attributes in
+// DynamoDB
+var orderAttributes = newOrderAttributes()
+
+func newOrderAttributes() map[string]string {
+	attrs := map[string]string{}
+	t := reflect.TypeOf(Order{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		attr, _, _ := strings.Cut(t.Field(i).Tag.Get("dynamodbav"), ",")
+		if name != "" && name != "-" && name != "sealed" {
+			attrs[name] = attr
+		}
+	}
+	return attrs
+}
+
+// protoOrderFields are the json fields of the orders of the grpc gateway
+var protoOrderFields = newProtoOrderFields()
+
+func newProtoOrderFields() map[string]string {
+	fields := map[string]string{}
+	descriptor := (&orderpb.Order{}).ProtoReflect().Descriptor().Fields()
+	for i := 0; i < descriptor.Len(); i++ {
+		fields[descriptor.Get(i).JSONName()] = ""
+	}
+	return fields
+}
+
+// parseFields returns the fields of the orders selected by the fields query
+// parameter of params, a comma separated list of the json fields of known,
+// with the id always selected. It returns nil when params select no fields,
+// for the orders to be returned whole.
+func parseFields(params url.Values, known map[string]string) ([]string, error) {
+	value := strings.TrimSpace(params.Get("fields"))
+	if value == "" {
+		return nil, nil
+	}
+	selected := map[string]bool{"id": true}
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if _, ok := known[field]; !ok {
+			return nil, &ValidationError{Field: "fields", Reason: fmt.Sprintf("%q is not a field of orders", field)}
+		}
+		selected[field] = true
+	}
+	fields := make([]string, 0, len(selected))
+	for field := range selected {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// orderShape is the shape of the orders of a response: the fields selected by
+// the fields query parameter, nil for whole orders, and the related resources
+// embedded by the expand query parameter
+type orderShape struct {
+	fields []string
+	expand []string
+}
+
+// parseOrderShape returns the shape of the orders selected by params, with the
+// fields among those of known
+func parseOrderShape(params url.Values, known map[string]string) (orderShape, error) {
+	fields, err := parseFields(params, known)
+	if err != nil {
+		return orderShape{}, err
+	}
+	expand, err := parseExpand(params)
+	if err != nil {
+		return orderShape{}, err
+	}
+	return orderShape{fields: fields, expand: expand}, nil
+}
+
+// whole reports whether the orders are returned whole and nothing else
+func (s orderShape) whole() bool {
+	return s.fields == nil && s.expand == nil
+}
+
+// readFields returns the fields of the orders to read for the shape: the
+// fields selected and those the expansions are read from, nil for whole orders
+func (s orderShape) readFields() []string {
+	if s.fields == nil {
+		return nil
+	}
+	read := append([]string{}, s.fields...)
+	for _, name := range s.expand {
+		read = append(read, expansionFields[name]...)
+	}
+	return read
+}
+
+// render returns the json of order in the shape, with the related resources
+// of expansions
+func (s orderShape) render(order *Order, expansions *orderExpansions) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	var rendered map[string]json.RawMessage
+	if err := json.Unmarshal(data, &rendered); err != nil {
+		return nil, err
+	}
+	if s.fields != nil {
+		rendered = pickFields(rendered, s.fields)
+	}
+	if expansions != nil {
+		if rendered[expandedField], err = json.Marshal(expansions.of(order)); err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// projectionAttributes returns the DynamoDB attributes read for the orders
+// with fields: those of the fields, with the attributes the repository and its
+// decorators need to read any order
+func projectionAttributes(fields []string) []string {
+	needed := map[string]bool{
+		AttrOrderID: true,
+		AttrVersion: true,
+		// the amounts are read in the currency of the order
+		"currency": true,
+		// the soft deleted orders are left out, the sealed fields opened
+		"deletedAt": true,
+		"sealed":    true,
+	}
+	for _, field := range fields {
+		if attr := orderAttributes[field]; attr != "" {
+			needed[attr] = true
+		}
+	}
+	projection := make([]string, 0, len(needed))
+	for attr := range needed {
+		projection = append(projection, attr)
+	}
+	sort.Strings(projection)
+	return projection
+}
+
+// pickFields returns the fields of the json object all
+func pickFields(all map[string]json.RawMessage, fields []string) map[string]json.RawMessage {
+	picked := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		if value, ok := all[field]; ok {
+			picked[field] = value
+		}
+	}
+	return picked
+}
+
+// projectedOrdersResponse is the body of the listings of orders with fields
+// or expansions
+type projectedOrdersResponse struct {
+	Orders        []map[string]json.RawMessage `json:"orders"`
+	NextPageToken string                       `json:"nextPageToken,omitempty"`
+}
+
+// writeOrders writes the page of orders of a listing, with the cursor of the
+// next page, as a listOrdersResponse or with the orders in shape
+func writeOrders(w http.ResponseWriter, r *http.Request, orders []*Order, next string, shape orderShape) {
+	if orders == nil {
+		orders = []*Order{}
+	}
+	if shape.whole() {
+		writeJSON(w, r, http.StatusOK, &listOrdersResponse{Orders: orders, NextPageToken: next})
+		return
+	}
+	var expansions *orderExpansions
+	if shape.expand != nil {
+		var err error
+		if expansions, err = loadExpansions(r.Context(), orders, shape.expand); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	resp := &projectedOrdersResponse{Orders: make([]map[string]json.RawMessage, 0, len(orders)), NextPageToken: next}
+	for _, order := range orders {
+		projected, err := shape.render(order, expansions)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp.Orders = append(resp.Orders, projected)
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// projectGateway serves the route r of gateway with its order, or the orders of
+// its listing, in shape. The fields to read reach the repository with the
+// context, for listings to read only them, and the orders expanded are read
+// again whole at once, as those of the gateway lack their related resources.
+func projectGateway(w http.ResponseWriter, r *http.Request, gateway http.Handler, shape orderShape) {
+	ctx := r.Context()
+	resp := &bufferedResponse{header: http.Header{}}
+	gateway.ServeHTTP(resp, r.WithContext(withFields(ctx, shape.readFields())))
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	if resp.status != http.StatusOK {
+		resp.writeTo(w)
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(resp.body.Bytes(), &body); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for key, values := range resp.header {
+		w.Header()[key] = values
+	}
+	w.Header().Del("Content-Length")
+	_, listing := body["orders"]
+	orders := []map[string]json.RawMessage{body}
+	if listing {
+		if err := json.Unmarshal(body["orders"], &orders); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	for i, order := range orders {
+		if shape.fields != nil {
+			orders[i] = pickFields(order, shape.fields)
+		}
+	}
+	if shape.expand != nil {
+		if err := expandGatewayOrders(ctx, orders, shape.expand); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	if !listing {
+		writeJSON(w, r, http.StatusOK, orders[0])
+		return
+	}
+	projected, err := json.Marshal(orders)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	body["orders"] = projected
+	writeJSON(w, r, http.StatusOK, body)
+}
+
+type fieldsKey struct{}
+
+// withFields returns a copy of ctx selecting fields of the orders listed
+func withFields(ctx context.Context, fields []string) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, fields)
+}
+
+// fieldsFromContext returns the fields of the orders selected in ctx, nil for
+// whole orders
+func fieldsFromContext(ctx context.Context) []string {
+	fields, _ := ctx.Value(fieldsKey{}).([]string)
+	return fields
+}
@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/fraud"
+)
+
+var (
+	// ErrOrderRejected is returned when the fraud screening rejects a new order,
+	// the reasons are logged and not told to the client
+	ErrOrderRejected = errors.New("order rejected")
+	// ErrNotHeld is returned when reviewing an order that is not held for review
+	ErrNotHeld = errors.New("order is not held for review")
+)
+
+// FraudReview is the fraud screening of an order and its review
+type FraudReview struct {
+	// Verdict is the verdict of the screening, empty while an order created in
+	// async mode waits for it
+	Verdict    fraud.Verdict `json:"verdict,omitempty" dynamodbav:"verdict,omitempty"`
+	Reasons    []string      `json:"reasons,omitempty" dynamodbav:"reasons,omitempty"`
+	ScreenedAt *time.Time    `json:"screenedAt,omitempty" dynamodbav:"screenedAt,omitempty"`
+	// ReviewedAt and Note are set once a reviewer released or rejected the held order
+	ReviewedAt *time.Time `json:"reviewedAt,omitempty" dynamodbav:"reviewedAt,omitempty"`
+	Note       string     `json:"note,omitempty" dynamodbav:"note,omitempty"`
+}
+
+// FraudScreen screens new orders with a checker in the mode of its configuration
+type FraudScreen struct {
+	checker fraud.Checker
+	cfg     config.FraudConfig
+}
+
+// NewFraudScreen returns a screen of the new orders calling checker
+func NewFraudScreen(checker fraud.Checker, cfg *config.FraudConfig) *FraudScreen {
+	return &FraudScreen{checker: checker, cfg: *cfg}
+}
+
+type fraudKey struct{}
+
+// WithFraud returns a copy of ctx carrying screen
+func WithFraud(ctx context.Context, screen *FraudScreen) context.Context {
+	return context.WithValue(ctx, fraudKey{}, screen)
+}
+
+// FraudFromContext returns the fraud screen stored in ctx, or nil when orders
+// are not screened
+func FraudFromContext(ctx context.Context) *FraudScreen {
+	screen, _ := ctx.Value(fraudKey{}).(*FraudScreen)
+	return screen
+}
+
+// fraudRequest returns the request screening order
+func fraudRequest(order *Order) *fraud.Request {
+	req := &fraud.Request{OrderID: order.ID, CustomerID: order.CustomerID, Amount: order.Total.Decimal()}
+	if a := order.ShippingAddress; a != nil {
+		req.ShippingAddress = &fraud.Address{Country: a.Country, PostalCode: a.PostalCode}
+	}
+	return req
+}
+
+// check screens order within the timeout. An order whose screening failed is
+// approved with failOpen and held for review otherwise.
+func (f *FraudScreen) check(ctx context.Context, order *Order) *FraudReview {
+	checkCtx, cancel := context.WithTimeout(ctx, f.cfg.Timeout.Duration)
+	defer cancel()
+	decision, err := f.checker.Check(checkCtx, fraudRequest(order))
+	if err == nil && !decision.Verdict.Valid() {
+		err = fmt.Errorf("unknown verdict %q", decision.Verdict)
+	}
+	if err != nil {
+		LoggerFromContext(ctx).Errorf("failed to screen order %s: %v", order.ID, err)
+		decision = &fraud.Decision{Verdict: fraud.VerdictReview, Reasons: []string{"screening failed"}}
+		if f.cfg.FailOpen {
+			decision.Verdict = fraud.VerdictApprove
+		}
+	}
+	fraudVerdicts.WithLabelValues(string(decision.Verdict)).Inc()
+	now := time.Now().UTC()
+	return &FraudReview{Verdict: decision.Verdict, Reasons: decision.Reasons, ScreenedAt: &now}
+}
+
+// screen screens a new order before it is stored. In sync mode a rejected
+// order fails with ErrOrderRejected and a doubtful one is held, in async mode
+// every order is held until screenLater screened it.
+func (f *FraudScreen) screen(ctx context.Context, order *Order) error {
+	if f.cfg.Mode == config.FraudModeAsync {
+		order.Status = StatusHeld
+		order.Fraud = &FraudReview{}
+		return nil
+	}
+	review := f.check(ctx, order)
+	switch review.Verdict {
+	case fraud.VerdictReject:
+		LoggerFromContext(ctx).Warnf("rejected order %s of customer %s: %s", order.ID, order.CustomerID, strings.Join(review.Reasons, ", "))
+		return ErrOrderRejected
+	case fraud.VerdictReview:
+		order.Status = StatusHeld
+	}
+	order.Fraud = review
+	return nil
+}
+
+// screenLater screens the order with id created in async mode, in the
+// background as ctx is not cancelled. The approved order is released, the
+// rejected one cancelled and the doubtful one stays held for review.
+func (f *FraudScreen) screenLater(ctx context.Context, repo Repository, id string) {
+	logger := LoggerFromContext(ctx)
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		logger.Errorf("failed to screen order %s: %v", id, err)
+		return
+	}
+	defer unlock()
+
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		logger.Errorf("failed to screen order %s: %v", id, err)
+		return
+	}
+	if order.Status != StatusHeld || order.Fraud == nil || order.Fraud.Verdict != "" {
+		// cancelled since, e.g. as its payment was declined
+		return
+	}
+	order.Fraud = f.check(ctx, order)
+	switch order.Fraud.Verdict {
+	case fraud.VerdictApprove:
+		_, err = releaseOrder(ctx, repo, order)
+	case fraud.VerdictReject:
+		logger.Warnf("rejected order %s of customer %s: %s", order.ID, order.CustomerID, strings.Join(order.Fraud.Reasons, ", "))
+		_, err = cancelLockedOrder(ctx, repo, order, &cancelOrderRequest{Reason: CancelFraudSuspected, Note: "rejected by fraud screening"})
+	default:
+		logger.Infof("held order %s for review: %s", order.ID, strings.Join(order.Fraud.Reasons, ", "))
+		_, err = saveOrder(ctx, repo, order)
+	}
+	if err != nil && !errors.Is(err, ErrPaymentDeclined) {
+		logger.Errorf("failed to record the screening of order %s: %v", id, err)
+	}
+}
+
+// releaseOrder lets a held order through as pending, routing it to warehouses
+// and capturing its authorized payment. It stores the order.
+func releaseOrder(ctx context.Context, repo Repository, order *Order) (*Order, error) {
+	order.Status = StatusPending
+	routeConfirmed(ctx, repo, order)
+	var err error
+	if pay := PaymentsFromContext(ctx); pay != nil && (order.Payment != nil || len(order.Tenders) > 0) {
+		if err := pay.capture(ctx, order); err != nil {
+			return nil, err
+		}
+		order, err = settlePayment(ctx, repo, order)
+	} else {
+		order, err = saveOrder(ctx, repo, order)
+	}
+	if err == nil {
+		queueRouting(ctx, order)
+	}
+	return order, err
+}
+
+// orderHistory is the past of customers the fraud rules look up in the
+// orders of repo and the customers of customers
+type orderHistory struct {
+	repo      Repository
+	customers CustomerStore
+	// limit is the number of recent orders from which their count does not
+	// matter any more
+	limit int
+}
+
+func (h *orderHistory) RecentOrders(ctx context.Context, req *fraud.Request, since time.Time) (int, error) {
+	// the orders of a customer are listed newest first
+	orders, _, err := h.repo.ListOrders(ctx, ListOptions{CustomerID: req.CustomerID, Limit: h.limit + 1})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, order := range orders {
+		if order.CreatedAt.Before(since) {
+			break
+		}
+		if order.ID != req.OrderID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (h *orderHistory) Countries(ctx context.Context, req *fraud.Request) ([]string, error) {
+	if h.customers == nil {
+		return nil, nil
+	}
+	customer, err := h.customers.GetCustomer(ctx, req.CustomerID)
+	if errors.Is(err, ErrCustomerNotFound) || errors.Is(err, ErrNotSupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var countries []string
+	for _, address := range customer.Addresses {
+		countries = append(countries, address.Country)
+	}
+	return countries, nil
+}
+
+// reviewOrderRequest is the body of ReleaseOrder and RejectOrder
+type reviewOrderRequest struct {
+	Note string `json:"note,omitempty"`
+}
+
+// readReviewRequest decodes the optional body of a review
+func readReviewRequest(r *http.Request) (*reviewOrderRequest, error) {
+	var req reviewOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	if len(req.Note) > maxCancelNoteLength {
+		return nil, &ValidationError{Field: "note", Reason: fmt.Sprintf("must have at most %d characters", maxCancelNoteLength)}
+	}
+	return &req, nil
+}
+
+// reviewOrder locks the order with id and hands it to decide once the review
+// of req is recorded in it. It fails with ErrNotHeld unless the order is held.
+func reviewOrder(ctx context.Context, repo Repository, id string, req *reviewOrderRequest, decide func(ctx context.Context, order *Order) (*Order, error)) (*Order, error) {
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if order.Status != StatusHeld {
+		return nil, ErrNotHeld
+	}
+	now := time.Now().UTC()
+	if order.Fraud == nil {
+		order.Fraud = &FraudReview{}
+	}
+	order.Fraud.ReviewedAt = &now
+	order.Fraud.Note = req.Note
+	return decide(ctx, order)
+}
+
+// ListHeldOrders returns a page of the orders held for review, newest first
+func ListHeldOrders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	params := r.URL.Query()
+	limit, err := pageLimit(params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	shape, err := parseOrderShape(params, orderAttributes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	keys, err := parseSort(params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	orders, next, err := listOrdersPage(ctx, RepositoryFromContext(ctx), ListOptions{
+		Status:    StatusHeld,
+		Limit:     limit,
+		PageToken: params.Get("pageToken"),
+		Fields:    shape.readFields(),
+		Sort:      keys,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOrders(w, r, orders, next, shape)
+}
+
+// ReleaseOrder lets the held order named in the path through as pending and
+// captures its payment
+func ReleaseOrder(w http.ResponseWriter, r *http.Request) {
+	req, err := readReviewRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx := r.Context()
+	order, err := reviewOrder(ctx, RepositoryFromContext(ctx), mux.Vars(r)["orderId"], req, func(ctx context.Context, order *Order) (*Order, error) {
+		return releaseOrder(ctx, RepositoryFromContext(ctx), order)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("released held order %s", order.ID)
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	writeJSON(w, r, http.StatusOK, order)
+}
+
+// RejectOrder cancels the held order named in the path as fraud_suspected,
+// voiding its payment and releasing its stock
+func RejectOrder(w http.ResponseWriter, r *http.Request) {
+	req, err := readReviewRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx := r.Context()
+	order, err := reviewOrder(ctx, RepositoryFromContext(ctx), mux.Vars(r)["orderId"], req, func(ctx context.Context, order *Order) (*Order, error) {
+		return cancelLockedOrder(ctx, RepositoryFromContext(ctx), order, &cancelOrderRequest{Reason: CancelFraudSuspected, Note: req.Note})
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("rejected held order %s", order.ID)
+	w.Header().Set("ETag", order.ETag())
+	setLastModified(w, order.UpdatedAt)
+	writeJSON(w, r, http.StatusOK, order)
+}
@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// MiddlewareGatekeeper is the factory name of the gatekeeper middleware
+const MiddlewareGatekeeper = "gatekeeper"
+
+// Gatekeeper rejects requests that may modify state while the service is read only
+type Gatekeeper struct {
+	store *config.Store
+}
+
+// NewGatekeeper returns a gatekeeper following the gatekeeper settings in store
+func NewGatekeeper(store *config.Store) *Gatekeeper {
+	return &Gatekeeper{store: store}
+}
+
+func (g *Gatekeeper) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	settings := g.store.Current().Gatekeeper
+	if settings.ReadOnly && !isReadOnlyMethod(r.Method) && !isAdminPath(r.URL.Path) {
+		message := settings.Message
+		if message == "" {
+			message = "service is read only"
+		}
+		writeErrorCode(w, r, CodeReadOnly, message)
+		return
+	}
+	next(w, r)
+}
+
+func isReadOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
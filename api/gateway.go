@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+// httpCodeHeader is grpc header metadata setting the http status of a gateway response
+const httpCodeHeader = "x-http-code"
+
+// newGateway returns the handler of the REST routes generated from the http
+// options of order.proto. It calls the grpc methods in process with the
+// repository of the request context.
+func newGateway() (http.Handler, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   protojson.MarshalOptions{EmitUnpopulated: true},
+			UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+		}),
+		runtime.WithErrorHandler(gatewayError),
+		runtime.WithForwardResponseOption(gatewayResponse),
+	)
+	if err := orderpb.RegisterOrderServiceHandlerServer(context.Background(), mux, &orderServer{}); err != nil {
+		return nil, fmt.Errorf("failed to register the order gateway: %v", err)
+	}
+	return mux, nil
+}
+
+type gatewayKey struct{}
+
+// withGateway returns a copy of ctx carrying the gateway handler
+func withGateway(ctx context.Context, gateway http.Handler) context.Context {
+	return context.WithValue(ctx, gatewayKey{}, gateway)
+}
+
+// gatewayFromContext returns the gateway handler stored in ctx, or nil
+func gatewayFromContext(ctx context.Context) http.Handler {
+	gateway, _ := ctx.Value(gatewayKey{}).(http.Handler)
+	return gateway
+}
+
+// projectedGatewayRoutes are the gateway routes taking the fields and expand
+// query parameters
+var projectedGatewayRoutes = map[string]bool{
+	"GetOrder":   true,
+	"ListOrders": true,
+}
+
+// Gateway serves the routes of the grpc OrderService methods, the sort query
+// parameter of ListOrders reaching it with the context
+func Gateway(w http.ResponseWriter, r *http.Request) {
+	gateway := gatewayFromContext(r.Context())
+	if gateway == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	name, _ := RouteName(r)
+	if name == "ListOrders" {
+		keys, err := parseSort(r.URL.Query())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		r = r.WithContext(withSort(r.Context(), keys))
+	}
+	if projectedGatewayRoutes[name] {
+		shape, err := parseOrderShape(r.URL.Query(), protoOrderFields)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if !shape.whole() {
+			projectGateway(w, r, gateway, shape)
+			return
+		}
+	}
+	gateway.ServeHTTP(w, r)
+}
+
+// OpenAPI serves the OpenAPI document of the routes generated from order.proto,
+// with the docs of routeDocs
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(openAPIDocument()); err != nil {
+		LoggerFromContext(r.Context()).Errorf("failed to write OpenAPI document: %s", err)
+	}
+}
+
+// gatewayError writes grpc errors as the errorResponse of the hand written routes
+func gatewayError(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	writeJSON(w, r, runtime.HTTPStatusFromCode(st.Code()), newErrorResponse(r.Context(), grpcErrorCode(st), st.Message()))
+}
+
+// gatewayResponse sets the ETag and Last-Modified of orders, the X-Duplicate-Of header of the
+// orders suspected to be duplicates and the http status chosen by the grpc method
+func gatewayResponse(ctx context.Context, w http.ResponseWriter, m proto.Message) error {
+	if order, ok := m.(*orderpb.Order); ok {
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, order.GetVersion()))
+		if order.GetUpdatedAt() != nil {
+			setLastModified(w, order.GetUpdatedAt().AsTime())
+		}
+	}
+
+	md, ok := runtime.ServerMetadataFromContext(ctx)
+	if !ok {
+		return nil
+	}
+	if values := md.HeaderMD.Get(duplicateOfHeader); len(values) > 0 {
+		w.Header().Del("Grpc-Metadata-" + duplicateOfHeader)
+		w.Header().Set("X-Duplicate-Of", values[0])
+	}
+	if values := md.HeaderMD.Get(httpCodeHeader); len(values) > 0 {
+		code, err := strconv.Atoi(values[0])
+		if err != nil {
+			return err
+		}
+		delete(md.HeaderMD, httpCodeHeader)
+		w.Header().Del("Grpc-Metadata-" + httpCodeHeader)
+		w.WriteHeader(code)
+	}
+	return nil
+}
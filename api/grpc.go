@@ -0,0 +1,503 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soheilhy/cmux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/i18n"
+	"github.com/omnom-nom/order/inventory"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/pricing"
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+const (
+	// watchInterval is how often WatchOrder looks for a new version of the order
+	// written by another instance, writes of this one are seen on the event bus
+	watchInterval = time.Second
+	// grpcStopTimeout bounds the wait for calls in progress, streams are cut after it
+	grpcStopTimeout = 5 * time.Second
+)
+
+// orderServer implements the grpc OrderService with the same operations as the http handlers
+type orderServer struct {
+	orderpb.UnimplementedOrderServiceServer
+	// repo is the repository of the grpc server, the gateway uses the one of the request
+	repo Repository
+}
+
+func (s *orderServer) repository(ctx context.Context) Repository {
+	if s.repo != nil {
+		return s.repo
+	}
+	return RepositoryFromContext(ctx)
+}
+
+func (s *orderServer) CreateOrder(ctx context.Context, req *orderpb.CreateOrderRequest) (*orderpb.Order, error) {
+	order, err := createOrder(ctx, s.repository(ctx), &createOrderRequest{
+		CustomerID:      req.GetCustomerId(),
+		Items:           lineItemsFromProto(req.GetItems()),
+		ShippingAddress: addressFromProto(req.GetShippingAddress()),
+		DiscountCodes:   req.GetDiscountCodes(),
+		Currency:        req.GetCurrency(),
+		PaymentMethod:   req.GetPaymentMethod(),
+		AllowDuplicate:  req.GetAllowDuplicate(),
+	}, "")
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	if order.DuplicateOf != "" {
+		if err := grpc.SetHeader(ctx, metadata.Pairs(duplicateOfHeader, order.DuplicateOf)); err != nil {
+			LoggerFromContext(ctx).Warnf("failed to set the duplicate header: %v", err)
+		}
+	}
+	// the gateway answers 201 Created
+	if err := grpc.SetHeader(ctx, metadata.Pairs(httpCodeHeader, strconv.Itoa(http.StatusCreated))); err != nil {
+		LoggerFromContext(ctx).Warnf("failed to set the http status: %v", err)
+	}
+	return orderToProto(order), nil
+}
+
+func (s *orderServer) GetOrder(ctx context.Context, req *orderpb.GetOrderRequest) (*orderpb.Order, error) {
+	ctx = withHedging(ctx, &ConfigFromContext(ctx).Hedging, RouteGetOrder)
+	order, err := s.repository(ctx).GetOrder(ctx, req.GetId())
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return orderToProto(order), nil
+}
+
+func (s *orderServer) ListOrders(ctx context.Context, req *orderpb.ListOrdersRequest) (*orderpb.ListOrdersResponse, error) {
+	if req.GetLimit() < 0 || req.GetLimit() > MaxPageSize {
+		return nil, grpcError(ctx, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 0 and %d", MaxPageSize)})
+	}
+	orders, next, err := listOrdersPage(ctx, s.repository(ctx), ListOptions{
+		CustomerID: req.GetCustomerId(),
+		Status:     Status(req.GetStatus()),
+		Limit:      int(req.GetLimit()),
+		PageToken:  req.GetPageToken(),
+		Fields:     fieldsFromContext(ctx),
+		Sort:       sortFromContext(ctx),
+	})
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+
+	resp := &orderpb.ListOrdersResponse{NextPageToken: next}
+	for _, order := range orders {
+		resp.Orders = append(resp.Orders, orderToProto(order))
+	}
+	return resp, nil
+}
+
+func (s *orderServer) WatchOrder(req *orderpb.WatchOrderRequest, stream orderpb.OrderService_WatchOrderServer) error {
+	ctx := stream.Context()
+	changed, stop := watchOrder(s.repository(ctx), req.GetId())
+	defer stop()
+	var version int64 = -1
+	for {
+		order, err := s.repository(ctx).GetOrder(ctx, req.GetId())
+		if err != nil {
+			return grpcError(ctx, err)
+		}
+		if order.Version != version {
+			if err := stream.Send(orderToProto(order)); err != nil {
+				return err
+			}
+			version = order.Version
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changed:
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+// grpcError maps err onto a grpc status like writeError maps it onto an http
+// status, with the code of the error catalog in its details
+func grpcError(ctx context.Context, err error) error {
+	kind := errorKindOf(err)
+	if kind.code == CodeInternal {
+		LoggerFromContext(ctx).Errorf("Internal Error: %s", err)
+		return grpcStatus(ctx, kind, "internal error")
+	}
+	return grpcStatus(ctx, kind, err.Error())
+}
+
+func orderToProto(o *Order) *orderpb.Order {
+	pb := &orderpb.Order{
+		Id:              o.ID,
+		CustomerId:      o.CustomerID,
+		Status:          string(o.Status),
+		ShippingAddress: addressToProto(o.ShippingAddress),
+		Total:           o.Total.Decimal(),
+		Currency:        o.Currency,
+		CreatedAt:       timestamppb.New(o.CreatedAt),
+		UpdatedAt:       timestamppb.New(o.UpdatedAt),
+		Version:         o.Version,
+	}
+	for _, item := range o.Items {
+		pb.Items = append(pb.Items, &orderpb.LineItem{
+			Sku:       item.SKU,
+			Name:      item.Name,
+			Quantity:  int32(item.Quantity),
+			UnitPrice: item.UnitPrice.Decimal(),
+		})
+	}
+	return pb
+}
+
+func addressToProto(a *Address) *orderpb.Address {
+	if a == nil {
+		return nil
+	}
+	return &orderpb.Address{
+		Name:       a.Name,
+		Line1:      a.Line1,
+		Line2:      a.Line2,
+		City:       a.City,
+		State:      a.State,
+		PostalCode: a.PostalCode,
+		Country:    a.Country,
+	}
+}
+
+func addressFromProto(a *orderpb.Address) *Address {
+	if a == nil {
+		return nil
+	}
+	return &Address{
+		Name:       a.GetName(),
+		Line1:      a.GetLine1(),
+		Line2:      a.GetLine2(),
+		City:       a.GetCity(),
+		State:      a.GetState(),
+		PostalCode: a.GetPostalCode(),
+		Country:    a.GetCountry(),
+	}
+}
+
+// lineItemsFromProto returns the line items of a request, with prices of no
+// currency until the order they are in has one
+func lineItemsFromProto(items []*orderpb.LineItem) []LineItem {
+	out := make([]LineItem, 0, len(items))
+	for _, item := range items {
+		out = append(out, LineItem{
+			SKU:       item.GetSku(),
+			Name:      item.GetName(),
+			Quantity:  int(item.GetQuantity()),
+			UnitPrice: money.FromDecimal(item.GetUnitPrice(), ""),
+		})
+	}
+	return out
+}
+
+// grpcContext gives grpc calls the request id, config, tenant and logger the
+// injector gives http requests, the tenant authenticated by the x-api-key
+// metadata. It fails when the x-tenant-id metadata claims another tenant.
+func grpcContext(ctx context.Context, logger logging.Logger, cfg *config.Config, method string) (context.Context, error) {
+	requestID := newID()
+	ctx = WithRequestID(ctx, requestID)
+	ctx = WithConfig(ctx, cfg)
+	fields := logging.Fields{logging.RequestIDKey: requestID, "method": method}
+	var apiKey, claimed string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(APIKeyHeader); len(values) > 0 {
+			apiKey = values[0]
+		}
+		if values := md.Get(TenantHeader); len(values) > 0 {
+			claimed = values[0]
+		}
+	}
+	tenant, ok := requestTenant(&cfg.Tenants, apiKey, claimed)
+	if !ok {
+		return nil, grpcStatus(ctx, errorKinds[CodeTenantForbidden], "the api key of the call does not authenticate the tenant of the x-tenant-id metadata")
+	}
+	if tenant != "" {
+		fields[logging.TenantIDKey] = tenant
+		ctx = WithTenant(ctx, tenant)
+	}
+	return WithLogger(ctx, logger.WithFields(fields)), nil
+}
+
+// GRPCServer serves the grpc api on its own listener, or multiplexed with the
+// http api on one listener
+type GRPCServer struct {
+	server   *grpc.Server
+	logger   logging.Logger
+	payments *Payments
+	stock    inventory.Client
+	pricing  *pricing.Engine
+	fraud    *FraudScreen
+	router   *Router
+	sagas    *SagaCoordinator
+	catalog  *i18n.Catalog
+	cursors  *PageCursors
+	config   *config.Store
+
+	mu       sync.Mutex
+	listener net.Listener
+	// http serves the http side of a multiplexed listener
+	http    *http.Server
+	running bool
+}
+
+// NewGRPCServer returns a grpc server of the orders in repo
+func NewGRPCServer(repo Repository, logger logging.Logger) *GRPCServer {
+	g := &GRPCServer{logger: logger}
+	g.server = grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := g.context(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := g.context(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+		}),
+	)
+	orderpb.RegisterOrderServiceServer(g.server, &orderServer{repo: repo})
+	return g
+}
+
+// WithPayments makes the server take the payments of new orders with p, it has to
+// be called before the server is started
+func (g *GRPCServer) WithPayments(p *Payments) *GRPCServer {
+	g.payments = p
+	return g
+}
+
+// WithInventory makes the server reserve the stock of new orders with client, it
+// has to be called before the server is started
+func (g *GRPCServer) WithInventory(client inventory.Client) *GRPCServer {
+	g.stock = client
+	return g
+}
+
+// WithPricing makes the server price new orders with engine, it has to be called
+// before the server is started
+func (g *GRPCServer) WithPricing(engine *pricing.Engine) *GRPCServer {
+	g.pricing = engine
+	return g
+}
+
+// WithFraud makes the server screen new orders with screen, it has to be called
+// before the server is started
+func (g *GRPCServer) WithFraud(screen *FraudScreen) *GRPCServer {
+	g.fraud = screen
+	return g
+}
+
+// WithRouter makes the server route confirmed orders to warehouses with
+// router, it has to be called before the server is started
+func (g *GRPCServer) WithRouter(router *Router) *GRPCServer {
+	g.router = router
+	return g
+}
+
+// WithSagas makes the server place new orders as sagas with coordinator, it has
+// to be called before the server is started
+func (g *GRPCServer) WithSagas(coordinator *SagaCoordinator) *GRPCServer {
+	g.sagas = coordinator
+	return g
+}
+
+// WithCatalog makes the server localize its errors with catalog to the locales
+// accepted by the clients, it has to be called before the server is started
+func (g *GRPCServer) WithCatalog(catalog *i18n.Catalog) *GRPCServer {
+	g.catalog = catalog
+	return g
+}
+
+// WithConfig makes the server give calls the current configuration of store,
+// which authenticates their tenants, it has to be called before the server is
+// started
+func (g *GRPCServer) WithConfig(store *config.Store) *GRPCServer {
+	g.config = store
+	return g
+}
+
+// WithPageCursors makes the server seal the page tokens of the order listings
+// with cursors, it has to be called before the server is started
+func (g *GRPCServer) WithPageCursors(cursors *PageCursors) *GRPCServer {
+	g.cursors = cursors
+	return g
+}
+
+// context returns the context of a call of method
+func (g *GRPCServer) context(ctx context.Context, method string) (context.Context, error) {
+	cfg := config.Default()
+	if g.config != nil {
+		cfg = g.config.Current()
+	}
+	ctx, err := grpcContext(ctx, g.logger, cfg, method)
+	if err != nil {
+		return nil, err
+	}
+	if g.catalog != nil {
+		var accepted string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			accepted = strings.Join(md.Get(LocaleHeader), ",")
+		}
+		ctx = WithLocale(ctx, g.catalog, g.catalog.Negotiate(accepted))
+	}
+	if g.payments != nil {
+		ctx = WithPayments(ctx, g.payments)
+	}
+	if g.stock != nil {
+		ctx = WithInventory(ctx, g.stock)
+	}
+	if g.pricing != nil {
+		ctx = WithPricing(ctx, g.pricing)
+	}
+	if g.fraud != nil {
+		ctx = WithFraud(ctx, g.fraud)
+	}
+	if g.router != nil {
+		ctx = WithRouter(ctx, g.router)
+	}
+	if g.sagas != nil {
+		ctx = WithSagas(ctx, g.sagas)
+	}
+	if g.cursors != nil {
+		ctx = WithPageCursors(ctx, g.cursors)
+	}
+	return ctx, nil
+}
+
+// contextStream replaces the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// Start serves grpc on address of network
+func (g *GRPCServer) Start(network, address string) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	g.serve(listener, func() error { return g.server.Serve(listener) })
+	return nil
+}
+
+// StartMultiplexed serves grpc and the http server on address of network,
+// telling them apart by the content type of http/2 requests
+func (g *GRPCServer) StartMultiplexed(network, address string, server *http.Server) error {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	mux := cmux.New(listener)
+	grpcListener := mux.MatchWithWriters(cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"))
+	httpListener := mux.Match(cmux.Any())
+
+	g.mu.Lock()
+	g.http = server
+	g.mu.Unlock()
+
+	go func() {
+		if err := g.http.Serve(httpListener); err != nil && err != http.ErrServerClosed && err != cmux.ErrListenerClosed {
+			g.logger.Errorf("multiplexed http server failed: %v", err)
+		}
+	}()
+	go func() {
+		if err := g.server.Serve(grpcListener); err != nil && err != cmux.ErrListenerClosed {
+			g.logger.Errorf("multiplexed grpc server failed: %v", err)
+		}
+	}()
+	g.serve(listener, mux.Serve)
+	return nil
+}
+
+// serve runs serve in the background while the server is marked running
+func (g *GRPCServer) serve(listener net.Listener, serve func() error) {
+	g.mu.Lock()
+	g.listener = listener
+	g.running = true
+	g.mu.Unlock()
+
+	go func() {
+		err := serve()
+		g.mu.Lock()
+		stopping := !g.running
+		g.running = false
+		g.mu.Unlock()
+		if err != nil && !stopping {
+			g.logger.Errorf("grpc server stopped: %v", err)
+		}
+	}()
+}
+
+// Endpoint returns the address the server listens on
+func (g *GRPCServer) Endpoint() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.listener == nil {
+		return ""
+	}
+	return g.listener.Addr().String()
+}
+
+// IsRunning reports whether the server is serving
+func (g *GRPCServer) IsRunning() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.running
+}
+
+// Stop finishes the calls in progress and stops serving
+func (g *GRPCServer) Stop() {
+	g.mu.Lock()
+	g.running = false
+	httpServer := g.http
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(grpcStopTimeout):
+		g.server.Stop()
+	}
+
+	if httpServer != nil {
+		if err := httpServer.Close(); err != nil {
+			g.logger.Errorf("failed to stop multiplexed http server: %v", err)
+		}
+	}
+	g.mu.Lock()
+	if g.listener != nil {
+		g.listener.Close()
+	}
+	g.mu.Unlock()
+}
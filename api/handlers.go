@@ -1,25 +1,225 @@
 package api
 
 import (
-	"fmt"
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 type Product struct {
-        Name  string  `json:"Name"`
+	Name string `json:"Name"`
 }
 
-
 func HealthCheck(w http.ResponseWriter, r *http.Request) {
-        fmt.Println("healthcheck api")
+	logger := LoggerFromContext(r.Context())
+	logger.Debug("healthcheck api")
+	if drain := DrainFromContext(r.Context()); drain != nil && drain.Draining() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+
+	prod := &Product{Name: "chirag"}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(prod); err != nil {
+
+		logger.Errorf("/HealthCheck Internal Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetConfig returns the running configuration with secrets redacted
+func GetConfig(w http.ResponseWriter, r *http.Request) {
+	logger := LoggerFromContext(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ConfigFromContext(r.Context()).Redacted()); err != nil {
+		logger.Errorf("/GetConfig Internal Error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// errorResponse is the body of every error returned by the order api
+type errorResponse struct {
+	Error string `json:"error"`
+	// Code is the machine readable code of the error, listed by ListErrorCodes
+	Code ErrorCode `json:"code"`
+	// Detail is the message in English when Error is localized
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		LoggerFromContext(r.Context()).Errorf("failed to encode response: %s", err)
+	}
+}
+
+// writeError maps err onto an http status and code of the error catalog and
+// writes it as an errorResponse
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := errorKindOf(err)
+	message := err.Error()
+	if kind.code == CodeInternal {
+		LoggerFromContext(r.Context()).Errorf("%s %s Internal Error: %s", r.Method, r.URL.Path, err)
+		message = "internal error"
+	}
+	writeJSON(w, r, kind.status, newErrorResponse(r.Context(), kind.code, message))
+}
+
+// createOrderRequest is the body of CreateOrder
+type createOrderRequest struct {
+	CustomerID      string     `json:"customerId"`
+	Items           []LineItem `json:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	DiscountCodes   []string   `json:"discountCodes,omitempty"`
+	// Currency is the ISO 4217 currency of the prices, that of the tenant when empty
+	Currency string `json:"currency,omitempty"`
+	// PaymentMethod is the token of the payment method at the payment provider,
+	// required while payments are enabled
+	PaymentMethod string `json:"paymentMethod,omitempty"`
+	// Tenders are the gift cards and store credit paying part of the total,
+	// the payment method pays what they leave
+	Tenders []tenderRequest `json:"tenders,omitempty"`
+	// PurchaseOrder is the number of the purchase order of the customer
+	PurchaseOrder string `json:"purchaseOrder,omitempty"`
+	// Priority is standard, expedited or rush, standard when empty
+	Priority string `json:"priority,omitempty"`
+	// AllowDuplicate creates the order even if it repeats a recent order of the
+	// customer
+	AllowDuplicate bool `json:"allowDuplicate,omitempty"`
+	// ScheduleID names the schedule placing the order, it is not read from clients
+	ScheduleID string `json:"-"`
+}
+
+// newOrder returns the validated pending order described by req, priced with the
+// pricing engine of ctx
+func (req *createOrderRequest) newOrder(ctx context.Context) (*Order, error) {
+	now := time.Now().UTC()
+	order := &Order{
+		ID:              newID(),
+		CustomerID:      req.CustomerID,
+		Status:          StatusPending,
+		Items:           req.Items,
+		ShippingAddress: req.ShippingAddress,
+		ScheduleID:      req.ScheduleID,
+		TenantID:        TenantFromContext(ctx),
+		PurchaseOrder:   strings.TrimSpace(req.PurchaseOrder),
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		Version:         1,
+	}
+	currency, err := orderCurrency(ctx, req.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if err := order.SetCurrency(currency); err != nil {
+		return nil, err
+	}
+	if order.Priority, err = parsePriority(req.Priority); err != nil {
+		return nil, err
+	}
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if err := checkRushCountry(ctx, order); err != nil {
+		return nil, &ValidationError{Field: "priority", Reason: "rush orders do not ship to the address of the order"}
+	}
+	if err := validatePurchaseOrder(ctx, order.PurchaseOrder); err != nil {
+		return nil, err
+	}
+	if err := priceOrder(ctx, order, req.DiscountCodes); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// checkIfMatch returns ErrPreconditionFailed unless the If-Match header of r, if any,
+// names the current version of order
+func checkIfMatch(r *http.Request, order *Order) error {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || ifMatch == "*" {
+		return nil
+	}
+	for _, tag := range strings.Split(ifMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == order.ETag() {
+			return nil
+		}
+	}
+	return ErrPreconditionFailed
+}
+
+// orderStatusResponse is the body of OrderStatus
+type orderStatusResponse struct {
+	ID     string `json:"id"`
+	Status Status `json:"status"`
+	// StatusText is the name of the status in the locale of the request
+	StatusText string    `json:"statusText,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// OrderStatus returns the status of the order named in the path. With a wait
+// duration like wait=30s it holds the request until the status differs from the
+// status query parameter, or from the status at the time of the request, or
+// until the wait expires, and then returns the current status.
+func OrderStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	repo := RepositoryFromContext(ctx)
+	id := mux.Vars(r)["orderId"]
+
+	order, err := repo.GetOrder(withHedging(ctx, &ConfigFromContext(ctx).Hedging, RouteOrderStatus), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	if value := query.Get("wait"); value != "" {
+		wait, err := time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			writeError(w, r, &ValidationError{Field: "wait", Reason: "must be a duration like 30s"})
+			return
+		}
+		known := order.Status
+		if status := query.Get("status"); status != "" {
+			known = Status(status)
+		}
+		order, err = waitForStatusChange(ctx, repo, order, known, capStatusWait(ctx, wait))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	writeJSON(w, r, http.StatusOK, &orderStatusResponse{ID: order.ID, Status: order.Status, StatusText: statusText(ctx, order.Status), UpdatedAt: order.UpdatedAt})
+}
+
+// DeleteOrder removes the order named in the path, honouring If-Match and
+// If-Unmodified-Since
+func DeleteOrder(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["orderId"]
+	repo := RepositoryFromContext(r.Context())
 
-        prod := &Product{Name: "chirag"}
+	if hasPreconditions(r) {
+		order, err := repo.GetOrder(r.Context(), id)
+		if err == nil {
+			err = checkPreconditions(r, order)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
 
-        w.Header().Set("Content-Type", "application/json")
-        if err := json.NewEncoder(w).Encode(prod); err != nil {
+	if err := repo.DeleteOrder(withPreconditions(r.Context(), r), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-                fmt.Printf("/HostRegistrationStatus Internal Error: %s", err)
-                http.Error(w, err.Error(), http.StatusInternalServerError)
-        }
+	LoggerFromContext(r.Context()).Infof("deleted order %s", id)
+	w.WriteHeader(http.StatusNoContent)
 }
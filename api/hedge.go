@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+const (
+	// latencySamples is the number of recent order reads the hedging delay is computed from
+	latencySamples = 512
+	// minLatencySamples is the number of reads seen before their percentile is trusted
+	minLatencySamples = 50
+)
+
+// Hedged routes
+const (
+	RouteGetOrder    = "GetOrder"
+	RouteOrderStatus = "OrderStatus"
+)
+
+// latencyWindow keeps the latencies of the recent reads
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	// n is the number of samples recorded, next the index of the next one
+	n, next int
+}
+
+func (w *latencyWindow) record(latency time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = latency
+	w.next = (w.next + 1) % latencySamples
+	if w.n < latencySamples {
+		w.n++
+	}
+}
+
+// percentile returns the latency p of the recent reads are faster than,
+// false until enough reads were seen
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	if w.n < minLatencySamples {
+		w.mu.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, w.n)
+	copy(sorted, w.samples[:w.n])
+	w.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))], true
+}
+
+// delay returns the wait before the hedged read with the settings of cfg
+func (w *latencyWindow) delay(cfg *config.HedgingConfig) time.Duration {
+	delay, ok := w.percentile(cfg.Percentile)
+	switch {
+	case !ok || delay > cfg.MaxDelay.Duration:
+		return cfg.MaxDelay.Duration
+	case delay < cfg.MinDelay.Duration:
+		return cfg.MinDelay.Duration
+	}
+	return delay
+}
+
+type hedgingKey struct{}
+
+// withHedging returns a copy of ctx whose order reads are hedged with the
+// settings of cfg when cfg hedges route
+func withHedging(ctx context.Context, cfg *config.HedgingConfig, route string) context.Context {
+	if !cfg.Hedged(route) {
+		return ctx
+	}
+	return context.WithValue(ctx, hedgingKey{}, cfg)
+}
+
+// hedgingFromContext returns the hedging settings of ctx, nil when its reads are not hedged
+func hedgingFromContext(ctx context.Context) *config.HedgingConfig {
+	cfg, _ := ctx.Value(hedgingKey{}).(*config.HedgingConfig)
+	return cfg
+}
+
+// hedgedRead is the outcome of one of the reads of hedgeOrder
+type hedgedRead struct {
+	order  *Order
+	err    error
+	hedged bool
+}
+
+// hedgeOrder calls read, and calls it a second time when it did not answer
+// after delay. It returns the first order found, or not found, and cancels the
+// other read; the error of the last read when both fail.
+func hedgeOrder(ctx context.Context, delay time.Duration, read func(ctx context.Context) (*Order, error)) (*Order, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reads := make(chan hedgedRead, 2)
+	start := func(hedged bool) {
+		go func() {
+			order, err := read(ctx)
+			reads <- hedgedRead{order: order, err: err, hedged: hedged}
+		}()
+	}
+	start(false)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	pending, hedged := 1, false
+	for {
+		select {
+		case <-timer.C:
+			hedged = true
+			pending++
+			hedgedReads.WithLabelValues("sent").Inc()
+			start(true)
+		case res := <-reads:
+			pending--
+			if res.err == nil || errors.Is(res.err, ErrOrderNotFound) || pending == 0 {
+				if res.hedged {
+					hedgedReads.WithLabelValues("won").Inc()
+				}
+				return res.order, res.err
+			}
+			if !hedged {
+				// the first read failed before the hedge was due, which is no tail latency
+				return nil, res.err
+			}
+		}
+	}
+}
@@ -0,0 +1,458 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+)
+
+const (
+	// MiddlewareHostNotRegistered is the factory name of the middleware refusing
+	// the requests of hosts that are not registered
+	MiddlewareHostNotRegistered = "host-not-registered"
+	// HostHeader names the registered host a request is made from
+	HostHeader = "X-Host-Id"
+)
+
+// ErrHostNotFound is returned when no host has the requested id
+var ErrHostNotFound = errors.New("host not found")
+
+// hostRetention is the time a host that stopped heartbeating is kept before
+// the database may delete it
+const hostRetention = 24 * time.Hour
+
+// maxHostIDLength is the longest host id accepted
+const maxHostIDLength = 128
+
+// Host is a registered host, such as a warehouse agent, calling the api
+type Host struct {
+	// ID is chosen by the host, its host name unless it has a better one
+	ID      string            `json:"id" dynamodbav:"hostId"`
+	Address string            `json:"address,omitempty" dynamodbav:"address,omitempty"`
+	Version string            `json:"version,omitempty" dynamodbav:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty" dynamodbav:"labels,omitempty"`
+	// Live is set when hosts are read, from the last heartbeat
+	Live         bool      `json:"live" dynamodbav:"-"`
+	RegisteredAt time.Time `json:"registeredAt" dynamodbav:"registeredAt"`
+	// LastSeen is the time of the registration or the last heartbeat of the host
+	LastSeen time.Time `json:"lastSeen" dynamodbav:"lastSeen"`
+	// ExpiresAt is the unix time the database may delete the host at
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt"`
+	// Key signs the requests of the host, it is issued by RotateHostKey and
+	// returned only by it
+	Key string `json:"-" dynamodbav:"agentKey,omitempty"`
+}
+
+// registeredHostResponse is the response of RotateHostKey, with the agent key
+// it issued
+type registeredHostResponse struct {
+	*Host
+	Key string `json:"key,omitempty"`
+}
+
+// live reports whether the last heartbeat of h is not older than ttl at now
+func (h *Host) live(now time.Time, ttl time.Duration) bool {
+	return now.Sub(h.LastSeen) <= ttl
+}
+
+// HostStore is implemented by repositories keeping the registered hosts, which
+// they do once EnableHosts is called.
+type HostStore interface {
+	// PutHost stores host, replacing the host with the same id
+	PutHost(ctx context.Context, host *Host) error
+	// GetHost returns the host with id, live or not, or ErrHostNotFound
+	GetHost(ctx context.Context, id string) (*Host, error)
+	// TouchHost records a heartbeat of the host with id at seen, it fails with
+	// ErrHostNotFound unless the host is registered
+	TouchHost(ctx context.Context, id string, seen time.Time) error
+	// DeleteHost removes the host with id, or fails with ErrHostNotFound
+	DeleteHost(ctx context.Context, id string) error
+	// ListHosts returns all stored hosts, live or not
+	ListHosts(ctx context.Context) ([]*Host, error)
+}
+
+// hostsEnabler is implemented by repositories able to keep hosts
+type hostsEnabler interface {
+	enableHosts(table string)
+}
+
+// EnableHosts makes repo keep the registered hosts, in table for the backends
+// that keep them in a separate table
+func EnableHosts(repo Repository, table string) error {
+	enabler, ok := repo.(hostsEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support hosts", repo)
+	}
+	enabler.enableHosts(table)
+	return nil
+}
+
+// findHostStore returns the host store of repo or of the repository it decorates
+func findHostStore(repo Repository) (HostStore, bool) {
+	var store HostStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(HostStore)
+		return ok
+	})
+	return store, found
+}
+
+// hostStoreFromContext returns the host store of the request repository or ErrNotSupported
+func hostStoreFromContext(ctx context.Context) (HostStore, error) {
+	store, ok := findHostStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// hostExpiry returns the unix time a host last seen at seen may be deleted at
+func hostExpiry(seen time.Time) int64 {
+	return seen.Add(hostRetention).Unix()
+}
+
+// registerHostRequest is the body of RegisterHost
+type registerHostRequest struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+func (req *registerHostRequest) validate() error {
+	switch {
+	case req.ID == "":
+		return &ValidationError{Field: "id", Reason: "is required"}
+	case len(req.ID) > maxHostIDLength:
+		return &ValidationError{Field: "id", Reason: fmt.Sprintf("must be at most %d characters", maxHostIDLength)}
+	case strings.ContainsAny(req.ID, "/ "):
+		return &ValidationError{Field: "id", Reason: "must not contain slashes or spaces"}
+	}
+	return nil
+}
+
+// signingHost returns the host whose agent key signed r, or writes why r is
+// refused. The host routes serve only the host itself, whose key the admin api
+// issued, so that no caller gets or drops the registration of another.
+func signingHost(w http.ResponseWriter, r *http.Request, store HostStore) (*Host, bool) {
+	ctx := r.Context()
+	host, err := verifyHostSignature(r, time.Now(), ConfigFromContext(ctx).Agents.MaxSkew.Duration, store.GetHost)
+	switch {
+	case errors.Is(err, ErrInvalidAgentSignature):
+		LoggerFromContext(ctx).Warnf("refused %s %s of host %q: %v", r.Method, r.URL.Path, r.Header.Get(HostHeader), err)
+		writeErrorCode(w, r, CodeInvalidAgentSignature, ErrInvalidAgentSignature.Error())
+		return nil, false
+	case err != nil:
+		writeError(w, r, err)
+		return nil, false
+	}
+	return host, true
+}
+
+// RegisterHost registers the host described by the body again, keeping its
+// registration time and agent key, with the address, version and labels of
+// the body. It counts as a heartbeat. The request is signed with the key of the
+// host, which RotateHostKey provisions it with beforehand.
+func RegisterHost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	existing, ok := signingHost(w, r, store)
+	if !ok {
+		return
+	}
+
+	var req registerHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if req.ID != existing.ID {
+		writeErrorCode(w, r, CodeInvalidAgentSignature, fmt.Sprintf("%s: signed by host %s", ErrInvalidAgentSignature, existing.ID))
+		return
+	}
+
+	now := time.Now().UTC()
+	host := &Host{
+		ID:           req.ID,
+		Address:      req.Address,
+		Version:      req.Version,
+		Labels:       req.Labels,
+		Live:         true,
+		RegisteredAt: existing.RegisteredAt,
+		LastSeen:     now,
+		ExpiresAt:    hostExpiry(now),
+		Key:          existing.Key,
+	}
+	// a provisioned host is registered by its first registration
+	status := http.StatusOK
+	if existing.LastSeen.IsZero() {
+		host.RegisteredAt = now
+		status = http.StatusCreated
+	}
+	if err := store.PutHost(ctx, host); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if status == http.StatusCreated {
+		LoggerFromContext(ctx).Infof("registered host %s", host.ID)
+	}
+	writeJSON(w, r, status, host)
+}
+
+// RotateHostKey issues a new agent key to the host named in the path and
+// returns it, the only way a host gets one. A host that is not registered is
+// provisioned, it registers with the key within a day. The requests signed
+// with the previous key, such as those of a lost device, are refused from then
+// on.
+func RotateHostKey(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["hostId"]
+	if err := (&registerHostRequest{ID: id}).validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	host, err := store.GetHost(ctx, id)
+	switch {
+	case errors.Is(err, ErrHostNotFound):
+		now := time.Now().UTC()
+		host = &Host{ID: id, RegisteredAt: now, ExpiresAt: hostExpiry(now)}
+	case err != nil:
+		writeError(w, r, err)
+		return
+	}
+	host.Key = newID()
+	if err := store.PutHost(ctx, host); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("issued a new agent key to host %s", host.ID)
+	host.Live = host.live(time.Now(), ConfigFromContext(ctx).Hosts.HeartbeatTTL.Duration)
+	writeJSON(w, r, http.StatusOK, &registeredHostResponse{Host: host, Key: host.Key})
+}
+
+// HeartbeatHost records a heartbeat of the host named in the path, signed with
+// its key. A host that is no longer registered is refused and provisioned again.
+func HeartbeatHost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	host, ok := signingHost(w, r, store)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["hostId"]
+	if id != host.ID {
+		writeErrorCode(w, r, CodeInvalidAgentSignature, fmt.Sprintf("%s: signed by host %s", ErrInvalidAgentSignature, host.ID))
+		return
+	}
+	if err := store.TouchHost(ctx, id, time.Now().UTC()); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeregisterHost removes the host named in the path, in a request signed with
+// its key, whose requests are refused from then on
+func DeregisterHost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	host, ok := signingHost(w, r, store)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["hostId"]
+	if id != host.ID {
+		writeErrorCode(w, r, CodeInvalidAgentSignature, fmt.Sprintf("%s: signed by host %s", ErrInvalidAgentSignature, host.ID))
+		return
+	}
+	if err := store.DeleteHost(ctx, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("deregistered host %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetHost returns the host named in the path
+func GetHost(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	host, err := store.GetHost(ctx, mux.Vars(r)["hostId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	host.Live = host.live(time.Now(), ConfigFromContext(ctx).Hosts.HeartbeatTTL.Duration)
+	writeJSON(w, r, http.StatusOK, host)
+}
+
+// hostsResponse lists the registered hosts
+type hostsResponse struct {
+	Hosts []*Host `json:"hosts"`
+}
+
+// ListHosts returns the registered hosts ordered by id, those whose heartbeat
+// expired included unless live=true is asked
+func ListHosts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := hostStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	hosts, err := store.ListHosts(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	onlyLive := r.URL.Query().Get("live") == "true"
+	now := time.Now()
+	ttl := ConfigFromContext(ctx).Hosts.HeartbeatTTL.Duration
+	resp := &hostsResponse{Hosts: []*Host{}}
+	for _, host := range hosts {
+		host.Live = host.live(now, ttl)
+		if host.Live || !onlyLive {
+			resp.Hosts = append(resp.Hosts, host)
+		}
+	}
+	sort.Slice(resp.Hosts, func(i, j int) bool { return resp.Hosts[i].ID < resp.Hosts[j].ID })
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// hostExemptPaths are the routes called by others than the registered hosts
+var hostExemptPaths = map[string]bool{
+	"/" + v1Prefix + "/healthcheck":      true,
+	"/" + v1Prefix + "/metrics":          true,
+	"/" + v1Prefix + "/openapi":          true,
+	"/" + v1Prefix + "/payments/webhook": true,
+}
+
+// isHostExemptPath reports whether path is served to hosts that are not
+// registered: the host routes, which they register with and which check the
+// signature of the host themselves, the admin api, the
+// health check, metrics and the docs of the api, the webhooks of the payment provider and the
+// carriers, and the public tracking of orders
+func isHostExemptPath(path string) bool {
+	return hostExemptPaths[path] || isAdminPath(path) ||
+		strings.HasPrefix(path, "/"+hostPrefix+"/") ||
+		strings.HasPrefix(path, "/"+trackPrefix+"/") ||
+		strings.HasPrefix(path, "/"+v1Prefix+"/docs/") ||
+		strings.HasPrefix(path, "/"+v1Prefix+"/tracking/")
+}
+
+// hostState is a host as last read by HostRegistry
+type hostState struct {
+	host *Host
+	read time.Time
+}
+
+// HostRegistry refuses with 403 the requests whose X-Host-Id header does not
+// name a registered host with a heartbeat within the heartbeat ttl, and with
+// 401 those not signed with the agent key of the host, so that no caller passes
+// for a host by naming it. A live host is read again from the store once its
+// cache ttl is over, so a host deregistered, or whose key was rotated, on
+// another instance is refused by this one within the cache ttl. Hosts that are
+// not registered, or not live, are read at every request so that they are
+// served as soon as they register.
+type HostRegistry struct {
+	store   HostStore
+	cfg     config.HostsConfig
+	maxSkew time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]hostState
+}
+
+// NewHostRegistry returns the middleware checking the hosts of store as set in
+// cfg, and their signatures within the max skew of agents
+func NewHostRegistry(store HostStore, cfg config.HostsConfig, agents config.AgentsConfig) *HostRegistry {
+	return &HostRegistry{store: store, cfg: cfg, maxSkew: agents.MaxSkew.Duration, hosts: map[string]hostState{}}
+}
+
+// host returns the host with id, or ErrHostNotFound when it is not registered
+func (h *HostRegistry) host(ctx context.Context, id string) (*Host, error) {
+	now := time.Now()
+	h.mu.Lock()
+	state, ok := h.hosts[id]
+	h.mu.Unlock()
+	if ok && now.Sub(state.read) < h.cfg.CacheTTL.Duration && state.host.live(now, h.cfg.HeartbeatTTL.Duration) {
+		return state.host, nil
+	}
+
+	host, err := h.store.GetHost(ctx, id)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.hosts, id)
+	if err != nil {
+		return nil, err
+	}
+	h.hosts[id] = hostState{host: host, read: now}
+	return host, nil
+}
+
+func (h *HostRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isHostExemptPath(r.URL.Path) {
+		next(w, r)
+		return
+	}
+	id := r.Header.Get(HostHeader)
+	if id == "" {
+		writeErrorCode(w, r, CodeHostNotRegistered, fmt.Sprintf("the %s header naming a registered host is required", HostHeader))
+		return
+	}
+	host, err := verifyHostSignature(r, time.Now(), h.maxSkew, h.host)
+	switch {
+	case errors.Is(err, ErrHostNotFound):
+		writeErrorCode(w, r, CodeHostNotRegistered, fmt.Sprintf("host %s is not registered", id))
+	case errors.Is(err, ErrInvalidAgentSignature):
+		LoggerFromContext(r.Context()).Warnf("refused %s %s of host %q: %v", r.Method, r.URL.Path, id, err)
+		writeErrorCode(w, r, CodeInvalidAgentSignature, ErrInvalidAgentSignature.Error())
+	case err != nil:
+		writeError(w, r, err)
+	case !host.live(time.Now(), h.cfg.HeartbeatTTL.Duration):
+		writeErrorCode(w, r, CodeHostNotRegistered, fmt.Sprintf("host %s missed its heartbeats, register it again", id))
+	default:
+		next(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+)
+
+func TestHostRoutesRequireSignature(t *testing.T) {
+	repo := NewMemoryRepository()
+	if err := EnableHosts(repo, ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Hosts.Enabled = true
+	injector := NewInjector(repo, nil, config.NewStore(cfg, nil))
+	serve := func(handler http.HandlerFunc, r *http.Request, vars map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		injector.ServeHTTP(w, mux.SetURLVars(r, vars), handler)
+		return w
+	}
+	provision := func(id string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/"+adminPrefix+"/hosts/"+id+"/key", nil)
+		w := serve(RotateHostKey, r, map[string]string{"hostId": id})
+		var resp struct {
+			Key string `json:"key"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK || resp.Key == "" {
+			t.Fatalf("provision %s: status = %d, key %q, %v", id, w.Code, resp.Key, err)
+		}
+		return resp.Key
+	}
+	registerURI := "/" + hostPrefix + "/register"
+	register := func(id string) string { return `{"id": "` + id + `", "version": "1.4.2"}` }
+	deregisterURI := "/" + hostPrefix + "/wh-berlin-01"
+	vars := map[string]string{"hostId": "wh-berlin-01"}
+
+	unsigned := httptest.NewRequest(http.MethodPost, registerURI, strings.NewReader(register("wh-berlin-01")))
+	unsigned.Header.Set(HostHeader, "wh-berlin-01")
+	if w := serve(RegisterHost, unsigned, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unsigned registration: status = %d, want 401", w.Code)
+	}
+
+	berlinKey, parisKey := provision("wh-berlin-01"), provision("wh-paris-01")
+	now := time.Now().Unix()
+	if w := serve(RegisterHost, signedRequest(http.MethodPost, registerURI, "wh-paris-01", parisKey, now, register("wh-berlin-01")), nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("registration signed by another host: status = %d, want 401", w.Code)
+	}
+	w := serve(RegisterHost, signedRequest(http.MethodPost, registerURI, "wh-berlin-01", berlinKey, now, register("wh-berlin-01")), nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("signed registration: status = %d, body %s", w.Code, w.Body)
+	}
+	if strings.Contains(w.Body.String(), berlinKey) || strings.Contains(w.Body.String(), `"key"`) {
+		t.Errorf("registration returned the key: %s", w.Body)
+	}
+
+	if w := serve(DeregisterHost, httptest.NewRequest(http.MethodDelete, deregisterURI, nil), vars); w.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned deregistration: status = %d, want 401", w.Code)
+	}
+	if w := serve(DeregisterHost, signedRequest(http.MethodDelete, deregisterURI, "wh-paris-01", parisKey, now, ""), vars); w.Code != http.StatusUnauthorized {
+		t.Errorf("deregistration signed by another host: status = %d, want 401", w.Code)
+	}
+	if w := serve(DeregisterHost, signedRequest(http.MethodDelete, deregisterURI, "wh-berlin-01", berlinKey, now, ""), vars); w.Code != http.StatusNoContent {
+		t.Errorf("signed deregistration: status = %d, want 204", w.Code)
+	}
+	if w := serve(RegisterHost, signedRequest(http.MethodPost, registerURI, "wh-berlin-01", berlinKey, now, register("wh-berlin-01")), nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("registration after deregistration: status = %d, want 401", w.Code)
+	}
+}
+
+func TestHostRegistrySignature(t *testing.T) {
+	const key = "0123456789abcdef"
+	now := time.Now()
+	store := hostStoreWith(t,
+		&Host{ID: "wh-berlin-01", Key: key, LastSeen: now},
+		&Host{ID: "wh-paris-01", Key: key, LastSeen: now.Add(-time.Hour)},
+	)
+	cfg := config.Default()
+	registry := NewHostRegistry(store, cfg.Hosts, cfg.Agents)
+	uri := "/" + v1Prefix + "/list"
+
+	claimed := httptest.NewRequest(http.MethodGet, uri, nil)
+	claimed.Header.Set(HostHeader, "wh-berlin-01")
+	tests := []struct {
+		name    string
+		request *http.Request
+		status  int
+	}{
+		{name: "signed by a live host", request: signedRequest(http.MethodGet, uri, "wh-berlin-01", key, now.Unix(), ""), status: http.StatusOK},
+		{name: "claimed host id", request: claimed, status: http.StatusUnauthorized},
+		{name: "signed with another key", request: signedRequest(http.MethodGet, uri, "wh-berlin-01", "fedcba9876543210", now.Unix(), ""), status: http.StatusUnauthorized},
+		{name: "host not live", request: signedRequest(http.MethodGet, uri, "wh-paris-01", key, now.Unix(), ""), status: http.StatusForbidden},
+		{name: "host not registered", request: signedRequest(http.MethodGet, uri, "wh-madrid-01", key, now.Unix(), ""), status: http.StatusForbidden},
+		{name: "no host", request: httptest.NewRequest(http.MethodGet, uri, nil), status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			registry.ServeHTTP(w, tt.request, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d, body %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/money"
+)
+
+const (
+	// importBatchSize is the number of orders created at a time, a cancelled
+	// import stops between batches
+	importBatchSize = 25
+	// maxImportErrors bounds the row errors kept with an import, Failed counts all of them
+	maxImportErrors = 1000
+	// importFormMemory is the part of an upload kept in memory, the rest is spooled to disk
+	importFormMemory = 10 << 20
+)
+
+// import formats
+const (
+	ImportCSV  = "csv"
+	ImportJSON = "jsonl"
+)
+
+// ImportJob is the type of the jobs importing orders
+const ImportJob jobs.Type = "import"
+
+// ImportRowError reports an order of an upload that was not imported
+type ImportRowError struct {
+	// Row is the line of the upload the order starts at, the csv header is line 1
+	Row     int    `json:"row"`
+	OrderID string `json:"orderId,omitempty"`
+	Error   string `json:"error"`
+}
+
+// importParams are the params of an import job
+type importParams struct {
+	Format   string `json:"format"`
+	FileName string `json:"fileName,omitempty"`
+}
+
+// ImportResult is the result of an import job, it is partial when the job was
+// cancelled
+type ImportResult struct {
+	// Orders is the number of orders in the upload, Created, Skipped and Failed
+	// add up to it once the import completed
+	Orders  int `json:"orders"`
+	Created int `json:"created"`
+	// Skipped counts the orders whose id already exists, e.g. of an earlier import
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// Errors are the first row errors of the import
+	Errors []ImportRowError `json:"errors,omitempty"`
+}
+
+// fail records an order that was not imported
+func (res *ImportResult) fail(e ImportRowError) {
+	res.Failed++
+	if len(res.Errors) < maxImportErrors {
+		res.Errors = append(res.Errors, e)
+	}
+}
+
+// done is the number of orders of the upload handled so far
+func (res *ImportResult) done() int64 {
+	return int64(res.Created + res.Skipped + res.Failed)
+}
+
+// importOrder is an order of an upload as it was kept by the legacy system,
+// with its id, status and creation time
+type importOrder struct {
+	ID              string     `json:"id"`
+	CustomerID      string     `json:"customerId"`
+	Status          Status     `json:"status"`
+	Items           []LineItem `json:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	// Currency defaults to the currency of the orders of the tenant
+	Currency string `json:"currency,omitempty"`
+	// Total defaults to the sum of the line items
+	Total     *money.Money `json:"total,omitempty"`
+	CreatedAt time.Time    `json:"createdAt"`
+
+	// row is the line of the upload the order starts at
+	row int
+}
+
+// importStatuses are the statuses an imported order may have
+var importStatuses = map[Status]bool{
+	StatusPending: true, StatusPaid: true, StatusShipped: true, StatusDelivered: true, StatusCancelled: true,
+}
+
+// order returns the validated order of ctx described by o, new ones get an id
+// and now as their creation time
+func (o *importOrder) order(ctx context.Context, now time.Time) (*Order, error) {
+	order := &Order{
+		ID:              o.ID,
+		CustomerID:      o.CustomerID,
+		Status:          o.Status,
+		Items:           o.Items,
+		ShippingAddress: o.ShippingAddress,
+		CreatedAt:       o.CreatedAt.UTC(),
+		UpdatedAt:       now,
+	}
+	currency, err := orderCurrency(ctx, o.Currency)
+	if err != nil {
+		return nil, err
+	}
+	if err := order.SetCurrency(currency); err != nil {
+		return nil, err
+	}
+	if err := order.Validate(); err != nil {
+		return nil, err
+	}
+	if order.ShippingAddress != nil {
+		if err := validateAddress("shippingAddress", order.ShippingAddress); err != nil {
+			return nil, err
+		}
+	}
+	if order.Status == "" {
+		order.Status = StatusPending
+	}
+	if !importStatuses[order.Status] {
+		return nil, &ValidationError{Field: "status", Reason: fmt.Sprintf("%q is not an order status", order.Status)}
+	}
+	if order.ID == "" {
+		order.ID = newID()
+	}
+	if order.CreatedAt.IsZero() {
+		order.CreatedAt = now
+	}
+	order.ComputeTotal()
+	if o.Total != nil {
+		total, err := o.Total.In(currency)
+		if err != nil {
+			return nil, &ValidationError{Field: "total", Reason: err.Error()}
+		}
+		if total.IsNegative() {
+			return nil, &ValidationError{Field: "total", Reason: "must not be negative"}
+		}
+		order.Total = total
+	}
+	return order, nil
+}
+
+// readJSONLines reads one order object per line, blank lines are skipped
+func readJSONLines(r io.Reader) ([]*importOrder, []ImportRowError, error) {
+	var orders []*importOrder
+	var rowErrs []ImportRowError
+	br := bufio.NewReader(r)
+	for row := 1; ; row++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			o := &importOrder{row: row}
+			if err := json.Unmarshal(line, o); err != nil {
+				rowErrs = append(rowErrs, ImportRowError{Row: row, Error: err.Error()})
+			} else {
+				orders = append(orders, o)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return orders, rowErrs, nil
+}
+
+// importColumns are the columns of a csv upload, one row per line item. The rows
+// of an order follow each other and repeat its id, the order fields are read
+// from its first row. Rows without an id are orders of their own.
+var importColumns = []string{
+	"id", "customerId", "status", "createdAt", "currency", "total",
+	"sku", "name", "quantity", "unitPrice",
+	"recipient", "line1", "line2", "city", "state", "postalCode", "country",
+}
+
+// requiredImportColumns must be in the header of a csv upload
+var requiredImportColumns = []string{"customerId", "sku", "quantity", "unitPrice"}
+
+// readCSV reads the orders of a csv upload with a header row of importColumns
+func readCSV(r io.Reader) ([]*importOrder, []ImportRowError, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, nil, &ValidationError{Field: "file", Reason: fmt.Sprintf("the csv header can not be read: %v", err)}
+	}
+	index := map[string]int{}
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	for _, name := range requiredImportColumns {
+		if _, ok := index[name]; !ok {
+			return nil, nil, &ValidationError{Field: "file", Reason: fmt.Sprintf("the csv header has no %s column", name)}
+		}
+	}
+
+	var orders []*importOrder
+	var rowErrs []ImportRowError
+	// current is the order of the previous row, invalid the id of the last order
+	// that failed, whose other rows are skipped
+	var current *importOrder
+	invalid := ""
+	for row := 2; ; row++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, &ValidationError{Field: "file", Reason: fmt.Sprintf("line %d is not csv: %v", row, err)}
+		}
+		get := func(name string) string {
+			if i, ok := index[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		id := get("id")
+		if id != "" && id == invalid {
+			continue
+		}
+		fail := func(err error) {
+			rowErrs = append(rowErrs, ImportRowError{Row: row, OrderID: id, Error: err.Error()})
+			current, invalid = nil, id
+		}
+
+		if current == nil || id == "" || id != current.ID {
+			current = &importOrder{ID: id, CustomerID: get("customerId"), Status: Status(get("status")), row: row}
+			if err := csvOrderFields(current, get); err != nil {
+				fail(err)
+				continue
+			}
+			orders = append(orders, current)
+		}
+		item, err := csvLineItem(get)
+		if err != nil {
+			// current is the last order read, it is dropped with all its rows
+			orders = orders[:len(orders)-1]
+			fail(err)
+			continue
+		}
+		current.Items = append(current.Items, item)
+	}
+	return orders, rowErrs, nil
+}
+
+// csvLineItem reads the line item of a csv row
+func csvLineItem(get func(string) string) (LineItem, error) {
+	item := LineItem{SKU: get("sku"), Name: get("name")}
+	quantity, err := strconv.Atoi(get("quantity"))
+	if err != nil {
+		return item, &ValidationError{Field: "quantity", Reason: "is not a number"}
+	}
+	unitPrice, err := money.Parse(get("unitPrice"), "")
+	if err != nil {
+		return item, &ValidationError{Field: "unitPrice", Reason: err.Error()}
+	}
+	item.Quantity, item.UnitPrice = quantity, unitPrice
+	return item, nil
+}
+
+// csvOrderFields reads the creation time, total and address of the first row of an order
+func csvOrderFields(o *importOrder, get func(string) string) error {
+	if value := get("createdAt"); value != "" {
+		t, err := parseSearchTime(value)
+		if err != nil {
+			return &ValidationError{Field: "createdAt", Reason: "must be a date or an RFC3339 time"}
+		}
+		o.CreatedAt = t
+	}
+	o.Currency = get("currency")
+	if value := get("total"); value != "" {
+		total, err := money.Parse(value, "")
+		if err != nil {
+			return &ValidationError{Field: "total", Reason: err.Error()}
+		}
+		o.Total = &total
+	}
+	if get("line1") != "" || get("city") != "" || get("postalCode") != "" || get("country") != "" {
+		o.ShippingAddress = &Address{
+			Name:       get("recipient"),
+			Line1:      get("line1"),
+			Line2:      get("line2"),
+			City:       get("city"),
+			State:      get("state"),
+			PostalCode: get("postalCode"),
+			Country:    get("country"),
+		}
+	}
+	return nil
+}
+
+// importFormat returns the format of an upload named in the format form field
+// or by the extension of its file name
+func importFormat(r *http.Request, fileName string) (string, error) {
+	format := r.FormValue("format")
+	if format == "" {
+		switch strings.ToLower(path.Ext(fileName)) {
+		case ".csv":
+			format = ImportCSV
+		case ".jsonl", ".ndjson", ".json":
+			format = ImportJSON
+		}
+	}
+	if format != ImportCSV && format != ImportJSON {
+		return "", &ValidationError{Field: "format", Reason: "must be csv or jsonl"}
+	}
+	return format, nil
+}
+
+// ImportOrders accepts a csv or JSON lines file in the file field of a multipart
+// upload. The file is read and validated at once and its orders are created by
+// an import job on this instance, which is answered to be followed with GetJob.
+func ImportOrders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	pool, err := jobsFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, ConfigFromContext(ctx).Imports.MaxUploadSize)
+	if err := r.ParseMultipartForm(importFormMemory); err != nil {
+		writeError(w, r, &ValidationError{Field: "file", Reason: fmt.Sprintf("the upload can not be read: %v", err)})
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	file, fh, err := r.FormFile("file")
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "file", Reason: "is required"})
+		return
+	}
+	defer file.Close()
+	format, err := importFormat(r, fh.Filename)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	read := readJSONLines
+	if format == ImportCSV {
+		read = readCSV
+	}
+	rows, rowErrs, err := read(file)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	res := &ImportResult{Orders: len(rows) + len(rowErrs)}
+	for _, e := range rowErrs {
+		res.fail(e)
+	}
+	var orders []*Order
+	var starts []int
+	for _, row := range rows {
+		order, err := row.order(ctx, now)
+		if err != nil {
+			res.fail(ImportRowError{Row: row.row, OrderID: row.ID, Error: err.Error()})
+			continue
+		}
+		orders = append(orders, order)
+		starts = append(starts, row.row)
+	}
+
+	repo := RepositoryFromContext(ctx)
+	logger := LoggerFromContext(ctx)
+	// the upload is only held by this instance, so the job is started here
+	job, err := pool.Start(ctx, ImportJob, &importParams{Format: format, FileName: fh.Filename},
+		func(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+			return runImport(WithLogger(ctx, logger.WithField("job", job.ID)), repo, res, orders, starts, report)
+		})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	logger.WithField("job", job.ID).Infof("importing %d of %d orders from %s", len(orders), res.Orders, fh.Filename)
+	w.Header().Set("Location", jobLocation(job.ID))
+	writeJSON(w, r, http.StatusAccepted, job)
+}
+
+// runImport creates orders, whose rows start at starts, a batch at a time,
+// counting them in res, until they are all created or ctx is cancelled
+func runImport(ctx context.Context, repo Repository, res *ImportResult, orders []*Order, starts []int, report func(done, total int64)) (*ImportResult, error) {
+	report(res.done(), int64(res.Orders))
+	for start := 0; start < len(orders); start += importBatchSize {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		end := start + importBatchSize
+		if end > len(orders) {
+			end = len(orders)
+		}
+		for i, err := range batchCreateOrders(ctx, repo, orders[start:end]) {
+			switch {
+			case err == nil:
+				res.Created++
+			case errors.Is(err, ErrOrderExists):
+				res.Skipped++
+			default:
+				res.fail(ImportRowError{Row: starts[start+i], OrderID: orders[start+i].ID, Error: err.Error()})
+			}
+		}
+		report(res.done(), int64(res.Orders))
+	}
+	LoggerFromContext(ctx).WithFields(logging.Fields{"created": res.Created, "skipped": res.Skipped, "failed": res.Failed}).Info("import completed")
+	return res, nil
+}
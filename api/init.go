@@ -1,129 +1,89 @@
 package api
 
 import (
-        "fmt"
-        "net/http"
-        "time"
-	"sync"
-
-	log "github.com/sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-
-        "github.com/omnom-nom/apiserver"
-)
-
-const (
-        // APIServerStartupTimeout ...
-        APIServerStartupTimeout = 5 * time.Second
-        // APIServerStartupWaitPause ...
-        APIServerStartupWaitPause = 500 * time.Millisecond
-
-	DbIP = "192.168.1.101"
-	DbPort = 8000
-	DbZone = "us-west-2"
-)
-
-var (
-	env  *EnvSingleton
-	once sync.Once
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsretry "github.com/aws/aws-sdk-go-v2/aws/retry"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/retry"
 )
 
-func handleCrash(w http.ResponseWriter) {
-        crash := recover()
-        if crash == nil {
-                return
-        }
-        log.Error(crash)
+// handleCrash logs the panic of a request, the crash handler answers it
+func (s *Service) handleCrash(w http.ResponseWriter) {
+	crash := recover()
+	if crash == nil {
+		return
+	}
+	s.logger.Error(crash)
 }
 
-func initDb() *ApiDb {
-
-	dbUrl := fmt.Sprintf("http://%s:%s", DbIP, DbPort)
-
-	config := &aws.Config{
-		Region:   aws.String(DbZone),
-		Endpoint: aws.String(dbUrl),
+// newAWSConfig returns the aws configuration of the region and credentials in cfg
+// with the retry policy of DynamoDB calls
+func newAWSConfig(ctx context.Context, cfg *config.Config) (aws.Config, error) {
+	opts := []func(*awsconfig.LoadOptions) error{
+		awsconfig.WithRegion(cfg.Db.Region),
+		awsconfig.WithRetryer(func() aws.Retryer {
+			policy := retry.New(cfg.Db.Retry, nil)
+			return awsretry.NewStandard(func(o *awsretry.StandardOptions) {
+				o.MaxAttempts = cfg.Db.Retry.MaxAttempts
+				o.MaxBackoff = cfg.Db.Retry.MaxBackoff.Duration
+				o.Backoff = awsretry.BackoffDelayerFunc(func(attempt int, err error) (time.Duration, error) {
+					return policy.Backoff(attempt), nil
+				})
+			})
+		}),
 	}
-
-	sess := session.Must(session.NewSession(config))
-
-	return &ApiDb{dynamodb.New(sess)}
+	if cfg.Db.AccessKeyID != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.Db.AccessKeyID, cfg.Db.SecretAccessKey, "")))
+	}
+	return awsconfig.LoadDefaultConfig(ctx, opts...)
 }
 
+// NewDb returns a dynamodb client for the endpoint, region and retry policy in cfg
+func NewDb(ctx context.Context, cfg *config.Config) (*ApiDb, error) {
 
-func GetEnvInstance() *EnvSingleton {
+	awsConfig, err := newAWSConfig(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	once.Do(func() {
-		env.db = initDb()
+	client := dynamodb.NewFromConfig(awsConfig, func(o *dynamodb.Options) {
+		if cfg.Db.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Db.Endpoint)
+		}
+		o.APIOptions = append(o.APIOptions, addDbUsageMiddleware)
+		if cfg.Capacity.Enabled {
+			o.APIOptions = append(o.APIOptions, addCapacityMiddleware)
+		}
 	})
-
-	return env
+	return &ApiDb{Client: client, Retry: retry.New(cfg.Db.Retry, transactionConflict)}, nil
 }
 
+// Init runs the order service with the default configuration until the process exits.
+// It is kept for compatibility, new code should use NewService and Run.
 func Init() error {
 
-        factory, err := apiserver.FactoryForGorillaMux()
-        if err != nil {
-                log.Errorf("failed to create mux: %v",err)
-                return fmt.Errorf("failed to create mux: %v", err)
-        }
-
-        // register middleware objects with factory
-        factory.Default(apiserver.MiddlewareLogger, apiserver.Logger())
-        factory.Always("crash-handler", apiserver.NewCrashHandler(handleCrash))
-
-        secureMux, err := factory.Make(routes)
-        if err != nil {
-                log.Errorf("failed to do factory make: %v",err)
-                return fmt.Errorf("failed to do factory make: %v", err)
-        }
-
-        httpServer, err := apiserver.New(secureMux, apiserver.ServerAddress(fmt.Sprintf("%s:%d", "0.0.0.0", 8080)))
-        if err != nil {
-                log.Errorf("failed to create HTTP API server: %v",err)
-                return fmt.Errorf("failed to create HTTP API server: %s", err)
-        }
+	cfg := config.Default()
 
-        if err = httpServer.StartHTTP(); err != nil {
-                log.Errorf("failed to start HTTPS API server: %s", err)
-                return fmt.Errorf("failed to start HTTPS API server: %v", err)
-        }
-        defer func() {
-                if !httpServer.IsStopped() {
-                        if err := httpServer.Stop(); err != nil {
-                                errMsg := fmt.Sprintf("failed to stop HTTP server: %s", err)
-                                fmt.Println(errMsg)
-                        }
-                }
-        }()
-
-	waitUntil := time.Now().Add(APIServerStartupTimeout)
-        for waitUntil.After(time.Now()) {
-                if httpServer.IsRunning() {
-                        break
-                }
-                if httpServer.IsStopped() {
-                        log.Error("http server has stopped, can not continue")
-                        return fmt.Errorf("http server has stopped, can not continue")
-                }
-
-                fmt.Println("waiting for api servers to start...")
-                time.Sleep(APIServerStartupWaitPause)
-        }
-
-        if !httpServer.IsRunning() {
-                log.Error("http server is not running")
-                return fmt.Errorf("http server is not running after %s", APIServerStartupTimeout)
-        }
-
-        log.Infof("http server is running: %s", httpServer.Endpoint())
+	repo, err := NewRepository(context.Background(), cfg)
+	if err != nil {
+		logging.Default().Errorf("failed to create repository: %v", err)
+		return err
+	}
 
-	for {
-                time.Sleep(120 * time.Second)
-                continue
-        }
+	svc, err := NewService(repo, config.NewStore(cfg, nil))
+	if err != nil {
+		return err
+	}
 
-	return nil
+	return svc.Run(context.Background())
 }
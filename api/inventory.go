@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/omnom-nom/order/inventory"
+)
+
+// releaseTimeout bounds the compensating release of a reservation whose request
+// failed, which may run after the context of the request is done
+const releaseTimeout = 5 * time.Second
+
+type inventoryKey struct{}
+
+// WithInventory returns a copy of ctx carrying client
+func WithInventory(ctx context.Context, client inventory.Client) context.Context {
+	return context.WithValue(ctx, inventoryKey{}, client)
+}
+
+// InventoryFromContext returns the inventory client stored in ctx, or nil when
+// stock is not reserved
+func InventoryFromContext(ctx context.Context) inventory.Client {
+	client, _ := ctx.Value(inventoryKey{}).(inventory.Client)
+	return client
+}
+
+// reserveStock reserves the items of a new order with client. The reservation is
+// named after the order, so after a failure, e.g. a timeout that may have reserved
+// the stock after all, it is released again.
+func reserveStock(ctx context.Context, client inventory.Client, order *Order) error {
+	err := client.Reserve(ctx, newReservation(order, order.Items))
+	if errors.Is(err, inventory.ErrOutOfStock) {
+		return err
+	}
+	if err != nil {
+		order.StockReserved = true
+		releaseStock(ctx, order)
+		return err
+	}
+	order.StockReserved = true
+	return nil
+}
+
+// newReservation returns the reservation of items of order, named after the order
+func newReservation(order *Order, items []LineItem) *inventory.Reservation {
+	reservation := &inventory.Reservation{ID: order.ID, OrderID: order.ID}
+	for _, item := range items {
+		reservation.Items = append(reservation.Items, inventory.Item{SKU: item.SKU, Quantity: item.Quantity})
+	}
+	return reservation
+}
+
+// swapReservation replaces the reservation of the from items of an edited order by
+// one of the to items. It is released first, so the stock it holds counts for the
+// new items, and reserved again with the from items when the to items are short.
+func swapReservation(ctx context.Context, order *Order, from, to []LineItem) error {
+	client := InventoryFromContext(ctx)
+	if !order.StockReserved || client == nil {
+		return nil
+	}
+	if err := client.Release(ctx, order.ID); err != nil {
+		return err
+	}
+	err := client.Reserve(ctx, newReservation(order, to))
+	if err == nil {
+		return nil
+	}
+	releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if restoreErr := client.Reserve(releaseCtx, newReservation(order, from)); restoreErr != nil {
+		LoggerFromContext(ctx).Errorf("failed to reserve the stock of order %s again: %v", order.ID, restoreErr)
+	}
+	return err
+}
+
+// releaseStock releases the stock reserved for order with the inventory client of
+// ctx and reports whether it did. A failed release is logged and left for the
+// order to be cancelled again, the caller stores the order.
+func releaseStock(ctx context.Context, order *Order) bool {
+	client := InventoryFromContext(ctx)
+	if !order.StockReserved || client == nil {
+		return false
+	}
+
+	releaseCtx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	if err := client.Release(releaseCtx, order.ID); err != nil {
+		LoggerFromContext(ctx).Errorf("failed to release the stock of order %s: %v", order.ID, err)
+		return false
+	}
+	order.StockReserved = false
+	LoggerFromContext(ctx).Infof("released the stock of order %s", order.ID)
+	return true
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/jobs"
+)
+
+// jobsEnabler is implemented by repositories able to keep background jobs
+type jobsEnabler interface {
+	enableJobs(table string)
+}
+
+// EnableJobs makes repo keep background jobs, in table for the backends that keep
+// them in a separate table
+func EnableJobs(repo Repository, table string) error {
+	enabler, ok := repo.(jobsEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support jobs", repo)
+	}
+	enabler.enableJobs(table)
+	return nil
+}
+
+// findJobStore returns the job store of repo or of the repository it decorates
+func findJobStore(repo Repository) (jobs.Store, bool) {
+	var store jobs.Store
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(jobs.Store)
+		return ok
+	})
+	return store, found
+}
+
+type jobsKey struct{}
+
+// WithJobs returns a copy of ctx carrying pool
+func WithJobs(ctx context.Context, pool *jobs.Pool) context.Context {
+	return context.WithValue(ctx, jobsKey{}, pool)
+}
+
+// JobsFromContext returns the job pool stored in ctx, or nil
+func JobsFromContext(ctx context.Context) *jobs.Pool {
+	pool, _ := ctx.Value(jobsKey{}).(*jobs.Pool)
+	return pool
+}
+
+// jobsFromContext returns the job pool of the request or ErrNotSupported
+func jobsFromContext(ctx context.Context) (*jobs.Pool, error) {
+	pool := JobsFromContext(ctx)
+	if pool == nil {
+		return nil, ErrNotSupported
+	}
+	return pool, nil
+}
+
+// GetJob returns the state, progress and result of the job named in the path
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	pool, err := jobsFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	job, err := pool.Get(r.Context(), mux.Vars(r)["jobId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, job)
+}
+
+// CancelJob cancels the job named in the path. A queued job is cancelled at
+// once, a running job is answered with 202 and stops shortly after.
+func CancelJob(w http.ResponseWriter, r *http.Request) {
+	pool, err := jobsFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	job, err := pool.Cancel(r.Context(), mux.Vars(r)["jobId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	status := http.StatusOK
+	if !job.State.Finished() {
+		status = http.StatusAccepted
+	}
+	writeJSON(w, r, status, job)
+}
+
+// jobLocation is the path clients follow a job at
+func jobLocation(id string) string {
+	return fmt.Sprintf("/%s/jobs/%s", v1Prefix, id)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// orderEventSchema is the avro schema of order events, the payload is the order as json
+const orderEventSchema = `{
+	"type": "record",
+	"name": "OrderEvent",
+	"namespace": "com.omnomnom.order",
+	"fields": [
+		{"name": "id", "type": "string"},
+		{"name": "orderId", "type": "string"},
+		{"name": "type", "type": "string"},
+		{"name": "payload", "type": "string"},
+		{"name": "createdAt", "type": {"type": "long", "logicalType": "timestamp-millis"}}
+	]
+}`
+
+// EventEncoder serializes events for a message bus
+type EventEncoder interface {
+	// ContentType names the encoding, e.g. application/json
+	ContentType() string
+	Encode(event *OutboxEvent) ([]byte, error)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) ContentType() string { return "application/json" }
+
+func (jsonEncoder) Encode(event *OutboxEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+type avroEncoder struct {
+	codec *goavro.Codec
+}
+
+func newAvroEncoder() (*avroEncoder, error) {
+	codec, err := goavro.NewCodec(orderEventSchema)
+	if err != nil {
+		return nil, err
+	}
+	return &avroEncoder{codec: codec}, nil
+}
+
+func (a *avroEncoder) ContentType() string { return "avro/binary" }
+
+func (a *avroEncoder) Encode(event *OutboxEvent) ([]byte, error) {
+	return a.codec.BinaryFromNative(nil, map[string]interface{}{
+		"id":        event.ID,
+		"orderId":   event.OrderID,
+		"type":      string(event.Type),
+		"payload":   string(event.Payload),
+		"createdAt": event.CreatedAt,
+	})
+}
+
+// NewEventEncoder returns the encoder named by encoding, json or avro
+func NewEventEncoder(encoding string) (EventEncoder, error) {
+	switch encoding {
+	case config.EncodingJSON:
+		return jsonEncoder{}, nil
+	case config.EncodingAvro:
+		return newAvroEncoder()
+	}
+	return nil, fmt.Errorf("unknown event encoding %q", encoding)
+}
+
+// KafkaPublisher is an EventPublisher writing events to a kafka topic keyed by
+// order id, so the events of one order stay in one partition and in order
+type KafkaPublisher struct {
+	writer  *kafka.Writer
+	encoder EventEncoder
+}
+
+// NewKafkaPublisher returns a publisher to the brokers and topic of cfg
+func NewKafkaPublisher(cfg *config.KafkaConfig) (*KafkaPublisher, error) {
+	encoder, err := NewEventEncoder(cfg.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaPublisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Topic:        cfg.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			WriteTimeout: cfg.WriteTimeout.Duration,
+		},
+		encoder: encoder,
+	}, nil
+}
+
+func (k *KafkaPublisher) Publish(ctx context.Context, event *OutboxEvent) error {
+	value, err := k.encoder.Encode(event)
+	if err != nil {
+		return err
+	}
+	return k.writer.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(event.OrderID),
+		Value: value,
+		Headers: []kafka.Header{
+			{Key: "event-id", Value: []byte(event.ID)},
+			{Key: "event-type", Value: []byte(string(event.Type))},
+			{Key: "content-type", Value: []byte(k.encoder.ContentType())},
+		},
+	})
+}
+
+// Close flushes pending messages and closes the broker connections
+func (k *KafkaPublisher) Close() error {
+	return k.writer.Close()
+}
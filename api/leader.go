@@ -0,0 +1,122 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/omnom-nom/order/cluster"
+)
+
+const (
+	// MiddlewareLeader is the factory name of the middleware sending writes to the leader
+	MiddlewareLeader = "leader"
+	// LeaderHeader names the leader in the redirects of followers
+	LeaderHeader = "X-Order-Leader"
+	// leaderRedirectParam marks a request redirected by a follower with its node
+	// id. A follower receiving it again does not redirect it on, as the
+	// instances disagree on the leader, which would loop.
+	leaderRedirectParam = "leaderRedirect"
+)
+
+// leasesEnabler is implemented by repositories able to keep leases
+type leasesEnabler interface {
+	enableLeases(table string)
+}
+
+// EnableLeases makes repo keep leases, in table for the backends that keep
+// them in a separate table
+func EnableLeases(repo Repository, table string) error {
+	enabler, ok := repo.(leasesEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support leases", repo)
+	}
+	enabler.enableLeases(table)
+	return nil
+}
+
+// findLeaseStore returns the lease store of repo or of the repository it decorates
+func findLeaseStore(repo Repository) (cluster.LeaseStore, bool) {
+	var store cluster.LeaseStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(cluster.LeaseStore)
+		return ok
+	})
+	return store, found
+}
+
+// LeaderRedirect sends the requests that may modify state to the leader. A
+// follower answers them with a 307 redirect to the same path on the leader,
+// which clients follow with the same method and body, and with 503 while
+// there is no live leader.
+type LeaderRedirect struct {
+	elector *cluster.Elector
+	members *cluster.Membership
+}
+
+// NewLeaderRedirect returns the middleware redirecting writes to the leader
+// elected by elector, while it is a live member of members when not nil
+func NewLeaderRedirect(elector *cluster.Elector, members *cluster.Membership) *LeaderRedirect {
+	return &LeaderRedirect{elector: elector, members: members}
+}
+
+func (l *LeaderRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isReadOnlyMethod(r.Method) || isAdminPath(r.URL.Path) || l.elector.IsLeader() {
+		next(w, r)
+		return
+	}
+	leader, target, ok := leaderTarget(w, r, l.elector, l.members, r.URL.Query().Get(leaderRedirectParam))
+	if !ok {
+		return
+	}
+
+	location := *r.URL
+	location.Scheme, location.Host = target.Scheme, target.Host
+	query := location.Query()
+	query.Set(leaderRedirectParam, l.elector.ID())
+	location.RawQuery = query.Encode()
+	w.Header().Set(LeaderHeader, leader.Holder)
+	http.Redirect(w, r, location.String(), http.StatusTemporaryRedirect)
+}
+
+// leaderTarget returns the lease and the address of the leader a follower
+// hands a write to, forwardedBy names the follower that already handed it on.
+// It answers the request itself and returns false when there is no leader to
+// hand it to, or the leader stopped heartbeating as a member of members.
+func leaderTarget(w http.ResponseWriter, r *http.Request, elector *cluster.Elector, members *cluster.Membership, forwardedBy string) (*cluster.Lease, *url.URL, bool) {
+	leader, ok := elector.Leader()
+	if !ok || leader.Holder == elector.ID() {
+		leaderUnavailable(w, r, http.StatusServiceUnavailable, "no leader is elected, retry later")
+		return nil, nil, false
+	}
+	if members != nil && !members.Live(leader.Holder) {
+		LoggerFromContext(r.Context()).Warnf("leader %s is not a live member", leader.Holder)
+		leaderUnavailable(w, r, http.StatusServiceUnavailable, "the leader can not be reached, retry later")
+		return nil, nil, false
+	}
+	if forwardedBy != "" {
+		LoggerFromContext(r.Context()).Warnf("not forwarding a write forwarded by %s on to %s", forwardedBy, leader.Holder)
+		leaderUnavailable(w, r, http.StatusServiceUnavailable, "the leader is changing, retry later")
+		return nil, nil, false
+	}
+	target, err := url.Parse(leader.Address)
+	if err != nil || target.Host == "" {
+		LoggerFromContext(r.Context()).Errorf("leader %s has an invalid address %q", leader.Holder, leader.Address)
+		leaderUnavailable(w, r, http.StatusServiceUnavailable, "the leader can not be reached, retry later")
+		return nil, nil, false
+	}
+	return leader, target, true
+}
+
+// leaderUnavailable answers status with a Retry-After of the renew interval,
+// by when the instances agree on a leader again
+func leaderUnavailable(w http.ResponseWriter, r *http.Request, status int, message string) {
+	retry := int(ConfigFromContext(r.Context()).Cluster.RenewInterval.Seconds())
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeJSON(w, r, status, newErrorResponse(r.Context(), CodeLeaderUnavailable, message))
+}
@@ -0,0 +1,92 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+const (
+	// ForwardedByHeader names the follower that proxied a write to the leader. A
+	// follower receiving it does not proxy the write on, which would loop while
+	// the instances disagree on the leader.
+	ForwardedByHeader = "X-Order-Forwarded-By"
+)
+
+// LeaderProxy sends the requests that may modify state to the leader. A
+// follower proxies them to the leader and relays its response, for clients
+// that do not follow redirects with a body, like payment and carrier webhooks.
+// Connections to the leader are pooled with those of the other outbound calls.
+type LeaderProxy struct {
+	elector   *cluster.Elector
+	members   *cluster.Membership
+	transport http.RoundTripper
+
+	mu sync.Mutex
+	// proxies are the reverse proxies by leader address
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// NewLeaderProxy returns the middleware proxying writes to the leader elected
+// by elector, while it is a live member of members when not nil, with the
+// transport of clients
+func NewLeaderProxy(elector *cluster.Elector, members *cluster.Membership, clients *httpclient.Factory) *LeaderProxy {
+	return &LeaderProxy{
+		elector:   elector,
+		members:   members,
+		transport: clients.Transport("leader"),
+		proxies:   map[string]*httputil.ReverseProxy{},
+	}
+}
+
+func (l *LeaderProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isReadOnlyMethod(r.Method) || isAdminPath(r.URL.Path) || l.elector.IsLeader() {
+		next(w, r)
+		return
+	}
+	leader, target, ok := leaderTarget(w, r, l.elector, l.members, r.Header.Get(ForwardedByHeader))
+	if !ok {
+		return
+	}
+	w.Header().Set(LeaderHeader, leader.Holder)
+	l.proxy(target).ServeHTTP(w, r)
+}
+
+// proxy returns the reverse proxy to the leader at target
+func (l *LeaderProxy) proxy(target *url.URL) *httputil.ReverseProxy {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := target.Scheme + "://" + target.Host
+	if proxy, ok := l.proxies[key]; ok {
+		return proxy
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Transport: l.transport,
+		// the headers of the client are kept, the proxy adds X-Forwarded-For
+		Director: func(out *http.Request) {
+			proto := "http"
+			if out.TLS != nil {
+				proto = "https"
+			}
+			out.URL.Scheme, out.URL.Host = target.Scheme, target.Host
+			out.Header.Set("X-Forwarded-Host", out.Host)
+			out.Header.Set("X-Forwarded-Proto", proto)
+			out.Header.Set(ForwardedByHeader, l.elector.ID())
+			if _, ok := out.Header["User-Agent"]; !ok {
+				// keeps the transport from adding its own
+				out.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			LoggerFromContext(r.Context()).Errorf("failed to proxy %s %s to the leader at %s: %v", r.Method, r.URL.Path, key, err)
+			leaderUnavailable(w, r, http.StatusBadGateway, "the leader can not be reached, retry later")
+		},
+	}
+	l.proxies[key] = proxy
+	return proxy
+}
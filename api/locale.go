@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/omnom-nom/order/i18n"
+)
+
+// MiddlewareLocale is the factory name of the locale negotiation middleware
+const MiddlewareLocale = "locale"
+
+// LocaleHeader is the header of the grpc metadata naming the locales a client
+// accepts, as Accept-Language does for http
+const LocaleHeader = "accept-language"
+
+// LocaleNegotiator picks the locale of every request among the locales of its
+// catalog from the Accept-Language header of the request
+type LocaleNegotiator struct {
+	catalog *i18n.Catalog
+}
+
+// NewLocaleNegotiator returns the middleware localizing the responses with catalog
+func NewLocaleNegotiator(catalog *i18n.Catalog) *LocaleNegotiator {
+	return &LocaleNegotiator{catalog: catalog}
+}
+
+func (n *LocaleNegotiator) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	locale := n.catalog.Negotiate(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+	next(w, r.WithContext(WithLocale(r.Context(), n.catalog, locale)))
+}
+
+type localeKey struct{}
+
+// localization is the catalog and locale of a request
+type localization struct {
+	catalog *i18n.Catalog
+	locale  string
+}
+
+// WithLocale returns a copy of ctx localizing the messages to locale with catalog
+func WithLocale(ctx context.Context, catalog *i18n.Catalog, locale string) context.Context {
+	return context.WithValue(ctx, localeKey{}, &localization{catalog: catalog, locale: locale})
+}
+
+// LocaleFromContext returns the locale of ctx, i18n.Fallback when there is none
+func LocaleFromContext(ctx context.Context) string {
+	if l, ok := ctx.Value(localeKey{}).(*localization); ok {
+		return l.locale
+	}
+	return i18n.Fallback
+}
+
+// localize returns the message of key in the locale of ctx, or fallback when
+// the locale has none
+func localize(ctx context.Context, key, fallback string) string {
+	l, ok := ctx.Value(localeKey{}).(*localization)
+	if !ok {
+		return fallback
+	}
+	if message, ok := l.catalog.Message(l.locale, key); ok {
+		return message
+	}
+	return fallback
+}
+
+// statusText returns the name of status in the locale of ctx, "" when
+// responses are not localized
+func statusText(ctx context.Context, status Status) string {
+	return localize(ctx, "status."+string(status), "")
+}
+
+// newErrorResponse returns the error response of code with message, redacted,
+// in the locale of ctx. A localized response keeps message as its detail, as
+// the message of the code is the same for every error.
+func newErrorResponse(ctx context.Context, code ErrorCode, message string) *errorResponse {
+	message = RedactorFromContext(ctx).Text(message)
+	res := &errorResponse{Error: localize(ctx, "error."+string(code), message), Code: code}
+	if res.Error != message {
+		res.Detail = message
+	}
+	return res
+}
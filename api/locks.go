@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/config"
+)
+
+var (
+	// ErrOrderLocked is returned when another change of an order held its lock
+	// for longer than the lock wait
+	ErrOrderLocked = errors.New("order is being changed by another request")
+	// ErrLockLost is returned when a change is written under a lock of the order
+	// that expired and was taken by another change
+	ErrLockLost = errors.New("lock of the order expired")
+)
+
+const (
+	// orderLockPrefix prefixes the lease names of the order locks
+	orderLockPrefix = "order/"
+	// unlockTimeout bounds the release of an order lock
+	unlockTimeout = 5 * time.Second
+)
+
+// OrderLocks serializes the changes of an order across the instances with a
+// lease per order. Every lock carries the fencing token of its lease, which
+// the changes made under it store with the order, so the repository refuses
+// the changes of a holder whose lock expired and was taken by another.
+type OrderLocks struct {
+	store cluster.LeaseStore
+	node  string
+	ttl   time.Duration
+	wait  time.Duration
+}
+
+// NewOrderLocks returns the order locks of the instance named node, kept as
+// leases in store
+func NewOrderLocks(store cluster.LeaseStore, node string, cfg config.ClusterConfig) *OrderLocks {
+	return &OrderLocks{store: store, node: node, ttl: cfg.OrderLockTTL.Duration, wait: cfg.OrderLockWait.Duration}
+}
+
+// Lock takes the lock of the order with id. It returns a copy of ctx whose
+// order writes carry the fencing token of the lock, and the func releasing it.
+func (l *OrderLocks) Lock(ctx context.Context, id string) (context.Context, func(), error) {
+	// every change is a holder of its own, changes on the same instance exclude each other too
+	holder := l.node + "/" + newID()
+	lease, err := cluster.Lock(ctx, l.store, orderLockPrefix+id, holder, l.ttl, l.wait)
+	if errors.Is(err, cluster.ErrLockTimeout) {
+		return nil, nil, ErrOrderLocked
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock order %s: %v", id, err)
+	}
+
+	unlock := func() {
+		// ctx may be done by now, the lock is released regardless
+		releaseCtx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+		defer cancel()
+		if err := cluster.Release(releaseCtx, l.store, lease); err != nil {
+			LoggerFromContext(ctx).Errorf("failed to unlock order %s: %v", id, err)
+		}
+	}
+	return withLockToken(ctx, lease.Token), unlock, nil
+}
+
+type orderLocksKey struct{}
+
+// WithOrderLocks returns a copy of ctx carrying locks
+func WithOrderLocks(ctx context.Context, locks *OrderLocks) context.Context {
+	return context.WithValue(ctx, orderLocksKey{}, locks)
+}
+
+// OrderLocksFromContext returns the order locks stored in ctx, or nil
+func OrderLocksFromContext(ctx context.Context) *OrderLocks {
+	locks, _ := ctx.Value(orderLocksKey{}).(*OrderLocks)
+	return locks
+}
+
+type lockTokenKey struct{}
+
+func withLockToken(ctx context.Context, token int64) context.Context {
+	return context.WithValue(ctx, lockTokenKey{}, token)
+}
+
+// lockTokenFromContext returns the fencing token of the order lock held by ctx, 0 without one
+func lockTokenFromContext(ctx context.Context) int64 {
+	token, _ := ctx.Value(lockTokenKey{}).(int64)
+	return token
+}
+
+// lockOrder takes the lock of the order with id when ctx carries order locks.
+// Without them, as with a single instance, changes rely on the version of the
+// order alone and unlock does nothing.
+func lockOrder(ctx context.Context, id string) (context.Context, func(), error) {
+	locks := OrderLocksFromContext(ctx)
+	if locks == nil {
+		return ctx, func() {}, nil
+	}
+	return locks.Lock(ctx, id)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// newTestOrderLocks returns order locks kept in a memory repository, which
+// holds the order o-1
+func newTestOrderLocks(t *testing.T, ttl, wait time.Duration) (*OrderLocks, Repository) {
+	t.Helper()
+	repo := NewMemoryRepository().(*memoryRepository)
+	repo.enableLeases("")
+	if err := repo.CreateOrder(context.Background(), &Order{ID: "o-1", Status: StatusPending}); err != nil {
+		t.Fatalf("CreateOrder() = %v", err)
+	}
+	cfg := config.ClusterConfig{OrderLockTTL: config.Duration{Duration: ttl}, OrderLockWait: config.Duration{Duration: wait}}
+	return NewOrderLocks(repo, "node-1", cfg), repo
+}
+
+// writeLockedOrder writes the order o-1 again, under the lock of ctx
+func writeLockedOrder(ctx context.Context, repo Repository) error {
+	order, err := repo.GetOrder(ctx, "o-1")
+	if err != nil {
+		return err
+	}
+	return repo.UpdateOrder(ctx, order)
+}
+
+func TestOrderLocksFencing(t *testing.T) {
+	tests := []struct {
+		name string
+		// takeOver lets the first lock expire and another change lock the order
+		takeOver bool
+		// secondWrites writes under the second lock before the first one
+		secondWrites bool
+		err          error
+	}{
+		{name: "lock held"},
+		{name: "lock taken over, nothing written", takeOver: true},
+		{name: "lock taken over and written", takeOver: true, secondWrites: true, err: ErrLockLost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locks, repo := newTestOrderLocks(t, 50*time.Millisecond, time.Second)
+			ctx := context.Background()
+			first, unlock, err := locks.Lock(ctx, "o-1")
+			if err != nil {
+				t.Fatalf("Lock() = %v", err)
+			}
+			defer unlock()
+			if lockTokenFromContext(first) == 0 {
+				t.Fatal("the context of the lock carries no fencing token")
+			}
+
+			if tt.takeOver {
+				time.Sleep(60 * time.Millisecond)
+				second, unlockSecond, err := locks.Lock(ctx, "o-1")
+				if err != nil {
+					t.Fatalf("Lock() of the expired lock = %v", err)
+				}
+				defer unlockSecond()
+				if lockTokenFromContext(second) <= lockTokenFromContext(first) {
+					t.Fatalf("token %d of the second lock is not above %d", lockTokenFromContext(second), lockTokenFromContext(first))
+				}
+				if tt.secondWrites {
+					if err := writeLockedOrder(second, repo); err != nil {
+						t.Fatalf("UpdateOrder() under the second lock = %v", err)
+					}
+				}
+			}
+
+			if err := writeLockedOrder(first, repo); !errors.Is(err, tt.err) {
+				t.Fatalf("UpdateOrder() under the first lock = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestOrderLocksWait(t *testing.T) {
+	locks, _ := newTestOrderLocks(t, time.Minute, 100*time.Millisecond)
+	ctx := context.Background()
+	_, unlock, err := locks.Lock(ctx, "o-1")
+	if err != nil {
+		t.Fatalf("Lock() = %v", err)
+	}
+
+	if _, _, err := locks.Lock(ctx, "o-1"); !errors.Is(err, ErrOrderLocked) {
+		t.Fatalf("Lock() of a held lock = %v, want %v", err, ErrOrderLocked)
+	}
+	// the locks of other orders are independent
+	if _, unlockOther, err := locks.Lock(ctx, "o-2"); err != nil {
+		t.Fatalf("Lock() of another order = %v", err)
+	} else {
+		unlockOther()
+	}
+
+	unlock()
+	_, unlock, err = locks.Lock(ctx, "o-1")
+	if err != nil {
+		t.Fatalf("Lock() of a released lock = %v", err)
+	}
+	unlock()
+}
+
+func TestLockOrderWithoutLocks(t *testing.T) {
+	ctx := context.Background()
+	locked, unlock, err := lockOrder(ctx, "o-1")
+	if err != nil {
+		t.Fatalf("lockOrder() = %v", err)
+	}
+	defer unlock()
+	if lockTokenFromContext(locked) != 0 {
+		t.Fatal("lockOrder() without order locks set a fencing token")
+	}
+}
+
+func TestSQLRepositoryFencing(t *testing.T) {
+	ctx := context.Background()
+	repo, err := newSQLRepository(dialectSQLite, filepath.Join(t.TempDir(), "orders.db"))
+	if err != nil {
+		t.Fatalf("newSQLRepository() = %v", err)
+	}
+	defer repo.Close()
+	if err := repo.Migrate(ctx); err != nil {
+		t.Fatalf("Migrate() = %v", err)
+	}
+	if err := repo.CreateOrder(ctx, &Order{ID: "o-1", Status: StatusPending}); err != nil {
+		t.Fatalf("CreateOrder() = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token int64
+		err   error
+	}{
+		{name: "first lock", token: 1},
+		{name: "same lock", token: 1},
+		{name: "newer lock", token: 3},
+		{name: "older lock", token: 2, err: ErrLockLost},
+		{name: "without a lock", token: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			locked := ctx
+			if tt.token > 0 {
+				locked = withLockToken(ctx, tt.token)
+			}
+			if err := writeLockedOrder(locked, repo); !errors.Is(err, tt.err) {
+				t.Fatalf("UpdateOrder() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// MaxStatusWait is the longest a status request may wait for a change
+	MaxStatusWait = time.Minute
+	// statusPollInterval is how often a waiting status request reads the order
+	statusPollInterval = time.Second
+	// statusWaitMargin is left of the request timeout to write the response
+	statusWaitMargin = time.Second
+)
+
+// capStatusWait limits wait to MaxStatusWait and to the request timeout of the configuration
+func capStatusWait(ctx context.Context, wait time.Duration) time.Duration {
+	if wait > MaxStatusWait {
+		wait = MaxStatusWait
+	}
+	if timeout := ConfigFromContext(ctx).Timeouts.Request.Duration; timeout > 0 && wait > timeout-statusWaitMargin {
+		wait = timeout - statusWaitMargin
+	}
+	return wait
+}
+
+// waitForStatusChange returns the order as soon as its status differs from known,
+// or as it is when wait expires. A cancelled request ends the wait early. The order
+// is read again on every event of it on the bus and every statusPollInterval.
+func waitForStatusChange(ctx context.Context, repo Repository, order *Order, known Status, wait time.Duration) (*Order, error) {
+	if order.Status != known || wait <= 0 {
+		return order, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	changed, stop := watchOrder(repo, order.ID)
+	defer stop()
+	ticker := time.NewTicker(statusPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return order, nil
+		case <-changed:
+		case <-ticker.C:
+		}
+
+		current, err := repo.GetOrder(ctx, order.ID)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return order, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		order = current
+		if order.Status != known {
+			return order, nil
+		}
+	}
+}
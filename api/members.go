@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/omnom-nom/order/cluster"
+)
+
+// membersEnabler is implemented by repositories able to keep cluster members
+type membersEnabler interface {
+	enableMembers(table string)
+}
+
+// EnableMembers makes repo keep cluster members, in table for the backends that
+// keep them in a separate table
+func EnableMembers(repo Repository, table string) error {
+	enabler, ok := repo.(membersEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support cluster members", repo)
+	}
+	enabler.enableMembers(table)
+	return nil
+}
+
+// findMemberStore returns the member store of repo or of the repository it decorates
+func findMemberStore(repo Repository) (cluster.MemberStore, bool) {
+	var store cluster.MemberStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(cluster.MemberStore)
+		return ok
+	})
+	return store, found
+}
+
+type membershipKey struct{}
+
+// WithMembership returns a copy of ctx carrying membership
+func WithMembership(ctx context.Context, membership *cluster.Membership) context.Context {
+	return context.WithValue(ctx, membershipKey{}, membership)
+}
+
+// MembershipFromContext returns the cluster membership stored in ctx, or nil
+func MembershipFromContext(ctx context.Context) *cluster.Membership {
+	membership, _ := ctx.Value(membershipKey{}).(*cluster.Membership)
+	return membership
+}
+
+// membersResponse lists the live members of the cluster
+type membersResponse struct {
+	// Self is the id of the member answering
+	Self    string            `json:"self"`
+	Leader  string            `json:"leader,omitempty"`
+	Members []*cluster.Member `json:"members"`
+}
+
+// ListMembers returns the live instances of the cluster and their roles
+func ListMembers(w http.ResponseWriter, r *http.Request) {
+	membership := MembershipFromContext(r.Context())
+	if membership == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	members, err := membership.Members(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	resp := &membersResponse{Self: membership.ID(), Members: members}
+	if resp.Members == nil {
+		resp.Members = []*cluster.Member{}
+	}
+	for _, member := range members {
+		if member.Role == cluster.RoleLeader {
+			resp.Leader = member.ID
+		}
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
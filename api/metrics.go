@@ -0,0 +1,257 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/omnom-nom/apiserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "order"
+
+// MiddlewareRequestMetrics is the factory name of the middleware counting the requests
+const MiddlewareRequestMetrics = "request-metrics"
+
+var (
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "cache",
+		Name:      "requests_total",
+		Help:      "Order cache lookups by result (hit, miss, error).",
+	}, []string{"result"})
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "webhook",
+		Name:      "delivery_attempts_total",
+		Help:      "Webhook delivery attempts by result (delivered, failed, dead).",
+	}, []string{"result"})
+	commandsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "commands",
+		Name:      "processed_total",
+		Help:      "Queued order commands by type and result (ok, retry, dead).",
+	}, []string{"type", "result"})
+	orderEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "events",
+		Name:      "published_total",
+		Help:      "Order events published to the event bus by type.",
+	}, []string{"type"})
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "events",
+		Name:      "dropped_total",
+		Help:      "Order events dropped by event bus subscribers that fell behind.",
+	}, []string{"subscriber"})
+	deadLetters = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "events",
+		Name:      "dead_lettered_total",
+		Help:      "Order events dead-lettered by publisher (webhooks, kafka).",
+	}, []string{"publisher"})
+	hedgedReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "hedging",
+		Name:      "reads_total",
+		Help:      "Hedged order reads by result (sent, won).",
+	}, []string{"result"})
+	dbHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "healthy",
+		Help:      "1 when the last database status check passed, 0 when writes are refused.",
+	})
+	dbStatusLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "db",
+		Name:      "status_check_duration_seconds",
+		Help:      "Duration of the database status checks.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Requests by route and status code.",
+	}, []string{"route", "code"})
+	mirroredRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "mirror",
+		Name:      "requests_total",
+		Help:      "Requests sampled for mirroring by route and result (sent, failed, dropped, too_large, not_json).",
+	}, []string{"route", "result"})
+	experimentExposures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "experiments",
+		Name:      "exposures_total",
+		Help:      "Exposures of customers to the variants of experiments by experiment and variant.",
+	}, []string{"experiment", "variant"})
+	canaryRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "canary_requests_total",
+		Help:      "Requests of the routes with a canary by route, variant (stable, canary) and status code.",
+	}, []string{"route", "variant", "code"})
+	coalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "coalesced_requests_total",
+		Help:      "GET requests answered with the response of an identical concurrent request by route.",
+	}, []string{"route"})
+	deprecatedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "deprecated_requests_total",
+		Help:      "Requests of deprecated routes by route.",
+	}, []string{"route"})
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route"})
+	slowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "slow_requests_total",
+		Help:      "Requests slower than the threshold of their route by route.",
+	}, []string{"route"})
+	capacityConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "dynamodb",
+		Name:      "consumed_capacity_units_total",
+		Help:      "DynamoDB capacity units consumed by route, operation, table and type (read, write).",
+	}, []string{"route", "operation", "table", "type"})
+	quotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "quota",
+		Name:      "exceeded_total",
+		Help:      "Requests refused beyond a quota by period (daily, monthly).",
+	}, []string{"period"})
+	aclDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "http",
+		Name:      "acl_denied_total",
+		Help:      "Requests refused by the network acl by route group.",
+	}, []string{"group"})
+	fraudVerdicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "fraud",
+		Name:      "verdicts_total",
+		Help:      "Fraud screenings of new orders by verdict (approve, review, reject).",
+	}, []string{"verdict"})
+	duplicateOrders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "duplicates",
+		Name:      "detected_total",
+		Help:      "New orders repeating a recent order of their customer by action (flag, block).",
+	}, []string{"action"})
+	routedOrders = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "routing",
+		Name:      "orders_total",
+		Help:      "Routings of orders to warehouses by result (routed, unroutable, failed).",
+	}, []string{"result"})
+	agentConfirmations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "agents",
+		Name:      "confirmations_total",
+		Help:      "Confirmations of the warehouse agents by type (pick, pack, ship) and result (recorded, duplicate, rejected).",
+	}, []string{"type", "result"})
+	notificationsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "notifications",
+		Name:      "sent_total",
+		Help:      "Notifications of customers by channel (email, sms) and result (sent, failed).",
+	}, []string{"channel", "result"})
+	documentsServed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "documents",
+		Name:      "served_total",
+		Help:      "Documents of orders served by document, format and source (rendered, stored).",
+	}, []string{"document", "format", "source"})
+	priorityUpgrades = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "priority",
+		Name:      "upgrades_total",
+		Help:      "Orders whose priority was raised by new priority (expedited, rush).",
+	}, []string{"priority"})
+	trackingLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "tracking",
+		Name:      "lookups_total",
+		Help:      "Public tracking lookups by result (found, invalid, limited).",
+	}, []string{"result"})
+	slaOverdue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sla",
+		Name:      "overdue_orders",
+		Help:      "Orders past the SLA of their status at the last run of the watchdog, by status.",
+	}, []string{"status"})
+	slaEscalations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sla",
+		Name:      "escalations_total",
+		Help:      "Orders escalated as overdue by status.",
+	}, []string{"status"})
+	sagasFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sagas",
+		Name:      "finished_total",
+		Help:      "Sagas placing orders by outcome (completed, compensated).",
+	}, []string{"outcome"})
+	sagaCompensationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "sagas",
+		Name:      "compensation_failures_total",
+		Help:      "Compensations of sagas that failed and are left to the recovery.",
+	})
+	paymentFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "payments",
+		Name:      "failures_total",
+		Help:      "Payments of orders declined by the payment provider.",
+	})
+	statsFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "stats",
+		Name:      "failures_total",
+		Help:      "Order events the statistics failed to count, which they miss.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequests, webhookDeliveries, commandsProcessed, orderEvents, eventsDropped, deadLetters, hedgedReads, dbHealthy, dbStatusLatency, quotaExceeded, slowRequests, capacityConsumed, aclDenied, fraudVerdicts, duplicateOrders, routedOrders, agentConfirmations, priorityUpgrades, trackingLookups, documentsServed, notificationsSent, slaOverdue, slaEscalations, sagasFinished, sagaCompensationFailures, statsFailures, httpRequests, canaryRequests, experimentExposures, mirroredRequests, coalescedRequests, deprecatedRequests, httpRequestDuration, paymentFailures)
+}
+
+// RequestMetrics counts the requests and times them by route
+type RequestMetrics struct {
+	routes *routeMatcher
+}
+
+// NewRequestMetrics returns the middleware counting the requests of routes
+func NewRequestMetrics(routes map[string][]apiserver.Route) *RequestMetrics {
+	return &RequestMetrics{routes: newRouteMatcher(routes)}
+}
+
+func (m *RequestMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	next(sw, r)
+	// the requests of no route are counted together, their paths are unbounded
+	route, _, ok := m.routes.match(r)
+	if !ok {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, strconv.Itoa(sw.status)).Inc()
+	httpRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+}
+
+// Metrics serves the prometheus metrics of the service
+func Metrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
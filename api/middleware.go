@@ -0,0 +1,211 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/omnom-nom/apiserver"
+)
+
+// MiddlewareCrashHandler is the factory name of the middleware answering the
+// requests whose handler panicked
+const MiddlewareCrashHandler = "crash-handler"
+
+// chainHandler is a handler of the mux factory, it runs the rest of the chain
+// with next
+type chainHandler interface {
+	ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc)
+}
+
+// RouteMiddleware names the middleware of a route. Include lists the
+// middleware the route needs, which have to be registered, and Exclude the
+// default middleware the route skips.
+type RouteMiddleware struct {
+	Include []string
+	Exclude []string
+}
+
+// routeMiddleware holds the middleware of the routes by route name
+var routeMiddleware = map[string]RouteMiddleware{
+	// the probes of the load balancer would flood the request log
+	"HealthCheck": {Exclude: []string{apiserver.MiddlewareLogger}},
+}
+
+// registeredMiddleware is a middleware of the chain with its factory name
+type registeredMiddleware struct {
+	Name    string
+	Always  bool
+	Handler chainHandler
+	// After are the middleware that have to run before this one
+	After []string
+}
+
+// middlewareChain collects the middleware of the service in order before they
+// are registered with the mux factory, so that a name registered twice, a
+// middleware running after one that is unknown or registered later, or a
+// route naming middleware that is unknown fails the start rather than the
+// requests.
+type middlewareChain struct {
+	entries []registeredMiddleware
+}
+
+// Default adds a middleware the routes run unless they exclude it
+func (c *middlewareChain) Default(name string, handler chainHandler, after ...string) {
+	c.entries = append(c.entries, registeredMiddleware{Name: name, Handler: handler, After: after})
+}
+
+// Always adds a middleware every route runs
+func (c *middlewareChain) Always(name string, handler chainHandler, after ...string) {
+	c.entries = append(c.entries, registeredMiddleware{Name: name, Always: true, Handler: handler, After: after})
+}
+
+// Names returns the names of the middleware in the order they run
+func (c *middlewareChain) Names() []string {
+	names := make([]string, len(c.entries))
+	for i, entry := range c.entries {
+		names[i] = entry.Name
+	}
+	return names
+}
+
+// Validate returns an error listing every middleware without a name or
+// handler, registered more than once, or running after a middleware that is
+// not registered before it
+func (c *middlewareChain) Validate() error {
+	var errs []string
+	position := map[string]int{}
+	for i, entry := range c.entries {
+		switch {
+		case entry.Name == "":
+			errs = append(errs, fmt.Sprintf("middleware %d has no name", i))
+			continue
+		case entry.Handler == nil:
+			errs = append(errs, fmt.Sprintf("middleware %q has no handler", entry.Name))
+		}
+		if _, ok := position[entry.Name]; ok {
+			errs = append(errs, fmt.Sprintf("middleware %q is registered more than once", entry.Name))
+			continue
+		}
+		position[entry.Name] = i
+	}
+	for i, entry := range c.entries {
+		for _, before := range entry.After {
+			at, ok := position[before]
+			switch {
+			case !ok:
+				errs = append(errs, fmt.Sprintf("middleware %q runs after unknown middleware %q", entry.Name, before))
+			case at > i:
+				errs = append(errs, fmt.Sprintf("middleware %q runs after %q, which is registered later", entry.Name, before))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid middleware: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// validateRoutes returns an error listing every route of byRoute that is not
+// one of routes, that names middleware which is not registered, that both
+// includes and excludes a middleware, or that excludes a middleware every
+// route runs
+func (c *middlewareChain) validateRoutes(routes map[string][]apiserver.Route, byRoute map[string]RouteMiddleware) error {
+	known := map[string]bool{}
+	for _, group := range routes {
+		for _, route := range group {
+			known[route.Name] = true
+		}
+	}
+	registered := map[string]registeredMiddleware{}
+	for _, entry := range c.entries {
+		registered[entry.Name] = entry
+	}
+	names := make([]string, 0, len(byRoute))
+	for name := range byRoute {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []string
+	for _, name := range names {
+		if !known[name] {
+			errs = append(errs, fmt.Sprintf("middleware of unknown route %q", name))
+			continue
+		}
+		middleware := byRoute[name]
+		included := map[string]bool{}
+		for _, include := range middleware.Include {
+			included[include] = true
+			if _, ok := registered[include]; !ok {
+				errs = append(errs, fmt.Sprintf("route %q includes unknown middleware %q", name, include))
+			}
+		}
+		for _, exclude := range middleware.Exclude {
+			entry, ok := registered[exclude]
+			switch {
+			case included[exclude]:
+				errs = append(errs, fmt.Sprintf("route %q both includes and excludes middleware %q", name, exclude))
+			case !ok:
+				errs = append(errs, fmt.Sprintf("route %q excludes unknown middleware %q", name, exclude))
+			case entry.Always:
+				errs = append(errs, fmt.Sprintf("route %q excludes middleware %q, which runs on every route", name, exclude))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid route middleware: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Make checks the middleware and the middleware of the routes, given by
+// route name, and returns the middleware to register with the mux factory in
+// order. The default middleware skip the routes excluding them.
+func (c *middlewareChain) Make(routes map[string][]apiserver.Route, byRoute map[string]RouteMiddleware) ([]registeredMiddleware, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if err := c.validateRoutes(routes, byRoute); err != nil {
+		return nil, err
+	}
+	skip := map[string]map[string]bool{}
+	for name, middleware := range byRoute {
+		for _, exclude := range middleware.Exclude {
+			if skip[exclude] == nil {
+				skip[exclude] = map[string]bool{}
+			}
+			skip[exclude][name] = true
+		}
+	}
+
+	var matcher *routeMatcher
+	entries := make([]registeredMiddleware, len(c.entries))
+	for i, entry := range c.entries {
+		if len(skip[entry.Name]) > 0 {
+			if matcher == nil {
+				matcher = newRouteMatcher(routes)
+			}
+			entry.Handler = &skipRoutes{handler: entry.Handler, routes: matcher, skip: skip[entry.Name]}
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// skipRoutes runs a default middleware on the requests of every route but the
+// ones excluding it
+type skipRoutes struct {
+	handler chainHandler
+	routes  *routeMatcher
+	skip    map[string]bool
+}
+
+func (s *skipRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if name, _, ok := s.routes.match(r); ok && s.skip[name] {
+		next(w, r)
+		return
+	}
+	s.handler.ServeHTTP(w, r, next)
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/omnom-nom/apiserver"
+)
+
+type nopMiddleware struct{}
+
+func (nopMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(w, r)
+}
+
+// countingMiddleware counts the requests it runs for
+type countingMiddleware struct {
+	calls int
+}
+
+func (m *countingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	m.calls++
+	next(w, r)
+}
+
+var middlewareTestRoutes = map[string][]apiserver.Route{
+	"v1/order": {
+		{Name: "HealthCheck", Method: http.MethodGet, Path: "healthcheck"},
+		{Name: "GetOrder", Method: http.MethodGet, Path: "{orderId}"},
+	},
+}
+
+func TestMiddlewareChainValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(c *middlewareChain)
+		err   string
+	}{
+		{
+			name: "valid",
+			build: func(c *middlewareChain) {
+				c.Default("logger", nopMiddleware{})
+				c.Always("injector", nopMiddleware{})
+				c.Always("experiments", nopMiddleware{}, "injector")
+			},
+		},
+		{
+			name: "registered twice",
+			build: func(c *middlewareChain) {
+				c.Default("rate-limit", nopMiddleware{})
+				c.Always("rate-limit", nopMiddleware{})
+			},
+			err: `middleware "rate-limit" is registered more than once`,
+		},
+		{
+			name: "unknown dependency",
+			build: func(c *middlewareChain) {
+				c.Always("mirror", nopMiddleware{}, "gatekeeper")
+			},
+			err: `middleware "mirror" runs after unknown middleware "gatekeeper"`,
+		},
+		{
+			name: "dependency registered later",
+			build: func(c *middlewareChain) {
+				c.Always("experiments", nopMiddleware{}, "injector")
+				c.Always("injector", nopMiddleware{})
+			},
+			err: `middleware "experiments" runs after "injector", which is registered later`,
+		},
+		{
+			name: "no name",
+			build: func(c *middlewareChain) {
+				c.Always("", nopMiddleware{})
+			},
+			err: "middleware 0 has no name",
+		},
+		{
+			name: "no handler",
+			build: func(c *middlewareChain) {
+				c.Always("canary", nil)
+			},
+			err: `middleware "canary" has no handler`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &middlewareChain{}
+			tt.build(chain)
+			err := chain.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMiddlewareChainMakeRoutes(t *testing.T) {
+	tests := []struct {
+		name    string
+		byRoute map[string]RouteMiddleware
+		err     string
+	}{
+		{
+			name: "valid",
+			byRoute: map[string]RouteMiddleware{
+				"HealthCheck": {Exclude: []string{"logger"}},
+				"GetOrder":    {Include: []string{"logger", "injector"}},
+			},
+		},
+		{
+			name:    "unknown route",
+			byRoute: map[string]RouteMiddleware{"ListOrders": {Include: []string{"logger"}}},
+			err:     `middleware of unknown route "ListOrders"`,
+		},
+		{
+			name:    "unknown included middleware",
+			byRoute: map[string]RouteMiddleware{"GetOrder": {Include: []string{"gatekeeper"}}},
+			err:     `route "GetOrder" includes unknown middleware "gatekeeper"`,
+		},
+		{
+			name:    "unknown excluded middleware",
+			byRoute: map[string]RouteMiddleware{"HealthCheck": {Exclude: []string{"gatekeeper"}}},
+			err:     `route "HealthCheck" excludes unknown middleware "gatekeeper"`,
+		},
+		{
+			name:    "included and excluded",
+			byRoute: map[string]RouteMiddleware{"GetOrder": {Include: []string{"logger"}, Exclude: []string{"logger"}}},
+			err:     `route "GetOrder" both includes and excludes middleware "logger"`,
+		},
+		{
+			name:    "excludes a middleware of every route",
+			byRoute: map[string]RouteMiddleware{"HealthCheck": {Exclude: []string{"injector"}}},
+			err:     `route "HealthCheck" excludes middleware "injector", which runs on every route`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := &middlewareChain{}
+			chain.Default("logger", nopMiddleware{})
+			chain.Always("injector", nopMiddleware{})
+			entries, err := chain.Make(middlewareTestRoutes, tt.byRoute)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Make() = %v, want nil", err)
+				}
+				if len(entries) != 2 {
+					t.Fatalf("Make() returned %d middleware, want 2", len(entries))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Make() = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMiddlewareChainMakeInvalidChain(t *testing.T) {
+	chain := &middlewareChain{}
+	chain.Always("injector", nopMiddleware{})
+	chain.Always("injector", nopMiddleware{})
+	if _, err := chain.Make(middlewareTestRoutes, nil); err == nil {
+		t.Fatal("Make() of a chain registering a middleware twice returned no error")
+	}
+}
+
+func TestMiddlewareChainMakeExclude(t *testing.T) {
+	logger, injector := &countingMiddleware{}, &countingMiddleware{}
+	chain := &middlewareChain{}
+	chain.Default("logger", logger)
+	chain.Always("injector", injector)
+	entries, err := chain.Make(middlewareTestRoutes, map[string]RouteMiddleware{
+		"HealthCheck": {Exclude: []string{"logger"}},
+	})
+	if err != nil {
+		t.Fatalf("Make() = %v", err)
+	}
+
+	for _, path := range []string{"/v1/order/healthcheck", "/v1/order/o-1", "/v1/order/healthcheck"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		reached := false
+		for _, entry := range entries {
+			entry.Handler.ServeHTTP(httptest.NewRecorder(), r, func(http.ResponseWriter, *http.Request) { reached = true })
+		}
+		if !reached {
+			t.Fatalf("the middleware did not run the rest of the chain for %s", path)
+		}
+	}
+	if logger.calls != 1 {
+		t.Errorf("logger ran %d times, want once, for the route not excluding it", logger.calls)
+	}
+	if injector.calls != 3 {
+		t.Errorf("injector ran %d times, want 3", injector.calls)
+	}
+}
+
+func TestMiddlewareChainNames(t *testing.T) {
+	chain := &middlewareChain{}
+	chain.Default("logger", nopMiddleware{})
+	chain.Always("injector", nopMiddleware{})
+	chain.Always("canary", nopMiddleware{})
+	want := []string{"logger", "injector", "canary"}
+	if got := chain.Names(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Names() = %v, want %v", got, want)
+	}
+}
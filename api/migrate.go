@@ -0,0 +1,502 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// attribute and index names of the orders table
+const (
+	AttrOrderID    = "orderId"
+	AttrCustomerID = "customerId"
+	AttrStatus     = "status"
+	AttrCreatedAt  = "createdAt"
+	AttrCreatedDay = "createdDay"
+	AttrExpiresAt  = "expiresAt"
+	AttrVersion    = "version"
+
+	IndexCustomerID = "customer-id-index"
+	IndexStatus     = "status-index"
+	IndexCreatedAt  = "created-at-index"
+	// IndexNextRun indexes the schedules table by status and next run
+	IndexNextRun = "next-run-index"
+	// IndexJobState indexes the jobs table by state and creation
+	IndexJobState = "state-index"
+
+	attrEventID        = "eventId"
+	attrSubscriptionID = "subscriptionId"
+	attrSortKey        = "sk"
+	attrReturnID       = "returnId"
+	attrDraftID        = "draftId"
+	attrScheduleID     = "scheduleId"
+	attrNextRunAt      = "nextRunAt"
+	attrJobID          = "jobId"
+	attrJobState       = "state"
+	attrLeaseName      = "leaseName"
+	attrMemberID       = "memberId"
+	attrHostID         = "hostId"
+	attrConsumer       = "consumer"
+	attrPeriod         = "period"
+	attrLockToken      = "lockToken"
+	attrLetterID       = "letterId"
+	attrSagaID         = "sagaId"
+	attrStatsKey       = "statsKey"
+	attrWarehouseID    = "warehouseId"
+	attrUpdatedAt      = "updatedAt"
+
+	attrMigrationTable   = "tableName"
+	attrMigrationVersion = "version"
+
+	tableActiveTimeout = 5 * time.Minute
+)
+
+// Migration is one versioned change of the database schema
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error
+}
+
+// Migrations lists every schema migration, new ones are appended with the next version
+var Migrations = []Migration{
+	{Version: 1, Description: "create orders table and indexes", Apply: createOrdersTable},
+	{Version: 2, Description: "enable ttl on orders", Apply: enableOrdersTTL},
+	{Version: 3, Description: "create outbox table", Apply: createOutboxTable},
+	{Version: 4, Description: "create webhooks table", Apply: createWebhooksTable},
+	{Version: 5, Description: "create returns table", Apply: createReturnsTable},
+	{Version: 6, Description: "create customers table", Apply: createCustomersTable},
+	{Version: 7, Description: "create drafts table with ttl", Apply: createDraftsTable},
+	{Version: 8, Description: "create schedules table and indexes", Apply: createSchedulesTable},
+	{Version: 9, Description: "create jobs table with ttl and state index", Apply: createJobsTable},
+	{Version: 10, Description: "create leases table with ttl", Apply: createLeasesTable},
+	{Version: 11, Description: "create members table with ttl", Apply: createMembersTable},
+	{Version: 12, Description: "create hosts table with ttl", Apply: createHostsTable},
+	{Version: 13, Description: "create quotas table with ttl", Apply: createQuotasTable},
+	{Version: 14, Description: "enable ttl on webhooks", Apply: enableWebhooksTTL},
+	{Version: 15, Description: "create dead letters table", Apply: createDeadLettersTable},
+	{Version: 16, Description: "create sagas table", Apply: createSagasTable},
+	{Version: 17, Description: "create streams table", Apply: createStreamsTable},
+	{Version: 18, Description: "create stats table", Apply: createStatsTable},
+	{Version: 19, Description: "create warehouses table", Apply: createWarehousesTable},
+}
+
+// Migrate creates the bookkeeping table if needed and applies all pending migrations in order
+func (db *ApiDb) Migrate(ctx context.Context, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.MigrationsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrMigrationTable), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrMigrationTable), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return fmt.Errorf("failed to create migrations table: %v", err)
+	}
+
+	current, err := db.SchemaVersion(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	pending := append([]Migration(nil), Migrations...)
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+	for _, m := range pending {
+		if m.Version <= current {
+			continue
+		}
+		repositoryLogger(ctx).Infof("applying schema migration %d: %s", m.Version, m.Description)
+		if err := m.Apply(ctx, db, cfg); err != nil {
+			return fmt.Errorf("schema migration %d failed: %v", m.Version, err)
+		}
+		if err := db.setSchemaVersion(ctx, cfg, m.Version); err != nil {
+			return err
+		}
+		current = m.Version
+	}
+
+	repositoryLogger(ctx).Infof("schema of %s is at version %d", cfg.OrdersTable, current)
+	return nil
+}
+
+// SchemaVersion returns the last migration applied to the orders table, 0 if none
+func (db *ApiDb) SchemaVersion(ctx context.Context, cfg *config.DbConfig) (int, error) {
+	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(cfg.MigrationsTable),
+		Key:            map[string]types.AttributeValue{attrMigrationTable: &types.AttributeValueMemberS{Value: cfg.OrdersTable}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	v, ok := out.Item[attrMigrationVersion].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(v.Value)
+}
+
+func (db *ApiDb) setSchemaVersion(ctx context.Context, cfg *config.DbConfig, version int) error {
+	_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(cfg.MigrationsTable),
+		Item: map[string]types.AttributeValue{
+			attrMigrationTable:   &types.AttributeValueMemberS{Value: cfg.OrdersTable},
+			attrMigrationVersion: &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+			"appliedAt":          &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record schema version %d: %v", version, err)
+	}
+	return nil
+}
+
+// createTable creates a table unless it already exists and waits for it to become active
+func (db *ApiDb) createTable(ctx context.Context, input *dynamodb.CreateTableInput) error {
+	_, err := db.CreateTable(ctx, input)
+	var inUse *types.ResourceInUseException
+	if errors.As(err, &inUse) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	waiter := dynamodb.NewTableExistsWaiter(db.Client)
+	return waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: input.TableName}, tableActiveTimeout)
+}
+
+func createOrdersTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	index := func(name, hash string) types.GlobalSecondaryIndex {
+		return types.GlobalSecondaryIndex{
+			IndexName: aws.String(name),
+			KeySchema: []types.KeySchemaElement{
+				{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash},
+				{AttributeName: aws.String(AttrCreatedAt), KeyType: types.KeyTypeRange},
+			},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}
+	}
+	attr := func(name string) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: types.ScalarAttributeTypeS}
+	}
+
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.OrdersTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			attr(AttrOrderID), attr(AttrCustomerID), attr(AttrStatus), attr(AttrCreatedAt), attr(AttrCreatedDay),
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(AttrOrderID), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			index(IndexCustomerID, AttrCustomerID),
+			index(IndexStatus, AttrStatus),
+			index(IndexCreatedAt, AttrCreatedDay),
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func enableOrdersTTL(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.enableTTL(ctx, cfg.OrdersTable)
+}
+
+// enableTTL makes DynamoDB delete the items of table after their expiresAt
+func (db *ApiDb) enableTTL(ctx context.Context, table string) error {
+	_, err := db.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(AttrExpiresAt),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	// enabling ttl twice is rejected, which is fine for a re-run
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "ValidationException" {
+		return nil
+	}
+	return err
+}
+
+func createOutboxTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.OutboxTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrEventID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrEventID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createWebhooksTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.WebhooksTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrSubscriptionID), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrSortKey), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrSubscriptionID), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrSortKey), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func enableWebhooksTTL(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.enableTTL(ctx, cfg.WebhooksTable)
+}
+
+func createReturnsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.ReturnsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(AttrOrderID), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrReturnID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(AttrOrderID), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrReturnID), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createCustomersTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.CustomersTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(AttrCustomerID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(AttrCustomerID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createDraftsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.DraftsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrDraftID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrDraftID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.DraftsTable)
+}
+
+func createSchedulesTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	attr := func(name string) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: types.ScalarAttributeTypeS}
+	}
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(cfg.SchedulesTable),
+		AttributeDefinitions: []types.AttributeDefinition{attr(attrScheduleID), attr(AttrCustomerID), attr(AttrStatus), attr(attrNextRunAt)},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrScheduleID), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(IndexCustomerID),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String(AttrCustomerID), KeyType: types.KeyTypeHash},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+			{
+				IndexName: aws.String(IndexNextRun),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String(AttrStatus), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String(attrNextRunAt), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createJobsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	attr := func(name string) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: types.ScalarAttributeTypeS}
+	}
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(cfg.JobsTable),
+		AttributeDefinitions: []types.AttributeDefinition{attr(attrJobID), attr(attrJobState), attr(AttrCreatedAt)},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrJobID), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(IndexJobState),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String(attrJobState), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String(AttrCreatedAt), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.JobsTable)
+}
+
+func createLeasesTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.LeasesTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrLeaseName), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrLeaseName), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.LeasesTable)
+}
+
+func createMembersTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.MembersTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrMemberID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrMemberID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.MembersTable)
+}
+
+func createHostsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.HostsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrHostID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrHostID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.HostsTable)
+}
+
+func createQuotasTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	if err := db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.QuotasTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrConsumer), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrPeriod), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrConsumer), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrPeriod), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	}); err != nil {
+		return err
+	}
+	return db.enableTTL(ctx, cfg.QuotasTable)
+}
+
+func createDeadLettersTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.DeadLettersTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrLetterID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrLetterID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createSagasTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.SagasTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrSagaID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrSagaID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createStreamsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.StreamsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(AttrOrderID), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrSortKey), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(AttrOrderID), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrSortKey), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createStatsTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.StatsTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrStatsKey), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String(attrSortKey), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrStatsKey), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(attrSortKey), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
+
+func createWarehousesTable(ctx context.Context, db *ApiDb, cfg *config.DbConfig) error {
+	return db.createTable(ctx, &dynamodb.CreateTableInput{
+		TableName: aws.String(cfg.WarehousesTable),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String(attrWarehouseID), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String(attrWarehouseID), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/omnom-nom/order/capture"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// MiddlewareMirror is the factory name of the middleware mirroring requests to
+// a shadow deployment
+const MiddlewareMirror = "mirror"
+
+// mirroredFromHeader carries the id of the request a mirrored request copies
+const mirroredFromHeader = "X-Mirrored-From"
+
+// Mirror sends copies of a sample of the requests of the routes in its
+// configuration to a shadow deployment, such as a new version of the service
+// to validate against real traffic, and discards its responses. The copies are
+// sent in the background with the credentials of the headers left out and the
+// configured body and query fields redacted; requests whose body is not json
+// or larger than the limit are not mirrored, nor are those of the admin api,
+// health check and metrics.
+type Mirror struct {
+	cfg       config.MirrorConfig
+	routes    map[string]bool
+	client    *http.Client
+	sanitizer *capture.Sanitizer
+	// slots bounds the mirrored requests in flight
+	slots  chan struct{}
+	logger logging.Logger
+}
+
+// NewMirror returns the middleware mirroring requests as set in cfg with
+// client
+func NewMirror(cfg config.MirrorConfig, client *http.Client, logger logging.Logger) *Mirror {
+	m := &Mirror{
+		cfg:       cfg,
+		client:    client,
+		sanitizer: capture.NewSanitizer(cfg.RedactFields),
+		slots:     make(chan struct{}, cfg.Concurrency),
+		logger:    logger,
+	}
+	if len(cfg.Routes) > 0 {
+		m.routes = make(map[string]bool, len(cfg.Routes))
+		for _, route := range cfg.Routes {
+			m.routes[route] = true
+		}
+	}
+	return m
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	route, ok := RouteName(r)
+	if !ok || isCaptureExemptPath(r.URL.Path) || (m.routes != nil && !m.routes[route]) || rand.Float64() >= m.cfg.SampleRate {
+		next(w, r)
+		return
+	}
+
+	// the body is read up to the limit and handed on whole
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, int64(m.cfg.MaxBodyBytes)+1))
+		if err != nil {
+			writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+			return
+		}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+	if req, reason := m.copy(r, body); req != nil {
+		select {
+		case m.slots <- struct{}{}:
+			go m.send(req, route)
+		default:
+			mirroredRequests.WithLabelValues(route, "dropped").Inc()
+		}
+	} else {
+		mirroredRequests.WithLabelValues(route, reason).Inc()
+	}
+	next(w, r)
+}
+
+// copy returns the sanitized copy of r, with body, to send to the shadow
+// deployment, or nil and why r is not mirrored
+func (m *Mirror) copy(r *http.Request, body []byte) (*http.Request, string) {
+	if len(body) > m.cfg.MaxBodyBytes {
+		return nil, "too_large"
+	}
+	if len(body) > 0 {
+		var ok bool
+		if body, ok = m.sanitizer.Body(body); !ok {
+			return nil, "not_json"
+		}
+	}
+	target := strings.TrimSuffix(m.cfg.Endpoint, "/") + r.URL.Path
+	if query := r.URL.Query(); len(query) > 0 {
+		target += "?" + m.sanitizer.Query(query).Encode()
+	}
+	req, err := http.NewRequest(r.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, "failed"
+	}
+	for key, values := range m.sanitizer.Header(r.Header) {
+		if len(values) == 1 && values[0] == capture.Redacted {
+			continue
+		}
+		req.Header[key] = values
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Set(mirroredFromHeader, RequestIDFromContext(r.Context()))
+	return req, ""
+}
+
+// send sends req and discards the response
+func (m *Mirror) send(req *http.Request, route string) {
+	defer func() { <-m.slots }()
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout.Duration)
+	defer cancel()
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		mirroredRequests.WithLabelValues(route, "failed").Inc()
+		m.logger.Debugf("failed to mirror %s %s: %v", req.Method, route, err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	mirroredRequests.WithLabelValues(route, "sent").Inc()
+}
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/notify"
+	"github.com/omnom-nom/order/retry"
+)
+
+// NotificationPreferences are the notifications a customer receives. A
+// customer without preferences receives the emails of every event type with
+// a message, text messages are only sent to those who opt in.
+type NotificationPreferences struct {
+	Email bool `json:"email" dynamodbav:"email"`
+	SMS   bool `json:"sms" dynamodbav:"sms"`
+	// Events are the event types notified, every event type with a message
+	// when empty
+	Events []events.Type `json:"events,omitempty" dynamodbav:"events,omitempty"`
+}
+
+// defaultNotificationPreferences are those of the customers without any
+var defaultNotificationPreferences = NotificationPreferences{Email: true}
+
+// wants reports whether p receives the notifications of eventType on channel
+func (p *NotificationPreferences) wants(channel string, eventType events.Type) bool {
+	if (channel == notify.ChannelEmail && !p.Email) || (channel == notify.ChannelSMS && !p.SMS) {
+		return false
+	}
+	if len(p.Events) == 0 {
+		return true
+	}
+	for _, t := range p.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the event types of p
+func (p *NotificationPreferences) validate() error {
+	for i, t := range p.Events {
+		if !t.Known() {
+			return &ValidationError{Field: fmt.Sprintf("events[%d]", i), Reason: fmt.Sprintf("unknown event type %q", t)}
+		}
+	}
+	return nil
+}
+
+// UpdateNotificationPreferences replaces the notification preferences of the
+// customer named in the path with the body
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := prefs.validate(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	updateCustomer(w, r, func(customer *Customer) error {
+		customer.Notifications = &prefs
+		return nil
+	})
+}
+
+// Notifier notifies customers of the events of their orders on the event bus,
+// by email and text message as their preferences allow. A notification is
+// sent again after failures with the retry policy and dead-lettered once its
+// attempts are spent; replaying the letter sends it again. Like every
+// subscriber of the bus it misses the events of the writes of other instances,
+// which notify them themselves, and those of a crash.
+type Notifier struct {
+	customers   CustomerStore
+	repo        Repository
+	senders     map[string]notify.NotificationSender
+	templates   *notify.Templates
+	retry       retry.Policy
+	concurrency int
+	// tracker issues the tracking tokens of the messages, nil when the
+	// tracking is not served
+	tracker     *Tracker
+	deadLetters *DeadLetterQueue
+	logger      logging.Logger
+
+	wg sync.WaitGroup
+}
+
+// NewNotifier returns the notifier of the customers of repo sending the
+// messages of the templates of cfg with senders, by channel
+func NewNotifier(repo Repository, senders map[string]notify.NotificationSender, cfg *config.NotificationsConfig, logger logging.Logger) (*Notifier, error) {
+	customers, ok := findCustomerStore(repo)
+	if !ok {
+		return nil, fmt.Errorf("notifications need a repository keeping customers")
+	}
+	templates, err := notify.NewTemplates(cfg.Templates)
+	if err != nil {
+		return nil, err
+	}
+	return &Notifier{
+		customers:   customers,
+		repo:        repo,
+		senders:     senders,
+		templates:   templates,
+		retry:       retry.New(cfg.Retry, nil),
+		concurrency: cfg.Concurrency,
+		logger:      logger,
+	}, nil
+}
+
+// WithTracker adds the tracking token of tracker to the messages
+func (n *Notifier) WithTracker(tracker *Tracker) *Notifier {
+	n.tracker = tracker
+	return n
+}
+
+// WithDeadLetters adds the notifications failing every attempt to queue, a
+// replayed letter is sent again on the channel it failed on
+func (n *Notifier) WithDeadLetters(queue *DeadLetterQueue) *Notifier {
+	n.deadLetters = queue
+	queue.handle(PublisherNotifications, func(ctx context.Context, letter *DeadLetter) error {
+		return n.notify(ctx, letter.Event, letter.DeliveryID)
+	})
+	return n
+}
+
+// Run notifies the events of bus until ctx is done and the notifications in
+// progress are sent
+func (n *Notifier) Run(ctx context.Context, bus *events.Bus) {
+	sem := make(chan struct{}, n.concurrency)
+	sub := bus.Subscribe(events.SubscribeOptions{
+		Name:   "notifications",
+		Types:  n.templates.Types(),
+		Buffer: subscriberBuffer,
+		Policy: events.Block,
+	}, func(ctx context.Context, event *events.Event) {
+		sem <- struct{}{}
+		n.wg.Add(1)
+		go func() {
+			defer func() { <-sem; n.wg.Done() }()
+			if err := n.notify(ctx, event, ""); err != nil {
+				n.logger.Errorf("failed to notify %s event %s of order %s: %v", event.Type, event.ID, event.OrderID, err)
+			}
+		}()
+	})
+	<-ctx.Done()
+	sub.Unsubscribe()
+	n.wg.Wait()
+}
+
+// notify sends the messages of event to its customer, on channel only unless
+// it is empty. The messages failing every attempt are dead-lettered, notify
+// only fails when they can not be, or when it sends on channel only.
+func (n *Notifier) notify(ctx context.Context, event *events.Event, channel string) error {
+	data, customerID, err := n.data(ctx, event)
+	if err != nil {
+		return err
+	}
+	if customerID == "" {
+		return nil
+	}
+	customer, err := n.customers.GetCustomer(ctx, customerID)
+	if errors.Is(err, ErrCustomerNotFound) {
+		n.logger.Debugf("not notifying %s event %s of order %s, customer %s is not kept", event.Type, event.ID, event.OrderID, customerID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if customer.ErasedAt != nil {
+		return nil
+	}
+	data.Name = customer.Name
+	prefs := &defaultNotificationPreferences
+	if customer.Notifications != nil {
+		prefs = customer.Notifications
+	}
+
+	var failed error
+	for _, c := range notify.Channels {
+		if channel != "" && c != channel {
+			continue
+		}
+		sender, ok := n.senders[c]
+		if !ok || !prefs.wants(c, event.Type) {
+			continue
+		}
+		to := customer.Email
+		if c == notify.ChannelSMS {
+			to = customer.Phone
+		}
+		if to == "" {
+			continue
+		}
+		msg, err := n.templates.Render(c, to, data)
+		if err != nil {
+			return err
+		}
+		if msg == nil {
+			continue
+		}
+		if err := n.send(ctx, sender, msg, event, channel == ""); err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// send sends msg with the retry policy. A message failing every attempt is
+// dead-lettered when deadLetter is set, and its error returned otherwise.
+func (n *Notifier) send(ctx context.Context, sender notify.NotificationSender, msg *notify.Message, event *events.Event, deadLetter bool) error {
+	attempts := 0
+	err := n.retry.Do(ctx, func(ctx context.Context) error {
+		attempts++
+		return sender.Send(ctx, msg)
+	})
+	if err == nil {
+		notificationsSent.WithLabelValues(msg.Channel, "sent").Inc()
+		n.logger.Debugf("sent %s notification of %s event %s of order %s", msg.Channel, event.Type, event.ID, event.OrderID)
+		return nil
+	}
+	notificationsSent.WithLabelValues(msg.Channel, "failed").Inc()
+	if !deadLetter || ctx.Err() != nil {
+		return err
+	}
+	if n.deadLetters == nil {
+		n.logger.Errorf("dropped %s notification of %s event %s of order %s after %d attempts: %v", msg.Channel, event.Type, event.ID, event.OrderID, attempts, err)
+		return nil
+	}
+	letter := &DeadLetter{
+		ID:         PublisherNotifications + "-" + event.ID + "-" + msg.Channel,
+		Publisher:  PublisherNotifications,
+		Event:      event,
+		DeliveryID: msg.Channel,
+		Attempts:   attempts,
+		LastError:  err.Error(),
+		FailedAt:   time.Now().UTC(),
+	}
+	return n.deadLetters.Add(ctx, letter)
+}
+
+// data returns what the templates of event render, but the name of the
+// customer, and the id of the customer to notify, empty when the order names
+// none
+func (n *Notifier) data(ctx context.Context, event *events.Event) (*notify.Data, string, error) {
+	data := &notify.Data{Event: event.Type, OrderID: event.OrderID}
+	var order *Order
+	if isReturnEvent(event.Type) {
+		var ret Return
+		if err := json.Unmarshal(event.Payload, &ret); err != nil {
+			return nil, "", err
+		}
+		data.ReturnID = ret.ID
+		data.ReturnStatus = string(ret.Status)
+		data.Reason = ret.RejectionReason
+		data.Refunded = ret.Refunded().String()
+		var err error
+		if order, err = n.repo.GetOrder(ctx, ret.OrderID); err != nil {
+			return nil, "", err
+		}
+	} else {
+		order = &Order{}
+		if err := json.Unmarshal(event.Payload, order); err != nil {
+			return nil, "", err
+		}
+		if order.Cancellation != nil {
+			data.Reason = string(order.Cancellation.Reason)
+		}
+	}
+
+	data.Status = string(order.Status)
+	data.Total = order.Total.String()
+	for _, item := range order.Items {
+		data.Items = append(data.Items, notify.Item{SKU: item.SKU, Name: item.Name, Quantity: item.Quantity})
+	}
+	if n.tracker != nil {
+		data.TrackingToken, _ = n.tracker.Token(order.ID, time.Now())
+	}
+	return data, order.CustomerID, nil
+}
+
+// isReturnEvent reports whether the payload of events of type t is a return
+func isReturnEvent(t events.Type) bool {
+	switch t {
+	case events.ReturnRequested, events.ReturnApproved, events.ReturnRejected, events.ReturnShipped, events.ReturnReceived, events.ReturnRefunded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/omnom-nom/order/payments"
+)
+
+// the order operations below are shared by the http handlers and the command worker
+
+// createOrder validates req and stores it as a new pending order, with id unless it
+// is empty, after checking it for duplicates, screening it for fraud and reserving
+// its stock and before taking its payment. An order held by the screening is created held, the others are
+// routed to warehouses. With the saga coordinator of ctx the order is placed as
+// a saga.
+func createOrder(ctx context.Context, repo Repository, req *createOrderRequest, id string) (*Order, error) {
+	order, err := req.newOrder(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		order.ID = id
+	}
+	if pay := PaymentsFromContext(ctx); pay != nil {
+		if err := pay.planTenders(ctx, order, req.Tenders, req.PaymentMethod); err != nil {
+			return nil, err
+		}
+		if req.PaymentMethod == payments.MethodOnAccount {
+			if err := pay.checkCredit(ctx, order); err != nil {
+				return nil, err
+			}
+		}
+	} else if len(req.Tenders) > 0 {
+		return nil, &ValidationError{Field: "tenders", Reason: "gift cards and store credit are not accepted"}
+	}
+	if cfg := ConfigFromContext(ctx).Duplicates; cfg.Enabled && !req.AllowDuplicate {
+		if err := checkDuplicate(ctx, repo, order, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	screen := FraudFromContext(ctx)
+	if screen != nil {
+		if err := screen.screen(ctx, order); err != nil {
+			return nil, err
+		}
+	}
+	if order.Status != StatusHeld {
+		routeConfirmed(ctx, repo, order)
+	}
+	if sagas := SagasFromContext(ctx); sagas != nil {
+		order, err = sagas.place(ctx, repo, order, req.PaymentMethod)
+	} else {
+		order, err = placeOrder(ctx, repo, order, req.PaymentMethod)
+	}
+	if err == nil && order.Status == StatusHeld && order.Fraud.Verdict == "" {
+		go screen.screenLater(context.WithoutCancel(ctx), repo, order.ID)
+	}
+	if err == nil {
+		queueRouting(ctx, order)
+	}
+	return order, err
+}
+
+// placeOrder reserves the stock of the new order, redeems its tenders, stores
+// it and takes its payment with paymentMethod
+func placeOrder(ctx context.Context, repo Repository, order *Order, paymentMethod string) (*Order, error) {
+	if stock := InventoryFromContext(ctx); stock != nil {
+		if err := reserveStock(ctx, stock, order); err != nil {
+			return nil, err
+		}
+	}
+	pay := PaymentsFromContext(ctx)
+	if pay != nil && len(order.Tenders) > 0 {
+		if err := pay.redeemTenders(ctx, order); err != nil {
+			releaseStock(ctx, order)
+			return nil, err
+		}
+	}
+	if err := repo.CreateOrder(ctx, order); err != nil {
+		// a retried command reserved the stock and redeemed the tenders of the
+		// existing order again
+		if !errors.Is(err, ErrOrderExists) {
+			releaseStock(ctx, order)
+			if pay != nil && len(order.Tenders) > 0 {
+				if reverseErr := pay.reverseTenders(ctx, order.ID, order.Tenders); reverseErr != nil {
+					LoggerFromContext(ctx).Errorf("failed to reverse the tenders of order %s: %v", order.ID, reverseErr)
+				}
+			}
+		}
+		return nil, err
+	}
+	LoggerFromContext(ctx).Infof("created order %s", order.ID)
+	if pay != nil {
+		// the payment of a held order is only authorized until it is released
+		return pay.Pay(ctx, repo, order, paymentMethod)
+	}
+	return order, nil
+}
+
+// cancelOrder cancels the order with id for the reason of req, recording an
+// OrderCancelled event, and refunds it with the refund hook of ctx if it was paid
+// or its payment is authorized.
+// The reserved stock of the order is released. Cancelling a cancelled order returns
+// it after retrying a failed release of its stock or refund. The order is locked
+// while it is cancelled, as it is while it ships.
+func cancelOrder(ctx context.Context, repo Repository, id string, req *cancelOrderRequest) (*Order, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return cancelLockedOrder(ctx, repo, order, req)
+}
+
+// cancelLockedOrder cancels order, whose lock the caller holds, like cancelOrder
+func cancelLockedOrder(ctx context.Context, repo Repository, order *Order, req *cancelOrderRequest) (*Order, error) {
+	if order.Status == StatusCancelled {
+		released := releaseStock(ctx, order)
+		if order.Cancellation != nil && order.Cancellation.Refund == RefundFailed {
+			return refundOrder(ctx, repo, order)
+		}
+		if released {
+			return saveOrder(ctx, repo, order)
+		}
+		return order, nil
+	}
+	if !order.Cancellable() {
+		return nil, ErrNotCancellable
+	}
+
+	now := time.Now().UTC()
+	refund := RefundNone
+	if needsRefund(order) {
+		refund = RefundPending
+	}
+	order.Status = StatusCancelled
+	order.Cancellation = &Cancellation{Reason: req.Reason, Note: req.Note, CancelledAt: now, Refund: refund}
+	order.UpdatedAt = now
+	if err := repo.UpdateOrder(WithEventType(ctx, EventOrderCancelled), order); err != nil {
+		return nil, err
+	}
+	LoggerFromContext(ctx).Infof("cancelled order %s: %s", order.ID, req.Reason)
+	// the preconditions held for the cancellation, the writes of the refund
+	// and the stock change the order cancelled
+	ctx = withoutPreconditions(ctx)
+
+	released := releaseStock(ctx, order)
+	if refund == RefundPending {
+		return refundOrder(ctx, repo, order)
+	}
+	if released {
+		return saveOrder(ctx, repo, order)
+	}
+	return order, nil
+}
+
+// refundOrder calls the refund hook of ctx for a cancelled order and records the
+// outcome. A failed refund leaves the order cancelled with the refund failed.
+func refundOrder(ctx context.Context, repo Repository, order *Order) (*Order, error) {
+	refundErr := RefundHookFromContext(ctx).Refund(ctx, order, order.Total, order.ID+"-cancel")
+	order.Cancellation.Refund = RefundRefunded
+	if refundErr != nil {
+		LoggerFromContext(ctx).Errorf("failed to refund cancelled order %s: %v", order.ID, refundErr)
+		order.Cancellation.Refund = RefundFailed
+	}
+	return saveOrder(ctx, repo, order)
+}
+
+// saveOrder stores the changes to order
+func saveOrder(ctx context.Context, repo Repository, order *Order) (*Order, error) {
+	order.UpdatedAt = time.Now().UTC()
+	if err := repo.UpdateOrder(ctx, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
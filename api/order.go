@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/payments"
+	"github.com/omnom-nom/order/pricing"
+)
+
+// Status is the lifecycle state of an order
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusPaid      Status = "paid"
+	StatusShipped   Status = "shipped"
+	StatusDelivered Status = "delivered"
+	StatusCancelled Status = "cancelled"
+	// StatusHeld marks a new order the fraud screening holds for review
+	StatusHeld Status = "held"
+)
+
+var (
+	// ErrOrderNotFound is returned when no order has the requested id
+	ErrOrderNotFound = errors.New("order not found")
+	// ErrOrderExists is returned when creating an order whose id is taken
+	ErrOrderExists = errors.New("order already exists")
+	// ErrVersionConflict is returned when an order was modified since it was read
+	ErrVersionConflict = errors.New("order was modified concurrently")
+	// ErrNotCancellable is returned when cancelling an order that has shipped
+	ErrNotCancellable = errors.New("order can no longer be cancelled")
+	// ErrPreconditionFailed is returned when an If-Match header does not match the order,
+	// or it was modified after the date of an If-Unmodified-Since header
+	ErrPreconditionFailed = errors.New("order does not match the precondition")
+)
+
+// ValidationError describes an invalid request
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Address is a postal address
+type Address struct {
+	Name       string `json:"name,omitempty" dynamodbav:"name,omitempty"`
+	Line1      string `json:"line1" dynamodbav:"line1"`
+	Line2      string `json:"line2,omitempty" dynamodbav:"line2,omitempty"`
+	City       string `json:"city" dynamodbav:"city"`
+	State      string `json:"state,omitempty" dynamodbav:"state,omitempty"`
+	PostalCode string `json:"postalCode" dynamodbav:"postalCode"`
+	Country    string `json:"country" dynamodbav:"country"`
+}
+
+// LineItem is one product of an order
+type LineItem struct {
+	SKU       string      `json:"sku" dynamodbav:"sku"`
+	Name      string      `json:"name,omitempty" dynamodbav:"name,omitempty"`
+	Quantity  int         `json:"quantity" dynamodbav:"quantity"`
+	UnitPrice money.Money `json:"unitPrice" dynamodbav:"unitPrice"`
+}
+
+// Cancellation records why and when an order was cancelled and the state of its refund
+type Cancellation struct {
+	Reason      CancelReason `json:"reason" dynamodbav:"reason"`
+	Note        string       `json:"note,omitempty" dynamodbav:"note,omitempty"`
+	CancelledAt time.Time    `json:"cancelledAt" dynamodbav:"cancelledAt"`
+	Refund      RefundStatus `json:"refund" dynamodbav:"refund"`
+}
+
+// Order is the order aggregate as stored and returned by the api
+type Order struct {
+	ID              string     `json:"id" dynamodbav:"orderId"`
+	CustomerID      string     `json:"customerId" dynamodbav:"customerId"`
+	Status          Status     `json:"status" dynamodbav:"status"`
+	Items           []LineItem `json:"items" dynamodbav:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty" dynamodbav:"shippingAddress,omitempty"`
+	// Currency is the ISO 4217 currency of the amounts of the order, empty on
+	// the orders stored before orders had one
+	Currency  string      `json:"currency,omitempty" dynamodbav:"currency,omitempty"`
+	Total     money.Money `json:"total" dynamodbav:"total"`
+	CreatedAt time.Time   `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time   `json:"updatedAt" dynamodbav:"updatedAt"`
+	// Cancellation is set when the order is cancelled
+	Cancellation *Cancellation `json:"cancellation,omitempty" dynamodbav:"cancellation,omitempty"`
+	// Payment is the payment taken with the payment provider
+	Payment *payments.Payment `json:"payment,omitempty" dynamodbav:"payment,omitempty"`
+	// Tenders are the gift cards and store credit paying part of the total,
+	// the card payment pays the rest
+	Tenders []Tender `json:"tenders,omitempty" dynamodbav:"tenders,omitempty"`
+	// Ledger records the value taken off and returned to the tenders and the
+	// card, oldest first
+	Ledger []LedgerEntry `json:"ledger,omitempty" dynamodbav:"ledger,omitempty"`
+	// PurchaseOrder is the number of the purchase order of the customer the
+	// order fulfils
+	PurchaseOrder string `json:"purchaseOrder,omitempty" dynamodbav:"purchaseOrder,omitempty"`
+	// Terms are the net terms of the invoice of an order paid on account
+	Terms *PaymentTerms `json:"terms,omitempty" dynamodbav:"terms,omitempty"`
+	// StockReserved is set while the inventory holds the stock of the order
+	StockReserved bool `json:"stockReserved,omitempty" dynamodbav:"stockReserved,omitempty"`
+	// Pricing is the price breakdown Total was computed with
+	Pricing *pricing.Breakdown `json:"pricing,omitempty" dynamodbav:"pricing,omitempty"`
+	// Shipments are the parcels the order ships in
+	Shipments []Shipment `json:"shipments,omitempty" dynamodbav:"shipments,omitempty"`
+	// Confirmations are the picks, packs and shipments the warehouse agents
+	// confirmed, oldest received first
+	Confirmations []Confirmation `json:"confirmations,omitempty" dynamodbav:"confirmations,omitempty"`
+	// Priority is standard, expedited or rush, empty on the orders stored
+	// before orders had one
+	Priority Priority `json:"priority,omitempty" dynamodbav:"priority,omitempty"`
+	// Routing assigns the items to the warehouses shipping them, set once the
+	// order is confirmed while orders are routed
+	Routing *OrderRouting `json:"routing,omitempty" dynamodbav:"routing,omitempty"`
+	// DuplicateOf names the recent order of the customer the order is
+	// suspected to repeat
+	DuplicateOf string `json:"duplicateOf,omitempty" dynamodbav:"duplicateOf,omitempty"`
+	// Fraud is the fraud screening of the order, set while orders are screened
+	Fraud *FraudReview `json:"fraud,omitempty" dynamodbav:"fraud,omitempty"`
+	// Escalation is set once the order overstayed the SLA of its status
+	Escalation *Escalation `json:"escalation,omitempty" dynamodbav:"escalation,omitempty"`
+	// ScheduleID names the schedule that placed the order
+	ScheduleID string `json:"scheduleId,omitempty" dynamodbav:"scheduleId,omitempty"`
+	// TenantID is the tenant the order was created for, authenticated by the
+	// api key of the request
+	TenantID string `json:"tenantId,omitempty" dynamodbav:"tenantId,omitempty"`
+	// Edits is the audit trail of the edits of the order, oldest first
+	Edits []OrderEdit `json:"edits,omitempty" dynamodbav:"edits,omitempty"`
+	// DeletedAt is set when the order is deleted, it can be restored until it is purged at ExpiresAt
+	DeletedAt *time.Time `json:"deletedAt,omitempty" dynamodbav:"deletedAt,omitempty"`
+	// ArchivedAt is set on orders read from the archive, which can not be changed
+	ArchivedAt *time.Time `json:"archivedAt,omitempty" dynamodbav:"archivedAt,omitempty"`
+	// Sealed holds the shipping address and payment id while the order is
+	// stored with encryption, they are opened when it is read
+	Sealed *SealedFields `json:"sealed,omitempty" dynamodbav:"sealed,omitempty"`
+	// ErasedAt is set once the personal data of the order is erased
+	ErasedAt *time.Time `json:"erasedAt,omitempty" dynamodbav:"erasedAt,omitempty"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+	// ExpiresAt is the unix time after which DynamoDB may delete the order, 0 keeps it
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt,omitempty"`
+	// LockToken is the fencing token of the last order lock the order was
+	// changed under, changes under an older lock are refused
+	LockToken int64 `json:"-" dynamodbav:"lockToken,omitempty"`
+}
+
+// Validate checks the fields a client has to provide
+func (o *Order) Validate() error {
+	if o.CustomerID == "" {
+		return &ValidationError{Field: "customerId", Reason: "is required"}
+	}
+	if !money.ValidCurrency(o.Currency) {
+		return &ValidationError{Field: "currency", Reason: "must be an ISO 4217 currency code"}
+	}
+	return validateItems(o.Items)
+}
+
+// validateItems checks the line items of an order
+func validateItems(items []LineItem) error {
+	if len(items) == 0 {
+		return &ValidationError{Field: "items", Reason: "at least one item is required"}
+	}
+	for i, item := range items {
+		if item.SKU == "" {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].sku", i), Reason: "is required"}
+		}
+		if item.Quantity <= 0 {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].quantity", i), Reason: "must be positive"}
+		}
+		if item.UnitPrice.IsNegative() {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].unitPrice", i), Reason: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// ETag returns the entity tag of the current version of the order
+func (o *Order) ETag() string {
+	return fmt.Sprintf(`"%d"`, o.Version)
+}
+
+// ComputeTotal sets Total from the line items
+func (o *Order) ComputeTotal() {
+	total := money.New(0, o.Currency)
+	for _, item := range o.Items {
+		total = total.Add(item.UnitPrice.Mul(int64(item.Quantity)))
+	}
+	o.Total = total
+}
+
+// SetCurrency makes currency the currency of the order, taking the amounts
+// read without one to be in it. It fails when an amount has more decimals
+// than the currency has minor units.
+func (o *Order) SetCurrency(currency string) error {
+	for i := range o.Items {
+		price, err := o.Items[i].UnitPrice.In(currency)
+		if err != nil {
+			return &ValidationError{Field: fmt.Sprintf("items[%d].unitPrice", i), Reason: err.Error()}
+		}
+		o.Items[i].UnitPrice = price
+	}
+	total, err := o.Total.In(currency)
+	if err != nil {
+		return &ValidationError{Field: "total", Reason: err.Error()}
+	}
+	o.Total = total
+	for i := range o.Edits {
+		edit := &o.Edits[i]
+		if edit.TotalBefore, err = edit.TotalBefore.In(currency); err != nil {
+			return err
+		}
+		if edit.TotalAfter, err = edit.TotalAfter.In(currency); err != nil {
+			return err
+		}
+	}
+	for i := range o.Tenders {
+		tender := &o.Tenders[i]
+		if tender.Amount, err = tender.Amount.In(currency); err != nil {
+			return err
+		}
+		if tender.Refunded, err = tender.Refunded.In(currency); err != nil {
+			return err
+		}
+	}
+	for i := range o.Ledger {
+		if o.Ledger[i].Amount, err = o.Ledger[i].Amount.In(currency); err != nil {
+			return err
+		}
+	}
+	if o.Pricing != nil {
+		if err := o.Pricing.SetCurrency(currency); err != nil {
+			return err
+		}
+	}
+	if o.Payment != nil {
+		if err := o.Payment.SetCurrency(currency); err != nil {
+			return err
+		}
+	}
+	o.Currency = currency
+	return nil
+}
+
+// UnmarshalJSON decodes the order with its amounts in its currency
+func (o *Order) UnmarshalJSON(data []byte) error {
+	type order Order
+	if err := json.Unmarshal(data, (*order)(o)); err != nil {
+		return err
+	}
+	if o.Currency == "" {
+		return nil
+	}
+	return o.SetCurrency(o.Currency)
+}
+
+// orderCurrency returns the currency of an order of ctx asking for currency,
+// the currency of the orders of its tenant when empty
+func orderCurrency(ctx context.Context, currency string) (string, error) {
+	if currency == "" {
+		return ConfigFromContext(ctx).OrderCurrency(TenantFromContext(ctx)), nil
+	}
+	code, err := money.ParseCurrency(currency)
+	if err != nil {
+		return "", &ValidationError{Field: "currency", Reason: "must be an ISO 4217 currency code"}
+	}
+	return code, nil
+}
+
+// Finished reports whether the order reached a final status, delivered or cancelled
+func (o *Order) Finished() bool {
+	return o.Status == StatusDelivered || o.Status == StatusCancelled
+}
+
+// Cancellable reports whether the order may still be cancelled
+func (o *Order) Cancellable() bool {
+	return o.Status == StatusPending || o.Status == StatusPaid || o.Status == StatusHeld
+}
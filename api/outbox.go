@@ -0,0 +1,244 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/logging"
+)
+
+// order lifecycle event types
+const (
+	EventOrderCreated   = events.OrderCreated
+	EventOrderUpdated   = events.OrderUpdated
+	EventOrderCancelled = events.OrderCancelled
+	EventOrderDeleted   = events.OrderDeleted
+	EventOrderEdited    = events.OrderEdited
+	EventOrderRestored  = events.OrderRestored
+	EventOrderArchived  = events.OrderArchived
+	EventOrderOverdue   = events.OrderOverdue
+)
+
+// OutboxEvent is an order event recorded in the same transaction as the change it describes
+type OutboxEvent = events.Event
+
+// Outbox is implemented by repositories that record an OutboxEvent with every order write
+type Outbox interface {
+	// PendingEvents returns up to limit unpublished events, oldest first
+	PendingEvents(ctx context.Context, limit int) ([]*OutboxEvent, error)
+	// MarkPublished removes a published event from the outbox
+	MarkPublished(ctx context.Context, event *OutboxEvent) error
+}
+
+// EventPublisher delivers outbox events to the message bus
+type EventPublisher interface {
+	Publish(ctx context.Context, event *OutboxEvent) error
+}
+
+// outboxEnabler is implemented by repositories able to keep an outbox
+type outboxEnabler interface {
+	enableOutbox(table string)
+}
+
+// EnableOutbox makes repo record an event with every order write, in table
+// for the backends that keep the outbox in a separate table
+func EnableOutbox(repo Repository, table string) error {
+	enabler, ok := repo.(outboxEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support an outbox", repo)
+	}
+	enabler.enableOutbox(table)
+	return nil
+}
+
+// unwrapper is implemented by repositories decorating another one
+type unwrapper interface {
+	Unwrap() Repository
+}
+
+// eachLayer calls fn with repo and then each repository it decorates, until fn returns true.
+// It reports whether fn returned true.
+func eachLayer(repo Repository, fn func(Repository) bool) bool {
+	for repo != nil {
+		if fn(repo) {
+			return true
+		}
+		u, ok := repo.(unwrapper)
+		if !ok {
+			break
+		}
+		repo = u.Unwrap()
+	}
+	return false
+}
+
+// findOutbox returns the outbox of repo or of the repository it decorates
+func findOutbox(repo Repository) (Outbox, bool) {
+	var outbox Outbox
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		outbox, ok = r.(Outbox)
+		return ok
+	})
+	return outbox, found
+}
+
+type eventTypeKey struct{}
+
+// WithEventType returns a copy of ctx making the next UpdateOrder record eventType
+// instead of OrderUpdated, e.g. OrderCancelled
+func WithEventType(ctx context.Context, eventType events.Type) context.Context {
+	return context.WithValue(ctx, eventTypeKey{}, eventType)
+}
+
+func eventTypeFromContext(ctx context.Context, fallback events.Type) events.Type {
+	if eventType, ok := ctx.Value(eventTypeKey{}).(events.Type); ok && eventType != "" {
+		return eventType
+	}
+	return fallback
+}
+
+// newOutboxEvent returns the event of a write of order, whose state is the payload
+func newOutboxEvent(eventType events.Type, order *Order) (*OutboxEvent, error) {
+	payload, err := json.Marshal(order)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{
+		ID:        newID(),
+		OrderID:   order.ID,
+		Type:      eventType,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC(),
+		TenantID:  order.TenantID,
+	}, nil
+}
+
+// newDeleteEvent returns the event of the removal of order id, which is an
+// OrderDeleted event unless ctx carries another event type
+func newDeleteEvent(ctx context.Context, id string) *OutboxEvent {
+	payload, _ := json.Marshal(map[string]string{"id": id})
+	return &OutboxEvent{
+		ID:        newID(),
+		OrderID:   id,
+		Type:      eventTypeFromContext(ctx, EventOrderDeleted),
+		Payload:   payload,
+		CreatedAt: time.Now().UTC(),
+		TenantID:  TenantFromContext(ctx),
+	}
+}
+
+// sortEvents orders events by creation time, oldest first
+func sortEvents(events []*OutboxEvent) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+}
+
+// logPublisher only logs events, it is used until a message bus is configured
+type logPublisher struct {
+	logger logging.Logger
+}
+
+func (p logPublisher) Publish(ctx context.Context, event *OutboxEvent) error {
+	p.logger.WithFields(logging.Fields{"event": event.Type, logging.OrderIDKey: event.OrderID}).Info("order event")
+	return nil
+}
+
+// multiPublisher publishes every event to all of its publishers. An event failing
+// on one of them is published to all again, consumers deduplicate by event id.
+type multiPublisher []EventPublisher
+
+func (m multiPublisher) Publish(ctx context.Context, event *OutboxEvent) error {
+	for _, publisher := range m {
+		if err := publisher.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutboxRelay drains the outbox into a publisher. Events of one order are published
+// in order; when one fails the later events of that order wait for the next round.
+type OutboxRelay struct {
+	outbox     Outbox
+	publisher  EventPublisher
+	interval   time.Duration
+	maxBackoff time.Duration
+	batchSize  int
+	logger     logging.Logger
+}
+
+// NewOutboxRelay returns a relay polling outbox every interval for up to batchSize events,
+// backing off up to maxBackoff while publishing fails
+func NewOutboxRelay(outbox Outbox, publisher EventPublisher, interval, maxBackoff time.Duration, batchSize int, logger logging.Logger) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:     outbox,
+		publisher:  publisher,
+		interval:   interval,
+		maxBackoff: maxBackoff,
+		batchSize:  batchSize,
+		logger:     logger,
+	}
+}
+
+// Run relays events until ctx is done
+func (o *OutboxRelay) Run(ctx context.Context) {
+	wait := o.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		published, failed := o.RelayOnce(ctx)
+		switch {
+		case failed > 0:
+			wait *= 2
+			if wait > o.maxBackoff {
+				wait = o.maxBackoff
+			}
+		case published == o.batchSize:
+			// the outbox has a backlog, continue right away
+			wait = 0
+		default:
+			wait = o.interval
+		}
+	}
+}
+
+// RelayOnce publishes one batch of pending events and returns how many were
+// published and how many failed
+func (o *OutboxRelay) RelayOnce(ctx context.Context) (int, int) {
+	events, err := o.outbox.PendingEvents(ctx, o.batchSize)
+	if err != nil {
+		o.logger.Errorf("failed to read outbox: %v", err)
+		return 0, 1
+	}
+
+	published, failed := 0, 0
+	blocked := map[string]bool{}
+	for _, event := range events {
+		if blocked[event.OrderID] {
+			continue
+		}
+		if err := o.publisher.Publish(ctx, event); err != nil {
+			o.logger.Warnf("failed to publish %s event %s of order %s: %v", event.Type, event.ID, event.OrderID, err)
+			blocked[event.OrderID] = true
+			failed++
+			continue
+		}
+		if err := o.outbox.MarkPublished(ctx, event); err != nil {
+			// the event will be published again, consumers deduplicate by event id
+			o.logger.Errorf("failed to mark event %s published: %v", event.ID, err)
+			blocked[event.OrderID] = true
+			failed++
+			continue
+		}
+		published++
+	}
+	return published, failed
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/payments"
+)
+
+// ErrPaymentDeclined is returned when the payment of a new order is declined, the
+// order is kept cancelled with the reason payment_failed
+var ErrPaymentDeclined = errors.New("payment declined")
+
+// maxWebhookBody bounds the notifications read from payment providers
+const maxWebhookBody = 1 << 20
+
+// Payments takes the payments of orders with a provider in the currency of each
+// order, and the tenders paying part of them with the gift card service. It is
+// the refund hook of the service while payments are enabled.
+type Payments struct {
+	Provider payments.PaymentProvider
+	// GiftCards keeps the balances of gift cards and store credit, nil while
+	// orders are paid by card only
+	GiftCards payments.GiftCardService
+	// Account charges the orders on account to the credit lines of Credit, nil
+	// while orders can not be paid on account
+	Account payments.PaymentProvider
+	Credit  payments.CreditService
+	// Currency is the currency of the orders stored before orders had one
+	Currency string
+}
+
+// WithCredit lets orders be paid on account, charged to the credit lines of
+// credit
+func (p *Payments) WithCredit(credit payments.CreditService) *Payments {
+	p.Credit = credit
+	p.Account = payments.NewAccountProvider(credit)
+	return p
+}
+
+// provider returns the provider taking the payments with paymentMethod
+func (p *Payments) provider(paymentMethod string) payments.PaymentProvider {
+	if paymentMethod == payments.MethodOnAccount && p.Account != nil {
+		return p.Account
+	}
+	return p.Provider
+}
+
+// providerOf returns the provider that took payment
+func (p *Payments) providerOf(payment *payments.Payment) payments.PaymentProvider {
+	if payment.Provider == payments.ProviderAccount && p.Account != nil {
+		return p.Account
+	}
+	return p.Provider
+}
+
+type paymentsKey struct{}
+
+// WithPayments returns a copy of ctx carrying p
+func WithPayments(ctx context.Context, p *Payments) context.Context {
+	return context.WithValue(ctx, paymentsKey{}, p)
+}
+
+// PaymentsFromContext returns the payments stored in ctx, or nil when payments are disabled
+func PaymentsFromContext(ctx context.Context) *Payments {
+	p, _ := ctx.Value(paymentsKey{}).(*Payments)
+	return p
+}
+
+// idempotency keys of the payment operations of an order, stable across retries
+func authorizeKey(order *Order) string { return order.ID + "-authorize" }
+func captureKey(order *Order) string   { return order.ID + "-capture" }
+
+// Pay authorizes and captures the total of a new order with paymentMethod and
+// stores the outcome. A pending payment is settled by the provider webhook.
+func (p *Payments) Pay(ctx context.Context, repo Repository, order *Order, paymentMethod string) (*Order, error) {
+	if err := p.authorize(ctx, order, paymentMethod); err != nil {
+		return nil, err
+	}
+	if err := p.capture(ctx, order); err != nil {
+		return nil, err
+	}
+	return settlePayment(ctx, repo, order)
+}
+
+// authorize authorizes the payment of order with paymentMethod, of the part of
+// its total its tenders leave to the card, and sets order.Payment. Authorizing
+// the order again returns the same payment. An order its tenders pay in full
+// has no card payment.
+func (p *Payments) authorize(ctx context.Context, order *Order, paymentMethod string) error {
+	amount := order.cardAmount()
+	if amount.IsZero() && len(order.Tenders) > 0 {
+		return nil
+	}
+	currency := order.Currency
+	if currency == "" {
+		currency = p.Currency
+	}
+	amount, err := amount.In(currency)
+	if err != nil {
+		return err
+	}
+	provider := p.provider(paymentMethod)
+	result, err := provider.Authorize(ctx, &payments.AuthorizeRequest{
+		OrderID:        order.ID,
+		CustomerID:     order.CustomerID,
+		Amount:         amount,
+		PaymentMethod:  paymentMethod,
+		IdempotencyKey: authorizeKey(order),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to authorize payment of order %s: %v", order.ID, err)
+	}
+	order.Payment = &payments.Payment{Provider: provider.Name(), Amount: amount, Refunded: money.New(0, currency), Currency: currency}
+	order.Payment.Apply(result)
+	return nil
+}
+
+// capture collects an authorized payment of a pending order
+func (p *Payments) capture(ctx context.Context, order *Order) error {
+	if order.Payment == nil || order.Payment.Status != payments.StatusAuthorized || order.Status != StatusPending {
+		return nil
+	}
+	result, err := p.providerOf(order.Payment).Capture(ctx, order.Payment.ID, order.Payment.Amount, captureKey(order))
+	if err != nil {
+		return fmt.Errorf("failed to capture payment of order %s: %v", order.ID, err)
+	}
+	order.Payment.Apply(result)
+	return nil
+}
+
+// settlePayment stores order with the status following from its payment: paid once
+// captured, or without a card payment as its tenders pay it in full, cancelled
+// when declined. A held order stays held until it is released.
+func settlePayment(ctx context.Context, repo Repository, order *Order) (*Order, error) {
+	eventType := EventOrderUpdated
+	var declined error
+	if order.Payment != nil && order.Payment.Status == payments.StatusCaptured {
+		order.recordCardCharge()
+	}
+	if order.Status == StatusPending || order.Status == StatusHeld {
+		switch {
+		case order.Payment == nil || order.Payment.Status == payments.StatusCaptured:
+			if order.Status == StatusPending {
+				order.Status = StatusPaid
+			}
+		case order.Payment.Status == payments.StatusFailed:
+			eventType = EventOrderCancelled
+			declined = declinePayment(ctx, order)
+		}
+	}
+	order.UpdatedAt = time.Now().UTC()
+	if err := repo.UpdateOrder(WithEventType(ctx, eventType), order); err != nil {
+		return nil, err
+	}
+	if order.Payment != nil {
+		LoggerFromContext(ctx).Infof("payment %s of order %s is %s", order.Payment.ID, order.ID, order.Payment.Status)
+	}
+	return order, declined
+}
+
+// declinePayment cancels order as its payment failed, releasing its stock and
+// reversing its tenders, and returns the ErrPaymentDeclined the order is created
+// or stored with. Tenders that fail to reverse leave the refund failed, for
+// the cancellation to retry.
+func declinePayment(ctx context.Context, order *Order) error {
+	paymentFailures.Inc()
+	order.Status = StatusCancelled
+	order.Cancellation = &Cancellation{
+		Reason:      CancelPaymentFailed,
+		Note:        order.Payment.FailureReason,
+		CancelledAt: time.Now().UTC(),
+		Refund:      RefundNone,
+	}
+	releaseStock(ctx, order)
+	if pay := PaymentsFromContext(ctx); pay != nil && len(order.Tenders) > 0 {
+		if err := pay.reverseOrderTenders(ctx, order); err != nil {
+			LoggerFromContext(ctx).Errorf("failed to reverse the tenders of declined order %s: %v", order.ID, err)
+			order.Cancellation.Refund = RefundFailed
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrPaymentDeclined, order.Payment.FailureReason)
+}
+
+// Refund returns amount of order to the tenders it was paid with: to the card
+// first, refunding its captured payment or voiding it while it is only
+// authorized, then to its gift cards and store credit, the last one first. A
+// refund retried with idempotencyKey returns only what it did not before. It
+// updates order.Payment and the tenders and ledger of order, which the caller
+// stores.
+func (p *Payments) Refund(ctx context.Context, order *Order, amount money.Money, idempotencyKey string) error {
+	amount = amount.Sub(order.refundedWith(idempotencyKey))
+	if amount.IsZero() || amount.IsNegative() {
+		return nil
+	}
+	if payment := order.Payment; payment != nil {
+		var result *payments.Result
+		var err error
+		kind := LedgerRefund
+		card := payment.Amount.Sub(payment.Refunded)
+		switch payment.Status {
+		case payments.StatusAuthorized, payments.StatusPending:
+			kind = LedgerReversal
+			result, err = p.providerOf(payment).Void(ctx, payment.ID, idempotencyKey)
+		case payments.StatusCaptured:
+			if card.Cmp(amount) > 0 {
+				card = amount
+			}
+			if !card.IsZero() {
+				result, err = p.providerOf(payment).Refund(ctx, payment.ID, card, idempotencyKey)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if result != nil {
+			if result.Status == payments.StatusFailed {
+				return fmt.Errorf("payment provider refused the refund: %s", result.FailureReason)
+			}
+			payment.Apply(result)
+			order.addLedgerEntry(LedgerEntry{Kind: kind, Tender: paymentTender(payment), Amount: card, Reference: payment.ID, Key: idempotencyKey})
+			if card.Cmp(amount) > 0 {
+				card = amount
+			}
+			amount = amount.Sub(card)
+		}
+	}
+	_, err := p.refundTenders(ctx, order, amount, idempotencyKey)
+	return err
+}
+
+// needsRefund reports whether cancelling order has to refund or void its payment,
+// or return what it took off its gift cards and store credit
+func needsRefund(order *Order) bool {
+	if order.Status == StatusPaid || order.tendersRefundable() {
+		return true
+	}
+	return order.Payment != nil &&
+		(order.Payment.Status == payments.StatusAuthorized || order.Payment.Status == payments.StatusPending)
+}
+
+// reconcilePayment applies a payment result reported by the provider webhook to its
+// order, capturing payments authorized asynchronously
+func (p *Payments) reconcilePayment(ctx context.Context, repo Repository, result *payments.Result) error {
+	order, err := repo.GetOrder(ctx, result.OrderID)
+	if errors.Is(err, ErrOrderNotFound) {
+		LoggerFromContext(ctx).Warnf("ignoring payment %s of unknown order %q", result.PaymentID, result.OrderID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if order.Payment == nil || order.Payment.ID != result.PaymentID {
+		LoggerFromContext(ctx).Warnf("ignoring payment %s, it is not the payment of order %s", result.PaymentID, order.ID)
+		return nil
+	}
+
+	status := order.Payment.Status
+	order.Payment.Apply(result)
+	if err := p.capture(ctx, order); err != nil {
+		return err
+	}
+	if order.Payment.Status == status {
+		return nil
+	}
+	_, err = settlePayment(ctx, repo, order)
+	if errors.Is(err, ErrPaymentDeclined) {
+		return nil
+	}
+	return err
+}
+
+// PaymentWebhook receives the asynchronous payment results of the provider. An
+// error response makes the provider deliver the notification again.
+func PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	p := PaymentsFromContext(ctx)
+	if p == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	result, err := p.Provider.ParseWebhook(r.Header, body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if result != nil {
+		if err := p.reconcilePayment(ctx, RepositoryFromContext(ctx), result); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
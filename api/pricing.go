@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/pricing"
+)
+
+// defaultPricing prices orders without shipping, discounts and taxes
+var defaultPricing = pricing.NewEngine(&config.PricingConfig{})
+
+type pricingKey struct{}
+
+// WithPricing returns a copy of ctx carrying engine
+func WithPricing(ctx context.Context, engine *pricing.Engine) context.Context {
+	return context.WithValue(ctx, pricingKey{}, engine)
+}
+
+// PricingFromContext returns the pricing engine stored in ctx, falling back to
+// pricing orders by their line items only
+func PricingFromContext(ctx context.Context) *pricing.Engine {
+	if engine, ok := ctx.Value(pricingKey{}).(*pricing.Engine); ok && engine != nil {
+		return engine
+	}
+	return defaultPricing
+}
+
+// quoteRequest is the body of Quote
+type quoteRequest struct {
+	// Currency of the prices of Items, that of the tenant when empty
+	Currency        string     `json:"currency,omitempty"`
+	Items           []LineItem `json:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty"`
+	DiscountCodes   []string   `json:"discountCodes,omitempty"`
+}
+
+// quote prices items, whose prices are in currency, shipped to address with
+// the pricing engine of ctx
+func quote(ctx context.Context, currency string, items []LineItem, address *Address, discountCodes []string) (*pricing.Breakdown, error) {
+	req := &pricing.Request{Currency: currency, DiscountCodes: discountCodes}
+	for i, item := range items {
+		price, err := item.UnitPrice.In(currency)
+		if err != nil {
+			return nil, &ValidationError{Field: fmt.Sprintf("items[%d].unitPrice", i), Reason: err.Error()}
+		}
+		req.Lines = append(req.Lines, pricing.Line{SKU: item.SKU, Quantity: item.Quantity, UnitPrice: price})
+	}
+	if address != nil {
+		req.Address = &pricing.Address{Country: address.Country, State: address.State, PostalCode: address.PostalCode}
+	}
+
+	breakdown, err := PricingFromContext(ctx).Quote(ctx, req)
+	if errors.Is(err, pricing.ErrUnknownDiscount) || errors.Is(err, pricing.ErrDiscountNotApplicable) {
+		return nil, &ValidationError{Field: "discountCodes", Reason: err.Error()}
+	}
+	return breakdown, err
+}
+
+// priceOrder sets the price breakdown and total of order
+func priceOrder(ctx context.Context, order *Order, discountCodes []string) error {
+	breakdown, err := quote(ctx, order.Currency, order.Items, order.ShippingAddress, discountCodes)
+	if err != nil {
+		return err
+	}
+	order.Pricing = breakdown
+	order.Total = breakdown.Total
+	return nil
+}
+
+// Quote returns the price breakdown of the line items, shipping address and
+// discount codes of the body without creating an order
+func Quote(w http.ResponseWriter, r *http.Request) {
+	var req quoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := validateItems(req.Items); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	currency, err := orderCurrency(r.Context(), req.Currency)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	breakdown, err := quote(r.Context(), currency, req.Items, req.ShippingAddress, req.DiscountCodes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, breakdown)
+}
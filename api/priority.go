@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/jobs"
+)
+
+// Priority is how urgently an order is fulfilled
+type Priority string
+
+// the priorities of orders
+const (
+	PriorityStandard  Priority = config.PriorityStandard
+	PriorityExpedited Priority = config.PriorityExpedited
+	PriorityRush      Priority = config.PriorityRush
+)
+
+// RouteJob is the type of the jobs routing an order that could not be routed
+// when it was confirmed, queued at the priority of the order
+const RouteJob jobs.Type = "route"
+
+// ErrPriorityNotUpgradable is returned when the priority of an order can not be
+// raised to the one asked for
+var ErrPriorityNotUpgradable = errors.New("the priority of the order can not be raised")
+
+// rank orders the priorities, standard, an empty priority included, first
+func (p Priority) rank() int {
+	switch p {
+	case PriorityExpedited:
+		return 1
+	case PriorityRush:
+		return 2
+	}
+	return 0
+}
+
+// orStandard returns p, or standard when p is empty as on the orders stored
+// before orders had a priority
+func (p Priority) orStandard() Priority {
+	if p == "" {
+		return PriorityStandard
+	}
+	return p
+}
+
+// parsePriority returns the priority named value, standard when empty
+func parsePriority(value string) (Priority, error) {
+	if value == "" {
+		return PriorityStandard, nil
+	}
+	if !config.ValidPriority(value) {
+		return "", &ValidationError{Field: "priority", Reason: fmt.Sprintf("must be one of %s", strings.Join(config.Priorities, ", "))}
+	}
+	return Priority(value), nil
+}
+
+// checkRushCountry returns ErrPriorityNotUpgradable when order is rush and ships
+// to a country the configuration of ctx does not ship rush orders to
+func checkRushCountry(ctx context.Context, order *Order) error {
+	countries := ConfigFromContext(ctx).Priority.RushCountries
+	if order.Priority != PriorityRush || len(countries) == 0 {
+		return nil
+	}
+	if order.ShippingAddress != nil {
+		for _, country := range countries {
+			if strings.EqualFold(country, order.ShippingAddress.Country) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: rush orders do not ship to the address of the order", ErrPriorityNotUpgradable)
+}
+
+// upgradePriority raises the priority of order to priority. The priority can
+// only be raised, while the order is not shipped, and within the upgrade window
+// of the configuration of ctx after the order was created.
+func upgradePriority(ctx context.Context, order *Order, priority Priority, now time.Time) error {
+	current := order.Priority.orStandard()
+	if priority.rank() <= current.rank() {
+		return fmt.Errorf("%w: it is %s already", ErrPriorityNotUpgradable, current)
+	}
+	if !order.Cancellable() {
+		return fmt.Errorf("%w: the order is %s", ErrPriorityNotUpgradable, order.Status)
+	}
+	if window := ConfigFromContext(ctx).Priority.UpgradeWindow.Duration; window > 0 && now.After(order.CreatedAt.Add(window)) {
+		return fmt.Errorf("%w: the order was created more than %s ago", ErrPriorityNotUpgradable, window)
+	}
+	previous := order.Priority
+	order.Priority = priority
+	if err := checkRushCountry(ctx, order); err != nil {
+		order.Priority = previous
+		return err
+	}
+	return nil
+}
+
+// routeParams are the parameters of the route jobs
+type routeParams struct {
+	OrderID string `json:"orderId"`
+}
+
+// queueRouting queues a route job at the priority of order when it is left
+// without a routing while orders are routed. The job is lost when it can not
+// be queued, RouteOrder routes the order then.
+func queueRouting(ctx context.Context, order *Order) {
+	pool := JobsFromContext(ctx)
+	if pool == nil || RouterFromContext(ctx) == nil || order.Routing != nil {
+		return
+	}
+	if order.Status != StatusPending && order.Status != StatusPaid {
+		return
+	}
+	if _, err := pool.EnqueuePriority(ctx, RouteJob, order.Priority.rank(), &routeParams{OrderID: order.ID}); err != nil {
+		LoggerFromContext(ctx).Warnf("failed to queue the routing of order %s: %v", order.ID, err)
+	}
+}
+
+// NewRouteJob returns the function of the route jobs, routing an order of repo
+// left without a routing with the router of the context of the job. Orders
+// routed meanwhile, or no longer shippable, are left as they are.
+func NewRouteJob(repo Repository) jobs.Func {
+	return func(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+		var params routeParams
+		if err := job.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		router := RouterFromContext(ctx)
+		if router == nil {
+			return nil, ErrNotSupported
+		}
+		ctx, unlock, err := lockOrder(ctx, params.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+
+		order, err := repo.GetOrder(ctx, params.OrderID)
+		if err != nil {
+			return nil, err
+		}
+		if order.Routing != nil || (order.Status != StatusPending && order.Status != StatusPaid) {
+			report(1, 1)
+			return newFulfillmentResponse(order), nil
+		}
+		strategy, name := router.strategyFor(order)
+		if err := router.route(ctx, repo, order, strategy, name); err != nil {
+			return nil, err
+		}
+		order.UpdatedAt = time.Now().UTC()
+		if err := repo.UpdateOrder(ctx, order); err != nil {
+			return nil, err
+		}
+		report(1, 1)
+		LoggerFromContext(ctx).Infof("routed %s order %s with the %s strategy", order.Priority.orStandard(), order.ID, name)
+		return newFulfillmentResponse(order), nil
+	}
+}
+
+// upgradePriorityRequest is the body of UpgradePriority
+type upgradePriorityRequest struct {
+	Priority string `json:"priority"`
+}
+
+// UpgradePriority raises the priority of the order named in the path to the
+// one of the body and routes it again with the strategy of its new priority,
+// honouring If-Match and If-Unmodified-Since
+func UpgradePriority(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req upgradePriorityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.Priority == "" {
+		writeError(w, r, &ValidationError{Field: "priority", Reason: "is required"})
+		return
+	}
+	priority, err := parsePriority(req.Priority)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["orderId"]
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := checkPreconditions(r, order); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	previous := order.Priority.orStandard()
+	now := time.Now().UTC()
+	if err := upgradePriority(ctx, order, priority, now); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if order.Status != StatusHeld {
+		routeConfirmed(ctx, repo, order)
+	}
+	order.UpdatedAt = now
+	if err := repo.UpdateOrder(withPreconditions(ctx, r), order); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	queueRouting(ctx, order)
+	priorityUpgrades.WithLabelValues(string(priority)).Inc()
+	LoggerFromContext(ctx).Infof("raised the priority of order %s from %s to %s", order.ID, previous, priority)
+	writeJSON(w, r, http.StatusOK, order)
+}
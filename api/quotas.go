@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+const (
+	// MiddlewareQuota is the factory name of the request quota middleware
+	MiddlewareQuota = "quota"
+	// APIKeyHeader carries the api key of a consumer
+	APIKeyHeader = "X-Api-Key"
+
+	rateLimitLimitHeader     = "X-RateLimit-Limit"
+	rateLimitRemainingHeader = "X-RateLimit-Remaining"
+	rateLimitResetHeader     = "X-RateLimit-Reset"
+)
+
+// quotaRetention is the time the counts of a period are kept after it ends
+const quotaRetention = 90 * 24 * time.Hour
+
+// QuotaStore is implemented by repositories keeping the request counts of the
+// quotas, which they do once EnableQuotas is called.
+type QuotaStore interface {
+	// AddUsage counts a request of consumer in period and returns the count of
+	// the period, the count may be deleted after expiresAt
+	AddUsage(ctx context.Context, consumer, period string, expiresAt time.Time) (int64, error)
+	// GetUsage returns the count of consumer in period, 0 when there is none
+	GetUsage(ctx context.Context, consumer, period string) (int64, error)
+}
+
+// quotasEnabler is implemented by repositories able to keep request counts
+type quotasEnabler interface {
+	enableQuotas(table string)
+}
+
+// EnableQuotas makes repo keep the request counts of the quotas, in table for
+// the backends that keep them in a separate table
+func EnableQuotas(repo Repository, table string) error {
+	enabler, ok := repo.(quotasEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support quotas", repo)
+	}
+	enabler.enableQuotas(table)
+	return nil
+}
+
+// findQuotaStore returns the quota store of repo or of the repository it decorates
+func findQuotaStore(repo Repository) (QuotaStore, bool) {
+	var store QuotaStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(QuotaStore)
+		return ok
+	})
+	return store, found
+}
+
+// quotaPeriod is a utc day or month whose requests are counted together
+type quotaPeriod struct {
+	// Name is daily or monthly
+	Name string
+	// Key names the count of the period in the store
+	Key   string
+	Start time.Time
+	Reset time.Time
+	Limit int64
+}
+
+// quotaPeriods returns the day and the month of now with their limits
+func quotaPeriods(now time.Time, limits config.QuotaLimits) []quotaPeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []quotaPeriod{
+		{Name: "daily", Key: "day#" + day.Format("2006-01-02"), Start: day, Reset: day.AddDate(0, 0, 1), Limit: limits.Daily},
+		{Name: "monthly", Key: "month#" + month.Format("2006-01"), Start: month, Reset: month.AddDate(0, 1, 0), Limit: limits.Monthly},
+	}
+}
+
+// quotaConsumer returns the id the requests of r are counted by: the hash of
+// its api key or its tenant when quotas has quotas of that consumer, otherwise
+// its client ip
+func quotaConsumer(r *http.Request, keyBy string, quotas *config.QuotasConfig) string {
+	var id string
+	switch keyBy {
+	case config.QuotaKeyAPIKey:
+		if key := r.Header.Get(APIKeyHeader); key != "" {
+			// the keys themselves are neither stored nor shown
+			sum := sha256.Sum256([]byte(key))
+			id = "key:" + hex.EncodeToString(sum[:8])
+		}
+	case config.QuotaKeyTenant:
+		// the tenant the injector authenticated by the api key
+		if tenant := TenantFromContext(r.Context()); tenant != "" {
+			id = "tenant:" + tenant
+		}
+	}
+	// the api keys of the quotas are not authenticated, counting any key
+	// would let a client start over with fresh quotas by sending another one
+	if _, ok := quotas.Consumers[id]; ok && id != "" {
+		return id
+	}
+	return "ip:" + clientIP(r)
+}
+
+// usagePath is the route consumers read their usage at, which is not counted
+var usagePath = "/" + v1Prefix + "/usage"
+
+// isQuotaExemptPath reports whether the requests for path are not counted:
+// the admin api, the health check, metrics and the usage of the consumer
+func isQuotaExemptPath(path string) bool {
+	switch path {
+	case usagePath, "/" + v1Prefix + "/healthcheck", "/" + v1Prefix + "/metrics":
+		return true
+	}
+	return isAdminPath(path)
+}
+
+// Quotas counts the requests of every consumer in the day and the month, and
+// refuses with 429 those beyond the quotas of the configuration. Every
+// response tells the limit, remaining requests and reset time of the period
+// closest to its quota in the X-RateLimit headers. Counting fails open: the
+// requests are served while the store fails.
+type Quotas struct {
+	store QuotaStore
+	keyBy string
+}
+
+// NewQuotas returns the middleware counting the requests of the consumers in
+// store, by api key or tenant as set in cfg
+func NewQuotas(store QuotaStore, cfg config.QuotasConfig) *Quotas {
+	return &Quotas{store: store, keyBy: cfg.KeyBy}
+}
+
+func (q *Quotas) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isQuotaExemptPath(r.URL.Path) {
+		next(w, r)
+		return
+	}
+	ctx := r.Context()
+	quotas := &ConfigFromContext(ctx).Quotas
+	consumer := quotaConsumer(r, q.keyBy, quotas)
+	now := time.Now()
+	var closest *quotaPeriod
+	var closestRemaining int64
+	for _, period := range quotaPeriods(now, quotas.Limits(consumer)) {
+		period := period
+		used, err := q.store.AddUsage(ctx, consumer, period.Key, period.Reset.Add(quotaRetention))
+		if err != nil {
+			LoggerFromContext(ctx).Errorf("failed to count the %s usage of %s: %v", period.Name, consumer, err)
+			next(w, r)
+			return
+		}
+		if period.Limit == 0 {
+			continue
+		}
+		remaining := period.Limit - used
+		if closest == nil || remaining < closestRemaining {
+			closest, closestRemaining = &period, remaining
+		}
+	}
+	if closest == nil {
+		next(w, r)
+		return
+	}
+
+	// the request itself is counted, it is beyond the quota below 0
+	exceeded := closestRemaining < 0
+	if exceeded {
+		closestRemaining = 0
+	}
+	w.Header().Set(rateLimitLimitHeader, strconv.FormatInt(closest.Limit, 10))
+	w.Header().Set(rateLimitRemainingHeader, strconv.FormatInt(closestRemaining, 10))
+	w.Header().Set(rateLimitResetHeader, strconv.FormatInt(closest.Reset.Unix(), 10))
+	if !exceeded {
+		next(w, r)
+		return
+	}
+	quotaExceeded.WithLabelValues(closest.Name).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(closest.Reset.Sub(now).Seconds())+1))
+	writeErrorCode(w, r, CodeQuotaExceeded, fmt.Sprintf("%s quota of %d requests exceeded", closest.Name, closest.Limit))
+}
+
+// quotaUsage is the usage of a consumer in a period
+type quotaUsage struct {
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Reset  time.Time `json:"reset"`
+	Used   int64     `json:"used"`
+	// Limit and Remaining are left out without a limit
+	Limit     int64  `json:"limit,omitempty"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+// usageResponse is the usage of the consumer of a request
+type usageResponse struct {
+	Consumer string        `json:"consumer"`
+	Usage    []*quotaUsage `json:"usage"`
+}
+
+// GetUsage returns the requests counted for the consumer of the request in
+// the current day and month, with its quotas
+func GetUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cfg := ConfigFromContext(ctx)
+	store, ok := findQuotaStore(RepositoryFromContext(ctx))
+	if !ok {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+
+	consumer := quotaConsumer(r, cfg.Quotas.KeyBy, &cfg.Quotas)
+	resp := &usageResponse{Consumer: consumer}
+	for _, period := range quotaPeriods(time.Now(), cfg.Quotas.Limits(consumer)) {
+		used, err := store.GetUsage(ctx, consumer, period.Key)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		usage := &quotaUsage{Period: period.Name, Start: period.Start, Reset: period.Reset, Used: used, Limit: period.Limit}
+		if period.Limit > 0 {
+			remaining := period.Limit - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			usage.Remaining = &remaining
+		}
+		resp.Usage = append(resp.Usage, usage)
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/omnom-nom/order/config"
+)
+
+const (
+	// MiddlewareRateLimit is the factory name of the rate limiting middleware
+	MiddlewareRateLimit = "rate-limit"
+
+	rateLimiterIdle = 10 * time.Minute
+)
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter limits the request rate of every client ip with a token bucket
+type RateLimiter struct {
+	mu        sync.Mutex
+	config    config.RateLimitConfig
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+// NewRateLimiter returns a rate limiter configured with cfg
+func NewRateLimiter(cfg config.RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		config:    cfg,
+		clients:   map[string]*clientLimiter{},
+		lastPrune: time.Now(),
+	}
+}
+
+// Configure replaces the limits, existing client buckets are reset
+func (l *RateLimiter) Configure(cfg config.RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = cfg
+	l.clients = map[string]*clientLimiter{}
+}
+
+// Allow reports whether client may issue a request now
+func (l *RateLimiter) Allow(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.config.Enabled {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > rateLimiterIdle {
+		for key, c := range l.clients {
+			if now.Sub(c.lastSeen) > rateLimiterIdle {
+				delete(l.clients, key)
+			}
+		}
+		l.lastPrune = now
+	}
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(l.config.RequestsPerSecond), l.config.Burst)}
+		l.clients[client] = c
+	}
+	c.lastSeen = now
+	return c.limiter.Allow()
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if !l.Allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "1")
+		writeErrorCode(w, r, CodeRateLimited, "rate limit exceeded")
+		return
+	}
+	next(w, r)
+}
+
+// clientIP returns the ip address of the client of r, resolved from the
+// headers of trusted proxies when they are read, its peer otherwise
+func clientIP(r *http.Request) string {
+	if ip := ClientIPFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	return peerIP(r)
+}
+
+// peerIP returns the ip address of the peer of r, the client given by the
+// load balancer with the proxy protocol
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"context"
+
+	"github.com/omnom-nom/order/redact"
+)
+
+type redactorKey struct{}
+
+// WithRedactor returns a copy of ctx carrying the redactor of personal data
+func WithRedactor(ctx context.Context, r *redact.Redactor) context.Context {
+	return context.WithValue(ctx, redactorKey{}, r)
+}
+
+// RedactorFromContext returns the redactor stored in ctx, or nil, which
+// redacts nothing
+func RedactorFromContext(ctx context.Context) *redact.Redactor {
+	r, _ := ctx.Value(redactorKey{}).(*redact.Redactor)
+	return r
+}
+
+// redactEdit redacts the client address and the changed values of the audit
+// record of an edit, a dropped value is recorded as null
+func redactEdit(r *redact.Redactor, edit *OrderEdit) {
+	if r == nil {
+		return
+	}
+	edit.ClientIP, _ = r.String("clientIp", edit.ClientIP)
+	for i, change := range edit.Changes {
+		edit.Changes[i].Before = r.JSON(change.Field, change.Before)
+		edit.Changes[i].After = r.JSON(change.Field, change.After)
+	}
+}
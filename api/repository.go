@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	// DefaultPageSize is the number of orders listed when no limit is given
+	DefaultPageSize = 50
+	// MaxPageSize is the largest limit of a page of orders
+	MaxPageSize = 500
+)
+
+// ListOptions filters and pages ListOrders
+type ListOptions struct {
+	CustomerID string
+	Status     Status
+	Limit      int
+	// PageToken continues a previous listing, as returned by ListOrders
+	PageToken string
+	// Fields are the json fields of the orders the caller uses, the
+	// repositories may leave the others out. All are read when empty.
+	Fields []string
+	// Sort orders the orders listed, the repositories order them by createdAt
+	// from their indexes, else by the keys as far as they can. The listing is
+	// newest first when empty.
+	Sort []SortKey
+}
+
+// Repository stores orders
+type Repository interface {
+	// CreateOrder stores a new order, failing with ErrOrderExists if the id is taken
+	CreateOrder(ctx context.Context, order *Order) error
+	// GetOrder returns the order with id, or ErrOrderNotFound
+	GetOrder(ctx context.Context, id string) (*Order, error)
+	// UpdateOrder replaces an existing order if its stored version equals order.Version,
+	// incrementing order.Version. It fails with ErrOrderNotFound or ErrVersionConflict.
+	UpdateOrder(ctx context.Context, order *Order) error
+	// DeleteOrder removes the order with id, or fails with ErrOrderNotFound
+	DeleteOrder(ctx context.Context, id string) error
+	// ListOrders returns a page of orders and the token of the next page, "" on the last.
+	// Orders filtered by customer or status are listed newest first.
+	ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error)
+}
+
+// BatchRepository is implemented by repositories with native bulk operations.
+// Repositories without it are driven one order at a time.
+type BatchRepository interface {
+	// BatchCreateOrders stores new orders and returns one error, or nil, per order
+	BatchCreateOrders(ctx context.Context, orders []*Order) []error
+	// BatchGetOrders returns the orders found among ids, keyed by id
+	BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error)
+}
+
+// batchCreateOrders creates orders with the bulk operation of repo when it has one
+func batchCreateOrders(ctx context.Context, repo Repository, orders []*Order) []error {
+	if batch, ok := repo.(BatchRepository); ok {
+		return batch.BatchCreateOrders(ctx, orders)
+	}
+	errs := make([]error, len(orders))
+	for i, order := range orders {
+		errs[i] = repo.CreateOrder(ctx, order)
+	}
+	return errs
+}
+
+// batchGetOrders reads orders with the bulk operation of repo when it has one
+func batchGetOrders(ctx context.Context, repo Repository, ids []string) (map[string]*Order, error) {
+	if batch, ok := repo.(BatchRepository); ok {
+		return batch.BatchGetOrders(ctx, ids)
+	}
+	orders := map[string]*Order{}
+	for _, id := range ids {
+		order, err := repo.GetOrder(ctx, id)
+		if errors.Is(err, ErrOrderNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		orders[id] = order
+	}
+	return orders, nil
+}
@@ -0,0 +1,2760 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/jobs"
+)
+
+const createdDayLayout = "2006-01-02"
+
+// dynamoRepository stores orders in the DynamoDB orders table
+type dynamoRepository struct {
+	db    *ApiDb
+	table string
+	// outboxTable receives an event with every write when set
+	outboxTable string
+	// webhooksTable holds webhook subscriptions and their deliveries, keyed by
+	// subscription id and a sort key of "subscription" or "delivery#<time>#<id>"
+	webhooksTable string
+	// returnsTable holds returns, keyed by order id and return id
+	returnsTable string
+	// customersTable holds customers, keyed by customer id
+	customersTable string
+	// draftsTable holds draft orders, keyed by draft id and expiring by ttl
+	draftsTable string
+	// schedulesTable holds schedules, keyed by schedule id and indexed by customer
+	// and by status and next run
+	schedulesTable string
+	// jobsTable holds background jobs, keyed by job id, indexed by state and
+	// expiring by ttl
+	jobsTable string
+	// leasesTable holds leases, keyed by lease name and expiring by ttl
+	leasesTable string
+	// membersTable holds the cluster members, keyed by member id and expiring by ttl
+	membersTable string
+	// hostsTable holds the registered hosts, keyed by host id and expiring by ttl
+	hostsTable string
+	// quotasTable holds the request counts of the quotas, keyed by consumer and
+	// period and expiring by ttl
+	quotasTable string
+	// deadLettersTable holds the dead letters, keyed by letter id
+	deadLettersTable string
+	// sagasTable holds the sagas in flight, keyed by saga id
+	sagasTable string
+	// streamsTable receives the stream event of every order write when set,
+	// keyed by order id and a sort key of "event#..." or "snapshot#..."
+	streamsTable  string
+	snapshotEvery int
+	// statsTable holds the order statistics, the days of a tenant keyed by
+	// "tenant#<tenant>" and day and the entries of the orders by "order#<id>"
+	statsTable string
+	// warehousesTable holds the warehouses, keyed by warehouse id
+	warehousesTable string
+	// latency of the recent order reads, which hedged reads wait for
+	latency latencyWindow
+}
+
+// NewDynamoRepository returns a repository backed by the given orders table
+func NewDynamoRepository(db *ApiDb, table string) Repository {
+	return &dynamoRepository{db: db, table: table}
+}
+
+// pingKey is the id of the order read by Ping, which no order has
+const pingKey = "ping"
+
+// Ping reads an order that does not exist, which takes the time of any read
+func (d *dynamoRepository) Ping(ctx context.Context) error {
+	_, err := d.db.Client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.table),
+		Key:       d.key(pingKey),
+	})
+	return err
+}
+
+// Db returns the dynamodb client of the repository
+func (d *dynamoRepository) Db() *ApiDb {
+	return d.db
+}
+
+func (d *dynamoRepository) marshal(order *Order) (map[string]types.AttributeValue, error) {
+	item, err := attributevalue.MarshalMap(order)
+	if err != nil {
+		return nil, err
+	}
+	// createdDay partitions the created-at index
+	item[AttrCreatedDay] = &types.AttributeValueMemberS{Value: order.CreatedAt.UTC().Format(createdDayLayout)}
+	return item, nil
+}
+
+func (d *dynamoRepository) key(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{AttrOrderID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) CreateOrder(ctx context.Context, order *Order) error {
+	item, err := d.marshal(order)
+	if err != nil {
+		return err
+	}
+
+	stream, err := d.streamItems(ctx, EventOrderCreated, nil, order)
+	if err != nil {
+		return err
+	}
+
+	failed, _, err := d.write(ctx, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(d.table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + AttrOrderID + ")"),
+	}}, func() (*OutboxEvent, error) { return newOutboxEvent(EventOrderCreated, order) }, stream...)
+	if failed {
+		return ErrOrderExists
+	}
+	return err
+}
+
+// write executes the order write op, in one transaction with the outbox event
+// returned by event when the outbox is enabled and with the stream items,
+// retried while it conflicts with another transaction. It reports whether the
+// condition of op failed, with the item as it was stored if there was one.
+func (d *dynamoRepository) write(ctx context.Context, op types.TransactWriteItem, event func() (*OutboxEvent, error), stream ...types.TransactWriteItem) (bool, map[string]types.AttributeValue, error) {
+	if d.outboxTable == "" && len(stream) == 0 {
+		var err error
+		if op.Put != nil {
+			_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+				TableName:                           op.Put.TableName,
+				Item:                                op.Put.Item,
+				ConditionExpression:                 op.Put.ConditionExpression,
+				ExpressionAttributeNames:            op.Put.ExpressionAttributeNames,
+				ExpressionAttributeValues:           op.Put.ExpressionAttributeValues,
+				ReturnValuesOnConditionCheckFailure: op.Put.ReturnValuesOnConditionCheckFailure,
+			})
+		} else {
+			_, err = d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName:                           op.Delete.TableName,
+				Key:                                 op.Delete.Key,
+				ConditionExpression:                 op.Delete.ConditionExpression,
+				ExpressionAttributeNames:            op.Delete.ExpressionAttributeNames,
+				ExpressionAttributeValues:           op.Delete.ExpressionAttributeValues,
+				ReturnValuesOnConditionCheckFailure: op.Delete.ReturnValuesOnConditionCheckFailure,
+			})
+		}
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return true, cfe.Item, nil
+		}
+		return false, nil, err
+	}
+
+	items := []types.TransactWriteItem{op}
+	if d.outboxTable != "" {
+		e, err := event()
+		if err != nil {
+			return false, nil, err
+		}
+		eventItem, err := attributevalue.MarshalMap(e)
+		if err != nil {
+			return false, nil, err
+		}
+		items = append(items, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(d.outboxTable), Item: eventItem}})
+	}
+	items = append(items, stream...)
+
+	err := d.db.Retry.Do(ctx, func(ctx context.Context) error {
+		_, err := d.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		return err
+	})
+	var tce *types.TransactionCanceledException
+	if errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+		aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+		return true, tce.CancellationReasons[0].Item, nil
+	}
+	return false, nil, err
+}
+
+// transactionConflict reports whether a transaction was cancelled as it ran
+// into another transaction on the same item, which it may win when tried again
+func transactionConflict(err error) bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return false
+	}
+	for _, reason := range tce.CancellationReasons {
+		if aws.ToString(reason.Code) == "TransactionConflict" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetOrder reads the order, hedged when ctx asks for it
+func (d *dynamoRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	read := func(ctx context.Context) (*Order, error) {
+		start := time.Now()
+		order, err := d.getOrder(ctx, id)
+		if err == nil || errors.Is(err, ErrOrderNotFound) {
+			d.latency.record(time.Since(start))
+		}
+		return order, err
+	}
+	if cfg := hedgingFromContext(ctx); cfg != nil && lockTokenFromContext(ctx) == 0 {
+		return hedgeOrder(ctx, d.latency.delay(cfg), read)
+	}
+	return read(ctx)
+}
+
+// getOrder reads the order consistently under an order lock, so it sees the
+// change of the previous holder
+func (d *dynamoRepository) getOrder(ctx context.Context, id string) (*Order, error) {
+	return d.readOrder(ctx, id, lockTokenFromContext(ctx) > 0)
+}
+
+// readOrder reads the order, consistently if asked
+func (d *dynamoRepository) readOrder(ctx context.Context, id string, consistent bool) (*Order, error) {
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            d.key(id),
+		ConsistentRead: aws.Bool(consistent),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrOrderNotFound
+	}
+
+	order := &Order{}
+	if err := attributevalue.UnmarshalMap(out.Item, order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads the order with its amounts in its currency
+func (o *Order) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	type order Order
+	if err := attributevalue.Unmarshal(av, (*order)(o)); err != nil {
+		return err
+	}
+	if o.Currency == "" {
+		return nil
+	}
+	return o.SetCurrency(o.Currency)
+}
+
+func (d *dynamoRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	next := *order
+	next.Version++
+	condition := "attribute_exists(#id) AND #v = :v"
+	names := map[string]string{
+		"#id": AttrOrderID,
+		"#v":  AttrVersion,
+	}
+	values := map[string]types.AttributeValue{
+		":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(order.Version, 10)},
+	}
+	token := lockTokenFromContext(ctx)
+	if token > 0 {
+		// fences off the writes made under an older lock of the order
+		next.LockToken = token
+		condition += " AND (attribute_not_exists(#lt) OR #lt <= :lt)"
+		names["#lt"] = attrLockToken
+		values[":lt"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(token, 10)}
+	}
+	since, conditional := unmodifiedSinceFromContext(ctx)
+	if conditional {
+		condition += " AND #u < :u"
+		names["#u"] = attrUpdatedAt
+		values[":u"] = &types.AttributeValueMemberS{Value: unmodifiedSinceBound(since)}
+	}
+	item, err := d.marshal(&next)
+	if err != nil {
+		return err
+	}
+	eventType := eventTypeFromContext(ctx, EventOrderUpdated)
+	var stream []types.TransactWriteItem
+	if d.streamsTable != "" {
+		// the stream event is the change from the order as stored, which the
+		// condition makes sure is still stored when the write succeeds
+		prev, err := d.readOrder(ctx, order.ID, true)
+		if err != nil {
+			return err
+		}
+		if stream, err = d.streamItems(ctx, eventType, prev, &next); err != nil {
+			return err
+		}
+	}
+
+	failed, old, err := d.write(ctx, types.TransactWriteItem{Put: &types.Put{
+		TableName:                           aws.String(d.table),
+		Item:                                item,
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}}, func() (*OutboxEvent, error) {
+		return newOutboxEvent(eventType, &next)
+	}, stream...)
+	if failed {
+		if len(old) == 0 {
+			return ErrOrderNotFound
+		}
+		var stored struct {
+			LockToken int64     `dynamodbav:"lockToken"`
+			UpdatedAt time.Time `dynamodbav:"updatedAt"`
+		}
+		if attributevalue.UnmarshalMap(old, &stored) == nil {
+			if token > 0 && stored.LockToken > token {
+				return ErrLockLost
+			}
+			if conditional && modifiedSince(stored.UpdatedAt, since) {
+				return ErrPreconditionFailed
+			}
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	order.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) DeleteOrder(ctx context.Context, id string) error {
+	// an event sourced order changed since its last version was read is read again
+	return retryConflicts(func() error { return d.deleteOrder(ctx, id) })
+}
+
+func (d *dynamoRepository) deleteOrder(ctx context.Context, id string) error {
+	condition := "attribute_exists(#id)"
+	names := map[string]string{"#id": AttrOrderID}
+	values := map[string]types.AttributeValue{}
+	var stream []types.TransactWriteItem
+	if d.streamsTable != "" {
+		// the delete event follows the last version of the order
+		prev, err := d.readOrder(ctx, id, true)
+		if err != nil {
+			return err
+		}
+		if stream, err = d.streamItems(ctx, eventTypeFromContext(ctx, EventOrderDeleted), prev, nil); err != nil {
+			return err
+		}
+		condition += " AND #v = :v"
+		names["#v"] = AttrVersion
+		values[":v"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(prev.Version, 10)}
+	}
+	since, conditional := unmodifiedSinceFromContext(ctx)
+	if conditional {
+		condition += " AND #u < :u"
+		names["#u"] = attrUpdatedAt
+		values[":u"] = &types.AttributeValueMemberS{Value: unmodifiedSinceBound(since)}
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	failed, old, err := d.write(ctx, types.TransactWriteItem{Delete: &types.Delete{
+		TableName:                           aws.String(d.table),
+		Key:                                 d.key(id),
+		ConditionExpression:                 aws.String(condition),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}}, func() (*OutboxEvent, error) { return newDeleteEvent(ctx, id), nil }, stream...)
+	if failed && len(old) > 0 {
+		var stored struct {
+			UpdatedAt time.Time `dynamodbav:"updatedAt"`
+		}
+		if conditional && attributevalue.UnmarshalMap(old, &stored) == nil && modifiedSince(stored.UpdatedAt, since) {
+			return ErrPreconditionFailed
+		}
+		return ErrVersionConflict
+	}
+	if failed {
+		return ErrOrderNotFound
+	}
+	return err
+}
+
+// PurgeExpiredOrders removes the orders whose expiresAt is before now that the
+// ttl of the table has not deleted yet, DynamoDB takes up to a few days. Like
+// the ttl it records no event, the orders were deleted when they got expiresAt.
+func (d *dynamoRepository) PurgeExpiredOrders(ctx context.Context, now time.Time) (int, error) {
+	expiry := map[string]string{"#expiresAt": AttrExpiresAt}
+	deadline := &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)}
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:                aws.String(d.table),
+		FilterExpression:         aws.String("#expiresAt > :zero AND #expiresAt < :now"),
+		ProjectionExpression:     aws.String("#id"),
+		ExpressionAttributeNames: map[string]string{"#expiresAt": AttrExpiresAt, "#id": AttrOrderID},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+			":now":  deadline,
+		},
+	})
+	purged := 0
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return purged, err
+		}
+		for _, key := range out.Items {
+			// the order may have been restored since the scan read it
+			_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName:                 aws.String(d.table),
+				Key:                       key,
+				ConditionExpression:       aws.String("#expiresAt < :now"),
+				ExpressionAttributeNames:  expiry,
+				ExpressionAttributeValues: map[string]types.AttributeValue{":now": deadline},
+			})
+			var cfe *types.ConditionalCheckFailedException
+			if errors.As(err, &cfe) {
+				continue
+			}
+			if err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (d *dynamoRepository) ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	startKey, err := decodePageToken(opts.PageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var items []map[string]types.AttributeValue
+	var lastKey map[string]types.AttributeValue
+
+	switch {
+	case opts.CustomerID != "" || opts.Status != "":
+		input := &dynamodb.QueryInput{
+			TableName:                 aws.String(d.table),
+			ScanIndexForward:          aws.Bool(false),
+			Limit:                     aws.Int32(int32(limit)),
+			ExclusiveStartKey:         startKey,
+			ExpressionAttributeNames:  map[string]string{},
+			ExpressionAttributeValues: map[string]types.AttributeValue{},
+		}
+		if opts.CustomerID != "" {
+			input.IndexName = aws.String(IndexCustomerID)
+			input.KeyConditionExpression = aws.String("#c = :c")
+			input.ExpressionAttributeNames["#c"] = AttrCustomerID
+			input.ExpressionAttributeValues[":c"] = &types.AttributeValueMemberS{Value: opts.CustomerID}
+			if opts.Status != "" {
+				input.FilterExpression = aws.String("#s = :s")
+			}
+		} else {
+			input.IndexName = aws.String(IndexStatus)
+			input.KeyConditionExpression = aws.String("#s = :s")
+		}
+		if opts.Status != "" {
+			input.ExpressionAttributeNames["#s"] = AttrStatus
+			input.ExpressionAttributeValues[":s"] = &types.AttributeValueMemberS{Value: string(opts.Status)}
+		}
+		input.ProjectionExpression = orderProjection(opts.Fields, input.ExpressionAttributeNames)
+		if desc, ok := createdAtSort(opts.Sort); ok {
+			// createdAt is the sort key of both indexes
+			input.ScanIndexForward = aws.Bool(!desc)
+		}
+
+		out, err := d.db.Query(ctx, input)
+		if err != nil {
+			return nil, "", err
+		}
+		items, lastKey = out.Items, out.LastEvaluatedKey
+	default:
+		input := &dynamodb.ScanInput{
+			TableName:         aws.String(d.table),
+			Limit:             aws.Int32(int32(limit)),
+			ExclusiveStartKey: startKey,
+		}
+		if len(opts.Fields) > 0 {
+			input.ExpressionAttributeNames = map[string]string{}
+			input.ProjectionExpression = orderProjection(opts.Fields, input.ExpressionAttributeNames)
+		}
+		out, err := d.db.Scan(ctx, input)
+		if err != nil {
+			return nil, "", err
+		}
+		items, lastKey = out.Items, out.LastEvaluatedKey
+	}
+
+	orders := make([]*Order, 0, len(items))
+	if err := attributevalue.UnmarshalListOfMaps(items, &orders); err != nil {
+		return nil, "", err
+	}
+
+	next, err := encodePageToken(lastKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return orders, next, nil
+}
+
+// orderProjection returns the ProjectionExpression reading the attributes of
+// the orders needed for their json fields, nil to read them whole when fields
+// is empty, and adds the names of the attributes to names
+func orderProjection(fields []string, names map[string]string) *string {
+	if len(fields) == 0 {
+		return nil
+	}
+	attrs := projectionAttributes(fields)
+	placeholders := make([]string, len(attrs))
+	for i, attr := range attrs {
+		placeholders[i] = "#p" + strconv.Itoa(i)
+		names[placeholders[i]] = attr
+	}
+	return aws.String(strings.Join(placeholders, ", "))
+}
+
+// encodePageToken serializes a LastEvaluatedKey, all key attributes of the
+// orders table and its indexes are strings
+func encodePageToken(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	values := map[string]string{}
+	for name, v := range key {
+		s, ok := v.(*types.AttributeValueMemberS)
+		if !ok {
+			return "", errors.New("unexpected key attribute type of " + name)
+		}
+		values[name] = s.Value
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodePageToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, &ValidationError{Field: "pageToken", Reason: "is malformed"}
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, &ValidationError{Field: "pageToken", Reason: "is malformed"}
+	}
+	key := map[string]types.AttributeValue{}
+	for name, v := range values {
+		key[name] = &types.AttributeValueMemberS{Value: v}
+	}
+	return key, nil
+}
+
+const (
+	// dynamodb limits on the number of items of one batch call
+	batchWriteLimit = 25
+	batchGetLimit   = 100
+
+	batchRetries = 5
+)
+
+// BatchCreateOrders writes orders with BatchWriteItem. Unlike CreateOrder it cannot
+// detect existing ids, which is safe for the server generated ids of new orders.
+// BatchWriteItem is not transactional, so with the outbox or the streams enabled orders are
+// created one by one.
+func (d *dynamoRepository) BatchCreateOrders(ctx context.Context, orders []*Order) []error {
+	errs := make([]error, len(orders))
+	if d.outboxTable != "" || d.streamsTable != "" {
+		for i, order := range orders {
+			errs[i] = d.CreateOrder(ctx, order)
+		}
+		return errs
+	}
+
+	for start := 0; start < len(orders); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(orders) {
+			end = len(orders)
+		}
+
+		byID := map[string]int{}
+		var requests []types.WriteRequest
+		for i := start; i < end; i++ {
+			item, err := d.marshal(orders[i])
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			byID[orders[i].ID] = i
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+		}
+
+		unprocessed, err := d.batchWrite(ctx, d.table, requests)
+		if err != nil {
+			for _, i := range byID {
+				errs[i] = err
+			}
+			continue
+		}
+		for _, request := range unprocessed {
+			if id, ok := request.PutRequest.Item[AttrOrderID].(*types.AttributeValueMemberS); ok {
+				errs[byID[id.Value]] = errors.New("order was not written, dynamodb throttled the batch")
+			}
+		}
+	}
+	return errs
+}
+
+// batchWrite writes requests, retrying unprocessed items with the backoff of
+// the retry policy, and returns those left over
+func (d *dynamoRepository) batchWrite(ctx context.Context, table string, requests []types.WriteRequest) ([]types.WriteRequest, error) {
+	for attempt := 0; len(requests) > 0 && attempt < batchRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return requests, ctx.Err()
+			case <-time.After(d.db.Retry.Backoff(attempt)):
+			}
+		}
+
+		out, err := d.db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{table: requests},
+		})
+		if err != nil {
+			return nil, err
+		}
+		requests = out.UnprocessedItems[table]
+	}
+	return requests, nil
+}
+
+// BatchGetOrders reads orders with BatchGetItem, retrying unprocessed keys
+func (d *dynamoRepository) BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error) {
+	orders := map[string]*Order{}
+	err := d.batchGet(ctx, d.table, AttrOrderID, ids, func(item map[string]types.AttributeValue) error {
+		order := &Order{}
+		if err := attributevalue.UnmarshalMap(item, order); err != nil {
+			return err
+		}
+		orders[order.ID] = order
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+// batchGet reads the items of table whose key attribute is one of ids with
+// BatchGetItem, and passes each to read
+func (d *dynamoRepository) batchGet(ctx context.Context, table, attr string, ids []string, read func(map[string]types.AttributeValue) error) error {
+	seen := map[string]bool{}
+	var keys []map[string]types.AttributeValue
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, map[string]types.AttributeValue{attr: &types.AttributeValueMemberS{Value: id}})
+		}
+	}
+
+	for start := 0; start < len(keys); start += batchGetLimit {
+		end := start + batchGetLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pending := keys[start:end]
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == batchRetries {
+				return errors.New("dynamodb throttled the batch read")
+			}
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(d.db.Retry.Backoff(attempt)):
+				}
+			}
+
+			out, err := d.db.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{table: {Keys: pending}},
+			})
+			if err != nil {
+				return err
+			}
+			for _, item := range out.Responses[table] {
+				if err := read(item); err != nil {
+					return err
+				}
+			}
+			pending = out.UnprocessedKeys[table].Keys
+		}
+	}
+	return nil
+}
+
+// SearchOrders queries the customer or status index when the search names one,
+// with the creation time in the key condition and the other terms as filters
+func (d *dynamoRepository) SearchOrders(ctx context.Context, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error) {
+	startKey, err := decodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	var keyConds, filters []string
+	n := 0
+	placeholder := func(v types.AttributeValue) string {
+		n++
+		name := ":v" + strconv.Itoa(n)
+		values[name] = v
+		return name
+	}
+	str := func(s string) types.AttributeValue { return &types.AttributeValueMemberS{Value: s} }
+
+	index := ""
+	switch {
+	case query.CustomerID != "":
+		index = IndexCustomerID
+		names["#c"] = AttrCustomerID
+		keyConds = append(keyConds, "#c = "+placeholder(str(query.CustomerID)))
+		if query.Status != "" {
+			names["#s"] = AttrStatus
+			filters = append(filters, "#s = "+placeholder(str(string(query.Status))))
+		}
+	case query.Status != "":
+		index = IndexStatus
+		names["#s"] = AttrStatus
+		keyConds = append(keyConds, "#s = "+placeholder(str(string(query.Status))))
+	}
+
+	// createdAt is the sort key of both indexes, a key condition takes at most one range
+	for i, c := range query.Created {
+		names["#t"] = AttrCreatedAt
+		cond := "#t " + c.Op + " " + placeholder(str(c.Value))
+		if index != "" && i == 0 {
+			keyConds = append(keyConds, cond)
+		} else {
+			filters = append(filters, cond)
+		}
+	}
+	for _, c := range query.Total {
+		names["#total"] = "total"
+		filters = append(filters, "#total "+c.Op+" "+placeholder(&types.AttributeValueMemberN{Value: c.Value}))
+	}
+
+	var filter *string
+	if len(filters) > 0 {
+		filter = aws.String(strings.Join(filters, " AND "))
+	}
+	projection := orderProjection(query.Fields, names)
+	forward := false
+	if desc, ok := createdAtSort(query.Sort); ok {
+		forward = !desc
+	}
+	if len(names) == 0 {
+		names = nil
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	var found []*Order
+	for page := 0; page < maxSearchPages; page++ {
+		// as in searchOrders, a page reads no more items than are missing
+		remaining := aws.Int32(int32(limit - len(found)))
+		var items []map[string]types.AttributeValue
+		if index != "" {
+			out, err := d.db.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(d.table),
+				IndexName:                 aws.String(index),
+				KeyConditionExpression:    aws.String(strings.Join(keyConds, " AND ")),
+				FilterExpression:          filter,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				ProjectionExpression:      projection,
+				ScanIndexForward:          aws.Bool(forward),
+				Limit:                     remaining,
+				ExclusiveStartKey:         startKey,
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			items, startKey = out.Items, out.LastEvaluatedKey
+		} else {
+			out, err := d.db.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(d.table),
+				FilterExpression:          filter,
+				ProjectionExpression:      projection,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				Limit:                     remaining,
+				ExclusiveStartKey:         startKey,
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			items, startKey = out.Items, out.LastEvaluatedKey
+		}
+
+		var orders []*Order
+		if err := attributevalue.UnmarshalListOfMaps(items, &orders); err != nil {
+			return nil, "", err
+		}
+		found = append(found, orders...)
+		if len(startKey) == 0 || len(found) >= limit {
+			break
+		}
+	}
+
+	next, err := encodePageToken(startKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return found, next, nil
+}
+
+func (d *dynamoRepository) enableOutbox(table string) {
+	d.outboxTable = table
+}
+
+// PendingEvents scans the outbox table, which only holds unpublished events
+func (d *dynamoRepository) PendingEvents(ctx context.Context, limit int) ([]*OutboxEvent, error) {
+	var events []*OutboxEvent
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.outboxTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*OutboxEvent
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		events = append(events, page...)
+	}
+
+	sortEvents(events)
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (d *dynamoRepository) MarkPublished(ctx context.Context, event *OutboxEvent) error {
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.outboxTable),
+		Key:       map[string]types.AttributeValue{attrEventID: &types.AttributeValueMemberS{Value: event.ID}},
+	})
+	return err
+}
+
+func (d *dynamoRepository) enableWebhooks(table string) {
+	d.webhooksTable = table
+}
+
+const subscriptionSortKey = "subscription"
+
+// deliverySortKey orders the deliveries of a subscription by the creation of their
+// event, which stays the same when a republished event replaces its delivery
+func deliverySortKey(delivery *WebhookDelivery) string {
+	return "delivery#" + delivery.Event.CreatedAt.UTC().Format(time.RFC3339Nano) + "#" + delivery.ID
+}
+
+func (d *dynamoRepository) webhookKey(subscriptionID, sortKey string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrSubscriptionID: &types.AttributeValueMemberS{Value: subscriptionID},
+		attrSortKey:        &types.AttributeValueMemberS{Value: sortKey},
+	}
+}
+
+func (d *dynamoRepository) CreateSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	if d.webhooksTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(sub)
+	if err != nil {
+		return err
+	}
+	item[attrSortKey] = &types.AttributeValueMemberS{Value: subscriptionSortKey}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.webhooksTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetSubscription(ctx context.Context, id string) (*WebhookSubscription, error) {
+	if d.webhooksTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.webhooksTable),
+		Key:            d.webhookKey(id, subscriptionSortKey),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrSubscriptionNotFound
+	}
+	sub := &WebhookSubscription{}
+	if err := attributevalue.UnmarshalMap(out.Item, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (d *dynamoRepository) ListSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	if d.webhooksTable == "" {
+		return nil, ErrNotSupported
+	}
+	var subs []*WebhookSubscription
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:                 aws.String(d.webhooksTable),
+		FilterExpression:          aws.String("#sk = :sk"),
+		ExpressionAttributeNames:  map[string]string{"#sk": attrSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":sk": &types.AttributeValueMemberS{Value: subscriptionSortKey}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*WebhookSubscription
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		subs = append(subs, page...)
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs, nil
+}
+
+func (d *dynamoRepository) DeleteSubscription(ctx context.Context, id string) error {
+	if d.webhooksTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.webhooksTable),
+		Key:                 d.webhookKey(id, subscriptionSortKey),
+		ConditionExpression: aws.String("attribute_exists(" + attrSubscriptionID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrSubscriptionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// remove the delivery log, the dispatcher skips deliveries of deleted subscriptions
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.webhooksTable),
+		KeyConditionExpression:    aws.String("#id = :id"),
+		ProjectionExpression:      aws.String("#id, #sk"),
+		ExpressionAttributeNames:  map[string]string{"#id": attrSubscriptionID, "#sk": attrSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: id}},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(out.Items); start += batchWriteLimit {
+			end := start + batchWriteLimit
+			if end > len(out.Items) {
+				end = len(out.Items)
+			}
+			var requests []types.WriteRequest
+			for _, key := range out.Items[start:end] {
+				requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+			}
+			if _, err := d.batchWrite(ctx, d.webhooksTable, requests); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *dynamoRepository) SaveDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	if d.webhooksTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(delivery)
+	if err != nil {
+		return err
+	}
+	item[attrSortKey] = &types.AttributeValueMemberS{Value: deliverySortKey(delivery)}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.webhooksTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoRepository) ListDeliveries(ctx context.Context, subscriptionID string, status DeliveryStatus, limit int) ([]*WebhookDelivery, error) {
+	if d.webhooksTable == "" {
+		return nil, ErrNotSupported
+	}
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(d.webhooksTable),
+		KeyConditionExpression: aws.String("#id = :id AND begins_with(#sk, :prefix)"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrSubscriptionID,
+			"#sk": attrSortKey,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":     &types.AttributeValueMemberS{Value: subscriptionID},
+			":prefix": &types.AttributeValueMemberS{Value: "delivery#"},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+	if status != "" {
+		input.FilterExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames["#status"] = AttrStatus
+		input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: string(status)}
+	}
+
+	var deliveries []*WebhookDelivery
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, input)
+	for paginator.HasMorePages() && len(deliveries) < limit {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*WebhookDelivery
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, page...)
+	}
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+// DueDeliveries scans the pending deliveries, the due time is compared here since
+// the stored timestamps do not sort lexically
+func (d *dynamoRepository) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	if d.webhooksTable == "" {
+		return nil, ErrNotSupported
+	}
+	var due []*WebhookDelivery
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:                 aws.String(d.webhooksTable),
+		FilterExpression:          aws.String("#status = :status"),
+		ExpressionAttributeNames:  map[string]string{"#status": AttrStatus},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":status": &types.AttributeValueMemberS{Value: string(DeliveryPending)}},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*WebhookDelivery
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, delivery := range page {
+			if !delivery.NextAttemptAt.After(now) {
+				due = append(due, delivery)
+			}
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// PurgeDeliveries removes the delivered and dead deliveries last changed before
+// cutoff, those that got no expiresAt and those the ttl of the table has not
+// deleted yet
+func (d *dynamoRepository) PurgeDeliveries(ctx context.Context, cutoff time.Time) (int, error) {
+	if d.webhooksTable == "" {
+		return 0, ErrNotSupported
+	}
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:                aws.String(d.webhooksTable),
+		FilterExpression:         aws.String("begins_with(#sk, :prefix) AND #status <> :pending"),
+		ExpressionAttributeNames: map[string]string{"#sk": attrSortKey, "#status": AttrStatus},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":prefix":  &types.AttributeValueMemberS{Value: "delivery#"},
+			":pending": &types.AttributeValueMemberS{Value: string(DeliveryPending)},
+		},
+	})
+	purged := 0
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return purged, err
+		}
+		var page []*WebhookDelivery
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return purged, err
+		}
+		// the update time is compared here since the stored timestamps do not sort lexically
+		var requests []types.WriteRequest
+		for _, delivery := range page {
+			if delivery.UpdatedAt.Before(cutoff) {
+				key := d.webhookKey(delivery.SubscriptionID, deliverySortKey(delivery))
+				requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+			}
+		}
+		for start := 0; start < len(requests); start += batchWriteLimit {
+			end := start + batchWriteLimit
+			if end > len(requests) {
+				end = len(requests)
+			}
+			unprocessed, err := d.batchWrite(ctx, d.webhooksTable, requests[start:end])
+			purged += end - start - len(unprocessed)
+			if err != nil {
+				return purged, err
+			}
+		}
+	}
+	return purged, nil
+}
+
+func (d *dynamoRepository) enableReturns(table string) {
+	d.returnsTable = table
+}
+
+func (d *dynamoRepository) returnKey(orderID, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		AttrOrderID:  &types.AttributeValueMemberS{Value: orderID},
+		attrReturnID: &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+func (d *dynamoRepository) CreateReturn(ctx context.Context, ret *Return) error {
+	if d.returnsTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(ret)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = d.write(ctx, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(d.returnsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrReturnID + ")"),
+	}}, func() (*OutboxEvent, error) { return newReturnEvent(ctx, events.ReturnRequested, ret) })
+	return err
+}
+
+func (d *dynamoRepository) GetReturn(ctx context.Context, orderID, id string) (*Return, error) {
+	if d.returnsTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.returnsTable),
+		Key:            d.returnKey(orderID, id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrReturnNotFound
+	}
+	ret := &Return{}
+	if err := attributevalue.UnmarshalMap(out.Item, ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (d *dynamoRepository) ListReturns(ctx context.Context, orderID string) ([]*Return, error) {
+	if d.returnsTable == "" {
+		return nil, ErrNotSupported
+	}
+	var returns []*Return
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.returnsTable),
+		KeyConditionExpression:    aws.String("#id = :id"),
+		ExpressionAttributeNames:  map[string]string{"#id": AttrOrderID},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: orderID}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Return
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		returns = append(returns, page...)
+	}
+	sort.Slice(returns, func(i, j int) bool { return returns[i].CreatedAt.Before(returns[j].CreatedAt) })
+	return returns, nil
+}
+
+func (d *dynamoRepository) UpdateReturn(ctx context.Context, ret *Return, eventType events.Type) error {
+	if d.returnsTable == "" {
+		return ErrNotSupported
+	}
+	next := *ret
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	failed, old, err := d.write(ctx, types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(d.returnsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrReturnID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(ret.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}}, func() (*OutboxEvent, error) { return newReturnEvent(ctx, eventType, &next) })
+	if failed {
+		if len(old) == 0 {
+			return ErrReturnNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	ret.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) enableCustomers(table string) {
+	d.customersTable = table
+}
+
+func (d *dynamoRepository) CreateCustomer(ctx context.Context, customer *Customer) error {
+	if d.customersTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(customer)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.customersTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + AttrCustomerID + ")"),
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	if d.customersTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.customersTable),
+		Key:            map[string]types.AttributeValue{AttrCustomerID: &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrCustomerNotFound
+	}
+	customer := &Customer{}
+	if err := attributevalue.UnmarshalMap(out.Item, customer); err != nil {
+		return nil, err
+	}
+	return customer, nil
+}
+
+func (d *dynamoRepository) BatchGetCustomers(ctx context.Context, ids []string) (map[string]*Customer, error) {
+	if d.customersTable == "" {
+		return nil, ErrNotSupported
+	}
+	customers := map[string]*Customer{}
+	err := d.batchGet(ctx, d.customersTable, AttrCustomerID, ids, func(item map[string]types.AttributeValue) error {
+		customer := &Customer{}
+		if err := attributevalue.UnmarshalMap(item, customer); err != nil {
+			return err
+		}
+		customers[customer.ID] = customer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return customers, nil
+}
+
+func (d *dynamoRepository) UpdateCustomer(ctx context.Context, customer *Customer) error {
+	if d.customersTable == "" {
+		return ErrNotSupported
+	}
+	next := *customer
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.customersTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": AttrCustomerID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(customer.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return ErrCustomerNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	customer.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) enableDrafts(table string) {
+	d.draftsTable = table
+}
+
+func (d *dynamoRepository) draftKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{attrDraftID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) CreateDraft(ctx context.Context, draft *Draft) error {
+	if d.draftsTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(draft)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.draftsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrDraftID + ")"),
+	})
+	return err
+}
+
+// GetDraft returns the draft with id. DynamoDB deletes expired items up to days
+// after they expire, until then they are not found either.
+func (d *dynamoRepository) GetDraft(ctx context.Context, id string) (*Draft, error) {
+	if d.draftsTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.draftsTable),
+		Key:            d.draftKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrDraftNotFound
+	}
+	draft := &Draft{}
+	if err := attributevalue.UnmarshalMap(out.Item, draft); err != nil {
+		return nil, err
+	}
+	if draft.Expired(time.Now()) {
+		return nil, ErrDraftNotFound
+	}
+	return draft, nil
+}
+
+func (d *dynamoRepository) UpdateDraft(ctx context.Context, draft *Draft) error {
+	if d.draftsTable == "" {
+		return ErrNotSupported
+	}
+	next := *draft
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.draftsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrDraftID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(draft.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return ErrDraftNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	draft.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) DeleteDraft(ctx context.Context, id string) error {
+	if d.draftsTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.draftsTable),
+		Key:                 d.draftKey(id),
+		ConditionExpression: aws.String("attribute_exists(" + attrDraftID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrDraftNotFound
+	}
+	return err
+}
+
+func (d *dynamoRepository) enableSchedules(table string) {
+	d.schedulesTable = table
+}
+
+func (d *dynamoRepository) CreateSchedule(ctx context.Context, s *Schedule) error {
+	if d.schedulesTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(s)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.schedulesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrScheduleID + ")"),
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetSchedule(ctx context.Context, id string) (*Schedule, error) {
+	if d.schedulesTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.schedulesTable),
+		Key:            map[string]types.AttributeValue{attrScheduleID: &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrScheduleNotFound
+	}
+	s := &Schedule{}
+	if err := attributevalue.UnmarshalMap(out.Item, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (d *dynamoRepository) UpdateSchedule(ctx context.Context, s *Schedule) error {
+	if d.schedulesTable == "" {
+		return ErrNotSupported
+	}
+	next := *s
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.schedulesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrScheduleID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(s.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return ErrScheduleNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	s.Version = next.Version
+	return nil
+}
+
+// ListSchedules queries the customer index of the schedules table
+func (d *dynamoRepository) ListSchedules(ctx context.Context, customerID string) ([]*Schedule, error) {
+	if d.schedulesTable == "" {
+		return nil, ErrNotSupported
+	}
+	var schedules []*Schedule
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.schedulesTable),
+		IndexName:                 aws.String(IndexCustomerID),
+		KeyConditionExpression:    aws.String("#c = :c"),
+		ExpressionAttributeNames:  map[string]string{"#c": AttrCustomerID},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":c": &types.AttributeValueMemberS{Value: customerID}},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Schedule
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, page...)
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].CreatedAt.Before(schedules[j].CreatedAt) })
+	return schedules, nil
+}
+
+// DueSchedules queries the next run index for active schedules. Next runs are
+// stored in UTC to the second, so their strings sort like their times.
+func (d *dynamoRepository) DueSchedules(ctx context.Context, now time.Time, limit int) ([]*Schedule, error) {
+	if d.schedulesTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.schedulesTable),
+		IndexName:              aws.String(IndexNextRun),
+		KeyConditionExpression: aws.String("#s = :s AND #n <= :n"),
+		ExpressionAttributeNames: map[string]string{
+			"#s": AttrStatus,
+			"#n": attrNextRunAt,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":s": &types.AttributeValueMemberS{Value: string(ScheduleActive)},
+			":n": &types.AttributeValueMemberS{Value: now.UTC().Truncate(time.Second).Format(time.RFC3339)},
+		},
+		Limit: aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var schedules []*Schedule
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+func (d *dynamoRepository) enableJobs(table string) {
+	d.jobsTable = table
+}
+
+func (d *dynamoRepository) CreateJob(ctx context.Context, job *jobs.Job) error {
+	if d.jobsTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.jobsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrJobID + ")"),
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetJob(ctx context.Context, id string) (*jobs.Job, error) {
+	if d.jobsTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.jobsTable),
+		Key:            map[string]types.AttributeValue{attrJobID: &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, jobs.ErrNotFound
+	}
+	job := &jobs.Job{}
+	if err := attributevalue.UnmarshalMap(out.Item, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (d *dynamoRepository) UpdateJob(ctx context.Context, job *jobs.Job) error {
+	if d.jobsTable == "" {
+		return ErrNotSupported
+	}
+	next := *job
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.jobsTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrJobID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(job.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return jobs.ErrNotFound
+		}
+		return jobs.ErrConflict
+	}
+	if err != nil {
+		return err
+	}
+	job.Version = next.Version
+	return nil
+}
+
+// ListJobs queries the state index of the jobs table, which is sorted by creation
+func (d *dynamoRepository) ListJobs(ctx context.Context, state jobs.State, limit int) ([]*jobs.Job, error) {
+	if d.jobsTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.jobsTable),
+		IndexName:                 aws.String(IndexJobState),
+		KeyConditionExpression:    aws.String("#s = :s"),
+		ExpressionAttributeNames:  map[string]string{"#s": attrJobState},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":s": &types.AttributeValueMemberS{Value: string(state)}},
+		Limit:                     aws.Int32(int32(limit)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []*jobs.Job
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (d *dynamoRepository) enableLeases(table string) {
+	d.leasesTable = table
+}
+
+func (d *dynamoRepository) GetLease(ctx context.Context, name string) (*cluster.Lease, error) {
+	if d.leasesTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.leasesTable),
+		Key:            map[string]types.AttributeValue{attrLeaseName: &types.AttributeValueMemberS{Value: name}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, cluster.ErrLeaseNotFound
+	}
+	lease := &cluster.Lease{}
+	if err := attributevalue.UnmarshalMap(out.Item, lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+func (d *dynamoRepository) CreateLease(ctx context.Context, lease *cluster.Lease) error {
+	if d.leasesTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(lease)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.leasesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrLeaseName + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return cluster.ErrLeaseHeld
+	}
+	return err
+}
+
+func (d *dynamoRepository) UpdateLease(ctx context.Context, lease *cluster.Lease) error {
+	if d.leasesTable == "" {
+		return ErrNotSupported
+	}
+	next := *lease
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.leasesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#n) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#n": attrLeaseName,
+			"#v": AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(lease.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return cluster.ErrLeaseNotFound
+		}
+		return cluster.ErrLeaseHeld
+	}
+	if err != nil {
+		return err
+	}
+	lease.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) enableMembers(table string) {
+	d.membersTable = table
+}
+
+func (d *dynamoRepository) PutMember(ctx context.Context, member *cluster.Member) error {
+	if d.membersTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(member)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.membersTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoRepository) DeleteMember(ctx context.Context, id string) error {
+	if d.membersTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.membersTable),
+		Key:       map[string]types.AttributeValue{attrMemberID: &types.AttributeValueMemberS{Value: id}},
+	})
+	return err
+}
+
+// ListMembers scans the members table, which holds one item per instance
+func (d *dynamoRepository) ListMembers(ctx context.Context) ([]*cluster.Member, error) {
+	if d.membersTable == "" {
+		return nil, ErrNotSupported
+	}
+	var members []*cluster.Member
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.membersTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*cluster.Member
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		members = append(members, page...)
+	}
+	return members, nil
+}
+
+func (d *dynamoRepository) enableHosts(table string) {
+	d.hostsTable = table
+}
+
+func (d *dynamoRepository) hostKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{attrHostID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) PutHost(ctx context.Context, host *Host) error {
+	if d.hostsTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(host)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.hostsTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetHost(ctx context.Context, id string) (*Host, error) {
+	if d.hostsTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.hostsTable),
+		Key:            d.hostKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrHostNotFound
+	}
+	host := &Host{}
+	if err := attributevalue.UnmarshalMap(out.Item, host); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+func (d *dynamoRepository) TouchHost(ctx context.Context, id string, seen time.Time) error {
+	if d.hostsTable == "" {
+		return ErrNotSupported
+	}
+	lastSeen, err := attributevalue.Marshal(seen)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(d.hostsTable),
+		Key:                 d.hostKey(id),
+		UpdateExpression:    aws.String("SET #seen = :seen, #exp = :exp"),
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]string{
+			"#id":   attrHostID,
+			"#seen": "lastSeen",
+			"#exp":  "expiresAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":seen": lastSeen,
+			":exp":  &types.AttributeValueMemberN{Value: strconv.FormatInt(hostExpiry(seen), 10)},
+		},
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrHostNotFound
+	}
+	return err
+}
+
+func (d *dynamoRepository) DeleteHost(ctx context.Context, id string) error {
+	if d.hostsTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.hostsTable),
+		Key:                 d.hostKey(id),
+		ConditionExpression: aws.String("attribute_exists(" + attrHostID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrHostNotFound
+	}
+	return err
+}
+
+// ListHosts scans the hosts table, which holds one item per host
+func (d *dynamoRepository) ListHosts(ctx context.Context) ([]*Host, error) {
+	if d.hostsTable == "" {
+		return nil, ErrNotSupported
+	}
+	var hosts []*Host
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.hostsTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Host
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, page...)
+	}
+	return hosts, nil
+}
+
+func (d *dynamoRepository) enableQuotas(table string) {
+	d.quotasTable = table
+}
+
+func (d *dynamoRepository) usageKey(consumer, period string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrConsumer: &types.AttributeValueMemberS{Value: consumer},
+		attrPeriod:   &types.AttributeValueMemberS{Value: period},
+	}
+}
+
+// AddUsage increments the count of the period atomically, so the instances
+// share it
+func (d *dynamoRepository) AddUsage(ctx context.Context, consumer, period string, expiresAt time.Time) (int64, error) {
+	if d.quotasTable == "" {
+		return 0, ErrNotSupported
+	}
+	out, err := d.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(d.quotasTable),
+		Key:                      d.usageKey(consumer, period),
+		UpdateExpression:         aws.String("ADD #count :one SET #exp = if_not_exists(#exp, :exp)"),
+		ExpressionAttributeNames: map[string]string{"#count": "count", "#exp": "expiresAt"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+			":exp": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	var count struct {
+		Count int64 `dynamodbav:"count"`
+	}
+	if err := attributevalue.UnmarshalMap(out.Attributes, &count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+func (d *dynamoRepository) GetUsage(ctx context.Context, consumer, period string) (int64, error) {
+	if d.quotasTable == "" {
+		return 0, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:                aws.String(d.quotasTable),
+		Key:                      d.usageKey(consumer, period),
+		ProjectionExpression:     aws.String("#count"),
+		ExpressionAttributeNames: map[string]string{"#count": "count"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	var count struct {
+		Count int64 `dynamodbav:"count"`
+	}
+	if err := attributevalue.UnmarshalMap(out.Item, &count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+func (d *dynamoRepository) enableDeadLetters(table string) {
+	d.deadLettersTable = table
+}
+
+func (d *dynamoRepository) deadLetterKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{attrLetterID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) SaveDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	if d.deadLettersTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(letter)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.deadLettersTable),
+		Item:      item,
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	if d.deadLettersTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.deadLettersTable),
+		Key:            d.deadLetterKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	letter := &DeadLetter{}
+	if err := attributevalue.UnmarshalMap(out.Item, letter); err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func (d *dynamoRepository) DeleteDeadLetter(ctx context.Context, id string) error {
+	if d.deadLettersTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.deadLettersTable),
+		Key:                 d.deadLetterKey(id),
+		ConditionExpression: aws.String("attribute_exists(" + attrLetterID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrDeadLetterNotFound
+	}
+	return err
+}
+
+// ListDeadLetters scans the dead letters table, which is expected to stay
+// small, and orders the letters by the time they failed
+func (d *dynamoRepository) ListDeadLetters(ctx context.Context, publisher string, limit int) ([]*DeadLetter, error) {
+	if d.deadLettersTable == "" {
+		return nil, ErrNotSupported
+	}
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(d.deadLettersTable),
+		ConsistentRead: aws.Bool(true),
+	}
+	if publisher != "" {
+		input.FilterExpression = aws.String("#p = :p")
+		input.ExpressionAttributeNames = map[string]string{"#p": "publisher"}
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":p": &types.AttributeValueMemberS{Value: publisher},
+		}
+	}
+	var letters []*DeadLetter
+	paginator := dynamodb.NewScanPaginator(d.db.Client, input)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*DeadLetter
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		letters = append(letters, page...)
+	}
+	sortDeadLetters(letters)
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (d *dynamoRepository) enableSagas(table string) {
+	d.sagasTable = table
+}
+
+func (d *dynamoRepository) sagaKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{attrSagaID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) CreateSaga(ctx context.Context, saga *Saga) error {
+	if d.sagasTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(saga)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.sagasTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrSagaID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrSagaExists
+	}
+	return err
+}
+
+func (d *dynamoRepository) GetSaga(ctx context.Context, id string) (*Saga, error) {
+	if d.sagasTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.sagasTable),
+		Key:            d.sagaKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrSagaNotFound
+	}
+	saga := &Saga{}
+	if err := attributevalue.UnmarshalMap(out.Item, saga); err != nil {
+		return nil, err
+	}
+	return saga, nil
+}
+
+func (d *dynamoRepository) UpdateSaga(ctx context.Context, saga *Saga) error {
+	if d.sagasTable == "" {
+		return ErrNotSupported
+	}
+	next := *saga
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.sagasTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrSagaID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(saga.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return ErrSagaNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	saga.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) DeleteSaga(ctx context.Context, id string) error {
+	if d.sagasTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.sagasTable),
+		Key:                 d.sagaKey(id),
+		ConditionExpression: aws.String("attribute_exists(" + attrSagaID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrSagaNotFound
+	}
+	return err
+}
+
+// ListSagas scans the sagas table, which only holds the sagas in flight, and
+// orders the sagas by the time they started
+func (d *dynamoRepository) ListSagas(ctx context.Context, limit int) ([]*Saga, error) {
+	if d.sagasTable == "" {
+		return nil, ErrNotSupported
+	}
+	var sagas []*Saga
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.sagasTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Saga
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		sagas = append(sagas, page...)
+	}
+	sortSagas(sagas)
+	if len(sagas) > limit {
+		sagas = sagas[:limit]
+	}
+	return sagas, nil
+}
+
+func (d *dynamoRepository) enableEventSourcing(table string, snapshotEvery int) {
+	d.streamsTable = table
+	d.snapshotEvery = snapshotEvery
+}
+
+// streamItems returns the puts of the stream event of the write turning prev
+// into next and of the snapshot due with it, none unless streams are enabled
+func (d *dynamoRepository) streamItems(ctx context.Context, eventType events.Type, prev, next *Order) ([]types.TransactWriteItem, error) {
+	if d.streamsTable == "" {
+		return nil, nil
+	}
+	event, err := newStreamEvent(ctx, eventType, prev, next)
+	if err != nil {
+		return nil, err
+	}
+	item, err := attributevalue.MarshalMap(event)
+	if err != nil {
+		return nil, err
+	}
+	items := []types.TransactWriteItem{{Put: &types.Put{TableName: aws.String(d.streamsTable), Item: item}}}
+	snapshot, err := newSnapshot(next, event, d.snapshotEvery)
+	if err != nil || snapshot == nil {
+		return items, err
+	}
+	if item, err = attributevalue.MarshalMap(snapshot); err != nil {
+		return nil, err
+	}
+	return append(items, types.TransactWriteItem{Put: &types.Put{TableName: aws.String(d.streamsTable), Item: item}}), nil
+}
+
+// queryStream returns the paginator of the entries of the stream of the order
+// with id whose keys are between from and to
+func (d *dynamoRepository) queryStream(id, from, to string, forward bool) *dynamodb.QueryPaginator {
+	return dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                aws.String(d.streamsTable),
+		KeyConditionExpression:   aws.String("#id = :id AND #sk BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{"#id": AttrOrderID, "#sk": attrSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":   &types.AttributeValueMemberS{Value: id},
+			":from": &types.AttributeValueMemberS{Value: from},
+			":to":   &types.AttributeValueMemberS{Value: to},
+		},
+		ScanIndexForward: aws.Bool(forward),
+		ConsistentRead:   aws.Bool(true),
+	})
+}
+
+func (d *dynamoRepository) LatestSnapshot(ctx context.Context, id string, until time.Time) (*Snapshot, error) {
+	if d.streamsTable == "" {
+		return nil, ErrNotSupported
+	}
+	// the snapshots are read newest first until one was taken before until
+	paginator := d.queryStream(id, streamSnapshot+"#", streamSnapshot+"#~", false)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Snapshot
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, snapshot := range page {
+			if until.IsZero() || !snapshot.TakenAt.After(until) {
+				return snapshot, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (d *dynamoRepository) ReadEvents(ctx context.Context, id string, after *Snapshot) ([]*StreamEvent, error) {
+	if d.streamsTable == "" {
+		return nil, ErrNotSupported
+	}
+	from := streamEvent + "#"
+	if after != nil {
+		from = after.eventKey()
+	}
+	var events []*StreamEvent
+	paginator := d.queryStream(id, from, streamEvent+"#~", true)
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*StreamEvent
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		for _, event := range page {
+			// the snapshot already holds the event it was taken after
+			if after == nil || event.Key != from {
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+// CompactStream puts the snapshot of the order before deleting the rest of
+// its stream, so a failed compaction leaves the stream replayable
+func (d *dynamoRepository) CompactStream(ctx context.Context, id string) error {
+	if d.streamsTable == "" {
+		return ErrNotSupported
+	}
+	keep := ""
+	order, err := d.readOrder(ctx, id, true)
+	switch {
+	case errors.Is(err, ErrOrderNotFound):
+	case err != nil:
+		return err
+	default:
+		snapshot, err := takeSnapshot(order, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		item, err := attributevalue.MarshalMap(snapshot)
+		if err != nil {
+			return err
+		}
+		if _, err := d.db.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(d.streamsTable), Item: item}); err != nil {
+			return err
+		}
+		keep = snapshot.Key
+	}
+
+	var requests []types.WriteRequest
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                 aws.String(d.streamsTable),
+		KeyConditionExpression:    aws.String("#id = :id"),
+		ProjectionExpression:      aws.String("#id, #sk"),
+		ExpressionAttributeNames:  map[string]string{"#id": AttrOrderID, "#sk": attrSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, key := range out.Items {
+			if sk, ok := key[attrSortKey].(*types.AttributeValueMemberS); ok && sk.Value == keep {
+				continue
+			}
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+	}
+	for start := 0; start < len(requests); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(requests) {
+			end = len(requests)
+		}
+		unprocessed, err := d.batchWrite(ctx, d.streamsTable, requests[start:end])
+		if err != nil {
+			return err
+		}
+		if len(unprocessed) > 0 {
+			return errors.New("stream was not compacted, dynamodb throttled the batch")
+		}
+	}
+	return nil
+}
+
+func (d *dynamoRepository) enableStats(table string) {
+	d.statsTable = table
+}
+
+// statsEntryKey is the key of the stats entry of the order with id
+func (d *dynamoRepository) statsEntryKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrStatsKey: &types.AttributeValueMemberS{Value: "order#" + id},
+		attrSortKey:  &types.AttributeValueMemberS{Value: "entry"},
+	}
+}
+
+// statsDayKey is the key of the statistics of the orders of tenant created on day
+func (d *dynamoRepository) statsDayKey(tenant, day string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		attrStatsKey: &types.AttributeValueMemberS{Value: "tenant#" + tenant},
+		attrSortKey:  &types.AttributeValueMemberS{Value: day},
+	}
+}
+
+// the attributes of the statistics of a day, the number of orders in a status
+// is kept in the attribute of the status prefixed by statsStatusPrefix
+const (
+	attrStatsRevenue     = "revenue"
+	attrStatsFulfilled   = "fulfilled"
+	attrStatsFulfillment = "fulfillmentSeconds"
+	statsStatusPrefix    = "status_"
+)
+
+// CountOrder moves the counts of the order in one transaction with its entry,
+// which is written on the condition it did not change since it was read
+func (d *dynamoRepository) CountOrder(ctx context.Context, id string, order *Order, at time.Time) error {
+	if d.statsTable == "" {
+		return ErrNotSupported
+	}
+	for attempt := 0; attempt < maxStatsAttempts; attempt++ {
+		out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(d.statsTable),
+			Key:            d.statsEntryKey(id),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		var prev *StatsEntry
+		if len(out.Item) > 0 {
+			prev = &StatsEntry{}
+			if err := attributevalue.UnmarshalMap(out.Item, prev); err != nil {
+				return err
+			}
+		}
+		next, ok := nextStatsEntry(prev, order, at)
+		if !ok {
+			return nil
+		}
+
+		names := map[string]string{"#k": attrStatsKey}
+		condition := "attribute_not_exists(#k)"
+		var values map[string]types.AttributeValue
+		if prev != nil {
+			condition = "#v = :v"
+			names = map[string]string{"#v": AttrVersion}
+			values = map[string]types.AttributeValue{
+				":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(prev.Version, 10)},
+			}
+		}
+		var entry types.TransactWriteItem
+		if next == nil {
+			entry.Delete = &types.Delete{
+				TableName:                 aws.String(d.statsTable),
+				Key:                       d.statsEntryKey(id),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			}
+		} else {
+			item, err := attributevalue.MarshalMap(next)
+			if err != nil {
+				return err
+			}
+			for k, v := range d.statsEntryKey(id) {
+				item[k] = v
+			}
+			entry.Put = &types.Put{
+				TableName:                 aws.String(d.statsTable),
+				Item:                      item,
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			}
+		}
+		items := []types.TransactWriteItem{entry}
+		for _, delta := range statsDeltas(prev, next) {
+			items = append(items, types.TransactWriteItem{Update: d.statsDayUpdate(delta)})
+		}
+
+		_, err = d.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+			aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			// another instance counted the order meanwhile
+			continue
+		}
+		if err == nil || !transactionConflict(err) {
+			return err
+		}
+	}
+	return ErrVersionConflict
+}
+
+// statsDayUpdate returns the update adding delta to the statistics of its day
+func (d *dynamoRepository) statsDayUpdate(delta *statsDelta) *types.Update {
+	names := map[string]string{
+		"#revenue":     attrStatsRevenue,
+		"#fulfilled":   attrStatsFulfilled,
+		"#fulfillment": attrStatsFulfillment,
+	}
+	revenue, _ := delta.revenue.MarshalDynamoDBAttributeValue()
+	values := map[string]types.AttributeValue{
+		":revenue":     revenue,
+		":fulfilled":   &types.AttributeValueMemberN{Value: strconv.FormatInt(delta.fulfilled, 10)},
+		":fulfillment": &types.AttributeValueMemberN{Value: strconv.FormatFloat(delta.fulfillment, 'f', -1, 64)},
+	}
+	expression := "ADD #revenue :revenue, #fulfilled :fulfilled, #fulfillment :fulfillment"
+	statuses := make([]string, 0, len(delta.statuses))
+	for status := range delta.statuses {
+		statuses = append(statuses, string(status))
+	}
+	sort.Strings(statuses)
+	for i, status := range statuses {
+		name, value := "#s"+strconv.Itoa(i), ":s"+strconv.Itoa(i)
+		names[name] = statsStatusPrefix + status
+		values[value] = &types.AttributeValueMemberN{Value: strconv.FormatInt(delta.statuses[Status(status)], 10)}
+		expression += ", " + name + " " + value
+	}
+	return &types.Update{
+		TableName:                 aws.String(d.statsTable),
+		Key:                       d.statsDayKey(delta.tenant, delta.day),
+		UpdateExpression:          aws.String(expression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+}
+
+func (d *dynamoRepository) OrderStats(ctx context.Context, tenant, from, to string) ([]*StatsDay, error) {
+	if d.statsTable == "" {
+		return nil, ErrNotSupported
+	}
+	var days []*StatsDay
+	paginator := dynamodb.NewQueryPaginator(d.db.Client, &dynamodb.QueryInput{
+		TableName:                aws.String(d.statsTable),
+		KeyConditionExpression:   aws.String("#k = :k AND #sk BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{"#k": attrStatsKey, "#sk": attrSortKey},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":k":    &types.AttributeValueMemberS{Value: "tenant#" + tenant},
+			":from": &types.AttributeValueMemberS{Value: from},
+			":to":   &types.AttributeValueMemberS{Value: to},
+		},
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			day, err := statsDayFromItem(item)
+			if err != nil {
+				return nil, err
+			}
+			days = append(days, day)
+		}
+	}
+	return days, nil
+}
+
+// statsDayFromItem reads the statistics of a day from its item, whose status
+// attributes are not known in advance
+func statsDayFromItem(item map[string]types.AttributeValue) (*StatsDay, error) {
+	day := &StatsDay{Statuses: map[Status]int64{}}
+	for name, value := range item {
+		if name == attrSortKey {
+			if s, ok := value.(*types.AttributeValueMemberS); ok {
+				day.Day = s.Value
+			}
+			continue
+		}
+		n, ok := value.(*types.AttributeValueMemberN)
+		if !ok {
+			continue
+		}
+		var err error
+		switch {
+		case name == attrStatsRevenue:
+			err = day.Revenue.UnmarshalDynamoDBAttributeValue(n)
+		case name == attrStatsFulfilled:
+			day.Fulfilled, err = strconv.ParseInt(n.Value, 10, 64)
+		case name == attrStatsFulfillment:
+			day.FulfillmentSeconds, err = strconv.ParseFloat(n.Value, 64)
+		case strings.HasPrefix(name, statsStatusPrefix):
+			var count int64
+			if count, err = strconv.ParseInt(n.Value, 10, 64); err == nil && count != 0 {
+				day.Statuses[Status(strings.TrimPrefix(name, statsStatusPrefix))] = count
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s of stats day %s: %v", name, day.Day, err)
+		}
+	}
+	return day, nil
+}
+
+func (d *dynamoRepository) enableWarehouses(table string) {
+	d.warehousesTable = table
+}
+
+func (d *dynamoRepository) warehouseKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{attrWarehouseID: &types.AttributeValueMemberS{Value: id}}
+}
+
+func (d *dynamoRepository) CreateWarehouse(ctx context.Context, warehouse *Warehouse) error {
+	if d.warehousesTable == "" {
+		return ErrNotSupported
+	}
+	item, err := attributevalue.MarshalMap(warehouse)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.warehousesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(" + attrWarehouseID + ")"),
+	})
+	return err
+}
+
+func (d *dynamoRepository) GetWarehouse(ctx context.Context, id string) (*Warehouse, error) {
+	if d.warehousesTable == "" {
+		return nil, ErrNotSupported
+	}
+	out, err := d.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.warehousesTable),
+		Key:            d.warehouseKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, ErrWarehouseNotFound
+	}
+	warehouse := &Warehouse{}
+	if err := attributevalue.UnmarshalMap(out.Item, warehouse); err != nil {
+		return nil, err
+	}
+	return warehouse, nil
+}
+
+func (d *dynamoRepository) UpdateWarehouse(ctx context.Context, warehouse *Warehouse) error {
+	if d.warehousesTable == "" {
+		return ErrNotSupported
+	}
+	next := *warehouse
+	next.Version++
+	item, err := attributevalue.MarshalMap(&next)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.warehousesTable),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_exists(#id) AND #v = :v"),
+		ExpressionAttributeNames: map[string]string{
+			"#id": attrWarehouseID,
+			"#v":  AttrVersion,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v": &types.AttributeValueMemberN{Value: strconv.FormatInt(warehouse.Version, 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		if len(cfe.Item) == 0 {
+			return ErrWarehouseNotFound
+		}
+		return ErrVersionConflict
+	}
+	if err != nil {
+		return err
+	}
+	warehouse.Version = next.Version
+	return nil
+}
+
+func (d *dynamoRepository) DeleteWarehouse(ctx context.Context, id string) error {
+	if d.warehousesTable == "" {
+		return ErrNotSupported
+	}
+	_, err := d.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.warehousesTable),
+		Key:                 d.warehouseKey(id),
+		ConditionExpression: aws.String("attribute_exists(" + attrWarehouseID + ")"),
+	})
+	var cfe *types.ConditionalCheckFailedException
+	if errors.As(err, &cfe) {
+		return ErrWarehouseNotFound
+	}
+	return err
+}
+
+// ListWarehouses scans the warehouses table, which holds one item per warehouse
+func (d *dynamoRepository) ListWarehouses(ctx context.Context) ([]*Warehouse, error) {
+	if d.warehousesTable == "" {
+		return nil, ErrNotSupported
+	}
+	var warehouses []*Warehouse
+	paginator := dynamodb.NewScanPaginator(d.db.Client, &dynamodb.ScanInput{
+		TableName:      aws.String(d.warehousesTable),
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		out, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var page []*Warehouse
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, err
+		}
+		warehouses = append(warehouses, page...)
+	}
+	return warehouses, nil
+}
@@ -0,0 +1,1546 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/jobs"
+)
+
+// memoryRepository keeps orders in a map, it is meant for tests and development
+type memoryRepository struct {
+	mu     sync.RWMutex
+	orders map[string]*Order
+	// events is the outbox, written while outbox is set
+	events []*OutboxEvent
+	outbox bool
+	// subscriptions and deliveries are kept while webhooks is set
+	subscriptions map[string]*WebhookSubscription
+	deliveries    map[string]*WebhookDelivery
+	webhooks      bool
+	// returns are kept while returnsEnabled is set
+	returns        map[string]*Return
+	returnsEnabled bool
+	// customers are kept while customersEnabled is set
+	customers        map[string]*Customer
+	customersEnabled bool
+	// drafts are kept while draftsEnabled is set
+	drafts        map[string]*Draft
+	draftsEnabled bool
+	// schedules are kept while schedulesEnabled is set
+	schedules        map[string]*Schedule
+	schedulesEnabled bool
+	// jobs are kept while jobsEnabled is set
+	jobs        map[string]*jobs.Job
+	jobsEnabled bool
+	// leases are kept while leasesEnabled is set
+	leases        map[string]*cluster.Lease
+	leasesEnabled bool
+	// members are kept while membersEnabled is set
+	members        map[string]*cluster.Member
+	membersEnabled bool
+	// hosts are kept while hostsEnabled is set
+	hosts        map[string]*Host
+	hostsEnabled bool
+	// usage counts the requests of the quotas by consumer and period while
+	// quotasEnabled is set
+	usage         map[string]int64
+	quotasEnabled bool
+	// deadLetters are kept while deadLettersEnabled is set
+	deadLetters        map[string]*DeadLetter
+	deadLettersEnabled bool
+	// sagas are kept while sagasEnabled is set
+	sagas        map[string]*Saga
+	sagasEnabled bool
+	// statsEntries and statsDays, by tenant and day, are kept while
+	// statsEnabled is set
+	statsEntries map[string]*StatsEntry
+	statsDays    map[string]*StatsDay
+	statsEnabled bool
+	// warehouses are kept while warehousesEnabled is set
+	warehouses        map[string]*Warehouse
+	warehousesEnabled bool
+	// streams and snapshots of the orders are kept while snapshotEvery is set
+	streams       map[string][]*StreamEvent
+	snapshots     map[string][]*Snapshot
+	snapshotEvery int
+}
+
+// NewMemoryRepository returns an empty in-memory repository
+func NewMemoryRepository() Repository {
+	return &memoryRepository{
+		orders:        map[string]*Order{},
+		subscriptions: map[string]*WebhookSubscription{},
+		deliveries:    map[string]*WebhookDelivery{},
+		returns:       map[string]*Return{},
+		customers:     map[string]*Customer{},
+		drafts:        map[string]*Draft{},
+		schedules:     map[string]*Schedule{},
+		jobs:          map[string]*jobs.Job{},
+		leases:        map[string]*cluster.Lease{},
+		members:       map[string]*cluster.Member{},
+		hosts:         map[string]*Host{},
+		usage:         map[string]int64{},
+		deadLetters:   map[string]*DeadLetter{},
+		sagas:         map[string]*Saga{},
+		statsEntries:  map[string]*StatsEntry{},
+		statsDays:     map[string]*StatsDay{},
+		warehouses:    map[string]*Warehouse{},
+		streams:       map[string][]*StreamEvent{},
+		snapshots:     map[string][]*Snapshot{},
+	}
+}
+
+func copyOrder(o *Order) *Order {
+	c := *o
+	c.Items = append([]LineItem(nil), o.Items...)
+	if o.ShippingAddress != nil {
+		address := *o.ShippingAddress
+		c.ShippingAddress = &address
+	}
+	if o.Cancellation != nil {
+		cancellation := *o.Cancellation
+		c.Cancellation = &cancellation
+	}
+	if o.Payment != nil {
+		payment := *o.Payment
+		c.Payment = &payment
+	}
+	if o.Terms != nil {
+		terms := *o.Terms
+		c.Terms = &terms
+	}
+	c.Shipments = nil
+	for _, shipment := range o.Shipments {
+		shipment.Events = append([]TrackingEvent(nil), shipment.Events...)
+		c.Shipments = append(c.Shipments, shipment)
+	}
+	if o.Routing != nil {
+		routing := *o.Routing
+		routing.Allocations = append([]Allocation(nil), o.Routing.Allocations...)
+		c.Routing = &routing
+	}
+	c.Confirmations = nil
+	for _, confirmation := range o.Confirmations {
+		confirmation.Items = append([]ConfirmedItem(nil), confirmation.Items...)
+		c.Confirmations = append(c.Confirmations, confirmation)
+	}
+	c.Edits = append([]OrderEdit(nil), o.Edits...)
+	c.Tenders = append([]Tender(nil), o.Tenders...)
+	c.Ledger = append([]LedgerEntry(nil), o.Ledger...)
+	if o.DeletedAt != nil {
+		deletedAt := *o.DeletedAt
+		c.DeletedAt = &deletedAt
+	}
+	if o.ArchivedAt != nil {
+		archivedAt := *o.ArchivedAt
+		c.ArchivedAt = &archivedAt
+	}
+	return &c
+}
+
+func (m *memoryRepository) CreateOrder(ctx context.Context, order *Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[order.ID]; ok {
+		return ErrOrderExists
+	}
+	if err := m.record(EventOrderCreated, order); err != nil {
+		return err
+	}
+	if err := m.appendStream(ctx, EventOrderCreated, nil, order); err != nil {
+		return err
+	}
+	m.orders[order.ID] = copyOrder(order)
+	return nil
+}
+
+// record adds the event of a write of order to the outbox, if enabled
+func (m *memoryRepository) record(eventType events.Type, order *Order) error {
+	if !m.outbox {
+		return nil
+	}
+	event, err := newOutboxEvent(eventType, order)
+	if err != nil {
+		return err
+	}
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	order, ok := m.orders[id]
+	if !ok {
+		return nil, ErrOrderNotFound
+	}
+	return copyOrder(order), nil
+}
+
+func (m *memoryRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[order.ID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	token := lockTokenFromContext(ctx)
+	if token > 0 && stored.LockToken > token {
+		return ErrLockLost
+	}
+	if since, ok := unmodifiedSinceFromContext(ctx); ok && modifiedSince(stored.UpdatedAt, since) {
+		return ErrPreconditionFailed
+	}
+	if stored.Version != order.Version {
+		return ErrVersionConflict
+	}
+	next := copyOrder(order)
+	next.Version++
+	if token > 0 {
+		next.LockToken = token
+	}
+	eventType := eventTypeFromContext(ctx, EventOrderUpdated)
+	if err := m.record(eventType, next); err != nil {
+		return err
+	}
+	if err := m.appendStream(ctx, eventType, stored, next); err != nil {
+		return err
+	}
+	order.Version = next.Version
+	m.orders[order.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) DeleteOrder(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.orders[id]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if since, ok := unmodifiedSinceFromContext(ctx); ok && modifiedSince(stored.UpdatedAt, since) {
+		return ErrPreconditionFailed
+	}
+	if err := m.appendStream(ctx, eventTypeFromContext(ctx, EventOrderDeleted), stored, nil); err != nil {
+		return err
+	}
+	if m.outbox {
+		m.events = append(m.events, newDeleteEvent(ctx, id))
+	}
+	delete(m.orders, id)
+	return nil
+}
+
+// PurgeExpiredOrders removes the orders whose ExpiresAt is before now
+func (m *memoryRepository) PurgeExpiredOrders(ctx context.Context, now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	purged := 0
+	for id, order := range m.orders {
+		if order.ExpiresAt > 0 && order.ExpiresAt < now.Unix() {
+			delete(m.orders, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *memoryRepository) ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matched []*Order
+	for _, order := range m.orders {
+		if opts.CustomerID != "" && order.CustomerID != opts.CustomerID {
+			continue
+		}
+		if opts.Status != "" && order.Status != opts.Status {
+			continue
+		}
+		matched = append(matched, order)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].ID < matched[j].ID
+		}
+		return matched[i].CreatedAt.After(matched[j].CreatedAt)
+	})
+	sortOrders(matched, opts.Sort)
+
+	// the page token of the memory repository is the offset of the next page
+	offset := 0
+	if opts.PageToken != "" {
+		n, err := strconv.Atoi(opts.PageToken)
+		if err != nil || n < 0 {
+			return nil, "", &ValidationError{Field: "pageToken", Reason: "is malformed"}
+		}
+		offset = n
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	if offset > len(matched) {
+		offset = len(matched)
+	}
+	end := offset + limit
+	next := ""
+	if end < len(matched) {
+		next = strconv.Itoa(end)
+	} else {
+		end = len(matched)
+	}
+
+	page := make([]*Order, 0, end-offset)
+	for _, order := range matched[offset:end] {
+		page = append(page, copyOrder(order))
+	}
+	return page, next, nil
+}
+
+func (m *memoryRepository) enableOutbox(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.outbox = true
+}
+
+func (m *memoryRepository) PendingEvents(ctx context.Context, limit int) ([]*OutboxEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	events := append([]*OutboxEvent(nil), m.events...)
+	sortEvents(events)
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (m *memoryRepository) MarkPublished(ctx context.Context, event *OutboxEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.events {
+		if e.ID == event.ID {
+			m.events = append(m.events[:i], m.events[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepository) enableWebhooks(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhooks = true
+}
+
+func copySubscription(s *WebhookSubscription) *WebhookSubscription {
+	c := *s
+	c.EventTypes = append([]string(nil), s.EventTypes...)
+	return &c
+}
+
+func copyDelivery(d *WebhookDelivery) *WebhookDelivery {
+	c := *d
+	return &c
+}
+
+func (m *memoryRepository) CreateSubscription(ctx context.Context, sub *WebhookSubscription) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.webhooks {
+		return ErrNotSupported
+	}
+	m.subscriptions[sub.ID] = copySubscription(sub)
+	return nil
+}
+
+func (m *memoryRepository) GetSubscription(ctx context.Context, id string) (*WebhookSubscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.webhooks {
+		return nil, ErrNotSupported
+	}
+	sub, ok := m.subscriptions[id]
+	if !ok {
+		return nil, ErrSubscriptionNotFound
+	}
+	return copySubscription(sub), nil
+}
+
+func (m *memoryRepository) ListSubscriptions(ctx context.Context) ([]*WebhookSubscription, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.webhooks {
+		return nil, ErrNotSupported
+	}
+	subs := make([]*WebhookSubscription, 0, len(m.subscriptions))
+	for _, sub := range m.subscriptions {
+		subs = append(subs, copySubscription(sub))
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs, nil
+}
+
+func (m *memoryRepository) DeleteSubscription(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.webhooks {
+		return ErrNotSupported
+	}
+	if _, ok := m.subscriptions[id]; !ok {
+		return ErrSubscriptionNotFound
+	}
+	delete(m.subscriptions, id)
+	for deliveryID, d := range m.deliveries {
+		if d.SubscriptionID == id {
+			delete(m.deliveries, deliveryID)
+		}
+	}
+	return nil
+}
+
+func (m *memoryRepository) SaveDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.webhooks {
+		return ErrNotSupported
+	}
+	m.deliveries[delivery.ID] = copyDelivery(delivery)
+	return nil
+}
+
+func (m *memoryRepository) ListDeliveries(ctx context.Context, subscriptionID string, status DeliveryStatus, limit int) ([]*WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.webhooks {
+		return nil, ErrNotSupported
+	}
+	var deliveries []*WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.SubscriptionID == subscriptionID && (status == "" || d.Status == status) {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt) })
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+	return deliveries, nil
+}
+
+func (m *memoryRepository) DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.webhooks {
+		return nil, ErrNotSupported
+	}
+	var due []*WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.Status == DeliveryPending && !d.NextAttemptAt.After(now) {
+			due = append(due, copyDelivery(d))
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt.Before(due[j].NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// PurgeDeliveries removes the delivered and dead deliveries last changed before cutoff
+func (m *memoryRepository) PurgeDeliveries(ctx context.Context, cutoff time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.webhooks {
+		return 0, ErrNotSupported
+	}
+	purged := 0
+	for id, d := range m.deliveries {
+		if d.Status != DeliveryPending && d.UpdatedAt.Before(cutoff) {
+			delete(m.deliveries, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (m *memoryRepository) enableReturns(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.returnsEnabled = true
+}
+
+func copyReturn(r *Return) *Return {
+	c := *r
+	c.Items = append([]ReturnItem(nil), r.Items...)
+	c.Refunds = append([]ReturnRefund(nil), r.Refunds...)
+	if r.Shipment != nil {
+		shipment := *r.Shipment
+		c.Shipment = &shipment
+	}
+	return &c
+}
+
+// recordReturn adds the event of a write of ret to the outbox, if enabled
+func (m *memoryRepository) recordReturn(ctx context.Context, eventType events.Type, ret *Return) error {
+	if !m.outbox {
+		return nil
+	}
+	event, err := newReturnEvent(ctx, eventType, ret)
+	if err != nil {
+		return err
+	}
+	m.events = append(m.events, event)
+	return nil
+}
+
+func (m *memoryRepository) CreateReturn(ctx context.Context, ret *Return) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.returnsEnabled {
+		return ErrNotSupported
+	}
+	if err := m.recordReturn(ctx, events.ReturnRequested, ret); err != nil {
+		return err
+	}
+	m.returns[ret.ID] = copyReturn(ret)
+	return nil
+}
+
+func (m *memoryRepository) GetReturn(ctx context.Context, orderID, id string) (*Return, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.returnsEnabled {
+		return nil, ErrNotSupported
+	}
+	ret, ok := m.returns[id]
+	if !ok || ret.OrderID != orderID {
+		return nil, ErrReturnNotFound
+	}
+	return copyReturn(ret), nil
+}
+
+func (m *memoryRepository) ListReturns(ctx context.Context, orderID string) ([]*Return, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.returnsEnabled {
+		return nil, ErrNotSupported
+	}
+	var returns []*Return
+	for _, ret := range m.returns {
+		if ret.OrderID == orderID {
+			returns = append(returns, copyReturn(ret))
+		}
+	}
+	sort.Slice(returns, func(i, j int) bool { return returns[i].CreatedAt.Before(returns[j].CreatedAt) })
+	return returns, nil
+}
+
+func (m *memoryRepository) UpdateReturn(ctx context.Context, ret *Return, eventType events.Type) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.returnsEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.returns[ret.ID]
+	if !ok || stored.OrderID != ret.OrderID {
+		return ErrReturnNotFound
+	}
+	if stored.Version != ret.Version {
+		return ErrVersionConflict
+	}
+	next := copyReturn(ret)
+	next.Version++
+	if err := m.recordReturn(ctx, eventType, next); err != nil {
+		return err
+	}
+	ret.Version = next.Version
+	m.returns[ret.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) enableCustomers(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.customersEnabled = true
+}
+
+func copyCustomer(c *Customer) *Customer {
+	out := *c
+	out.Addresses = append([]CustomerAddress(nil), c.Addresses...)
+	if c.Notifications != nil {
+		prefs := *c.Notifications
+		prefs.Events = append([]events.Type(nil), c.Notifications.Events...)
+		out.Notifications = &prefs
+	}
+	return &out
+}
+
+func (m *memoryRepository) CreateCustomer(ctx context.Context, customer *Customer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.customersEnabled {
+		return ErrNotSupported
+	}
+	m.customers[customer.ID] = copyCustomer(customer)
+	return nil
+}
+
+func (m *memoryRepository) GetCustomer(ctx context.Context, id string) (*Customer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.customersEnabled {
+		return nil, ErrNotSupported
+	}
+	customer, ok := m.customers[id]
+	if !ok {
+		return nil, ErrCustomerNotFound
+	}
+	return copyCustomer(customer), nil
+}
+
+func (m *memoryRepository) BatchGetCustomers(ctx context.Context, ids []string) (map[string]*Customer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.customersEnabled {
+		return nil, ErrNotSupported
+	}
+	customers := map[string]*Customer{}
+	for _, id := range ids {
+		if customer, ok := m.customers[id]; ok {
+			customers[id] = copyCustomer(customer)
+		}
+	}
+	return customers, nil
+}
+
+func (m *memoryRepository) UpdateCustomer(ctx context.Context, customer *Customer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.customersEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.customers[customer.ID]
+	if !ok {
+		return ErrCustomerNotFound
+	}
+	if stored.Version != customer.Version {
+		return ErrVersionConflict
+	}
+	next := copyCustomer(customer)
+	next.Version++
+	customer.Version = next.Version
+	m.customers[customer.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) enableDrafts(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draftsEnabled = true
+}
+
+func copyDraft(d *Draft) *Draft {
+	out := *d
+	out.Items = append([]LineItem(nil), d.Items...)
+	out.DiscountCodes = append([]string(nil), d.DiscountCodes...)
+	if d.ShippingAddress != nil {
+		address := *d.ShippingAddress
+		out.ShippingAddress = &address
+	}
+	return &out
+}
+
+func (m *memoryRepository) CreateDraft(ctx context.Context, draft *Draft) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.draftsEnabled {
+		return ErrNotSupported
+	}
+	m.drafts[draft.ID] = copyDraft(draft)
+	return nil
+}
+
+// GetDraft returns the draft with id; expired drafts are removed as they are found
+func (m *memoryRepository) GetDraft(ctx context.Context, id string) (*Draft, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.draftsEnabled {
+		return nil, ErrNotSupported
+	}
+	draft, ok := m.drafts[id]
+	if !ok {
+		return nil, ErrDraftNotFound
+	}
+	if draft.Expired(time.Now()) {
+		delete(m.drafts, id)
+		return nil, ErrDraftNotFound
+	}
+	return copyDraft(draft), nil
+}
+
+func (m *memoryRepository) UpdateDraft(ctx context.Context, draft *Draft) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.draftsEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.drafts[draft.ID]
+	if !ok {
+		return ErrDraftNotFound
+	}
+	if stored.Version != draft.Version {
+		return ErrVersionConflict
+	}
+	next := copyDraft(draft)
+	next.Version++
+	draft.Version = next.Version
+	m.drafts[draft.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) DeleteDraft(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.draftsEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.drafts[id]; !ok {
+		return ErrDraftNotFound
+	}
+	delete(m.drafts, id)
+	return nil
+}
+
+func (m *memoryRepository) enableSchedules(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schedulesEnabled = true
+}
+
+func copySchedule(s *Schedule) *Schedule {
+	out := *s
+	out.Items = append([]LineItem(nil), s.Items...)
+	out.DiscountCodes = append([]string(nil), s.DiscountCodes...)
+	if s.ShippingAddress != nil {
+		address := *s.ShippingAddress
+		out.ShippingAddress = &address
+	}
+	if s.LastRun != nil {
+		run := *s.LastRun
+		out.LastRun = &run
+	}
+	return &out
+}
+
+func (m *memoryRepository) CreateSchedule(ctx context.Context, s *Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.schedulesEnabled {
+		return ErrNotSupported
+	}
+	m.schedules[s.ID] = copySchedule(s)
+	return nil
+}
+
+func (m *memoryRepository) GetSchedule(ctx context.Context, id string) (*Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.schedulesEnabled {
+		return nil, ErrNotSupported
+	}
+	s, ok := m.schedules[id]
+	if !ok {
+		return nil, ErrScheduleNotFound
+	}
+	return copySchedule(s), nil
+}
+
+func (m *memoryRepository) UpdateSchedule(ctx context.Context, s *Schedule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.schedulesEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.schedules[s.ID]
+	if !ok {
+		return ErrScheduleNotFound
+	}
+	if stored.Version != s.Version {
+		return ErrVersionConflict
+	}
+	next := copySchedule(s)
+	next.Version++
+	s.Version = next.Version
+	m.schedules[s.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) ListSchedules(ctx context.Context, customerID string) ([]*Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.schedulesEnabled {
+		return nil, ErrNotSupported
+	}
+	var out []*Schedule
+	for _, s := range m.schedules {
+		if s.CustomerID == customerID {
+			out = append(out, copySchedule(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out, nil
+}
+
+func (m *memoryRepository) DueSchedules(ctx context.Context, now time.Time, limit int) ([]*Schedule, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.schedulesEnabled {
+		return nil, ErrNotSupported
+	}
+	var out []*Schedule
+	for _, s := range m.schedules {
+		if s.Status == ScheduleActive && !s.NextRunAt.After(now) {
+			out = append(out, copySchedule(s))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].NextRunAt.Before(out[j].NextRunAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableJobs(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jobsEnabled = true
+}
+
+func (m *memoryRepository) CreateJob(ctx context.Context, job *jobs.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.jobsEnabled {
+		return ErrNotSupported
+	}
+	m.jobs[job.ID] = job.Copy()
+	return nil
+}
+
+func (m *memoryRepository) GetJob(ctx context.Context, id string) (*jobs.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.jobsEnabled {
+		return nil, ErrNotSupported
+	}
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, jobs.ErrNotFound
+	}
+	return job.Copy(), nil
+}
+
+func (m *memoryRepository) UpdateJob(ctx context.Context, job *jobs.Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.jobsEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.jobs[job.ID]
+	if !ok {
+		return jobs.ErrNotFound
+	}
+	if stored.Version != job.Version {
+		return jobs.ErrConflict
+	}
+	next := job.Copy()
+	next.Version++
+	job.Version = next.Version
+	m.jobs[job.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) ListJobs(ctx context.Context, state jobs.State, limit int) ([]*jobs.Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.jobsEnabled {
+		return nil, ErrNotSupported
+	}
+	var out []*jobs.Job
+	for _, job := range m.jobs {
+		if job.State == state {
+			out = append(out, job.Copy())
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableLeases(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.leasesEnabled = true
+}
+
+func (m *memoryRepository) GetLease(ctx context.Context, name string) (*cluster.Lease, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.leasesEnabled {
+		return nil, ErrNotSupported
+	}
+	lease, ok := m.leases[name]
+	if !ok {
+		return nil, cluster.ErrLeaseNotFound
+	}
+	out := *lease
+	return &out, nil
+}
+
+func (m *memoryRepository) CreateLease(ctx context.Context, lease *cluster.Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.leasesEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.leases[lease.Name]; ok {
+		return cluster.ErrLeaseHeld
+	}
+	stored := *lease
+	m.leases[lease.Name] = &stored
+	return nil
+}
+
+func (m *memoryRepository) UpdateLease(ctx context.Context, lease *cluster.Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.leasesEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.leases[lease.Name]
+	if !ok {
+		return cluster.ErrLeaseNotFound
+	}
+	if stored.Version != lease.Version {
+		return cluster.ErrLeaseHeld
+	}
+	next := *lease
+	next.Version++
+	lease.Version = next.Version
+	m.leases[lease.Name] = &next
+	return nil
+}
+
+func (m *memoryRepository) enableMembers(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.membersEnabled = true
+}
+
+func (m *memoryRepository) PutMember(ctx context.Context, member *cluster.Member) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.membersEnabled {
+		return ErrNotSupported
+	}
+	stored := *member
+	m.members[member.ID] = &stored
+	return nil
+}
+
+func (m *memoryRepository) DeleteMember(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.membersEnabled {
+		return ErrNotSupported
+	}
+	delete(m.members, id)
+	return nil
+}
+
+func (m *memoryRepository) ListMembers(ctx context.Context) ([]*cluster.Member, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.membersEnabled {
+		return nil, ErrNotSupported
+	}
+	out := make([]*cluster.Member, 0, len(m.members))
+	for _, member := range m.members {
+		stored := *member
+		out = append(out, &stored)
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableHosts(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hostsEnabled = true
+}
+
+func copyHost(h *Host) *Host {
+	out := *h
+	if h.Labels != nil {
+		out.Labels = make(map[string]string, len(h.Labels))
+		for k, v := range h.Labels {
+			out.Labels[k] = v
+		}
+	}
+	return &out
+}
+
+func (m *memoryRepository) PutHost(ctx context.Context, host *Host) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hostsEnabled {
+		return ErrNotSupported
+	}
+	m.hosts[host.ID] = copyHost(host)
+	return nil
+}
+
+func (m *memoryRepository) GetHost(ctx context.Context, id string) (*Host, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.hostsEnabled {
+		return nil, ErrNotSupported
+	}
+	host, ok := m.hosts[id]
+	if !ok {
+		return nil, ErrHostNotFound
+	}
+	return copyHost(host), nil
+}
+
+func (m *memoryRepository) TouchHost(ctx context.Context, id string, seen time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hostsEnabled {
+		return ErrNotSupported
+	}
+	host, ok := m.hosts[id]
+	if !ok {
+		return ErrHostNotFound
+	}
+	host.LastSeen = seen
+	host.ExpiresAt = hostExpiry(seen)
+	return nil
+}
+
+func (m *memoryRepository) DeleteHost(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.hostsEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.hosts[id]; !ok {
+		return ErrHostNotFound
+	}
+	delete(m.hosts, id)
+	return nil
+}
+
+func (m *memoryRepository) ListHosts(ctx context.Context) ([]*Host, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.hostsEnabled {
+		return nil, ErrNotSupported
+	}
+	out := make([]*Host, 0, len(m.hosts))
+	for _, host := range m.hosts {
+		out = append(out, copyHost(host))
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableQuotas(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quotasEnabled = true
+}
+
+func (m *memoryRepository) AddUsage(ctx context.Context, consumer, period string, expiresAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.quotasEnabled {
+		return 0, ErrNotSupported
+	}
+	m.usage[consumer+"#"+period]++
+	return m.usage[consumer+"#"+period], nil
+}
+
+func (m *memoryRepository) GetUsage(ctx context.Context, consumer, period string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.quotasEnabled {
+		return 0, ErrNotSupported
+	}
+	return m.usage[consumer+"#"+period], nil
+}
+
+func (m *memoryRepository) enableDeadLetters(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadLettersEnabled = true
+}
+
+func copyDeadLetter(l *DeadLetter) *DeadLetter {
+	out := *l
+	if l.Event != nil {
+		event := *l.Event
+		out.Event = &event
+	}
+	return &out
+}
+
+func (m *memoryRepository) SaveDeadLetter(ctx context.Context, letter *DeadLetter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.deadLettersEnabled {
+		return ErrNotSupported
+	}
+	m.deadLetters[letter.ID] = copyDeadLetter(letter)
+	return nil
+}
+
+func (m *memoryRepository) GetDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.deadLettersEnabled {
+		return nil, ErrNotSupported
+	}
+	letter, ok := m.deadLetters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return copyDeadLetter(letter), nil
+}
+
+func (m *memoryRepository) DeleteDeadLetter(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.deadLettersEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.deadLetters[id]; !ok {
+		return ErrDeadLetterNotFound
+	}
+	delete(m.deadLetters, id)
+	return nil
+}
+
+func (m *memoryRepository) ListDeadLetters(ctx context.Context, publisher string, limit int) ([]*DeadLetter, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.deadLettersEnabled {
+		return nil, ErrNotSupported
+	}
+	var out []*DeadLetter
+	for _, letter := range m.deadLetters {
+		if publisher == "" || letter.Publisher == publisher {
+			out = append(out, copyDeadLetter(letter))
+		}
+	}
+	sortDeadLetters(out)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableSagas(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sagasEnabled = true
+}
+
+func copySaga(s *Saga) *Saga {
+	out := *s
+	out.Steps = nil
+	for _, step := range s.Steps {
+		copied := *step
+		out.Steps = append(out.Steps, &copied)
+	}
+	out.Tenders = append([]Tender(nil), s.Tenders...)
+	return &out
+}
+
+func (m *memoryRepository) CreateSaga(ctx context.Context, saga *Saga) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.sagasEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.sagas[saga.ID]; ok {
+		return ErrSagaExists
+	}
+	m.sagas[saga.ID] = copySaga(saga)
+	return nil
+}
+
+func (m *memoryRepository) GetSaga(ctx context.Context, id string) (*Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.sagasEnabled {
+		return nil, ErrNotSupported
+	}
+	saga, ok := m.sagas[id]
+	if !ok {
+		return nil, ErrSagaNotFound
+	}
+	return copySaga(saga), nil
+}
+
+func (m *memoryRepository) UpdateSaga(ctx context.Context, saga *Saga) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.sagasEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.sagas[saga.ID]
+	if !ok {
+		return ErrSagaNotFound
+	}
+	if stored.Version != saga.Version {
+		return ErrVersionConflict
+	}
+	next := copySaga(saga)
+	next.Version++
+	saga.Version = next.Version
+	m.sagas[saga.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) DeleteSaga(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.sagasEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.sagas[id]; !ok {
+		return ErrSagaNotFound
+	}
+	delete(m.sagas, id)
+	return nil
+}
+
+func (m *memoryRepository) ListSagas(ctx context.Context, limit int) ([]*Saga, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.sagasEnabled {
+		return nil, ErrNotSupported
+	}
+	var out []*Saga
+	for _, saga := range m.sagas {
+		out = append(out, copySaga(saga))
+	}
+	sortSagas(out)
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (m *memoryRepository) enableEventSourcing(table string, snapshotEvery int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.snapshotEvery = snapshotEvery
+}
+
+// appendStream appends the event of the write turning prev into next to the
+// stream of the order, if event sourced
+func (m *memoryRepository) appendStream(ctx context.Context, eventType events.Type, prev, next *Order) error {
+	if m.snapshotEvery == 0 {
+		return nil
+	}
+	event, err := newStreamEvent(ctx, eventType, prev, next)
+	if err != nil {
+		return err
+	}
+	snapshot, err := newSnapshot(next, event, m.snapshotEvery)
+	if err != nil {
+		return err
+	}
+	m.streams[event.OrderID] = append(m.streams[event.OrderID], event)
+	if snapshot != nil {
+		m.snapshots[event.OrderID] = append(m.snapshots[event.OrderID], snapshot)
+	}
+	return nil
+}
+
+func (m *memoryRepository) LatestSnapshot(ctx context.Context, id string, until time.Time) (*Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.snapshotEvery == 0 {
+		return nil, ErrNotSupported
+	}
+	var latest *Snapshot
+	for _, snapshot := range m.snapshots[id] {
+		if !until.IsZero() && snapshot.TakenAt.After(until) {
+			continue
+		}
+		if latest == nil || snapshot.Key > latest.Key {
+			latest = snapshot
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	c := *latest
+	return &c, nil
+}
+
+func (m *memoryRepository) ReadEvents(ctx context.Context, id string, after *Snapshot) ([]*StreamEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.snapshotEvery == 0 {
+		return nil, ErrNotSupported
+	}
+	var events []*StreamEvent
+	for _, event := range m.streams[id] {
+		if after != nil && event.Key <= after.eventKey() {
+			continue
+		}
+		c := *event
+		events = append(events, &c)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Key < events[j].Key })
+	return events, nil
+}
+
+func (m *memoryRepository) CompactStream(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.snapshotEvery == 0 {
+		return ErrNotSupported
+	}
+	delete(m.streams, id)
+	delete(m.snapshots, id)
+	order, ok := m.orders[id]
+	if !ok {
+		return nil
+	}
+	snapshot, err := takeSnapshot(order, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	m.snapshots[id] = []*Snapshot{snapshot}
+	return nil
+}
+
+func (m *memoryRepository) enableStats(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.statsEnabled = true
+}
+
+func (m *memoryRepository) CountOrder(ctx context.Context, id string, order *Order, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.statsEnabled {
+		return ErrNotSupported
+	}
+	prev := m.statsEntries[id]
+	next, ok := nextStatsEntry(prev, order, at)
+	if !ok {
+		return nil
+	}
+	for _, delta := range statsDeltas(prev, next) {
+		key := delta.tenant + "#" + delta.day
+		day, ok := m.statsDays[key]
+		if !ok {
+			day = &StatsDay{Day: delta.day, Statuses: map[Status]int64{}}
+			m.statsDays[key] = day
+		}
+		delta.apply(day)
+	}
+	if next == nil {
+		delete(m.statsEntries, id)
+	} else {
+		m.statsEntries[id] = next
+	}
+	return nil
+}
+
+func (m *memoryRepository) OrderStats(ctx context.Context, tenant, from, to string) ([]*StatsDay, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.statsEnabled {
+		return nil, ErrNotSupported
+	}
+	var days []*StatsDay
+	for key, day := range m.statsDays {
+		if key != tenant+"#"+day.Day || day.Day < from || day.Day > to {
+			continue
+		}
+		c := *day
+		c.Statuses = map[Status]int64{}
+		for status, n := range day.Statuses {
+			c.Statuses[status] = n
+		}
+		days = append(days, &c)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	return days, nil
+}
+
+func (m *memoryRepository) enableWarehouses(table string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.warehousesEnabled = true
+}
+
+func copyWarehouse(w *Warehouse) *Warehouse {
+	out := *w
+	out.Stock = make(map[string]int, len(w.Stock))
+	for sku, quantity := range w.Stock {
+		out.Stock[sku] = quantity
+	}
+	return &out
+}
+
+func (m *memoryRepository) CreateWarehouse(ctx context.Context, warehouse *Warehouse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.warehousesEnabled {
+		return ErrNotSupported
+	}
+	m.warehouses[warehouse.ID] = copyWarehouse(warehouse)
+	return nil
+}
+
+func (m *memoryRepository) GetWarehouse(ctx context.Context, id string) (*Warehouse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.warehousesEnabled {
+		return nil, ErrNotSupported
+	}
+	warehouse, ok := m.warehouses[id]
+	if !ok {
+		return nil, ErrWarehouseNotFound
+	}
+	return copyWarehouse(warehouse), nil
+}
+
+func (m *memoryRepository) UpdateWarehouse(ctx context.Context, warehouse *Warehouse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.warehousesEnabled {
+		return ErrNotSupported
+	}
+	stored, ok := m.warehouses[warehouse.ID]
+	if !ok {
+		return ErrWarehouseNotFound
+	}
+	if stored.Version != warehouse.Version {
+		return ErrVersionConflict
+	}
+	next := copyWarehouse(warehouse)
+	next.Version++
+	warehouse.Version = next.Version
+	m.warehouses[warehouse.ID] = next
+	return nil
+}
+
+func (m *memoryRepository) DeleteWarehouse(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.warehousesEnabled {
+		return ErrNotSupported
+	}
+	if _, ok := m.warehouses[id]; !ok {
+		return ErrWarehouseNotFound
+	}
+	delete(m.warehouses, id)
+	return nil
+}
+
+func (m *memoryRepository) ListWarehouses(ctx context.Context) ([]*Warehouse, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if !m.warehousesEnabled {
+		return nil, ErrNotSupported
+	}
+	out := make([]*Warehouse, 0, len(m.warehouses))
+	for _, warehouse := range m.warehouses {
+		out = append(out, copyWarehouse(warehouse))
+	}
+	return out, nil
+}
@@ -0,0 +1,14 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/api/apitest"
+)
+
+func TestMemoryRepositoryConformance(t *testing.T) {
+	apitest.RunConformance(t, func(t testing.TB) api.Repository {
+		return api.NewMemoryRepository()
+	})
+}
@@ -0,0 +1,378 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// database/sql drivers of the postgres and sqlite backends
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect captures the differences between the supported sql databases
+type sqlDialect struct {
+	driver string
+	// numbered placeholders are $1, $2... instead of ?
+	numbered bool
+	// isUniqueViolation reports whether err is a primary key conflict
+	isUniqueViolation func(err error) bool
+}
+
+var (
+	dialectPostgres = sqlDialect{
+		driver:   "postgres",
+		numbered: true,
+		isUniqueViolation: func(err error) bool {
+			return strings.Contains(err.Error(), "duplicate key value")
+		},
+	}
+	dialectSQLite = sqlDialect{
+		driver: "sqlite3",
+		isUniqueViolation: func(err error) bool {
+			return strings.Contains(err.Error(), "UNIQUE constraint failed")
+		},
+	}
+)
+
+// sqlMigrations are applied in order by Migrate, both dialects understand them.
+// New migrations are appended, the applied count is kept in order_schema_version.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS orders (
+		id          VARCHAR(64) PRIMARY KEY,
+		customer_id VARCHAR(128) NOT NULL,
+		status      VARCHAR(32) NOT NULL,
+		created_at  VARCHAR(40) NOT NULL,
+		updated_at  VARCHAR(40) NOT NULL,
+		expires_at  BIGINT NOT NULL DEFAULT 0,
+		data        TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS orders_customer_id ON orders (customer_id, created_at)`,
+	`CREATE INDEX IF NOT EXISTS orders_status ON orders (status, created_at)`,
+	`CREATE INDEX IF NOT EXISTS orders_created_at ON orders (created_at)`,
+	`ALTER TABLE orders ADD COLUMN version BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS orders_expires_at ON orders (expires_at)`,
+	`ALTER TABLE orders ADD COLUMN lock_token BIGINT NOT NULL DEFAULT 0`,
+}
+
+// sqlRepository stores orders as json documents in a sql table, with the
+// columns needed for filtering and paging alongside
+type sqlRepository struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// NewPostgresRepository returns a repository backed by the postgres database at dsn
+func NewPostgresRepository(dsn string) (Repository, error) {
+	return newSQLRepository(dialectPostgres, dsn)
+}
+
+// NewSQLiteRepository returns a repository backed by the sqlite database at dsn
+func NewSQLiteRepository(dsn string) (Repository, error) {
+	return newSQLRepository(dialectSQLite, dsn)
+}
+
+func newSQLRepository(dialect sqlDialect, dsn string) (*sqlRepository, error) {
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if dialect.driver == dialectSQLite.driver {
+		// sqlite allows a single writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	return &sqlRepository{db: db, dialect: dialect}, nil
+}
+
+// Ping checks the connection to the database
+func (s *sqlRepository) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Migrate applies the sql migrations that have not been applied yet
+func (s *sqlRepository) Migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS order_schema_version (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("failed to create schema version table: %v", err)
+	}
+
+	var current int
+	err := s.db.QueryRowContext(ctx, `SELECT version FROM order_schema_version`).Scan(&current)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.ExecContext(ctx, `INSERT INTO order_schema_version (version) VALUES (0)`); err != nil {
+			return fmt.Errorf("failed to initialize schema version: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to read schema version: %v", err)
+	}
+
+	for i := current; i < len(sqlMigrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to apply %s migration %d: %v", s.dialect.driver, i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`UPDATE order_schema_version SET version = ?`), i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record schema version %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (s *sqlRepository) Close() error {
+	return s.db.Close()
+}
+
+// rebind rewrites ? placeholders for dialects using numbered ones
+func (s *sqlRepository) rebind(query string) string {
+	if !s.dialect.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func formatSQLTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (s *sqlRepository) CreateOrder(ctx context.Context, order *Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO orders
+		(id, customer_id, status, created_at, updated_at, expires_at, version, data) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		order.ID, order.CustomerID, string(order.Status), formatSQLTime(order.CreatedAt),
+		formatSQLTime(order.UpdatedAt), order.ExpiresAt, order.Version, string(data))
+	if err != nil && s.dialect.isUniqueViolation(err) {
+		return ErrOrderExists
+	}
+	return err
+}
+
+func (s *sqlRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT data FROM orders WHERE id = ?`), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrOrderNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSQLOrder(data)
+}
+
+func decodeSQLOrder(data string) (*Order, error) {
+	order := &Order{}
+	if err := json.Unmarshal([]byte(data), order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+func (s *sqlRepository) UpdateOrder(ctx context.Context, order *Order) error {
+	next := *order
+	next.Version++
+	data, err := json.Marshal(&next)
+	if err != nil {
+		return err
+	}
+
+	columns := `customer_id = ?, status = ?, created_at = ?, updated_at = ?, expires_at = ?, version = ?, data = ?`
+	args := []interface{}{next.CustomerID, string(next.Status), formatSQLTime(next.CreatedAt),
+		formatSQLTime(next.UpdatedAt), next.ExpiresAt, next.Version, string(data)}
+	token := lockTokenFromContext(ctx)
+	if token > 0 {
+		columns += ", lock_token = ?"
+		args = append(args, token)
+	}
+	query := `UPDATE orders SET ` + columns + ` WHERE id = ? AND version = ?`
+	args = append(args, next.ID, order.Version)
+	if token > 0 {
+		// fences off the writes made under an older lock of the order
+		query += " AND lock_token <= ?"
+		args = append(args, token)
+	}
+	since, conditional := unmodifiedSinceFromContext(ctx)
+	if conditional {
+		query += " AND updated_at < ?"
+		args = append(args, unmodifiedSinceBound(since))
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+
+	if err := expectOneRow(res); err != nil {
+		return s.writeFailure(ctx, order.ID, token, since, conditional, err)
+	}
+	order.Version = next.Version
+	return nil
+}
+
+func (s *sqlRepository) DeleteOrder(ctx context.Context, id string) error {
+	query := `DELETE FROM orders WHERE id = ?`
+	args := []interface{}{id}
+	since, conditional := unmodifiedSinceFromContext(ctx)
+	if conditional {
+		query += " AND updated_at < ?"
+		args = append(args, unmodifiedSinceBound(since))
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	if err := expectOneRow(res); err != nil {
+		return s.writeFailure(ctx, id, 0, since, conditional, err)
+	}
+	return nil
+}
+
+// writeFailure tells why the write of order id changed no row: err when the
+// order is missing, ErrLockLost when it was written under a lock newer than
+// token, ErrPreconditionFailed when it was modified since the date of a
+// conditional write, otherwise ErrVersionConflict. The dates are stored as
+// RFC 3339 in UTC, which compare as strings in the order of time.
+func (s *sqlRepository) writeFailure(ctx context.Context, id string, token int64, since time.Time, conditional bool, err error) error {
+	var data string
+	var lockToken int64
+	getErr := s.db.QueryRowContext(ctx, s.rebind(`SELECT data, lock_token FROM orders WHERE id = ?`), id).Scan(&data, &lockToken)
+	if getErr != nil {
+		return err
+	}
+	stored, getErr := decodeSQLOrder(data)
+	if getErr != nil {
+		return err
+	}
+	if token > 0 && lockToken > token {
+		return ErrLockLost
+	}
+	if conditional && modifiedSince(stored.UpdatedAt, since) {
+		return ErrPreconditionFailed
+	}
+	return ErrVersionConflict
+}
+
+// PurgeExpiredOrders removes the orders whose expires_at is before now
+func (s *sqlRepository) PurgeExpiredOrders(ctx context.Context, now time.Time) (int, error) {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM orders WHERE expires_at > 0 AND expires_at < ?`), now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func expectOneRow(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrOrderNotFound
+	}
+	return nil
+}
+
+func (s *sqlRepository) ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error) {
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+
+	var where []string
+	var args []interface{}
+	if opts.CustomerID != "" {
+		where = append(where, "customer_id = ?")
+		args = append(args, opts.CustomerID)
+	}
+	if opts.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, string(opts.Status))
+	}
+	if opts.PageToken != "" {
+		createdAt, id, err := decodeSQLPageToken(opts.PageToken)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, createdAt, createdAt, id)
+	}
+
+	query := "SELECT data FROM orders"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	// one extra row tells whether there is a next page
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var orders []*Order
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, "", err
+		}
+		order, err := decodeSQLOrder(data)
+		if err != nil {
+			return nil, "", err
+		}
+		orders = append(orders, order)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(orders) > limit {
+		orders = orders[:limit]
+		last := orders[limit-1]
+		next = encodeSQLPageToken(formatSQLTime(last.CreatedAt), last.ID)
+	}
+	return orders, next, nil
+}
+
+func encodeSQLPageToken(createdAt, id string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt + "|" + id))
+}
+
+func decodeSQLPageToken(token string) (string, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", &ValidationError{Field: "pageToken", Reason: "is malformed"}
+	}
+	parts := strings.SplitN(string(data), "|", 2)
+	if len(parts) != 2 {
+		return "", "", &ValidationError{Field: "pageToken", Reason: "is malformed"}
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,15 @@
+package api_test
+
+import (
+	"testing"
+
+	"github.com/omnom-nom/order/api/apitest"
+)
+
+func TestSQLiteRepositoryConformance(t *testing.T) {
+	apitest.RunConformance(t, apitest.NewSQLiteRepository)
+}
+
+func TestPostgresRepositoryConformance(t *testing.T) {
+	apitest.RunConformance(t, apitest.NewPostgresRepository)
+}
@@ -0,0 +1,485 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/logging"
+)
+
+// ArchivalJob is the type of the jobs recording the runs of the retention job
+const ArchivalJob jobs.Type = "archival"
+
+// RetentionResult is the result of an archival job
+type RetentionResult struct {
+	Purged   int `json:"purged"`
+	Archived int `json:"archived"`
+	// Expired is the number of finished orders anonymized or deleted at the
+	// end of their retention
+	Expired int `json:"expired"`
+	// Edits is the number of audit records of edits dropped
+	Edits int `json:"edits"`
+	// Deliveries is the number of webhook delivery logs purged
+	Deliveries int `json:"deliveries"`
+}
+
+// any reports whether the run changed anything
+func (r *RetentionResult) any() bool {
+	return r.Purged > 0 || r.Archived > 0 || r.Expired > 0 || r.Edits > 0 || r.Deliveries > 0
+}
+
+const (
+	// maxArchiveBatches bounds the batches archived by one run of the retention job,
+	// the orders left over are archived by the next runs
+	maxArchiveBatches = 20
+	// maxExpiredOrders bounds the orders expired by one run of the retention job
+	maxExpiredOrders = 1000
+)
+
+// softDeleteRepository turns the deletion of an order into marking it deleted. A
+// deleted order is hidden from reads and kept for the retention, when it can be
+// restored, before it expires and is purged by the backend.
+type softDeleteRepository struct {
+	Repository
+	retention time.Duration
+}
+
+// NewSoftDeleteRepository returns repo keeping deleted orders for retention, or
+// until they are restored when retention is 0
+func NewSoftDeleteRepository(repo Repository, retention time.Duration) Repository {
+	return &softDeleteRepository{Repository: repo, retention: retention}
+}
+
+// Unwrap returns the repository keeping the deleted orders
+func (s *softDeleteRepository) Unwrap() Repository {
+	return s.Repository
+}
+
+func (s *softDeleteRepository) GetOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := s.Repository.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if order.DeletedAt != nil {
+		return nil, ErrOrderNotFound
+	}
+	return order, nil
+}
+
+// ListOrders leaves the deleted orders out, so a page may hold fewer orders than
+// the limit
+func (s *softDeleteRepository) ListOrders(ctx context.Context, opts ListOptions) ([]*Order, string, error) {
+	orders, next, err := s.Repository.ListOrders(ctx, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return withoutDeleted(orders), next, nil
+}
+
+// BatchGetOrders keeps the bulk operation of the decorated repository
+func (s *softDeleteRepository) BatchGetOrders(ctx context.Context, ids []string) (map[string]*Order, error) {
+	orders, err := batchGetOrders(ctx, s.Repository, ids)
+	if err != nil {
+		return nil, err
+	}
+	for id, order := range orders {
+		if order.DeletedAt != nil {
+			delete(orders, id)
+		}
+	}
+	return orders, nil
+}
+
+// BatchCreateOrders keeps the bulk operation of the decorated repository
+func (s *softDeleteRepository) BatchCreateOrders(ctx context.Context, orders []*Order) []error {
+	return batchCreateOrders(ctx, s.Repository, orders)
+}
+
+// SearchOrders keeps the native search of the decorated repository
+func (s *softDeleteRepository) SearchOrders(ctx context.Context, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error) {
+	orders, next, err := searchOrders(ctx, s.Repository, query, limit, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return withoutDeleted(orders), next, nil
+}
+
+func withoutDeleted(orders []*Order) []*Order {
+	kept := orders[:0]
+	for _, order := range orders {
+		if order.DeletedAt == nil {
+			kept = append(kept, order)
+		}
+	}
+	return kept
+}
+
+// DeleteOrder marks the order with id deleted and lets it expire after the retention
+func (s *softDeleteRepository) DeleteOrder(ctx context.Context, id string) error {
+	order, err := s.GetOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	if order.ArchivedAt != nil {
+		return ErrOrderArchived
+	}
+
+	now := time.Now().UTC()
+	order.DeletedAt = &now
+	order.UpdatedAt = now
+	if s.retention > 0 {
+		order.ExpiresAt = now.Add(s.retention).Unix()
+	}
+	return s.Repository.UpdateOrder(WithEventType(ctx, eventTypeFromContext(ctx, EventOrderDeleted)), order)
+}
+
+// RestoreOrder clears the deletion of the order with id if it has not expired yet.
+// Restoring an order that is not deleted returns it unchanged.
+func (s *softDeleteRepository) RestoreOrder(ctx context.Context, id string) (*Order, error) {
+	order, err := s.Repository.GetOrder(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if order.DeletedAt == nil {
+		return order, nil
+	}
+	now := time.Now().UTC()
+	if order.ExpiresAt > 0 && order.ExpiresAt < now.Unix() {
+		return nil, ErrOrderNotFound
+	}
+
+	order.DeletedAt = nil
+	order.ExpiresAt = 0
+	order.UpdatedAt = now
+	if err := s.Repository.UpdateOrder(WithEventType(ctx, EventOrderRestored), order); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// orderRestorer is implemented by repositories keeping deleted orders
+type orderRestorer interface {
+	RestoreOrder(ctx context.Context, id string) (*Order, error)
+}
+
+// findOrderRestorer returns the layer of repo keeping deleted orders
+func findOrderRestorer(repo Repository) (orderRestorer, bool) {
+	var restorer orderRestorer
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		restorer, ok = r.(orderRestorer)
+		return ok
+	})
+	return restorer, found
+}
+
+// RestoreOrder brings back the deleted order named in the path while it is retained
+func RestoreOrder(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["orderId"]
+	restorer, ok := findOrderRestorer(RepositoryFromContext(r.Context()))
+	if !ok {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+
+	order, err := restorer.RestoreOrder(r.Context(), id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(r.Context()).Infof("restored order %s", id)
+	writeJSON(w, r, http.StatusOK, order)
+}
+
+// orderPurger is implemented by backends removing expired orders. DynamoDB
+// expires them itself within a few days, purging them there is a sweep for the
+// orders its ttl has not deleted yet.
+type orderPurger interface {
+	// PurgeExpiredOrders removes the orders whose ExpiresAt is before now and
+	// returns their number
+	PurgeExpiredOrders(ctx context.Context, now time.Time) (int, error)
+}
+
+// findOrderPurger returns the layer of repo purging expired orders
+func findOrderPurger(repo Repository) (orderPurger, bool) {
+	var purger orderPurger
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		purger, ok = r.(orderPurger)
+		return ok
+	})
+	return purger, found
+}
+
+// deliveryPurger is implemented by backends removing the logs of finished
+// webhook deliveries
+type deliveryPurger interface {
+	// PurgeDeliveries removes the delivered and dead deliveries last changed
+	// before cutoff and returns their number, it fails with ErrNotSupported
+	// while webhooks are not enabled
+	PurgeDeliveries(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// findDeliveryPurger returns the layer of repo purging webhook deliveries
+func findDeliveryPurger(repo Repository) (deliveryPurger, bool) {
+	var purger deliveryPurger
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		purger, ok = r.(deliveryPurger)
+		return ok
+	})
+	return purger, found
+}
+
+// belowSoftDelete returns the layer of repo the soft deletion decorates, which
+// removes orders for good, or repo itself without soft deletion
+func belowSoftDelete(repo Repository) Repository {
+	below := repo
+	eachLayer(repo, func(r Repository) bool {
+		s, ok := r.(*softDeleteRepository)
+		if ok {
+			below = s.Repository
+		}
+		return ok
+	})
+	return below
+}
+
+// RetentionJob purges the deleted orders whose retention ended, sweeping up
+// after the ttl of DynamoDB, and moves the finished orders that have not changed
+// for a while to the archive. It anonymizes or deletes the finished orders past
+// their retention, drops the audit records of old edits and purges the logs of
+// old webhook deliveries.
+type RetentionJob struct {
+	repo    Repository
+	archive Archive
+	cfg     config.RetentionConfig
+	pool    *jobs.Pool
+	logger  logging.Logger
+}
+
+// NewRetentionJob returns a job applying cfg to the orders of repo, archiving
+// them to archive unless it is nil
+func NewRetentionJob(repo Repository, archive Archive, cfg config.RetentionConfig, logger logging.Logger) *RetentionJob {
+	return &RetentionJob{
+		repo:    repo,
+		archive: archive,
+		cfg:     cfg,
+		logger:  logger,
+	}
+}
+
+// WithJobs makes the job record each of its archival runs as an archival job
+// of pool, which can be followed and cancelled like any other job
+func (j *RetentionJob) WithJobs(pool *jobs.Pool) *RetentionJob {
+	j.pool = pool
+	return j
+}
+
+// RunOnce purges the orders expired at now, archives the orders finished before
+// the archive age and applies the retention of orders, edits and webhook
+// deliveries, it returns what it did
+func (j *RetentionJob) RunOnce(ctx context.Context, now time.Time) *RetentionResult {
+	res := j.Expire(ctx, now)
+	if j.archiving() {
+		res.Archived = j.archiveOrders(ctx, now, func(done, total int64) {})
+	}
+	return res
+}
+
+// Expire purges the orders expired at now and applies the retention of orders,
+// edits and webhook deliveries, it returns what it did
+func (j *RetentionJob) Expire(ctx context.Context, now time.Time) *RetentionResult {
+	ctx = WithLogger(ctx, j.logger)
+	res := &RetentionResult{}
+	if purger, ok := findOrderPurger(j.repo); ok {
+		n, err := purger.PurgeExpiredOrders(ctx, now)
+		if err != nil {
+			j.logger.Errorf("failed to purge expired orders: %v", err)
+		}
+		res.Purged = n
+	}
+	if j.cfg.Orders.Duration > 0 || j.cfg.Edits.Duration > 0 {
+		res.Expired, res.Edits = j.expireOrders(ctx, now)
+	}
+	if purger, ok := findDeliveryPurger(j.repo); ok && j.cfg.Deliveries.Duration > 0 {
+		n, err := purger.PurgeDeliveries(ctx, now.Add(-j.cfg.Deliveries.Duration))
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			j.logger.Errorf("failed to purge webhook deliveries: %v", err)
+		}
+		res.Deliveries = n
+	}
+	if res.any() {
+		j.logger.Infof("purged %d and expired %d orders, dropped %d edits and purged %d webhook deliveries",
+			res.Purged, res.Expired, res.Edits, res.Deliveries)
+	}
+	return res
+}
+
+// archiving reports whether the job moves orders to the archive
+func (j *RetentionJob) archiving() bool {
+	return j.archive != nil && j.cfg.Archive.Enabled
+}
+
+// Archive moves the orders finished before the archive age at now to the
+// archive, recorded as an archival job with WithJobs, and returns their number
+func (j *RetentionJob) Archive(ctx context.Context, now time.Time) (*RetentionResult, error) {
+	ctx = WithLogger(ctx, j.logger)
+	if !j.archiving() {
+		return &RetentionResult{}, nil
+	}
+	if j.pool == nil {
+		return &RetentionResult{Archived: j.archiveOrders(ctx, now, func(done, total int64) {})}, nil
+	}
+	res := &RetentionResult{}
+	_, err := j.pool.Do(ctx, ArchivalJob, nil, func(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+		res.Archived = j.archiveOrders(ctx, now, report)
+		return res, ctx.Err()
+	})
+	if err != nil {
+		return res, fmt.Errorf("failed to record the archival run: %v", err)
+	}
+	return res, nil
+}
+
+// expireOrders applies the retention of orders and edits to the finished
+// orders. The orders last changed before the order retention are anonymized,
+// or deleted and then purged like any deleted order, and the edits made before
+// the edit retention are dropped from the others. An order changed meanwhile is
+// left to the next run.
+func (j *RetentionJob) expireOrders(ctx context.Context, now time.Time) (expired, edits int) {
+	cutoff := now.Add(-j.cfg.Orders.Duration)
+	editCutoff := now.Add(-j.cfg.Edits.Duration)
+	expires := func(order *Order) bool {
+		return j.cfg.Orders.Duration > 0 && order.UpdatedAt.Before(cutoff) &&
+			(j.cfg.OrdersAction == config.RetentionDelete || order.ErasedAt == nil)
+	}
+	orders := j.finishedOrders(ctx, j.repo, maxExpiredOrders, func(order *Order) bool {
+		return expires(order) || (j.cfg.Edits.Duration > 0 && len(order.Edits) > 0 && order.Edits[0].EditedAt.Before(editCutoff))
+	})
+	for _, order := range orders {
+		if ctx.Err() != nil {
+			break
+		}
+		if expires(order) {
+			if err := j.expireOrder(ctx, order, now); err != nil {
+				j.logger.Errorf("failed to expire order %s: %v", order.ID, err)
+				continue
+			}
+			expired++
+			continue
+		}
+		n := dropEdits(order, editCutoff)
+		if err := j.repo.UpdateOrder(ctx, order); err != nil {
+			j.logger.Errorf("failed to drop the edits of order %s: %v", order.ID, err)
+			continue
+		}
+		edits += n
+	}
+	return expired, edits
+}
+
+// expireOrder applies the retention action to an order past its retention
+func (j *RetentionJob) expireOrder(ctx context.Context, order *Order, now time.Time) error {
+	if j.cfg.OrdersAction == config.RetentionDelete {
+		err := j.repo.DeleteOrder(ctx, order.ID)
+		if errors.Is(err, ErrOrderNotFound) {
+			return nil
+		}
+		return err
+	}
+	if !order.erasePersonalData(now) {
+		// nothing to erase, ErasedAt keeps the next runs from visiting it again
+		order.ErasedAt = &now
+	}
+	return j.repo.UpdateOrder(ctx, order)
+}
+
+// dropEdits removes the edits of order made before cutoff and returns their
+// number
+func dropEdits(order *Order, cutoff time.Time) int {
+	kept := order.Edits[:0]
+	for _, edit := range order.Edits {
+		if !edit.EditedAt.Before(cutoff) {
+			kept = append(kept, edit)
+		}
+	}
+	dropped := len(order.Edits) - len(kept)
+	order.Edits = kept
+	return dropped
+}
+
+// archiveOrders moves the finished orders last changed before the archive age
+// to the archive, a batch at a time. The orders of a batch are removed once the
+// archive holds them; a failure or cancellation leaves them to the next run.
+func (j *RetentionJob) archiveOrders(ctx context.Context, now time.Time, report func(done, total int64)) int {
+	// the archive keeps the sensitive fields of the orders sealed
+	repo := belowEncryption(belowSoftDelete(j.repo))
+	batchSize := j.cfg.Archive.BatchSize
+	cutoff := now.Add(-j.cfg.Archive.After.Duration)
+	candidates := j.finishedOrders(ctx, repo, batchSize*maxArchiveBatches, func(order *Order) bool {
+		return order.UpdatedAt.Before(cutoff)
+	})
+
+	archived := 0
+	report(0, int64(len(candidates)))
+	ctx = WithEventType(ctx, EventOrderArchived)
+	for start := 0; start < len(candidates) && ctx.Err() == nil; start += batchSize {
+		end := start + batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		batch := candidates[start:end]
+		if err := j.archive.PutOrders(ctx, batch); err != nil {
+			j.logger.Errorf("failed to archive %d orders: %v", len(batch), err)
+			return archived
+		}
+		for _, order := range batch {
+			err := repo.DeleteOrder(ctx, order.ID)
+			if err != nil && !errors.Is(err, ErrOrderNotFound) {
+				j.logger.Errorf("failed to remove archived order %s: %v", order.ID, err)
+				continue
+			}
+			archived++
+		}
+		report(int64(archived), int64(len(candidates)))
+	}
+	if archived > 0 {
+		j.logger.Infof("archived %d orders", archived)
+	}
+	return archived
+}
+
+// finishedOrders lists up to limit finished orders of repo that are not deleted
+// and match
+func (j *RetentionJob) finishedOrders(ctx context.Context, repo Repository, limit int, match func(*Order) bool) []*Order {
+	var candidates []*Order
+	for _, status := range []Status{StatusDelivered, StatusCancelled} {
+		opts := ListOptions{Status: status, Limit: DefaultPageSize}
+		for len(candidates) < limit {
+			orders, next, err := repo.ListOrders(ctx, opts)
+			if err != nil {
+				j.logger.Errorf("failed to list %s orders: %v", status, err)
+				break
+			}
+			for _, order := range orders {
+				if order.Finished() && order.DeletedAt == nil && order.ArchivedAt == nil &&
+					match(order) && len(candidates) < limit {
+					candidates = append(candidates, order)
+				}
+			}
+			if next == "" || ctx.Err() != nil {
+				break
+			}
+			opts.PageToken = next
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,511 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/money"
+)
+
+var (
+	// ErrReturnNotFound is returned when an order has no return with the requested id
+	ErrReturnNotFound = errors.New("return not found")
+	// ErrInvalidTransition is returned when a return does not allow the requested change in its status
+	ErrInvalidTransition = errors.New("return does not allow this change in its status")
+	// ErrNotReturnable is returned when returning items of an order that was not delivered
+	ErrNotReturnable = errors.New("only delivered orders can be returned")
+)
+
+// ReturnStatus is the state of a return
+type ReturnStatus string
+
+const (
+	ReturnRequested ReturnStatus = "requested"
+	ReturnApproved  ReturnStatus = "approved"
+	ReturnRejected  ReturnStatus = "rejected"
+	// ReturnInTransit marks a return whose shipment back to the warehouse is on its way
+	ReturnInTransit ReturnStatus = "in_transit"
+	ReturnReceived  ReturnStatus = "received"
+	// ReturnRefunded marks a return whose value was refunded in full
+	ReturnRefunded ReturnStatus = "refunded"
+)
+
+// returnTransitions lists the statuses a return may move to from each status
+var returnTransitions = map[ReturnStatus][]ReturnStatus{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnInTransit, ReturnReceived, ReturnRefunded},
+	ReturnInTransit: {ReturnInTransit, ReturnReceived, ReturnRefunded},
+	ReturnReceived:  {ReturnRefunded},
+}
+
+// ShipmentStatus is the state of the shipment of a return
+type ShipmentStatus string
+
+const (
+	ShipmentInTransit ShipmentStatus = "in_transit"
+	ShipmentDelivered ShipmentStatus = "delivered"
+)
+
+// ReturnItem is a quantity of one line item of the order being returned
+type ReturnItem struct {
+	SKU      string `json:"sku" dynamodbav:"sku"`
+	Quantity int    `json:"quantity" dynamodbav:"quantity"`
+}
+
+// ReturnShipment tracks the shipment of the returned items back to the warehouse
+type ReturnShipment struct {
+	Carrier        string         `json:"carrier" dynamodbav:"carrier"`
+	TrackingNumber string         `json:"trackingNumber" dynamodbav:"trackingNumber"`
+	Status         ShipmentStatus `json:"status" dynamodbav:"status"`
+	UpdatedAt      time.Time      `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// ReturnRefund is one refund issued for a return
+type ReturnRefund struct {
+	ID        string      `json:"id" dynamodbav:"refundId"`
+	Amount    money.Money `json:"amount" dynamodbav:"amount"`
+	CreatedAt time.Time   `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// Return is a return merchandise authorization of line items of an order
+type Return struct {
+	ID      string       `json:"id" dynamodbav:"returnId"`
+	OrderID string       `json:"orderId" dynamodbav:"orderId"`
+	Items   []ReturnItem `json:"items" dynamodbav:"items"`
+	Reason  string       `json:"reason,omitempty" dynamodbav:"reason,omitempty"`
+	Status  ReturnStatus `json:"status" dynamodbav:"status"`
+	// RejectionReason explains a rejected return
+	RejectionReason string          `json:"rejectionReason,omitempty" dynamodbav:"rejectionReason,omitempty"`
+	Shipment        *ReturnShipment `json:"shipment,omitempty" dynamodbav:"shipment,omitempty"`
+	// Currency is the currency of the amounts, that of the order
+	Currency string `json:"currency,omitempty" dynamodbav:"currency,omitempty"`
+	// Amount is the value of the returned items, the most that can be refunded
+	Amount    money.Money    `json:"amount" dynamodbav:"amount"`
+	Refunds   []ReturnRefund `json:"refunds,omitempty" dynamodbav:"refunds,omitempty"`
+	CreatedAt time.Time      `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt" dynamodbav:"updatedAt"`
+	Version   int64          `json:"version" dynamodbav:"version"`
+}
+
+// Refunded returns the sum of the refunds issued for the return
+func (r *Return) Refunded() money.Money {
+	total := money.New(0, r.Currency)
+	for _, refund := range r.Refunds {
+		total = total.Add(refund.Amount)
+	}
+	return total
+}
+
+// canMoveTo reports whether the return may change from its status to status
+func (r *Return) canMoveTo(status ReturnStatus) bool {
+	for _, next := range returnTransitions[r.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ReturnStore is implemented by repositories that keep returns. Every write records
+// an outbox event when the outbox is enabled. Its methods fail with ErrNotSupported
+// until EnableReturns is called.
+type ReturnStore interface {
+	// CreateReturn stores a new return, recording a ReturnRequested event
+	CreateReturn(ctx context.Context, ret *Return) error
+	// GetReturn returns the return with id of an order, or ErrReturnNotFound
+	GetReturn(ctx context.Context, orderID, id string) (*Return, error)
+	// ListReturns returns the returns of an order, oldest first
+	ListReturns(ctx context.Context, orderID string) ([]*Return, error)
+	// UpdateReturn replaces a return if its stored version equals ret.Version,
+	// incrementing ret.Version and recording an event of eventType. It fails with
+	// ErrReturnNotFound or ErrVersionConflict.
+	UpdateReturn(ctx context.Context, ret *Return, eventType events.Type) error
+}
+
+// returnsEnabler is implemented by repositories able to keep returns
+type returnsEnabler interface {
+	enableReturns(table string)
+}
+
+// EnableReturns makes repo keep returns, in table for the backends that keep
+// them in a separate table
+func EnableReturns(repo Repository, table string) error {
+	enabler, ok := repo.(returnsEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support returns", repo)
+	}
+	enabler.enableReturns(table)
+	return nil
+}
+
+// findReturnStore returns the return store of repo or of the repository it decorates
+func findReturnStore(repo Repository) (ReturnStore, bool) {
+	var store ReturnStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(ReturnStore)
+		return ok
+	})
+	return store, found
+}
+
+// returnStoreFromContext returns the return store of the request repository or ErrNotSupported
+func returnStoreFromContext(ctx context.Context) (ReturnStore, error) {
+	store, ok := findReturnStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// newReturnEvent returns the event of a write of ret by the tenant of ctx, whose
+// state is the payload
+func newReturnEvent(ctx context.Context, eventType events.Type, ret *Return) (*OutboxEvent, error) {
+	payload, err := json.Marshal(ret)
+	if err != nil {
+		return nil, err
+	}
+	return &OutboxEvent{
+		ID:        newID(),
+		OrderID:   ret.OrderID,
+		Type:      eventType,
+		Payload:   payload,
+		CreatedAt: time.Now().UTC(),
+		TenantID:  TenantFromContext(ctx),
+	}, nil
+}
+
+// createReturnRequest is the body of CreateReturn
+type createReturnRequest struct {
+	Items  []ReturnItem `json:"items"`
+	Reason string       `json:"reason"`
+}
+
+// newReturn returns the validated return of req for order, whose other returns are
+// others. Items can only be returned up to their ordered quantity over all returns
+// that were not rejected.
+func (req *createReturnRequest) newReturn(order *Order, others []*Return) (*Return, error) {
+	if order.Status != StatusDelivered {
+		return nil, ErrNotReturnable
+	}
+	if len(req.Items) == 0 {
+		return nil, &ValidationError{Field: "items", Reason: "at least one item is required"}
+	}
+
+	returnable := map[string]int{}
+	prices := map[string]money.Money{}
+	for _, item := range order.Items {
+		returnable[item.SKU] += item.Quantity
+		prices[item.SKU] = item.UnitPrice
+	}
+	for _, other := range others {
+		if other.Status == ReturnRejected {
+			continue
+		}
+		for _, item := range other.Items {
+			returnable[item.SKU] -= item.Quantity
+		}
+	}
+
+	amount := money.New(0, order.Currency)
+	for i, item := range req.Items {
+		if _, ok := prices[item.SKU]; !ok {
+			return nil, &ValidationError{Field: fmt.Sprintf("items[%d].sku", i), Reason: "is not an item of the order"}
+		}
+		if item.Quantity <= 0 {
+			return nil, &ValidationError{Field: fmt.Sprintf("items[%d].quantity", i), Reason: "must be positive"}
+		}
+		if item.Quantity > returnable[item.SKU] {
+			return nil, &ValidationError{Field: fmt.Sprintf("items[%d].quantity", i), Reason: fmt.Sprintf("only %d can be returned", returnable[item.SKU])}
+		}
+		returnable[item.SKU] -= item.Quantity
+		amount = amount.Add(prices[item.SKU].Mul(int64(item.Quantity)))
+	}
+
+	now := time.Now().UTC()
+	return &Return{
+		ID:        newID(),
+		OrderID:   order.ID,
+		Items:     req.Items,
+		Reason:    req.Reason,
+		Status:    ReturnRequested,
+		Currency:  order.Currency,
+		Amount:    amount,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Version:   1,
+	}, nil
+}
+
+// transitionReturn moves ret to status, recording an event of eventType
+func transitionReturn(ctx context.Context, store ReturnStore, ret *Return, status ReturnStatus, eventType events.Type) error {
+	if !ret.canMoveTo(status) {
+		return ErrInvalidTransition
+	}
+	ret.Status = status
+	ret.UpdatedAt = time.Now().UTC()
+	if err := store.UpdateReturn(ctx, ret, eventType); err != nil {
+		return err
+	}
+	LoggerFromContext(ctx).Infof("return %s of order %s is %s", ret.ID, ret.OrderID, status)
+	return nil
+}
+
+// refundReturn refunds amount of ret, the rest of its amount when amount is 0,
+// with the refund hook of ctx. The return is refunded once its amount is.
+func refundReturn(ctx context.Context, repo Repository, store ReturnStore, ret *Return, amount money.Money) error {
+	if !ret.canMoveTo(ReturnRefunded) {
+		return ErrInvalidTransition
+	}
+	order, err := repo.GetOrder(ctx, ret.OrderID)
+	if err != nil {
+		return err
+	}
+	amount, err = amount.In(order.Currency)
+	if err != nil {
+		return &ValidationError{Field: "amount", Reason: err.Error()}
+	}
+	remaining := ret.Amount.Sub(ret.Refunded())
+	if amount.IsZero() {
+		amount = remaining
+	}
+	if amount.IsNegative() || amount.Cmp(remaining) > 0 {
+		return &ValidationError{Field: "amount", Reason: fmt.Sprintf("must be positive and at most %s", remaining)}
+	}
+	status := ret.Status
+	if amount.Cmp(remaining) == 0 {
+		status = ReturnRefunded
+	}
+
+	// the key names the n-th refund of the return, so a retried request refunds once
+	key := fmt.Sprintf("%s-refund-%d", ret.ID, len(ret.Refunds)+1)
+	if err := RefundHookFromContext(ctx).Refund(ctx, order, amount, key); err != nil {
+		return err
+	}
+	if order.Payment != nil || len(order.Tenders) > 0 {
+		order.UpdatedAt = time.Now().UTC()
+		if err := repo.UpdateOrder(ctx, order); err != nil {
+			LoggerFromContext(ctx).Errorf("failed to record the refund of return %s on order %s: %v", ret.ID, order.ID, err)
+		}
+	}
+
+	now := time.Now().UTC()
+	ret.Refunds = append(ret.Refunds, ReturnRefund{ID: newID(), Amount: amount, CreatedAt: now})
+	ret.Status = status
+	ret.UpdatedAt = now
+	if err := store.UpdateReturn(ctx, ret, events.ReturnRefunded); err != nil {
+		LoggerFromContext(ctx).Errorf("refunded %s for return %s of order %s but failed to record it: %v", amount, ret.ID, ret.OrderID, err)
+		return err
+	}
+	LoggerFromContext(ctx).Infof("refunded %s for return %s of order %s", amount, ret.ID, ret.OrderID)
+	return nil
+}
+
+// CreateReturn initiates a return of line items of the delivered order named in the path
+func CreateReturn(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := returnStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req createReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	order, err := RepositoryFromContext(ctx).GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	others, err := store.ListReturns(ctx, order.ID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ret, err := req.newReturn(order, others)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := store.CreateReturn(ctx, ret); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	LoggerFromContext(ctx).Infof("created return %s of order %s", ret.ID, order.ID)
+	writeJSON(w, r, http.StatusCreated, ret)
+}
+
+// listReturnsResponse is the body of ListReturns
+type listReturnsResponse struct {
+	Returns []*Return `json:"returns"`
+}
+
+// ListReturns returns the returns of the order named in the path
+func ListReturns(w http.ResponseWriter, r *http.Request) {
+	store, err := returnStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	returns, err := store.ListReturns(r.Context(), mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if returns == nil {
+		returns = []*Return{}
+	}
+	writeJSON(w, r, http.StatusOK, &listReturnsResponse{Returns: returns})
+}
+
+// returnFromRequest reads the return named in the path of r
+func returnFromRequest(r *http.Request) (ReturnStore, *Return, error) {
+	store, err := returnStoreFromContext(r.Context())
+	if err != nil {
+		return nil, nil, err
+	}
+	vars := mux.Vars(r)
+	ret, err := store.GetReturn(r.Context(), vars["orderId"], vars["returnId"])
+	if err != nil {
+		return nil, nil, err
+	}
+	return store, ret, nil
+}
+
+// GetReturn returns the return named in the path
+func GetReturn(w http.ResponseWriter, r *http.Request) {
+	_, ret, err := returnFromRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// ApproveReturn approves the requested return named in the path
+func ApproveReturn(w http.ResponseWriter, r *http.Request) {
+	store, ret, err := returnFromRequest(r)
+	if err == nil {
+		err = transitionReturn(r.Context(), store, ret, ReturnApproved, events.ReturnApproved)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// rejectReturnRequest is the body of RejectReturn
+type rejectReturnRequest struct {
+	Reason string `json:"reason"`
+}
+
+// RejectReturn rejects the requested return named in the path, the items of a
+// rejected return can be returned again
+func RejectReturn(w http.ResponseWriter, r *http.Request) {
+	var req rejectReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.Reason == "" {
+		writeError(w, r, &ValidationError{Field: "reason", Reason: "is required"})
+		return
+	}
+
+	store, ret, err := returnFromRequest(r)
+	if err == nil {
+		ret.RejectionReason = req.Reason
+		err = transitionReturn(r.Context(), store, ret, ReturnRejected, events.ReturnRejected)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// updateShipmentRequest is the body of UpdateReturnShipment
+type updateShipmentRequest struct {
+	Carrier        string         `json:"carrier"`
+	TrackingNumber string         `json:"trackingNumber"`
+	Status         ShipmentStatus `json:"status"`
+}
+
+// UpdateReturnShipment records the shipment of the approved return named in the
+// path. A delivered shipment marks the return received.
+func UpdateReturnShipment(w http.ResponseWriter, r *http.Request) {
+	var req updateShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.Carrier == "" || req.TrackingNumber == "" {
+		writeError(w, r, &ValidationError{Field: "shipment", Reason: "carrier and tracking number are required"})
+		return
+	}
+	status, eventType := ReturnInTransit, events.ReturnShipped
+	switch req.Status {
+	case ShipmentInTransit:
+	case ShipmentDelivered:
+		status, eventType = ReturnReceived, events.ReturnReceived
+	default:
+		writeError(w, r, &ValidationError{Field: "status", Reason: "must be in_transit or delivered"})
+		return
+	}
+
+	store, ret, err := returnFromRequest(r)
+	if err == nil {
+		ret.Shipment = &ReturnShipment{
+			Carrier:        req.Carrier,
+			TrackingNumber: req.TrackingNumber,
+			Status:         req.Status,
+			UpdatedAt:      time.Now().UTC(),
+		}
+		err = transitionReturn(r.Context(), store, ret, status, eventType)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
+
+// refundReturnRequest is the body of RefundReturn
+type refundReturnRequest struct {
+	// Amount is refunded, the rest of the return amount when it is 0
+	Amount money.Money `json:"amount"`
+}
+
+// RefundReturn issues a full or partial refund of the approved return named in the
+// path, without a body the rest of its amount is refunded
+func RefundReturn(w http.ResponseWriter, r *http.Request) {
+	var req refundReturnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+
+	store, ret, err := returnFromRequest(r)
+	if err == nil {
+		err = refundReturn(r.Context(), RepositoryFromContext(r.Context()), store, ret, req.Amount)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, ret)
+}
@@ -13,11 +13,163 @@ const (
 )
 
 var v1Prefix = fmt.Sprintf("%s/%s", Apiv1, ApiServiceType)
+var customerPrefix = fmt.Sprintf("%s/customer", Apiv1)
+var draftPrefix = fmt.Sprintf("%s/draft", Apiv1)
+var schedulePrefix = fmt.Sprintf("%s/schedule", Apiv1)
+var hostPrefix = fmt.Sprintf("%s/host", Apiv1)
+var warehousePrefix = fmt.Sprintf("%s/warehouse", Apiv1)
+var trackPrefix = fmt.Sprintf("%s/track", Apiv1)
+var agentPrefix = fmt.Sprintf("%s/agent", Apiv1)
+var adminPrefix = fmt.Sprintf("%s/admin", Apiv1)
+// streamingPaths are served without the request timeout, which buffers the
+// whole response
+var streamingPaths = map[string]bool{
+	"/" + v1Prefix + "/export": true,
+	"/" + adminPrefix + "/debug/pprof/profile": true,
+	"/" + adminPrefix + "/debug/pprof/trace": true,
+}
+
 var routes = map[string][]apiserver.Route{
 	v1Prefix: {
 		{ Name: "HealthCheck",	Method: http.MethodGet,		Path: "healthcheck",		Handler: HealthCheck},
-	//	{ Name: "CreateOrder",	Method: http.MethodPost,	Path: "create",			Handler: CreateOrder},
-	//	{ Name: "OrderStatus",	Method: http.MethodGet,		Path: "status/{orderId}",	Handler: OrderStatus},
-	//	{ Name: "DeleteOrder",	Method: http.MethodDelete,	Path: "delete/{orderId}",	Handler: DeleteOrder},
+		{ Name: "GetConfig",	Method: http.MethodGet,		Path: "config",			Handler: GetConfig},
+		{ Name: "Metrics",	Method: http.MethodGet,		Path: "metrics",		Handler: Metrics},
+		{ Name: "OpenAPI",	Method: http.MethodGet,		Path: "openapi",		Handler: OpenAPI},
+		{ Name: "GetRouteDoc",	Method: http.MethodGet,		Path: "docs/{routeName}",	Handler: GetRouteDoc},
+		{ Name: "GetUsage",	Method: http.MethodGet,		Path: "usage",			Handler: GetUsage},
+		{ Name: "CreateOrder",	Method: http.MethodPost,	Path: "create",			Handler: Gateway},
+		{ Name: "Quote",	Method: http.MethodPost,	Path: "quote",			Handler: Quote},
+		{ Name: "BatchCreateOrders",	Method: http.MethodPost,	Path: "batch/create",		Handler: BatchCreateOrders},
+		{ Name: "BatchOrderStatus",	Method: http.MethodPost,	Path: "batch/status",		Handler: BatchOrderStatus},
+		{ Name: "SearchOrders",	Method: http.MethodGet,		Path: "search",			Handler: SearchOrders},
+		{ Name: "GetOrderStats",	Method: http.MethodGet,		Path: "stats",			Handler: GetOrderStats},
+		{ Name: "ListErrorCodes",	Method: http.MethodGet,		Path: "errors",			Handler: ListErrorCodes},
+		{ Name: "ExportOrders",	Method: http.MethodGet,		Path: "export",			Handler: ExportOrders},
+		{ Name: "StartExport",	Method: http.MethodPost,	Path: "export",			Handler: StartExport},
+		{ Name: "ImportOrders",	Method: http.MethodPost,	Path: "import",			Handler: ImportOrders},
+		{ Name: "GetJob",	Method: http.MethodGet,		Path: "jobs/{jobId}",		Handler: GetJob},
+		{ Name: "CancelJob",	Method: http.MethodPost,	Path: "jobs/{jobId}/cancel",	Handler: CancelJob},
+		{ Name: "ListMembers",	Method: http.MethodGet,		Path: "cluster/members",	Handler: ListMembers},
+		{ Name: "CreateWebhook",	Method: http.MethodPost,	Path: "webhooks",		Handler: CreateWebhook},
+		{ Name: "ListWebhooks",	Method: http.MethodGet,		Path: "webhooks",		Handler: ListWebhooks},
+		{ Name: "ListWebhookDeliveries",	Method: http.MethodGet,	Path: "webhooks/{subscriptionId}/deliveries",	Handler: ListWebhookDeliveries},
+		{ Name: "GetWebhook",	Method: http.MethodGet,		Path: "webhooks/{subscriptionId}",	Handler: GetWebhook},
+		{ Name: "DeleteWebhook",	Method: http.MethodDelete,	Path: "webhooks/{subscriptionId}",	Handler: DeleteWebhook},
+		{ Name: "PaymentWebhook",	Method: http.MethodPost,	Path: "payments/webhook",	Handler: PaymentWebhook},
+		{ Name: "CarrierWebhook",	Method: http.MethodPost,	Path: "tracking/{carrier}",	Handler: CarrierWebhook},
+		{ Name: "ListOrders",	Method: http.MethodGet,		Path: "list",			Handler: Gateway},
+		{ Name: "ListHeldOrders",	Method: http.MethodGet,		Path: "held",			Handler: ListHeldOrders},
+		{ Name: "ListOverdueOrders",	Method: http.MethodGet,		Path: "overdue",		Handler: ListOverdueOrders},
+		{ Name: "WatchOrder",	Method: http.MethodGet,		Path: "watch/{orderId}",	Handler: Gateway},
+		{ Name: "OrderStatus",	Method: http.MethodGet,		Path: "status/{orderId}",	Handler: OrderStatus},
+		{ Name: "DeleteOrder",	Method: http.MethodDelete,	Path: "delete/{orderId}",	Handler: DeleteOrder},
+		{ Name: "CancelOrder",	Method: http.MethodPost,	Path: "{orderId}/cancel",	Handler: CancelOrder},
+		{ Name: "RestoreOrder",	Method: http.MethodPost,	Path: "{orderId}/restore",	Handler: RestoreOrder},
+		{ Name: "ReleaseOrder",	Method: http.MethodPost,	Path: "{orderId}/release",	Handler: ReleaseOrder},
+		{ Name: "RejectOrder",	Method: http.MethodPost,	Path: "{orderId}/reject",	Handler: RejectOrder},
+		{ Name: "CreateReturn",	Method: http.MethodPost,	Path: "{orderId}/returns",	Handler: CreateReturn},
+		{ Name: "ListReturns",	Method: http.MethodGet,		Path: "{orderId}/returns",	Handler: ListReturns},
+		{ Name: "GetReturn",	Method: http.MethodGet,		Path: "{orderId}/returns/{returnId}",	Handler: GetReturn},
+		{ Name: "ApproveReturn",	Method: http.MethodPost,	Path: "{orderId}/returns/{returnId}/approve",	Handler: ApproveReturn},
+		{ Name: "RejectReturn",	Method: http.MethodPost,	Path: "{orderId}/returns/{returnId}/reject",	Handler: RejectReturn},
+		{ Name: "UpdateReturnShipment",	Method: http.MethodPut,	Path: "{orderId}/returns/{returnId}/shipment",	Handler: UpdateReturnShipment},
+		{ Name: "RefundReturn",	Method: http.MethodPost,	Path: "{orderId}/returns/{returnId}/refund",	Handler: RefundReturn},
+		{ Name: "GetOrderHistory",	Method: http.MethodGet,		Path: "{orderId}/history",	Handler: GetOrderHistory},
+		{ Name: "GetOrderStream",	Method: http.MethodGet,		Path: "{orderId}/stream",	Handler: GetOrderStream},
+		{ Name: "GetOrderAsOf",	Method: http.MethodGet,		Path: "{orderId}/as-of",	Handler: GetOrderAsOf},
+		{ Name: "CreateShipment",	Method: http.MethodPost,	Path: "{orderId}/shipments",	Handler: CreateShipment},
+		{ Name: "TrackShipment",	Method: http.MethodPost,	Path: "{orderId}/shipments/{shipmentId}/tracking",	Handler: TrackShipment},
+		{ Name: "GetFulfillment",	Method: http.MethodGet,		Path: "{orderId}/fulfillment",	Handler: GetFulfillment},
+		{ Name: "RouteOrder",	Method: http.MethodPost,	Path: "{orderId}/route",	Handler: RouteOrder},
+		{ Name: "UpgradePriority",	Method: http.MethodPost,	Path: "{orderId}/priority",	Handler: UpgradePriority},
+		{ Name: "GetTrackingToken",	Method: http.MethodGet,	Path: "{orderId}/tracking-token",	Handler: GetTrackingToken},
+		{ Name: "GetInvoice",	Method: http.MethodGet,		Path: "{orderId}/invoice",	Handler: GetInvoice},
+		{ Name: "GetPackingSlip",	Method: http.MethodGet,		Path: "{orderId}/packing-slip",	Handler: GetPackingSlip},
+		{ Name: "GetOrder",	Method: http.MethodGet,		Path: "{orderId}",		Handler: Gateway},
+		{ Name: "EditOrder",	Method: http.MethodPatch,	Path: "{orderId}",		Handler: EditOrder},
+	},
+	customerPrefix: {
+		{ Name: "CreateCustomer",	Method: http.MethodPost,	Path: "create",			Handler: CreateCustomer},
+		{ Name: "GetCustomer",	Method: http.MethodGet,		Path: "{customerId}",		Handler: GetCustomer},
+		{ Name: "AddCustomerAddress",	Method: http.MethodPost,	Path: "{customerId}/addresses",	Handler: AddCustomerAddress},
+		{ Name: "DeleteCustomerAddress",	Method: http.MethodDelete,	Path: "{customerId}/addresses/{addressId}",	Handler: DeleteCustomerAddress},
+		{ Name: "UpdateNotificationPreferences",	Method: http.MethodPut,	Path: "{customerId}/notifications",	Handler: UpdateNotificationPreferences},
+		{ Name: "ListCustomerOrders",	Method: http.MethodGet,		Path: "{customerId}/orders",	Handler: ListCustomerOrders},
+		{ Name: "ListCustomerSchedules",	Method: http.MethodGet,	Path: "{customerId}/schedules",	Handler: ListCustomerSchedules},
+		{ Name: "StartSubjectExport",	Method: http.MethodPost,	Path: "{customerId}/data-export",	Handler: StartSubjectExport},
+		{ Name: "StartErasure",	Method: http.MethodPost,	Path: "{customerId}/erasure",	Handler: StartErasure},
+	},
+	draftPrefix: {
+		{ Name: "CreateDraft",	Method: http.MethodPost,	Path: "create",			Handler: CreateDraft},
+		{ Name: "GetDraft",	Method: http.MethodGet,		Path: "{draftId}",		Handler: GetDraft},
+		{ Name: "EditDraft",	Method: http.MethodPatch,	Path: "{draftId}",		Handler: EditDraft},
+		{ Name: "DeleteDraft",	Method: http.MethodDelete,	Path: "{draftId}",		Handler: DeleteDraft},
+		{ Name: "QuoteDraft",	Method: http.MethodPost,	Path: "{draftId}/quote",	Handler: QuoteDraft},
+		{ Name: "CheckoutDraft",	Method: http.MethodPost,	Path: "{draftId}/checkout",	Handler: CheckoutDraft},
+	},
+	adminPrefix: {
+		{ Name: "GetDrain",	Method: http.MethodGet,		Path: "drain",			Handler: GetDrain},
+		{ Name: "StartDrain",	Method: http.MethodPost,	Path: "drain",			Handler: StartDrain},
+		{ Name: "StopDrain",	Method: http.MethodDelete,	Path: "drain",			Handler: StopDrain},
+		{ Name: "GetMaintenance",	Method: http.MethodGet,	Path: "maintenance",		Handler: GetMaintenance},
+		{ Name: "SetMaintenance",	Method: http.MethodPut,	Path: "maintenance",		Handler: SetMaintenance},
+		{ Name: "GetLogLevel",	Method: http.MethodGet,		Path: "loglevel",		Handler: GetLogLevel},
+		{ Name: "SetLogLevel",	Method: http.MethodPut,		Path: "loglevel",		Handler: SetLogLevel},
+		{ Name: "DumpConfig",	Method: http.MethodGet,		Path: "config",			Handler: GetConfig},
+		{ Name: "ListRoutes",	Method: http.MethodGet,		Path: "routes",			Handler: ListRoutes},
+		{ Name: "IssueCSRFToken",	Method: http.MethodGet,	Path: "csrf",			Handler: IssueCSRFToken},
+		{ Name: "ListSlowRequests",	Method: http.MethodGet,	Path: "slow-requests",		Handler: ListSlowRequests},
+		{ Name: "ResetSlowRequests",	Method: http.MethodDelete,	Path: "slow-requests",		Handler: ResetSlowRequests},
+		{ Name: "GetCapacity",	Method: http.MethodGet,		Path: "capacity",		Handler: GetCapacity},
+		{ Name: "ResetCapacity",	Method: http.MethodDelete,	Path: "capacity",		Handler: ResetCapacity},
+		{ Name: "RotateHostKey",	Method: http.MethodPost,	Path: "hosts/{hostId}/key",	Handler: RotateHostKey},
+		{ Name: "StartReseal",	Method: http.MethodPost,	Path: "encryption/reseal",	Handler: StartReseal},
+		{ Name: "ListTasks",	Method: http.MethodGet,		Path: "schedules",		Handler: ListTasks},
+		{ Name: "ListDeadLetters",	Method: http.MethodGet,		Path: "dead-letters",		Handler: ListDeadLetters},
+		{ Name: "ReplayDeadLetters",	Method: http.MethodPost,	Path: "dead-letters/replay",	Handler: ReplayDeadLetters},
+		{ Name: "GetDeadLetter",	Method: http.MethodGet,		Path: "dead-letters/{letterId}",	Handler: GetDeadLetter},
+		{ Name: "ReplayDeadLetter",	Method: http.MethodPost,	Path: "dead-letters/{letterId}/replay",	Handler: ReplayDeadLetter},
+		{ Name: "DeleteDeadLetter",	Method: http.MethodDelete,	Path: "dead-letters/{letterId}",	Handler: DeleteDeadLetter},
+		{ Name: "ListSagas",	Method: http.MethodGet,		Path: "sagas",			Handler: ListSagas},
+		{ Name: "GetSaga",	Method: http.MethodGet,		Path: "sagas/{sagaId}",		Handler: GetSaga},
+		{ Name: "DebugVars",	Method: http.MethodGet,		Path: "debug/vars",		Handler: DebugVars},
+		{ Name: "DumpGoroutines",	Method: http.MethodGet,	Path: "debug/dump/goroutines",	Handler: DumpGoroutines},
+		{ Name: "DumpHeap",	Method: http.MethodGet,		Path: "debug/dump/heap",	Handler: DumpHeap},
+		{ Name: "PprofCmdline",	Method: http.MethodGet,		Path: "debug/pprof/cmdline",	Handler: PprofCmdline},
+		{ Name: "PprofProfile",	Method: http.MethodGet,		Path: "debug/pprof/profile",	Handler: PprofProfile},
+		{ Name: "PprofSymbol",	Method: http.MethodGet,		Path: "debug/pprof/symbol",	Handler: PprofSymbol},
+		{ Name: "PprofSymbolLookup",	Method: http.MethodPost,	Path: "debug/pprof/symbol",	Handler: PprofSymbol},
+		{ Name: "PprofTrace",	Method: http.MethodGet,		Path: "debug/pprof/trace",	Handler: PprofTrace},
+		{ Name: "PprofIndex",	Method: http.MethodGet,		Path: "debug/pprof/{profile}",	Handler: PprofIndex},
+		{ Name: "PprofProfiles",	Method: http.MethodGet,	Path: "debug/pprof/",		Handler: PprofIndex},
+	},
+	schedulePrefix: {
+		{ Name: "CreateSchedule",	Method: http.MethodPost,	Path: "create",			Handler: CreateSchedule},
+		{ Name: "GetSchedule",	Method: http.MethodGet,		Path: "{scheduleId}",		Handler: GetSchedule},
+		{ Name: "PauseSchedule",	Method: http.MethodPost,	Path: "{scheduleId}/pause",	Handler: PauseSchedule},
+		{ Name: "ResumeSchedule",	Method: http.MethodPost,	Path: "{scheduleId}/resume",	Handler: ResumeSchedule},
+		{ Name: "CancelSchedule",	Method: http.MethodPost,	Path: "{scheduleId}/cancel",	Handler: CancelSchedule},
+	},
+	hostPrefix: {
+		{ Name: "RegisterHost",	Method: http.MethodPost,	Path: "register",		Handler: RegisterHost},
+		{ Name: "ListHosts",	Method: http.MethodGet,		Path: "list",			Handler: ListHosts},
+		{ Name: "GetHost",	Method: http.MethodGet,		Path: "{hostId}",		Handler: GetHost},
+		{ Name: "DeregisterHost",	Method: http.MethodDelete,	Path: "{hostId}",		Handler: DeregisterHost},
+		{ Name: "HeartbeatHost",	Method: http.MethodPost,	Path: "{hostId}/heartbeat",	Handler: HeartbeatHost},
+	},
+	warehousePrefix: {
+		{ Name: "CreateWarehouse",	Method: http.MethodPost,	Path: "create",			Handler: CreateWarehouse},
+		{ Name: "ListWarehouses",	Method: http.MethodGet,		Path: "list",			Handler: ListWarehouses},
+		{ Name: "GetWarehouse",	Method: http.MethodGet,		Path: "{warehouseId}",		Handler: GetWarehouse},
+		{ Name: "UpdateWarehouse",	Method: http.MethodPut,		Path: "{warehouseId}",		Handler: UpdateWarehouse},
+		{ Name: "DeleteWarehouse",	Method: http.MethodDelete,	Path: "{warehouseId}",		Handler: DeleteWarehouse},
+		{ Name: "UpdateWarehouseStock",	Method: http.MethodPut,	Path: "{warehouseId}/stock",	Handler: UpdateWarehouseStock},
+	},
+	trackPrefix: {
+		{ Name: "TrackOrder",	Method: http.MethodGet,		Path: "{trackingToken}",	Handler: TrackOrder},
+	},
+	agentPrefix: {
+		{ Name: "ConfirmFulfillment",	Method: http.MethodPost,	Path: "confirmations",		Handler: ConfirmFulfillment},
+		{ Name: "BatchConfirmFulfillment",	Method: http.MethodPost,	Path: "confirmations/batch",	Handler: BatchConfirmFulfillment},
 	},
 }
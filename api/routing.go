@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/routing"
+)
+
+// customStrategy names the routing of the strategy set with SetRoutingStrategy
+const customStrategy = "custom"
+
+// Allocation is a quantity of a SKU of an order a warehouse ships
+type Allocation struct {
+	WarehouseID string `json:"warehouseId" dynamodbav:"warehouseId"`
+	SKU         string `json:"sku" dynamodbav:"sku"`
+	Quantity    int    `json:"quantity" dynamodbav:"quantity"`
+}
+
+// OrderRouting assigns the items of an order to the warehouses shipping them
+type OrderRouting struct {
+	// Strategy is the strategy that routed the order
+	Strategy    string       `json:"strategy" dynamodbav:"strategy"`
+	Allocations []Allocation `json:"allocations" dynamodbav:"allocations"`
+	RoutedAt    time.Time    `json:"routedAt" dynamodbav:"routedAt"`
+}
+
+// routes reports whether r allocates items to the warehouse with id
+func (r *OrderRouting) routes(id string) bool {
+	for _, a := range r.Allocations {
+		if a.WarehouseID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Router routes the items of confirmed orders to the warehouses of the
+// repository with a strategy
+type Router struct {
+	strategy routing.Strategy
+	name     string
+	// priorities names the strategies routing the orders of a priority
+	// instead of strategy
+	priorities map[Priority]string
+	strategies map[string]routing.Strategy
+}
+
+// NewRouter returns the router with the strategy of cfg, and those of the
+// priorities of cfg
+func NewRouter(cfg *config.RoutingConfig) (*Router, error) {
+	strategy, err := routing.New(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	r := &Router{
+		strategy:   strategy,
+		name:       cfg.Strategy,
+		priorities: map[Priority]string{},
+		strategies: map[string]routing.Strategy{cfg.Strategy: strategy},
+	}
+	for priority, name := range cfg.Priorities {
+		if _, ok := r.strategies[name]; !ok {
+			if r.strategies[name], err = routing.New(name); err != nil {
+				return nil, err
+			}
+		}
+		r.priorities[Priority(priority)] = name
+	}
+	return r, nil
+}
+
+// strategyFor returns the strategy routing order and its name, the one of its
+// priority unless SetRoutingStrategy replaced the strategies of the
+// configuration
+func (r *Router) strategyFor(order *Order) (routing.Strategy, string) {
+	if r.name == customStrategy {
+		return r.strategy, r.name
+	}
+	if name, ok := r.priorities[order.Priority.orStandard()]; ok {
+		return r.strategies[name], name
+	}
+	return r.strategy, r.name
+}
+
+type routerKey struct{}
+
+// WithRouter returns a copy of ctx carrying router
+func WithRouter(ctx context.Context, router *Router) context.Context {
+	return context.WithValue(ctx, routerKey{}, router)
+}
+
+// RouterFromContext returns the router stored in ctx, or nil when orders are
+// not routed
+func RouterFromContext(ctx context.Context) *Router {
+	router, _ := ctx.Value(routerKey{}).(*Router)
+	return router
+}
+
+// routingRequest returns the request routing order to warehouses
+func routingRequest(order *Order, warehouses []*Warehouse) *routing.Request {
+	req := &routing.Request{OrderID: order.ID, Priority: string(order.Priority.orStandard())}
+	for _, item := range order.Items {
+		req.Items = append(req.Items, routing.Item{SKU: item.SKU, Quantity: item.Quantity})
+	}
+	if a := order.ShippingAddress; a != nil {
+		req.Destination = &routing.Destination{Country: a.Country, PostalCode: a.PostalCode}
+	}
+	for _, w := range warehouses {
+		req.Warehouses = append(req.Warehouses, &routing.Warehouse{
+			ID:           w.ID,
+			Country:      w.Address.Country,
+			PostalCode:   w.Address.PostalCode,
+			Stock:        w.Stock,
+			ShipmentCost: w.ShipmentCost,
+			UnitCost:     w.UnitCost,
+		})
+	}
+	return req
+}
+
+// route assigns the items of order to the warehouses of repo with strategy,
+// named name, and records the assignment in the order
+func (r *Router) route(ctx context.Context, repo Repository, order *Order, strategy routing.Strategy, name string) error {
+	store, ok := findWarehouseStore(repo)
+	if !ok {
+		return ErrNotSupported
+	}
+	warehouses, err := store.ListWarehouses(ctx)
+	if err != nil {
+		routedOrders.WithLabelValues("failed").Inc()
+		return err
+	}
+	allocations, err := strategy.Route(ctx, routingRequest(order, warehouses))
+	if errors.Is(err, routing.ErrUnroutable) {
+		routedOrders.WithLabelValues("unroutable").Inc()
+		return err
+	}
+	if err != nil {
+		routedOrders.WithLabelValues("failed").Inc()
+		return err
+	}
+	routedOrders.WithLabelValues("routed").Inc()
+	result := &OrderRouting{Strategy: name, RoutedAt: time.Now().UTC()}
+	for _, a := range allocations {
+		result.Allocations = append(result.Allocations, Allocation{WarehouseID: a.WarehouseID, SKU: a.SKU, Quantity: a.Quantity})
+	}
+	order.Routing = result
+	return nil
+}
+
+// routeConfirmed routes order, which is confirmed or whose items changed, with
+// the router of ctx if orders are routed. The order is confirmed all the same
+// when it can not be routed, it is left without a routing until a route job,
+// queued with queueRouting once the order is stored, or RouteOrder routes it
+// again.
+func routeConfirmed(ctx context.Context, repo Repository, order *Order) {
+	router := RouterFromContext(ctx)
+	if router == nil {
+		return
+	}
+	strategy, name := router.strategyFor(order)
+	if err := router.route(ctx, repo, order, strategy, name); err != nil {
+		LoggerFromContext(ctx).Warnf("failed to route order %s: %v", order.ID, err)
+		order.Routing = nil
+	}
+}
+
+// routeOrderRequest is the optional body of RouteOrder
+type routeOrderRequest struct {
+	// Strategy overrides the strategy of the configuration and of the
+	// priority of the order
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// fulfillmentItem is a quantity of a SKU a warehouse ships
+type fulfillmentItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// warehouseFulfillment is the part of an order a warehouse ships
+type warehouseFulfillment struct {
+	WarehouseID string            `json:"warehouseId"`
+	Items       []fulfillmentItem `json:"items"`
+	// ShipmentIDs are the shipments of the order that left the warehouse
+	ShipmentIDs []string `json:"shipmentIds,omitempty"`
+	// PickedAt and PackedAt are the times of the last pick and pack the agents
+	// of the warehouse confirmed
+	PickedAt *time.Time `json:"pickedAt,omitempty"`
+	PackedAt *time.Time `json:"packedAt,omitempty"`
+}
+
+// fulfillmentResponse is the routing of an order by warehouse
+type fulfillmentResponse struct {
+	OrderID    string                 `json:"orderId"`
+	Status     Status                 `json:"status"`
+	Strategy   string                 `json:"strategy,omitempty"`
+	RoutedAt   *time.Time             `json:"routedAt,omitempty"`
+	Warehouses []warehouseFulfillment `json:"warehouses"`
+}
+
+// newFulfillmentResponse groups the allocations of order by warehouse, in the
+// order they were made
+func newFulfillmentResponse(order *Order) *fulfillmentResponse {
+	resp := &fulfillmentResponse{OrderID: order.ID, Status: order.Status, Warehouses: []warehouseFulfillment{}}
+	if order.Routing == nil {
+		return resp
+	}
+	resp.Strategy = order.Routing.Strategy
+	routedAt := order.Routing.RoutedAt
+	resp.RoutedAt = &routedAt
+	index := map[string]int{}
+	for _, a := range order.Routing.Allocations {
+		i, ok := index[a.WarehouseID]
+		if !ok {
+			i = len(resp.Warehouses)
+			index[a.WarehouseID] = i
+			resp.Warehouses = append(resp.Warehouses, warehouseFulfillment{WarehouseID: a.WarehouseID})
+		}
+		resp.Warehouses[i].Items = append(resp.Warehouses[i].Items, fulfillmentItem{SKU: a.SKU, Quantity: a.Quantity})
+	}
+	for _, shipment := range order.Shipments {
+		if i, ok := index[shipment.WarehouseID]; ok {
+			resp.Warehouses[i].ShipmentIDs = append(resp.Warehouses[i].ShipmentIDs, shipment.ID)
+		}
+	}
+	for _, confirmation := range order.Confirmations {
+		i, ok := index[confirmation.WarehouseID]
+		if !ok {
+			continue
+		}
+		at := confirmation.OccurredAt
+		fulfillment := &resp.Warehouses[i]
+		switch confirmation.Type {
+		case ConfirmationPick:
+			if fulfillment.PickedAt == nil || at.After(*fulfillment.PickedAt) {
+				fulfillment.PickedAt = &at
+			}
+		case ConfirmationPack:
+			if fulfillment.PackedAt == nil || at.After(*fulfillment.PackedAt) {
+				fulfillment.PackedAt = &at
+			}
+		}
+	}
+	return resp
+}
+
+// GetFulfillment returns the warehouses the order named in the path is routed
+// to, the items each of them ships, the picks and packs its agents confirmed
+// and the shipments that left it
+func GetFulfillment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	order, err := RepositoryFromContext(ctx).GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newFulfillmentResponse(order))
+}
+
+// RouteOrder routes the order named in the path again, with the strategy of
+// the body or that of the configuration for its priority, such as after the stock of the
+// warehouses changed. Held orders are routed once they are released.
+func RouteOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	router := RouterFromContext(ctx)
+	if router == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	var req routeOrderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	var strategy routing.Strategy
+	var name string
+	if req.Strategy != "" {
+		var err error
+		if strategy, err = routing.New(req.Strategy); err != nil {
+			writeError(w, r, &ValidationError{Field: "strategy", Reason: err.Error()})
+			return
+		}
+		name = req.Strategy
+	}
+
+	id := mux.Vars(r)["orderId"]
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if order.Status != StatusPending && order.Status != StatusPaid {
+		writeError(w, r, ErrNotShippable)
+		return
+	}
+	if strategy == nil {
+		strategy, name = router.strategyFor(order)
+	}
+	if err := router.route(ctx, repo, order, strategy, name); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	order.UpdatedAt = time.Now().UTC()
+	if err := repo.UpdateOrder(ctx, order); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("routed order %s with the %s strategy", order.ID, name)
+	writeJSON(w, r, http.StatusOK, newFulfillmentResponse(order))
+}
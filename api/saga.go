@@ -0,0 +1,502 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/payments"
+)
+
+var (
+	// ErrSagaNotFound is returned when no saga places the requested order
+	ErrSagaNotFound = errors.New("saga not found")
+	// ErrSagaExists is returned when an order is placed while a saga still
+	// places an order with its id
+	ErrSagaExists = errors.New("order is being placed")
+)
+
+// the steps of the saga placing an order, in the order they run
+const (
+	SagaReserveInventory = "reserve_inventory"
+	SagaRedeemTenders    = "redeem_tenders"
+	SagaAuthorizePayment = "authorize_payment"
+	SagaConfirmOrder     = "confirm_order"
+)
+
+// the outcomes of the sagas
+const (
+	sagaCompleted   = "completed"
+	sagaCompensated = "compensated"
+)
+
+const (
+	// defaultSagaLimit is the number of sagas listed unless the request asks for fewer
+	defaultSagaLimit = 100
+	// maxSagaLimit bounds the sagas listed, and those recovered by a run of the recovery
+	maxSagaLimit = 1000
+)
+
+// SagaState is the state of a saga in flight, a finished saga is removed
+type SagaState string
+
+const (
+	// SagaRunning is the state of a saga running its steps
+	SagaRunning SagaState = "running"
+	// SagaCompensating is the state of a saga undoing the steps it started, as
+	// one failed or as its instance abandoned it
+	SagaCompensating SagaState = "compensating"
+)
+
+// SagaStep is the progress of a step of a saga
+type SagaStep struct {
+	Name      string    `json:"name" dynamodbav:"name"`
+	StartedAt time.Time `json:"startedAt" dynamodbav:"startedAt"`
+	// Done is set once the step completed. A step started and not done may
+	// have taken effect or not, it is compensated all the same.
+	Done        bool `json:"done,omitempty" dynamodbav:"done,omitempty"`
+	Compensated bool `json:"compensated,omitempty" dynamodbav:"compensated,omitempty"`
+}
+
+// Saga is the stored progress of the placement of an order: its stock is
+// reserved, its tenders redeemed, its payment authorized and the order
+// confirmed in steps, the steps
+// started are undone when a later one fails or the saga is abandoned
+type Saga struct {
+	// ID is the id of the order placed, its reservation and payment are named after it
+	ID    string      `json:"id" dynamodbav:"sagaId"`
+	State SagaState   `json:"state" dynamodbav:"state"`
+	Steps []*SagaStep `json:"steps" dynamodbav:"steps"`
+	// Tenders are the gift cards and store credit the order redeems, their
+	// redemptions are reversed by their idempotency keys
+	Tenders []Tender `json:"tenders,omitempty" dynamodbav:"tenders,omitempty"`
+	// CustomerID, Amount, Currency and PaymentMethod authorize the payment
+	// again, which returns the same payment, when the saga was abandoned before
+	// it recorded PaymentID. Amount is the part of the total the tenders leave
+	// to the card or the account of the customer.
+	CustomerID    string      `json:"customerId,omitempty" dynamodbav:"customerId,omitempty"`
+	Amount        money.Money `json:"amount" dynamodbav:"amount"`
+	Currency      string      `json:"currency,omitempty" dynamodbav:"currency,omitempty"`
+	PaymentMethod string      `json:"-" dynamodbav:"paymentMethod,omitempty"`
+	PaymentID     string      `json:"paymentId,omitempty" dynamodbav:"paymentId,omitempty"`
+	// LastError is the error of the failed step, or of the failed compensation
+	LastError string `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+	// Attempts counts the compensations that failed
+	Attempts  int       `json:"attempts,omitempty" dynamodbav:"attempts,omitempty"`
+	StartedAt time.Time `json:"startedAt" dynamodbav:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	// Version is incremented by every update and guards against two instances
+	// moving the saga on
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// SagaStore is implemented by repositories that keep sagas. Its methods fail
+// with ErrNotSupported until EnableSagas is called.
+type SagaStore interface {
+	// CreateSaga stores a new saga, or fails with ErrSagaExists
+	CreateSaga(ctx context.Context, saga *Saga) error
+	// GetSaga returns the saga with id, or ErrSagaNotFound
+	GetSaga(ctx context.Context, id string) (*Saga, error)
+	// UpdateSaga replaces a saga if its stored version equals saga.Version,
+	// incrementing saga.Version. It fails with ErrSagaNotFound or
+	// ErrVersionConflict.
+	UpdateSaga(ctx context.Context, saga *Saga) error
+	// DeleteSaga removes the saga with id, or fails with ErrSagaNotFound
+	DeleteSaga(ctx context.Context, id string) error
+	// ListSagas returns up to limit sagas, the longest in flight first
+	ListSagas(ctx context.Context, limit int) ([]*Saga, error)
+}
+
+// sagasEnabler is implemented by repositories able to keep sagas
+type sagasEnabler interface {
+	enableSagas(table string)
+}
+
+// EnableSagas makes repo keep sagas, in table for the backends that keep them
+// in a separate table
+func EnableSagas(repo Repository, table string) error {
+	enabler, ok := repo.(sagasEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support sagas", repo)
+	}
+	enabler.enableSagas(table)
+	return nil
+}
+
+// findSagaStore returns the saga store of repo or of the repository it decorates
+func findSagaStore(repo Repository) (SagaStore, bool) {
+	var store SagaStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(SagaStore)
+		return ok
+	})
+	return store, found
+}
+
+// sortSagas orders sagas by the time they started, oldest first
+func sortSagas(sagas []*Saga) {
+	sort.Slice(sagas, func(i, j int) bool {
+		if !sagas[i].StartedAt.Equal(sagas[j].StartedAt) {
+			return sagas[i].StartedAt.Before(sagas[j].StartedAt)
+		}
+		return sagas[i].ID < sagas[j].ID
+	})
+}
+
+// SagaCoordinator places new orders as sagas and compensates the sagas their
+// instances abandoned
+type SagaCoordinator struct {
+	repo   Repository
+	store  SagaStore
+	cfg    config.SagaConfig
+	logger logging.Logger
+}
+
+// NewSagaCoordinator returns a coordinator placing the orders of repo, keeping
+// its sagas in store
+func NewSagaCoordinator(repo Repository, store SagaStore, cfg *config.SagaConfig, logger logging.Logger) *SagaCoordinator {
+	return &SagaCoordinator{repo: repo, store: store, cfg: *cfg, logger: logger}
+}
+
+// place reserves the stock of the new order with the inventory client of ctx,
+// redeems its tenders and authorizes its payment with paymentMethod and the
+// payments of ctx and creates it, as the steps of a saga. A failed step compensates those started
+// before it; when the compensation fails too the saga is left to the recovery.
+// The payment of the placed order is captured once the saga finished.
+func (c *SagaCoordinator) place(ctx context.Context, repo Repository, order *Order, paymentMethod string) (*Order, error) {
+	now := time.Now().UTC()
+	saga := &Saga{
+		ID:            order.ID,
+		State:         SagaRunning,
+		Tenders:       order.Tenders,
+		CustomerID:    order.CustomerID,
+		Amount:        order.cardAmount(),
+		Currency:      order.Currency,
+		PaymentMethod: paymentMethod,
+		StartedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := c.store.CreateSaga(ctx, saga); err != nil {
+		return nil, err
+	}
+
+	if stock := InventoryFromContext(ctx); stock != nil {
+		if err := c.run(ctx, saga, SagaReserveInventory, func() error { return reserveStock(ctx, stock, order) }); err != nil {
+			return nil, err
+		}
+	}
+	pay := PaymentsFromContext(ctx)
+	if pay != nil && len(order.Tenders) > 0 {
+		if err := c.run(ctx, saga, SagaRedeemTenders, func() error { return pay.redeemTenders(ctx, order) }); err != nil {
+			return nil, err
+		}
+	}
+	var declined error
+	if pay != nil && (saga.Amount.Cmp(money.New(0, order.Currency)) > 0 || len(order.Tenders) == 0) {
+		err := c.run(ctx, saga, SagaAuthorizePayment, func() error {
+			if err := pay.authorize(ctx, order, paymentMethod); err != nil {
+				return err
+			}
+			saga.PaymentID = order.Payment.ID
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if order.Payment.Status == payments.StatusFailed {
+			// the declined order is kept cancelled, without its stock
+			declined = declinePayment(ctx, order)
+		}
+	}
+	if err := c.run(ctx, saga, SagaConfirmOrder, func() error { return repo.CreateOrder(ctx, order) }); err != nil {
+		return nil, err
+	}
+	c.finish(ctx, saga, sagaCompleted)
+	LoggerFromContext(ctx).Infof("created order %s", order.ID)
+	if declined != nil {
+		return order, declined
+	}
+	if pay != nil {
+		// a held order keeps its payment authorized until it is released
+		if err := pay.capture(ctx, order); err != nil {
+			return nil, err
+		}
+		return settlePayment(ctx, repo, order)
+	}
+	return order, nil
+}
+
+// run records the start of the step name of saga, and the end of the step
+// before, and runs the step with fn. A failed step aborts the saga.
+func (c *SagaCoordinator) run(ctx context.Context, saga *Saga, name string, fn func() error) error {
+	saga.Steps = append(saga.Steps, &SagaStep{Name: name, StartedAt: time.Now().UTC()})
+	saga.UpdatedAt = time.Now().UTC()
+	if err := c.store.UpdateSaga(ctx, saga); err != nil {
+		// taken over by the recovery, which compensates the steps before
+		return fmt.Errorf("failed to record step %s of the saga of order %s: %w", name, saga.ID, err)
+	}
+	if err := fn(); err != nil {
+		return c.abort(ctx, saga, err)
+	}
+	saga.Steps[len(saga.Steps)-1].Done = true
+	return nil
+}
+
+// abort compensates the steps saga started as one failed with cause, and
+// returns cause. A saga whose compensation failed is stored for the recovery.
+func (c *SagaCoordinator) abort(ctx context.Context, saga *Saga, cause error) error {
+	if errors.Is(cause, ErrOrderExists) {
+		// a retried command, the stock and payment are those of the existing order
+		c.finish(ctx, saga, sagaCompleted)
+		return cause
+	}
+	saga.State = SagaCompensating
+	saga.LastError = cause.Error()
+	if err := c.compensate(ctx, saga); err != nil {
+		c.failed(ctx, saga, err)
+		return cause
+	}
+	c.finish(ctx, saga, sagaCompensated)
+	return cause
+}
+
+// compensate undoes the steps saga started, the latest first. The steps that
+// are compensated already are skipped, every compensation may run again.
+func (c *SagaCoordinator) compensate(ctx context.Context, saga *Saga) error {
+	for i := len(saga.Steps) - 1; i >= 0; i-- {
+		step := saga.Steps[i]
+		if step.Compensated {
+			continue
+		}
+		var err error
+		switch step.Name {
+		case SagaReserveInventory:
+			err = c.releaseStock(ctx, saga)
+		case SagaRedeemTenders:
+			err = c.reverseTenders(ctx, saga)
+		case SagaAuthorizePayment:
+			err = c.voidPayment(ctx, saga)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to compensate step %s: %v", step.Name, err)
+		}
+		step.Compensated = true
+	}
+	return nil
+}
+
+// releaseStock releases the reservation of the order of saga, if it was made
+func (c *SagaCoordinator) releaseStock(ctx context.Context, saga *Saga) error {
+	stock := InventoryFromContext(ctx)
+	if stock == nil {
+		return fmt.Errorf("inventory is not enabled")
+	}
+	return stock.Release(ctx, saga.ID)
+}
+
+// reverseTenders reverses the redemptions of the tenders of the order of saga,
+// those that were made
+func (c *SagaCoordinator) reverseTenders(ctx context.Context, saga *Saga) error {
+	pay := PaymentsFromContext(ctx)
+	if pay == nil || pay.GiftCards == nil {
+		return fmt.Errorf("gift cards are not enabled")
+	}
+	return pay.reverseTenders(ctx, saga.ID, saga.Tenders)
+}
+
+// voidPayment voids the authorized payment of the order of saga. Without the
+// id of the payment it is authorized again, which returns the payment if the
+// saga authorized it.
+func (c *SagaCoordinator) voidPayment(ctx context.Context, saga *Saga) error {
+	pay := PaymentsFromContext(ctx)
+	if pay == nil {
+		return fmt.Errorf("payments are not enabled")
+	}
+	if saga.PaymentID == "" {
+		order := &Order{ID: saga.ID, CustomerID: saga.CustomerID, Currency: saga.Currency, Total: saga.Amount}
+		if err := pay.authorize(ctx, order, saga.PaymentMethod); err != nil {
+			return err
+		}
+		if order.Payment.Status == payments.StatusFailed {
+			return nil
+		}
+		saga.PaymentID = order.Payment.ID
+	}
+	result, err := pay.provider(saga.PaymentMethod).Void(ctx, saga.PaymentID, saga.ID+"-void")
+	if err != nil {
+		return err
+	}
+	if result.Status == payments.StatusFailed {
+		return fmt.Errorf("payment provider refused the void: %s", result.FailureReason)
+	}
+	return nil
+}
+
+// failed records that the compensation of saga failed with err, for the
+// recovery to compensate it again
+func (c *SagaCoordinator) failed(ctx context.Context, saga *Saga, err error) {
+	saga.Attempts++
+	saga.LastError = err.Error()
+	saga.UpdatedAt = time.Now().UTC()
+	sagaCompensationFailures.Inc()
+	c.logger.Errorf("failed to compensate the saga of order %s, attempt %d: %v", saga.ID, saga.Attempts, err)
+	if saveErr := c.store.UpdateSaga(ctx, saga); saveErr != nil && !errors.Is(saveErr, ErrVersionConflict) {
+		c.logger.Errorf("failed to record the compensation of the saga of order %s: %v", saga.ID, saveErr)
+	}
+}
+
+// finish removes the finished saga
+func (c *SagaCoordinator) finish(ctx context.Context, saga *Saga, outcome string) {
+	if err := c.store.DeleteSaga(ctx, saga.ID); err != nil && !errors.Is(err, ErrSagaNotFound) {
+		// the recovery removes it once it is stale
+		c.logger.Errorf("failed to remove the saga of order %s: %v", saga.ID, err)
+	}
+	sagasFinished.WithLabelValues(outcome).Inc()
+	if outcome == sagaCompensated {
+		c.logger.Warnf("compensated the saga of order %s: %s", saga.ID, saga.LastError)
+	}
+}
+
+// sagaRecovery is the result of a run of the sagas task
+type sagaRecovery struct {
+	Completed   int `json:"completed"`
+	Compensated int `json:"compensated"`
+	Failed      int `json:"failed"`
+}
+
+// RunOnce recovers the sagas without progress for sagas.staleAfter at now: a
+// saga whose order was created is completed, the others are compensated
+func (c *SagaCoordinator) RunOnce(ctx context.Context, now time.Time) (*sagaRecovery, error) {
+	sagas, err := c.store.ListSagas(ctx, maxSagaLimit)
+	if err != nil {
+		return nil, err
+	}
+	res := &sagaRecovery{}
+	for _, saga := range sagas {
+		if now.Sub(saga.UpdatedAt) < c.cfg.StaleAfter.Duration {
+			continue
+		}
+		outcome, err := c.recover(ctx, saga, now)
+		switch {
+		case err != nil:
+			res.Failed++
+			c.failed(ctx, saga, err)
+		case outcome == sagaCompleted:
+			res.Completed++
+		case outcome == sagaCompensated:
+			res.Compensated++
+		}
+	}
+	return res, nil
+}
+
+// recover takes over the abandoned saga and finishes it, returning its outcome,
+// or none when another instance moved it on
+func (c *SagaCoordinator) recover(ctx context.Context, saga *Saga, now time.Time) (string, error) {
+	saga.State = SagaCompensating
+	saga.UpdatedAt = now
+	if err := c.store.UpdateSaga(ctx, saga); err != nil {
+		if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrSagaNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	order, err := c.repo.GetOrder(ctx, saga.ID)
+	if err == nil {
+		// confirmed before the saga was abandoned, only its payment is left
+		if pay := PaymentsFromContext(ctx); pay != nil && order.Payment != nil {
+			if err := pay.capture(ctx, order); err != nil {
+				return "", err
+			}
+			if _, err := settlePayment(ctx, c.repo, order); err != nil && !errors.Is(err, ErrPaymentDeclined) {
+				return "", err
+			}
+		}
+		c.finish(ctx, saga, sagaCompleted)
+		c.logger.Infof("completed the abandoned saga of order %s", saga.ID)
+		return sagaCompleted, nil
+	}
+	if !errors.Is(err, ErrOrderNotFound) {
+		return "", err
+	}
+	if saga.LastError == "" {
+		saga.LastError = "abandoned"
+	}
+	if err := c.compensate(ctx, saga); err != nil {
+		return "", err
+	}
+	c.finish(ctx, saga, sagaCompensated)
+	return sagaCompensated, nil
+}
+
+type sagasKey struct{}
+
+// WithSagas returns a copy of ctx carrying the saga coordinator
+func WithSagas(ctx context.Context, coordinator *SagaCoordinator) context.Context {
+	return context.WithValue(ctx, sagasKey{}, coordinator)
+}
+
+// SagasFromContext returns the saga coordinator stored in ctx, or nil when new
+// orders are not placed as sagas
+func SagasFromContext(ctx context.Context) *SagaCoordinator {
+	coordinator, _ := ctx.Value(sagasKey{}).(*SagaCoordinator)
+	return coordinator
+}
+
+// sagasResponse lists sagas
+type sagasResponse struct {
+	Sagas []*Saga `json:"sagas"`
+}
+
+// ListSagas returns the sagas in flight, the longest in flight first, up to limit
+func ListSagas(w http.ResponseWriter, r *http.Request) {
+	coordinator := SagasFromContext(r.Context())
+	if coordinator == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	limit := defaultSagaLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxSagaLimit {
+			writeError(w, r, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", maxSagaLimit)})
+			return
+		}
+		limit = n
+	}
+	sagas, err := coordinator.store.ListSagas(r.Context(), limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if sagas == nil {
+		sagas = []*Saga{}
+	}
+	writeJSON(w, r, http.StatusOK, &sagasResponse{Sagas: sagas})
+}
+
+// GetSaga returns the saga in flight placing the order named in the path
+func GetSaga(w http.ResponseWriter, r *http.Request) {
+	coordinator := SagasFromContext(r.Context())
+	if coordinator == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	saga, err := coordinator.store.GetSaga(r.Context(), mux.Vars(r)["sagaId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, saga)
+}
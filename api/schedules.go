@@ -0,0 +1,505 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/inventory"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/schedule"
+)
+
+var (
+	// ErrScheduleNotFound is returned when no schedule has the requested id
+	ErrScheduleNotFound = errors.New("schedule not found")
+	// ErrScheduleFinished is returned when changing a schedule that is cancelled or completed
+	ErrScheduleFinished = errors.New("schedule is cancelled or completed")
+)
+
+// ScheduleStatus is the state of a schedule
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "active"
+	SchedulePaused    ScheduleStatus = "paused"
+	ScheduleCancelled ScheduleStatus = "cancelled"
+	// ScheduleCompleted marks a one-off schedule that placed its order
+	ScheduleCompleted ScheduleStatus = "completed"
+)
+
+const (
+	// maxRunAttempts is the number of polls a run failing for a transient reason is
+	// attempted at before it is skipped
+	maxRunAttempts = 3
+	// maxFailedRuns is the number of runs in a row that may fail before the
+	// schedule is paused
+	maxFailedRuns = 3
+	// scheduleBatchSize is the number of due schedules read per poll
+	scheduleBatchSize = 100
+)
+
+// ScheduleRun is the outcome of placing the order of a schedule
+type ScheduleRun struct {
+	// At is the time the order was due
+	At      time.Time `json:"at" dynamodbav:"at"`
+	OrderID string    `json:"orderId,omitempty" dynamodbav:"orderId,omitempty"`
+	Error   string    `json:"error,omitempty" dynamodbav:"error,omitempty"`
+}
+
+// Schedule places orders of a customer in the future: once at NextRunAt, or
+// recurring at the times of the Cron expression in Timezone
+type Schedule struct {
+	ID         string         `json:"id" dynamodbav:"scheduleId"`
+	CustomerID string         `json:"customerId" dynamodbav:"customerId"`
+	Status     ScheduleStatus `json:"status" dynamodbav:"status"`
+	// Cron is the cron expression of a recurring schedule, empty for a one-off one
+	Cron string `json:"cron,omitempty" dynamodbav:"cron,omitempty"`
+	// Timezone is the IANA time zone the cron expression is read in, UTC by default
+	Timezone        string     `json:"timezone,omitempty" dynamodbav:"timezone,omitempty"`
+	Items           []LineItem `json:"items" dynamodbav:"items"`
+	ShippingAddress *Address   `json:"shippingAddress,omitempty" dynamodbav:"shippingAddress,omitempty"`
+	DiscountCodes   []string   `json:"discountCodes,omitempty" dynamodbav:"discountCodes,omitempty"`
+	PaymentMethod   string     `json:"paymentMethod,omitempty" dynamodbav:"paymentMethod,omitempty"`
+	// NextRunAt is the time the next order is placed at, in UTC to the second
+	NextRunAt time.Time `json:"nextRunAt" dynamodbav:"nextRunAt"`
+	// Runs counts the orders placed
+	Runs    int          `json:"runs" dynamodbav:"runs"`
+	LastRun *ScheduleRun `json:"lastRun,omitempty" dynamodbav:"lastRun,omitempty"`
+	// Attempts counts the failed attempts of the next run, FailedRuns the runs in
+	// a row that failed
+	Attempts   int       `json:"-" dynamodbav:"attempts,omitempty"`
+	FailedRuns int       `json:"failedRuns,omitempty" dynamodbav:"failedRuns,omitempty"`
+	CreatedAt  time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// Recurring reports whether s places orders at the times of a cron expression
+func (s *Schedule) Recurring() bool {
+	return s.Cron != ""
+}
+
+// next returns the time after now the recurring schedule s fires at, or the
+// zero time when it does not
+func (s *Schedule) next(now time.Time) (time.Time, error) {
+	cron, err := schedule.Parse(s.Cron)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cron.Next(now.In(loc)).UTC().Truncate(time.Second), nil
+}
+
+// ScheduleStore is implemented by repositories keeping schedules, which they do
+// once EnableSchedules is called.
+type ScheduleStore interface {
+	// CreateSchedule stores a new schedule
+	CreateSchedule(ctx context.Context, s *Schedule) error
+	// GetSchedule returns the schedule with id, or ErrScheduleNotFound
+	GetSchedule(ctx context.Context, id string) (*Schedule, error)
+	// UpdateSchedule replaces a schedule if its stored version equals s.Version,
+	// incrementing s.Version. It fails with ErrScheduleNotFound or
+	// ErrVersionConflict.
+	UpdateSchedule(ctx context.Context, s *Schedule) error
+	// ListSchedules returns the schedules of a customer
+	ListSchedules(ctx context.Context, customerID string) ([]*Schedule, error)
+	// DueSchedules returns up to limit active schedules whose next run is not
+	// after now, the earliest first
+	DueSchedules(ctx context.Context, now time.Time, limit int) ([]*Schedule, error)
+}
+
+// schedulesEnabler is implemented by repositories able to keep schedules
+type schedulesEnabler interface {
+	enableSchedules(table string)
+}
+
+// EnableSchedules makes repo keep schedules, in table for the backends that keep
+// them in a separate table
+func EnableSchedules(repo Repository, table string) error {
+	enabler, ok := repo.(schedulesEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support schedules", repo)
+	}
+	enabler.enableSchedules(table)
+	return nil
+}
+
+// findScheduleStore returns the schedule store of repo or of the repository it decorates
+func findScheduleStore(repo Repository) (ScheduleStore, bool) {
+	var store ScheduleStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(ScheduleStore)
+		return ok
+	})
+	return store, found
+}
+
+// scheduleStoreFromContext returns the schedule store of the request repository or ErrNotSupported
+func scheduleStoreFromContext(ctx context.Context) (ScheduleStore, error) {
+	store, ok := findScheduleStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// createScheduleRequest is the body of CreateSchedule, with either a cron
+// expression or the time of a single order in runAt
+type createScheduleRequest struct {
+	createOrderRequest
+	Cron     string    `json:"cron,omitempty"`
+	Timezone string    `json:"timezone,omitempty"`
+	RunAt    time.Time `json:"runAt,omitempty"`
+}
+
+// newSchedule returns the validated active schedule described by req
+func (req *createScheduleRequest) newSchedule(ctx context.Context) (*Schedule, error) {
+	if req.CustomerID == "" {
+		return nil, &ValidationError{Field: "customerId", Reason: "is required"}
+	}
+	if err := validateItems(req.Items); err != nil {
+		return nil, err
+	}
+	if req.ShippingAddress != nil {
+		if err := validateAddress("shippingAddress", req.ShippingAddress); err != nil {
+			return nil, err
+		}
+	}
+	if PaymentsFromContext(ctx) != nil && req.PaymentMethod == "" {
+		return nil, &ValidationError{Field: "paymentMethod", Reason: "is required"}
+	}
+	currency, err := orderCurrency(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := quote(ctx, currency, req.Items, req.ShippingAddress, req.DiscountCodes); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	s := &Schedule{
+		ID:              newID(),
+		CustomerID:      req.CustomerID,
+		Status:          ScheduleActive,
+		Cron:            req.Cron,
+		Timezone:        req.Timezone,
+		Items:           req.Items,
+		ShippingAddress: req.ShippingAddress,
+		DiscountCodes:   req.DiscountCodes,
+		PaymentMethod:   req.PaymentMethod,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+		Version:         1,
+	}
+	switch {
+	case req.Cron != "" && !req.RunAt.IsZero():
+		return nil, &ValidationError{Field: "runAt", Reason: "can not be combined with cron"}
+	case req.Cron != "":
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return nil, &ValidationError{Field: "timezone", Reason: err.Error()}
+		}
+		next, err := s.next(now)
+		if err != nil {
+			return nil, &ValidationError{Field: "cron", Reason: err.Error()}
+		}
+		if next.IsZero() {
+			return nil, &ValidationError{Field: "cron", Reason: "never fires"}
+		}
+		s.NextRunAt = next
+	case req.RunAt.After(now):
+		s.NextRunAt = req.RunAt.UTC().Truncate(time.Second)
+	default:
+		return nil, &ValidationError{Field: "runAt", Reason: "a cron expression or a time in the future is required"}
+	}
+	return s, nil
+}
+
+// CreateSchedule stores the schedule described by the body with a new id
+func CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := scheduleStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req createScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	s, err := req.newSchedule(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := store.CreateSchedule(ctx, s); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("created schedule %s, next run at %s", s.ID, s.NextRunAt.Format(time.RFC3339))
+	writeJSON(w, r, http.StatusCreated, s)
+}
+
+// GetSchedule returns the schedule named in the path
+func GetSchedule(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := scheduleStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s, err := store.GetSchedule(ctx, mux.Vars(r)["scheduleId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, s)
+}
+
+// listSchedulesResponse is the body of ListCustomerSchedules
+type listSchedulesResponse struct {
+	Schedules []*Schedule `json:"schedules"`
+}
+
+// ListCustomerSchedules returns the schedules of the customer named in the path
+func ListCustomerSchedules(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := scheduleStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	schedules, err := store.ListSchedules(ctx, mux.Vars(r)["customerId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if schedules == nil {
+		schedules = []*Schedule{}
+	}
+	writeJSON(w, r, http.StatusOK, &listSchedulesResponse{Schedules: schedules})
+}
+
+// PauseSchedule stops the schedule named in the path from placing orders
+func PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	updateSchedule(w, r, func(s *Schedule) error {
+		s.Status = SchedulePaused
+		return nil
+	})
+}
+
+// ResumeSchedule lets a paused schedule place orders again. A recurring schedule
+// continues with its next time from now on, the runs missed while it was paused
+// are not placed; a one-off schedule whose time passed places its order now.
+func ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	updateSchedule(w, r, func(s *Schedule) error {
+		if s.Status == ScheduleActive {
+			return nil
+		}
+		s.Status = ScheduleActive
+		s.Attempts = 0
+		s.FailedRuns = 0
+		if !s.Recurring() {
+			return nil
+		}
+		next, err := s.next(time.Now())
+		if err != nil {
+			return err
+		}
+		s.NextRunAt = next
+		return nil
+	})
+}
+
+// CancelSchedule ends the schedule named in the path for good
+func CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	updateSchedule(w, r, func(s *Schedule) error {
+		s.Status = ScheduleCancelled
+		return nil
+	})
+}
+
+// updateSchedule applies change to the schedule named in the path, unless it is
+// finished, and writes it
+func updateSchedule(w http.ResponseWriter, r *http.Request, change func(*Schedule) error) {
+	ctx := r.Context()
+	store, err := scheduleStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	s, err := store.GetSchedule(ctx, mux.Vars(r)["scheduleId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if s.Status == ScheduleCancelled || s.Status == ScheduleCompleted {
+		writeError(w, r, ErrScheduleFinished)
+		return
+	}
+	if err := change(s); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	s.UpdatedAt = time.Now().UTC()
+	if err := store.UpdateSchedule(ctx, s); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("schedule %s is %s", s.ID, s.Status)
+	writeJSON(w, r, http.StatusOK, s)
+}
+
+// scheduledOrderID returns the id of the order a schedule places at a time. It is
+// the same for every attempt of a run, so a run places one order even when
+// schedulers race or a run is attempted again.
+func scheduledOrderID(scheduleID string, at time.Time) string {
+	sum := sha256.Sum256([]byte(scheduleID + "/" + at.UTC().Format(time.RFC3339)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Scheduler places the orders of the schedules that are due
+type Scheduler struct {
+	repo     Repository
+	store    ScheduleStore
+	interval time.Duration
+	logger   logging.Logger
+}
+
+// NewScheduler returns a scheduler looking for due schedules in store every
+// interval and placing their orders in repo
+func NewScheduler(repo Repository, store ScheduleStore, interval time.Duration, logger logging.Logger) *Scheduler {
+	return &Scheduler{
+		repo:     repo,
+		store:    store,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run places the orders of due schedules until ctx is done
+func (s *Scheduler) Run(ctx context.Context) {
+	ctx = WithLogger(ctx, s.logger)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.interval):
+		}
+		s.RunOnce(ctx)
+	}
+}
+
+// RunOnce places the orders of the schedules due now and returns the number of
+// orders placed
+func (s *Scheduler) RunOnce(ctx context.Context) int {
+	due, err := s.store.DueSchedules(ctx, time.Now().UTC(), scheduleBatchSize)
+	if err != nil {
+		s.logger.Errorf("failed to list due schedules: %v", err)
+		return 0
+	}
+	placed := 0
+	for _, sched := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		ok, err := s.run(ctx, sched)
+		if errors.Is(err, ErrVersionConflict) {
+			s.logger.Debugf("schedule %s was changed while it ran", sched.ID)
+			continue
+		}
+		if err != nil {
+			s.logger.Errorf("failed to record the run of schedule %s: %v", sched.ID, err)
+			continue
+		}
+		if ok {
+			placed++
+		}
+	}
+	return placed
+}
+
+// run places the order of the next run of sched and advances it to the run
+// after. It reports whether the order was placed.
+func (s *Scheduler) run(ctx context.Context, sched *Schedule) (bool, error) {
+	runAt := sched.NextRunAt
+	id := scheduledOrderID(sched.ID, runAt)
+	order, err := createOrder(ctx, s.repo, &createOrderRequest{
+		CustomerID:      sched.CustomerID,
+		Items:           sched.Items,
+		ShippingAddress: sched.ShippingAddress,
+		DiscountCodes:   sched.DiscountCodes,
+		PaymentMethod:   sched.PaymentMethod,
+		// a schedule repeats its order on purpose
+		AllowDuplicate: true,
+		ScheduleID:     sched.ID,
+	}, id)
+	if errors.Is(err, ErrOrderExists) {
+		// placed by another scheduler, or by an attempt that failed to record it
+		err = nil
+	}
+
+	run := &ScheduleRun{At: runAt}
+	if order != nil || err == nil {
+		run.OrderID = id
+	}
+	if err != nil {
+		run.Error = err.Error()
+		sched.Attempts++
+		if !finalRunError(err) && sched.Attempts < maxRunAttempts {
+			s.logger.Warnf("run of schedule %s failed, attempt %d: %v", sched.ID, sched.Attempts, err)
+			sched.LastRun = run
+			sched.UpdatedAt = time.Now().UTC()
+			return false, s.store.UpdateSchedule(ctx, sched)
+		}
+		s.logger.Errorf("skipping run at %s of schedule %s: %v", runAt.Format(time.RFC3339), sched.ID, err)
+		sched.FailedRuns++
+	} else {
+		sched.Runs++
+		sched.FailedRuns = 0
+		s.logger.Infof("schedule %s placed order %s", sched.ID, id)
+	}
+	sched.LastRun = run
+	sched.Attempts = 0
+
+	switch {
+	case !sched.Recurring():
+		sched.Status = ScheduleCompleted
+	case sched.FailedRuns >= maxFailedRuns:
+		s.logger.Warnf("pausing schedule %s after %d failed runs", sched.ID, sched.FailedRuns)
+		sched.Status = SchedulePaused
+	default:
+		next, nextErr := sched.next(time.Now())
+		if nextErr != nil || next.IsZero() {
+			sched.Status = ScheduleCompleted
+			break
+		}
+		sched.NextRunAt = next
+	}
+	sched.UpdatedAt = time.Now().UTC()
+	return err == nil, s.store.UpdateSchedule(ctx, sched)
+}
+
+// finalRunError reports whether err fails a run for a reason attempting it again
+// does not fix
+func finalRunError(err error) bool {
+	var validationErr *ValidationError
+	return errors.As(err, &validationErr) || errors.Is(err, ErrPaymentDeclined) || errors.Is(err, inventory.ErrOutOfStock)
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSearchPages bounds the repository pages read for one search request
+const maxSearchPages = 10
+
+// SearchCondition compares an order field with a value, Op is one of = > >= < <=
+type SearchCondition struct {
+	Op    string
+	Value string
+}
+
+// SearchQuery is a parsed order search like `status:shipped customer:123 created>2024-01-01 total>100`
+type SearchQuery struct {
+	CustomerID string
+	Status     Status
+	// Created holds RFC3339 timestamps compared with the order creation time
+	Created []SearchCondition
+	// Total holds numbers compared with the order total
+	Total []SearchCondition
+	// Fields are the json fields of the orders found the caller uses, like
+	// ListOptions.Fields
+	Fields []string
+	// Sort orders the orders found like ListOptions.Sort
+	Sort []SortKey
+}
+
+// searchOps are tried longest first so that >= is not read as >
+var searchOps = []string{">=", "<=", ":", ">", "<", "="}
+
+// ParseSearchQuery parses whitespace separated field/operator/value terms
+func ParseSearchQuery(q string) (*SearchQuery, error) {
+	query := &SearchQuery{}
+
+	for _, term := range strings.Fields(q) {
+		field, op, value := splitSearchTerm(term)
+		if op == "" || value == "" {
+			return nil, &ValidationError{Field: "q", Reason: fmt.Sprintf("term %q is not of the form field:value", term)}
+		}
+		if op == ":" {
+			op = "="
+		}
+
+		switch field {
+		case "customer":
+			if op != "=" {
+				return nil, &ValidationError{Field: "q", Reason: "customer only supports ':'"}
+			}
+			query.CustomerID = value
+		case "status":
+			if op != "=" {
+				return nil, &ValidationError{Field: "q", Reason: "status only supports ':'"}
+			}
+			query.Status = Status(value)
+		case "created":
+			t, err := parseSearchTime(value)
+			if err != nil {
+				return nil, &ValidationError{Field: "q", Reason: fmt.Sprintf("created %q is not a date", value)}
+			}
+			query.Created = append(query.Created, SearchCondition{Op: op, Value: formatSQLTime(t)})
+		case "total":
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, &ValidationError{Field: "q", Reason: fmt.Sprintf("total %q is not a number", value)}
+			}
+			query.Total = append(query.Total, SearchCondition{Op: op, Value: value})
+		default:
+			return nil, &ValidationError{Field: "q", Reason: fmt.Sprintf("unknown search field %q", field)}
+		}
+	}
+	return query, nil
+}
+
+func splitSearchTerm(term string) (string, string, string) {
+	best, bestOp := -1, ""
+	for _, op := range searchOps {
+		if i := strings.Index(term, op); i > 0 && (best < 0 || i < best) {
+			best, bestOp = i, op
+		}
+	}
+	if best < 0 {
+		return term, "", ""
+	}
+	return strings.ToLower(term[:best]), bestOp, term[best+len(bestOp):]
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func compareSearch(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Matches reports whether order satisfies every term of the query
+func (q *SearchQuery) Matches(order *Order) bool {
+	if q.CustomerID != "" && order.CustomerID != q.CustomerID {
+		return false
+	}
+	if q.Status != "" && order.Status != q.Status {
+		return false
+	}
+	created := formatSQLTime(order.CreatedAt)
+	for _, c := range q.Created {
+		if !compareSearch(strings.Compare(created, c.Value), c.Op) {
+			return false
+		}
+	}
+	for _, c := range q.Total {
+		value, _ := strconv.ParseFloat(c.Value, 64)
+		cmp := 0
+		if total := order.Total.Decimal(); total < value {
+			cmp = -1
+		} else if total > value {
+			cmp = 1
+		}
+		if !compareSearch(cmp, c.Op) {
+			return false
+		}
+	}
+	return true
+}
+
+// Searcher is implemented by repositories, or external indexes, that can evaluate
+// a SearchQuery natively. A page may hold fewer than limit orders and still be
+// followed by more, callers continue until the returned token is empty.
+type Searcher interface {
+	SearchOrders(ctx context.Context, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error)
+}
+
+// searchOrders evaluates query with the Searcher of repo, or by filtering its listing
+func searchOrders(ctx context.Context, repo Repository, query *SearchQuery, limit int, pageToken string) ([]*Order, string, error) {
+	if searcher, ok := repo.(Searcher); ok {
+		return searcher.SearchOrders(ctx, query, limit, pageToken)
+	}
+
+	opts := ListOptions{CustomerID: query.CustomerID, Status: query.Status, PageToken: pageToken, Sort: query.Sort}
+	var found []*Order
+	for page := 0; page < maxSearchPages; page++ {
+		// a page holds no more orders than are missing, so the matches never
+		// go beyond limit and the next page starts after the last one
+		opts.Limit = limit - len(found)
+		orders, next, err := repo.ListOrders(ctx, opts)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, order := range orders {
+			if query.Matches(order) {
+				found = append(found, order)
+			}
+		}
+		opts.PageToken = next
+		if next == "" || len(found) >= limit {
+			break
+		}
+	}
+	return found, opts.PageToken, nil
+}
+
+// SearchOrders returns the orders matching the q query parameter
+func SearchOrders(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query, err := ParseSearchQuery(params.Get("q"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	limit, err := pageLimit(params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	shape, err := parseOrderShape(params, orderAttributes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if query.Sort, err = parseSort(params); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if query.Fields = shape.readFields(); query.Fields != nil {
+		query.Fields = append(query.Fields, sortFields(query.Sort)...)
+	}
+
+	// the cursors are bound to the query as written
+	ctx := r.Context()
+	filter := pageFilter("search", params.Get("q"))
+	if query.Sort != nil {
+		filter = pageFilter("search", params.Get("q"), sortTerm(query.Sort))
+	}
+	token, err := openPageToken(ctx, params.Get("pageToken"), filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	orders, next, err := searchOrders(ctx, RepositoryFromContext(ctx), query, limit, token)
+	if err == nil {
+		sortOrders(orders, query.Sort)
+		next, err = sealPageToken(ctx, next, filter)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeOrders(w, r, orders, next, shape)
+}
+
+// pageLimit returns the limit query parameter, DefaultPageSize when it is
+// missing. It is at most MaxPageSize.
+func pageLimit(params url.Values) (int, error) {
+	value := params.Get("limit")
+	if value == "" {
+		return DefaultPageSize, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || n > MaxPageSize {
+		return 0, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", MaxPageSize)}
+	}
+	return n, nil
+}
+
+// listOrdersResponse is the body of SearchOrders and ListCustomerOrders
+type listOrdersResponse struct {
+	Orders        []*Order `json:"orders"`
+	NextPageToken string   `json:"nextPageToken,omitempty"`
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/money"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	query, err := ParseSearchQuery("status:shipped customer:c-1 created>=2024-01-01 created<2024-02-01T00:00:00Z total>100")
+	if err != nil {
+		t.Fatalf("ParseSearchQuery: %v", err)
+	}
+	want := &SearchQuery{
+		CustomerID: "c-1",
+		Status:     StatusShipped,
+		Created: []SearchCondition{
+			{Op: ">=", Value: "2024-01-01T00:00:00Z"},
+			{Op: "<", Value: "2024-02-01T00:00:00Z"},
+		},
+		Total: []SearchCondition{{Op: ">", Value: "100"}},
+	}
+	if !reflect.DeepEqual(query, want) {
+		t.Errorf("ParseSearchQuery returned %+v, want %+v", query, want)
+	}
+}
+
+func TestParseSearchQueryInvalid(t *testing.T) {
+	for _, q := range []string{
+		"shipped",
+		"status:",
+		"status>shipped",
+		"customer<c-1",
+		"created>yesterday",
+		"total>much",
+		"color:red",
+	} {
+		var validationErr *ValidationError
+		if _, err := ParseSearchQuery(q); !errors.As(err, &validationErr) {
+			t.Errorf("ParseSearchQuery(%q) returned %v, want a validation error", q, err)
+		}
+	}
+}
+
+func TestSearchQueryMatches(t *testing.T) {
+	order := &Order{
+		ID:         "o-1",
+		CustomerID: "c-1",
+		Status:     StatusPaid,
+		Total:      money.New(12050, "USD"),
+		CreatedAt:  time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		q    string
+		want bool
+	}{
+		{"", true},
+		{"status:paid customer:c-1", true},
+		{"status:shipped", false},
+		{"customer:c-2", false},
+		{"created>2024-01-01 created<2024-02-01", true},
+		{"created>=2024-01-16", false},
+		{"total>120", true},
+		{"total>=120.5 total<=120.5", true},
+		{"total<100", false},
+	}
+	for _, tt := range tests {
+		query, err := ParseSearchQuery(tt.q)
+		if err != nil {
+			t.Fatalf("ParseSearchQuery(%q): %v", tt.q, err)
+		}
+		if got := query.Matches(order); got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		err   bool
+	}{
+		{"", DefaultPageSize, false},
+		{"1", 1, false},
+		{fmt.Sprint(MaxPageSize), MaxPageSize, false},
+		{fmt.Sprint(MaxPageSize + 1), 0, true},
+		{"1000000000", 0, true},
+		{"0", 0, true},
+		{"-1", 0, true},
+		{"ten", 0, true},
+	}
+	for _, tt := range tests {
+		params := url.Values{}
+		if tt.value != "" {
+			params.Set("limit", tt.value)
+		}
+		got, err := pageLimit(params)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("pageLimit(%q) = %d, %v, want %d, error %v", tt.value, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSearchOrdersLimit(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 20; i++ {
+		status := StatusPending
+		if i%3 == 0 {
+			status = StatusPaid
+		}
+		order := &Order{ID: fmt.Sprintf("o-%02d", i), CustomerID: "c-1", Status: status, Currency: "USD",
+			CreatedAt: created.Add(time.Duration(i) * time.Minute)}
+		if err := repo.CreateOrder(ctx, order); err != nil {
+			t.Fatalf("CreateOrder: %v", err)
+		}
+	}
+	query, err := ParseSearchQuery("customer:c-1 created>=2024-01-01")
+	if err != nil {
+		t.Fatalf("ParseSearchQuery: %v", err)
+	}
+
+	// every order matches, the pages are read until limit are found
+	seen := map[string]bool{}
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("searchOrders did not stop paging")
+		}
+		orders, next, err := searchOrders(ctx, repo, query, 3, token)
+		if err != nil {
+			t.Fatalf("searchOrders: %v", err)
+		}
+		if len(orders) > 3 {
+			t.Fatalf("searchOrders returned %d orders, limit is 3", len(orders))
+		}
+		for _, order := range orders {
+			if seen[order.ID] {
+				t.Fatalf("searchOrders returned %s twice", order.ID)
+			}
+			seen[order.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	if len(seen) != 20 {
+		t.Errorf("searchOrders found %d orders, want 20", len(seen))
+	}
+}
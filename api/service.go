@@ -0,0 +1,959 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+
+	"github.com/omnom-nom/apiserver"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/cron"
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/fraud"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/i18n"
+	"github.com/omnom-nom/order/inventory"
+	"github.com/omnom-nom/order/jobs"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/metricsexport"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/notify"
+	"github.com/omnom-nom/order/payments"
+	"github.com/omnom-nom/order/pricing"
+	"github.com/omnom-nom/order/proxyproto"
+	"github.com/omnom-nom/order/redact"
+	"github.com/omnom-nom/order/routing"
+	"github.com/omnom-nom/order/tracking"
+)
+
+// Service is the order api server together with its dependencies
+type Service struct {
+	repo     Repository
+	bus      *events.Bus
+	config   *config.Config
+	store    *config.Store
+	limiter  *RateLimiter
+	logger   logging.Logger
+	levels   *logging.Levels
+	routes   map[string][]apiserver.Route
+	server   *http.Server
+	endpoint string
+	grpc     *GRPCServer
+	refunds  RefundHook
+	payments *Payments
+	stock    inventory.Client
+	pricing  *pricing.Engine
+	fraud    *FraudScreen
+	router   *Router
+	tracker  *Tracker
+	gateway  http.Handler
+	docs     *Documents
+	cursors  *PageCursors
+	sla      *SLAWatchdog
+	sagas    *SagaCoordinator
+	carriers map[string]tracking.Carrier
+	jobs     *jobs.Pool
+	tasks    *cron.Runner
+	elector  *cluster.Elector
+	members  *cluster.Membership
+	locks    *OrderLocks
+	clients  *httpclient.Factory
+	drain    *Drain
+	dbStatus *DbStatus
+	hosts    *HostRegistry
+	agents   *AgentGuard
+	quotas   *Quotas
+	slow     *SlowRequests
+	capacity *CapacityRoutes
+	capture  *Capture
+	mirror   *Mirror
+	acl      *NetworkACL
+	redactor *redact.Redactor
+	catalog  *i18n.Catalog
+	fx       money.Converter
+	admin    *http.Server
+	handler  http.Handler
+	// baseContext and connContext are those of the http servers
+	baseContext func(net.Listener) context.Context
+	connContext func(context.Context, net.Conn) context.Context
+	// experiments assigns the callers to experiments, nil when disabled
+	experiments *Experiments
+	// coalescing coalesces identical concurrent GET requests, nil when disabled
+	coalescing *Coalescing
+	// deadLetters keeps the events the publishers failed, nil when disabled
+	deadLetters *DeadLetterQueue
+	// serverOpts change the http servers of the service
+	serverOpts []ServerOption
+	// notificationSenders replace the senders of the configuration by channel
+	notificationSenders map[string]notify.NotificationSender
+}
+
+// ServerOption changes an http server of the service before it serves,
+// after the timeouts of the configuration are set
+type ServerOption func(server *http.Server)
+
+// NewService returns a service serving the order routes from repo with the
+// given configuration store and additional server options. The order writes
+// of the service are published to its event bus.
+func NewService(repo Repository, store *config.Store, opts ...ServerOption) (*Service, error) {
+	if repo == nil {
+		return nil, fmt.Errorf("repository is required")
+	}
+	if store == nil {
+		store = config.NewStore(config.Default(), nil)
+	}
+	cfg := store.Current()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	clients, err := httpclient.New(cfg.Outbound, RequestIDFromContext)
+	if err != nil {
+		return nil, err
+	}
+	levels := logging.NewLevels(cfg.Level())
+	levels.Set(cfg.Level(), cfg.ModuleLevels())
+	redactor := redact.New(cfg.Redaction)
+	logger := logging.New(redact.NewBackend(logging.DefaultBackend(), redactor), levels).WithField("service", ApiServiceType).Module(logging.ModuleAPIServer)
+	store.SetLogger(logger.Module(logging.ModuleConfig))
+	bus := events.NewBus(logger.Module(logging.ModuleEvents))
+	s := &Service{
+		repo:     NewPublishingRepository(repo, bus),
+		bus:      bus,
+		config:   cfg,
+		store:    store,
+		limiter:  NewRateLimiter(cfg.RateLimit),
+		logger:   logger,
+		levels:   levels,
+		routes:   routes,
+		pricing:  pricing.NewEngine(&cfg.Pricing),
+		carriers: NewCarriers(cfg.Shipping.Carriers, clients),
+		clients:  clients,
+		drain:    &Drain{},
+		redactor: redactor,
+	}
+	s.serverOpts = opts
+	if s.gateway, err = newGateway(); err != nil {
+		return nil, err
+	}
+	if cfg.Timeouts.Startup.Duration != 0 {
+		logger.Warnf("timeouts.startup is deprecated and ignored, the listeners are bound before the service starts")
+	}
+	if cfg.Currency.Base != "" {
+		s.fx = money.NewRates(cfg.Currency.Base, cfg.Currency.Rates)
+	}
+	if cfg.Payments.Enabled {
+		provider, err := payments.New(&cfg.Payments, clients)
+		if err != nil {
+			return nil, err
+		}
+		s.payments = &Payments{Provider: provider, Currency: cfg.Payments.Currency}
+		if cfg.Payments.GiftCards.Enabled {
+			if s.payments.GiftCards, err = payments.NewGiftCardService(&cfg.Payments.GiftCards, clients); err != nil {
+				return nil, err
+			}
+		}
+		if cfg.Payments.Credit.Enabled {
+			credit, err := payments.NewCreditService(&cfg.Payments.Credit, clients)
+			if err != nil {
+				return nil, err
+			}
+			s.payments.WithCredit(credit)
+		}
+		s.refunds = s.payments
+	}
+	if cfg.Inventory.Enabled {
+		stock, err := inventory.New(&cfg.Inventory, clients)
+		if err != nil {
+			return nil, err
+		}
+		s.stock = stock
+	}
+	if cfg.SLA.Enabled {
+		s.sla = NewSLAWatchdog(s.repo, &cfg.SLA, logger.Module(logging.ModuleSLA))
+	}
+	if cfg.Fraud.Enabled {
+		customers, _ := findCustomerStore(repo)
+		history := &orderHistory{repo: repo, customers: customers, limit: cfg.Fraud.Rules.VelocityLimit}
+		s.fraud = NewFraudScreen(fraud.NewRules(&cfg.Fraud.Rules, history), &cfg.Fraud)
+	}
+	if cfg.Routing.Enabled {
+		router, err := NewRouter(&cfg.Routing)
+		if err != nil {
+			return nil, err
+		}
+		s.router = router
+	}
+	if cfg.Tracking.Enabled {
+		s.tracker = NewTracker(&cfg.Tracking)
+	}
+	if cfg.Cursors.Enabled {
+		if s.cursors, err = NewPageCursors(&cfg.Cursors); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Documents.Enabled {
+		if s.docs, err = NewDocuments(&cfg.Documents); err != nil {
+			return nil, err
+		}
+	}
+	if jobStore, ok := findJobStore(repo); ok && cfg.Jobs.Enabled {
+		s.jobs = jobs.NewPool(jobStore, cfg.Jobs, logger.Module(logging.ModuleJobs))
+	}
+	if cfg.DbStatus.Enabled {
+		pinger, ok := findPinger(repo)
+		if !ok {
+			return nil, fmt.Errorf("db status needs a repository that can be pinged")
+		}
+		s.dbStatus = NewDbStatus(pinger, cfg.DbStatus)
+	}
+	if cfg.Hosts.Require {
+		hostStore, ok := findHostStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("requiring registered hosts needs a repository keeping hosts")
+		}
+		s.hosts = NewHostRegistry(hostStore, cfg.Hosts, cfg.Agents)
+	}
+	if cfg.Agents.Enabled {
+		hostStore, ok := findHostStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("the agent api needs a repository keeping hosts")
+		}
+		s.agents = NewAgentGuard(hostStore, cfg.Agents)
+	}
+	if cfg.SlowRequests.Enabled {
+		s.slow = NewSlowRequests(s.routes, cfg.SlowRequests)
+	}
+	if s.catalog, err = i18n.New(cfg.I18n); err != nil {
+		return nil, err
+	}
+	if cfg.Capacity.Enabled {
+		s.capacity = NewCapacityRoutes(s.routes)
+	}
+	if cfg.ACL.Enabled {
+		acl, err := NewNetworkACL(cfg.ACL)
+		if err != nil {
+			return nil, err
+		}
+		s.acl = acl
+	}
+	if cfg.Capture.Enabled {
+		capture, err := NewCapture(cfg.Capture)
+		if err != nil {
+			return nil, err
+		}
+		s.capture = capture
+	}
+	if cfg.Experiments.Enabled {
+		s.experiments = NewExperiments(&cfg.Experiments)
+	}
+	if cfg.Coalescing.Enabled {
+		s.coalescing = NewCoalescing(cfg)
+	}
+	if cfg.Mirror.Enabled {
+		// the calls are bounded by the mirror timeout
+		s.mirror = NewMirror(cfg.Mirror, clients.Client("mirror", 0), logger)
+	}
+	if cfg.Quotas.Enabled {
+		quotaStore, ok := findQuotaStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("quotas need a repository keeping request counts")
+		}
+		s.quotas = NewQuotas(quotaStore, cfg.Quotas)
+	}
+	if cfg.Sagas.Enabled {
+		sagaStore, ok := findSagaStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("sagas need a repository keeping sagas")
+		}
+		s.sagas = NewSagaCoordinator(s.repo, sagaStore, &cfg.Sagas, logger.Module(logging.ModuleSagas))
+	}
+	if cfg.DeadLetters.Enabled {
+		letterStore, ok := findDeadLetterStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("dead letters need a repository keeping dead letters")
+		}
+		s.deadLetters = NewDeadLetterQueue(letterStore, logger.Module(logging.ModuleEvents))
+	}
+	if cfg.Cluster.Enabled {
+		leaseStore, ok := findLeaseStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("cluster needs a repository keeping leases")
+		}
+		s.elector = cluster.NewElector(leaseStore, cfg.Cluster, logger.Module(logging.ModuleCluster))
+		s.locks = NewOrderLocks(leaseStore, s.elector.ID(), cfg.Cluster)
+		memberStore, ok := findMemberStore(repo)
+		if !ok {
+			return nil, fmt.Errorf("cluster needs a repository keeping members")
+		}
+		s.members = cluster.NewMembership(memberStore, s.elector, cfg.Cluster)
+		s.tasks = cron.NewRunner(leaseStore, s.elector.ID(), cfg.Cron, logger.Module(logging.ModuleCron))
+	} else {
+		// a single instance runs every task itself
+		s.tasks = cron.NewRunner(nil, "", cfg.Cron, logger.Module(logging.ModuleCron))
+	}
+	store.OnChange(s.configChanged)
+	return s, nil
+}
+
+// configChanged applies the reloadable settings of a new configuration
+func (s *Service) configChanged(old, new *config.Config) {
+	if old.LogLevel != new.LogLevel || !reflect.DeepEqual(old.LogLevels, new.LogLevels) {
+		s.levels.Set(new.Level(), new.ModuleLevels())
+		s.logger.Infof("log level changed to %s, of the modules to %v", new.Level(), new.ModuleLevels())
+	}
+	if old.RateLimit != new.RateLimit {
+		s.limiter.Configure(new.RateLimit)
+		s.logger.Infof("rate limit changed to %+v", new.RateLimit)
+	}
+	if old.Gatekeeper.ReadOnly != new.Gatekeeper.ReadOnly {
+		s.logger.Warnf("read only changed to %t", new.Gatekeeper.ReadOnly)
+	}
+}
+
+// Config returns the configuration the service was started with
+func (s *Service) Config() *config.Config {
+	return s.config
+}
+
+// Store returns the store holding the current configuration
+func (s *Service) Store() *config.Store {
+	return s.store
+}
+
+// Repository returns the order repository of the service
+func (s *Service) Repository() Repository {
+	return s.repo
+}
+
+// SetRefundHook makes the service refund cancelled orders with hook instead of the
+// payment provider, it has to be called before the service is started
+func (s *Service) SetRefundHook(hook RefundHook) {
+	s.refunds = hook
+}
+
+// SetGiftCardService makes the service redeem and credit gift cards and store
+// credit with giftCards instead of the client of the configuration while
+// payments.giftCards.enabled is set, it has to be called before the service is
+// started
+func (s *Service) SetGiftCardService(giftCards payments.GiftCardService) {
+	if s.payments != nil && s.payments.GiftCards != nil {
+		s.payments.GiftCards = giftCards
+	}
+}
+
+// SetCreditService makes the service charge the orders on account to the
+// credit lines of credit instead of the client of the configuration while
+// payments.credit.enabled is set, it has to be called before the service is
+// started
+func (s *Service) SetCreditService(credit payments.CreditService) {
+	if s.payments != nil && s.payments.Credit != nil {
+		s.payments.WithCredit(credit)
+	}
+}
+
+// SetTaxProvider makes the service tax orders with provider instead of the flat
+// rate of the configuration, it has to be called before the service is started
+func (s *Service) SetTaxProvider(provider pricing.TaxProvider) {
+	s.pricing.WithTaxProvider(provider)
+}
+
+// SetFraudChecker makes the service screen new orders with checker instead of
+// the rules of the configuration while fraud.enabled is set, it has to be
+// called before the service is started
+func (s *Service) SetFraudChecker(checker fraud.Checker) {
+	if s.fraud != nil {
+		s.fraud.checker = checker
+	}
+}
+
+// SetRoutingStrategy makes the service route confirmed orders to warehouses
+// with strategy instead of the one of the configuration while routing.enabled
+// is set, it has to be called before the service is started
+func (s *Service) SetRoutingStrategy(strategy routing.Strategy) {
+	if s.router != nil {
+		s.router.strategy = strategy
+		s.router.name = customStrategy
+	}
+}
+
+// SetNotificationSender makes the service send the notifications of channel,
+// email or sms, with sender instead of the provider of the configuration while
+// notifications.enabled is set, it has to be called before the service is
+// started
+func (s *Service) SetNotificationSender(channel string, sender notify.NotificationSender) {
+	if s.notificationSenders == nil {
+		s.notificationSenders = map[string]notify.NotificationSender{}
+	}
+	s.notificationSenders[channel] = sender
+}
+
+// SetDocumentStore makes the service keep the rendered documents of orders in
+// store instead of the bucket of the configuration while documents.enabled is
+// set, it has to be called before the service is started
+func (s *Service) SetDocumentStore(store DocumentStore) {
+	if s.docs != nil {
+		s.docs.WithStore(store)
+	}
+}
+
+// SetCurrencyConverter makes the service convert the totals of orders to the
+// base currency of the statistics with converter instead of the rates of the
+// configuration, it has to be called before the service is started
+func (s *Service) SetCurrencyConverter(converter money.Converter) {
+	s.fx = converter
+}
+
+// SetBaseContext makes the http servers derive the contexts of their
+// requests from the one base returns for their listener. Run uses its context
+// unless one was set, so the requests in progress are cancelled when it is
+// done. It has to be called before the service is started.
+func (s *Service) SetBaseContext(base func(net.Listener) context.Context) {
+	s.baseContext = base
+}
+
+// SetConnContext makes the http servers derive the contexts of the requests
+// of a connection from the one conn returns for it, to carry what is known of
+// the connection such as the certificate of the client or the address given by
+// a proxy. It has to be called before the service is started.
+func (s *Service) SetConnContext(conn func(ctx context.Context, c net.Conn) context.Context) {
+	s.connContext = conn
+}
+
+// Elector returns the leader election of the service, nil unless cluster is enabled
+func (s *Service) Elector() *cluster.Elector {
+	return s.elector
+}
+
+// Membership returns the cluster membership of the service, nil unless cluster is enabled
+func (s *Service) Membership() *cluster.Membership {
+	return s.members
+}
+
+// Bus returns the event bus the order writes of the service are published to
+func (s *Service) Bus() *events.Bus {
+	return s.bus
+}
+
+// Handler returns the http handler serving the order routes with all middleware applied
+func (s *Service) Handler() (http.Handler, error) {
+	if s.handler != nil {
+		return s.handler, nil
+	}
+
+	factory, err := apiserver.FactoryForGorillaMux()
+	if err != nil {
+		s.logger.Errorf("failed to create mux: %v", err)
+		return nil, fmt.Errorf("failed to create mux: %v", err)
+	}
+
+	// collect the middleware in the order they run, checked with the
+	// middleware of the routes before they are registered with the factory
+	chain := &middlewareChain{}
+	chain.Default(apiserver.MiddlewareLogger, apiserver.Logger())
+	// counts the requests failed by the crash handler and refused by the middleware below
+	chain.Always(MiddlewareRequestMetrics, NewRequestMetrics(s.routes))
+	chain.Always(MiddlewareCrashHandler, apiserver.NewCrashHandler(s.handleCrash))
+	if s.catalog != nil {
+		// before the middleware refusing requests, whose errors are localized too
+		chain.Always(MiddlewareLocale, NewLocaleNegotiator(s.catalog))
+	}
+	chain.Always(MiddlewareAdminGuard, NewAdminGuard(s.config.Admin))
+	if s.config.Admin.CSRF.Enabled {
+		chain.Always(MiddlewareCSRF, NewCSRF(s.config.Admin.CSRF))
+	}
+	if s.config.Forwarded.Enabled {
+		// before the injector, which logs the address of the client
+		trusted, _ := s.config.Forwarded.TrustedNetworks()
+		chain.Always(MiddlewareClientIP, NewClientIP(trusted))
+	}
+	chain.Always(MiddlewareInjector, NewInjector(s.repo, s.logger, s.store).WithRefundHook(s.refunds).WithPayments(s.payments).WithInventory(s.stock).WithPricing(s.pricing).WithFraud(s.fraud).WithRouter(s.router).WithSagas(s.sagas).WithCarriers(s.carriers).WithJobs(s.jobs).WithMembership(s.members).WithOrderLocks(s.locks).WithDrain(s.drain).WithSlowRequests(s.slow).WithRedactor(s.redactor).WithTasks(s.tasks).WithDeadLetters(s.deadLetters).WithSLA(s.sla).WithTracker(s.tracker).WithDocuments(s.docs).WithPageCursors(s.cursors).WithGateway(s.gateway))
+	if s.experiments != nil {
+		// after the injector, exposures are logged with the logger of the request
+		chain.Always(MiddlewareExperiments, s.experiments, MiddlewareInjector)
+	}
+	if s.acl != nil {
+		chain.Always(MiddlewareACL, s.acl)
+	}
+	if s.slow != nil {
+		chain.Always(MiddlewareSlowRequests, s.slow)
+	}
+	if s.capacity != nil {
+		chain.Always(MiddlewareCapacity, s.capacity)
+	}
+	if s.capture != nil {
+		chain.Always(MiddlewareCapture, s.capture)
+	}
+	chain.Always(MiddlewareRateLimit, s.limiter)
+	if s.quotas != nil {
+		chain.Always(MiddlewareQuota, s.quotas)
+	}
+	chain.Always(MiddlewareGatekeeper, NewGatekeeper(s.store))
+	chain.Always(MiddlewareDeprecation, NewDeprecations(s.store))
+	if s.agents != nil {
+		chain.Always(MiddlewareAgentAuth, s.agents)
+	}
+	if s.hosts != nil {
+		chain.Always(MiddlewareHostNotRegistered, s.hosts)
+	}
+	if s.mirror != nil {
+		// after the middleware refusing requests, which are not mirrored
+		chain.Always(MiddlewareMirror, s.mirror, MiddlewareRateLimit, MiddlewareGatekeeper)
+	}
+	if s.elector != nil && s.config.Cluster.Forward == config.ForwardProxy {
+		chain.Always(MiddlewareLeader, NewLeaderProxy(s.elector, s.members, s.clients))
+	} else if s.elector != nil {
+		chain.Always(MiddlewareLeader, NewLeaderRedirect(s.elector, s.members))
+	}
+	if s.dbStatus != nil {
+		// after the leader middleware, the instance writing checks the database
+		chain.Always(MiddlewareDbStatus, s.dbStatus)
+	}
+	if s.coalescing != nil {
+		// after the middleware refusing or forwarding requests, which are
+		// answered for each caller
+		chain.Always(MiddlewareCoalescing, s.coalescing)
+	}
+	// last, the canary answers in place of the route
+	chain.Always(MiddlewareCanary, NewCanary(s.store))
+
+	middleware, err := chain.Make(s.routes, routeMiddleware)
+	if err != nil {
+		s.logger.Errorf("failed to register middleware: %v", err)
+		return nil, fmt.Errorf("failed to register middleware: %v", err)
+	}
+	for _, entry := range middleware {
+		if entry.Always {
+			factory.Always(entry.Name, entry.Handler)
+		} else {
+			factory.Default(entry.Name, entry.Handler)
+		}
+	}
+
+	secureMux, err := factory.Make(s.routes)
+	if err != nil {
+		s.logger.Errorf("failed to do factory make: %v", err)
+		return nil, fmt.Errorf("failed to do factory make: %v", err)
+	}
+
+	s.handler = secureMux
+	if timeout := s.config.Timeouts.Request.Duration; timeout > 0 {
+		timed := http.TimeoutHandler(secureMux, timeout, "request timed out")
+		s.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if streamingPaths[r.URL.Path] {
+				secureMux.ServeHTTP(w, r)
+				return
+			}
+			timed.ServeHTTP(w, r)
+		})
+	}
+	return s.handler, nil
+}
+
+// Start starts the http server, and the grpc server when enabled. The listen
+// addresses are bound before Start returns, so a port 0 is replaced by the
+// port the system picked, which Endpoint reports.
+func (s *Service) Start() error {
+	handler, err := s.Handler()
+	if err != nil {
+		return err
+	}
+
+	if s.config.GRPC.Enabled {
+		s.grpc = NewGRPCServer(s.repo, s.logger.Module(logging.ModuleGRPC)).WithPayments(s.payments).WithInventory(s.stock).WithPricing(s.pricing).WithFraud(s.fraud).WithRouter(s.router).WithSagas(s.sagas).WithCatalog(s.catalog).WithPageCursors(s.cursors).WithConfig(s.store)
+		if s.config.GRPC.Multiplex {
+			// grpc and http share the http listen address, tls is not supported
+			network, address, _ := s.config.Listen(s.config.ListenAddress)
+			if err := s.grpc.StartMultiplexed(network, address, s.newHTTPServer(handler)); err != nil {
+				s.logger.Errorf("failed to start multiplexed server: %s", err)
+				return fmt.Errorf("failed to start multiplexed server: %v", err)
+			}
+			s.endpoint = "http://" + s.grpc.Endpoint()
+			s.logger.Infof("grpc and http server is running: %s", s.endpoint)
+			if err := s.startAdmin(handler); err != nil {
+				s.Stop()
+				return err
+			}
+			return nil
+		}
+		network, address, _ := s.config.Listen(s.config.GRPC.ListenAddress)
+		if err := s.grpc.Start(network, address); err != nil {
+			s.logger.Errorf("failed to start grpc server: %s", err)
+			return fmt.Errorf("failed to start grpc server: %v", err)
+		}
+		s.logger.Infof("grpc server is running: %s", s.grpc.Endpoint())
+	}
+
+	// the listen addresses were checked when the configuration was validated
+	network, address, _ := s.config.Listen(s.config.ListenAddress)
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		s.Stop()
+		s.logger.Errorf("failed to listen on the listen address: %s", err)
+		return fmt.Errorf("failed to listen on the listen address: %v", err)
+	}
+	if s.config.ProxyProtocol.Enabled {
+		// the header comes before the tls handshake
+		trusted, _ := s.config.ProxyProtocol.TrustedNetworks()
+		listener = proxyproto.NewListener(listener, trusted, s.config.ProxyProtocol.HeaderTimeout.Duration)
+	}
+	scheme := "http"
+	if s.config.TLS.Enabled() {
+		tlsConfig, err := serverTLSConfig(s.config.TLS)
+		if err != nil {
+			listener.Close()
+			s.Stop()
+			s.logger.Errorf("failed to load the tls configuration: %s", err)
+			return fmt.Errorf("failed to load the tls configuration: %v", err)
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+		scheme = "https"
+	}
+	s.server = s.newHTTPServer(handler)
+	s.endpoint = scheme + "://" + listener.Addr().String()
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("http server failed: %s", err)
+		}
+	}(s.server)
+	s.logger.Infof("http server is running: %s", s.endpoint)
+
+	if err := s.startAdmin(handler); err != nil {
+		s.Stop()
+		return err
+	}
+	return nil
+}
+
+// Endpoint returns the url of the http api once the service is started, with
+// the address it is bound to
+func (s *Service) Endpoint() string {
+	return s.endpoint
+}
+
+// newHTTPServer returns an http server of handler with the contexts and the
+// timeouts of the service, changed by its server options
+func (s *Service) newHTTPServer(handler http.Handler) *http.Server {
+	server := &http.Server{
+		Handler:           handler,
+		BaseContext:       s.baseContext,
+		ConnContext:       s.connContext,
+		ReadHeaderTimeout: s.config.Timeouts.ReadHeader.Duration,
+		ReadTimeout:       s.config.Timeouts.Read.Duration,
+		IdleTimeout:       s.config.Timeouts.Idle.Duration,
+	}
+	for _, opt := range s.serverOpts {
+		opt(server)
+	}
+	return server
+}
+
+// serverTLSConfig returns the tls configuration serving the certificate of
+// cfg. With a ca bundle the clients have to present a certificate it signed.
+func serverTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", cfg.CAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// startAdmin serves the admin api on the admin listen address, if any, next
+// to the http or multiplexed listener
+func (s *Service) startAdmin(handler http.Handler) error {
+	if s.config.Admin.ListenAddress == "" {
+		return nil
+	}
+	network, address, _ := s.config.Listen(s.config.Admin.ListenAddress)
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		s.logger.Errorf("failed to listen on the admin address: %s", err)
+		return fmt.Errorf("failed to listen on the admin address: %v", err)
+	}
+	s.admin = s.newHTTPServer(withAdminListener(handler))
+	go func(server *http.Server) {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("admin server failed: %s", err)
+		}
+	}(s.admin)
+	s.logger.Infof("admin server is running: %s", listener.Addr())
+	return nil
+}
+
+// Stop stops the grpc and http servers if they are running
+func (s *Service) Stop() error {
+	if s.grpc != nil && s.grpc.IsRunning() {
+		s.grpc.Stop()
+	}
+	if s.admin != nil {
+		if err := s.admin.Close(); err != nil {
+			s.logger.Errorf("failed to stop admin server: %s", err)
+		}
+		s.admin = nil
+	}
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.Close()
+	s.server = nil
+	if err != nil {
+		s.logger.Errorf("failed to stop HTTP server: %s", err)
+		return fmt.Errorf("failed to stop HTTP server: %s", err)
+	}
+	return nil
+}
+
+// Run starts the service and blocks until ctx is done, then stops it.
+// The configuration is reloaded whenever the process receives SIGHUP and the
+// leader election, order events, background jobs, the command queue, if
+// enabled, and the scheduled tasks, such as the retention of orders, are
+// processed in the background.
+func (s *Service) Run(ctx context.Context) error {
+	// libraries logging with the standard logrus logger, like apiserver, log with the service
+	logging.RedirectLogrus(s.logger)
+	if s.baseContext == nil {
+		s.baseContext = func(net.Listener) context.Context { return ctx }
+	}
+	if s.docs != nil && s.docs.store == nil && s.config.Documents.Storage.Enabled {
+		store, err := NewS3DocumentStore(ctx, s.config)
+		if err != nil {
+			return fmt.Errorf("failed to create document storage: %v", err)
+		}
+		s.docs.WithStore(store)
+	}
+	if err := s.Start(); err != nil {
+		return err
+	}
+	go s.store.WatchSignals(ctx)
+	subscribeMetrics(s.bus)
+	if s.config.MetricsExport.Sink != "" {
+		exporter, err := metricsexport.New(s.config.MetricsExport, prometheus.DefaultGatherer, s.logger.Module(logging.ModuleMetrics))
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to create metrics exporter: %v", err)
+		}
+		go exporter.Run(ctx)
+	}
+	if store, ok := findStatsStore(s.repo); ok && s.config.Stats.Enabled {
+		SubscribeStats(s.bus, store, s.config.Currency.Base, s.fx, s.logger.Module(logging.ModuleStats))
+	}
+	if s.refunds != nil {
+		ctx = WithRefundHook(ctx, s.refunds)
+	}
+	if s.payments != nil {
+		ctx = WithPayments(ctx, s.payments)
+	}
+	if s.stock != nil {
+		ctx = WithInventory(ctx, s.stock)
+	}
+	ctx = WithPricing(ctx, s.pricing)
+	if s.fraud != nil {
+		ctx = WithFraud(ctx, s.fraud)
+	}
+	if s.router != nil {
+		ctx = WithRouter(ctx, s.router)
+	}
+	if s.sagas != nil {
+		ctx = WithSagas(ctx, s.sagas)
+	}
+	if s.locks != nil {
+		ctx = WithOrderLocks(ctx, s.locks)
+	}
+	if err := s.startPublishers(ctx); err != nil {
+		s.Stop()
+		return err
+	}
+	if s.config.Notifications.Enabled {
+		if err := s.startNotifications(ctx); err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to start notifications: %v", err)
+		}
+	}
+	if interval := s.config.Shipping.PollInterval.Duration; interval > 0 && len(s.carriers) > 0 {
+		go NewTrackingPoller(s.repo, s.carriers, interval, s.logger.Module(logging.ModuleTracking)).Run(ctx)
+	}
+	if s.elector != nil {
+		go s.members.Run(ctx)
+		go s.elector.Run(ctx)
+	}
+	if s.jobs != nil {
+		if s.config.Jobs.Bucket != "" {
+			export, err := NewExportJob(ctx, s.config, s.repo)
+			if err != nil {
+				s.Stop()
+				return fmt.Errorf("failed to create export job: %v", err)
+			}
+			s.jobs.Handle(ExportJob, export)
+			subjectExport, err := NewSubjectExportJob(ctx, s.config, s.repo)
+			if err != nil {
+				s.Stop()
+				return fmt.Errorf("failed to create subject export job: %v", err)
+			}
+			s.jobs.Handle(SubjectExportJob, subjectExport)
+		}
+		s.jobs.Handle(ErasureJob, NewErasureJob(s.repo))
+		if s.router != nil {
+			s.jobs.Handle(RouteJob, NewRouteJob(s.repo))
+		}
+		if reseal, err := NewResealJob(s.repo); err == nil {
+			s.jobs.Handle(ResealJob, reseal)
+		}
+		go s.jobs.Run(ctx)
+	}
+	if err := s.addTasks(); err != nil {
+		s.Stop()
+		return fmt.Errorf("failed to schedule background tasks: %v", err)
+	}
+	go s.tasks.Run(ctx)
+	if s.config.Commands.Enabled {
+		worker, err := NewCommandWorker(ctx, s.config, s.repo, s.logger.Module(logging.ModuleCommands))
+		if err != nil {
+			s.Stop()
+			return fmt.Errorf("failed to create command worker: %v", err)
+		}
+		go worker.Run(ctx)
+	}
+
+	<-ctx.Done()
+	s.logger.Info("shutting down http server")
+	err := s.Stop()
+	s.bus.Close()
+	s.clients.CloseIdleConnections()
+	return err
+}
+
+// startNotifications notifies customers of the events of the bus with the
+// senders set with SetNotificationSender, or those of the configuration, until
+// ctx is done
+func (s *Service) startNotifications(ctx context.Context) error {
+	cfg := &s.config.Notifications
+	senders := map[string]notify.NotificationSender{}
+	for channel, sender := range s.notificationSenders {
+		senders[channel] = sender
+	}
+	if len(senders) < len(notify.Channels) {
+		awsConfig, err := newAWSConfig(ctx, s.config)
+		if err != nil {
+			return err
+		}
+		if _, ok := senders[notify.ChannelEmail]; !ok {
+			sender, err := notify.NewEmailSender(cfg, awsConfig)
+			if err != nil {
+				return err
+			}
+			if sender != nil {
+				senders[notify.ChannelEmail] = sender
+			}
+		}
+		if _, ok := senders[notify.ChannelSMS]; !ok {
+			sender, err := notify.NewSMSSender(cfg, awsConfig, s.clients)
+			if err != nil {
+				return err
+			}
+			if sender != nil {
+				senders[notify.ChannelSMS] = sender
+			}
+		}
+	}
+	notifier, err := NewNotifier(s.repo, senders, cfg, s.logger.Module(logging.ModuleNotifications))
+	if err != nil {
+		return err
+	}
+	notifier.WithTracker(s.tracker)
+	if s.deadLetters != nil {
+		notifier.WithDeadLetters(s.deadLetters)
+	}
+	go notifier.Run(ctx, s.bus)
+	return nil
+}
+
+// startPublishers hands order events to the webhook dispatcher and kafka when they
+// are enabled until ctx is done. With the outbox they get every event at least once
+// from the outbox relay, which logs the events when neither is enabled. Without it
+// they subscribe to the event bus and miss the events of a failed write or a crash.
+func (s *Service) startPublishers(ctx context.Context) error {
+	var publishers multiPublisher
+	var names []string
+	if store, ok := findWebhookStore(s.repo); ok && s.config.Webhooks.Enabled {
+		dispatcher := NewWebhookDispatcher(store, s.config.Webhooks, s.clients, s.logger.Module(logging.ModuleWebhooks)).
+			WithRetention(s.config.Retention.Deliveries.Duration)
+		if s.deadLetters != nil {
+			dispatcher.WithDeadLetters(s.deadLetters)
+		}
+		if err := s.addWebhookTask(dispatcher); err != nil {
+			return err
+		}
+		publishers = append(publishers, dispatcher)
+		names = append(names, logging.ModuleWebhooks)
+	}
+	if s.config.Kafka.Enabled {
+		kafka, err := NewKafkaPublisher(&s.config.Kafka)
+		if err != nil {
+			return fmt.Errorf("failed to create kafka publisher: %v", err)
+		}
+		go func() {
+			<-ctx.Done()
+			if err := kafka.Close(); err != nil {
+				s.logger.Errorf("failed to close kafka publisher: %v", err)
+			}
+		}()
+		publishers = append(publishers, kafka)
+		names = append(names, logging.ModuleKafka)
+	}
+
+	outbox, ok := findOutbox(s.repo)
+	relayed := ok && s.config.Outbox.Enabled
+	if s.deadLetters != nil {
+		for i, publisher := range publishers {
+			if names[i] != logging.ModuleKafka {
+				// the dead deliveries of the webhooks are dead-lettered by the dispatcher
+				continue
+			}
+			// without the relay a failed event is not published again
+			maxAttempts := 1
+			if relayed {
+				maxAttempts = s.config.DeadLetters.MaxAttempts
+			}
+			publishers[i] = s.deadLetters.Publisher(PublisherKafka, publisher, maxAttempts)
+		}
+	}
+	if !relayed {
+		for i, publisher := range publishers {
+			subscribePublisher(s.bus, names[i], publisher, s.logger.Module(names[i]))
+		}
+		return nil
+	}
+
+	if encrypted, ok := findEncryption(s.repo); ok {
+		outbox = encrypted.openingOutbox(outbox)
+	}
+	var publisher EventPublisher = logPublisher{logger: s.logger.Module(logging.ModuleOutbox)}
+	if len(publishers) > 0 {
+		publisher = publishers
+	}
+	cfg := s.config.Outbox
+	relay := NewOutboxRelay(outbox, publisher, cfg.PollInterval.Duration, cfg.MaxBackoff.Duration, cfg.BatchSize, s.logger.Module(logging.ModuleOutbox))
+	go relay.Run(ctx)
+	return nil
+}
@@ -0,0 +1,425 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/tracking"
+)
+
+var (
+	// ErrNotShippable is returned when shipping an order that is cancelled or delivered
+	ErrNotShippable = errors.New("order can not be shipped")
+	// ErrShipmentNotFound is returned when an order has no shipment with the requested id
+	ErrShipmentNotFound = errors.New("shipment not found")
+)
+
+// maxTrackingEvents is the number of tracking events kept per shipment, the oldest are dropped
+const maxTrackingEvents = 50
+
+// TrackingEvent is an event in the tracking history of a shipment
+type TrackingEvent struct {
+	Status      tracking.Status `json:"status" dynamodbav:"status"`
+	Location    string          `json:"location,omitempty" dynamodbav:"location,omitempty"`
+	Description string          `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	OccurredAt  time.Time       `json:"occurredAt" dynamodbav:"occurredAt"`
+}
+
+// Shipment is a parcel of an order handed to a carrier. Its status is the status
+// of its latest tracking event.
+type Shipment struct {
+	ID             string          `json:"id" dynamodbav:"shipmentId"`
+	Carrier        string          `json:"carrier" dynamodbav:"carrier"`
+	TrackingNumber string          `json:"trackingNumber" dynamodbav:"trackingNumber"`
+	WarehouseID    string          `json:"warehouseId,omitempty" dynamodbav:"warehouseId,omitempty"`
+	Status         tracking.Status `json:"status" dynamodbav:"status"`
+	Events         []TrackingEvent `json:"events,omitempty" dynamodbav:"events,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// Shippable reports whether shipments may be added to the order
+func (o *Order) Shippable() bool {
+	return o.Status == StatusPending || o.Status == StatusPaid || o.Status == StatusShipped
+}
+
+// shipment returns the shipment of o with id, or nil
+func (o *Order) shipment(id string) *Shipment {
+	for i := range o.Shipments {
+		if o.Shipments[i].ID == id {
+			return &o.Shipments[i]
+		}
+	}
+	return nil
+}
+
+// shipmentByTracking returns the shipment of o with the tracking number of a carrier, or nil
+func (o *Order) shipmentByTracking(carrier, trackingNumber string) *Shipment {
+	for i := range o.Shipments {
+		if o.Shipments[i].Carrier == carrier && o.Shipments[i].TrackingNumber == trackingNumber {
+			return &o.Shipments[i]
+		}
+	}
+	return nil
+}
+
+// applyTracking records update in the history of shipment, a shipment of order,
+// and advances the order: shipped once a shipment is moving, delivered once all
+// of them are delivered. It reports whether anything changed, updates already
+// recorded are ignored.
+func applyTracking(order *Order, shipment *Shipment, update *tracking.Update) bool {
+	event := TrackingEvent{
+		Status:      update.Status,
+		Location:    update.Location,
+		Description: update.Description,
+		OccurredAt:  update.OccurredAt.UTC(),
+	}
+	if event.OccurredAt.IsZero() {
+		event.OccurredAt = time.Now().UTC()
+	}
+	for _, e := range shipment.Events {
+		if e.Status == event.Status && e.Location == event.Location && e.Description == event.Description &&
+			e.OccurredAt.Equal(event.OccurredAt) {
+			return false
+		}
+	}
+
+	shipment.Events = append(shipment.Events, event)
+	sort.SliceStable(shipment.Events, func(i, j int) bool {
+		return shipment.Events[i].OccurredAt.Before(shipment.Events[j].OccurredAt)
+	})
+	if len(shipment.Events) > maxTrackingEvents {
+		shipment.Events = shipment.Events[len(shipment.Events)-maxTrackingEvents:]
+	}
+	shipment.Status = shipment.Events[len(shipment.Events)-1].Status
+	shipment.UpdatedAt = time.Now().UTC()
+
+	delivered := true
+	for _, s := range order.Shipments {
+		if s.Status.Moving() && (order.Status == StatusPending || order.Status == StatusPaid) {
+			order.Status = StatusShipped
+		}
+		delivered = delivered && s.Status == tracking.StatusDelivered
+	}
+	if delivered && order.Status == StatusShipped {
+		order.Status = StatusDelivered
+	}
+	return true
+}
+
+// trackShipment applies update to the shipment with id of the order with orderID
+// and stores the order if it changed, holding the lock of the order
+func trackShipment(ctx context.Context, repo Repository, orderID, id string, update *tracking.Update) (*Order, *Shipment, error) {
+	ctx, unlock, err := lockOrder(ctx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	order, err := repo.GetOrder(ctx, orderID)
+	if err != nil {
+		return nil, nil, err
+	}
+	shipment := order.shipment(id)
+	if shipment == nil {
+		return nil, nil, ErrShipmentNotFound
+	}
+	status := order.Status
+	if !applyTracking(order, shipment, update) {
+		return order, shipment, nil
+	}
+	order.UpdatedAt = time.Now().UTC()
+	if err := repo.UpdateOrder(ctx, order); err != nil {
+		return nil, nil, err
+	}
+	if order.Status != status {
+		LoggerFromContext(ctx).Infof("order %s is %s", order.ID, order.Status)
+	}
+	return order, shipment, nil
+}
+
+// newShipment returns a new shipment of the parcel with the tracking number
+// of carrier, which left the warehouse with warehouseID at at
+func newShipment(carrier, trackingNumber, warehouseID string, at time.Time) Shipment {
+	return Shipment{
+		ID:             newID(),
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		WarehouseID:    warehouseID,
+		Status:         tracking.StatusLabelCreated,
+		Events:         []TrackingEvent{{Status: tracking.StatusLabelCreated, OccurredAt: at}},
+		CreatedAt:      at,
+		UpdatedAt:      at,
+	}
+}
+
+// createShipmentRequest is the body of CreateShipment
+type createShipmentRequest struct {
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"trackingNumber"`
+	WarehouseID    string `json:"warehouseId,omitempty"`
+}
+
+// trackingRequest is the body of TrackShipment
+type trackingRequest struct {
+	Status      tracking.Status `json:"status"`
+	Location    string          `json:"location,omitempty"`
+	Description string          `json:"description,omitempty"`
+	OccurredAt  time.Time       `json:"occurredAt,omitempty"`
+}
+
+// CreateShipment adds a shipment with the carrier and tracking number of the body
+// to the order named in the path. Its tracking comes from TrackShipment, the
+// carrier webhook or, for configured carriers, from polling the carrier. The
+// shipment may name the warehouse it left, one the order is routed to.
+func CreateShipment(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req createShipmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if req.Carrier == "" {
+		writeError(w, r, &ValidationError{Field: "carrier", Reason: "is required"})
+		return
+	}
+	if req.TrackingNumber == "" {
+		writeError(w, r, &ValidationError{Field: "trackingNumber", Reason: "is required"})
+		return
+	}
+
+	id := mux.Vars(r)["orderId"]
+	ctx, unlock, err := lockOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, id)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !order.Shippable() {
+		writeError(w, r, ErrNotShippable)
+		return
+	}
+	if order.shipmentByTracking(req.Carrier, req.TrackingNumber) != nil {
+		writeError(w, r, &ValidationError{Field: "trackingNumber", Reason: "is already shipped with the order"})
+		return
+	}
+	if req.WarehouseID != "" && order.Routing != nil && !order.Routing.routes(req.WarehouseID) {
+		writeError(w, r, &ValidationError{Field: "warehouseId", Reason: "is not a warehouse the order is routed to"})
+		return
+	}
+
+	now := time.Now().UTC()
+	shipment := newShipment(req.Carrier, req.TrackingNumber, req.WarehouseID, now)
+	order.Shipments = append(order.Shipments, shipment)
+	order.UpdatedAt = now
+	if err := repo.UpdateOrder(ctx, order); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("order %s ships %s with %s", order.ID, shipment.TrackingNumber, shipment.Carrier)
+	writeJSON(w, r, http.StatusCreated, &shipment)
+}
+
+// TrackShipment records the tracking event of the body for the shipment named in the path
+func TrackShipment(w http.ResponseWriter, r *http.Request) {
+	var req trackingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if !req.Status.Known() {
+		writeError(w, r, &ValidationError{Field: "status", Reason: fmt.Sprintf("unknown shipment status %q", req.Status)})
+		return
+	}
+
+	vars := mux.Vars(r)
+	_, shipment, err := trackShipment(r.Context(), RepositoryFromContext(r.Context()), vars["orderId"], vars["shipmentId"], &tracking.Update{
+		Status:      req.Status,
+		Location:    req.Location,
+		Description: req.Description,
+		OccurredAt:  req.OccurredAt,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, shipment)
+}
+
+type carriersKey struct{}
+
+// WithCarriers returns a copy of ctx carrying the tracking carriers by name
+func WithCarriers(ctx context.Context, carriers map[string]tracking.Carrier) context.Context {
+	return context.WithValue(ctx, carriersKey{}, carriers)
+}
+
+// CarriersFromContext returns the tracking carriers stored in ctx by name
+func CarriersFromContext(ctx context.Context) map[string]tracking.Carrier {
+	carriers, _ := ctx.Value(carriersKey{}).(map[string]tracking.Carrier)
+	return carriers
+}
+
+// NewCarriers returns the tracking carriers of cfg by name, called with clients of clients
+func NewCarriers(cfg map[string]config.CarrierConfig, clients *httpclient.Factory) map[string]tracking.Carrier {
+	carriers := map[string]tracking.Carrier{}
+	for name, c := range cfg {
+		c := c
+		carriers[name] = tracking.NewHTTPCarrier(name, &c, clients)
+	}
+	return carriers
+}
+
+// applyCarrierUpdate applies an update of carrier to the shipment it tracks. The
+// order is found by the reference of the update.
+func applyCarrierUpdate(ctx context.Context, repo Repository, carrier string, update *tracking.Update) error {
+	if !update.Status.Known() {
+		LoggerFromContext(ctx).Warnf("ignoring %s tracking of %s with unknown status %q", carrier, update.TrackingNumber, update.Status)
+		return nil
+	}
+	order, err := repo.GetOrder(ctx, update.Reference)
+	if errors.Is(err, ErrOrderNotFound) {
+		LoggerFromContext(ctx).Warnf("ignoring %s tracking of %s for unknown order %q", carrier, update.TrackingNumber, update.Reference)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	shipment := order.shipmentByTracking(carrier, update.TrackingNumber)
+	if shipment == nil {
+		LoggerFromContext(ctx).Warnf("ignoring %s tracking of %s, order %s has no such shipment", carrier, update.TrackingNumber, order.ID)
+		return nil
+	}
+	_, _, err = trackShipment(ctx, repo, order.ID, shipment.ID, update)
+	return err
+}
+
+// CarrierWebhook receives the tracking notifications of the carrier named in the
+// path. An error response makes the carrier deliver the notification again.
+func CarrierWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := mux.Vars(r)["carrier"]
+	carrier, ok := CarriersFromContext(ctx)[name]
+	if !ok {
+		writeError(w, r, &ValidationError{Field: "carrier", Reason: fmt.Sprintf("unknown carrier %q", name)})
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	updates, err := carrier.ParseWebhook(r.Header, body)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	repo := RepositoryFromContext(ctx)
+	for _, update := range updates {
+		if err := applyCarrierUpdate(ctx, repo, name, update); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TrackingPoller polls the carriers for the tracking of the shipments of orders
+// that are not delivered
+type TrackingPoller struct {
+	repo     Repository
+	carriers map[string]tracking.Carrier
+	interval time.Duration
+	logger   logging.Logger
+}
+
+// NewTrackingPoller returns a poller reading the tracking of the shipments in repo
+// from carriers every interval
+func NewTrackingPoller(repo Repository, carriers map[string]tracking.Carrier, interval time.Duration, logger logging.Logger) *TrackingPoller {
+	return &TrackingPoller{
+		repo:     repo,
+		carriers: carriers,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// Run polls the carriers until ctx is done
+func (p *TrackingPoller) Run(ctx context.Context) {
+	ctx = WithLogger(ctx, p.logger)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+		p.PollOnce(ctx)
+	}
+}
+
+// PollOnce polls the tracking of every shipment that is not delivered and
+// returns the number of shipments whose tracking changed
+func (p *TrackingPoller) PollOnce(ctx context.Context) int {
+	changed := 0
+	for _, status := range []Status{StatusPending, StatusPaid, StatusShipped} {
+		opts := ListOptions{Status: status, Limit: DefaultPageSize}
+		for {
+			orders, next, err := p.repo.ListOrders(ctx, opts)
+			if err != nil {
+				p.logger.Errorf("failed to list %s orders: %v", status, err)
+				break
+			}
+			for _, order := range orders {
+				changed += p.pollOrder(ctx, order)
+			}
+			if next == "" || ctx.Err() != nil {
+				break
+			}
+			opts.PageToken = next
+		}
+	}
+	return changed
+}
+
+// pollOrder polls the shipments of order that are not delivered
+func (p *TrackingPoller) pollOrder(ctx context.Context, order *Order) int {
+	changed := 0
+	for _, shipment := range order.Shipments {
+		carrier, ok := p.carriers[shipment.Carrier]
+		if !ok || shipment.Status == tracking.StatusDelivered {
+			continue
+		}
+		update, err := carrier.Track(ctx, shipment.TrackingNumber)
+		if err != nil {
+			p.logger.Warnf("failed to track %s with %s: %v", shipment.TrackingNumber, shipment.Carrier, err)
+			continue
+		}
+		if !update.Status.Known() || update.Status == shipment.Status {
+			continue
+		}
+		if _, _, err := trackShipment(ctx, p.repo, order.ID, shipment.ID, update); err != nil {
+			p.logger.Errorf("failed to record tracking of %s of order %s: %v", shipment.TrackingNumber, order.ID, err)
+			continue
+		}
+		changed++
+	}
+	return changed
+}
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// maxOverdueOrders bounds the overdue orders listed by ListOverdueOrders
+const maxOverdueOrders = 500
+
+// Escalation records that an order kept its status for longer than the SLA of
+// the status
+type Escalation struct {
+	Status Status `json:"status" dynamodbav:"status"`
+	// Deadline is the time the order was due to leave Status by
+	Deadline    time.Time `json:"deadline" dynamodbav:"deadline"`
+	EscalatedAt time.Time `json:"escalatedAt" dynamodbav:"escalatedAt"`
+}
+
+// OverdueOrder is an order that kept its status past the deadline of its SLA
+type OverdueOrder struct {
+	ID         string    `json:"id"`
+	CustomerID string    `json:"customerId"`
+	Status     Status    `json:"status"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+	Deadline   time.Time `json:"deadline"`
+	// OverdueBy is the time since the deadline, in seconds
+	OverdueBy float64 `json:"overdueBy"`
+	// Escalated is set once the watchdog recorded an OrderOverdue event
+	Escalated bool `json:"escalated"`
+}
+
+// SLAWatchdog finds the orders that keep a status, since their last change,
+// for longer than the SLA of the status and escalates them with an
+// OrderOverdue event, once per status
+type SLAWatchdog struct {
+	repo   Repository
+	limits map[Status]time.Duration
+	logger logging.Logger
+}
+
+// NewSLAWatchdog returns a watchdog of the orders in repo with the limits of cfg
+func NewSLAWatchdog(repo Repository, cfg *config.SLAConfig, logger logging.Logger) *SLAWatchdog {
+	limits := map[Status]time.Duration{}
+	for status, limit := range cfg.Limits {
+		if limit.Duration > 0 {
+			limits[Status(status)] = limit.Duration
+		}
+	}
+	return &SLAWatchdog{repo: repo, limits: limits, logger: logger}
+}
+
+// slaResult is the result of a run of the sla task
+type slaResult struct {
+	Overdue   int `json:"overdue"`
+	Escalated int `json:"escalated"`
+}
+
+// each calls fn with the orders of status whose deadline passed at now
+func (s *SLAWatchdog) each(ctx context.Context, status Status, now time.Time, fn func(order *Order, deadline time.Time) error) error {
+	limit, ok := s.limits[status]
+	if !ok {
+		return nil
+	}
+	opts := ListOptions{Status: status, Limit: DefaultPageSize}
+	for {
+		orders, next, err := s.repo.ListOrders(ctx, opts)
+		if err != nil {
+			return err
+		}
+		for _, order := range orders {
+			deadline := order.UpdatedAt.Add(limit)
+			if order.Status != status || !now.After(deadline) {
+				continue
+			}
+			if err := fn(order, deadline); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		opts.PageToken = next
+	}
+}
+
+// statuses returns the statuses with an SLA, or status alone when it is set
+func (s *SLAWatchdog) statuses(status Status) []Status {
+	if status != "" {
+		return []Status{status}
+	}
+	var statuses []Status
+	for _, name := range config.SLAStatuses {
+		if _, ok := s.limits[Status(name)]; ok {
+			statuses = append(statuses, Status(name))
+		}
+	}
+	return statuses
+}
+
+// RunOnce escalates the overdue orders that were not escalated in their
+// status yet and updates the overdue gauge
+func (s *SLAWatchdog) RunOnce(ctx context.Context, now time.Time) (*slaResult, error) {
+	res := &slaResult{}
+	for _, status := range s.statuses("") {
+		overdue := 0
+		err := s.each(ctx, status, now, func(order *Order, deadline time.Time) error {
+			overdue++
+			if order.Escalation != nil && order.Escalation.Status == order.Status {
+				return nil
+			}
+			// the escalation is no change of the order, its UpdatedAt is kept
+			order.Escalation = &Escalation{Status: order.Status, Deadline: deadline, EscalatedAt: now.UTC()}
+			err := s.repo.UpdateOrder(WithEventType(ctx, EventOrderOverdue), order)
+			if errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrOrderNotFound) {
+				// changed since it was listed, the next run looks at it again
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			res.Escalated++
+			slaEscalations.WithLabelValues(string(status)).Inc()
+			s.logger.Warnf("order %s is %s since %s, past its deadline %s", order.ID, status, order.UpdatedAt.Format(time.RFC3339), deadline.Format(time.RFC3339))
+			return nil
+		})
+		if err != nil {
+			return res, err
+		}
+		slaOverdue.WithLabelValues(string(status)).Set(float64(overdue))
+		res.Overdue += overdue
+	}
+	return res, nil
+}
+
+// Overdue returns the overdue orders of status, or of every status with an SLA
+// when it is empty, the longest overdue first
+func (s *SLAWatchdog) Overdue(ctx context.Context, status Status, now time.Time) ([]*OverdueOrder, error) {
+	var out []*OverdueOrder
+	for _, status := range s.statuses(status) {
+		err := s.each(ctx, status, now, func(order *Order, deadline time.Time) error {
+			out = append(out, &OverdueOrder{
+				ID:         order.ID,
+				CustomerID: order.CustomerID,
+				Status:     order.Status,
+				UpdatedAt:  order.UpdatedAt,
+				Deadline:   deadline,
+				OverdueBy:  now.Sub(deadline).Seconds(),
+				Escalated:  order.Escalation != nil && order.Escalation.Status == order.Status,
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Deadline.Before(out[j].Deadline) })
+	return out, nil
+}
+
+type slaKey struct{}
+
+// WithSLA returns a copy of ctx carrying the sla watchdog
+func WithSLA(ctx context.Context, watchdog *SLAWatchdog) context.Context {
+	return context.WithValue(ctx, slaKey{}, watchdog)
+}
+
+// SLAFromContext returns the sla watchdog stored in ctx, or nil
+func SLAFromContext(ctx context.Context) *SLAWatchdog {
+	watchdog, _ := ctx.Value(slaKey{}).(*SLAWatchdog)
+	return watchdog
+}
+
+// overdueOrdersResponse lists overdue orders
+type overdueOrdersResponse struct {
+	Orders []*OverdueOrder `json:"orders"`
+	// Truncated is set when more orders are overdue than were listed
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ListOverdueOrders returns the orders past the SLA of their status, of the
+// status query parameter if given, the longest overdue first, up to limit
+func ListOverdueOrders(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	watchdog := SLAFromContext(ctx)
+	if watchdog == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	query := r.URL.Query()
+	limit := maxOverdueOrders
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxOverdueOrders {
+			writeError(w, r, &ValidationError{Field: "limit", Reason: "must be between 1 and " + strconv.Itoa(maxOverdueOrders)})
+			return
+		}
+		limit = n
+	}
+	status := Status(query.Get("status"))
+	if _, ok := watchdog.limits[status]; status != "" && !ok {
+		writeError(w, r, &ValidationError{Field: "status", Reason: "has no sla"})
+		return
+	}
+
+	orders, err := watchdog.Overdue(ctx, status, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	res := &overdueOrdersResponse{Orders: orders}
+	if len(orders) > limit {
+		res.Orders, res.Truncated = orders[:limit], true
+	}
+	if res.Orders == nil {
+		res.Orders = []*OverdueOrder{}
+	}
+	writeJSON(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/omnom-nom/apiserver"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// MiddlewareSlowRequests is the factory name of the slow request middleware
+const MiddlewareSlowRequests = "slow-requests"
+
+// SlowRequest is a request that took longer than the threshold of its route
+type SlowRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	// Route is the name of the route, the path of requests matching none
+	Route string `json:"route"`
+	// ParamsHash tells apart the path variables and query of the requests of a
+	// route without showing them
+	ParamsHash  string `json:"paramsHash,omitempty"`
+	Status      int    `json:"status"`
+	DurationMs  int64  `json:"durationMs"`
+	ThresholdMs int64  `json:"thresholdMs"`
+	// the DynamoDB calls made for the request
+	DbCalls          int     `json:"dbCalls"`
+	DbDurationMs     int64   `json:"dbDurationMs"`
+	ConsumedCapacity float64 `json:"consumedCapacity"`
+}
+
+// SlowRequests finds the requests slower than the threshold of their route,
+// logs them and keeps the last ones in a ring buffer for the admin api, with
+// the number, duration and consumed capacity of their DynamoDB calls.
+type SlowRequests struct {
+	cfg    config.SlowConfig
+	routes *routeMatcher
+
+	mu    sync.Mutex
+	ring  []SlowRequest
+	next  int
+	total int
+}
+
+// NewSlowRequests returns the middleware finding the slow requests of routes
+// as set in cfg
+func NewSlowRequests(routes map[string][]apiserver.Route, cfg config.SlowConfig) *SlowRequests {
+	return &SlowRequests{cfg: cfg, routes: newRouteMatcher(routes), ring: make([]SlowRequest, 0, cfg.Size)}
+}
+
+// routeMatcher matches requests to the routes of the service, which the
+// middleware run without knowing
+type routeMatcher struct {
+	router *mux.Router
+}
+
+// newRouteMatcher returns the matcher of routes
+func newRouteMatcher(routes map[string][]apiserver.Route) *routeMatcher {
+	router := mux.NewRouter()
+	prefixes := make([]string, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		for _, route := range routes[prefix] {
+			router.Methods(route.Method).Path("/" + prefix + "/" + route.Path).Name(route.Name)
+		}
+	}
+	return &routeMatcher{router: router}
+}
+
+// match returns the name of the route of r and the hash of its path
+// variables and query, false when r matches no route
+func (m *routeMatcher) match(r *http.Request) (string, string, bool) {
+	var match mux.RouteMatch
+	if !m.router.Match(r, &match) || match.Route == nil {
+		return "", "", false
+	}
+	keys := make([]string, 0, len(match.Vars))
+	for key := range match.Vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s&", key, match.Vars[key])
+	}
+	hash.Write([]byte(r.URL.Query().Encode()))
+	return match.Route.GetName(), hex.EncodeToString(hash.Sum(nil)[:8]), true
+}
+
+// add keeps req, replacing the oldest slow request once the ring is full
+func (s *SlowRequests) add(req SlowRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, req)
+	} else {
+		s.ring[s.next] = req
+	}
+	s.next = (s.next + 1) % cap(s.ring)
+	s.total++
+}
+
+// List returns the kept slow requests, the latest first, and the number of
+// slow requests found since the start or the last Reset
+func (s *SlowRequests) List() ([]SlowRequest, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]SlowRequest, 0, len(s.ring))
+	for i := 1; i <= len(s.ring); i++ {
+		out = append(out, s.ring[(s.next-i+len(s.ring))%len(s.ring)])
+	}
+	return out, s.total
+}
+
+// Reset forgets the slow requests
+func (s *SlowRequests) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ring = s.ring[:0]
+	s.next = 0
+	s.total = 0
+}
+
+func (s *SlowRequests) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if isAdminPath(r.URL.Path) {
+		next(w, r)
+		return
+	}
+	usage := &dbUsage{queryThreshold: s.cfg.QueryThreshold.Duration}
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	start := time.Now()
+	next(sw, r.WithContext(withDbUsage(r.Context(), usage)))
+	duration := time.Since(start)
+
+	route, params, ok := s.routes.match(r)
+	if !ok {
+		route = r.URL.Path
+	}
+	threshold := s.cfg.RouteThreshold(route)
+	if threshold == 0 || duration <= threshold {
+		return
+	}
+	calls, dbDuration, capacity := usage.totals()
+	req := SlowRequest{
+		Time:             start.UTC(),
+		RequestID:        RequestIDFromContext(r.Context()),
+		Method:           r.Method,
+		Route:            route,
+		ParamsHash:       params,
+		Status:           sw.status,
+		DurationMs:       duration.Milliseconds(),
+		ThresholdMs:      threshold.Milliseconds(),
+		DbCalls:          calls,
+		DbDurationMs:     dbDuration.Milliseconds(),
+		ConsumedCapacity: capacity,
+	}
+	s.add(req)
+	slowRequests.WithLabelValues(route).Inc()
+	LoggerFromContext(r.Context()).WithFields(logging.Fields{
+		"route":             route,
+		"status":            req.Status,
+		"duration_ms":       req.DurationMs,
+		"db_calls":          calls,
+		"db_duration_ms":    req.DbDurationMs,
+		"consumed_capacity": capacity,
+	}).Warnf("slow request %s %s took %s", r.Method, route, duration.Round(time.Millisecond))
+}
+
+// statusWriter records the status of a response, it flushes through for the
+// streamed responses
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the writer w records the status of, for http.ResponseController
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type slowRequestsKey struct{}
+
+// WithSlowRequests returns a copy of ctx carrying the slow requests
+func WithSlowRequests(ctx context.Context, slow *SlowRequests) context.Context {
+	return context.WithValue(ctx, slowRequestsKey{}, slow)
+}
+
+// SlowRequestsFromContext returns the slow requests stored in ctx, or nil
+func SlowRequestsFromContext(ctx context.Context) *SlowRequests {
+	slow, _ := ctx.Value(slowRequestsKey{}).(*SlowRequests)
+	return slow
+}
+
+// slowRequestsResponse lists the slow requests kept by an instance
+type slowRequestsResponse struct {
+	// Total is the number of slow requests found, kept or not
+	Total    int           `json:"total"`
+	Requests []SlowRequest `json:"requests"`
+}
+
+// ListSlowRequests returns the last slow requests of the instance answering, latest first
+func ListSlowRequests(w http.ResponseWriter, r *http.Request) {
+	slow := SlowRequestsFromContext(r.Context())
+	if slow == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	requests, total := slow.List()
+	writeJSON(w, r, http.StatusOK, &slowRequestsResponse{Total: total, Requests: requests})
+}
+
+// ResetSlowRequests forgets the slow requests of the instance answering
+func ResetSlowRequests(w http.ResponseWriter, r *http.Request) {
+	slow := SlowRequestsFromContext(r.Context())
+	if slow == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	slow.Reset()
+	LoggerFromContext(r.Context()).Info("slow requests reset")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SortKey orders the orders of a listing by one of their json fields
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// String returns the key as written in the sort query parameter
+func (k SortKey) String() string {
+	if k.Desc {
+		return k.Field + ":desc"
+	}
+	return k.Field + ":asc"
+}
+
+// sortableFields compare two orders by the json fields the listings sort on,
+// returning a negative number when a sorts before b ascending
+var sortableFields = map[string]func(a, b *Order) int{
+	"createdAt": func(a, b *Order) int { return a.CreatedAt.Compare(b.CreatedAt) },
+	"updatedAt": func(a, b *Order) int { return a.UpdatedAt.Compare(b.UpdatedAt) },
+	"total": func(a, b *Order) int {
+		// amounts of different currencies do not compare, the totals sort by
+		// currency and then by amount
+		if c := strings.Compare(totalCurrency(a), totalCurrency(b)); c != 0 {
+			return c
+		}
+		return a.Total.Cmp(b.Total)
+	},
+	"status":     func(a, b *Order) int { return strings.Compare(string(a.Status), string(b.Status)) },
+	"customerId": func(a, b *Order) int { return strings.Compare(a.CustomerID, b.CustomerID) },
+	"id":         func(a, b *Order) int { return strings.Compare(a.ID, b.ID) },
+}
+
+// totalCurrency returns the currency of the total of order, that of the order
+// for a total read without its currency
+func totalCurrency(order *Order) string {
+	if order.Total.Currency != "" {
+		return order.Total.Currency
+	}
+	return order.Currency
+}
+
+// parseSort returns the keys of the sort query parameter of params, a comma
+// separated list of fields each followed by :asc, the default, or :desc. It
+// returns nil without one, for the orders to keep the order of the listing.
+func parseSort(params url.Values) ([]SortKey, error) {
+	value := strings.TrimSpace(params.Get("sort"))
+	if value == "" {
+		return nil, nil
+	}
+	var keys []SortKey
+	seen := map[string]bool{}
+	for _, term := range strings.Split(value, ",") {
+		field, direction, _ := strings.Cut(strings.TrimSpace(term), ":")
+		if field == "" {
+			continue
+		}
+		if _, ok := sortableFields[field]; !ok {
+			return nil, &ValidationError{Field: "sort", Reason: fmt.Sprintf("orders can not be sorted by %q, only by createdAt, updatedAt, total, status, customerId and id", field)}
+		}
+		if seen[field] {
+			return nil, &ValidationError{Field: "sort", Reason: fmt.Sprintf("%q is sorted by twice", field)}
+		}
+		seen[field] = true
+		key := SortKey{Field: field}
+		switch strings.ToLower(direction) {
+		case "", "asc":
+		case "desc":
+			key.Desc = true
+		default:
+			return nil, &ValidationError{Field: "sort", Reason: fmt.Sprintf("%q is not a direction, only asc or desc", direction)}
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// sortOrders sorts orders by keys, then by id for a stable order
+func sortOrders(orders []*Order, keys []SortKey) {
+	if len(keys) == 0 {
+		return
+	}
+	sort.SliceStable(orders, func(i, j int) bool {
+		for _, key := range keys {
+			c := sortableFields[key.Field](orders[i], orders[j])
+			if key.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return orders[i].ID < orders[j].ID
+	})
+}
+
+// sortFields returns the json fields of the orders read to sort them by keys
+func sortFields(keys []SortKey) []string {
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, key.Field)
+	}
+	return fields
+}
+
+// createdAtSort reports whether keys sort by createdAt alone, which the
+// indexes of the orders serve, and whether descending
+func createdAtSort(keys []SortKey) (desc bool, ok bool) {
+	if len(keys) != 1 || keys[0].Field != "createdAt" {
+		return false, false
+	}
+	return keys[0].Desc, true
+}
+
+// sortTerm returns the keys as a term of the filter of the cursors
+func sortTerm(keys []SortKey) string {
+	terms := make([]string, 0, len(keys))
+	for _, key := range keys {
+		terms = append(terms, key.String())
+	}
+	return strings.Join(terms, ",")
+}
+
+type sortKey struct{}
+
+// withSort returns a copy of ctx sorting the orders listed by keys
+func withSort(ctx context.Context, keys []SortKey) context.Context {
+	return context.WithValue(ctx, sortKey{}, keys)
+}
+
+// sortFromContext returns the keys the orders listed with ctx are sorted by,
+// nil for the order of the listing
+func sortFromContext(ctx context.Context) []SortKey {
+	keys, _ := ctx.Value(sortKey{}).([]SortKey)
+	return keys
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/omnom-nom/order/money"
+)
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []SortKey
+	}{
+		{"", nil},
+		{"createdAt", []SortKey{{Field: "createdAt"}}},
+		{"total:desc, createdAt:ASC", []SortKey{{Field: "total", Desc: true}, {Field: "createdAt"}}},
+		{"status,,id:desc", []SortKey{{Field: "status"}, {Field: "id", Desc: true}}},
+	}
+	for _, tt := range tests {
+		got, err := parseSort(url.Values{"sort": {tt.value}})
+		if err != nil {
+			t.Fatalf("parseSort(%q): %v", tt.value, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSort(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestParseSortInvalid(t *testing.T) {
+	for _, value := range []string{
+		"color",
+		"total:up",
+		"createdAt,createdAt:desc",
+	} {
+		var validationErr *ValidationError
+		if _, err := parseSort(url.Values{"sort": {value}}); !errors.As(err, &validationErr) {
+			t.Errorf("parseSort(%q) returned %v, want a validation error", value, err)
+		}
+	}
+}
+
+func TestSortOrdersByTotal(t *testing.T) {
+	orders := []*Order{
+		{ID: "o-1", Currency: "USD", Total: money.New(500, "USD")},
+		{ID: "o-2", Currency: "JPY", Total: money.New(900, "JPY")},
+		{ID: "o-3", Currency: "USD", Total: money.New(100, "USD")},
+		{ID: "o-4", Currency: "JPY", Total: money.New(50, "JPY")},
+		{ID: "o-5", Currency: "USD", Total: money.New(100, "USD")},
+	}
+	sortOrders(orders, []SortKey{{Field: "total", Desc: true}})
+
+	// by currency, then by amount, then by id
+	want := []string{"o-1", "o-3", "o-5", "o-2", "o-4"}
+	var got []string
+	for _, order := range orders {
+		got = append(got, order.ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sortOrders by total:desc = %v, want %v", got, want)
+	}
+}
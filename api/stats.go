@@ -0,0 +1,322 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/money"
+)
+
+// statsAllTenants is the tenant of the statistics of the orders of all tenants
+const statsAllTenants = "*"
+
+// maxStatsAttempts bounds the attempts to count an order whose entry was
+// changed by another instance meanwhile
+const maxStatsAttempts = 5
+
+// StatsEntry is what an order counts for in the statistics of the day it was
+// created on, kept to take it back out when the order changes
+type StatsEntry struct {
+	OrderID string `json:"orderId" dynamodbav:"orderId"`
+	Tenant  string `json:"tenant,omitempty" dynamodbav:"tenant,omitempty"`
+	Day     string `json:"day" dynamodbav:"day"`
+	// Status is the status the order is counted in, empty while it is deleted
+	Status Status `json:"status,omitempty" dynamodbav:"status,omitempty"`
+	// Revenue is the total of a paid order, in the base currency when there is
+	// one, kept without its currency so the totals of all currencies add up
+	Revenue money.Money `json:"revenue" dynamodbav:"revenue"`
+	// FulfilledIn is the time in seconds a delivered order took from its creation
+	FulfilledIn float64 `json:"fulfilledIn,omitempty" dynamodbav:"fulfilledIn,omitempty"`
+	Version     int64   `json:"version" dynamodbav:"version"`
+}
+
+// StatsDay is the statistics of the orders of a tenant created on a day
+type StatsDay struct {
+	Day      string           `json:"day"`
+	Statuses map[Status]int64 `json:"statuses"`
+	Revenue  money.Money      `json:"revenue"`
+	// Fulfilled is the number of orders delivered, which took FulfillmentSeconds
+	Fulfilled          int64   `json:"fulfilled"`
+	FulfillmentSeconds float64 `json:"-"`
+}
+
+// StatsStore is implemented by repositories keeping order statistics. Its
+// methods fail with ErrNotSupported until EnableStats is called.
+type StatsStore interface {
+	// CountOrder counts the order with id in the state of order at the time
+	// at instead of its previous state, or takes it out when order is nil. An
+	// order older than the one counted is ignored.
+	CountOrder(ctx context.Context, id string, order *Order, at time.Time) error
+	// OrderStats returns the days of tenant between from and to, both
+	// formatted as 2006-01-02, that have orders, oldest first
+	OrderStats(ctx context.Context, tenant, from, to string) ([]*StatsDay, error)
+}
+
+// statsEnabler is implemented by repositories able to keep order statistics
+type statsEnabler interface {
+	enableStats(table string)
+}
+
+// EnableStats makes repo keep order statistics, in table for the backends
+// that keep them in a separate table
+func EnableStats(repo Repository, table string) error {
+	enabler, ok := repo.(statsEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support stats", repo)
+	}
+	enabler.enableStats(table)
+	return nil
+}
+
+// findStatsStore returns the stats store of repo or of the repository it decorates
+func findStatsStore(repo Repository) (StatsStore, bool) {
+	var store StatsStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(StatsStore)
+		return ok
+	})
+	return store, found
+}
+
+// nextStatsEntry returns the entry of order counted at at, following prev,
+// either may be nil, and false when order is older than prev
+func nextStatsEntry(prev *StatsEntry, order *Order, at time.Time) (*StatsEntry, bool) {
+	if order == nil {
+		return nil, prev != nil
+	}
+	if prev != nil && order.Version <= prev.Version {
+		return nil, false
+	}
+	next := &StatsEntry{
+		OrderID: order.ID,
+		Tenant:  order.TenantID,
+		Day:     order.CreatedAt.UTC().Format(createdDayLayout),
+		Version: order.Version,
+	}
+	if order.DeletedAt != nil {
+		return next, true
+	}
+	next.Status = order.Status
+	switch order.Status {
+	case StatusPaid, StatusShipped, StatusDelivered:
+		next.Revenue = order.Total.WithoutCurrency()
+	}
+	if order.Status == StatusDelivered {
+		if prev != nil && prev.Status == StatusDelivered {
+			next.FulfilledIn = prev.FulfilledIn
+		} else {
+			next.FulfilledIn = at.Sub(order.CreatedAt).Seconds()
+		}
+	}
+	return next, true
+}
+
+// statsDelta is a change of the statistics of the orders of a tenant created on a day
+type statsDelta struct {
+	tenant      string
+	day         string
+	statuses    map[Status]int64
+	revenue     money.Money
+	fulfilled   int64
+	fulfillment float64
+}
+
+// statsDeltas returns the changes of the days of the tenant and of all
+// tenants counting an order as next instead of prev, either may be nil
+func statsDeltas(prev, next *StatsEntry) []*statsDelta {
+	var deltas []*statsDelta
+	count := func(entry *StatsEntry, sign int64) {
+		if entry == nil || entry.Status == "" {
+			return
+		}
+		for _, tenant := range []string{entry.Tenant, statsAllTenants} {
+			var delta *statsDelta
+			for _, d := range deltas {
+				if d.tenant == tenant && d.day == entry.Day {
+					delta = d
+				}
+			}
+			if delta == nil {
+				delta = &statsDelta{tenant: tenant, day: entry.Day, statuses: map[Status]int64{}}
+				deltas = append(deltas, delta)
+			}
+			delta.statuses[entry.Status] += sign
+			delta.revenue = delta.revenue.Add(entry.Revenue.Mul(sign))
+			if entry.Status == StatusDelivered {
+				delta.fulfilled += sign
+				delta.fulfillment += float64(sign) * entry.FulfilledIn
+			}
+		}
+	}
+	count(prev, -1)
+	count(next, 1)
+	return deltas
+}
+
+// apply adds the delta to day
+func (d *statsDelta) apply(day *StatsDay) {
+	for status, n := range d.statuses {
+		day.Statuses[status] += n
+		if day.Statuses[status] == 0 {
+			delete(day.Statuses, status)
+		}
+	}
+	day.Revenue = day.Revenue.Add(d.revenue)
+	day.Fulfilled += d.fulfilled
+	day.FulfillmentSeconds += d.fulfillment
+}
+
+// SubscribeStats counts the orders of the events published to bus in store,
+// logging the failures with logger. The totals of the orders are converted to
+// the base currency with fx, unless base is empty.
+func SubscribeStats(bus *events.Bus, store StatsStore, base string, fx money.Converter, logger logging.Logger) *events.Subscription {
+	return bus.Subscribe(events.SubscribeOptions{
+		Name:   "stats",
+		Buffer: subscriberBuffer,
+		Policy: events.Block,
+	}, func(ctx context.Context, event *events.Event) {
+		if err := countEvent(ctx, store, base, fx, event); err != nil {
+			statsFailures.Inc()
+			logger.Errorf("failed to count %s event %s of order %s: %v", event.Type, event.ID, event.OrderID, err)
+		}
+	})
+}
+
+// countEvent counts the order of event in store, with its total in base
+func countEvent(ctx context.Context, store StatsStore, base string, fx money.Converter, event *events.Event) error {
+	if isReturnEvent(event.Type) {
+		return nil
+	}
+	order := &Order{}
+	if err := json.Unmarshal(event.Payload, order); err != nil {
+		return err
+	}
+	// the events of removals carry the id of the order only
+	if order.Version == 0 {
+		if event.Type == EventOrderArchived {
+			// archived orders still count for the days they were created on
+			return nil
+		}
+		order = nil
+	}
+	// the orders stored before orders had a currency are counted as they are
+	if order != nil && base != "" && order.Currency != "" {
+		total, err := fx.Convert(ctx, order.Total, base)
+		if err != nil {
+			return fmt.Errorf("failed to convert the total to %s: %v", base, err)
+		}
+		order.Total = total
+	}
+	return store.CountOrder(ctx, event.OrderID, order, event.CreatedAt)
+}
+
+// orderStatsResponse is the statistics of the orders of a tenant created
+// between two days
+type orderStatsResponse struct {
+	Tenant   string           `json:"tenant,omitempty"`
+	From     string           `json:"from"`
+	To       string           `json:"to"`
+	Orders   int64            `json:"orders"`
+	Statuses map[Status]int64 `json:"statuses"`
+	Revenue  money.Money      `json:"revenue"`
+	// Currency is the currency of the revenue, empty when the totals of all
+	// currencies add up
+	Currency string `json:"currency,omitempty"`
+	// AverageFulfillmentSeconds is the average time the orders delivered took
+	// from their creation
+	AverageFulfillmentSeconds float64     `json:"averageFulfillmentSeconds"`
+	Days                      []*StatsDay `json:"days"`
+}
+
+// statsRange returns the days of the from and to query parameters of r, by
+// default the 30 days up to today
+func statsRange(r *http.Request, maxDays int) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if raw := query.Get("to"); raw != "" {
+		day, err := time.Parse(createdDayLayout, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, &ValidationError{Field: "to", Reason: "must be a date like 2006-01-02"}
+		}
+		to = day
+	}
+	from := to.AddDate(0, 0, -29)
+	if raw := query.Get("from"); raw != "" {
+		day, err := time.Parse(createdDayLayout, raw)
+		if err != nil {
+			return time.Time{}, time.Time{}, &ValidationError{Field: "from", Reason: "must be a date like 2006-01-02"}
+		}
+		from = day
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, &ValidationError{Field: "from", Reason: "must not be after to"}
+	}
+	if int(to.Sub(from).Hours()/24) >= maxDays {
+		return time.Time{}, time.Time{}, &ValidationError{Field: "from", Reason: "must be less than " + strconv.Itoa(maxDays) + " days before to"}
+	}
+	return from, to, nil
+}
+
+// GetOrderStats returns the statistics of the orders created between the from
+// and to query parameters, of the tenant query parameter or of all tenants:
+// their number by status, the revenue of the paid ones and the average time
+// the delivered ones took, in all and by day
+func GetOrderStats(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, ok := findStatsStore(RepositoryFromContext(ctx))
+	if !ok {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	from, to, err := statsRange(r, ConfigFromContext(ctx).Stats.MaxDays)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	bucket := tenant
+	if bucket == "" {
+		bucket = statsAllTenants
+	}
+	days, err := store.OrderStats(ctx, bucket, from.Format(createdDayLayout), to.Format(createdDayLayout))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+
+	res := &orderStatsResponse{
+		Tenant:   tenant,
+		From:     from.Format(createdDayLayout),
+		To:       to.Format(createdDayLayout),
+		Statuses: map[Status]int64{},
+		Currency: ConfigFromContext(ctx).Currency.Base,
+		Days:     days,
+	}
+	var fulfilled int64
+	var fulfillment float64
+	for _, day := range days {
+		for status, n := range day.Statuses {
+			res.Statuses[status] += n
+			res.Orders += n
+		}
+		res.Revenue = res.Revenue.Add(day.Revenue)
+		fulfilled += day.Fulfilled
+		fulfillment += day.FulfillmentSeconds
+	}
+	if fulfilled > 0 {
+		res.AverageFulfillmentSeconds = fulfillment / float64(fulfilled)
+	}
+	if res.Days == nil {
+		res.Days = []*StatsDay{}
+	}
+	writeJSON(w, r, http.StatusOK, res)
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// Migrator is implemented by repositories that can create their own schema
+type Migrator interface {
+	Migrate(ctx context.Context) error
+}
+
+// NewRepository returns the repository of the storage backend selected in cfg,
+// recording outbox events and order streams, keeping webhooks, returns, customers, hosts, quotas, stats, drafts,
+// schedules, jobs, leases and cluster members, reading through from the archive and behind the order cache when
+// they are enabled. Deleted orders are kept for the retention of cfg.
+func NewRepository(ctx context.Context, cfg *config.Config) (Repository, error) {
+	repo, err := newBackend(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Outbox.Enabled {
+		if err := EnableOutbox(repo, cfg.Db.OutboxTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Storage.Mode == config.StorageModeEvents {
+		if err := EnableEventSourcing(repo, cfg.Db.StreamsTable, cfg.Storage.SnapshotEvery); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Webhooks.Enabled {
+		if err := EnableWebhooks(repo, cfg.Db.WebhooksTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Returns.Enabled {
+		if err := EnableReturns(repo, cfg.Db.ReturnsTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Customers.Enabled {
+		if err := EnableCustomers(repo, cfg.Db.CustomersTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Hosts.Enabled {
+		if err := EnableHosts(repo, cfg.Db.HostsTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Quotas.Enabled {
+		if err := EnableQuotas(repo, cfg.Db.QuotasTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DeadLetters.Enabled {
+		if err := EnableDeadLetters(repo, cfg.Db.DeadLettersTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Sagas.Enabled {
+		if err := EnableSagas(repo, cfg.Db.SagasTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Routing.Enabled {
+		if err := EnableWarehouses(repo, cfg.Db.WarehousesTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Stats.Enabled {
+		if err := EnableStats(repo, cfg.Db.StatsTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Drafts.Enabled {
+		if err := EnableDrafts(repo, cfg.Db.DraftsTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Schedules.Enabled {
+		if err := EnableSchedules(repo, cfg.Db.SchedulesTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Jobs.Enabled {
+		if err := EnableJobs(repo, cfg.Db.JobsTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Cluster.Enabled {
+		if err := EnableLeases(repo, cfg.Db.LeasesTable); err != nil {
+			return nil, err
+		}
+		if err := EnableMembers(repo, cfg.Db.MembersTable); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Retention.Archive.Enabled {
+		archive, err := NewS3Archive(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create archive: %v", err)
+		}
+		repo = NewArchivedRepository(repo, archive)
+	}
+	if cfg.Cache.Enabled {
+		repo = NewCachedRepository(repo, NewRedisCache(&cfg.Cache), cfg.Cache.TTL.Duration)
+	}
+	if cfg.Encryption.Enabled {
+		keys, err := NewKMSDataKeys(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kms client: %v", err)
+		}
+		repo = NewEncryptedRepository(repo, NewSealer(keys, cfg.Encryption))
+	}
+	return NewSoftDeleteRepository(repo, cfg.Retention.Deleted.Duration), nil
+}
+
+func newBackend(ctx context.Context, cfg *config.Config) (Repository, error) {
+	switch cfg.Storage.Backend {
+	case config.BackendDynamoDB:
+		db, err := NewDb(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create db client: %v", err)
+		}
+		return NewDynamoRepository(db, cfg.Db.OrdersTable), nil
+	case config.BackendPostgres:
+		return NewPostgresRepository(cfg.Storage.DSN)
+	case config.BackendSQLite:
+		return NewSQLiteRepository(cfg.Storage.DSN)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+}
+
+// MigrateStorage creates or upgrades the schema of the storage backend selected in cfg
+func MigrateStorage(ctx context.Context, cfg *config.Config) error {
+	if cfg.Storage.Backend == config.BackendDynamoDB {
+		db, err := NewDb(ctx, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to create db client: %v", err)
+		}
+		return db.Migrate(ctx, &cfg.Db)
+	}
+
+	repo, err := newBackend(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	migrator, ok := repo.(Migrator)
+	if !ok {
+		return fmt.Errorf("storage backend %s has no migrations", cfg.Storage.Backend)
+	}
+	return migrator.Migrate(ctx)
+}
@@ -0,0 +1,502 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/jobs"
+)
+
+const (
+	// SubjectExportJob is the type of the jobs exporting everything kept about
+	// a customer, for a data subject access request
+	SubjectExportJob jobs.Type = "subject-export"
+	// ErasureJob is the type of the jobs erasing the personal data of a customer
+	ErasureJob jobs.Type = "erasure"
+)
+
+// maxErasureAttempts is the number of times a record changed while it is
+// erased is read and erased again
+const maxErasureAttempts = 3
+
+// jsonNull is the erased value of a change of an edit
+var jsonNull = json.RawMessage("null")
+
+// subjectParams are the params of the data subject jobs
+type subjectParams struct {
+	CustomerID string `json:"customerId"`
+}
+
+// SubjectData is everything kept about a customer, the file of a subject
+// export
+type SubjectData struct {
+	CustomerID string    `json:"customerId"`
+	Customer   *Customer `json:"customer,omitempty"`
+	// Orders are the orders of the customer, deleted and archived ones included
+	Orders     []*Order    `json:"orders"`
+	Returns    []*Return   `json:"returns,omitempty"`
+	Schedules  []*Schedule `json:"schedules,omitempty"`
+	ExportedAt time.Time   `json:"exportedAt"`
+}
+
+// SubjectExportResult is the result of a subject export job
+type SubjectExportResult struct {
+	CustomerID     string `json:"customerId"`
+	Orders         int    `json:"orders"`
+	ArchivedOrders int    `json:"archivedOrders"`
+	Returns        int    `json:"returns"`
+	Schedules      int    `json:"schedules"`
+	Bucket         string `json:"bucket,omitempty"`
+	Key            string `json:"key,omitempty"`
+	// URL downloads the export until URLExpiresAt
+	URL          string     `json:"url,omitempty"`
+	URLExpiresAt *time.Time `json:"urlExpiresAt,omitempty"`
+}
+
+// ErasureResult is the result of an erasure job, the report of the records
+// erased and of their verification
+type ErasureResult struct {
+	CustomerID string `json:"customerId"`
+	// Customer reports whether the customer record was found
+	Customer       bool `json:"customer"`
+	Orders         int  `json:"orders"`
+	ArchivedOrders int  `json:"archivedOrders"`
+	Schedules      int  `json:"schedules"`
+	// Verified reports whether every record was read again without personal data
+	Verified bool `json:"verified"`
+	// Remaining names the records still holding personal data
+	Remaining []string `json:"remaining,omitempty"`
+}
+
+// hasPersonalData reports whether the customer holds personal data
+func (c *Customer) hasPersonalData() bool {
+	return c.Name != "" || c.Email != "" || c.Phone != "" || len(c.Addresses) > 0 || c.Sealed != nil
+}
+
+// erasePersonalData removes the name, email, phone and addresses of the
+// customer, it reports whether there were any
+func (c *Customer) erasePersonalData(now time.Time) bool {
+	if !c.hasPersonalData() {
+		return false
+	}
+	c.Name, c.Email, c.Phone = "", "", ""
+	c.Addresses, c.Sealed = []CustomerAddress{}, nil
+	c.UpdatedAt, c.ErasedAt = now, &now
+	return true
+}
+
+// hasPersonalData reports whether the order holds personal data
+func (o *Order) hasPersonalData() bool {
+	if o.ShippingAddress != nil || o.Sealed != nil || (o.Payment != nil && o.Payment.ID != "") {
+		return true
+	}
+	for _, edit := range o.Edits {
+		if edit.ClientIP != "" {
+			return true
+		}
+		for _, change := range edit.Changes {
+			if change.Field == "shippingAddress" && (!bytes.Equal(change.Before, jsonNull) || !bytes.Equal(change.After, jsonNull)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// erasePersonalData removes the shipping address and payment id of the order,
+// its sealed fields, and the addresses and client addresses of the audit
+// trail of its edits. It reports whether there were any.
+func (o *Order) erasePersonalData(now time.Time) bool {
+	if !o.hasPersonalData() {
+		return false
+	}
+	o.ShippingAddress, o.Sealed = nil, nil
+	if o.Payment != nil {
+		payment := *o.Payment
+		payment.ID = ""
+		o.Payment = &payment
+	}
+	for i := range o.Edits {
+		edit := &o.Edits[i]
+		edit.ClientIP = ""
+		for j := range edit.Changes {
+			if edit.Changes[j].Field == "shippingAddress" {
+				edit.Changes[j].Before, edit.Changes[j].After = jsonNull, jsonNull
+			}
+		}
+	}
+	o.ErasedAt = &now
+	return true
+}
+
+// hasPersonalData reports whether the schedule holds personal data
+func (s *Schedule) hasPersonalData() bool {
+	return s.ShippingAddress != nil || s.PaymentMethod != ""
+}
+
+// customerOrders returns every order of a customer in repo
+func customerOrders(ctx context.Context, repo Repository, customerID string) ([]*Order, error) {
+	var orders []*Order
+	opts := ListOptions{CustomerID: customerID, Limit: DefaultPageSize}
+	for {
+		page, next, err := repo.ListOrders(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, page...)
+		if next == "" {
+			return orders, nil
+		}
+		opts.PageToken = next
+	}
+}
+
+// retryConflicts calls fn again while it fails with ErrVersionConflict, up to
+// maxErasureAttempts times
+func retryConflicts(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxErasureAttempts; attempt++ {
+		if err = fn(); !errors.Is(err, ErrVersionConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// NewSubjectExportJob returns the function of the subject export jobs, writing
+// everything repo keeps about a customer to a JSON file in the jobs bucket of
+// cfg. The personal data is exported as it is, it is not redacted.
+func NewSubjectExportJob(ctx context.Context, cfg *config.Config, repo Repository) (jobs.Func, error) {
+	e, err := newS3Exporter(ctx, cfg, repo)
+	if err != nil {
+		return nil, err
+	}
+	return e.runSubject, nil
+}
+
+// runSubject collects the data of the customer of job and uploads it
+func (e *s3Exporter) runSubject(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+	var params subjectParams
+	if err := job.DecodeParams(&params); err != nil {
+		return nil, err
+	}
+	// the deleted orders are kept until they are purged, they are exported too
+	repo := belowSoftDelete(e.repo)
+	data := &SubjectData{CustomerID: params.CustomerID, Orders: []*Order{}, ExportedAt: time.Now().UTC()}
+	res := &SubjectExportResult{CustomerID: params.CustomerID}
+
+	if store, ok := findCustomerStore(repo); ok {
+		customer, err := store.GetCustomer(ctx, params.CustomerID)
+		if err != nil && !errors.Is(err, ErrCustomerNotFound) {
+			return res, err
+		}
+		data.Customer = customer
+	}
+	orders, err := customerOrders(ctx, repo, params.CustomerID)
+	if err != nil {
+		return res, err
+	}
+	data.Orders = append(data.Orders, orders...)
+	res.Orders = len(orders)
+	if archive, ok := findArchive(repo); ok {
+		ids, err := archive.CustomerOrderIDs(ctx, params.CustomerID)
+		if err != nil {
+			return res, err
+		}
+		// read through the repository, which opens sealed fields
+		archived, err := batchGetOrders(ctx, repo, ids)
+		if err != nil {
+			return res, err
+		}
+		for _, id := range ids {
+			if order, ok := archived[id]; ok && order.ArchivedAt != nil {
+				data.Orders = append(data.Orders, order)
+				res.ArchivedOrders++
+			}
+		}
+	}
+	report(int64(len(data.Orders)), 0)
+
+	if store, ok := findReturnStore(repo); ok {
+		for _, order := range data.Orders {
+			returns, err := store.ListReturns(ctx, order.ID)
+			if err != nil {
+				return res, err
+			}
+			data.Returns = append(data.Returns, returns...)
+		}
+		res.Returns = len(data.Returns)
+	}
+	if store, ok := findScheduleStore(repo); ok {
+		if data.Schedules, err = store.ListSchedules(ctx, params.CustomerID); err != nil {
+			return res, err
+		}
+		res.Schedules = len(data.Schedules)
+	}
+
+	body, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return res, err
+	}
+	name := "customer-" + params.CustomerID + ".json"
+	key := e.prefix + job.ID + "/" + name
+	if err := e.upload(ctx, key, name, "application/json", bytes.NewReader(body)); err != nil {
+		return res, err
+	}
+	res.Bucket, res.Key = e.bucket, key
+	download, expires, err := e.link(ctx, key)
+	if err != nil {
+		return res, err
+	}
+	res.URL, res.URLExpiresAt = download, &expires
+	LoggerFromContext(ctx).Infof("exported the data of customer %s to %s", params.CustomerID, key)
+	return res, nil
+}
+
+// NewErasureJob returns the function of the erasure jobs, erasing the personal
+// data of a customer from the customer, its orders, deleted and archived ones
+// included, and its schedules in repo. Every record is read again once
+// erased, the job fails when one still holds personal data.
+func NewErasureJob(repo Repository) jobs.Func {
+	return func(ctx context.Context, job *jobs.Job, report func(done, total int64)) (interface{}, error) {
+		var params subjectParams
+		if err := job.DecodeParams(&params); err != nil {
+			return nil, err
+		}
+		e := &erasure{repo: belowSoftDelete(repo), customerID: params.CustomerID, now: time.Now().UTC()}
+		e.res = &ErasureResult{CustomerID: params.CustomerID, Verified: true}
+		if err := e.run(ctx, report); err != nil {
+			e.res.Verified = false
+			return e.res, err
+		}
+		if !e.res.Verified {
+			return e.res, fmt.Errorf("personal data of customer %s remains in %d records", params.CustomerID, len(e.res.Remaining))
+		}
+		LoggerFromContext(ctx).Infof("erased the personal data of customer %s from %d orders and %d archived orders", params.CustomerID, e.res.Orders, e.res.ArchivedOrders)
+		return e.res, nil
+	}
+}
+
+// erasure erases the personal data of a customer
+type erasure struct {
+	repo       Repository
+	customerID string
+	now        time.Time
+	res        *ErasureResult
+}
+
+// remains records a record still holding personal data once erased
+func (e *erasure) remains(record string) {
+	e.res.Verified = false
+	e.res.Remaining = append(e.res.Remaining, record)
+}
+
+func (e *erasure) run(ctx context.Context, report func(done, total int64)) error {
+	if err := e.eraseCustomer(ctx); err != nil {
+		return err
+	}
+	orders, err := customerOrders(ctx, e.repo, e.customerID)
+	if err != nil {
+		return err
+	}
+	for i, order := range orders {
+		if err := e.eraseOrder(ctx, order.ID); err != nil {
+			return err
+		}
+		report(int64(i+1), int64(len(orders)))
+	}
+	if err := e.eraseArchivedOrders(ctx); err != nil {
+		return err
+	}
+	return e.eraseSchedules(ctx)
+}
+
+func (e *erasure) eraseCustomer(ctx context.Context) error {
+	store, ok := findCustomerStore(e.repo)
+	if !ok {
+		return nil
+	}
+	err := retryConflicts(func() error {
+		customer, err := store.GetCustomer(ctx, e.customerID)
+		if err != nil {
+			return err
+		}
+		e.res.Customer = true
+		if !customer.erasePersonalData(e.now) {
+			return nil
+		}
+		return store.UpdateCustomer(ctx, customer)
+	})
+	if errors.Is(err, ErrCustomerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to erase customer %s: %w", e.customerID, err)
+	}
+
+	customer, err := store.GetCustomer(ctx, e.customerID)
+	if err != nil {
+		return err
+	}
+	if customer.hasPersonalData() {
+		e.remains("customer " + customer.ID)
+	}
+	return nil
+}
+
+// eraseOrder erases the order with id, which an update the customer made after
+// it was listed may have changed
+func (e *erasure) eraseOrder(ctx context.Context, id string) error {
+	err := retryConflicts(func() error {
+		order, err := e.repo.GetOrder(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !order.erasePersonalData(e.now) {
+			return nil
+		}
+		return e.repo.UpdateOrder(ctx, order)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to erase order %s: %w", id, err)
+	}
+	e.res.Orders++
+	// the history of an event sourced order keeps the data the update erased
+	if store, ok := findEventStore(e.repo); ok {
+		err := store.CompactStream(ctx, id)
+		if err != nil && !errors.Is(err, ErrNotSupported) {
+			return fmt.Errorf("failed to compact the stream of order %s: %w", id, err)
+		}
+	}
+
+	order, err := e.repo.GetOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	if order.hasPersonalData() {
+		e.remains("order " + id)
+	}
+	return nil
+}
+
+// eraseArchivedOrders replaces the archived orders of the customer with their
+// erased copies
+func (e *erasure) eraseArchivedOrders(ctx context.Context) error {
+	archive, ok := findArchive(e.repo)
+	if !ok {
+		return nil
+	}
+	ids, err := archive.CustomerOrderIDs(ctx, e.customerID)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		order, err := archive.GetOrder(ctx, id)
+		if errors.Is(err, ErrOrderNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if order.erasePersonalData(e.now) {
+			if err := archive.ReplaceOrder(ctx, order); err != nil {
+				return fmt.Errorf("failed to erase archived order %s: %w", id, err)
+			}
+		}
+		e.res.ArchivedOrders++
+
+		if order, err = archive.GetOrder(ctx, id); err != nil {
+			return err
+		}
+		if order.hasPersonalData() {
+			e.remains("archived order " + id)
+		}
+	}
+	return nil
+}
+
+// eraseSchedules cancels the schedules of the customer, which can not place
+// orders without an address and payment method, and erases them
+func (e *erasure) eraseSchedules(ctx context.Context) error {
+	store, ok := findScheduleStore(e.repo)
+	if !ok {
+		return nil
+	}
+	schedules, err := store.ListSchedules(ctx, e.customerID)
+	if err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		err := retryConflicts(func() error {
+			current, err := store.GetSchedule(ctx, s.ID)
+			if err != nil || !current.hasPersonalData() {
+				return err
+			}
+			current.ShippingAddress, current.PaymentMethod = nil, ""
+			if current.Status == ScheduleActive || current.Status == SchedulePaused {
+				current.Status = ScheduleCancelled
+			}
+			current.UpdatedAt = e.now
+			return store.UpdateSchedule(ctx, current)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to erase schedule %s: %w", s.ID, err)
+		}
+		e.res.Schedules++
+
+		stored, err := store.GetSchedule(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		if stored.hasPersonalData() {
+			e.remains("schedule " + s.ID)
+		}
+	}
+	return nil
+}
+
+// StartSubjectExport queues a job exporting everything kept about the customer
+// named in the path to a JSON file in the jobs bucket, answered to be followed
+// with GetJob, whose result links the file
+func StartSubjectExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if ConfigFromContext(ctx).Jobs.Bucket == "" {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	startSubjectJob(w, r, SubjectExportJob)
+}
+
+// StartErasure queues a job erasing the personal data of the customer named in
+// the path, answered to be followed with GetJob, whose result is the
+// verification report
+func StartErasure(w http.ResponseWriter, r *http.Request) {
+	startSubjectJob(w, r, ErasureJob)
+}
+
+// startSubjectJob queues a job of jobType for the customer named in the path
+func startSubjectJob(w http.ResponseWriter, r *http.Request, jobType jobs.Type) {
+	ctx := r.Context()
+	pool, err := jobsFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customerID := mux.Vars(r)["customerId"]
+	job, err := pool.Enqueue(ctx, jobType, &subjectParams{CustomerID: customerID})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("queued %s job %s of customer %s", jobType, job.ID, customerID)
+	w.Header().Set("Location", jobLocation(job.ID))
+	writeJSON(w, r, http.StatusAccepted, job)
+}
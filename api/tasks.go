@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/omnom-nom/order/cron"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/schedule"
+)
+
+// names of the background tasks, which cron.tasks of the configuration
+// schedules by
+const (
+	TaskRetention = "retention"
+	TaskArchival  = "archival"
+	TaskSchedules = "schedules"
+	TaskWebhooks  = "webhooks"
+	TaskSLA       = "sla"
+	TaskSagas     = "sagas"
+)
+
+// scheduleResult is the result of a run of the schedules task
+type scheduleResult struct {
+	Placed int `json:"placed"`
+}
+
+// webhookSweepResult is the result of a run of the webhooks task
+type webhookSweepResult struct {
+	Attempted int `json:"attempted"`
+}
+
+// addTasks schedules the retention and archival of orders and the placing of
+// the orders of due schedules on tasks, by the intervals of the configuration
+// unless cron.tasks schedules them. Each runs on one instance at a time.
+func (s *Service) addTasks() error {
+	if interval := s.config.Retention.Interval.Duration; interval > 0 {
+		archive, _ := findArchive(s.repo)
+		job := NewRetentionJob(s.repo, archive, s.config.Retention, s.logger.Module(logging.ModuleRetention)).WithJobs(s.jobs)
+		err := s.tasks.Add(TaskRetention, schedule.Every(interval), true, func(ctx context.Context) (interface{}, error) {
+			return job.Expire(ctx, time.Now()), nil
+		})
+		if err != nil {
+			return err
+		}
+		if job.archiving() {
+			err := s.tasks.Add(TaskArchival, schedule.Every(interval), true, func(ctx context.Context) (interface{}, error) {
+				return job.Archive(ctx, time.Now())
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if s.sagas != nil {
+		err := s.tasks.Add(TaskSagas, schedule.Every(s.config.Sagas.Interval.Duration), true, func(ctx context.Context) (interface{}, error) {
+			return s.sagas.RunOnce(ctx, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if s.sla != nil {
+		err := s.tasks.Add(TaskSLA, schedule.Every(s.config.SLA.Interval.Duration), true, func(ctx context.Context) (interface{}, error) {
+			return s.sla.RunOnce(ctx, time.Now())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if store, ok := findScheduleStore(s.repo); ok && s.config.Schedules.Enabled {
+		scheduler := NewScheduler(s.repo, store, s.config.Schedules.PollInterval.Duration, s.logger.Module(logging.ModuleScheduler))
+		err := s.tasks.Add(TaskSchedules, schedule.Every(s.config.Schedules.PollInterval.Duration), true, func(ctx context.Context) (interface{}, error) {
+			return &scheduleResult{Placed: scheduler.RunOnce(WithLogger(ctx, scheduler.logger))}, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWebhookTask schedules the sweeps of dispatcher sending the due webhook
+// deliveries and retrying the failed ones
+func (s *Service) addWebhookTask(dispatcher *WebhookDispatcher) error {
+	return s.tasks.Add(TaskWebhooks, schedule.Every(s.config.Webhooks.PollInterval.Duration), true, func(ctx context.Context) (interface{}, error) {
+		return &webhookSweepResult{Attempted: dispatcher.DeliverOnce(ctx)}, nil
+	})
+}
+
+type tasksKey struct{}
+
+// WithTasks returns a copy of ctx carrying the background tasks
+func WithTasks(ctx context.Context, tasks *cron.Runner) context.Context {
+	return context.WithValue(ctx, tasksKey{}, tasks)
+}
+
+// TasksFromContext returns the background tasks stored in ctx, or nil
+func TasksFromContext(ctx context.Context) *cron.Runner {
+	tasks, _ := ctx.Value(tasksKey{}).(*cron.Runner)
+	return tasks
+}
+
+// tasksResponse lists the background tasks of an instance
+type tasksResponse struct {
+	Tasks []cron.Status `json:"tasks"`
+}
+
+// ListTasks returns the background tasks of the instance answering with their
+// schedules, next runs and the results of their last runs
+func ListTasks(w http.ResponseWriter, r *http.Request) {
+	tasks := TasksFromContext(r.Context())
+	if tasks == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, &tasksResponse{Tasks: tasks.Statuses()})
+}
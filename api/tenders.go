@@ -0,0 +1,283 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/payments"
+)
+
+// Tender is a part of the total of an order paid off the balance of a gift
+// card or of the store credit of its customer, the card pays what the tenders
+// leave
+type Tender struct {
+	// Type is giftCard or storeCredit
+	Type string `json:"type" dynamodbav:"type"`
+	// Account is the account of the tender at the gift card service
+	Account string      `json:"account" dynamodbav:"account"`
+	Amount  money.Money `json:"amount" dynamodbav:"amount"`
+	// Refunded is the part of Amount credited back to the account
+	Refunded money.Money `json:"refunded" dynamodbav:"refunded"`
+	// TransactionID is the redemption of Amount, set once it is taken off the
+	// balance of the account
+	TransactionID string `json:"transactionId,omitempty" dynamodbav:"transactionId,omitempty"`
+}
+
+// the kinds of ledger entries
+const (
+	// LedgerCharge takes value off a tender
+	LedgerCharge = "charge"
+	// LedgerRefund returns value to a tender
+	LedgerRefund = "refund"
+	// LedgerReversal undoes a charge of an order that was not placed or
+	// whose card payment was declined
+	LedgerReversal = "reversal"
+)
+
+// LedgerEntry is value moved between an order and one of its tenders
+type LedgerEntry struct {
+	Kind string `json:"kind" dynamodbav:"kind"`
+	// Tender is card, account, giftCard or storeCredit
+	Tender string `json:"tender" dynamodbav:"tender"`
+	// Account is the account at the gift card service, empty for the card
+	Account string      `json:"account,omitempty" dynamodbav:"account,omitempty"`
+	Amount  money.Money `json:"amount" dynamodbav:"amount"`
+	// Reference is the transaction at the payment provider or the gift card
+	// service
+	Reference string `json:"reference,omitempty" dynamodbav:"reference,omitempty"`
+	// Key is the idempotency key of the refund the entry is part of
+	Key string    `json:"key,omitempty" dynamodbav:"key,omitempty"`
+	At  time.Time `json:"at" dynamodbav:"at"`
+}
+
+// tenderRequest is a tender of createOrderRequest
+type tenderRequest struct {
+	// Type is giftCard or storeCredit
+	Type string `json:"type"`
+	// Code is the code of the gift card
+	Code string `json:"code,omitempty"`
+	// Amount is the part of the total paid with the tender, as much as its
+	// balance covers when zero
+	Amount money.Money `json:"amount"`
+}
+
+// cardAmount returns the part of the total of o its tenders leave to the card
+func (o *Order) cardAmount() money.Money {
+	amount := o.Total
+	for _, t := range o.Tenders {
+		amount = amount.Sub(t.Amount)
+	}
+	if amount.IsNegative() {
+		// an edit lowered the total below the tenders
+		return money.New(0, o.Currency)
+	}
+	return amount
+}
+
+// tendersRefundable reports whether value taken off the tenders of o is left to
+// refund
+func (o *Order) tendersRefundable() bool {
+	for _, t := range o.Tenders {
+		if t.TransactionID != "" && t.Refunded.Cmp(t.Amount) < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// refundedWith returns the amount the refund with idempotency key returned to
+// the tenders of o and its card so far
+func (o *Order) refundedWith(key string) money.Money {
+	refunded := money.New(0, o.Currency)
+	for _, entry := range o.Ledger {
+		if entry.Kind == LedgerRefund && entry.Key == key {
+			refunded = refunded.Add(entry.Amount)
+		}
+	}
+	return refunded
+}
+
+// addLedgerEntry appends entry to the ledger of o
+func (o *Order) addLedgerEntry(entry LedgerEntry) {
+	entry.At = time.Now().UTC()
+	o.Ledger = append(o.Ledger, entry)
+}
+
+// paymentTender returns the tender of payment, the card or the account of the
+// customer
+func paymentTender(payment *payments.Payment) string {
+	if payment.Provider == payments.ProviderAccount {
+		return payments.TenderAccount
+	}
+	return payments.TenderCard
+}
+
+// recordCardCharge adds the captured payment of o to its ledger, once
+func (o *Order) recordCardCharge() {
+	tender := paymentTender(o.Payment)
+	for _, entry := range o.Ledger {
+		if entry.Kind == LedgerCharge && entry.Tender == tender {
+			return
+		}
+	}
+	o.addLedgerEntry(LedgerEntry{
+		Kind:      LedgerCharge,
+		Tender:    tender,
+		Amount:    o.Payment.Amount,
+		Reference: o.Payment.ID,
+	})
+}
+
+// tenderKey is the idempotency key of the redemption of the i-th tender of the
+// order with id, stable across retries
+func tenderKey(orderID string, i int) string {
+	return fmt.Sprintf("%s-tender-%d", orderID, i)
+}
+
+// planTenders sets the tenders of the new order from reqs. Each pays its
+// amount, or as much of the total the tenders before it leave as its balance
+// covers. The card pays the rest with paymentMethod, which is required unless
+// the tenders pay the whole total.
+func (p *Payments) planTenders(ctx context.Context, order *Order, reqs []tenderRequest, paymentMethod string) error {
+	if len(reqs) > 0 && p.GiftCards == nil {
+		return &ValidationError{Field: "tenders", Reason: "gift cards and store credit are not accepted"}
+	}
+	left := order.Total
+	seen := map[string]bool{}
+	order.Tenders = nil
+	for i, req := range reqs {
+		field := fmt.Sprintf("tenders[%d]", i)
+		var account string
+		switch req.Type {
+		case payments.TenderGiftCard:
+			if req.Code == "" {
+				return &ValidationError{Field: field + ".code", Reason: "is required"}
+			}
+			account = req.Code
+		case payments.TenderStoreCredit:
+			account = payments.StoreCreditAccount(order.CustomerID)
+		default:
+			return &ValidationError{Field: field + ".type", Reason: fmt.Sprintf("must be %s or %s", payments.TenderGiftCard, payments.TenderStoreCredit)}
+		}
+		if seen[account] {
+			return &ValidationError{Field: field, Reason: "repeats a tender before it"}
+		}
+		seen[account] = true
+		amount, err := req.Amount.In(order.Currency)
+		if err != nil || amount.IsNegative() {
+			return &ValidationError{Field: field + ".amount", Reason: "must be a positive amount in the currency of the order"}
+		}
+		if left.IsZero() {
+			return &ValidationError{Field: field, Reason: "the tenders before it pay the whole total"}
+		}
+
+		balance, err := p.GiftCards.Balance(ctx, account)
+		if err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+		if !strings.EqualFold(balance.Currency, order.Currency) {
+			return &ValidationError{Field: field, Reason: fmt.Sprintf("its balance is in %s, not %s", balance.Currency, order.Currency)}
+		}
+		available := balance.Amount
+		switch {
+		case amount.IsZero() && left.Cmp(available) < 0:
+			amount = left
+		case amount.IsZero():
+			amount = available
+		case amount.Cmp(left) > 0:
+			return &ValidationError{Field: field + ".amount", Reason: fmt.Sprintf("is more than the %s left of the total", left)}
+		}
+		if amount.IsZero() || amount.Cmp(available) > 0 {
+			return fmt.Errorf("%s: %w", field, payments.ErrInsufficientBalance)
+		}
+		order.Tenders = append(order.Tenders, Tender{
+			Type:     req.Type,
+			Account:  account,
+			Amount:   amount,
+			Refunded: money.New(0, order.Currency),
+		})
+		left = left.Sub(amount)
+	}
+	if paymentMethod == "" && (len(order.Tenders) == 0 || !left.IsZero()) {
+		return &ValidationError{Field: "paymentMethod", Reason: "is required"}
+	}
+	return nil
+}
+
+// redeemTenders takes the tenders of order off their balances and records them
+// in its ledger. When one fails those redeemed before it are reversed.
+func (p *Payments) redeemTenders(ctx context.Context, order *Order) error {
+	for i := range order.Tenders {
+		t := &order.Tenders[i]
+		id, err := p.GiftCards.Redeem(ctx, t.Account, t.Amount, tenderKey(order.ID, i))
+		if err != nil {
+			// the failed redemption may have taken effect, it is reversed too
+			if reverseErr := p.reverseTenders(ctx, order.ID, order.Tenders[:i+1]); reverseErr != nil {
+				LoggerFromContext(ctx).Errorf("failed to reverse the tenders of order %s: %v", order.ID, reverseErr)
+			}
+			return fmt.Errorf("failed to redeem %s of order %s: %w", t.Type, order.ID, err)
+		}
+		t.TransactionID = id
+		order.addLedgerEntry(LedgerEntry{Kind: LedgerCharge, Tender: t.Type, Account: t.Account, Amount: t.Amount, Reference: id})
+	}
+	return nil
+}
+
+// reverseTenders undoes the redemptions of tenders, the tenders of the order
+// with id, returning the last failure
+func (p *Payments) reverseTenders(ctx context.Context, orderID string, tenders []Tender) error {
+	var failed error
+	for i, t := range tenders {
+		if err := p.GiftCards.Reverse(ctx, t.Account, tenderKey(orderID, i)); err != nil {
+			failed = fmt.Errorf("failed to reverse %s: %v", t.Type, err)
+		}
+	}
+	return failed
+}
+
+// reverseOrderTenders undoes the redemptions of the order whose card payment
+// was declined, recording them in its ledger
+func (p *Payments) reverseOrderTenders(ctx context.Context, order *Order) error {
+	if err := p.reverseTenders(ctx, order.ID, order.Tenders); err != nil {
+		return err
+	}
+	for i := range order.Tenders {
+		t := &order.Tenders[i]
+		if t.TransactionID == "" || t.Refunded.Cmp(t.Amount) >= 0 {
+			continue
+		}
+		order.addLedgerEntry(LedgerEntry{Kind: LedgerReversal, Tender: t.Type, Account: t.Account, Amount: t.Amount.Sub(t.Refunded), Reference: t.TransactionID})
+		t.Refunded = t.Amount
+	}
+	return nil
+}
+
+// refundTenders credits up to amount back to the tenders of order, the last
+// one first, as part of the refund with idempotency key. It returns the part
+// of amount the tenders did not take.
+func (p *Payments) refundTenders(ctx context.Context, order *Order, amount money.Money, key string) (money.Money, error) {
+	for i := len(order.Tenders) - 1; i >= 0 && amount.Cmp(money.New(0, order.Currency)) > 0; i-- {
+		t := &order.Tenders[i]
+		part := t.Amount.Sub(t.Refunded)
+		if t.TransactionID == "" || part.IsZero() || part.IsNegative() {
+			continue
+		}
+		if p.GiftCards == nil {
+			return amount, fmt.Errorf("gift cards are not enabled to refund %s of order %s", t.Type, order.ID)
+		}
+		if part.Cmp(amount) > 0 {
+			part = amount
+		}
+		id, err := p.GiftCards.Credit(ctx, t.Account, part, fmt.Sprintf("%s-%d", key, i))
+		if err != nil {
+			return amount, fmt.Errorf("failed to refund %s of order %s: %w", t.Type, order.ID, err)
+		}
+		t.Refunded = t.Refunded.Add(part)
+		order.addLedgerEntry(LedgerEntry{Kind: LedgerRefund, Tender: t.Type, Account: t.Account, Amount: part, Reference: id, Key: key})
+		amount = amount.Sub(part)
+	}
+	return amount, nil
+}
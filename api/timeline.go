@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/payments"
+)
+
+// TimelineKind is the kind of an entry of the timeline of an order
+type TimelineKind string
+
+// kinds of timeline entries
+const (
+	TimelineStatus   TimelineKind = "status"
+	TimelineEdit     TimelineKind = "edit"
+	TimelinePayment  TimelineKind = "payment"
+	TimelineShipment TimelineKind = "shipment"
+	TimelineNote     TimelineKind = "note"
+	TimelineReturn   TimelineKind = "return"
+	TimelineWebhook  TimelineKind = "webhook"
+)
+
+// timelineDeliveries is the number of the latest deliveries of each webhook
+// subscription searched for the deliveries of an order
+const timelineDeliveries = 100
+
+// TimelineEntry is a thing that happened to an order
+type TimelineEntry struct {
+	At      time.Time    `json:"at"`
+	Kind    TimelineKind `json:"kind"`
+	Summary string       `json:"summary"`
+	// Status is the status the order moved to, for status entries
+	Status    Status `json:"status,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Details is the record the entry was made from
+	Details interface{} `json:"details,omitempty"`
+}
+
+// orderTimeline gathers the timeline of an order from the order and the
+// stores of repo keeping records of it
+type orderTimeline struct {
+	repo    Repository
+	order   *Order
+	entries []*TimelineEntry
+}
+
+// add appends an entry to the timeline
+func (t *orderTimeline) add(at time.Time, kind TimelineKind, summary string, details interface{}) *TimelineEntry {
+	entry := &TimelineEntry{At: at, Kind: kind, Summary: summary, Details: details}
+	t.entries = append(t.entries, entry)
+	return entry
+}
+
+// build gathers the entries, oldest first
+func (t *orderTimeline) build(ctx context.Context) error {
+	streamed, err := t.addStream(ctx)
+	if err != nil {
+		return err
+	}
+	if !streamed {
+		t.addStatuses()
+	}
+	t.addEdits()
+	t.addShipments()
+	t.addNotes()
+	if err := t.addReturns(ctx); err != nil {
+		return err
+	}
+	if err := t.addDeliveries(ctx); err != nil {
+		return err
+	}
+	sort.SliceStable(t.entries, func(i, j int) bool { return t.entries[i].At.Before(t.entries[j].At) })
+	return nil
+}
+
+// streamedFields are the fields of an order whose changes the stream events
+// of the order tell
+type streamedFields struct {
+	Status  *Status           `json:"status"`
+	Payment *payments.Payment `json:"payment"`
+}
+
+// addStream adds the status and payment changes told by the stream of an
+// event sourced order, it reports whether the order has a stream
+func (t *orderTimeline) addStream(ctx context.Context) (bool, error) {
+	store, ok := findEventStore(t.repo)
+	if !ok {
+		return false, nil
+	}
+	events, err := store.ReadEvents(ctx, t.order.ID, nil)
+	if errors.Is(err, ErrNotSupported) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if len(events) == 0 {
+		return false, nil
+	}
+	for _, event := range events {
+		if event.removed() {
+			summary := "order deleted"
+			if event.Type == EventOrderArchived {
+				summary = "order archived"
+			}
+			entry := t.add(event.RecordedAt, TimelineStatus, summary, nil)
+			entry.RequestID = event.RequestID
+			continue
+		}
+		var changed streamedFields
+		if err := json.Unmarshal(event.Patch, &changed); err != nil {
+			return false, fmt.Errorf("failed to read event %s of order %s: %v", event.Key, t.order.ID, err)
+		}
+		if changed.Status != nil {
+			summary := "status changed to " + string(*changed.Status)
+			if event.Type == EventOrderCreated {
+				summary = "order created as " + string(*changed.Status)
+			}
+			entry := t.add(event.RecordedAt, TimelineStatus, summary, nil)
+			entry.Status, entry.RequestID = *changed.Status, event.RequestID
+		}
+		if changed.Payment != nil && changed.Payment.Status != "" {
+			entry := t.add(event.RecordedAt, TimelinePayment, "payment "+string(changed.Payment.Status), nil)
+			entry.RequestID = event.RequestID
+		}
+	}
+	return true, nil
+}
+
+// addStatuses adds the status changes the order records itself when it has
+// no stream: its creation, cancellation, deletion and the current state of
+// its payment
+func (t *orderTimeline) addStatuses() {
+	o := t.order
+	t.add(o.CreatedAt, TimelineStatus, "order created", nil)
+	if o.Cancellation != nil {
+		entry := t.add(o.Cancellation.CancelledAt, TimelineStatus, "order cancelled: "+string(o.Cancellation.Reason), nil)
+		entry.Status = StatusCancelled
+	}
+	if o.DeletedAt != nil {
+		t.add(*o.DeletedAt, TimelineStatus, "order deleted", nil)
+	}
+	if o.Payment != nil {
+		summary := fmt.Sprintf("payment %s: %s", o.Payment.Status, o.Payment.Amount)
+		t.add(o.Payment.UpdatedAt, TimelinePayment, summary, nil)
+	}
+}
+
+func (t *orderTimeline) addEdits() {
+	for i := range t.order.Edits {
+		edit := &t.order.Edits[i]
+		summary := fmt.Sprintf("order edited, total %s to %s", edit.TotalBefore, edit.TotalAfter)
+		entry := t.add(edit.EditedAt, TimelineEdit, summary, edit)
+		entry.RequestID = edit.RequestID
+	}
+}
+
+func (t *orderTimeline) addShipments() {
+	for i := range t.order.Shipments {
+		shipment := &t.order.Shipments[i]
+		t.add(shipment.CreatedAt, TimelineShipment, fmt.Sprintf("shipment %s handed to %s", shipment.ID, shipment.Carrier), nil)
+		for j := range shipment.Events {
+			event := &shipment.Events[j]
+			t.add(event.OccurredAt, TimelineShipment, fmt.Sprintf("shipment %s %s", shipment.ID, event.Status), event)
+		}
+	}
+}
+
+// addNotes adds the notes left on the order by the people cancelling it and
+// reviewing it, its duplicate and fraud screenings, escalation and erasure
+func (t *orderTimeline) addNotes() {
+	o := t.order
+	if o.Cancellation != nil && o.Cancellation.Note != "" {
+		t.add(o.Cancellation.CancelledAt, TimelineNote, o.Cancellation.Note, nil)
+	}
+	if o.DuplicateOf != "" {
+		t.add(o.CreatedAt, TimelineNote, "suspected duplicate of order "+o.DuplicateOf, nil)
+	}
+	if o.Fraud != nil {
+		if o.Fraud.ScreenedAt != nil {
+			t.add(*o.Fraud.ScreenedAt, TimelineNote, "fraud screening: "+string(o.Fraud.Verdict), o.Fraud.Reasons)
+		}
+		if o.Fraud.ReviewedAt != nil {
+			t.add(*o.Fraud.ReviewedAt, TimelineNote, "fraud review: "+o.Fraud.Note, nil)
+		}
+	}
+	if o.Escalation != nil {
+		t.add(o.Escalation.EscalatedAt, TimelineNote, fmt.Sprintf("overdue in status %s since %s", o.Escalation.Status, o.Escalation.Deadline.Format(time.RFC3339)), nil)
+	}
+	if o.ErasedAt != nil {
+		t.add(*o.ErasedAt, TimelineNote, "personal data erased", nil)
+	}
+}
+
+func (t *orderTimeline) addReturns(ctx context.Context) error {
+	store, ok := findReturnStore(t.repo)
+	if !ok {
+		return nil
+	}
+	returns, err := store.ListReturns(ctx, t.order.ID)
+	if errors.Is(err, ErrNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, ret := range returns {
+		t.add(ret.CreatedAt, TimelineReturn, fmt.Sprintf("return %s requested", ret.ID), nil)
+		if ret.UpdatedAt.After(ret.CreatedAt) {
+			t.add(ret.UpdatedAt, TimelineReturn, fmt.Sprintf("return %s %s", ret.ID, ret.Status), nil)
+		}
+		for _, refund := range ret.Refunds {
+			t.add(refund.CreatedAt, TimelinePayment, fmt.Sprintf("refund %s of %s for return %s", refund.ID, refund.Amount, ret.ID), nil)
+		}
+	}
+	return nil
+}
+
+// addDeliveries adds the webhook deliveries of the events of the order among
+// the latest deliveries of every subscription of the tenant of the order
+func (t *orderTimeline) addDeliveries(ctx context.Context) error {
+	store, ok := findWebhookStore(t.repo)
+	if !ok {
+		return nil
+	}
+	subs, err := store.ListSubscriptions(ctx)
+	if errors.Is(err, ErrNotSupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if sub.TenantID != t.order.TenantID {
+			continue
+		}
+		deliveries, err := store.ListDeliveries(ctx, sub.ID, "", timelineDeliveries)
+		if err != nil {
+			return err
+		}
+		for _, delivery := range deliveries {
+			if delivery.Event == nil || delivery.Event.OrderID != t.order.ID {
+				continue
+			}
+			summary := fmt.Sprintf("%s %s to subscription %s", delivery.Event.Type, delivery.Status, sub.ID)
+			t.add(delivery.UpdatedAt, TimelineWebhook, summary, &timelineDelivery{
+				ID:           delivery.ID,
+				Status:       delivery.Status,
+				Attempts:     delivery.Attempts,
+				ResponseCode: delivery.ResponseCode,
+				LastError:    delivery.LastError,
+			})
+		}
+	}
+	return nil
+}
+
+// timelineDelivery is a webhook delivery without the event it delivered
+type timelineDelivery struct {
+	ID           string         `json:"id"`
+	Status       DeliveryStatus `json:"status"`
+	Attempts     int            `json:"attempts"`
+	ResponseCode int            `json:"responseCode,omitempty"`
+	LastError    string         `json:"lastError,omitempty"`
+}
+
+// orderTimelineResponse is the timeline of an order, oldest first
+type orderTimelineResponse struct {
+	OrderID string           `json:"orderId"`
+	Entries []*TimelineEntry `json:"entries"`
+}
+
+// GetOrderHistory returns the timeline of the order named in the path: its
+// status changes, edits, payments, shipments, notes, returns and webhook
+// deliveries, oldest first
+func GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	repo := RepositoryFromContext(ctx)
+	order, err := repo.GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	timeline := &orderTimeline{repo: repo, order: order}
+	if err := timeline.build(ctx); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	entries := timeline.entries
+	if entries == nil {
+		entries = []*TimelineEntry{}
+	}
+	writeJSON(w, r, http.StatusOK, &orderTimelineResponse{OrderID: order.ID, Entries: entries})
+}
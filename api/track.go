@@ -0,0 +1,194 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/tracking"
+)
+
+// ErrInvalidTrackingToken is returned for tracking tokens that are malformed,
+// forged or expired, or whose order is gone
+var ErrInvalidTrackingToken = errors.New("unknown tracking token")
+
+// trackingSignatureSize is the length of the truncated signature of the tokens
+const trackingSignatureSize = 16
+
+// Tracker issues the tracking tokens of orders and serves the public tracking
+// of their orders. A token carries the id of its order and its expiry, signed
+// with the secret of the configuration, so it can not be guessed from the id
+// and no token is stored.
+type Tracker struct {
+	secret  []byte
+	ttl     time.Duration
+	limiter *RateLimiter
+}
+
+// NewTracker returns the tracker of cfg
+func NewTracker(cfg *config.TrackingConfig) *Tracker {
+	return &Tracker{secret: []byte(cfg.Secret), ttl: cfg.TTL.Duration, limiter: NewRateLimiter(cfg.RateLimit)}
+}
+
+type trackerKey struct{}
+
+// WithTracker returns a copy of ctx carrying tracker
+func WithTracker(ctx context.Context, tracker *Tracker) context.Context {
+	return context.WithValue(ctx, trackerKey{}, tracker)
+}
+
+// TrackerFromContext returns the tracker stored in ctx, or nil when orders are
+// not tracked publicly
+func TrackerFromContext(ctx context.Context) *Tracker {
+	tracker, _ := ctx.Value(trackerKey{}).(*Tracker)
+	return tracker
+}
+
+// sign returns the signature of payload
+func (t *Tracker) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)[:trackingSignatureSize]
+}
+
+// Token returns the tracking token of the order with id issued at now and the
+// time it expires
+func (t *Tracker) Token(id string, now time.Time) (string, time.Time) {
+	expiresAt := now.Add(t.ttl).UTC().Truncate(time.Second)
+	payload := strconv.FormatInt(expiresAt.Unix(), 10) + "." + id
+	token := base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(t.sign(payload))
+	return token, expiresAt
+}
+
+// orderID returns the id of the order of token, or ErrInvalidTrackingToken
+// when it is not signed by t or expired at now
+func (t *Tracker) orderID(token string, now time.Time) (string, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", ErrInvalidTrackingToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrInvalidTrackingToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, t.sign(string(payload))) {
+		return "", ErrInvalidTrackingToken
+	}
+	expiry, id, ok := strings.Cut(string(payload), ".")
+	if !ok || id == "" {
+		return "", ErrInvalidTrackingToken
+	}
+	seconds, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || !now.Before(time.Unix(seconds, 0)) {
+		return "", ErrInvalidTrackingToken
+	}
+	return id, nil
+}
+
+// trackingTokenResponse is the tracking token of an order
+type trackingTokenResponse struct {
+	OrderID   string    `json:"orderId"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// trackedShipment is the part of a shipment shown to anyone with the token of
+// its order, without its tracking number or the locations of its events
+type trackedShipment struct {
+	Carrier   string          `json:"carrier"`
+	Status    tracking.Status `json:"status"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// trackingResponse is the public tracking of an order. It holds no personal
+// data: neither the customer nor the addresses, items or amounts of the order.
+type trackingResponse struct {
+	Status Status `json:"status"`
+	// StatusText is the name of the status in the locale of the request
+	StatusText string            `json:"statusText,omitempty"`
+	PlacedAt   time.Time         `json:"placedAt"`
+	UpdatedAt  time.Time         `json:"updatedAt"`
+	Shipments  []trackedShipment `json:"shipments"`
+}
+
+// newTrackingResponse returns the public tracking of order
+func newTrackingResponse(ctx context.Context, order *Order) *trackingResponse {
+	resp := &trackingResponse{
+		Status:     order.Status,
+		StatusText: statusText(ctx, order.Status),
+		PlacedAt:   order.CreatedAt,
+		UpdatedAt:  order.UpdatedAt,
+		Shipments:  []trackedShipment{},
+	}
+	for _, shipment := range order.Shipments {
+		resp.Shipments = append(resp.Shipments, trackedShipment{Carrier: shipment.Carrier, Status: shipment.Status, UpdatedAt: shipment.UpdatedAt})
+	}
+	return resp
+}
+
+// GetTrackingToken issues a tracking token of the order named in the path,
+// for the customer to look the order up with TrackOrder
+func GetTrackingToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tracker := TrackerFromContext(ctx)
+	if tracker == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	order, err := RepositoryFromContext(ctx).GetOrder(ctx, mux.Vars(r)["orderId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	token, expiresAt := tracker.Token(order.ID, time.Now())
+	writeJSON(w, r, http.StatusOK, &trackingTokenResponse{OrderID: order.ID, Token: token, ExpiresAt: expiresAt})
+}
+
+// TrackOrder returns the public tracking of the order of the token in the
+// path. It is served without authentication, so the lookups of every client
+// are rate limited, and an unknown token answers the same whether it is
+// forged, expired or its order is gone.
+func TrackOrder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tracker := TrackerFromContext(ctx)
+	if tracker == nil {
+		writeError(w, r, ErrNotSupported)
+		return
+	}
+	if !tracker.limiter.Allow(clientIP(r)) {
+		trackingLookups.WithLabelValues("limited").Inc()
+		w.Header().Set("Retry-After", "5")
+		writeErrorCode(w, r, CodeRateLimited, "rate limit exceeded")
+		return
+	}
+	id, err := tracker.orderID(mux.Vars(r)["trackingToken"], time.Now())
+	if err != nil {
+		trackingLookups.WithLabelValues("invalid").Inc()
+		writeError(w, r, err)
+		return
+	}
+	order, err := RepositoryFromContext(ctx).GetOrder(ctx, id)
+	if errors.Is(err, ErrOrderNotFound) {
+		trackingLookups.WithLabelValues("invalid").Inc()
+		writeError(w, r, ErrInvalidTrackingToken)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	trackingLookups.WithLabelValues("found").Inc()
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	writeJSON(w, r, http.StatusOK, newTrackingResponse(ctx, order))
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackerToken(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tracker := &Tracker{secret: []byte("tracking-secret"), ttl: 24 * time.Hour}
+	token, expiresAt := tracker.Token("o-1", now)
+	if want := now.Add(24 * time.Hour); !expiresAt.Equal(want) {
+		t.Fatalf("expires at %v, want %v", expiresAt, want)
+	}
+	encoded, signature, _ := strings.Cut(token, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+
+	tests := []struct {
+		name    string
+		tracker *Tracker
+		token   string
+		at      time.Time
+		want    string
+	}{
+		{name: "valid", token: token, at: now, want: "o-1"},
+		{name: "valid until it expires", token: token, at: expiresAt.Add(-time.Second), want: "o-1"},
+		{name: "expired", token: token, at: expiresAt},
+		{name: "signed with another secret", tracker: &Tracker{secret: []byte("other-secret"), ttl: time.Hour}, token: token, at: now},
+		{name: "another order", token: base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "o-1", "o-2", 1))) + "." + signature, at: now},
+		{name: "extended expiry", token: base64.RawURLEncoding.EncodeToString([]byte("9999999999.o-1")) + "." + signature, at: now},
+		{name: "truncated signature", token: token[:len(token)-2], at: now},
+		{name: "no signature", token: encoded, at: now},
+		{name: "invalid encoding", token: "!!." + signature, at: now},
+		{name: "empty", token: "", at: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := tracker
+			if tt.tracker != nil {
+				verifier = tt.tracker
+			}
+			id, err := verifier.orderID(tt.token, tt.at)
+			if tt.want == "" {
+				if !errors.Is(err, ErrInvalidTrackingToken) {
+					t.Fatalf("orderID() = %q, %v, want %v", id, err, ErrInvalidTrackingToken)
+				}
+				return
+			}
+			if err != nil || id != tt.want {
+				t.Fatalf("orderID() = %q, %v, want %q", id, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackerTokenUnguessable(t *testing.T) {
+	now := time.Now()
+	a, _ := (&Tracker{secret: []byte("secret-a"), ttl: time.Hour}).Token("o-1", now)
+	b, _ := (&Tracker{secret: []byte("secret-b"), ttl: time.Hour}).Token("o-1", now)
+	if a == b {
+		t.Fatal("the tokens of an order signed with different secrets are equal")
+	}
+}
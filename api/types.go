@@ -1,13 +1,15 @@
 package api
 
 import (
-	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+
+	"github.com/omnom-nom/order/retry"
 )
 
+// ApiDb is the DynamoDB client of the service, every call takes the request context
 type ApiDb struct {
-	*dynamodb.DynamoDB
-}
-
-type EnvSingleton struct {
-	db	*ApiDb
+	*dynamodb.Client
+	// Retry is the policy of the retries the client does not do itself, like
+	// those of cancelled transactions and unprocessed batch items
+	Retry retry.Policy
 }
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrWarehouseNotFound is returned when no warehouse has the requested id
+var ErrWarehouseNotFound = errors.New("warehouse not found")
+
+// Warehouse is a warehouse the items of orders ship from. Its stock is the
+// one it reports, which the routing of orders reads; the reservations of the
+// stock are left to the inventory service.
+type Warehouse struct {
+	ID      string  `json:"id" dynamodbav:"warehouseId"`
+	Name    string  `json:"name" dynamodbav:"name"`
+	Address Address `json:"address" dynamodbav:"address"`
+	// Stock is the quantity the warehouse holds by SKU
+	Stock map[string]int `json:"stock" dynamodbav:"stock"`
+	// ShipmentCost is the cost of a parcel leaving the warehouse and UnitCost
+	// that of picking one unit, which the cost strategy compares
+	ShipmentCost float64   `json:"shipmentCost,omitempty" dynamodbav:"shipmentCost,omitempty"`
+	UnitCost     float64   `json:"unitCost,omitempty" dynamodbav:"unitCost,omitempty"`
+	CreatedAt    time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// WarehouseStore is implemented by repositories keeping warehouses, which they
+// do once EnableWarehouses is called.
+type WarehouseStore interface {
+	// CreateWarehouse stores a new warehouse
+	CreateWarehouse(ctx context.Context, warehouse *Warehouse) error
+	// GetWarehouse returns the warehouse with id, or ErrWarehouseNotFound
+	GetWarehouse(ctx context.Context, id string) (*Warehouse, error)
+	// UpdateWarehouse replaces a warehouse if its stored version equals
+	// warehouse.Version, incrementing warehouse.Version. It fails with
+	// ErrWarehouseNotFound or ErrVersionConflict.
+	UpdateWarehouse(ctx context.Context, warehouse *Warehouse) error
+	// DeleteWarehouse removes the warehouse with id, or fails with ErrWarehouseNotFound
+	DeleteWarehouse(ctx context.Context, id string) error
+	// ListWarehouses returns all stored warehouses
+	ListWarehouses(ctx context.Context) ([]*Warehouse, error)
+}
+
+// warehousesEnabler is implemented by repositories able to keep warehouses
+type warehousesEnabler interface {
+	enableWarehouses(table string)
+}
+
+// EnableWarehouses makes repo keep warehouses, in table for the backends that
+// keep them in a separate table
+func EnableWarehouses(repo Repository, table string) error {
+	enabler, ok := repo.(warehousesEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support warehouses", repo)
+	}
+	enabler.enableWarehouses(table)
+	return nil
+}
+
+// findWarehouseStore returns the warehouse store of repo or of the repository it decorates
+func findWarehouseStore(repo Repository) (WarehouseStore, bool) {
+	var store WarehouseStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(WarehouseStore)
+		return ok
+	})
+	return store, found
+}
+
+// warehouseStoreFromContext returns the warehouse store of the request repository or ErrNotSupported
+func warehouseStoreFromContext(ctx context.Context) (WarehouseStore, error) {
+	store, ok := findWarehouseStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// warehouseRequest is the body of CreateWarehouse and UpdateWarehouse
+type warehouseRequest struct {
+	Name         string         `json:"name"`
+	Address      Address        `json:"address"`
+	Stock        map[string]int `json:"stock,omitempty"`
+	ShipmentCost float64        `json:"shipmentCost,omitempty"`
+	UnitCost     float64        `json:"unitCost,omitempty"`
+}
+
+// validate checks the fields of req
+func (req *warehouseRequest) validate() error {
+	if req.Name == "" {
+		return &ValidationError{Field: "name", Reason: "is required"}
+	}
+	if err := validateAddress("address", &req.Address); err != nil {
+		return err
+	}
+	if req.ShipmentCost < 0 {
+		return &ValidationError{Field: "shipmentCost", Reason: "must not be negative"}
+	}
+	if req.UnitCost < 0 {
+		return &ValidationError{Field: "unitCost", Reason: "must not be negative"}
+	}
+	return validateStock(req.Stock)
+}
+
+// validateStock checks the stock levels of a warehouse
+func validateStock(stock map[string]int) error {
+	for sku, quantity := range stock {
+		if sku == "" {
+			return &ValidationError{Field: "stock", Reason: "skus must not be empty"}
+		}
+		if quantity < 0 {
+			return &ValidationError{Field: fmt.Sprintf("stock.%s", sku), Reason: "must not be negative"}
+		}
+	}
+	return nil
+}
+
+// apply sets the fields of req on warehouse, the stock only when req has one
+func (req *warehouseRequest) apply(warehouse *Warehouse) {
+	warehouse.Name = req.Name
+	warehouse.Address = req.Address
+	warehouse.ShipmentCost = req.ShipmentCost
+	warehouse.UnitCost = req.UnitCost
+	if req.Stock != nil {
+		warehouse.Stock = req.Stock
+	}
+}
+
+// readWarehouseRequest decodes and validates the body of r
+func readWarehouseRequest(r *http.Request) (*warehouseRequest, error) {
+	var req warehouseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, &ValidationError{Field: "body", Reason: err.Error()}
+	}
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// stockRequest is the body of UpdateWarehouseStock
+type stockRequest struct {
+	Stock map[string]int `json:"stock"`
+}
+
+// warehousesResponse lists the warehouses
+type warehousesResponse struct {
+	Warehouses []*Warehouse `json:"warehouses"`
+}
+
+// CreateWarehouse stores the warehouse described by the body with a new id
+func CreateWarehouse(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := warehouseStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	req, err := readWarehouseRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	warehouse := &Warehouse{ID: newID(), Stock: map[string]int{}, CreatedAt: now, UpdatedAt: now, Version: 1}
+	req.apply(warehouse)
+	if err := store.CreateWarehouse(ctx, warehouse); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("created warehouse %s", warehouse.ID)
+	writeJSON(w, r, http.StatusCreated, warehouse)
+}
+
+// ListWarehouses returns the warehouses ordered by id
+func ListWarehouses(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := warehouseStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	warehouses, err := store.ListWarehouses(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if warehouses == nil {
+		warehouses = []*Warehouse{}
+	}
+	sort.Slice(warehouses, func(i, j int) bool { return warehouses[i].ID < warehouses[j].ID })
+	writeJSON(w, r, http.StatusOK, &warehousesResponse{Warehouses: warehouses})
+}
+
+// GetWarehouse returns the warehouse named in the path
+func GetWarehouse(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := warehouseStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	warehouse, err := store.GetWarehouse(ctx, mux.Vars(r)["warehouseId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, warehouse)
+}
+
+// UpdateWarehouse replaces the warehouse named in the path with the body,
+// keeping its stock unless the body has one
+func UpdateWarehouse(w http.ResponseWriter, r *http.Request) {
+	req, err := readWarehouseRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	updateWarehouse(w, r, func(warehouse *Warehouse) {
+		req.apply(warehouse)
+	})
+}
+
+// UpdateWarehouseStock sets the stock levels of the body on the warehouse
+// named in the path, the SKUs it does not name keep theirs and those set to
+// 0 are dropped
+func UpdateWarehouseStock(w http.ResponseWriter, r *http.Request) {
+	var req stockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	if err := validateStock(req.Stock); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	updateWarehouse(w, r, func(warehouse *Warehouse) {
+		if warehouse.Stock == nil {
+			warehouse.Stock = map[string]int{}
+		}
+		for sku, quantity := range req.Stock {
+			if quantity == 0 {
+				delete(warehouse.Stock, sku)
+			} else {
+				warehouse.Stock[sku] = quantity
+			}
+		}
+	})
+}
+
+// updateWarehouse applies change to the warehouse named in the path and writes it
+func updateWarehouse(w http.ResponseWriter, r *http.Request, change func(*Warehouse)) {
+	ctx := r.Context()
+	store, err := warehouseStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	warehouse, err := store.GetWarehouse(ctx, mux.Vars(r)["warehouseId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	change(warehouse)
+	warehouse.UpdatedAt = time.Now().UTC()
+	if err := store.UpdateWarehouse(ctx, warehouse); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, warehouse)
+}
+
+// DeleteWarehouse removes the warehouse named in the path. The orders routed
+// to it keep their allocations until they are routed again.
+func DeleteWarehouse(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	store, err := warehouseStoreFromContext(ctx)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["warehouseId"]
+	if err := store.DeleteWarehouse(ctx, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	LoggerFromContext(ctx).Infof("deleted warehouse %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,361 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/events"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+var (
+	// ErrSubscriptionNotFound is returned when no webhook subscription has the requested id
+	ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+	// ErrNotSupported is returned when the storage backend lacks a feature
+	ErrNotSupported = errors.New("not supported by the storage backend")
+)
+
+// DeliveryStatus is the state of a webhook delivery
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	// DeliveryDead marks a delivery that failed MaxAttempts times and is no longer retried
+	DeliveryDead DeliveryStatus = "dead"
+)
+
+// WebhookSubscription receives the order events of EventTypes, or all when
+// empty, of the orders of its tenant
+type WebhookSubscription struct {
+	ID         string    `json:"id" dynamodbav:"subscriptionId"`
+	URL        string    `json:"url" dynamodbav:"url"`
+	Secret     string    `json:"secret,omitempty" dynamodbav:"secret"`
+	EventTypes []string  `json:"eventTypes,omitempty" dynamodbav:"eventTypes,omitempty"`
+	CreatedAt  time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	// TenantID is the tenant that created the subscription, the only one
+	// that sees it and whose events it receives
+	TenantID string `json:"tenantId,omitempty" dynamodbav:"tenantId,omitempty"`
+}
+
+// Matches reports whether event is delivered to s: it is of the tenant of s
+// and of one of its event types
+func (s *WebhookSubscription) Matches(event *OutboxEvent) bool {
+	if event.TenantID != s.TenantID {
+		return false
+	}
+	if len(s.EventTypes) == 0 {
+		return true
+	}
+	for _, t := range s.EventTypes {
+		if events.Type(t) == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is the delivery of one event to one subscription and its log
+type WebhookDelivery struct {
+	ID             string         `json:"id" dynamodbav:"deliveryId"`
+	SubscriptionID string         `json:"subscriptionId" dynamodbav:"subscriptionId"`
+	Event          *OutboxEvent   `json:"event" dynamodbav:"event"`
+	Status         DeliveryStatus `json:"status" dynamodbav:"status"`
+	Attempts       int            `json:"attempts" dynamodbav:"attempts"`
+	// ResponseCode is the http status of the last attempt, 0 if it got no response
+	ResponseCode  int       `json:"responseCode,omitempty" dynamodbav:"responseCode,omitempty"`
+	LastError     string    `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt" dynamodbav:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	// ExpiresAt is the unix time after which DynamoDB may delete the delivery
+	// once it is delivered or dead, 0 keeps it
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt,omitempty"`
+}
+
+// WebhookStore is implemented by repositories that keep webhook subscriptions and deliveries.
+// Its methods fail with ErrNotSupported until EnableWebhooks is called.
+type WebhookStore interface {
+	CreateSubscription(ctx context.Context, sub *WebhookSubscription) error
+	// GetSubscription returns the subscription with id, or ErrSubscriptionNotFound
+	GetSubscription(ctx context.Context, id string) (*WebhookSubscription, error)
+	ListSubscriptions(ctx context.Context) ([]*WebhookSubscription, error)
+	// DeleteSubscription removes the subscription with id and its delivery log,
+	// or fails with ErrSubscriptionNotFound
+	DeleteSubscription(ctx context.Context, id string) error
+	// SaveDelivery creates or replaces a delivery
+	SaveDelivery(ctx context.Context, delivery *WebhookDelivery) error
+	// ListDeliveries returns up to limit deliveries of a subscription, newest first,
+	// only those with status unless it is empty
+	ListDeliveries(ctx context.Context, subscriptionID string, status DeliveryStatus, limit int) ([]*WebhookDelivery, error)
+	// DueDeliveries returns up to limit pending deliveries whose next attempt is not after now
+	DueDeliveries(ctx context.Context, now time.Time, limit int) ([]*WebhookDelivery, error)
+}
+
+// webhooksEnabler is implemented by repositories able to keep webhooks
+type webhooksEnabler interface {
+	enableWebhooks(table string)
+}
+
+// EnableWebhooks makes repo keep webhook subscriptions and deliveries, in table
+// for the backends that keep them in a separate table
+func EnableWebhooks(repo Repository, table string) error {
+	enabler, ok := repo.(webhooksEnabler)
+	if !ok {
+		return fmt.Errorf("repository %T does not support webhooks", repo)
+	}
+	enabler.enableWebhooks(table)
+	return nil
+}
+
+// findWebhookStore returns the webhook store of repo or of the repository it decorates
+func findWebhookStore(repo Repository) (WebhookStore, bool) {
+	var store WebhookStore
+	found := eachLayer(repo, func(r Repository) bool {
+		var ok bool
+		store, ok = r.(WebhookStore)
+		return ok
+	})
+	return store, found
+}
+
+// webhookStoreFromContext returns the webhook store of the request repository or ErrNotSupported
+func webhookStoreFromContext(ctx context.Context) (WebhookStore, error) {
+	store, ok := findWebhookStore(RepositoryFromContext(ctx))
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return store, nil
+}
+
+// tenantSubscription returns the subscription with id of the tenant of ctx,
+// ErrSubscriptionNotFound when it is of another tenant
+func tenantSubscription(ctx context.Context, store WebhookStore, id string) (*WebhookSubscription, error) {
+	sub, err := store.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if sub.TenantID != TenantFromContext(ctx) {
+		return nil, ErrSubscriptionNotFound
+	}
+	return sub, nil
+}
+
+// createSubscriptionRequest is the body of CreateWebhook
+type createSubscriptionRequest struct {
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"`
+	EventTypes []string `json:"eventTypes"`
+}
+
+// minSecretLength is the shortest signing secret accepted from a client
+const minSecretLength = 16
+
+// newSubscription returns the validated subscription described by req for
+// the tenant of ctx, with a generated secret if none was given
+func (req *createSubscriptionRequest) newSubscription(ctx context.Context) (*WebhookSubscription, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, &ValidationError{Field: "url", Reason: "must be an absolute http or https url"}
+	}
+	if !ConfigFromContext(ctx).Webhooks.AllowPrivateNetworks {
+		if err := checkPublicHost(ctx, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+	for i, t := range req.EventTypes {
+		if !events.Type(t).Known() {
+			return nil, &ValidationError{Field: fmt.Sprintf("eventTypes[%d]", i), Reason: fmt.Sprintf("unknown event type %q", t)}
+		}
+	}
+	secret := req.Secret
+	if secret == "" {
+		secret = newID()
+	} else if len(secret) < minSecretLength {
+		return nil, &ValidationError{Field: "secret", Reason: fmt.Sprintf("must have at least %d characters", minSecretLength)}
+	}
+
+	return &WebhookSubscription{
+		ID:         newID(),
+		URL:        u.String(),
+		Secret:     secret,
+		EventTypes: req.EventTypes,
+		CreatedAt:  time.Now().UTC(),
+		TenantID:   TenantFromContext(ctx),
+	}, nil
+}
+
+// checkPublicHost returns a validation error unless every address host
+// resolves to is public. The deliveries connect to public addresses only, so
+// a host resolving to another address later is refused then.
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return &ValidationError{Field: "url", Reason: fmt.Sprintf("host %q does not resolve", host)}
+	}
+	for _, addr := range addrs {
+		if !httpclient.IsPublicAddress(addr) {
+			return &ValidationError{Field: "url", Reason: fmt.Sprintf("host %q is not a public address", host)}
+		}
+	}
+	return nil
+}
+
+// withoutSecret returns a copy of sub that is safe to return after creation
+func withoutSecret(sub *WebhookSubscription) *WebhookSubscription {
+	c := *sub
+	c.Secret = ""
+	return &c
+}
+
+// CreateWebhook registers a webhook subscription. The response is the only one
+// including the signing secret.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	store, err := webhookStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var req createSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, &ValidationError{Field: "body", Reason: err.Error()})
+		return
+	}
+	sub, err := req.newSubscription(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := store.CreateSubscription(r.Context(), sub); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	LoggerFromContext(r.Context()).Infof("created webhook subscription %s for %s", sub.ID, sub.URL)
+	writeJSON(w, r, http.StatusCreated, sub)
+}
+
+// listSubscriptionsResponse is the body of ListWebhooks
+type listSubscriptionsResponse struct {
+	Subscriptions []*WebhookSubscription `json:"subscriptions"`
+}
+
+// ListWebhooks returns the webhook subscriptions of the tenant of the request
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	store, err := webhookStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	subs, err := store.ListSubscriptions(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	tenant := TenantFromContext(r.Context())
+	resp := &listSubscriptionsResponse{Subscriptions: make([]*WebhookSubscription, 0, len(subs))}
+	for _, sub := range subs {
+		if sub.TenantID == tenant {
+			resp.Subscriptions = append(resp.Subscriptions, withoutSecret(sub))
+		}
+	}
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// GetWebhook returns the webhook subscription named in the path
+func GetWebhook(w http.ResponseWriter, r *http.Request) {
+	store, err := webhookStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	sub, err := tenantSubscription(r.Context(), store, mux.Vars(r)["subscriptionId"])
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, withoutSecret(sub))
+}
+
+// DeleteWebhook removes the webhook subscription named in the path
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	store, err := webhookStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	id := mux.Vars(r)["subscriptionId"]
+	if _, err := tenantSubscription(r.Context(), store, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := store.DeleteSubscription(r.Context(), id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	LoggerFromContext(r.Context()).Infof("deleted webhook subscription %s", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listDeliveriesResponse is the body of ListWebhookDeliveries
+type listDeliveriesResponse struct {
+	Deliveries []*WebhookDelivery `json:"deliveries"`
+}
+
+// ListWebhookDeliveries returns the delivery log of the subscription named in the path,
+// filtered by the status query parameter, e.g. status=dead for the dead letters
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	store, err := webhookStoreFromContext(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	query := r.URL.Query()
+	status := DeliveryStatus(query.Get("status"))
+	switch status {
+	case "", DeliveryPending, DeliveryDelivered, DeliveryDead:
+	default:
+		writeError(w, r, &ValidationError{Field: "status", Reason: "must be pending, delivered or dead"})
+		return
+	}
+	limit := DefaultPageSize
+	if l := query.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > MaxPageSize {
+			writeError(w, r, &ValidationError{Field: "limit", Reason: fmt.Sprintf("must be between 1 and %d", MaxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	id := mux.Vars(r)["subscriptionId"]
+	if _, err := tenantSubscription(r.Context(), store, id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	deliveries, err := store.ListDeliveries(r.Context(), id, status, limit)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if deliveries == nil {
+		deliveries = []*WebhookDelivery{}
+	}
+	writeJSON(w, r, http.StatusOK, &listDeliveriesResponse{Deliveries: deliveries})
+}
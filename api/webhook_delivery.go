@@ -0,0 +1,285 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/retry"
+)
+
+// headers of a webhook delivery request
+const (
+	WebhookEventHeader     = "X-Order-Event"
+	WebhookDeliveryHeader  = "X-Order-Delivery"
+	WebhookTimestampHeader = "X-Order-Timestamp"
+	// WebhookSignatureHeader is "sha256=" followed by WebhookSignature of the request
+	WebhookSignatureHeader = "X-Order-Signature"
+)
+
+// WebhookSignature returns the hex HMAC-SHA256 of "<timestamp>.<body>" with secret.
+// Receivers recompute it to authenticate a delivery and reject old timestamps to prevent replays.
+func WebhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher is the EventPublisher of webhooks. Publishing records a pending
+// delivery per matching subscription; Run sends due deliveries and retries failed
+// ones with exponential backoff until they are delivered or dead-lettered.
+type WebhookDispatcher struct {
+	store  WebhookStore
+	client *http.Client
+	cfg    config.WebhookConfig
+	// retry sends the request of an attempt again after transient failures
+	retry retry.Policy
+	// schedule is the backoff between the attempts of a delivery
+	schedule retry.Policy
+	// retention is the time a delivered or dead delivery is kept, 0 keeps it
+	retention time.Duration
+	// deadLetters keeps the dead deliveries for replay, nil when disabled
+	deadLetters *DeadLetterQueue
+	logger      logging.Logger
+}
+
+// NewWebhookDispatcher returns a dispatcher of the deliveries in store with the
+// settings of cfg, sending them with a client of clients and logging with logger
+func NewWebhookDispatcher(store WebhookStore, cfg config.WebhookConfig, clients *httpclient.Factory, logger logging.Logger) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:  store,
+		client: webhookClient(clients, cfg),
+		cfg:    cfg,
+		retry:  retry.New(cfg.Retry, nil),
+		schedule: retry.Policy{
+			MaxAttempts:    cfg.MaxAttempts,
+			InitialBackoff: cfg.InitialBackoff.Duration,
+			MaxBackoff:     cfg.MaxBackoff.Duration,
+		},
+		logger: logger,
+	}
+}
+
+// webhookClient returns the client of the deliveries, connecting to public
+// addresses only unless cfg allows private networks
+func webhookClient(clients *httpclient.Factory, cfg config.WebhookConfig) *http.Client {
+	if cfg.AllowPrivateNetworks {
+		return clients.Client("webhooks", cfg.Timeout.Duration)
+	}
+	return clients.PublicClient("webhooks", cfg.Timeout.Duration)
+}
+
+// WithRetention makes the delivered and dead deliveries expire after retention
+func (d *WebhookDispatcher) WithRetention(retention time.Duration) *WebhookDispatcher {
+	d.retention = retention
+	return d
+}
+
+// WithDeadLetters adds the dead deliveries to queue, a replayed letter is sent
+// again from its first attempt
+func (d *WebhookDispatcher) WithDeadLetters(queue *DeadLetterQueue) *WebhookDispatcher {
+	d.deadLetters = queue
+	queue.handle(PublisherWebhooks, d.redeliver)
+	return d
+}
+
+// redeliver records the delivery of letter as pending again
+func (d *WebhookDispatcher) redeliver(ctx context.Context, letter *DeadLetter) error {
+	if _, err := d.store.GetSubscription(ctx, letter.SubscriptionID); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return d.store.SaveDelivery(ctx, &WebhookDelivery{
+		ID:             letter.DeliveryID,
+		SubscriptionID: letter.SubscriptionID,
+		Event:          letter.Event,
+		Status:         DeliveryPending,
+		NextAttemptAt:  now,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	})
+}
+
+// Publish records a delivery of event for every subscription of its tenant
+// interested in its type
+func (d *WebhookDispatcher) Publish(ctx context.Context, event *OutboxEvent) error {
+	subs, err := d.store.ListSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, sub := range subs {
+		if !sub.Matches(event) {
+			continue
+		}
+		// the id is derived from the event so a republished event replaces its delivery
+		delivery := &WebhookDelivery{
+			ID:             event.ID + "-" + sub.ID,
+			SubscriptionID: sub.ID,
+			Event:          event,
+			Status:         DeliveryPending,
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if err := d.store.SaveDelivery(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run sends due deliveries until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.cfg.PollInterval.Duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.DeliverOnce(ctx)
+	}
+}
+
+// DeliverOnce sends one batch of due deliveries, Concurrency at a time, and
+// returns how many were attempted
+func (d *WebhookDispatcher) DeliverOnce(ctx context.Context) int {
+	deliveries, err := d.store.DueDeliveries(ctx, time.Now().UTC(), d.cfg.Concurrency*10)
+	if err != nil {
+		d.logger.Errorf("failed to read due deliveries: %v", err)
+		return 0
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, d.cfg.Concurrency)
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(delivery *WebhookDelivery) {
+			defer func() { <-sem; wg.Done() }()
+			d.attempt(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+// attempt sends delivery once and records the outcome
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery *WebhookDelivery) {
+	sub, err := d.store.GetSubscription(ctx, delivery.SubscriptionID)
+	if errors.Is(err, ErrSubscriptionNotFound) {
+		// the subscription was deleted together with its deliveries
+		return
+	}
+	if err != nil {
+		d.logger.Errorf("failed to read subscription %s: %v", delivery.SubscriptionID, err)
+		return
+	}
+
+	code, err := d.send(ctx, sub, delivery)
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.ResponseCode = code
+	delivery.UpdatedAt = now
+
+	result := "delivered"
+	switch {
+	case err == nil:
+		delivery.Status = DeliveryDelivered
+		delivery.LastError = ""
+	case delivery.Attempts >= d.cfg.MaxAttempts:
+		result = "dead"
+		delivery.Status = DeliveryDead
+		delivery.LastError = err.Error()
+		d.logger.Warnf("dead-lettered delivery %s to %s after %d attempts: %v", delivery.ID, sub.URL, delivery.Attempts, err)
+	default:
+		result = "failed"
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = now.Add(d.schedule.Backoff(delivery.Attempts))
+	}
+	webhookDeliveries.WithLabelValues(result).Inc()
+	if delivery.Status != DeliveryPending && d.retention > 0 {
+		delivery.ExpiresAt = now.Add(d.retention).Unix()
+	}
+
+	if err := d.store.SaveDelivery(ctx, delivery); err != nil {
+		d.logger.Errorf("failed to record delivery %s: %v", delivery.ID, err)
+	}
+	if delivery.Status == DeliveryDead && d.deadLetters != nil {
+		letter := &DeadLetter{
+			ID:             PublisherWebhooks + "-" + delivery.ID,
+			Publisher:      PublisherWebhooks,
+			Event:          delivery.Event,
+			SubscriptionID: delivery.SubscriptionID,
+			DeliveryID:     delivery.ID,
+			Attempts:       delivery.Attempts,
+			LastError:      delivery.LastError,
+			FailedAt:       now,
+		}
+		if err := d.deadLetters.Add(ctx, letter); err != nil {
+			d.logger.Errorf("failed to dead-letter delivery %s: %v", delivery.ID, err)
+		}
+	}
+}
+
+// send posts the signed event of delivery to sub and returns the response status.
+// Network failures and responses that may succeed later are sent again right
+// away with the retry policy, before the attempt counts as failed.
+func (d *WebhookDispatcher) send(ctx context.Context, sub *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	var code int
+	err := d.retry.Do(ctx, func(ctx context.Context) error {
+		var err error
+		code, err = d.sendOnce(ctx, sub, delivery)
+		if err == nil || (code == 0 && retry.Temporary(err)) || retry.RetryableStatus(code) {
+			return err
+		}
+		return retry.Permanent(err)
+	})
+	return code, err
+}
+
+// sendOnce makes one request of send, signed with the current time
+func (d *WebhookDispatcher) sendOnce(ctx context.Context, sub *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, string(delivery.Event.Type))
+	req.Header.Set(WebhookDeliveryHeader, delivery.ID)
+	req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(sub.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
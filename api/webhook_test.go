@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"github.com/omnom-nom/order/config"
+)
+
+func TestWebhookTenantScoping(t *testing.T) {
+	const acmeKey, globexKey = "acme-key-0123456789", "globex-key-0123456789"
+	repo := NewMemoryRepository()
+	if err := EnableWebhooks(repo, ""); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Webhooks.AllowPrivateNetworks = true
+	cfg.Tenants.Keys = map[string][]string{"acme": {acmeKey}, "globex": {globexKey}}
+	injector := NewInjector(repo, nil, config.NewStore(cfg, nil))
+
+	serve := func(handler http.HandlerFunc, method, body string, header http.Header, vars map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, "/"+v1Prefix+"/webhooks", strings.NewReader(body))
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		r = mux.SetURLVars(r, vars)
+		w := httptest.NewRecorder()
+		injector.ServeHTTP(w, r, handler)
+		return w
+	}
+	acme := http.Header{APIKeyHeader: {acmeKey}}
+	globex := http.Header{APIKeyHeader: {globexKey}}
+
+	w := serve(CreateWebhook, http.MethodPost, `{"url": "http://127.0.0.1/hook"}`, acme, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, body %s", w.Code, w.Body)
+	}
+	var sub WebhookSubscription
+	if err := json.NewDecoder(w.Body).Decode(&sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.TenantID != "acme" {
+		t.Fatalf("tenant = %q, want acme", sub.TenantID)
+	}
+	vars := map[string]string{"subscriptionId": sub.ID}
+
+	count := func(header http.Header) int {
+		t.Helper()
+		w := serve(ListWebhooks, http.MethodGet, "", header, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("list: status = %d, body %s", w.Code, w.Body)
+		}
+		var resp listSubscriptionsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.Subscriptions)
+	}
+	if n := count(acme); n != 1 {
+		t.Errorf("acme lists %d subscriptions, want 1", n)
+	}
+	if n := count(globex); n != 0 {
+		t.Errorf("globex lists %d subscriptions, want 0", n)
+	}
+	if n := count(nil); n != 0 {
+		t.Errorf("a request without a key lists %d subscriptions, want 0", n)
+	}
+
+	if w := serve(GetWebhook, http.MethodGet, "", globex, vars); w.Code != http.StatusNotFound {
+		t.Errorf("get by globex: status = %d, want 404", w.Code)
+	}
+	if w := serve(DeleteWebhook, http.MethodDelete, "", globex, vars); w.Code != http.StatusNotFound {
+		t.Errorf("delete by globex: status = %d, want 404", w.Code)
+	}
+	claims := []http.Header{
+		{TenantHeader: {"acme"}},
+		{APIKeyHeader: {globexKey}, TenantHeader: {"acme"}},
+	}
+	for _, header := range claims {
+		if w := serve(GetWebhook, http.MethodGet, "", header, vars); w.Code != http.StatusForbidden {
+			t.Errorf("get claiming acme with %v: status = %d, want 403", header, w.Code)
+		}
+	}
+	if w := serve(GetWebhook, http.MethodGet, "", acme, vars); w.Code != http.StatusOK {
+		t.Errorf("get by acme: status = %d, want 200", w.Code)
+	}
+}
@@ -0,0 +1,211 @@
+// Package capture records sanitized request and response pairs of the order
+// api to files, one json file per exchange, and reads them back to replay them
+// against another build and compare the responses.
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Redacted replaces the values of the redacted headers and body fields
+const Redacted = "REDACTED"
+
+// fileSuffix ends the names of the exchange files
+const fileSuffix = ".json"
+
+// Request is a recorded request
+type Request struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Query  string      `json:"query,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is the json body of the request, left out when it is not json
+	Body json.RawMessage `json:"body,omitempty"`
+	// BodyOmitted is set when the request had a body that is not json or
+	// larger than the limit, it can not be replayed
+	BodyOmitted bool `json:"bodyOmitted,omitempty"`
+}
+
+// Response is a recorded response
+type Response struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+	// Body is the json body of the response, left out when it is not json
+	Body json.RawMessage `json:"body,omitempty"`
+	// BodyOmitted is set when the response had a body that is not json or
+	// larger than the limit, it is not compared
+	BodyOmitted bool `json:"bodyOmitted,omitempty"`
+}
+
+// Exchange is a request and the response it was given
+type Exchange struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId,omitempty"`
+	// Route is the name of the route of the request
+	Route      string   `json:"route"`
+	DurationMs int64    `json:"durationMs"`
+	Request    Request  `json:"request"`
+	Response   Response `json:"response"`
+}
+
+// sensitiveHeaders are the headers whose values are never recorded
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+	"X-Signature":         true,
+}
+
+// Sanitizer removes the secrets and personal data from the exchanges
+type Sanitizer struct {
+	fields map[string]bool
+}
+
+// NewSanitizer returns the sanitizer redacting the body fields named fields,
+// at any depth and in any case, besides the credentials of the headers
+func NewSanitizer(fields []string) *Sanitizer {
+	s := &Sanitizer{fields: make(map[string]bool, len(fields))}
+	for _, field := range fields {
+		s.fields[strings.ToLower(field)] = true
+	}
+	return s
+}
+
+// Header returns a copy of header with the credentials redacted
+func (s *Sanitizer) Header(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	out := make(http.Header, len(header))
+	for key, values := range header {
+		if sensitiveHeaders[http.CanonicalHeaderKey(key)] {
+			out[key] = []string{Redacted}
+			continue
+		}
+		out[key] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// Query returns a copy of query with the values of the redacted fields
+// replaced
+func (s *Sanitizer) Query(query url.Values) url.Values {
+	out := make(url.Values, len(query))
+	for key, values := range query {
+		if s.fields[strings.ToLower(key)] {
+			out[key] = []string{Redacted}
+			continue
+		}
+		out[key] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// Body returns body with the redacted fields replaced, false when body is
+// not json
+func (s *Sanitizer) Body(body []byte) (json.RawMessage, bool) {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return nil, false
+	}
+	out, err := json.Marshal(s.redact(value))
+	if err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+func (s *Sanitizer) redact(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s.fields[strings.ToLower(key)] {
+				v[key] = Redacted
+				continue
+			}
+			v[key] = s.redact(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = s.redact(item)
+		}
+	}
+	return value
+}
+
+// Recorder writes exchanges to the files of a directory
+type Recorder struct {
+	dir string
+	seq uint64
+}
+
+// NewRecorder returns the recorder writing to dir, which it creates
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create capture directory: %v", err)
+	}
+	return &Recorder{dir: dir}, nil
+}
+
+// unsafeFileChars are replaced in the route part of the file names
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Write writes e to a file of its own, named so that the files sort by time.
+// The file appears complete or not at all.
+func (r *Recorder) Write(e *Exchange) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	seq := atomic.AddUint64(&r.seq, 1)
+	name := fmt.Sprintf("%s-%06d-%s%s", e.Time.UTC().Format("20060102T150405.000000000"), seq%1000000,
+		unsafeFileChars.ReplaceAllString(e.Route, "_"), fileSuffix)
+	tmp := filepath.Join(r.dir, "."+name)
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(r.dir, name))
+}
+
+// ReadDir reads the exchanges recorded in dir, oldest first
+func ReadDir(dir string) ([]*Exchange, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, fileSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exchanges := make([]*Exchange, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		e := &Exchange{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return nil, fmt.Errorf("invalid exchange %s: %v", name, err)
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges, nil
+}
@@ -0,0 +1,111 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DefaultIgnore are the body fields that differ between runs whatever the
+// build: generated ids, times and versions
+var DefaultIgnore = []string{"id", "orderId", "requestId", "createdAt", "updatedAt", "cancelledAt", "time", "version", "nextPageToken", "etag"}
+
+// Compare returns the differences of the response of a replay, of status
+// and body, from the recorded response want. The body fields named in ignore,
+// at any depth, and the redacted values are not compared.
+func Compare(want *Response, status int, body []byte, ignore []string) []string {
+	var diffs []string
+	if status != want.Status {
+		diffs = append(diffs, fmt.Sprintf("status: want %d, got %d", want.Status, status))
+	}
+	if want.BodyOmitted || len(want.Body) == 0 {
+		return diffs
+	}
+	return append(diffs, CompareJSON("body", want.Body, body, ignore)...)
+}
+
+// CompareJSON returns the differences of the json got from want, with the
+// paths of the values starting at name. The fields named in ignore, at any
+// depth, and the redacted values are not compared.
+func CompareJSON(name string, want, got []byte, ignore []string) []string {
+	var wantValue, gotValue interface{}
+	if err := json.Unmarshal(want, &wantValue); err != nil {
+		return []string{fmt.Sprintf("%s: invalid recorded json: %v", name, err)}
+	}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		return []string{fmt.Sprintf("%s: not json", name)}
+	}
+	skip := make(map[string]bool, len(ignore))
+	for _, field := range ignore {
+		skip[strings.ToLower(field)] = true
+	}
+	return compareValues(name, wantValue, gotValue, skip)
+}
+
+func compareValues(path string, want, got interface{}, skip map[string]bool) []string {
+	if want == Redacted {
+		return nil
+	}
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: want an object, got %s", path, describe(got))}
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for key := range w {
+			keys = append(keys, key)
+		}
+		for key := range g {
+			if _, ok := w[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, key := range keys {
+			if skip[strings.ToLower(key)] {
+				continue
+			}
+			wantField, inWant := w[key]
+			gotField, inGot := g[key]
+			switch {
+			case !inGot:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: missing", path, key))
+			case !inWant:
+				diffs = append(diffs, fmt.Sprintf("%s.%s: unexpected %s", path, key, describe(gotField)))
+			default:
+				diffs = append(diffs, compareValues(path+"."+key, wantField, gotField, skip)...)
+			}
+		}
+		return diffs
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: want an array, got %s", path, describe(got))}
+		}
+		if len(w) != len(g) {
+			return []string{fmt.Sprintf("%s: want %d items, got %d", path, len(w), len(g))}
+		}
+		var diffs []string
+		for i := range w {
+			diffs = append(diffs, compareValues(fmt.Sprintf("%s[%d]", path, i), w[i], g[i], skip)...)
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(want, got) {
+		return []string{fmt.Sprintf("%s: want %s, got %s", path, describe(want), describe(got))}
+	}
+	return nil
+}
+
+// describe returns the json of a value, shortened
+func describe(value interface{}) string {
+	data, _ := json.Marshal(value)
+	if len(data) > 80 {
+		return string(data[:77]) + "..."
+	}
+	return string(data)
+}
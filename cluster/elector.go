@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// LeaderLease is the name of the lease held by the leader
+const LeaderLease = "leader"
+
+// Elector campaigns for the leadership of this instance. Every renew interval
+// the leader extends its lease and the followers try to take it, which they
+// do once it expired, and learn the current leader from it.
+type Elector struct {
+	store  LeaseStore
+	cfg    config.ClusterConfig
+	id     string
+	logger logging.Logger
+
+	mu sync.RWMutex
+	// lease is the last leader lease seen, held by this instance or another
+	lease *Lease
+}
+
+// NewElector returns an elector keeping the leader lease in store, it names
+// the instance after the host when cfg has no node id and logs with logger,
+// the default logger when nil
+func NewElector(store LeaseStore, cfg config.ClusterConfig, logger logging.Logger) *Elector {
+	id := cfg.NodeID
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	if logger == nil {
+		logger = logging.Default().Module(logging.ModuleCluster)
+	}
+	return &Elector{
+		store:  store,
+		cfg:    cfg,
+		id:     id,
+		logger: logger.WithField("node", id),
+	}
+}
+
+// ID returns the node id of this instance
+func (e *Elector) ID() string {
+	return e.id
+}
+
+// Address returns the url this instance is reached at
+func (e *Elector) Address() string {
+	return e.cfg.Address
+}
+
+// Leader returns the lease of the current leader, false when there is none or
+// its lease expired
+func (e *Elector) Leader() (*Lease, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.lease == nil || !e.lease.Held(time.Now()) {
+		return nil, false
+	}
+	lease := *e.lease
+	return &lease, true
+}
+
+// IsLeader reports whether this instance leads. The leader steps down a renew
+// interval before its lease ends unless it renewed it, which leaves the
+// followers' clocks that much room to be ahead.
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.lease != nil && e.lease.Holder == e.id &&
+		time.Now().Add(e.cfg.RenewInterval.Duration).Before(e.lease.Until)
+}
+
+// Run campaigns every renew interval until ctx is done, then releases the
+// leadership if this instance holds it
+func (e *Elector) Run(ctx context.Context) {
+	for {
+		e.campaign(ctx)
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-time.After(e.cfg.RenewInterval.Duration):
+		}
+	}
+}
+
+// campaign takes or renews the leader lease, or learns who holds it
+func (e *Elector) campaign(ctx context.Context) {
+	wasLeader := e.IsLeader()
+	lease, err := Acquire(ctx, e.store, LeaderLease, e.id, e.cfg.Address, e.cfg.LeaseDuration.Duration)
+	if err != nil && !errors.Is(err, ErrLeaseHeld) {
+		e.logger.Errorf("failed to campaign for leadership: %v", err)
+		if wasLeader && !e.IsLeader() {
+			e.logger.Warn("lost leadership as the lease could not be renewed")
+		}
+		return
+	}
+	if lease == nil {
+		// lost a race for a free or expired lease, the winner is known by the next campaign
+		return
+	}
+
+	e.mu.Lock()
+	previous := e.lease
+	e.lease = lease
+	e.mu.Unlock()
+	switch {
+	case lease.Holder == e.id && !wasLeader:
+		e.logger.WithField("token", lease.Token).Info("became the leader")
+	case lease.Holder != e.id && wasLeader:
+		e.logger.WithField("leader", lease.Holder).Warn("lost leadership")
+	case lease.Holder != e.id && (previous == nil || previous.Holder != lease.Holder):
+		e.logger.WithField("leader", lease.Holder).Info("following the leader")
+	}
+}
+
+// resign releases the leader lease held by this instance, so a follower takes
+// over without waiting for it to expire
+func (e *Elector) resign() {
+	e.mu.Lock()
+	lease := e.lease
+	e.lease = nil
+	e.mu.Unlock()
+	if lease == nil || lease.Holder != e.id {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.RenewInterval.Duration)
+	defer cancel()
+	if err := Release(ctx, e.store, lease); err != nil {
+		e.logger.Errorf("failed to release the leadership: %v", err)
+		return
+	}
+	e.logger.Info("released the leadership")
+}
@@ -0,0 +1,211 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// memoryLeases keeps leases in memory with the semantics of the repositories
+type memoryLeases struct {
+	mu     sync.Mutex
+	leases map[string]Lease
+}
+
+func newMemoryLeases() *memoryLeases {
+	return &memoryLeases{leases: map[string]Lease{}}
+}
+
+func (m *memoryLeases) GetLease(ctx context.Context, name string) (*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease, ok := m.leases[name]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+	return &lease, nil
+}
+
+func (m *memoryLeases) CreateLease(ctx context.Context, lease *Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.leases[lease.Name]; ok {
+		return ErrLeaseHeld
+	}
+	m.leases[lease.Name] = *lease
+	return nil
+}
+
+func (m *memoryLeases) UpdateLease(ctx context.Context, lease *Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.leases[lease.Name]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+	if stored.Version != lease.Version {
+		return ErrLeaseHeld
+	}
+	lease.Version++
+	m.leases[lease.Name] = *lease
+	return nil
+}
+
+// expire ends the lease name now
+func (m *memoryLeases) expire(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lease := m.leases[name]
+	lease.Until = time.Now().Add(-time.Millisecond)
+	m.leases[name] = lease
+}
+
+func TestAcquire(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		// setup are the holders taking the lease before, in order
+		setup []string
+		// expire ends the lease taken by setup
+		expire  bool
+		holder  string
+		want    string
+		err     error
+		newTerm bool
+	}{
+		{name: "free lease", holder: "a", want: "a"},
+		{name: "renewed by its holder", setup: []string{"a"}, holder: "a", want: "a"},
+		{name: "held by another holder", setup: []string{"a"}, holder: "b", want: "a", err: ErrLeaseHeld},
+		{name: "expired lease taken over", setup: []string{"a"}, expire: true, holder: "b", want: "b", newTerm: true},
+		{name: "expired lease taken again by its holder", setup: []string{"a"}, expire: true, holder: "a", want: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryLeases()
+			var previous *Lease
+			for _, holder := range tt.setup {
+				lease, err := Acquire(ctx, store, LeaderLease, holder, "http://"+holder, time.Minute)
+				if err != nil {
+					t.Fatalf("Acquire(%s) = %v", holder, err)
+				}
+				previous = lease
+			}
+			if tt.expire {
+				store.expire(LeaderLease)
+			}
+
+			lease, err := Acquire(ctx, store, LeaderLease, tt.holder, "http://"+tt.holder, time.Minute)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Acquire() = %v, want %v", err, tt.err)
+			}
+			if lease == nil || lease.Holder != tt.want {
+				t.Fatalf("Acquire() = %+v, want a lease of %s", lease, tt.want)
+			}
+			if !lease.Held(time.Now()) {
+				t.Fatal("the lease returned is not held")
+			}
+			if previous == nil {
+				return
+			}
+			switch {
+			case tt.newTerm && lease.Token <= previous.Token:
+				t.Fatalf("token %d of the new holder is not above %d", lease.Token, previous.Token)
+			case !tt.newTerm && lease.Token != previous.Token:
+				t.Fatalf("token = %d, want %d of the same holder", lease.Token, previous.Token)
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryLeases()
+	lease, err := Acquire(ctx, store, LeaderLease, "a", "", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	if err := Release(ctx, store, lease); err != nil {
+		t.Fatalf("Release() = %v", err)
+	}
+	next, err := Acquire(ctx, store, LeaderLease, "b", "", time.Minute)
+	if err != nil {
+		t.Fatalf("Acquire() of the released lease = %v", err)
+	}
+	if next.Token <= lease.Token {
+		t.Fatalf("token %d after the release is not above %d", next.Token, lease.Token)
+	}
+	// releasing a lease taken over leaves the new holder alone
+	if err := Release(ctx, store, lease); err != nil {
+		t.Fatalf("Release() of a lease taken over = %v", err)
+	}
+	if current, _ := store.GetLease(ctx, LeaderLease); current.Holder != "b" || !current.Held(time.Now()) {
+		t.Fatalf("lease = %+v, want it held by b", current)
+	}
+}
+
+// newTestElector returns the elector of the instance id
+func newTestElector(store LeaseStore, id string) *Elector {
+	cfg := config.ClusterConfig{
+		Enabled:       true,
+		NodeID:        id,
+		Address:       "http://" + id,
+		LeaseDuration: config.Duration{Duration: time.Minute},
+		RenewInterval: config.Duration{Duration: time.Second},
+	}
+	return NewElector(store, cfg, nil)
+}
+
+func TestElector(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryLeases()
+	a, b := newTestElector(store, "a"), newTestElector(store, "b")
+	if _, ok := a.Leader(); ok {
+		t.Fatal("Leader() before any campaign returned a leader")
+	}
+
+	steps := []struct {
+		name   string
+		run    func()
+		leader string
+	}{
+		{name: "first campaigns", run: func() { a.campaign(ctx); b.campaign(ctx) }, leader: "a"},
+		{name: "leader renews", run: func() { a.campaign(ctx); b.campaign(ctx) }, leader: "a"},
+		{name: "leader resigns", run: func() { a.resign(); b.campaign(ctx); a.campaign(ctx) }, leader: "b"},
+		{name: "lease expires", run: func() { store.expire(LeaderLease); a.campaign(ctx); b.campaign(ctx) }, leader: "a"},
+	}
+	for _, step := range steps {
+		step.run()
+		for _, e := range []*Elector{a, b} {
+			if got, want := e.IsLeader(), e.ID() == step.leader; got != want {
+				t.Fatalf("%s: IsLeader() of %s = %t, want %t", step.name, e.ID(), got, want)
+			}
+			lease, ok := e.Leader()
+			if !ok || lease.Holder != step.leader || lease.Address != "http://"+step.leader {
+				t.Fatalf("%s: Leader() of %s = %+v, want %s", step.name, e.ID(), lease, step.leader)
+			}
+		}
+	}
+}
+
+func TestElectorStepsDownBeforeTheLeaseEnds(t *testing.T) {
+	store := newMemoryLeases()
+	e := newTestElector(store, "a")
+	e.campaign(context.Background())
+	if !e.IsLeader() {
+		t.Fatal("IsLeader() after the first campaign = false")
+	}
+	// a lease ending within the renew interval is not relied on
+	e.mu.Lock()
+	e.lease.Until = time.Now().Add(e.cfg.RenewInterval.Duration / 2)
+	e.mu.Unlock()
+	if e.IsLeader() {
+		t.Fatal("IsLeader() with a lease ending within the renew interval = true")
+	}
+	if _, ok := e.Leader(); !ok {
+		t.Fatal("Leader() of a lease still held returned none")
+	}
+}
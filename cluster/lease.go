@@ -0,0 +1,148 @@
+// Package cluster coordinates the instances of the service: it elects the
+// leader serving the writes with an expiring lease kept in the database, and
+// tracks the live instances by their heartbeats.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// leaseGrace is the time an expired lease is kept before the database may
+// delete it. A lease created again starts its fencing token at the creation
+// time in milliseconds, above the tokens of the deleted lease.
+const leaseGrace = 24 * time.Hour
+
+const (
+	// lockMinBackoff and lockMaxBackoff bound the wait between the attempts of Lock
+	lockMinBackoff = 20 * time.Millisecond
+	lockMaxBackoff = 500 * time.Millisecond
+)
+
+var (
+	// ErrLeaseHeld is returned when a lease is held by another holder, or was
+	// changed concurrently
+	ErrLeaseHeld = errors.New("lease is held by another holder")
+	// ErrLeaseNotFound is returned when no lease has the requested name
+	ErrLeaseNotFound = errors.New("lease not found")
+	// ErrLockTimeout is returned when a lock is still held by another holder
+	// after the wait of Lock
+	ErrLockTimeout = errors.New("timed out waiting for the lock")
+)
+
+// Lease is an exclusive claim of a holder on a name until a time
+type Lease struct {
+	Name   string `json:"name" dynamodbav:"leaseName"`
+	Holder string `json:"holder" dynamodbav:"holder"`
+	// Address is the url the holder is reached at
+	Address string `json:"address,omitempty" dynamodbav:"address,omitempty"`
+	// Token increases with every change of holder. Writes made under the lease
+	// carry it, so the writes of a holder that lost the lease can be refused.
+	Token int64     `json:"token" dynamodbav:"token"`
+	Until time.Time `json:"until" dynamodbav:"until"`
+	// ExpiresAt is the unix time the database may delete the lease at
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"-" dynamodbav:"version"`
+}
+
+// Held reports whether the lease is still held at now
+func (l *Lease) Held(now time.Time) bool {
+	return now.Before(l.Until)
+}
+
+// LeaseStore keeps leases, it is implemented by the repositories of the api
+type LeaseStore interface {
+	// GetLease returns the lease with name, or ErrLeaseNotFound
+	GetLease(ctx context.Context, name string) (*Lease, error)
+	// CreateLease stores a new lease, it fails with ErrLeaseHeld when the name
+	// is taken
+	CreateLease(ctx context.Context, lease *Lease) error
+	// UpdateLease replaces a lease if its stored version equals lease.Version,
+	// incrementing lease.Version. It fails with ErrLeaseNotFound or ErrLeaseHeld.
+	UpdateLease(ctx context.Context, lease *Lease) error
+}
+
+// Acquire takes the lease name for holder, reached at address, for ttl when it
+// is free, expired or already held by holder, which extends it. It returns the
+// lease as stored, or the lease of the other holder with ErrLeaseHeld.
+func Acquire(ctx context.Context, store LeaseStore, name, holder, address string, ttl time.Duration) (*Lease, error) {
+	now := time.Now().UTC()
+	current, err := store.GetLease(ctx, name)
+	if errors.Is(err, ErrLeaseNotFound) {
+		lease := &Lease{Name: name, Holder: holder, Address: address, Token: now.UnixNano() / int64(time.Millisecond)}
+		lease.extend(now, ttl)
+		if err := store.CreateLease(ctx, lease); err != nil {
+			return nil, err
+		}
+		return lease, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current.Holder != holder && current.Held(now) {
+		return current, ErrLeaseHeld
+	}
+
+	next := *current
+	if next.Holder != holder {
+		next.Holder = holder
+		next.Token++
+	}
+	next.Address = address
+	next.extend(now, ttl)
+	if err := store.UpdateLease(ctx, &next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// Lock takes the lease name for holder for ttl like Acquire, waiting up to
+// wait while another holder has it, and fails with ErrLockTimeout after.
+// Holders that lock the same name concurrently must have distinct names.
+func Lock(ctx context.Context, store LeaseStore, name, holder string, ttl, wait time.Duration) (*Lease, error) {
+	deadline := time.Now().Add(wait)
+	backoff := lockMinBackoff
+	for {
+		lease, err := Acquire(ctx, store, name, holder, "", ttl)
+		if err == nil {
+			return lease, nil
+		}
+		if err != nil && !errors.Is(err, ErrLeaseHeld) {
+			return nil, err
+		}
+
+		// the lease is held, or another holder won the race for it
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		if time.Now().Add(delay).After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		if backoff *= 2; backoff > lockMaxBackoff {
+			backoff = lockMaxBackoff
+		}
+	}
+}
+
+// Release gives up lease before it expires, keeping it stored so its token
+// keeps increasing. A lease taken over in the meantime is left alone.
+func Release(ctx context.Context, store LeaseStore, lease *Lease) error {
+	released := *lease
+	released.Until = time.Now().UTC()
+	err := store.UpdateLease(ctx, &released)
+	if errors.Is(err, ErrLeaseHeld) || errors.Is(err, ErrLeaseNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (l *Lease) extend(now time.Time, ttl time.Duration) {
+	l.Until = now.Add(ttl)
+	l.ExpiresAt = l.Until.Add(leaseGrace).Unix()
+}
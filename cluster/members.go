@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// memberRetention is the time a member that stopped heartbeating is kept
+// before the database may delete it
+const memberRetention = 24 * time.Hour
+
+// Role is the part a member plays in the cluster
+type Role string
+
+const (
+	RoleLeader   Role = "leader"
+	RoleFollower Role = "follower"
+)
+
+// Member is an instance of the service
+type Member struct {
+	ID      string `json:"id" dynamodbav:"memberId"`
+	Address string `json:"address" dynamodbav:"address"`
+	// Role is set when members are listed, from the leader lease
+	Role      Role      `json:"role" dynamodbav:"-"`
+	StartedAt time.Time `json:"startedAt" dynamodbav:"startedAt"`
+	// LastSeen is the time of the last heartbeat of the member
+	LastSeen time.Time `json:"lastSeen" dynamodbav:"lastSeen"`
+	// ExpiresAt is the unix time the database may delete the member at
+	ExpiresAt int64 `json:"-" dynamodbav:"expiresAt"`
+}
+
+// MemberStore keeps the members of the cluster, it is implemented by the
+// repositories of the api
+type MemberStore interface {
+	// PutMember stores member, replacing the member with the same id
+	PutMember(ctx context.Context, member *Member) error
+	// DeleteMember removes the member with id, if any
+	DeleteMember(ctx context.Context, id string) error
+	// ListMembers returns all stored members, live or not
+	ListMembers(ctx context.Context) ([]*Member, error)
+}
+
+// Membership registers this instance as a member of the cluster with a
+// heartbeat every renew interval, and learns the other members from it.
+// Members whose last heartbeat is older than the lease duration are no longer
+// live.
+type Membership struct {
+	store   MemberStore
+	elector *Elector
+	cfg     config.ClusterConfig
+	self    Member
+	logger  logging.Logger
+
+	mu sync.RWMutex
+	// live are the live members by id as of the last heartbeat, nil before it
+	live map[string]*Member
+}
+
+// NewMembership returns the membership of the instance elected by elector,
+// kept in store and logged with the logger of elector
+func NewMembership(store MemberStore, elector *Elector, cfg config.ClusterConfig) *Membership {
+	return &Membership{
+		store:   store,
+		elector: elector,
+		cfg:     cfg,
+		self:    Member{ID: elector.ID(), Address: cfg.Address, StartedAt: time.Now().UTC()},
+		logger:  elector.logger,
+	}
+}
+
+// ID returns the member id of this instance
+func (m *Membership) ID() string {
+	return m.self.ID
+}
+
+// Run heartbeats every renew interval until ctx is done, then leaves the cluster
+func (m *Membership) Run(ctx context.Context) {
+	for {
+		m.heartbeat(ctx)
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return
+		case <-time.After(m.cfg.RenewInterval.Duration):
+		}
+	}
+}
+
+func (m *Membership) heartbeat(ctx context.Context) {
+	member := m.self
+	member.LastSeen = time.Now().UTC()
+	member.ExpiresAt = member.LastSeen.Add(memberRetention).Unix()
+	if err := m.store.PutMember(ctx, &member); err != nil {
+		m.logger.Errorf("failed to heartbeat membership: %v", err)
+		return
+	}
+
+	members, err := m.Members(ctx)
+	if err != nil {
+		m.logger.Errorf("failed to list the members: %v", err)
+		return
+	}
+	live := make(map[string]*Member, len(members))
+	for _, member := range members {
+		live[member.ID] = member
+	}
+	m.mu.Lock()
+	previous := m.live
+	m.live = live
+	m.mu.Unlock()
+	for id := range live {
+		if _, ok := previous[id]; !ok && previous != nil {
+			m.logger.WithField("member", id).Info("member joined")
+		}
+	}
+	for id := range previous {
+		if _, ok := live[id]; !ok {
+			m.logger.WithField("member", id).Info("member left")
+		}
+	}
+}
+
+// Live reports whether the member with id was live at the last heartbeat. All
+// members count as live until the first heartbeat listed them.
+func (m *Membership) Live(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.live == nil {
+		return true
+	}
+	_, ok := m.live[id]
+	return ok
+}
+
+func (m *Membership) leave() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.RenewInterval.Duration)
+	defer cancel()
+	if err := m.store.DeleteMember(ctx, m.self.ID); err != nil {
+		m.logger.Errorf("failed to leave the cluster: %v", err)
+	}
+}
+
+// Members returns the live members sorted by id, the holder of the leader
+// lease with the leader role
+func (m *Membership) Members(ctx context.Context) ([]*Member, error) {
+	stored, err := m.store.ListMembers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	leader := ""
+	if lease, ok := m.elector.Leader(); ok {
+		leader = lease.Holder
+	}
+	cutoff := time.Now().Add(-m.cfg.LeaseDuration.Duration)
+	var live []*Member
+	for _, member := range stored {
+		if member.LastSeen.Before(cutoff) {
+			continue
+		}
+		member.Role = RoleFollower
+		if member.ID == leader {
+			member.Role = RoleLeader
+		}
+		live = append(live, member)
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].ID < live[j].ID })
+	return live, nil
+}
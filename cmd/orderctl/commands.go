@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/omnom-nom/order/capture"
+	"github.com/omnom-nom/order/orderclient"
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+// stringList is a flag given once per value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// newFlags returns the flag set of the command name, usage describes its arguments
+func newFlags(name, usage string) *flag.FlagSet {
+	flags := flag.NewFlagSet("orderctl "+name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: orderctl %s %s\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// orderID returns the single order id argument of flags
+func orderID(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return "", flag.ErrHelp
+	}
+	return flags.Arg(0), nil
+}
+
+func runCreate(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("create", "[-f request.json | -customer id -item sku:quantity:price...]")
+	file := flags.String("f", "", "json CreateOrderRequest, - for stdin")
+	customer := flags.String("customer", "", "id of the customer")
+	paymentMethod := flags.String("payment-method", "", "token of the payment method at the payment provider")
+	currency := flags.String("currency", "", "ISO 4217 currency of the prices, that of the tenant when empty")
+	allowDuplicate := flags.Bool("allow-duplicate", false, "create the order even if it repeats a recent order of the customer")
+	var items, discounts stringList
+	flags.Var(&items, "item", "sku:quantity:unit price of an item, repeated per item")
+	flags.Var(&discounts, "discount", "discount code, repeated per code")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	req := &orderpb.CreateOrderRequest{}
+	if *file != "" {
+		data, err := readInput(*file)
+		if err != nil {
+			return err
+		}
+		if err := protojson.Unmarshal(data, req); err != nil {
+			return fmt.Errorf("invalid request in %s: %v", *file, err)
+		}
+	}
+	if *customer != "" {
+		req.CustomerId = *customer
+	}
+	if *paymentMethod != "" {
+		req.PaymentMethod = *paymentMethod
+	}
+	if *currency != "" {
+		req.Currency = *currency
+	}
+	if *allowDuplicate {
+		req.AllowDuplicate = true
+	}
+	req.DiscountCodes = append(req.DiscountCodes, discounts...)
+	for _, item := range items {
+		lineItem, err := parseItem(item)
+		if err != nil {
+			return err
+		}
+		req.Items = append(req.Items, lineItem)
+	}
+
+	order, err := env.client.CreateOrder(ctx, req)
+	if err != nil {
+		return err
+	}
+	return env.printOrder(order)
+}
+
+// parseItem reads an item given as sku:quantity:unit price
+func parseItem(value string) (*orderpb.LineItem, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("item %q must be sku:quantity:unit price", value)
+	}
+	quantity, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid quantity of item %q: %v", value, err)
+	}
+	price, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unit price of item %q: %v", value, err)
+	}
+	return &orderpb.LineItem{Sku: parts[0], Quantity: int32(quantity), UnitPrice: price}, nil
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func runGet(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("get", "<order id>")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	id, err := orderID(flags)
+	if err != nil {
+		return err
+	}
+	order, err := env.client.GetOrder(ctx, id)
+	if err != nil {
+		return err
+	}
+	return env.printOrder(order)
+}
+
+func runList(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("list", "[-customer id] [-status status] [-limit n] [-all]")
+	customer := flags.String("customer", "", "list the orders of the customer")
+	status := flags.String("status", "", "list the orders with the status")
+	limit := flags.Int("limit", 50, "orders per page")
+	pageToken := flags.String("page-token", "", "token of the page to list, from the previous page")
+	all := flags.Bool("all", false, "list the orders of all the pages")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	req := &orderpb.ListOrdersRequest{
+		CustomerId: *customer,
+		Status:     *status,
+		Limit:      int32(*limit),
+		PageToken:  *pageToken,
+	}
+
+	if !*all {
+		resp, err := env.client.ListOrders(ctx, req)
+		if err != nil {
+			return err
+		}
+		return env.printOrders(resp.GetOrders(), resp.GetNextPageToken())
+	}
+	var orders []*orderpb.Order
+	it := env.client.Orders(ctx, req)
+	for it.Next() {
+		orders = append(orders, it.Order())
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return env.printOrders(orders, "")
+}
+
+func runCancel(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("cancel", "[-reason code] [-note text] <order id>")
+	reason := flags.String("reason", string(orderclient.CancelOther),
+		"reason code: customer_request, payment_failed, out_of_stock, fraud_suspected, duplicate or other")
+	note := flags.String("note", "", "note explaining the cancellation")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	id, err := orderID(flags)
+	if err != nil {
+		return err
+	}
+	order, err := env.client.CancelOrder(ctx, id, &orderclient.CancelOrderRequest{
+		Reason: orderclient.CancelReason(*reason),
+		Note:   *note,
+	})
+	if err != nil {
+		return err
+	}
+	return env.printOrder(order)
+}
+
+func runExport(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("export", "[-format csv|json] [-from date] [-to date] [-status status] [-customer id] [-out file]")
+	format := flags.String("format", orderclient.ExportCSV, "csv, or json for JSON lines")
+	columns := flags.String("columns", "", "comma separated csv columns, the default columns when empty")
+	from := flags.String("from", "", "export the orders created from this date or RFC3339 time on")
+	to := flags.String("to", "", "export the orders created before this date or RFC3339 time")
+	status := flags.String("status", "", "export the orders with the status")
+	customer := flags.String("customer", "", "export the orders of the customer")
+	out := flags.String("out", "", "file written, stdout when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	req := &orderclient.ExportRequest{Format: *format, Status: *status, CustomerID: *customer}
+	if *columns != "" {
+		req.Columns = strings.Split(*columns, ",")
+	}
+	var err error
+	if req.From, err = parseTime(*from); err != nil {
+		return fmt.Errorf("invalid from: %v", err)
+	}
+	if req.To, err = parseTime(*to); err != nil {
+		return fmt.Errorf("invalid to: %v", err)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	export, err := env.client.ExportOrders(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer export.Close()
+	if _, err := io.Copy(w, export); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d orders\n", export.Count)
+	return nil
+}
+
+// parseTime reads a date or an RFC3339 time, the zero time when empty
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func runDrain(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("drain", "[start|stop|status]")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	action := "start"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+
+	var state *orderclient.DrainState
+	var err error
+	switch action {
+	case "start":
+		state, err = env.client.StartDrain(ctx)
+	case "stop":
+		state, err = env.client.StopDrain(ctx)
+	case "status":
+		state, err = env.client.GetDrain(ctx)
+	default:
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(state)
+	}
+	if state.Draining && state.Since != nil {
+		fmt.Printf("draining since %s\n", formatTime(*state.Since))
+	} else {
+		fmt.Println("in rotation")
+	}
+	return nil
+}
+
+func runConfig(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("config", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg, err := env.client.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+	return env.print(cfg)
+}
+
+func runMaintenance(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("maintenance", "[-message text] [on|off|status]")
+	message := flags.String("message", "", "message of the refused writes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	action := "status"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+	}
+
+	var m *orderclient.Maintenance
+	var err error
+	switch action {
+	case "on", "off":
+		m, err = env.client.SetMaintenance(ctx, &orderclient.Maintenance{Enabled: action == "on", Message: *message})
+	case "status":
+		m, err = env.client.GetMaintenance(ctx)
+	default:
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(m)
+	}
+	switch {
+	case m.Enabled && m.Message != "":
+		fmt.Printf("in maintenance: %s\n", m.Message)
+	case m.Enabled:
+		fmt.Println("in maintenance")
+	default:
+		fmt.Println("serving writes")
+	}
+	return nil
+}
+
+func runLogLevel(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("loglevel", "[-module name] [panic|fatal|error|warning|info|debug|trace]")
+	module := flags.String("module", "", "module whose level is shown or changed, e.g. apiserver, repository or webhooks")
+	reset := flags.Bool("reset", false, "make the module log at the level of the instance again")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *reset && (*module == "" || flags.NArg() > 0) {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	var levels *orderclient.LogLevels
+	var err error
+	switch {
+	case *reset:
+		levels, err = env.client.SetModuleLogLevel(ctx, *module, "")
+	case flags.NArg() > 0:
+		levels, err = env.client.SetModuleLogLevel(ctx, *module, flags.Arg(0))
+	default:
+		levels, err = env.client.GetLogLevels(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(levels)
+	}
+	if *module != "" {
+		level, ok := levels.Modules[*module]
+		if !ok {
+			level = levels.Level
+		}
+		fmt.Println(level)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "MODULE\tLEVEL")
+	fmt.Fprintf(w, "*\t%s\n", levels.Level)
+	modules := make([]string, 0, len(levels.Modules))
+	for name := range levels.Modules {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	for _, name := range modules {
+		fmt.Fprintf(w, "%s\t%s\n", name, levels.Modules[name])
+	}
+	return w.Flush()
+}
+
+func runRoutes(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("routes", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	routes, err := env.client.ListRoutes(ctx)
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(routes)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tPATH\tNAME")
+	for _, route := range routes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", route.Method, route.Path, route.Name)
+	}
+	return w.Flush()
+}
+
+func runSlow(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("slow", "[-reset]")
+	reset := flags.Bool("reset", false, "forget the slow requests instead of listing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *reset {
+		return env.client.ResetSlowRequests(ctx)
+	}
+	slow, err := env.client.ListSlowRequests(ctx)
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(slow)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tMETHOD\tROUTE\tSTATUS\tDURATION\tDB CALLS\tDB TIME\tCAPACITY\tREQUEST ID")
+	for _, req := range slow.Requests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%dms\t%d\t%dms\t%.1f\t%s\n", formatTime(req.Time), req.Method, req.Route, req.Status,
+			req.DurationMs, req.DbCalls, req.DbDurationMs, req.ConsumedCapacity, req.RequestID)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%d slow requests since the start, %d kept\n", slow.Total, len(slow.Requests))
+	return nil
+}
+
+func runCapacity(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("capacity", "[-by route|operation|table] [-reset]")
+	by := flags.String("by", "", "group the usage by route, operation or table")
+	reset := flags.Bool("reset", false, "forget the consumed capacity instead of showing it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *reset {
+		return env.client.ResetCapacity(ctx)
+	}
+	capacity, err := env.client.GetCapacity(ctx, *by)
+	if err != nil {
+		return err
+	}
+	if env.output != outputTable {
+		return env.print(capacity)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tOPERATION\tTABLE\tREAD UNITS\tWRITE UNITS\tCOST")
+	for _, usage := range capacity.Usage {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f\t%.1f\t%.4f\n", usage.Route, usage.Operation, usage.Table, usage.ReadUnits, usage.WriteUnits, usage.Cost)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("%.1f read and %.1f write units since %s, about %.4f\n", capacity.ReadUnits, capacity.WriteUnits, formatTime(capacity.Since), capacity.Cost)
+	return nil
+}
+
+// replaySkipHeaders are the recorded request headers not sent again: those of
+// the connection and those the client sets itself
+var replaySkipHeaders = map[string]bool{
+	"Authorization":   true,
+	"Connection":      true,
+	"Content-Length":  true,
+	"Accept-Encoding": true,
+	"User-Agent":      true,
+	"X-Request-Id":    true,
+}
+
+// replayResult is the outcome of replaying one recorded exchange
+type replayResult struct {
+	Method string   `json:"method" yaml:"method"`
+	Path   string   `json:"path" yaml:"path"`
+	Route  string   `json:"route" yaml:"route"`
+	Status int      `json:"status" yaml:"status"`
+	Result string   `json:"result" yaml:"result"`
+	Diffs  []string `json:"diffs,omitempty" yaml:"diffs,omitempty"`
+}
+
+func runReplay(ctx context.Context, env *env, args []string) error {
+	flags := newFlags("replay", "[-route name] [-ignore fields] dir")
+	var routes stringList
+	flags.Var(&routes, "route", "replay only the requests of the route, repeatable")
+	ignore := flags.String("ignore", strings.Join(capture.DefaultIgnore, ","), "comma separated body fields not compared")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return flag.ErrHelp
+	}
+	exchanges, err := capture.ReadDir(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	only := map[string]bool{}
+	for _, route := range routes {
+		only[route] = true
+	}
+	var ignored []string
+	for _, field := range strings.Split(*ignore, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			ignored = append(ignored, field)
+		}
+	}
+
+	var results []*replayResult
+	failed := 0
+	for _, e := range exchanges {
+		if len(only) > 0 && !only[e.Route] {
+			continue
+		}
+		result := &replayResult{Method: e.Request.Method, Path: e.Request.Path, Route: e.Route}
+		results = append(results, result)
+		if e.Request.BodyOmitted {
+			result.Result = "skipped"
+			continue
+		}
+		status, body, err := replay(ctx, env.client, e)
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", e.Request.Method, e.Request.Path, err)
+		}
+		result.Status = status
+		result.Diffs = capture.Compare(&e.Response, status, body, ignored)
+		result.Result = "ok"
+		if len(result.Diffs) > 0 {
+			result.Result = "differs"
+			failed++
+		}
+	}
+
+	if env.output != outputTable {
+		if err := env.print(results); err != nil {
+			return err
+		}
+	} else {
+		for _, result := range results {
+			fmt.Printf("%-8s %s %s (%s)\n", result.Result, result.Method, result.Path, result.Route)
+			for _, diff := range result.Diffs {
+				fmt.Printf("         %s\n", diff)
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d responses differ", failed, len(results))
+	}
+	return nil
+}
+
+// replay sends the recorded request of e again and returns the status and
+// body of the response
+func replay(ctx context.Context, client *orderclient.Client, e *capture.Exchange) (int, []byte, error) {
+	header := http.Header{}
+	for key, values := range e.Request.Header {
+		if replaySkipHeaders[http.CanonicalHeaderKey(key)] || (len(values) == 1 && values[0] == capture.Redacted) {
+			continue
+		}
+		header[key] = values
+	}
+	path := e.Request.Path
+	if e.Request.Query != "" {
+		path += "?" + e.Request.Query
+	}
+	var body []byte
+	if len(e.Request.Body) > 0 {
+		body = e.Request.Body
+	}
+	resp, err := client.Do(ctx, e.Request.Method, path, header, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
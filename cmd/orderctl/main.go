@@ -0,0 +1,149 @@
+// Command orderctl calls the order api from the command line, for operators
+// and support engineers:
+//
+//	orderctl [global flags] <command> [flags] [args]
+//
+// Run orderctl -h for the commands and orderctl <command> -h for their flags.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/omnom-nom/order/orderclient"
+)
+
+// command is a subcommand of orderctl
+type command struct {
+	usage string
+	run   func(ctx context.Context, env *env, args []string) error
+}
+
+var commands = map[string]command{
+	"create":      {"create an order from flags or a CreateOrderRequest json file", runCreate},
+	"get":         {"get <order id>: show an order", runGet},
+	"list":        {"list the orders of a customer or a status", runList},
+	"cancel":      {"cancel <order id>: cancel an order and refund it", runCancel},
+	"export":      {"export orders as csv or json lines", runExport},
+	"drain":       {"drain [start|stop|status]: take the instance answering out of rotation", runDrain},
+	"config":      {"dump the running configuration of the instance answering", runConfig},
+	"maintenance": {"maintenance [on|off|status]: refuse writes on the instance answering", runMaintenance},
+	"loglevel":    {"loglevel [-module name] [level]: show or change the log levels of the instance answering", runLogLevel},
+	"routes":      {"list the routes of the instance answering", runRoutes},
+	"slow":        {"slow [-reset]: list the slow requests of the instance answering", runSlow},
+	"replay":      {"replay [-route name] [-ignore fields] dir: re-issue recorded requests and compare the responses", runReplay},
+	"capacity":    {"capacity [-by route|operation|table] [-reset]: show the dynamodb capacity consumed by the instance answering", runCapacity},
+}
+
+// env is what the commands share: the client and the output format
+type env struct {
+	client *orderclient.Client
+	output string
+}
+
+func main() {
+	global := flag.NewFlagSet("orderctl", flag.ExitOnError)
+	baseURL := global.String("url", envOr("ORDERCTL_URL", orderclient.DefaultBaseURL), "base url of the order api (ORDERCTL_URL)")
+	token := global.String("token", os.Getenv("ORDERCTL_TOKEN"), "bearer token of the requests (ORDERCTL_TOKEN)")
+	adminToken := global.String("admin-token", os.Getenv("ORDERCTL_ADMIN_TOKEN"), "bearer token of the admin commands (ORDERCTL_ADMIN_TOKEN)")
+	timeout := global.Duration("timeout", 30*time.Second, "timeout of one request attempt")
+	attempts := global.Int("attempts", 3, "attempts of the requests that may be repeated")
+	caFile := global.String("ca-cert", "", "pem file of the certificate authorities of the server")
+	insecure := global.Bool("insecure", false, "skip the verification of the server certificate")
+	output := global.String("o", outputTable, "output format: table, json or yaml")
+	global.Usage = func() {
+		fmt.Fprintf(global.Output(), "usage: orderctl [global flags] <command> [flags] [args]\n\ncommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(global.Output(), "  %-12s %s\n", name, commands[name].usage)
+		}
+		fmt.Fprintf(global.Output(), "\nglobal flags:\n")
+		global.PrintDefaults()
+	}
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[global.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", global.Arg(0))
+		global.Usage()
+		os.Exit(2)
+	}
+	if !validOutput(*output) {
+		fatalf("unknown output format %q", *output)
+	}
+
+	tlsConfig, err := newTLSConfig(*caFile, *insecure)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	client, err := orderclient.New(
+		orderclient.WithBaseURL(*baseURL),
+		orderclient.WithToken(*token),
+		orderclient.WithAdminToken(*adminToken),
+		orderclient.WithTimeout(*timeout),
+		orderclient.WithRetries(*attempts, 200*time.Millisecond, 2*time.Second),
+		orderclient.WithTLSConfig(tlsConfig),
+		orderclient.WithUserAgent("orderctl"),
+	)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd.run(ctx, &env{client: client, output: *output}, global.Args()[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fatalf("%s: %v", global.Arg(0), err)
+	}
+}
+
+// newTLSConfig returns the tls settings trusting the certificate authorities
+// of caFile, nil for the defaults
+func newTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	if caFile == "" && !insecure {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca certificates: %v", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	return cfg, nil
+}
+
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func fatalf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, "orderctl: "+format+"\n", args...)
+	os.Exit(1)
+}
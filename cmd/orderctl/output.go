@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+// output formats
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+func validOutput(output string) bool {
+	return output == outputTable || output == outputJSON || output == outputYAML
+}
+
+// printOrders writes orders and the token of the page after them
+func (e *env) printOrders(orders []*orderpb.Order, nextPageToken string) error {
+	if e.output != outputTable {
+		return e.print(&orderpb.ListOrdersResponse{Orders: orders, NextPageToken: nextPageToken})
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCUSTOMER\tSTATUS\tITEMS\tTOTAL\tCREATED")
+	for _, order := range orders {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%.2f\t%s\n", order.GetId(), order.GetCustomerId(), order.GetStatus(),
+			len(order.GetItems()), order.GetTotal(), formatTime(order.GetCreatedAt().AsTime()))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if nextPageToken != "" {
+		fmt.Printf("\nmore orders with -page-token %s\n", nextPageToken)
+	}
+	return nil
+}
+
+// printOrder writes order with its items and shipping address
+func (e *env) printOrder(order *orderpb.Order) error {
+	if e.output != outputTable {
+		return e.print(order)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%s\n", order.GetId())
+	fmt.Fprintf(w, "Customer:\t%s\n", order.GetCustomerId())
+	fmt.Fprintf(w, "Status:\t%s\n", order.GetStatus())
+	fmt.Fprintf(w, "Total:\t%.2f %s\n", order.GetTotal(), order.GetCurrency())
+	fmt.Fprintf(w, "Created:\t%s\n", formatTime(order.GetCreatedAt().AsTime()))
+	fmt.Fprintf(w, "Updated:\t%s\n", formatTime(order.GetUpdatedAt().AsTime()))
+	fmt.Fprintf(w, "Version:\t%d\n", order.GetVersion())
+	if a := order.GetShippingAddress(); a != nil {
+		fmt.Fprintf(w, "Ship to:\t%s\n", joinNonEmpty(a.GetName(), a.GetLine1(), a.GetLine2(), a.GetCity(), a.GetState(), a.GetPostalCode(), a.GetCountry()))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SKU\tNAME\tQUANTITY\tUNIT PRICE")
+	for _, item := range order.GetItems() {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.2f\n", item.GetSku(), item.GetName(), item.GetQuantity(), item.GetUnitPrice())
+	}
+	return w.Flush()
+}
+
+// print writes v, a proto message or a json value, as json or yaml. The table
+// of values without one is their yaml.
+func (e *env) print(v interface{}) error {
+	var data []byte
+	var err error
+	if msg, ok := v.(proto.Message); ok {
+		data, err = protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(msg)
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return err
+	}
+	if e.output == outputJSON {
+		return writeIndented(os.Stdout, data)
+	}
+
+	// the json field names are kept in yaml
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+func writeIndented(w io.Writer, data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() || t.Unix() == 0 {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func joinNonEmpty(parts ...string) string {
+	joined := ""
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		if joined != "" {
+			joined += ", "
+		}
+		joined += part
+	}
+	return joined
+}
@@ -0,0 +1,2656 @@
+// Package config loads the order service configuration from a file,
+// environment variables and command line flags, in increasing order of precedence.
+package config
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/routing"
+	"github.com/omnom-nom/order/schedule"
+)
+
+const (
+	// EnvPrefix is prepended to every environment variable override
+	EnvPrefix = "ORDER_"
+	// EnvConfigFile names the config file when -config is not given
+	EnvConfigFile = EnvPrefix + "CONFIG"
+
+	redacted = "********"
+
+	// minTenantKeyLength is the shortest api key of a tenant accepted
+	minTenantKeyLength = 16
+)
+
+// Config is the complete configuration of the order service
+type Config struct {
+	ListenAddress string              `json:"listenAddress" yaml:"listenAddress"`
+	IPStack       string              `json:"ipStack" yaml:"ipStack"`
+	TLS           TLSConfig           `json:"tls" yaml:"tls"`
+	ProxyProtocol ProxyConfig         `json:"proxyProtocol" yaml:"proxyProtocol"`
+	Forwarded     ForwardedConfig     `json:"forwarded" yaml:"forwarded"`
+	ACL           ACLConfig           `json:"acl" yaml:"acl"`
+	GRPC          GRPCConfig          `json:"grpc" yaml:"grpc"`
+	Admin         AdminConfig         `json:"admin" yaml:"admin"`
+	Storage       StorageConfig       `json:"storage" yaml:"storage"`
+	Db            DbConfig            `json:"db" yaml:"db"`
+	Cache         CacheConfig         `json:"cache" yaml:"cache"`
+	Hedging       HedgingConfig       `json:"hedging" yaml:"hedging"`
+	DbStatus      DbStatusConfig      `json:"dbStatus" yaml:"dbStatus"`
+	SlowRequests  SlowConfig          `json:"slowRequests" yaml:"slowRequests"`
+	Capacity      CapacityConfig      `json:"capacity" yaml:"capacity"`
+	Capture       CaptureConfig       `json:"capture" yaml:"capture"`
+	Mirror        MirrorConfig        `json:"mirror" yaml:"mirror"`
+	Coalescing    CoalescingConfig    `json:"coalescing" yaml:"coalescing"`
+	Outbox        OutboxConfig        `json:"outbox" yaml:"outbox"`
+	Webhooks      WebhookConfig       `json:"webhooks" yaml:"webhooks"`
+	Kafka         KafkaConfig         `json:"kafka" yaml:"kafka"`
+	Notifications NotificationsConfig `json:"notifications" yaml:"notifications"`
+	DeadLetters   DeadLetterConfig    `json:"deadLetters" yaml:"deadLetters"`
+	Commands      SQSConfig           `json:"commands" yaml:"commands"`
+	Returns       ReturnsConfig       `json:"returns" yaml:"returns"`
+	Customers     CustomersConfig     `json:"customers" yaml:"customers"`
+	Hosts         HostsConfig         `json:"hosts" yaml:"hosts"`
+	Agents        AgentsConfig        `json:"agents" yaml:"agents"`
+	Quotas        QuotasConfig        `json:"quotas" yaml:"quotas"`
+	Drafts        DraftsConfig        `json:"drafts" yaml:"drafts"`
+	Schedules     SchedulesConfig     `json:"schedules" yaml:"schedules"`
+	Retention     RetentionConfig     `json:"retention" yaml:"retention"`
+	Encryption    EncryptionConfig    `json:"encryption" yaml:"encryption"`
+	Redaction     RedactionConfig     `json:"redaction" yaml:"redaction"`
+	I18n          I18nConfig          `json:"i18n" yaml:"i18n"`
+	Imports       ImportsConfig       `json:"imports" yaml:"imports"`
+	Jobs          JobsConfig          `json:"jobs" yaml:"jobs"`
+	Cron          CronConfig          `json:"cron" yaml:"cron"`
+	Cluster       ClusterConfig       `json:"cluster" yaml:"cluster"`
+	Payments      PaymentsConfig      `json:"payments" yaml:"payments"`
+	Currency      CurrencyConfig      `json:"currency" yaml:"currency"`
+	Inventory     InventoryConfig     `json:"inventory" yaml:"inventory"`
+	Fraud         FraudConfig         `json:"fraud" yaml:"fraud"`
+	Duplicates    DuplicatesConfig    `json:"duplicates" yaml:"duplicates"`
+	Experiments   ExperimentsConfig   `json:"experiments" yaml:"experiments"`
+	SLA           SLAConfig           `json:"sla" yaml:"sla"`
+	Sagas         SagaConfig          `json:"sagas" yaml:"sagas"`
+	Stats         StatsConfig         `json:"stats" yaml:"stats"`
+	MetricsExport MetricsExportConfig `json:"metricsExport" yaml:"metricsExport"`
+	Pricing       PricingConfig       `json:"pricing" yaml:"pricing"`
+	Shipping      ShippingConfig      `json:"shipping" yaml:"shipping"`
+	Routing       RoutingConfig       `json:"routing" yaml:"routing"`
+	Priority      PriorityConfig      `json:"priority" yaml:"priority"`
+	Tracking      TrackingConfig      `json:"tracking" yaml:"tracking"`
+	Cursors       CursorsConfig       `json:"cursors" yaml:"cursors"`
+	Documents     DocumentsConfig     `json:"documents" yaml:"documents"`
+	Outbound      OutboundConfig      `json:"outbound" yaml:"outbound"`
+	LogLevel      string              `json:"logLevel" yaml:"logLevel"`
+	LogFormat     string              `json:"logFormat" yaml:"logFormat"`
+	Timeouts      TimeoutConfig       `json:"timeouts" yaml:"timeouts"`
+
+	// Migrate applies the database schema migrations and exits instead of serving
+	Migrate bool `json:"-" yaml:"-"`
+
+	// the settings below are reloaded on SIGHUP
+	RateLimit    RateLimitConfig    `json:"rateLimit" yaml:"rateLimit"`
+	Gatekeeper   GatekeeperConfig   `json:"gatekeeper" yaml:"gatekeeper"`
+	Deprecations DeprecationsConfig `json:"deprecations" yaml:"deprecations"`
+	Canary       CanaryConfig       `json:"canary" yaml:"canary"`
+	Features     map[string]bool    `json:"features" yaml:"features"`
+	Tenants      TenantsConfig      `json:"tenants" yaml:"tenants"`
+	// LogLevels overrides the log level of modules, e.g. webhooks: debug
+	LogLevels map[string]string `json:"logLevels" yaml:"logLevels"`
+}
+
+// TLSConfig holds the certificate paths used to serve https
+type TLSConfig struct {
+	CertFile string `json:"certFile" yaml:"certFile"`
+	KeyFile  string `json:"keyFile" yaml:"keyFile"`
+	CAFile   string `json:"caFile" yaml:"caFile"`
+}
+
+// Enabled reports whether a certificate and key are configured
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// ProxyConfig controls the PROXY protocol header load balancers forwarding
+// tcp connections send first with the address of the client
+type ProxyConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Trusted are the addresses or cidr ranges of the load balancers whose
+	// connections start with a header, which must not be empty
+	Trusted []string `json:"trusted" yaml:"trusted"`
+	// HeaderTimeout is the time a load balancer has to send the header
+	HeaderTimeout Duration `json:"headerTimeout" yaml:"headerTimeout"`
+}
+
+// TrustedNetworks returns the networks of the trusted load balancers
+func (p ProxyConfig) TrustedNetworks() ([]*net.IPNet, error) {
+	return parseNetworks(p.Trusted)
+}
+
+// ForwardedConfig controls reading the address of the client from the
+// Forwarded, X-Forwarded-For and X-Real-IP headers of the proxies in front of
+// the service
+type ForwardedConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Trusted are the addresses or cidr ranges of the proxies whose headers
+	// are believed
+	Trusted []string `json:"trusted" yaml:"trusted"`
+}
+
+// TrustedNetworks returns the networks of the trusted proxies
+func (f ForwardedConfig) TrustedNetworks() ([]*net.IPNet, error) {
+	return parseNetworks(f.Trusted)
+}
+
+// ACLConfig controls the network acl of the api: a request is served when the
+// address of its client passes the lists of every route and those of the
+// group of its route
+type ACLConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	ACLRule `yaml:",inline"`
+	// Groups are the lists of the route groups by name: order, customer, draft,
+	// schedule, host and admin
+	Groups map[string]ACLRule `json:"groups" yaml:"groups"`
+}
+
+// ACLRule lists the addresses and cidr ranges of the clients allowed and
+// denied. A denied client is refused, and so is one not allowed unless the
+// allow list is empty.
+type ACLRule struct {
+	Allow []string `json:"allow" yaml:"allow"`
+	Deny  []string `json:"deny" yaml:"deny"`
+}
+
+// Networks returns the allowed and denied networks of r
+func (r ACLRule) Networks() (allow, deny []*net.IPNet, err error) {
+	if allow, err = parseNetworks(r.Allow); err != nil {
+		return nil, nil, fmt.Errorf("allow: %v", err)
+	}
+	if deny, err = parseNetworks(r.Deny); err != nil {
+		return nil, nil, fmt.Errorf("deny: %v", err)
+	}
+	return allow, deny, nil
+}
+
+// parseNetworks returns the networks of a list of addresses and cidr ranges,
+// an address is a network of one
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(list))
+	for _, trusted := range list {
+		if ip := net.ParseIP(trusted); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(trusted)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a cidr range", trusted)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// GRPCConfig controls the grpc api served next to the http api
+type GRPCConfig struct {
+	Enabled       bool   `json:"enabled" yaml:"enabled"`
+	ListenAddress string `json:"listenAddress" yaml:"listenAddress"`
+	// Multiplex serves grpc and http on the http listen address instead
+	Multiplex bool `json:"multiplex" yaml:"multiplex"`
+}
+
+// AdminConfig controls the admin api of the instance: drain, maintenance mode,
+// log level, config and route dumps. It is served on ListenAddress when set,
+// and on the http listen address otherwise; requests to it carry Token as
+// their bearer token when it is set. Without either it is not served.
+type AdminConfig struct {
+	ListenAddress string `json:"listenAddress" yaml:"listenAddress"`
+	Token         string `json:"token" yaml:"token"`
+	// Debug serves pprof, expvar and goroutine and heap dumps under /v1/admin/debug
+	Debug bool       `json:"debug" yaml:"debug"`
+	CSRF  CSRFConfig `json:"csrf" yaml:"csrf"`
+}
+
+// cookie SameSite modes
+const (
+	SameSiteStrict = "strict"
+	SameSiteLax    = "lax"
+	SameSiteNone   = "none"
+)
+
+// CSRFConfig controls the double submit cookie protecting the admin api from
+// the requests a browser is made to send by another site
+type CSRFConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// CookieName is the cookie holding the token
+	CookieName string `json:"cookieName" yaml:"cookieName"`
+	// HeaderName is the header the token is submitted in again
+	HeaderName string `json:"headerName" yaml:"headerName"`
+	// SameSite is the SameSite attribute of the cookie: strict, lax or none
+	SameSite string `json:"sameSite" yaml:"sameSite"`
+	// Secure sends the cookie over https only, SameSite none requires it
+	Secure bool `json:"secure" yaml:"secure"`
+	// TTL is the lifetime of a token
+	TTL Duration `json:"ttl" yaml:"ttl"`
+}
+
+// ip stacks the servers listen on
+const (
+	StackDual = "dual"
+	StackIPv4 = "ipv4"
+	StackIPv6 = "ipv6"
+)
+
+// storage backends
+const (
+	BackendDynamoDB = "dynamodb"
+	BackendPostgres = "postgres"
+	BackendSQLite   = "sqlite"
+)
+
+// storage modes
+const (
+	// StorageModeState stores the current state of the orders only
+	StorageModeState = "state"
+	// StorageModeEvents also appends every change of an order to its event stream
+	StorageModeEvents = "events"
+)
+
+// StorageConfig selects where orders are stored
+type StorageConfig struct {
+	// Backend is one of dynamodb, postgres or sqlite
+	Backend string `json:"backend" yaml:"backend"`
+	// DSN is the connection string of the postgres and sqlite backends
+	DSN string `json:"dsn" yaml:"dsn"`
+	// Mode is one of state or events, in events mode every change of an order
+	// is appended to its event stream in the same write
+	Mode string `json:"mode" yaml:"mode"`
+	// SnapshotEvery is the number of versions of an order between the
+	// snapshots of its event stream
+	SnapshotEvery int `json:"snapshotEvery" yaml:"snapshotEvery"`
+}
+
+// DbConfig holds the DynamoDB connection settings and table names
+type DbConfig struct {
+	Endpoint         string      `json:"endpoint" yaml:"endpoint"`
+	Region           string      `json:"region" yaml:"region"`
+	AccessKeyID      string      `json:"accessKeyId" yaml:"accessKeyId"`
+	SecretAccessKey  string      `json:"secretAccessKey" yaml:"secretAccessKey"`
+	OrdersTable      string      `json:"ordersTable" yaml:"ordersTable"`
+	MigrationsTable  string      `json:"migrationsTable" yaml:"migrationsTable"`
+	OutboxTable      string      `json:"outboxTable" yaml:"outboxTable"`
+	WebhooksTable    string      `json:"webhooksTable" yaml:"webhooksTable"`
+	DeadLettersTable string      `json:"deadLettersTable" yaml:"deadLettersTable"`
+	ReturnsTable     string      `json:"returnsTable" yaml:"returnsTable"`
+	CustomersTable   string      `json:"customersTable" yaml:"customersTable"`
+	DraftsTable      string      `json:"draftsTable" yaml:"draftsTable"`
+	SchedulesTable   string      `json:"schedulesTable" yaml:"schedulesTable"`
+	JobsTable        string      `json:"jobsTable" yaml:"jobsTable"`
+	LeasesTable      string      `json:"leasesTable" yaml:"leasesTable"`
+	MembersTable     string      `json:"membersTable" yaml:"membersTable"`
+	HostsTable       string      `json:"hostsTable" yaml:"hostsTable"`
+	QuotasTable      string      `json:"quotasTable" yaml:"quotasTable"`
+	SagasTable       string      `json:"sagasTable" yaml:"sagasTable"`
+	StreamsTable     string      `json:"streamsTable" yaml:"streamsTable"`
+	StatsTable       string      `json:"statsTable" yaml:"statsTable"`
+	WarehousesTable  string      `json:"warehousesTable" yaml:"warehousesTable"`
+	Retry            RetryConfig `json:"retry" yaml:"retry"`
+}
+
+// RetryConfig is the retry policy of calls to DynamoDB and other services,
+// backoff is exponential with jitter
+type RetryConfig struct {
+	// MaxAttempts is the number of attempts of a call including the first
+	MaxAttempts    int      `json:"maxAttempts" yaml:"maxAttempts"`
+	InitialBackoff Duration `json:"initialBackoff" yaml:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff" yaml:"maxBackoff"`
+}
+
+// validate returns the errors of the policy of the calls to name
+func (r RetryConfig) validate(name string) []string {
+	var errs []string
+	if r.MaxAttempts <= 0 {
+		errs = append(errs, name+" retry max attempts must be positive")
+	}
+	if r.InitialBackoff.Duration <= 0 || r.MaxBackoff.Duration < r.InitialBackoff.Duration {
+		errs = append(errs, name+" retry initial backoff must be positive and not above the max backoff")
+	}
+	return errs
+}
+
+// CacheConfig controls the redis read-through cache of order lookups
+type CacheConfig struct {
+	Enabled       bool     `json:"enabled" yaml:"enabled"`
+	RedisAddress  string   `json:"redisAddress" yaml:"redisAddress"`
+	RedisPassword string   `json:"redisPassword" yaml:"redisPassword"`
+	RedisDB       int      `json:"redisDb" yaml:"redisDb"`
+	TTL           Duration `json:"ttl" yaml:"ttl"`
+}
+
+// HedgingConfig controls hedged order reads: when a DynamoDB read of an order
+// takes longer than a percentile of the recent reads a second one is sent, the
+// first to answer is used and the other cancelled
+type HedgingConfig struct {
+	// Routes names the routes whose order reads are hedged, GetOrder and OrderStatus
+	Routes []string `json:"routes" yaml:"routes"`
+	// Percentile of the recent read latencies after which the second read is sent
+	Percentile float64 `json:"percentile" yaml:"percentile"`
+	// MinDelay and MaxDelay bound the wait before the second read, MaxDelay is
+	// the wait until enough reads were seen
+	MinDelay Duration `json:"minDelay" yaml:"minDelay"`
+	MaxDelay Duration `json:"maxDelay" yaml:"maxDelay"`
+}
+
+// Hedged reports whether the order reads of route are hedged
+func (h HedgingConfig) Hedged(route string) bool {
+	for _, r := range h.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// DbStatusConfig controls the database status check: writes are refused with
+// 503 while the last check failed or took longer than MaxLatency, reads are
+// still served, from the order cache when the database fails them
+type DbStatusConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// TTL is the time a check is reused before the next request checks again
+	TTL     Duration `json:"ttl" yaml:"ttl"`
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// MaxLatency is the slowest check of a healthy database, 0 disables it
+	MaxLatency Duration `json:"maxLatency" yaml:"maxLatency"`
+}
+
+// SlowConfig controls the detection of slow requests, the last of which are
+// kept for the admin api with the DynamoDB calls they made
+type SlowConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Threshold is the duration above which a request is slow
+	Threshold Duration `json:"threshold" yaml:"threshold"`
+	// Routes overrides the threshold by route name, 0 never finds the route slow
+	Routes map[string]Duration `json:"routes" yaml:"routes"`
+	// QueryThreshold is the duration above which a DynamoDB call of a request
+	// is logged, 0 disables it
+	QueryThreshold Duration `json:"queryThreshold" yaml:"queryThreshold"`
+	// Size is the number of slow requests kept
+	Size int `json:"size" yaml:"size"`
+}
+
+// RouteThreshold returns the duration above which a request of route is slow,
+// 0 when it never is
+func (s SlowConfig) RouteThreshold(route string) time.Duration {
+	if threshold, ok := s.Routes[route]; ok {
+		return threshold.Duration
+	}
+	return s.Threshold.Duration
+}
+
+// CapacityConfig controls the tracking of the capacity consumed by the
+// DynamoDB calls and the estimation of their cost
+type CapacityConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// ReadUnitPrice and WriteUnitPrice are the prices of a million read and
+	// write request units of on-demand tables
+	ReadUnitPrice  float64 `json:"readUnitPrice" yaml:"readUnitPrice"`
+	WriteUnitPrice float64 `json:"writeUnitPrice" yaml:"writeUnitPrice"`
+}
+
+// CaptureConfig controls the recording of sanitized request and response
+// pairs to files, which orderctl replay re-issues against another build
+type CaptureConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Dir is the directory the exchanges are written to, one file each
+	Dir string `json:"dir" yaml:"dir"`
+	// Routes limits the recording to the routes named, all when empty
+	Routes []string `json:"routes" yaml:"routes"`
+	// SampleRate is the fraction of the requests recorded, between 0 and 1
+	SampleRate float64 `json:"sampleRate" yaml:"sampleRate"`
+	// MaxBodyBytes is the largest body recorded, larger ones are left out
+	MaxBodyBytes int `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+	// RedactFields are the json body fields whose values are replaced, at any
+	// depth, besides the credentials of the headers which always are
+	RedactFields []string `json:"redactFields" yaml:"redactFields"`
+}
+
+// MirrorConfig sends copies of a sample of the requests to a shadow
+// deployment, whose responses are discarded
+type MirrorConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Endpoint is the base url of the shadow deployment the paths of the
+	// requests are appended to
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// Routes limits the mirroring to the routes named, all when empty
+	Routes []string `json:"routes" yaml:"routes"`
+	// SampleRate is the fraction of the requests mirrored, between 0 and 1
+	SampleRate float64 `json:"sampleRate" yaml:"sampleRate"`
+	// MaxBodyBytes is the largest body mirrored, requests with larger ones
+	// are not
+	MaxBodyBytes int `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+	// RedactFields are the json body fields whose values are replaced, at any
+	// depth, the credentials of the headers are never sent
+	RedactFields []string `json:"redactFields" yaml:"redactFields"`
+	Timeout      Duration `json:"timeout" yaml:"timeout"`
+	// Concurrency bounds the mirrored requests in flight, the requests beyond
+	// it are not mirrored
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+}
+
+// CoalescingConfig controls the coalescing of identical concurrent GET
+// requests into one execution of their handler
+type CoalescingConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Routes limits the coalescing to the GET routes named, all but the
+	// streamed ones when empty
+	Routes []string `json:"routes" yaml:"routes"`
+	// MaxBodyBytes is the largest response shared, the requests waiting for a
+	// larger one run their handler themselves
+	MaxBodyBytes int `json:"maxBodyBytes" yaml:"maxBodyBytes"`
+}
+
+// OutboundConfig tunes the pooled connections of the http calls the service
+// makes: webhooks, payment providers, inventory, carriers and writes proxied to
+// the leader
+type OutboundConfig struct {
+	// MaxIdleConns bounds the idle connections kept across all hosts,
+	// MaxIdleConnsPerHost those kept to one host
+	MaxIdleConns        int `json:"maxIdleConns" yaml:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost" yaml:"maxIdleConnsPerHost"`
+	// MaxConnsPerHost bounds the connections open to one host, requests beyond
+	// it wait for a connection; 0 is unlimited
+	MaxConnsPerHost     int      `json:"maxConnsPerHost" yaml:"maxConnsPerHost"`
+	IdleConnTimeout     Duration `json:"idleConnTimeout" yaml:"idleConnTimeout"`
+	DialTimeout         Duration `json:"dialTimeout" yaml:"dialTimeout"`
+	TLSHandshakeTimeout Duration `json:"tlsHandshakeTimeout" yaml:"tlsHandshakeTimeout"`
+	// ProxyURL is the proxy of the calls, when empty the proxy of the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+	ProxyURL string `json:"proxyUrl" yaml:"proxyUrl"`
+}
+
+// OutboxConfig controls the transactional outbox of order events and its relay
+type OutboxConfig struct {
+	Enabled      bool     `json:"enabled" yaml:"enabled"`
+	PollInterval Duration `json:"pollInterval" yaml:"pollInterval"`
+	MaxBackoff   Duration `json:"maxBackoff" yaml:"maxBackoff"`
+	BatchSize    int      `json:"batchSize" yaml:"batchSize"`
+}
+
+// WebhookConfig controls the delivery of order events to webhook subscriptions,
+// at least once only with the outbox
+type WebhookConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Timeout bounds one delivery request
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// MaxAttempts is the number of attempts before a delivery is dead-lettered
+	MaxAttempts    int      `json:"maxAttempts" yaml:"maxAttempts"`
+	InitialBackoff Duration `json:"initialBackoff" yaml:"initialBackoff"`
+	MaxBackoff     Duration `json:"maxBackoff" yaml:"maxBackoff"`
+	PollInterval   Duration `json:"pollInterval" yaml:"pollInterval"`
+	Concurrency    int      `json:"concurrency" yaml:"concurrency"`
+	// Retry sends the request of a delivery attempt again after transient
+	// failures, before the attempt counts as failed
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+	// AllowPrivateNetworks lets subscriptions deliver to loopback, private
+	// and link-local addresses, e.g. in development; by default only public
+	// addresses are accepted and connected to
+	AllowPrivateNetworks bool `json:"allowPrivateNetworks" yaml:"allowPrivateNetworks"`
+}
+
+// kafka payload encodings
+const (
+	EncodingJSON = "json"
+	EncodingAvro = "avro"
+)
+
+// KafkaConfig controls the publishing of order events to kafka, at least once only with the outbox
+type KafkaConfig struct {
+	Enabled bool     `json:"enabled" yaml:"enabled"`
+	Brokers []string `json:"brokers" yaml:"brokers"`
+	Topic   string   `json:"topic" yaml:"topic"`
+	// Encoding of the message values, json or avro
+	Encoding     string   `json:"encoding" yaml:"encoding"`
+	WriteTimeout Duration `json:"writeTimeout" yaml:"writeTimeout"`
+}
+
+// notification providers
+const (
+	EmailProviderSES  = "ses"
+	EmailProviderSMTP = "smtp"
+	SMSProviderSNS    = "sns"
+	SMSProviderTwilio = "twilio"
+)
+
+// NotificationsConfig controls the emails and text messages sent to customers
+// on the events of their orders
+type NotificationsConfig struct {
+	Enabled bool        `json:"enabled" yaml:"enabled"`
+	Email   EmailConfig `json:"email" yaml:"email"`
+	SMS     SMSConfig   `json:"sms" yaml:"sms"`
+	// Templates replace the built-in messages of event types or add messages
+	// for other event types, by event type
+	Templates map[string]NotificationTemplate `json:"templates" yaml:"templates"`
+	// Timeout bounds one send
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// Concurrency is the number of events notified in parallel
+	Concurrency int `json:"concurrency" yaml:"concurrency"`
+	// Retry sends a notification again after failures, it is dead-lettered
+	// once the attempts are spent
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+}
+
+// EmailConfig is the email channel of the notifications
+type EmailConfig struct {
+	// Provider is ses or smtp, empty sends no emails
+	Provider string `json:"provider" yaml:"provider"`
+	From     string `json:"from" yaml:"from"`
+	// Endpoint overrides the SES endpoint, e.g. for localstack
+	Endpoint string     `json:"endpoint" yaml:"endpoint"`
+	SMTP     SMTPConfig `json:"smtp" yaml:"smtp"`
+}
+
+// SMTPConfig is the mail server of the smtp provider, which authenticates
+// with the username and password when they are set
+type SMTPConfig struct {
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port" yaml:"port"`
+	Username string `json:"username" yaml:"username"`
+	Password string `json:"password" yaml:"password"`
+}
+
+// SMSConfig is the text message channel of the notifications
+type SMSConfig struct {
+	// Provider is sns or twilio, empty sends no text messages
+	Provider string `json:"provider" yaml:"provider"`
+	// Endpoint overrides the SNS endpoint or the Twilio api
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// SenderID names the sender of the messages sent with SNS
+	SenderID string       `json:"senderId" yaml:"senderId"`
+	Twilio   TwilioConfig `json:"twilio" yaml:"twilio"`
+}
+
+// TwilioConfig is the account of the twilio provider
+type TwilioConfig struct {
+	AccountSID string `json:"accountSid" yaml:"accountSid"`
+	AuthToken  string `json:"authToken" yaml:"authToken"`
+	// From is the phone number or messaging service the messages are sent from
+	From string `json:"from" yaml:"from"`
+}
+
+// NotificationTemplate is the message of an event type, as text/template
+// templates of the order. A message without a text is not sent.
+type NotificationTemplate struct {
+	Subject string `json:"subject" yaml:"subject"`
+	Email   string `json:"email" yaml:"email"`
+	SMS     string `json:"sms" yaml:"sms"`
+}
+
+// validate returns the errors of the providers of the notifications
+func (n *NotificationsConfig) validate() []string {
+	var errs []string
+	switch n.Email.Provider {
+	case "":
+	case EmailProviderSES:
+	case EmailProviderSMTP:
+		if n.Email.SMTP.Host == "" || n.Email.SMTP.Port <= 0 {
+			errs = append(errs, "notifications smtp host and port are required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown notifications email provider %q", n.Email.Provider))
+	}
+	if n.Email.Provider != "" && n.Email.From == "" {
+		errs = append(errs, "notifications email from is required")
+	}
+	switch n.SMS.Provider {
+	case "", SMSProviderSNS:
+	case SMSProviderTwilio:
+		if n.SMS.Twilio.AccountSID == "" || n.SMS.Twilio.AuthToken == "" || n.SMS.Twilio.From == "" {
+			errs = append(errs, "notifications twilio account sid, auth token and from are required")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown notifications sms provider %q", n.SMS.Provider))
+	}
+	if n.Email.Provider == "" && n.SMS.Provider == "" {
+		errs = append(errs, "notifications need an email or sms provider")
+	}
+	if n.Timeout.Duration <= 0 || n.Concurrency <= 0 {
+		errs = append(errs, "notifications timeout and concurrency must be positive")
+	}
+	return append(errs, n.Retry.validate("notifications")...)
+}
+
+// DeadLetterConfig controls keeping the events the webhooks and kafka failed
+// to deliver, for inspection and replay
+type DeadLetterConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxAttempts is the number of times the outbox relay publishes an event to
+	// kafka before it is dead-lettered, letting the later events of its order
+	// through
+	MaxAttempts int `json:"maxAttempts" yaml:"maxAttempts"`
+}
+
+// ReturnsConfig controls the returns (RMA) of delivered orders
+type ReturnsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
+// CustomersConfig controls the customer records and their address books
+type CustomersConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+}
+
+// HostsConfig controls the registry of the hosts, such as warehouse agents,
+// calling the api
+type HostsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Require refuses the requests of hosts that are not registered and live
+	Require bool `json:"require" yaml:"require"`
+	// HeartbeatTTL is the time a host stays live without a heartbeat
+	HeartbeatTTL Duration `json:"heartbeatTtl" yaml:"heartbeatTtl"`
+	// CacheTTL is the time a live host is trusted before it is read again
+	CacheTTL Duration `json:"cacheTtl" yaml:"cacheTtl"`
+}
+
+// AgentsConfig controls the api of the warehouse agents, which sign their
+// requests with the keys the admin api issues their hosts
+type AgentsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxSkew is the time the timestamp of a signed request, of an agent or
+	// to the host routes, may be away from the clock of the service
+	MaxSkew Duration `json:"maxSkew" yaml:"maxSkew"`
+}
+
+// TenantsConfig authenticates the tenants the requests are made for. A
+// request is made for the tenant whose key it carries in its X-Api-Key
+// header, and for none without one. Keys is reloaded on SIGHUP.
+type TenantsConfig struct {
+	// Keys maps tenants to their api keys, more than one while a key is rotated
+	Keys map[string][]string `json:"keys,omitempty" yaml:"keys"`
+}
+
+// Tenant returns the tenant whose key is key, "" when key is none of them
+func (c *TenantsConfig) Tenant(key string) string {
+	var tenant string
+	for t, keys := range c.Keys {
+		for _, k := range keys {
+			// every key is compared so the time does not tell which one matched
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 && key != "" {
+				tenant = t
+			}
+		}
+	}
+	return tenant
+}
+
+// what the consumers of the quotas are
+const (
+	// QuotaKeyAPIKey counts the requests of every X-Api-Key header
+	QuotaKeyAPIKey = "apiKey"
+	// QuotaKeyTenant counts the requests of every tenant authenticated by its
+	// api key
+	QuotaKeyTenant = "tenant"
+)
+
+// QuotasConfig controls the daily and monthly request quotas of the consumers
+// of the api. Default and Consumers are reloaded on SIGHUP.
+type QuotasConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// KeyBy is what a consumer is, apiKey or tenant; requests without the
+	// header of one of Consumers are counted by client ip
+	KeyBy string `json:"keyBy" yaml:"keyBy"`
+	// Default are the quotas of the consumers without quotas of their own
+	Default QuotaLimits `json:"default" yaml:"default"`
+	// Consumers are the quotas of consumers by the id the usage route shows
+	Consumers map[string]QuotaLimits `json:"consumers" yaml:"consumers"`
+}
+
+// QuotaLimits are the requests a consumer may make per utc day and month, 0
+// for no limit
+type QuotaLimits struct {
+	Daily   int64 `json:"daily" yaml:"daily"`
+	Monthly int64 `json:"monthly" yaml:"monthly"`
+}
+
+// Limits returns the quotas of consumer
+func (c *QuotasConfig) Limits(consumer string) QuotaLimits {
+	if limits, ok := c.Consumers[consumer]; ok {
+		return limits
+	}
+	return c.Default
+}
+
+// DraftsConfig controls the draft orders (carts) checked out into orders
+type DraftsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// TTL is the time an untouched draft is kept before it expires
+	TTL Duration `json:"ttl" yaml:"ttl"`
+}
+
+// SchedulesConfig controls the scheduled and recurring orders
+type SchedulesConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// PollInterval is the period of looking for schedules due to place an order
+	PollInterval Duration `json:"pollInterval" yaml:"pollInterval"`
+}
+
+// ImportsConfig controls the bulk import of orders from uploaded files
+type ImportsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxUploadSize is the largest file accepted, in bytes
+	MaxUploadSize int64 `json:"maxUploadSize" yaml:"maxUploadSize"`
+}
+
+// EncryptionConfig controls the envelope encryption of the sensitive fields of
+// orders and customers, their addresses, payment and email, with data keys
+// wrapped by a KMS key
+type EncryptionConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// KeyID is the KMS key, by id, arn or alias, wrapping the data keys of the
+	// records written. The records sealed with a previous key are still read.
+	KeyID string `json:"keyId" yaml:"keyId"`
+	// Region and Endpoint override those of the db for KMS
+	Region   string `json:"region" yaml:"region"`
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// DataKeyReuse is the time a data key seals the records written before a
+	// new one is generated
+	DataKeyReuse Duration `json:"dataKeyReuse" yaml:"dataKeyReuse"`
+	// DataKeyCacheSize is the number of unwrapped data keys kept to open records
+	DataKeyCacheSize int `json:"dataKeyCacheSize" yaml:"dataKeyCacheSize"`
+}
+
+// redaction policies of a field
+const (
+	// RedactMask replaces all but the end of the value with stars
+	RedactMask = "mask"
+	// RedactHash replaces the value with its keyed hash, equal values still
+	// match each other
+	RedactHash = "hash"
+	// RedactDrop leaves the field out
+	RedactDrop = "drop"
+)
+
+// RedactionConfig controls the scrubbing of personal data from the logs, the
+// audit trail of order edits, the error messages and the exports
+type RedactionConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Fields maps the fields redacted, such as email or clientIp, to their
+	// policy: mask, hash or drop. The names match the log fields, json fields
+	// and export columns regardless of case, dashes and underscores.
+	Fields map[string]string `json:"fields" yaml:"fields"`
+	// HashKey keys the hashes of the hash policy, so that a hashed value can
+	// not be found by hashing guesses
+	HashKey string `json:"hashKey" yaml:"hashKey"`
+}
+
+// I18nConfig controls the localization of the error messages and order
+// statuses of the responses to the language asked for in Accept-Language
+type I18nConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// DefaultLocale is the locale of the requests asking for none the catalog
+	// has, the messages missing in a locale are in English
+	DefaultLocale string `json:"defaultLocale" yaml:"defaultLocale"`
+	// Catalog is a directory of <locale>.json files of messages adding to and
+	// overriding the built in ones, by message key
+	Catalog string `json:"catalog" yaml:"catalog"`
+}
+
+// JobsConfig controls the background jobs, such as imports and exports, run by
+// a pool of workers shared by the instances of the service
+type JobsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Workers is the number of queued jobs an instance runs at a time
+	Workers int `json:"workers" yaml:"workers"`
+	// PollInterval is the period of looking for queued jobs
+	PollInterval Duration `json:"pollInterval" yaml:"pollInterval"`
+	// Heartbeat is the period a running job saves its progress and checks for its cancellation at
+	Heartbeat Duration `json:"heartbeat" yaml:"heartbeat"`
+	// Lease is the time without a heartbeat after which a running job is failed
+	// as its instance is gone
+	Lease Duration `json:"lease" yaml:"lease"`
+	// Bucket receives the files of export jobs, exports are only streamed without it
+	Bucket string `json:"bucket" yaml:"bucket"`
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Endpoint overrides the s3 endpoint, e.g. for minio or localstack
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+}
+
+// SLAStatuses are the statuses an order may overstay, the others are final
+var SLAStatuses = []string{"pending", "held", "paid", "shipped"}
+
+// SLAConfig sets the time an order may keep a status before it is overdue. A
+// watchdog escalates the overdue orders once per status.
+type SLAConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Interval is the period of the watchdog escalating the overdue orders
+	Interval Duration `json:"interval" yaml:"interval"`
+	// Limits is the time since its last change an order may keep a status, by
+	// status, e.g. paid: 48h for orders that have to ship within two days. A
+	// status without a limit, or with 0, is never overdue.
+	Limits map[string]Duration `json:"limits" yaml:"limits"`
+}
+
+// SagaConfig controls placing new orders as sagas, reserving their stock,
+// authorizing their payment and confirming them in steps whose progress is
+// stored, so the steps of a placement cut short, e.g. by a crash, are undone
+type SagaConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// StaleAfter is the time without progress after which a saga is taken as
+	// abandoned by its instance and compensated, it has to exceed the time a
+	// placement takes
+	StaleAfter Duration `json:"staleAfter" yaml:"staleAfter"`
+	// Interval is the period of the recovery of the abandoned sagas
+	Interval Duration `json:"interval" yaml:"interval"`
+}
+
+// StatsConfig controls the order statistics, counted by tenant and day of
+// creation as the orders are written
+type StatsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// MaxDays is the longest range of days the statistics are read for at once
+	MaxDays int `json:"maxDays" yaml:"maxDays"`
+}
+
+// the sinks the metrics are pushed to
+const (
+	// MetricsSinkStatsD sends the metrics to a StatsD server over udp
+	MetricsSinkStatsD = "statsd"
+	// MetricsSinkCloudWatch writes the metrics in the CloudWatch embedded
+	// metric format, picked up from stdout or sent to the CloudWatch agent
+	MetricsSinkCloudWatch = "cloudwatch"
+)
+
+// MetricsExportConfig pushes the metrics of the service, besides serving them
+// to prometheus, for the deployments that do not scrape them
+type MetricsExportConfig struct {
+	// Sink is where the metrics are pushed (statsd, cloudwatch), nowhere when empty
+	Sink string `json:"sink" yaml:"sink"`
+	// Interval is the period of the pushes, counters are pushed as their
+	// increase over it
+	Interval Duration `json:"interval" yaml:"interval"`
+	// Address is the udp address of the StatsD server or of the CloudWatch
+	// agent, the cloudwatch sink writes to stdout without it
+	Address string `json:"address" yaml:"address"`
+	// Namespace is the CloudWatch namespace of the metrics
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// Prefix is prepended to the names of the StatsD metrics
+	Prefix string `json:"prefix" yaml:"prefix"`
+	// Include are the prefixes of the names of the metrics pushed
+	Include []string `json:"include" yaml:"include"`
+}
+
+// CronConfig controls the scheduler running the background tasks, such as the
+// retention, the archival, the recurring orders and the webhook deliveries
+type CronConfig struct {
+	// Jitter delays every run of a task by a random time up to it, at most a
+	// tenth of the time since the previous run, so instances do not run in step
+	Jitter Duration `json:"jitter" yaml:"jitter"`
+	// LockTTL is the lease taken by the instance running a task that only one
+	// instance runs at a time, renewed while it runs
+	LockTTL Duration `json:"lockTTL" yaml:"lockTTL"`
+	// Tasks maps task names to their schedules, a cron expression, a
+	// descriptor like @daily or @every followed by a duration, in place of the
+	// intervals of their sections
+	Tasks map[string]string `json:"tasks,omitempty" yaml:"tasks"`
+}
+
+// ways followers hand writes to the leader
+const (
+	ForwardRedirect = "redirect"
+	ForwardProxy    = "proxy"
+)
+
+// ClusterConfig controls running several instances of the service, of which
+// the elected leader serves the writes
+type ClusterConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// NodeID names the instance, the host name by default
+	NodeID string `json:"nodeId" yaml:"nodeId"`
+	// Address is the base url the other instances and clients reach this
+	// instance at, e.g. http://10.0.0.5:8080
+	Address string `json:"address" yaml:"address"`
+	// LeaseDuration is the time the leadership lasts without being renewed, and
+	// a member stays live without a heartbeat
+	LeaseDuration Duration `json:"leaseDuration" yaml:"leaseDuration"`
+	// RenewInterval is the period the leader renews, and followers try to take,
+	// the leadership at, and the members heartbeat at
+	RenewInterval Duration `json:"renewInterval" yaml:"renewInterval"`
+	// Forward is how followers hand writes to the leader, redirect or proxy
+	Forward string `json:"forward" yaml:"forward"`
+	// OrderLockTTL is the time the lock serializing the changes of an order is
+	// held at most
+	OrderLockTTL Duration `json:"orderLockTtl" yaml:"orderLockTtl"`
+	// OrderLockWait is the time a change waits for the lock of its order
+	OrderLockWait Duration `json:"orderLockWait" yaml:"orderLockWait"`
+}
+
+// what happens to the orders past their retention
+const (
+	RetentionAnonymize = "anonymize"
+	RetentionDelete    = "delete"
+)
+
+// RetentionConfig controls how long deleted orders, finished orders, the audit
+// records of edits and the webhook delivery logs are kept, and the archival of
+// old orders
+type RetentionConfig struct {
+	// Deleted is the time a deleted order is kept, and can be restored, before it is purged
+	Deleted Duration `json:"deleted" yaml:"deleted"`
+	// Interval is the period of the retention job purging and archiving orders, 0 disables it
+	Interval Duration      `json:"interval" yaml:"interval"`
+	Archive  ArchiveConfig `json:"archive" yaml:"archive"`
+	// Orders is the time since its last change a finished order is kept before
+	// OrdersAction is applied to it, 0 keeps finished orders
+	Orders Duration `json:"orders" yaml:"orders"`
+	// OrdersAction is anonymize, erasing the personal data of the order, or
+	// delete
+	OrdersAction string `json:"ordersAction" yaml:"ordersAction"`
+	// Edits is the time the audit record of an edit is kept, 0 keeps it
+	Edits Duration `json:"edits" yaml:"edits"`
+	// Deliveries is the time the log of a delivered or dead webhook delivery
+	// is kept, 0 keeps it
+	Deliveries Duration `json:"deliveries" yaml:"deliveries"`
+}
+
+// ArchiveConfig controls the archival of delivered and cancelled orders to S3
+type ArchiveConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// After is the time since its last change after which a finished order is archived
+	After  Duration `json:"after" yaml:"after"`
+	Bucket string   `json:"bucket" yaml:"bucket"`
+	Prefix string   `json:"prefix" yaml:"prefix"`
+	// Endpoint overrides the s3 endpoint, e.g. for minio or localstack
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// BatchSize is the maximum number of orders written to one archive object
+	BatchSize int `json:"batchSize" yaml:"batchSize"`
+}
+
+// payment providers
+const (
+	PaymentProviderStripe = "stripe"
+	PaymentProviderMock   = "mock"
+)
+
+// PaymentsConfig controls the payment of orders, which are authorized and captured
+// when created and refunded when cancelled or returned
+type PaymentsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Provider is stripe or mock
+	Provider string `json:"provider" yaml:"provider"`
+	// Currency is the currency of the orders while currency.default is not set,
+	// payments are taken in the currency of their order
+	Currency string       `json:"currency" yaml:"currency"`
+	Stripe   StripeConfig `json:"stripe" yaml:"stripe"`
+	// GiftCards lets orders be paid in part or in full with gift cards and
+	// the store credit of their customer
+	GiftCards GiftCardsConfig `json:"giftCards" yaml:"giftCards"`
+	// Credit lets wholesale customers pay orders on account, within the
+	// credit line the credit service grants them
+	Credit CreditConfig `json:"credit" yaml:"credit"`
+}
+
+// gift card clients
+const (
+	GiftCardClientHTTP = "http"
+	GiftCardClientStub = "stub"
+)
+
+// GiftCardsConfig controls the gift card service keeping the balances of gift
+// cards and store credit
+type GiftCardsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Client is http, calling the gift card service at Endpoint, or stub
+	Client   string   `json:"client" yaml:"client"`
+	Endpoint string   `json:"endpoint" yaml:"endpoint"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+}
+
+// credit clients
+const (
+	CreditClientHTTP = "http"
+	CreditClientStub = "stub"
+)
+
+// CreditConfig controls the orders paid on account, charged to the credit line
+// of their customer and invoiced with net terms
+type CreditConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Client is http, calling the credit service at Endpoint, or stub
+	Client   string   `json:"client" yaml:"client"`
+	Endpoint string   `json:"endpoint" yaml:"endpoint"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+	// TermsDays is the number of days after which the invoices of the orders
+	// on account are due, for the credit lines without terms of their own
+	TermsDays int `json:"termsDays" yaml:"termsDays"`
+	// PurchaseOrderPattern is the regular expression purchase order numbers
+	// have to match
+	PurchaseOrderPattern string `json:"purchaseOrderPattern" yaml:"purchaseOrderPattern"`
+	// RequirePurchaseOrder makes every order on account name its purchase
+	// order, not only those of the credit lines requiring one
+	RequirePurchaseOrder bool `json:"requirePurchaseOrder" yaml:"requirePurchaseOrder"`
+}
+
+// CurrencyConfig controls the currencies of orders. An order is in the
+// currency it names, or else in that of the tenant it is created for.
+type CurrencyConfig struct {
+	// Default is the ISO 4217 currency of the orders of the tenants not in
+	// Tenants, the currency of payments when empty
+	Default string `json:"default" yaml:"default"`
+	// Tenants maps tenants to the currency of their orders
+	Tenants map[string]string `json:"tenants,omitempty" yaml:"tenants"`
+	// Base is the currency the statistics report revenue in, converting the
+	// totals of the other currencies. Unset, the totals of all currencies add up.
+	Base string `json:"base" yaml:"base"`
+	// Rates maps currencies to the units of Base one unit of them is worth,
+	// unless the service is given a converter of its own
+	Rates map[string]float64 `json:"rates,omitempty" yaml:"rates"`
+}
+
+// StripeConfig holds the credentials of the stripe payment provider
+type StripeConfig struct {
+	// Endpoint overrides the stripe api url, e.g. for stripe-mock
+	Endpoint  string `json:"endpoint" yaml:"endpoint"`
+	SecretKey string `json:"secretKey" yaml:"secretKey"`
+	// WebhookSecret verifies the signature of stripe webhook notifications
+	WebhookSecret string   `json:"webhookSecret" yaml:"webhookSecret"`
+	Timeout       Duration `json:"timeout" yaml:"timeout"`
+	// Retry calls the api again after transient failures, with the same
+	// idempotency key
+	Retry RetryConfig `json:"retry" yaml:"retry"`
+}
+
+// inventory clients
+const (
+	InventoryClientHTTP = "http"
+	InventoryClientStub = "stub"
+)
+
+// InventoryConfig controls the reservation of the stock of orders when they are
+// created, which is released again when they are cancelled
+type InventoryConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Client is http, calling the inventory service at Endpoint, or stub
+	Client   string   `json:"client" yaml:"client"`
+	Endpoint string   `json:"endpoint" yaml:"endpoint"`
+	Timeout  Duration `json:"timeout" yaml:"timeout"`
+}
+
+// actions on the orders suspected to be duplicates
+const (
+	DuplicateActionFlag  = "flag"
+	DuplicateActionBlock = "block"
+)
+
+// DuplicatesConfig controls the detection of new orders repeating a recent
+// order of their customer, such as one submitted twice, which the clients can
+// override for a legitimate repeat
+type DuplicatesConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Window is the time within which an order of the same customer with the
+	// same items and total is suspected to be repeated
+	Window Duration `json:"window" yaml:"window"`
+	// Action is flag, creating the order marked as a suspected duplicate, or
+	// block, refusing it
+	Action string `json:"action" yaml:"action"`
+}
+
+// ExperimentsConfig controls the A/B experiments the callers are assigned
+// to, by the hash of their customer
+type ExperimentsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Header is the request header naming the customer the caller acts for
+	Header string `json:"header" yaml:"header"`
+	// Experiments are the weights of the variants of each experiment by the
+	// names of the experiment and of the variant
+	Experiments map[string]map[string]int `json:"experiments" yaml:"experiments"`
+}
+
+// fraud screening modes
+const (
+	FraudModeSync  = "sync"
+	FraudModeAsync = "async"
+)
+
+// FraudConfig controls the screening of new orders for fraud. The orders the
+// screening doubts are held for review, those it rejects are refused.
+type FraudConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Mode is sync, screening an order before it is created, or async, creating
+	// it held and releasing it once it is screened
+	Mode    string   `json:"mode" yaml:"mode"`
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+	// FailOpen approves the orders whose screening failed or timed out, which
+	// are held for review otherwise
+	FailOpen bool             `json:"failOpen" yaml:"failOpen"`
+	Rules    FraudRulesConfig `json:"rules" yaml:"rules"`
+}
+
+// FraudRulesConfig are the thresholds of the default screening, 0 disables a rule
+type FraudRulesConfig struct {
+	// ReviewAmount and RejectAmount are the totals from which orders are held
+	// or rejected
+	ReviewAmount float64 `json:"reviewAmount" yaml:"reviewAmount"`
+	RejectAmount float64 `json:"rejectAmount" yaml:"rejectAmount"`
+	// VelocityLimit holds the orders of customers who placed as many orders
+	// within VelocityWindow before
+	VelocityLimit  int      `json:"velocityLimit" yaml:"velocityLimit"`
+	VelocityWindow Duration `json:"velocityWindow" yaml:"velocityWindow"`
+	// AddressMismatch holds the orders shipping to a country none of the
+	// addresses of their customer is in
+	AddressMismatch bool `json:"addressMismatch" yaml:"addressMismatch"`
+}
+
+// PricingConfig sets the shipping, discounts and flat tax rate orders are priced with
+type PricingConfig struct {
+	// TaxRate is the fraction of the discounted subtotal and shipping charged as tax, e.g. 0.08
+	TaxRate  float64 `json:"taxRate" yaml:"taxRate"`
+	Shipping float64 `json:"shipping" yaml:"shipping"`
+	// FreeShippingOver waives shipping from this discounted subtotal on, 0 never waives it
+	FreeShippingOver float64 `json:"freeShippingOver" yaml:"freeShippingOver"`
+	// Discounts are the discount codes orders may name
+	Discounts map[string]DiscountConfig `json:"discounts" yaml:"discounts"`
+}
+
+// DiscountConfig is a discount code, taking Rate of the subtotal and then Amount off
+type DiscountConfig struct {
+	Rate   float64 `json:"rate" yaml:"rate"`
+	Amount float64 `json:"amount" yaml:"amount"`
+	// MinSubtotal is the subtotal an order needs for the code to apply
+	MinSubtotal float64 `json:"minSubtotal" yaml:"minSubtotal"`
+}
+
+// ShippingConfig controls the tracking of the shipments of orders
+type ShippingConfig struct {
+	// PollInterval is the period of polling the carriers for the tracking of
+	// shipments that are not delivered, 0 only takes tracking from webhooks
+	PollInterval Duration `json:"pollInterval" yaml:"pollInterval"`
+	// Carriers are the carriers whose tracking is read, by carrier name
+	Carriers map[string]CarrierConfig `json:"carriers" yaml:"carriers"`
+}
+
+// CarrierConfig is the tracking api of a carrier
+type CarrierConfig struct {
+	// Endpoint serves the tracking of a shipment at {endpoint}/{trackingNumber}
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	// WebhookSecret verifies the signature of tracking notifications, it is
+	// required
+	WebhookSecret string `json:"webhookSecret" yaml:"webhookSecret"`
+	// Timeout bounds one tracking call, 0 means 10s
+	Timeout Duration `json:"timeout" yaml:"timeout"`
+}
+
+// RoutingConfig controls the warehouses and the routing of the items of
+// confirmed orders to them
+type RoutingConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Strategy is nearest, stock or cost
+	Strategy string `json:"strategy" yaml:"strategy"`
+	// Priorities maps the priorities of orders to the strategy routing their
+	// orders, those of the other priorities are routed with Strategy
+	Priorities map[string]string `json:"priorities,omitempty" yaml:"priorities"`
+}
+
+// the priorities of orders
+const (
+	PriorityStandard  = "standard"
+	PriorityExpedited = "expedited"
+	PriorityRush      = "rush"
+)
+
+// Priorities are the priorities of orders, the lowest first
+var Priorities = []string{PriorityStandard, PriorityExpedited, PriorityRush}
+
+// ValidPriority reports whether priority is one of Priorities
+func ValidPriority(priority string) bool {
+	for _, p := range Priorities {
+		if p == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// PriorityConfig controls the rules raising the priority of an order after it
+// was created
+type PriorityConfig struct {
+	// UpgradeWindow is the time after its creation within which the priority
+	// of an order can be raised, until it ships when 0
+	UpgradeWindow Duration `json:"upgradeWindow" yaml:"upgradeWindow"`
+	// RushCountries are the countries rush orders ship to, every country
+	// when empty
+	RushCountries []string `json:"rushCountries,omitempty" yaml:"rushCountries"`
+}
+
+// TrackingConfig controls the public tracking of orders, which customers look
+// up without logging in with a token signed by the service
+type TrackingConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Secret signs the tracking tokens, changing it invalidates the issued ones
+	Secret string `json:"secret" yaml:"secret"`
+	// TTL is the validity of a token from its issue
+	TTL Duration `json:"ttl" yaml:"ttl"`
+	// RateLimit limits the lookups of each client, on top of the rate limit of
+	// every route
+	RateLimit RateLimitConfig `json:"rateLimit" yaml:"rateLimit"`
+}
+
+// CursorsConfig controls the page tokens of the order listings, which are
+// sealed into cursors the clients can neither read nor change when enabled
+type CursorsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Secret encrypts and authenticates the cursors, the instances sharing it
+	// accept the cursors of each other. Changing it invalidates the issued ones.
+	Secret string `json:"secret" yaml:"secret"`
+	// TTL is the validity of a cursor from its issue
+	TTL Duration `json:"ttl" yaml:"ttl"`
+}
+
+// DocumentsConfig controls the invoices and packing slips rendered of orders
+type DocumentsConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Branding is the branding of the documents of the tenants without their own
+	Branding Branding `json:"branding" yaml:"branding"`
+	// Tenants maps tenants to their branding, its empty fields are those of
+	// Branding
+	Tenants map[string]Branding `json:"tenants,omitempty" yaml:"tenants"`
+	// Templates replaces the built-in templates by document, invoice or
+	// packingSlip
+	Templates map[string]DocumentTemplate `json:"templates,omitempty" yaml:"templates"`
+	// Storage keeps the rendered documents in S3
+	Storage DocumentStorageConfig `json:"storage" yaml:"storage"`
+}
+
+// Branding is the seller shown on the documents of a tenant
+type Branding struct {
+	Name string `json:"name" yaml:"name"`
+	// Address is the postal address of the seller, one line per line
+	Address string `json:"address" yaml:"address"`
+	Email   string `json:"email" yaml:"email"`
+	Website string `json:"website" yaml:"website"`
+	// TaxID is the VAT or tax number printed on invoices
+	TaxID string `json:"taxId" yaml:"taxId"`
+	// LogoURL is the image heading the html documents, the pdf documents have
+	// none
+	LogoURL string `json:"logoUrl" yaml:"logoUrl"`
+	// Color is the accent color of the documents, as #rrggbb
+	Color  string `json:"color" yaml:"color"`
+	Footer string `json:"footer" yaml:"footer"`
+}
+
+// DocumentTemplate is the layout of a document: HTML is an html/template
+// template of the html document and PDF a text/template template of the lines
+// of the pdf one. An empty template keeps the built-in one.
+type DocumentTemplate struct {
+	HTML string `json:"html" yaml:"html"`
+	PDF  string `json:"pdf" yaml:"pdf"`
+}
+
+// DocumentStorageConfig controls persisting the rendered documents to S3,
+// where each version of the document of an order is rendered once
+type DocumentStorageConfig struct {
+	Enabled bool   `json:"enabled" yaml:"enabled"`
+	Bucket  string `json:"bucket" yaml:"bucket"`
+	Prefix  string `json:"prefix" yaml:"prefix"`
+	// Endpoint overrides the s3 endpoint, e.g. for minio or localstack
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+}
+
+// validColor reports whether color is written #rrggbb
+func validColor(color string) bool {
+	if len(color) != 7 || color[0] != '#' {
+		return false
+	}
+	_, err := strconv.ParseUint(color[1:], 16, 32)
+	return err == nil
+}
+
+// SQSConfig controls the worker pool consuming order commands from an SQS queue
+type SQSConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Endpoint overrides the SQS endpoint, e.g. for localstack
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	QueueURL string `json:"queueUrl" yaml:"queueUrl"`
+	// DeadLetterQueueURL receives commands that cannot be processed, they are dropped if empty
+	DeadLetterQueueURL string `json:"deadLetterQueueUrl" yaml:"deadLetterQueueUrl"`
+	Concurrency        int    `json:"concurrency" yaml:"concurrency"`
+	// VisibilityTimeout is extended while a command is processed
+	VisibilityTimeout Duration `json:"visibilityTimeout" yaml:"visibilityTimeout"`
+	WaitTime          Duration `json:"waitTime" yaml:"waitTime"`
+	// MaxReceives is the number of failed attempts before a command is dead-lettered
+	MaxReceives int `json:"maxReceives" yaml:"maxReceives"`
+}
+
+// TimeoutConfig holds the server timeouts
+type TimeoutConfig struct {
+	// Startup is deprecated and ignored, the listeners are bound before the
+	// service starts. It is kept so that the configurations setting it load.
+	Startup Duration `json:"startup,omitempty" yaml:"startup,omitempty"`
+	Request Duration `json:"request" yaml:"request"`
+	// ReadHeader is the time a client has to send the headers of a request
+	ReadHeader Duration `json:"readHeader" yaml:"readHeader"`
+	// Read is the time a client has to send a whole request, 0 for no limit.
+	// It also ends the streaming and long polling requests that last longer.
+	Read Duration `json:"read" yaml:"read"`
+	// Idle is the time a kept alive connection waits for its next request
+	Idle Duration `json:"idle" yaml:"idle"`
+}
+
+// RateLimitConfig limits the request rate of each client
+type RateLimitConfig struct {
+	Enabled           bool    `json:"enabled" yaml:"enabled"`
+	RequestsPerSecond float64 `json:"requestsPerSecond" yaml:"requestsPerSecond"`
+	Burst             int     `json:"burst" yaml:"burst"`
+}
+
+// GatekeeperConfig controls which requests are admitted at all
+type GatekeeperConfig struct {
+	// ReadOnly rejects every request that may modify state
+	ReadOnly bool   `json:"readOnly" yaml:"readOnly"`
+	Message  string `json:"message" yaml:"message"`
+}
+
+// DeprecationsConfig controls the routes the service deprecates
+type DeprecationsConfig struct {
+	// EnforceSunset answers the requests of deprecated routes past their
+	// sunset with 410 Gone instead of serving them
+	EnforceSunset bool `json:"enforceSunset" yaml:"enforceSunset"`
+}
+
+// CanaryConfig sends a share of the requests of routes to the alternate
+// implementation of their handler
+type CanaryConfig struct {
+	// Header is the request header picking the implementation, true for the
+	// canary and false for the stable one, whatever the percentage
+	Header string `json:"header" yaml:"header"`
+	// Routes are the percentages of the requests sent to the canary by the
+	// name of their route
+	Routes map[string]float64 `json:"routes" yaml:"routes"`
+}
+
+// Default returns the built-in configuration
+func Default() *Config {
+	return &Config{
+		ListenAddress: "0.0.0.0:8080",
+		IPStack:       StackDual,
+		ProxyProtocol: ProxyConfig{
+			HeaderTimeout: Duration{5 * time.Second},
+		},
+		Admin: AdminConfig{
+			CSRF: CSRFConfig{
+				CookieName: "order_csrf",
+				HeaderName: "X-CSRF-Token",
+				SameSite:   SameSiteStrict,
+				TTL:        Duration{12 * time.Hour},
+			},
+		},
+		GRPC: GRPCConfig{
+			ListenAddress: "0.0.0.0:9090",
+		},
+		Storage: StorageConfig{
+			Backend:       BackendDynamoDB,
+			Mode:          StorageModeState,
+			SnapshotEvery: 20,
+		},
+		Db: DbConfig{
+			Endpoint:         "http://192.168.1.101:8000",
+			Region:           "us-west-2",
+			OrdersTable:      "orders",
+			MigrationsTable:  "order_migrations",
+			OutboxTable:      "order_outbox",
+			WebhooksTable:    "order_webhooks",
+			DeadLettersTable: "order_dead_letters",
+			ReturnsTable:     "order_returns",
+			CustomersTable:   "order_customers",
+			DraftsTable:      "order_drafts",
+			SchedulesTable:   "order_schedules",
+			JobsTable:        "order_jobs",
+			LeasesTable:      "order_leases",
+			MembersTable:     "order_members",
+			HostsTable:       "order_hosts",
+			QuotasTable:      "order_quotas",
+			SagasTable:       "order_sagas",
+			StreamsTable:     "order_streams",
+			StatsTable:       "order_stats",
+			WarehousesTable:  "order_warehouses",
+			Retry: RetryConfig{
+				MaxAttempts:    3,
+				InitialBackoff: Duration{50 * time.Millisecond},
+				MaxBackoff:     Duration{20 * time.Second},
+			},
+		},
+		Cache: CacheConfig{
+			RedisAddress: "localhost:6379",
+			TTL:          Duration{time.Minute},
+		},
+		Hedging: HedgingConfig{
+			Percentile: 0.95,
+			MinDelay:   Duration{5 * time.Millisecond},
+			MaxDelay:   Duration{100 * time.Millisecond},
+		},
+		SlowRequests: SlowConfig{
+			Threshold: Duration{time.Second},
+			// the long polls and streamed exports take as long as they need
+			Routes:         map[string]Duration{"WatchOrder": {}, "ExportOrders": {}},
+			QueryThreshold: Duration{200 * time.Millisecond},
+			Size:           100,
+		},
+		// the on-demand prices in dollars of us-east-1
+		Capacity: CapacityConfig{
+			ReadUnitPrice:  0.125,
+			WriteUnitPrice: 0.625,
+		},
+		Capture: CaptureConfig{
+			Dir:          "captures",
+			SampleRate:   1,
+			MaxBodyBytes: 64 << 10,
+			RedactFields: []string{"email", "phone", "line1", "line2", "paymentMethod", "token", "secret", "password"},
+		},
+		Coalescing: CoalescingConfig{
+			MaxBodyBytes: 1 << 20,
+		},
+		Mirror: MirrorConfig{
+			SampleRate:   0.01,
+			MaxBodyBytes: 64 << 10,
+			RedactFields: []string{"email", "phone", "name", "line1", "line2", "paymentMethod", "token", "secret", "password"},
+			Timeout:      Duration{5 * time.Second},
+			Concurrency:  16,
+		},
+		DbStatus: DbStatusConfig{
+			TTL:        Duration{5 * time.Second},
+			Timeout:    Duration{time.Second},
+			MaxLatency: Duration{500 * time.Millisecond},
+		},
+		Outbound: OutboundConfig{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 16,
+			MaxConnsPerHost:     64,
+			IdleConnTimeout:     Duration{90 * time.Second},
+			DialTimeout:         Duration{5 * time.Second},
+			TLSHandshakeTimeout: Duration{5 * time.Second},
+		},
+		Outbox: OutboxConfig{
+			PollInterval: Duration{time.Second},
+			MaxBackoff:   Duration{time.Minute},
+			BatchSize:    100,
+		},
+		Webhooks: WebhookConfig{
+			Timeout:        Duration{10 * time.Second},
+			MaxAttempts:    8,
+			InitialBackoff: Duration{10 * time.Second},
+			MaxBackoff:     Duration{time.Hour},
+			PollInterval:   Duration{time.Second},
+			Concurrency:    4,
+			Retry: RetryConfig{
+				MaxAttempts:    2,
+				InitialBackoff: Duration{200 * time.Millisecond},
+				MaxBackoff:     Duration{time.Second},
+			},
+		},
+		Kafka: KafkaConfig{
+			Brokers:      []string{"localhost:9092"},
+			Topic:        "order-events",
+			Encoding:     EncodingJSON,
+			WriteTimeout: Duration{10 * time.Second},
+		},
+		DeadLetters: DeadLetterConfig{
+			MaxAttempts: 10,
+		},
+		Notifications: NotificationsConfig{
+			Email: EmailConfig{
+				SMTP: SMTPConfig{Port: 587},
+			},
+			Templates:   map[string]NotificationTemplate{},
+			Timeout:     Duration{10 * time.Second},
+			Concurrency: 4,
+			Retry: RetryConfig{
+				MaxAttempts:    5,
+				InitialBackoff: Duration{time.Second},
+				MaxBackoff:     Duration{time.Minute},
+			},
+		},
+		Commands: SQSConfig{
+			Concurrency:       4,
+			VisibilityTimeout: Duration{30 * time.Second},
+			WaitTime:          Duration{20 * time.Second},
+			MaxReceives:       5,
+		},
+		Quotas: QuotasConfig{
+			KeyBy:     QuotaKeyAPIKey,
+			Consumers: map[string]QuotaLimits{},
+		},
+		Hosts: HostsConfig{
+			HeartbeatTTL: Duration{2 * time.Minute},
+			CacheTTL:     Duration{10 * time.Second},
+		},
+		Agents: AgentsConfig{
+			MaxSkew: Duration{5 * time.Minute},
+		},
+		Drafts: DraftsConfig{
+			TTL: Duration{7 * 24 * time.Hour},
+		},
+		Schedules: SchedulesConfig{
+			PollInterval: Duration{time.Minute},
+		},
+		Imports: ImportsConfig{
+			MaxUploadSize: 100 << 20,
+		},
+		Encryption: EncryptionConfig{
+			DataKeyReuse:     Duration{5 * time.Minute},
+			DataKeyCacheSize: 1000,
+		},
+		Jobs: JobsConfig{
+			Workers:      4,
+			PollInterval: Duration{5 * time.Second},
+			Heartbeat:    Duration{10 * time.Second},
+			Lease:        Duration{time.Minute},
+			Prefix:       "exports/",
+		},
+		Cron: CronConfig{
+			Jitter:  Duration{10 * time.Second},
+			LockTTL: Duration{time.Minute},
+		},
+		SLA: SLAConfig{
+			Interval: Duration{5 * time.Minute},
+			Limits:   map[string]Duration{},
+		},
+		Sagas: SagaConfig{
+			StaleAfter: Duration{2 * time.Minute},
+			Interval:   Duration{time.Minute},
+		},
+		I18n: I18nConfig{
+			DefaultLocale: "en",
+		},
+		Stats: StatsConfig{
+			MaxDays: 366,
+		},
+		MetricsExport: MetricsExportConfig{
+			Interval:  Duration{time.Minute},
+			Namespace: "OrderService",
+			Include:   []string{"order_"},
+		},
+		Cluster: ClusterConfig{
+			LeaseDuration: Duration{15 * time.Second},
+			RenewInterval: Duration{5 * time.Second},
+			Forward:       ForwardRedirect,
+			OrderLockTTL:  Duration{30 * time.Second},
+			OrderLockWait: Duration{5 * time.Second},
+		},
+		Retention: RetentionConfig{
+			Deleted:      Duration{30 * 24 * time.Hour},
+			Interval:     Duration{time.Hour},
+			OrdersAction: RetentionAnonymize,
+			Archive: ArchiveConfig{
+				After:     Duration{90 * 24 * time.Hour},
+				Prefix:    "orders/",
+				BatchSize: 500,
+			},
+		},
+		Payments: PaymentsConfig{
+			Provider: PaymentProviderMock,
+			Currency: "usd",
+			Stripe: StripeConfig{
+				Timeout: Duration{30 * time.Second},
+				Retry: RetryConfig{
+					MaxAttempts:    3,
+					InitialBackoff: Duration{200 * time.Millisecond},
+					MaxBackoff:     Duration{2 * time.Second},
+				},
+			},
+			GiftCards: GiftCardsConfig{
+				Client:  GiftCardClientStub,
+				Timeout: Duration{5 * time.Second},
+			},
+			Credit: CreditConfig{
+				Client:               CreditClientStub,
+				Timeout:              Duration{5 * time.Second},
+				TermsDays:            30,
+				PurchaseOrderPattern: `^[A-Za-z0-9][A-Za-z0-9./_-]{0,34}$`,
+			},
+		},
+		Inventory: InventoryConfig{
+			Client:  InventoryClientStub,
+			Timeout: Duration{5 * time.Second},
+		},
+		Routing: RoutingConfig{
+			Strategy:   routing.StrategyNearest,
+			Priorities: map[string]string{PriorityRush: routing.StrategyNearest},
+		},
+		Tracking: TrackingConfig{
+			TTL: Duration{90 * 24 * time.Hour},
+			RateLimit: RateLimitConfig{
+				Enabled:           true,
+				RequestsPerSecond: 0.2,
+				Burst:             5,
+			},
+		},
+		Cursors: CursorsConfig{
+			TTL: Duration{24 * time.Hour},
+		},
+		Documents: DocumentsConfig{
+			Branding: Branding{Color: "#333333"},
+			Tenants:  map[string]Branding{},
+			Storage: DocumentStorageConfig{
+				Prefix: "documents/",
+			},
+		},
+		Duplicates: DuplicatesConfig{
+			Window: Duration{10 * time.Minute},
+			Action: DuplicateActionFlag,
+		},
+		Experiments: ExperimentsConfig{
+			Header:      "X-Customer-Id",
+			Experiments: map[string]map[string]int{},
+		},
+		Fraud: FraudConfig{
+			Mode:    FraudModeSync,
+			Timeout: Duration{2 * time.Second},
+			Rules: FraudRulesConfig{
+				ReviewAmount:    1000,
+				VelocityLimit:   5,
+				VelocityWindow:  Duration{time.Hour},
+				AddressMismatch: true,
+			},
+		},
+		LogLevel:  logging.InfoLevel.String(),
+		LogFormat: logging.FormatJSON,
+		Timeouts: TimeoutConfig{
+			Request:    Duration{30 * time.Second},
+			ReadHeader: Duration{10 * time.Second},
+			Idle:       Duration{2 * time.Minute},
+		},
+		RateLimit: RateLimitConfig{
+			RequestsPerSecond: 50,
+			Burst:             100,
+		},
+		Canary: CanaryConfig{
+			Header: "X-Canary",
+			Routes: map[string]float64{},
+		},
+		Features:  map[string]bool{},
+		LogLevels: map[string]string{},
+	}
+}
+
+// Load returns the configuration built from the defaults, the config file,
+// the environment and the command line args (without the program name)
+func Load(args []string) (*Config, error) {
+	cfg := Default()
+
+	fs, configFile, flags := cfg.flagSet(filepath.Base(os.Args[0]))
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv(EnvConfigFile)
+	}
+	if path != "" {
+		if err := cfg.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyFlags(fs, flags); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadFile merges the YAML or JSON file at path into c
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	default:
+		return fmt.Errorf("unsupported config file type %q", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	for _, b := range c.bindings() {
+		value, ok := os.LookupEnv(b.env())
+		if !ok {
+			continue
+		}
+		if err := b.set(value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", b.env(), err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the configuration is complete and consistent
+func (c *Config) Validate() error {
+	var errs []string
+
+	switch c.IPStack {
+	case StackDual, StackIPv4, StackIPv6:
+		if _, _, err := c.Listen(c.ListenAddress); err != nil {
+			errs = append(errs, fmt.Sprintf("listen address %q: %v", c.ListenAddress, err))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown ip stack %q", c.IPStack))
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, "tls cert file and key file must be set together")
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.CAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Sprintf("tls file: %v", err))
+		}
+	}
+	if c.GRPC.Enabled && !c.GRPC.Multiplex {
+		if _, _, err := c.Listen(c.GRPC.ListenAddress); err != nil {
+			errs = append(errs, fmt.Sprintf("grpc listen address %q: %v", c.GRPC.ListenAddress, err))
+		}
+	}
+	if c.Admin.ListenAddress != "" {
+		if _, _, err := c.Listen(c.Admin.ListenAddress); err != nil {
+			errs = append(errs, fmt.Sprintf("admin listen address %q: %v", c.Admin.ListenAddress, err))
+		}
+		if sameListenAddress(c.Admin.ListenAddress, c.ListenAddress) {
+			errs = append(errs, "admin listen address must differ from the listen address")
+		}
+	}
+	if c.Admin.Debug && c.Admin.ListenAddress == "" && c.Admin.Token == "" {
+		errs = append(errs, "admin debug needs an admin listen address or token")
+	}
+	if csrf := c.Admin.CSRF; csrf.Enabled {
+		if csrf.CookieName == "" || csrf.HeaderName == "" {
+			errs = append(errs, "admin csrf cookie and header names are required")
+		}
+		switch csrf.SameSite {
+		case SameSiteStrict, SameSiteLax:
+		case SameSiteNone:
+			if !csrf.Secure {
+				errs = append(errs, "admin csrf cookie with SameSite none must be secure")
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("unknown admin csrf SameSite mode %q", csrf.SameSite))
+		}
+		if csrf.TTL.Duration <= 0 {
+			errs = append(errs, "admin csrf ttl must be positive")
+		}
+	}
+	if c.GRPC.Enabled && c.GRPC.Multiplex && c.TLS.Enabled() {
+		errs = append(errs, "grpc multiplexing is not supported with tls")
+	}
+	if c.ProxyProtocol.Enabled {
+		if len(c.ProxyProtocol.Trusted) == 0 {
+			errs = append(errs, "proxy protocol trusted must list the load balancers")
+		} else if _, err := c.ProxyProtocol.TrustedNetworks(); err != nil {
+			errs = append(errs, fmt.Sprintf("proxy protocol trusted: %v", err))
+		}
+		if c.ProxyProtocol.HeaderTimeout.Duration < 0 {
+			errs = append(errs, "proxy protocol header timeout must not be negative")
+		}
+		if c.GRPC.Enabled && c.GRPC.Multiplex {
+			errs = append(errs, "grpc multiplexing is not supported with the proxy protocol")
+		}
+	}
+	if c.ACL.Enabled {
+		if _, _, err := c.ACL.Networks(); err != nil {
+			errs = append(errs, fmt.Sprintf("acl %v", err))
+		}
+		for group, rule := range c.ACL.Groups {
+			if _, _, err := rule.Networks(); err != nil {
+				errs = append(errs, fmt.Sprintf("acl of group %s %v", group, err))
+			}
+		}
+	}
+	if c.Forwarded.Enabled {
+		if len(c.Forwarded.Trusted) == 0 {
+			errs = append(errs, "forwarded headers need trusted proxies")
+		} else if _, err := c.Forwarded.TrustedNetworks(); err != nil {
+			errs = append(errs, fmt.Sprintf("forwarded trusted: %v", err))
+		}
+	}
+	switch c.Storage.Backend {
+	case BackendDynamoDB:
+	case BackendPostgres, BackendSQLite:
+		if c.Storage.DSN == "" {
+			errs = append(errs, fmt.Sprintf("storage dsn is required for the %s backend", c.Storage.Backend))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown storage backend %q", c.Storage.Backend))
+	}
+	switch c.Storage.Mode {
+	case StorageModeState:
+	case StorageModeEvents:
+		if c.Storage.Backend != BackendDynamoDB {
+			errs = append(errs, fmt.Sprintf("storage mode %s is not supported by the %s backend", c.Storage.Mode, c.Storage.Backend))
+		}
+		if c.Storage.SnapshotEvery <= 0 {
+			errs = append(errs, "storage snapshot every must be positive")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown storage mode %q", c.Storage.Mode))
+	}
+	if c.Db.Region == "" {
+		errs = append(errs, "db region is required")
+	}
+	if c.Db.OrdersTable == "" {
+		errs = append(errs, "db orders table is required")
+	}
+	if c.Db.MigrationsTable == "" {
+		errs = append(errs, "db migrations table is required")
+	}
+	if c.Db.OutboxTable == "" {
+		errs = append(errs, "db outbox table is required")
+	}
+	if c.Db.DeadLettersTable == "" {
+		errs = append(errs, "db dead letters table is required")
+	}
+	if c.Db.WebhooksTable == "" {
+		errs = append(errs, "db webhooks table is required")
+	}
+	if c.Db.ReturnsTable == "" {
+		errs = append(errs, "db returns table is required")
+	}
+	if c.Db.CustomersTable == "" {
+		errs = append(errs, "db customers table is required")
+	}
+	if c.Db.DraftsTable == "" {
+		errs = append(errs, "db drafts table is required")
+	}
+	if c.Db.SchedulesTable == "" {
+		errs = append(errs, "db schedules table is required")
+	}
+	if c.Db.JobsTable == "" {
+		errs = append(errs, "db jobs table is required")
+	}
+	if c.Db.LeasesTable == "" {
+		errs = append(errs, "db leases table is required")
+	}
+	if c.Db.MembersTable == "" {
+		errs = append(errs, "db members table is required")
+	}
+	if c.Db.HostsTable == "" {
+		errs = append(errs, "db hosts table is required")
+	}
+	if c.Db.QuotasTable == "" {
+		errs = append(errs, "db quotas table is required")
+	}
+	if c.Db.SagasTable == "" {
+		errs = append(errs, "db sagas table is required")
+	}
+	if c.Db.StreamsTable == "" {
+		errs = append(errs, "db streams table is required")
+	}
+	if c.Db.StatsTable == "" {
+		errs = append(errs, "db stats table is required")
+	}
+	if c.Db.WarehousesTable == "" {
+		errs = append(errs, "db warehouses table is required")
+	}
+	errs = append(errs, c.Db.Retry.validate("db")...)
+	if (c.Db.AccessKeyID == "") != (c.Db.SecretAccessKey == "") {
+		errs = append(errs, "db access key id and secret access key must be set together")
+	}
+	if c.Cache.Enabled && c.Cache.RedisAddress == "" {
+		errs = append(errs, "cache redis address is required")
+	}
+	if c.Cache.Enabled && c.Cache.TTL.Duration <= 0 {
+		errs = append(errs, "cache ttl must be positive")
+	}
+	if c.SlowRequests.Enabled {
+		if c.SlowRequests.Threshold.Duration <= 0 || c.SlowRequests.Size <= 0 {
+			errs = append(errs, "slow requests threshold and size must be positive")
+		}
+		if c.SlowRequests.QueryThreshold.Duration < 0 {
+			errs = append(errs, "slow requests query threshold must not be negative")
+		}
+		for route, threshold := range c.SlowRequests.Routes {
+			if threshold.Duration < 0 {
+				errs = append(errs, fmt.Sprintf("slow requests threshold of route %q must not be negative", route))
+			}
+		}
+	}
+	if c.Capacity.Enabled && (c.Capacity.ReadUnitPrice < 0 || c.Capacity.WriteUnitPrice < 0) {
+		errs = append(errs, "capacity unit prices must not be negative")
+	}
+	if c.Capture.Enabled {
+		if c.Capture.Dir == "" {
+			errs = append(errs, "capture dir is required")
+		}
+		if c.Capture.SampleRate <= 0 || c.Capture.SampleRate > 1 {
+			errs = append(errs, "capture sample rate must be above 0 and at most 1")
+		}
+		if c.Capture.MaxBodyBytes <= 0 {
+			errs = append(errs, "capture max body bytes must be positive")
+		}
+	}
+	if c.Coalescing.Enabled && c.Coalescing.MaxBodyBytes <= 0 {
+		errs = append(errs, "coalescing max body bytes must be positive")
+	}
+	if c.Mirror.Enabled {
+		if u, err := url.Parse(c.Mirror.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, "mirror endpoint must be an http or https url")
+		}
+		if c.Mirror.SampleRate <= 0 || c.Mirror.SampleRate > 1 {
+			errs = append(errs, "mirror sample rate must be above 0 and at most 1")
+		}
+		if c.Mirror.MaxBodyBytes <= 0 || c.Mirror.Timeout.Duration <= 0 || c.Mirror.Concurrency <= 0 {
+			errs = append(errs, "mirror max body bytes, timeout and concurrency must be positive")
+		}
+	}
+	if c.DbStatus.Enabled {
+		if c.DbStatus.TTL.Duration <= 0 || c.DbStatus.Timeout.Duration <= 0 {
+			errs = append(errs, "db status ttl and timeout must be positive")
+		}
+		if c.DbStatus.MaxLatency.Duration < 0 {
+			errs = append(errs, "db status max latency must not be negative")
+		}
+	}
+	if len(c.Hedging.Routes) > 0 {
+		if c.Hedging.Percentile <= 0 || c.Hedging.Percentile >= 1 {
+			errs = append(errs, "hedging percentile must be between 0 and 1")
+		}
+		if c.Hedging.MinDelay.Duration <= 0 || c.Hedging.MaxDelay.Duration < c.Hedging.MinDelay.Duration {
+			errs = append(errs, "hedging min delay must be positive and not above the max delay")
+		}
+	}
+	if c.Outbound.MaxIdleConns < 0 || c.Outbound.MaxIdleConnsPerHost < 0 || c.Outbound.MaxConnsPerHost < 0 {
+		errs = append(errs, "outbound connection limits must not be negative")
+	}
+	if c.Outbound.DialTimeout.Duration <= 0 || c.Outbound.TLSHandshakeTimeout.Duration <= 0 {
+		errs = append(errs, "outbound dial and tls handshake timeouts must be positive")
+	}
+	if c.Outbound.ProxyURL != "" {
+		if u, err := url.Parse(c.Outbound.ProxyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("outbound proxy url %q must be an absolute url", redactURL(c.Outbound.ProxyURL)))
+		}
+	}
+	if c.Outbox.Enabled && (c.Outbox.PollInterval.Duration <= 0 || c.Outbox.MaxBackoff.Duration <= 0) {
+		errs = append(errs, "outbox poll interval and max backoff must be positive")
+	}
+	if c.Outbox.Enabled && c.Outbox.BatchSize <= 0 {
+		errs = append(errs, "outbox batch size must be positive")
+	}
+	if c.Webhooks.Enabled {
+		if c.Webhooks.Timeout.Duration <= 0 || c.Webhooks.PollInterval.Duration <= 0 {
+			errs = append(errs, "webhook timeout and poll interval must be positive")
+		}
+		if c.Webhooks.InitialBackoff.Duration <= 0 || c.Webhooks.MaxBackoff.Duration < c.Webhooks.InitialBackoff.Duration {
+			errs = append(errs, "webhook initial backoff must be positive and not above the max backoff")
+		}
+		if c.Webhooks.MaxAttempts <= 0 || c.Webhooks.Concurrency <= 0 {
+			errs = append(errs, "webhook max attempts and concurrency must be positive")
+		}
+		errs = append(errs, c.Webhooks.Retry.validate("webhook")...)
+	}
+	if c.DeadLetters.Enabled && c.DeadLetters.MaxAttempts <= 0 {
+		errs = append(errs, "dead letters max attempts must be positive")
+	}
+	if c.Kafka.Enabled {
+		if len(c.Kafka.Brokers) == 0 || c.Kafka.Topic == "" {
+			errs = append(errs, "kafka brokers and topic are required")
+		}
+		if c.Kafka.Encoding != EncodingJSON && c.Kafka.Encoding != EncodingAvro {
+			errs = append(errs, fmt.Sprintf("unknown kafka encoding %q", c.Kafka.Encoding))
+		}
+		if c.Kafka.WriteTimeout.Duration <= 0 {
+			errs = append(errs, "kafka write timeout must be positive")
+		}
+	}
+	if c.Notifications.Enabled {
+		errs = append(errs, c.Notifications.validate()...)
+	}
+	if c.Commands.Enabled {
+		if c.Commands.QueueURL == "" {
+			errs = append(errs, "commands queue url is required")
+		}
+		if c.Commands.Concurrency <= 0 || c.Commands.MaxReceives <= 0 {
+			errs = append(errs, "commands concurrency and max receives must be positive")
+		}
+		if c.Commands.VisibilityTimeout.Duration < 2*time.Second {
+			errs = append(errs, "commands visibility timeout must be at least 2s")
+		}
+		if c.Commands.WaitTime.Duration < 0 || c.Commands.WaitTime.Duration > 20*time.Second {
+			errs = append(errs, "commands wait time must be between 0 and 20s")
+		}
+	}
+	if c.Payments.Enabled {
+		switch c.Payments.Provider {
+		case PaymentProviderStripe:
+			if c.Payments.Stripe.SecretKey == "" || c.Payments.Stripe.WebhookSecret == "" {
+				errs = append(errs, "stripe secret key and webhook secret are required")
+			}
+			if c.Payments.Stripe.Timeout.Duration <= 0 {
+				errs = append(errs, "stripe timeout must be positive")
+			}
+			errs = append(errs, c.Payments.Stripe.Retry.validate("stripe")...)
+		case PaymentProviderMock:
+		default:
+			errs = append(errs, fmt.Sprintf("unknown payment provider %q", c.Payments.Provider))
+		}
+		if c.Payments.Currency == "" {
+			errs = append(errs, "payments currency is required")
+		}
+		if c.Payments.GiftCards.Enabled {
+			switch c.Payments.GiftCards.Client {
+			case GiftCardClientHTTP:
+				if c.Payments.GiftCards.Endpoint == "" {
+					errs = append(errs, "gift cards endpoint is required")
+				}
+				if c.Payments.GiftCards.Timeout.Duration <= 0 {
+					errs = append(errs, "gift cards timeout must be positive")
+				}
+			case GiftCardClientStub:
+			default:
+				errs = append(errs, fmt.Sprintf("unknown gift card client %q", c.Payments.GiftCards.Client))
+			}
+		}
+		if c.Payments.Credit.Enabled {
+			switch c.Payments.Credit.Client {
+			case CreditClientHTTP:
+				if c.Payments.Credit.Endpoint == "" {
+					errs = append(errs, "credit endpoint is required")
+				}
+				if c.Payments.Credit.Timeout.Duration <= 0 {
+					errs = append(errs, "credit timeout must be positive")
+				}
+			case CreditClientStub:
+			default:
+				errs = append(errs, fmt.Sprintf("unknown credit client %q", c.Payments.Credit.Client))
+			}
+			if c.Payments.Credit.TermsDays < 1 || c.Payments.Credit.TermsDays > 365 {
+				errs = append(errs, "credit terms must be between 1 and 365 days")
+			}
+			if _, err := regexp.Compile(c.Payments.Credit.PurchaseOrderPattern); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid purchase order pattern: %v", err))
+			}
+		}
+	}
+	if currency := c.OrderCurrency(""); !money.ValidCurrency(currency) {
+		errs = append(errs, fmt.Sprintf("default currency %q is not an upper case ISO 4217 code", currency))
+	}
+	for tenant, currency := range c.Currency.Tenants {
+		if !money.ValidCurrency(currency) {
+			errs = append(errs, fmt.Sprintf("currency %q of tenant %q is not an upper case ISO 4217 code", currency, tenant))
+		}
+	}
+	if c.Currency.Base != "" && !money.ValidCurrency(c.Currency.Base) {
+		errs = append(errs, fmt.Sprintf("base currency %q is not an upper case ISO 4217 code", c.Currency.Base))
+	}
+	for currency, rate := range c.Currency.Rates {
+		if !money.ValidCurrency(currency) || rate <= 0 {
+			errs = append(errs, fmt.Sprintf("currency rate of %q needs an upper case ISO 4217 code and a positive rate", currency))
+		}
+	}
+	if len(c.Currency.Rates) > 0 && c.Currency.Base == "" {
+		errs = append(errs, "currency rates need a base currency")
+	}
+	if c.Pricing.TaxRate < 0 || c.Pricing.TaxRate >= 1 {
+		errs = append(errs, "pricing tax rate must be between 0 and 1")
+	}
+	if c.Pricing.Shipping < 0 || c.Pricing.FreeShippingOver < 0 {
+		errs = append(errs, "pricing shipping must not be negative")
+	}
+	for code, d := range c.Pricing.Discounts {
+		if d.Rate < 0 || d.Rate > 1 || d.Amount < 0 || d.MinSubtotal < 0 {
+			errs = append(errs, fmt.Sprintf("discount %q needs a rate between 0 and 1 and amounts that are not negative", code))
+		}
+	}
+	if c.Hosts.Require && !c.Hosts.Enabled {
+		errs = append(errs, "hosts require needs hosts enabled")
+	}
+	if c.Hosts.Enabled && c.Hosts.HeartbeatTTL.Duration <= 0 {
+		errs = append(errs, "hosts heartbeat ttl must be positive")
+	}
+	if c.Hosts.CacheTTL.Duration < 0 {
+		errs = append(errs, "hosts cache ttl must not be negative")
+	}
+	if c.Agents.Enabled && !c.Hosts.Enabled {
+		errs = append(errs, "agents need hosts enabled")
+	}
+	if c.Agents.Enabled && c.Agents.MaxSkew.Duration <= 0 {
+		errs = append(errs, "agents max skew must be positive")
+	}
+	seenKeys := map[string]string{}
+	for tenant, keys := range c.Tenants.Keys {
+		for _, key := range keys {
+			switch other, ok := seenKeys[key]; {
+			case len(key) < minTenantKeyLength:
+				errs = append(errs, fmt.Sprintf("api keys of tenant %q must have at least %d characters", tenant, minTenantKeyLength))
+			case ok && other != tenant:
+				errs = append(errs, fmt.Sprintf("tenants %q and %q share an api key", other, tenant))
+			}
+			seenKeys[key] = tenant
+		}
+	}
+	if c.Quotas.KeyBy != QuotaKeyAPIKey && c.Quotas.KeyBy != QuotaKeyTenant {
+		errs = append(errs, fmt.Sprintf("unknown quotas key %q", c.Quotas.KeyBy))
+	}
+	if c.Quotas.Default.Daily < 0 || c.Quotas.Default.Monthly < 0 {
+		errs = append(errs, "default quotas must not be negative")
+	}
+	for consumer, limits := range c.Quotas.Consumers {
+		if limits.Daily < 0 || limits.Monthly < 0 {
+			errs = append(errs, fmt.Sprintf("quotas of consumer %q must not be negative", consumer))
+		}
+	}
+	if c.Drafts.Enabled && c.Drafts.TTL.Duration <= 0 {
+		errs = append(errs, "drafts ttl must be positive")
+	}
+	if c.Schedules.Enabled && c.Schedules.PollInterval.Duration <= 0 {
+		errs = append(errs, "schedules poll interval must be positive")
+	}
+	if c.Imports.Enabled && c.Imports.MaxUploadSize <= 0 {
+		errs = append(errs, "imports max upload size must be positive")
+	}
+	if c.Encryption.Enabled {
+		if c.Encryption.KeyID == "" {
+			errs = append(errs, "encryption needs a kms key id")
+		}
+		if c.Encryption.DataKeyReuse.Duration < 0 || c.Encryption.DataKeyCacheSize <= 0 {
+			errs = append(errs, "encryption data key reuse must not be negative and its cache size must be positive")
+		}
+	}
+	if c.Redaction.Enabled {
+		hashed := false
+		for field, policy := range c.Redaction.Fields {
+			switch policy {
+			case RedactMask, RedactDrop:
+			case RedactHash:
+				hashed = true
+			default:
+				errs = append(errs, fmt.Sprintf("unknown redaction policy %q of field %q, one of mask, hash or drop", policy, field))
+			}
+		}
+		if hashed && c.Redaction.HashKey == "" {
+			errs = append(errs, "redaction hash policy needs a hash key")
+		}
+	}
+	if c.I18n.Enabled && c.I18n.DefaultLocale == "" {
+		errs = append(errs, "i18n default locale must be set")
+	}
+	if c.Imports.Enabled && !c.Jobs.Enabled {
+		errs = append(errs, "imports need jobs to be enabled")
+	}
+	if c.Jobs.Enabled {
+		if c.Jobs.Workers <= 0 || c.Jobs.PollInterval.Duration <= 0 || c.Jobs.Heartbeat.Duration <= 0 {
+			errs = append(errs, "jobs workers, poll interval and heartbeat must be positive")
+		}
+		if c.Jobs.Lease.Duration <= c.Jobs.Heartbeat.Duration {
+			errs = append(errs, "jobs lease must be longer than the heartbeat")
+		}
+	}
+	if c.Cron.Jitter.Duration < 0 || c.Cron.LockTTL.Duration <= 0 {
+		errs = append(errs, "cron jitter must not be negative and the lock ttl must be positive")
+	}
+	for task, spec := range c.Cron.Tasks {
+		if _, err := schedule.ParseSpec(spec); err != nil {
+			errs = append(errs, fmt.Sprintf("schedule of cron task %q: %v", task, err))
+		}
+	}
+	if c.SLA.Enabled && c.SLA.Interval.Duration <= 0 {
+		errs = append(errs, "sla interval must be positive")
+	}
+	for status, limit := range c.SLA.Limits {
+		known := false
+		for _, s := range SLAStatuses {
+			known = known || s == status
+		}
+		if !known {
+			errs = append(errs, fmt.Sprintf("sla limit of unknown status %q, limits are set for %s", status, strings.Join(SLAStatuses, ", ")))
+		}
+		if limit.Duration < 0 {
+			errs = append(errs, fmt.Sprintf("sla limit of %s must not be negative", status))
+		}
+	}
+	if c.Sagas.Enabled && (c.Sagas.StaleAfter.Duration <= 0 || c.Sagas.Interval.Duration <= 0) {
+		errs = append(errs, "sagas stale after and interval must be positive")
+	}
+	if c.Stats.Enabled && c.Stats.MaxDays <= 0 {
+		errs = append(errs, "stats max days must be positive")
+	}
+	switch c.MetricsExport.Sink {
+	case "":
+	case MetricsSinkStatsD, MetricsSinkCloudWatch:
+		if c.MetricsExport.Interval.Duration <= 0 {
+			errs = append(errs, "metrics export interval must be positive")
+		}
+		if c.MetricsExport.Sink == MetricsSinkStatsD && c.MetricsExport.Address == "" {
+			errs = append(errs, "metrics export to statsd needs an address")
+		}
+		if c.MetricsExport.Sink == MetricsSinkCloudWatch && c.MetricsExport.Namespace == "" {
+			errs = append(errs, "metrics export to cloudwatch needs a namespace")
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("unknown metrics export sink %q, sinks are %s and %s", c.MetricsExport.Sink, MetricsSinkStatsD, MetricsSinkCloudWatch))
+	}
+	if c.Cluster.Enabled {
+		if u, err := url.Parse(c.Cluster.Address); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, "cluster address must be an absolute url")
+		}
+		if c.Cluster.RenewInterval.Duration <= 0 || c.Cluster.LeaseDuration.Duration <= 2*c.Cluster.RenewInterval.Duration {
+			errs = append(errs, "cluster renew interval must be positive and the lease duration more than twice as long")
+		}
+		if c.Cluster.Forward != ForwardRedirect && c.Cluster.Forward != ForwardProxy {
+			errs = append(errs, fmt.Sprintf("unknown cluster forward %q", c.Cluster.Forward))
+		}
+		if c.Cluster.OrderLockTTL.Duration <= 0 || c.Cluster.OrderLockWait.Duration < 0 {
+			errs = append(errs, "cluster order lock ttl must be positive and its wait not negative")
+		}
+	}
+	if c.Retention.Deleted.Duration < 0 || c.Retention.Interval.Duration < 0 {
+		errs = append(errs, "retention of deleted orders and its interval must not be negative")
+	}
+	if c.Retention.Orders.Duration < 0 || c.Retention.Edits.Duration < 0 || c.Retention.Deliveries.Duration < 0 {
+		errs = append(errs, "retention of orders, edits and deliveries must not be negative")
+	}
+	switch c.Retention.OrdersAction {
+	case RetentionAnonymize, RetentionDelete:
+	default:
+		errs = append(errs, fmt.Sprintf("unknown retention orders action %q, one of anonymize or delete", c.Retention.OrdersAction))
+	}
+	if (c.Retention.Orders.Duration > 0 || c.Retention.Edits.Duration > 0) && c.Retention.Interval.Duration == 0 {
+		errs = append(errs, "retention of orders and edits needs a retention interval")
+	}
+	if c.Retention.Archive.Enabled {
+		if c.Retention.Archive.Bucket == "" {
+			errs = append(errs, "archive bucket is required")
+		}
+		if c.Retention.Archive.After.Duration <= 0 || c.Retention.Archive.BatchSize <= 0 {
+			errs = append(errs, "archive after and batch size must be positive")
+		}
+		if c.Retention.Interval.Duration == 0 {
+			errs = append(errs, "archive needs a retention interval")
+		}
+	}
+	if c.Shipping.PollInterval.Duration < 0 {
+		errs = append(errs, "shipping poll interval must not be negative")
+	}
+	for name, carrier := range c.Shipping.Carriers {
+		if carrier.WebhookSecret == "" {
+			errs = append(errs, fmt.Sprintf("carrier %q webhook secret is required", name))
+		}
+		if carrier.Timeout.Duration < 0 {
+			errs = append(errs, fmt.Sprintf("carrier %q timeout must not be negative", name))
+		}
+	}
+	if c.Inventory.Enabled {
+		switch c.Inventory.Client {
+		case InventoryClientHTTP:
+			if c.Inventory.Endpoint == "" {
+				errs = append(errs, "inventory endpoint is required")
+			}
+			if c.Inventory.Timeout.Duration <= 0 {
+				errs = append(errs, "inventory timeout must be positive")
+			}
+		case InventoryClientStub:
+		default:
+			errs = append(errs, fmt.Sprintf("unknown inventory client %q", c.Inventory.Client))
+		}
+	}
+	if c.Routing.Enabled && !routing.Valid(c.Routing.Strategy) {
+		errs = append(errs, fmt.Sprintf("unknown routing strategy %q", c.Routing.Strategy))
+	}
+	for priority, strategy := range c.Routing.Priorities {
+		if !ValidPriority(priority) {
+			errs = append(errs, fmt.Sprintf("routing strategy of unknown priority %q", priority))
+		}
+		if c.Routing.Enabled && !routing.Valid(strategy) {
+			errs = append(errs, fmt.Sprintf("unknown routing strategy %q of %s orders", strategy, priority))
+		}
+	}
+	if c.Priority.UpgradeWindow.Duration < 0 {
+		errs = append(errs, "priority upgrade window must not be negative")
+	}
+	for _, country := range c.Priority.RushCountries {
+		if len(country) != 2 {
+			errs = append(errs, fmt.Sprintf("rush country %q is not an ISO 3166 alpha-2 code", country))
+		}
+	}
+	if c.Tracking.Enabled {
+		if len(c.Tracking.Secret) < 32 {
+			errs = append(errs, "tracking secret must have at least 32 characters")
+		}
+		if c.Tracking.TTL.Duration <= 0 {
+			errs = append(errs, "tracking ttl must be positive")
+		}
+		if c.Tracking.RateLimit.Enabled && (c.Tracking.RateLimit.RequestsPerSecond <= 0 || c.Tracking.RateLimit.Burst <= 0) {
+			errs = append(errs, "tracking rate limit requests per second and burst must be positive")
+		}
+	}
+	if c.Cursors.Enabled {
+		if len(c.Cursors.Secret) < 32 {
+			errs = append(errs, "cursors secret must have at least 32 characters")
+		}
+		if c.Cursors.TTL.Duration <= 0 {
+			errs = append(errs, "cursors ttl must be positive")
+		}
+	}
+	if c.Documents.Enabled {
+		if c.Documents.Branding.Color != "" && !validColor(c.Documents.Branding.Color) {
+			errs = append(errs, fmt.Sprintf("documents branding color %q must be #rrggbb", c.Documents.Branding.Color))
+		}
+		for tenant, branding := range c.Documents.Tenants {
+			if branding.Color != "" && !validColor(branding.Color) {
+				errs = append(errs, fmt.Sprintf("documents branding color %q of tenant %s must be #rrggbb", branding.Color, tenant))
+			}
+		}
+		if c.Documents.Storage.Enabled && c.Documents.Storage.Bucket == "" {
+			errs = append(errs, "documents storage bucket is required")
+		}
+	}
+	if c.Duplicates.Enabled {
+		if c.Duplicates.Window.Duration <= 0 {
+			errs = append(errs, "duplicates window must be positive")
+		}
+		if c.Duplicates.Action != DuplicateActionFlag && c.Duplicates.Action != DuplicateActionBlock {
+			errs = append(errs, fmt.Sprintf("unknown duplicates action %q", c.Duplicates.Action))
+		}
+	}
+	if c.Experiments.Enabled && c.Experiments.Header == "" {
+		errs = append(errs, "experiments header is required")
+	}
+	for name, variants := range c.Experiments.Experiments {
+		if len(variants) == 0 {
+			errs = append(errs, fmt.Sprintf("experiment %s has no variants", name))
+		}
+		for variant, weight := range variants {
+			if weight <= 0 {
+				errs = append(errs, fmt.Sprintf("weight of variant %s of experiment %s must be positive", variant, name))
+			}
+		}
+	}
+	if c.Fraud.Enabled {
+		if c.Fraud.Mode != FraudModeSync && c.Fraud.Mode != FraudModeAsync {
+			errs = append(errs, fmt.Sprintf("unknown fraud mode %q", c.Fraud.Mode))
+		}
+		if c.Fraud.Timeout.Duration <= 0 {
+			errs = append(errs, "fraud timeout must be positive")
+		}
+		rules := c.Fraud.Rules
+		if rules.ReviewAmount < 0 || rules.RejectAmount < 0 {
+			errs = append(errs, "fraud amounts must not be negative")
+		}
+		if rules.RejectAmount > 0 && rules.RejectAmount < rules.ReviewAmount {
+			errs = append(errs, "fraud reject amount must not be below the review amount")
+		}
+		if rules.VelocityLimit < 0 {
+			errs = append(errs, "fraud velocity limit must not be negative")
+		}
+		if rules.VelocityLimit > 0 && rules.VelocityWindow.Duration <= 0 {
+			errs = append(errs, "fraud velocity window must be positive")
+		}
+	}
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.LogFormat != logging.FormatJSON && c.LogFormat != logging.FormatText {
+		errs = append(errs, fmt.Sprintf("unknown log format %q", c.LogFormat))
+	}
+	for module, level := range c.LogLevels {
+		if _, err := logging.ParseLevel(level); err != nil {
+			errs = append(errs, fmt.Sprintf("log level of module %s: %v", module, err))
+		}
+	}
+	if c.Timeouts.Request.Duration < 0 {
+		errs = append(errs, "request timeout must not be negative")
+	}
+	if c.Timeouts.ReadHeader.Duration < 0 || c.Timeouts.Read.Duration < 0 || c.Timeouts.Idle.Duration < 0 {
+		errs = append(errs, "read header, read and idle timeouts must not be negative")
+	}
+	if c.RateLimit.Enabled && (c.RateLimit.RequestsPerSecond <= 0 || c.RateLimit.Burst <= 0) {
+		errs = append(errs, "rate limit requests per second and burst must be positive")
+	}
+	for route, percent := range c.Canary.Routes {
+		if percent < 0 || percent > 100 {
+			errs = append(errs, fmt.Sprintf("canary percentage of route %s must be between 0 and 100", route))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Listen returns the network and address net.Listen binds address with on
+// the ip stack of the configuration. A wildcard host, empty, 0.0.0.0 or ::,
+// binds every address of the stack, so 0.0.0.0:8080 takes ipv6 connections
+// too on the dual stack; an ip host has to be of the stack.
+func (c *Config) Listen(address string) (network, addr string, err error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", "", err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port %q", port)
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		host, ip = "", nil
+	}
+	switch c.IPStack {
+	case StackIPv4:
+		if ip != nil && ip.To4() == nil {
+			return "", "", fmt.Errorf("%s is not an ipv4 address", host)
+		}
+		network = "tcp4"
+	case StackIPv6:
+		if ip != nil && ip.To4() != nil {
+			return "", "", fmt.Errorf("%s is not an ipv6 address", host)
+		}
+		network = "tcp6"
+	default:
+		network = "tcp"
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// sameListenAddress reports whether the listen addresses a and b bind the
+// same port of an address, wildcard hosts included
+func sameListenAddress(a, b string) bool {
+	aHost, aPort, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	bHost, bPort, err := net.SplitHostPort(b)
+	if err != nil || aPort != bPort || aPort == "0" {
+		return false
+	}
+	if ip := net.ParseIP(aHost); ip != nil && ip.IsUnspecified() {
+		aHost = ""
+	}
+	if ip := net.ParseIP(bHost); ip != nil && ip.IsUnspecified() {
+		bHost = ""
+	}
+	return aHost == "" || bHost == "" || aHost == bHost
+}
+
+// Level returns the parsed log level, defaulting to info
+func (c *Config) Level() logging.Level {
+	level, err := logging.ParseLevel(c.LogLevel)
+	if err != nil {
+		return logging.InfoLevel
+	}
+	return level
+}
+
+// ModuleLevels returns the parsed log levels of the modules with their own
+func (c *Config) ModuleLevels() map[string]logging.Level {
+	levels := make(map[string]logging.Level, len(c.LogLevels))
+	for module, name := range c.LogLevels {
+		if level, err := logging.ParseLevel(name); err == nil {
+			levels[module] = level
+		}
+	}
+	return levels
+}
+
+// OrderCurrency returns the currency of the orders of tenant that name none:
+// that of the tenant, the default currency or the currency of payments
+func (c *Config) OrderCurrency(tenant string) string {
+	if currency, ok := c.Currency.Tenants[tenant]; ok && tenant != "" {
+		return currency
+	}
+	if c.Currency.Default != "" {
+		return c.Currency.Default
+	}
+	return strings.ToUpper(c.Payments.Currency)
+}
+
+// Feature reports whether the named feature flag is switched on
+func (c *Config) Feature(name string) bool {
+	return c.Features[name]
+}
+
+// Redacted returns a copy of c with secrets masked, safe to log or serve
+func (c *Config) Redacted() *Config {
+	out := *c
+	if out.Admin.Token != "" {
+		out.Admin.Token = redacted
+	}
+	if out.Db.SecretAccessKey != "" {
+		out.Db.SecretAccessKey = redacted
+	}
+	if out.Storage.DSN != "" {
+		out.Storage.DSN = redacted
+	}
+	if out.Cache.RedisPassword != "" {
+		out.Cache.RedisPassword = redacted
+	}
+	if out.Outbound.ProxyURL != "" {
+		out.Outbound.ProxyURL = redactURL(out.Outbound.ProxyURL)
+	}
+	if out.Redaction.HashKey != "" {
+		out.Redaction.HashKey = redacted
+	}
+	if out.Payments.Stripe.SecretKey != "" {
+		out.Payments.Stripe.SecretKey = redacted
+	}
+	if out.Payments.Stripe.WebhookSecret != "" {
+		out.Payments.Stripe.WebhookSecret = redacted
+	}
+	if out.Tracking.Secret != "" {
+		out.Tracking.Secret = redacted
+	}
+	if out.Cursors.Secret != "" {
+		out.Cursors.Secret = redacted
+	}
+	if out.Notifications.Email.SMTP.Password != "" {
+		out.Notifications.Email.SMTP.Password = redacted
+	}
+	if out.Notifications.SMS.Twilio.AuthToken != "" {
+		out.Notifications.SMS.Twilio.AuthToken = redacted
+	}
+	if len(c.Tenants.Keys) > 0 {
+		out.Tenants.Keys = map[string][]string{}
+		for tenant, keys := range c.Tenants.Keys {
+			out.Tenants.Keys[tenant] = make([]string, len(keys))
+			for i := range keys {
+				out.Tenants.Keys[tenant][i] = redacted
+			}
+		}
+	}
+	if len(c.Shipping.Carriers) > 0 {
+		out.Shipping.Carriers = map[string]CarrierConfig{}
+		for name, carrier := range c.Shipping.Carriers {
+			if carrier.WebhookSecret != "" {
+				carrier.WebhookSecret = redacted
+			}
+			out.Shipping.Carriers[name] = carrier
+		}
+	}
+	return &out
+}
+
+// redactURL returns raw with the user and password of its userinfo redacted,
+// or redacted whole when it does not parse
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redacted
+	}
+	if u.User == nil {
+		return raw
+	}
+	// set as a user the redaction would be escaped
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redacted+"@", 1)
+}
+
+// Duration is a time.Duration read from strings like "5s" in config files
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON encodes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON decodes a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// MarshalYAML encodes the duration as a string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalYAML decodes a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// Set parses s into d
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
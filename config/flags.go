@@ -0,0 +1,428 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// binding ties a config field to its command line flag and environment variable
+type binding struct {
+	flag  string
+	usage string
+	set   func(string) error
+	get   func() string
+	bool  bool
+}
+
+// env returns the environment variable name, e.g. db-orders-table => ORDER_DB_ORDERS_TABLE
+func (b binding) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(b.flag, "-", "_", -1))
+}
+
+func stringBinding(name, usage string, p *string) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set:   func(s string) error { *p = s; return nil },
+		get:   func() string { return *p },
+	}
+}
+
+func durationBinding(name, usage string, p *Duration) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set:   p.Set,
+		get:   p.String,
+	}
+}
+
+func intBinding(name, usage string, p *int) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set: func(s string) error {
+			v, err := strconv.Atoi(s)
+			if err != nil {
+				return err
+			}
+			*p = v
+			return nil
+		},
+		get: func() string { return strconv.Itoa(*p) },
+	}
+}
+
+func int64Binding(name, usage string, p *int64) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set: func(s string) error {
+			v, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return err
+			}
+			*p = v
+			return nil
+		},
+		get: func() string { return strconv.FormatInt(*p, 10) },
+	}
+}
+
+func floatBinding(name, usage string, p *float64) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set: func(s string) error {
+			v, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return err
+			}
+			*p = v
+			return nil
+		},
+		get: func() string { return strconv.FormatFloat(*p, 'f', -1, 64) },
+	}
+}
+
+// stringsBinding reads a comma separated list
+func stringsBinding(name, usage string, p *[]string) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set: func(s string) error {
+			*p = nil
+			for _, v := range strings.Split(s, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					*p = append(*p, v)
+				}
+			}
+			return nil
+		},
+		get: func() string { return strings.Join(*p, ",") },
+	}
+}
+
+func boolBinding(name, usage string, p *bool) binding {
+	return binding{
+		flag:  name,
+		usage: usage,
+		set: func(s string) error {
+			v, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			*p = v
+			return nil
+		},
+		get:  func() string { return strconv.FormatBool(*p) },
+		bool: true,
+	}
+}
+
+func (c *Config) bindings() []binding {
+	return []binding{
+		stringBinding("listen-address", "address the api server listens on", &c.ListenAddress),
+		stringBinding("ip-stack", "ip stack the servers listen on: dual, ipv4 or ipv6", &c.IPStack),
+		stringBinding("tls-cert-file", "path of the tls certificate", &c.TLS.CertFile),
+		stringBinding("tls-key-file", "path of the tls private key", &c.TLS.KeyFile),
+		stringBinding("tls-ca-file", "path of the tls client ca bundle", &c.TLS.CAFile),
+		boolBinding("proxy-protocol-enabled", "read the proxy protocol header of the load balancer", &c.ProxyProtocol.Enabled),
+		stringsBinding("proxy-protocol-trusted", "comma separated addresses or cidr ranges of the load balancers sending the proxy protocol header", &c.ProxyProtocol.Trusted),
+		durationBinding("proxy-protocol-header-timeout", "time a load balancer has to send the proxy protocol header", &c.ProxyProtocol.HeaderTimeout),
+		boolBinding("forwarded-enabled", "read the client address from the forwarded headers of trusted proxies", &c.Forwarded.Enabled),
+		stringsBinding("forwarded-trusted", "comma separated addresses or cidr ranges of the proxies whose forwarded headers are trusted", &c.Forwarded.Trusted),
+		boolBinding("acl-enabled", "refuse the requests of clients not passing the network acl", &c.ACL.Enabled),
+		stringsBinding("acl-allow", "comma separated addresses or cidr ranges of the clients allowed on every route", &c.ACL.Allow),
+		stringsBinding("acl-deny", "comma separated addresses or cidr ranges of the clients denied on every route", &c.ACL.Deny),
+		boolBinding("grpc-enabled", "serve the grpc api", &c.GRPC.Enabled),
+		stringBinding("grpc-listen-address", "address the grpc server listens on", &c.GRPC.ListenAddress),
+		boolBinding("grpc-multiplex", "serve grpc and http on the http listen address", &c.GRPC.Multiplex),
+		stringBinding("admin-listen-address", "address the admin api listens on, the http listen address when empty", &c.Admin.ListenAddress),
+		stringBinding("admin-token", "bearer token of the admin api", &c.Admin.Token),
+		boolBinding("admin-debug", "serve pprof, expvar and runtime dumps on the admin api", &c.Admin.Debug),
+		boolBinding("admin-csrf-enabled", "require the double submit csrf token on the admin requests of browsers", &c.Admin.CSRF.Enabled),
+		stringBinding("admin-csrf-same-site", "SameSite mode of the csrf cookie: strict, lax or none", &c.Admin.CSRF.SameSite),
+		boolBinding("admin-csrf-secure", "send the csrf cookie over https only", &c.Admin.CSRF.Secure),
+		stringBinding("storage-backend", "order storage backend (dynamodb, postgres, sqlite)", &c.Storage.Backend),
+		stringBinding("storage-dsn", "connection string of the postgres or sqlite backend", &c.Storage.DSN),
+		stringBinding("storage-mode", "order storage mode (state, events)", &c.Storage.Mode),
+		intBinding("storage-snapshot-every", "versions of an order between the snapshots of its event stream", &c.Storage.SnapshotEvery),
+		stringBinding("db-endpoint", "dynamodb endpoint url", &c.Db.Endpoint),
+		stringBinding("db-region", "dynamodb region", &c.Db.Region),
+		stringBinding("db-access-key-id", "dynamodb access key id", &c.Db.AccessKeyID),
+		stringBinding("db-secret-access-key", "dynamodb secret access key", &c.Db.SecretAccessKey),
+		stringBinding("db-orders-table", "dynamodb orders table name", &c.Db.OrdersTable),
+		stringBinding("db-migrations-table", "dynamodb table recording applied schema migrations", &c.Db.MigrationsTable),
+		stringBinding("db-outbox-table", "dynamodb table holding unpublished order events", &c.Db.OutboxTable),
+		stringBinding("db-webhooks-table", "dynamodb table holding webhook subscriptions and deliveries", &c.Db.WebhooksTable),
+		stringBinding("db-dead-letters-table", "dynamodb table holding the events publishers failed to deliver", &c.Db.DeadLettersTable),
+		stringBinding("db-returns-table", "dynamodb table holding order returns", &c.Db.ReturnsTable),
+		stringBinding("db-customers-table", "dynamodb table holding customers", &c.Db.CustomersTable),
+		stringBinding("db-drafts-table", "dynamodb table holding draft orders", &c.Db.DraftsTable),
+		stringBinding("db-schedules-table", "dynamodb table holding order schedules", &c.Db.SchedulesTable),
+		stringBinding("db-jobs-table", "dynamodb table holding background jobs", &c.Db.JobsTable),
+		stringBinding("db-leases-table", "dynamodb table holding the leader lease", &c.Db.LeasesTable),
+		stringBinding("db-members-table", "dynamodb table holding the cluster members", &c.Db.MembersTable),
+		stringBinding("db-hosts-table", "dynamodb table holding the registered hosts", &c.Db.HostsTable),
+		stringBinding("db-quotas-table", "dynamodb table holding the request counts of the quotas", &c.Db.QuotasTable),
+		stringBinding("db-sagas-table", "dynamodb table holding the sagas placing orders", &c.Db.SagasTable),
+		stringBinding("db-streams-table", "dynamodb table holding the event streams of the orders", &c.Db.StreamsTable),
+		stringBinding("db-stats-table", "dynamodb table holding the order statistics", &c.Db.StatsTable),
+		stringBinding("db-warehouses-table", "dynamodb table holding the warehouses", &c.Db.WarehousesTable),
+		intBinding("db-max-attempts", "maximum attempts of a dynamodb call", &c.Db.Retry.MaxAttempts),
+		durationBinding("db-initial-backoff", "backoff after the first failed dynamodb call attempt", &c.Db.Retry.InitialBackoff),
+		durationBinding("db-max-backoff", "maximum backoff between dynamodb call attempts", &c.Db.Retry.MaxBackoff),
+		boolBinding("cache-enabled", "cache order lookups in redis", &c.Cache.Enabled),
+		stringBinding("cache-redis-address", "redis address of the order cache", &c.Cache.RedisAddress),
+		stringBinding("cache-redis-password", "redis password of the order cache", &c.Cache.RedisPassword),
+		intBinding("cache-redis-db", "redis database of the order cache", &c.Cache.RedisDB),
+		durationBinding("cache-ttl", "time orders stay cached", &c.Cache.TTL),
+		stringsBinding("hedging-routes", "comma separated routes whose order reads are hedged (GetOrder, OrderStatus)", &c.Hedging.Routes),
+		floatBinding("hedging-percentile", "percentile of recent order read latencies after which a hedged read is sent", &c.Hedging.Percentile),
+		durationBinding("hedging-min-delay", "minimum wait before a hedged order read", &c.Hedging.MinDelay),
+		durationBinding("hedging-max-delay", "maximum wait before a hedged order read", &c.Hedging.MaxDelay),
+		boolBinding("slow-requests-enabled", "keep the slow requests for the admin api", &c.SlowRequests.Enabled),
+		durationBinding("slow-requests-threshold", "duration above which a request is slow", &c.SlowRequests.Threshold),
+		durationBinding("slow-requests-query-threshold", "duration above which a dynamodb call of a request is logged, 0 disables", &c.SlowRequests.QueryThreshold),
+		intBinding("slow-requests-size", "number of slow requests kept", &c.SlowRequests.Size),
+		boolBinding("capacity-enabled", "track the capacity consumed by the dynamodb calls by route", &c.Capacity.Enabled),
+		floatBinding("capacity-read-unit-price", "price of a million dynamodb read request units", &c.Capacity.ReadUnitPrice),
+		floatBinding("capacity-write-unit-price", "price of a million dynamodb write request units", &c.Capacity.WriteUnitPrice),
+		boolBinding("capture-enabled", "record sanitized requests and responses to files", &c.Capture.Enabled),
+		stringBinding("capture-dir", "directory the recorded requests and responses are written to", &c.Capture.Dir),
+		stringsBinding("capture-routes", "comma separated names of the routes recorded, all when empty", &c.Capture.Routes),
+		floatBinding("capture-sample-rate", "fraction of the requests recorded", &c.Capture.SampleRate),
+		intBinding("capture-max-body-bytes", "largest body recorded", &c.Capture.MaxBodyBytes),
+		boolBinding("coalescing-enabled", "run identical concurrent GET requests once and share the response", &c.Coalescing.Enabled),
+		stringsBinding("coalescing-routes", "comma separated names of the GET routes coalesced, all but the streamed ones when empty", &c.Coalescing.Routes),
+		boolBinding("mirror-enabled", "send copies of a sample of the requests to a shadow deployment", &c.Mirror.Enabled),
+		stringBinding("mirror-endpoint", "base url of the shadow deployment the requests are mirrored to", &c.Mirror.Endpoint),
+		stringsBinding("mirror-routes", "comma separated names of the routes mirrored, all when empty", &c.Mirror.Routes),
+		floatBinding("mirror-sample-rate", "fraction of the requests mirrored", &c.Mirror.SampleRate),
+		boolBinding("db-status-enabled", "refuse writes while the database is unhealthy", &c.DbStatus.Enabled),
+		durationBinding("db-status-ttl", "time a database status check is reused", &c.DbStatus.TTL),
+		durationBinding("db-status-timeout", "maximum time of a database status check", &c.DbStatus.Timeout),
+		durationBinding("db-status-max-latency", "slowest database status check of a healthy database, 0 disables", &c.DbStatus.MaxLatency),
+		intBinding("outbound-max-idle-conns", "maximum idle connections of outbound http calls across hosts", &c.Outbound.MaxIdleConns),
+		intBinding("outbound-max-idle-conns-per-host", "maximum idle connections of outbound http calls to one host", &c.Outbound.MaxIdleConnsPerHost),
+		intBinding("outbound-max-conns-per-host", "maximum connections of outbound http calls to one host, 0 for no limit", &c.Outbound.MaxConnsPerHost),
+		durationBinding("outbound-idle-conn-timeout", "time an idle outbound connection is kept", &c.Outbound.IdleConnTimeout),
+		durationBinding("outbound-dial-timeout", "maximum time to connect to the host of an outbound http call", &c.Outbound.DialTimeout),
+		durationBinding("outbound-tls-handshake-timeout", "maximum time of the tls handshake of an outbound connection", &c.Outbound.TLSHandshakeTimeout),
+		stringBinding("outbound-proxy-url", "proxy of outbound http calls, the proxy environment variables when empty", &c.Outbound.ProxyURL),
+		boolBinding("outbox-enabled", "record order events in the outbox and relay them", &c.Outbox.Enabled),
+		durationBinding("outbox-poll-interval", "time between polls of the outbox", &c.Outbox.PollInterval),
+		durationBinding("outbox-max-backoff", "maximum wait between outbox polls while publishing fails", &c.Outbox.MaxBackoff),
+		intBinding("outbox-batch-size", "maximum events relayed per outbox poll", &c.Outbox.BatchSize),
+		boolBinding("webhooks-enabled", "deliver order events to webhook subscriptions", &c.Webhooks.Enabled),
+		durationBinding("webhooks-timeout", "maximum time of one webhook delivery request", &c.Webhooks.Timeout),
+		intBinding("webhooks-max-attempts", "webhook delivery attempts before dead-lettering", &c.Webhooks.MaxAttempts),
+		durationBinding("webhooks-initial-backoff", "wait before the first webhook delivery retry", &c.Webhooks.InitialBackoff),
+		durationBinding("webhooks-max-backoff", "maximum wait between webhook delivery retries", &c.Webhooks.MaxBackoff),
+		durationBinding("webhooks-poll-interval", "time between polls for due webhook deliveries", &c.Webhooks.PollInterval),
+		intBinding("webhooks-concurrency", "webhook deliveries sent in parallel", &c.Webhooks.Concurrency),
+		intBinding("webhooks-request-attempts", "requests of a webhook delivery attempt on transient failures", &c.Webhooks.Retry.MaxAttempts),
+		boolBinding("webhooks-allow-private-networks", "deliver webhooks to loopback, private and link-local addresses", &c.Webhooks.AllowPrivateNetworks),
+		boolBinding("notifications-enabled", "notify customers of the events of their orders", &c.Notifications.Enabled),
+		stringBinding("notifications-email-provider", "provider of the notification emails (ses, smtp), empty sends none", &c.Notifications.Email.Provider),
+		stringBinding("notifications-email-from", "sender address of the notification emails", &c.Notifications.Email.From),
+		stringBinding("notifications-smtp-host", "smtp server of the notification emails", &c.Notifications.Email.SMTP.Host),
+		intBinding("notifications-smtp-port", "port of the smtp server of the notification emails", &c.Notifications.Email.SMTP.Port),
+		stringBinding("notifications-smtp-password", "password of the smtp server of the notification emails", &c.Notifications.Email.SMTP.Password),
+		stringBinding("notifications-sms-provider", "provider of the notification text messages (sns, twilio), empty sends none", &c.Notifications.SMS.Provider),
+		stringBinding("notifications-twilio-auth-token", "auth token of the twilio account of the notification text messages", &c.Notifications.SMS.Twilio.AuthToken),
+		boolBinding("kafka-enabled", "publish order events to kafka", &c.Kafka.Enabled),
+		stringsBinding("kafka-brokers", "comma separated kafka broker addresses", &c.Kafka.Brokers),
+		stringBinding("kafka-topic", "kafka topic of order events", &c.Kafka.Topic),
+		stringBinding("kafka-encoding", "kafka message encoding (json, avro)", &c.Kafka.Encoding),
+		durationBinding("kafka-write-timeout", "maximum time to publish an event to kafka", &c.Kafka.WriteTimeout),
+		boolBinding("dead-letters-enabled", "keep the events webhooks and kafka failed to deliver for replay", &c.DeadLetters.Enabled),
+		intBinding("dead-letters-max-attempts", "attempts of the outbox relay to publish an event to kafka before dead-lettering it", &c.DeadLetters.MaxAttempts),
+		boolBinding("commands-enabled", "process order commands from an sqs queue", &c.Commands.Enabled),
+		stringBinding("commands-endpoint", "sqs endpoint url", &c.Commands.Endpoint),
+		stringBinding("commands-queue-url", "url of the sqs queue of order commands", &c.Commands.QueueURL),
+		stringBinding("commands-dead-letter-queue-url", "url of the sqs queue receiving failed order commands", &c.Commands.DeadLetterQueueURL),
+		intBinding("commands-concurrency", "order commands processed in parallel", &c.Commands.Concurrency),
+		durationBinding("commands-visibility-timeout", "sqs visibility timeout of order commands being processed", &c.Commands.VisibilityTimeout),
+		durationBinding("commands-wait-time", "sqs long polling wait time", &c.Commands.WaitTime),
+		intBinding("commands-max-receives", "attempts of an order command before it is dead-lettered", &c.Commands.MaxReceives),
+		boolBinding("returns-enabled", "accept returns of delivered orders", &c.Returns.Enabled),
+		boolBinding("customers-enabled", "keep customers and their addresses", &c.Customers.Enabled),
+		boolBinding("quotas-enabled", "count the requests of every consumer against daily and monthly quotas", &c.Quotas.Enabled),
+		stringBinding("quotas-key-by", "what a quota consumer is (apiKey, tenant)", &c.Quotas.KeyBy),
+		int64Binding("quotas-daily", "requests a consumer may make per day, 0 for no limit", &c.Quotas.Default.Daily),
+		int64Binding("quotas-monthly", "requests a consumer may make per month, 0 for no limit", &c.Quotas.Default.Monthly),
+		boolBinding("hosts-enabled", "keep the registry of the hosts calling the api", &c.Hosts.Enabled),
+		boolBinding("hosts-require", "refuse the requests of hosts that are not registered", &c.Hosts.Require),
+		durationBinding("hosts-heartbeat-ttl", "time a registered host stays live without a heartbeat", &c.Hosts.HeartbeatTTL),
+		durationBinding("hosts-cache-ttl", "time a live host is trusted before it is read again", &c.Hosts.CacheTTL),
+		boolBinding("agents-enabled", "serve the api of the warehouse agents, signed with the keys of the host registry", &c.Agents.Enabled),
+		durationBinding("agents-max-skew", "time the timestamp of a signed agent request may be away from the clock", &c.Agents.MaxSkew),
+		boolBinding("drafts-enabled", "keep draft orders checked out into orders", &c.Drafts.Enabled),
+		durationBinding("drafts-ttl", "time an untouched draft order is kept", &c.Drafts.TTL),
+		boolBinding("schedules-enabled", "place scheduled and recurring orders", &c.Schedules.Enabled),
+		durationBinding("schedules-poll-interval", "time between polls for schedules due to place an order", &c.Schedules.PollInterval),
+		boolBinding("imports-enabled", "accept bulk imports of orders", &c.Imports.Enabled),
+		int64Binding("imports-max-upload-size", "largest order import file accepted, in bytes", &c.Imports.MaxUploadSize),
+		boolBinding("encryption-enabled", "encrypt the addresses, payments and emails of orders and customers", &c.Encryption.Enabled),
+		stringBinding("encryption-key-id", "kms key wrapping the data keys of the records written", &c.Encryption.KeyID),
+		stringBinding("encryption-region", "region of the kms key, the db region when empty", &c.Encryption.Region),
+		stringBinding("encryption-endpoint", "kms endpoint url", &c.Encryption.Endpoint),
+		durationBinding("encryption-data-key-reuse", "time a data key seals the records written", &c.Encryption.DataKeyReuse),
+		boolBinding("redaction-enabled", "redact personal data from logs, audit entries, error messages and exports", &c.Redaction.Enabled),
+		stringBinding("redaction-hash-key", "key of the hashes of the redacted fields", &c.Redaction.HashKey),
+		boolBinding("i18n-enabled", "localize error messages and statuses to the Accept-Language of requests", &c.I18n.Enabled),
+		stringBinding("i18n-default-locale", "locale of the requests asking for none available", &c.I18n.DefaultLocale),
+		stringBinding("i18n-catalog", "directory of <locale>.json message files adding to the built in ones", &c.I18n.Catalog),
+		boolBinding("jobs-enabled", "run background jobs such as imports and exports", &c.Jobs.Enabled),
+		intBinding("jobs-workers", "queued jobs run in parallel by an instance", &c.Jobs.Workers),
+		durationBinding("jobs-poll-interval", "time between polls for queued jobs", &c.Jobs.PollInterval),
+		durationBinding("jobs-heartbeat", "time between progress saves of a running job", &c.Jobs.Heartbeat),
+		durationBinding("jobs-lease", "time without a heartbeat after which a running job is failed", &c.Jobs.Lease),
+		stringBinding("jobs-bucket", "s3 bucket receiving the files of export jobs", &c.Jobs.Bucket),
+		stringBinding("jobs-prefix", "key prefix of export job files", &c.Jobs.Prefix),
+		stringBinding("jobs-endpoint", "s3 endpoint url of export job files", &c.Jobs.Endpoint),
+		durationBinding("cron-jitter", "random delay of the runs of background tasks, at most a tenth of their period", &c.Cron.Jitter),
+		durationBinding("cron-lock-ttl", "lease of the instance running a background task, renewed while it runs", &c.Cron.LockTTL),
+		boolBinding("sla-enabled", "escalate the orders keeping a status for longer than its sla", &c.SLA.Enabled),
+		durationBinding("sla-interval", "period of the watchdog escalating the overdue orders", &c.SLA.Interval),
+		boolBinding("sagas-enabled", "place new orders as sagas compensated when cut short", &c.Sagas.Enabled),
+		durationBinding("sagas-stale-after", "time without progress after which a saga is compensated", &c.Sagas.StaleAfter),
+		durationBinding("sagas-interval", "period of the recovery of abandoned sagas", &c.Sagas.Interval),
+		boolBinding("stats-enabled", "count the orders by tenant and day for the statistics", &c.Stats.Enabled),
+		intBinding("stats-max-days", "longest range of days the statistics are read for", &c.Stats.MaxDays),
+		stringBinding("metrics-export-sink", "where the metrics are pushed besides prometheus (statsd, cloudwatch)", &c.MetricsExport.Sink),
+		durationBinding("metrics-export-interval", "period of the metrics pushes", &c.MetricsExport.Interval),
+		stringBinding("metrics-export-address", "udp address of the statsd server or cloudwatch agent", &c.MetricsExport.Address),
+		stringBinding("metrics-export-namespace", "cloudwatch namespace of the metrics pushed", &c.MetricsExport.Namespace),
+		stringBinding("metrics-export-prefix", "prefix of the names of the statsd metrics", &c.MetricsExport.Prefix),
+		stringsBinding("metrics-export-include", "name prefixes of the metrics pushed, comma separated", &c.MetricsExport.Include),
+		boolBinding("cluster-enabled", "elect a leader among the instances to serve writes", &c.Cluster.Enabled),
+		stringBinding("cluster-node-id", "name of this instance, the host name by default", &c.Cluster.NodeID),
+		stringBinding("cluster-address", "base url this instance is reached at by the others", &c.Cluster.Address),
+		durationBinding("cluster-lease-duration", "time the leadership lasts without renewal", &c.Cluster.LeaseDuration),
+		durationBinding("cluster-renew-interval", "time between renewals of the leadership", &c.Cluster.RenewInterval),
+		stringBinding("cluster-forward", "how followers hand writes to the leader (redirect, proxy)", &c.Cluster.Forward),
+		durationBinding("cluster-order-lock-ttl", "time the lock serializing the changes of an order is held at most", &c.Cluster.OrderLockTTL),
+		durationBinding("cluster-order-lock-wait", "time a change waits for the lock of its order", &c.Cluster.OrderLockWait),
+		durationBinding("retention-deleted", "time a deleted order is kept before it is purged", &c.Retention.Deleted),
+		durationBinding("retention-interval", "time between runs of the order retention job, 0 disables it", &c.Retention.Interval),
+		durationBinding("retention-orders", "time a finished order is kept after its last change, 0 keeps it", &c.Retention.Orders),
+		stringBinding("retention-orders-action", "what happens to a finished order past its retention (anonymize, delete)", &c.Retention.OrdersAction),
+		durationBinding("retention-edits", "time the audit record of an order edit is kept, 0 keeps it", &c.Retention.Edits),
+		durationBinding("retention-deliveries", "time the log of a finished webhook delivery is kept, 0 keeps it", &c.Retention.Deliveries),
+		boolBinding("archive-enabled", "archive finished orders to s3", &c.Retention.Archive.Enabled),
+		durationBinding("archive-after", "time since its last change after which a finished order is archived", &c.Retention.Archive.After),
+		stringBinding("archive-bucket", "s3 bucket of archived orders", &c.Retention.Archive.Bucket),
+		stringBinding("archive-prefix", "key prefix of archived orders", &c.Retention.Archive.Prefix),
+		stringBinding("archive-endpoint", "s3 endpoint url", &c.Retention.Archive.Endpoint),
+		intBinding("archive-batch-size", "maximum number of orders in one archive object", &c.Retention.Archive.BatchSize),
+		boolBinding("payments-enabled", "authorize, capture and refund order payments", &c.Payments.Enabled),
+		stringBinding("payments-provider", "payment provider (stripe, mock)", &c.Payments.Provider),
+		stringBinding("payments-currency", "currency of orders while currency-default is not set", &c.Payments.Currency),
+		stringBinding("currency-default", "ISO 4217 currency of the orders of tenants without their own, that of payments when empty", &c.Currency.Default),
+		stringBinding("currency-base", "currency the statistics report revenue in", &c.Currency.Base),
+		boolBinding("payments-gift-cards-enabled", "let orders be paid with gift cards and store credit", &c.Payments.GiftCards.Enabled),
+		stringBinding("payments-gift-cards-client", "gift card client (http, stub)", &c.Payments.GiftCards.Client),
+		stringBinding("payments-gift-cards-endpoint", "gift card service url", &c.Payments.GiftCards.Endpoint),
+		boolBinding("payments-credit-enabled", "let wholesale customers pay orders on account", &c.Payments.Credit.Enabled),
+		stringBinding("payments-credit-client", "credit client (http, stub)", &c.Payments.Credit.Client),
+		stringBinding("payments-credit-endpoint", "credit service url", &c.Payments.Credit.Endpoint),
+		intBinding("payments-credit-terms-days", "days after which the invoices of orders on account are due", &c.Payments.Credit.TermsDays),
+		stringBinding("payments-stripe-endpoint", "stripe api url", &c.Payments.Stripe.Endpoint),
+		stringBinding("payments-stripe-secret-key", "stripe secret api key", &c.Payments.Stripe.SecretKey),
+		stringBinding("payments-stripe-webhook-secret", "secret verifying stripe webhook notifications", &c.Payments.Stripe.WebhookSecret),
+		durationBinding("payments-stripe-timeout", "maximum time of one stripe api call", &c.Payments.Stripe.Timeout),
+		intBinding("payments-stripe-max-attempts", "attempts of a stripe api call on transient failures", &c.Payments.Stripe.Retry.MaxAttempts),
+		boolBinding("inventory-enabled", "reserve the stock of new orders", &c.Inventory.Enabled),
+		stringBinding("inventory-client", "inventory client (http, stub)", &c.Inventory.Client),
+		stringBinding("inventory-endpoint", "url of the inventory service", &c.Inventory.Endpoint),
+		durationBinding("inventory-timeout", "maximum time of one inventory service call", &c.Inventory.Timeout),
+		boolBinding("fraud-enabled", "screen new orders for fraud", &c.Fraud.Enabled),
+		stringBinding("fraud-mode", "screen orders before creating them (sync) or hold them until screened (async)", &c.Fraud.Mode),
+		durationBinding("fraud-timeout", "maximum time of the screening of an order", &c.Fraud.Timeout),
+		boolBinding("fraud-fail-open", "approve the orders whose screening failed instead of holding them", &c.Fraud.FailOpen),
+		floatBinding("fraud-review-amount", "total from which orders are held for review, 0 disables", &c.Fraud.Rules.ReviewAmount),
+		floatBinding("fraud-reject-amount", "total from which orders are rejected, 0 disables", &c.Fraud.Rules.RejectAmount),
+		intBinding("fraud-velocity-limit", "orders of a customer within the velocity window from which orders are held, 0 disables", &c.Fraud.Rules.VelocityLimit),
+		durationBinding("fraud-velocity-window", "window the recent orders of a customer are counted in", &c.Fraud.Rules.VelocityWindow),
+		boolBinding("fraud-address-mismatch", "hold orders shipping to a country none of the addresses of their customer is in", &c.Fraud.Rules.AddressMismatch),
+		boolBinding("duplicates-enabled", "detect new orders repeating a recent order of their customer", &c.Duplicates.Enabled),
+		durationBinding("duplicates-window", "time within which an order with the same customer, items and total is a suspected duplicate", &c.Duplicates.Window),
+		stringBinding("duplicates-action", "flag suspected duplicates or block them", &c.Duplicates.Action),
+		boolBinding("experiments-enabled", "assign the callers to the variants of the A/B experiments", &c.Experiments.Enabled),
+		stringBinding("experiments-header", "request header naming the customer the caller acts for", &c.Experiments.Header),
+		floatBinding("pricing-tax-rate", "flat tax rate of orders, e.g. 0.08", &c.Pricing.TaxRate),
+		floatBinding("pricing-shipping", "shipping charged per order", &c.Pricing.Shipping),
+		floatBinding("pricing-free-shipping-over", "subtotal from which shipping is free, 0 disables", &c.Pricing.FreeShippingOver),
+		durationBinding("shipping-poll-interval", "period of polling carriers for tracking, 0 disables", &c.Shipping.PollInterval),
+		boolBinding("routing-enabled", "keep warehouses and route the items of confirmed orders to them", &c.Routing.Enabled),
+		stringBinding("routing-strategy", "strategy routing items to warehouses: nearest, stock or cost", &c.Routing.Strategy),
+		durationBinding("priority-upgrade-window", "time after its creation within which the priority of an order can be raised, 0 until it ships", &c.Priority.UpgradeWindow),
+		stringsBinding("priority-rush-countries", "countries rush orders ship to, every country when empty", &c.Priority.RushCountries),
+		boolBinding("tracking-enabled", "serve the public tracking of orders by signed token", &c.Tracking.Enabled),
+		stringBinding("tracking-secret", "secret signing the tracking tokens of orders", &c.Tracking.Secret),
+		durationBinding("tracking-ttl", "validity of the tracking tokens of orders", &c.Tracking.TTL),
+		floatBinding("tracking-rate-limit-rps", "tracking lookups per second of each client", &c.Tracking.RateLimit.RequestsPerSecond),
+		intBinding("tracking-rate-limit-burst", "tracking lookups a client may burst", &c.Tracking.RateLimit.Burst),
+		boolBinding("cursors-enabled", "seal the page tokens of order listings into encrypted cursors", &c.Cursors.Enabled),
+		stringBinding("cursors-secret", "secret encrypting the page cursors, shared by the instances", &c.Cursors.Secret),
+		durationBinding("cursors-ttl", "validity of the page cursors", &c.Cursors.TTL),
+		boolBinding("documents-enabled", "render the invoices and packing slips of orders", &c.Documents.Enabled),
+		boolBinding("documents-storage-enabled", "keep the rendered documents of orders in s3", &c.Documents.Storage.Enabled),
+		stringBinding("documents-storage-bucket", "s3 bucket of the rendered documents of orders", &c.Documents.Storage.Bucket),
+		stringBinding("log-level", "log level (debug, info, warn, error)", &c.LogLevel),
+		stringBinding("log-format", "log output format (json, text)", &c.LogFormat),
+		durationBinding("request-timeout", "maximum time to serve a request, 0 disables", &c.Timeouts.Request),
+		durationBinding("read-header-timeout", "maximum time to read the headers of a request, 0 disables", &c.Timeouts.ReadHeader),
+		durationBinding("read-timeout", "maximum time to read a whole request, 0 disables", &c.Timeouts.Read),
+		durationBinding("idle-timeout", "maximum time a kept alive connection waits for a request, 0 disables", &c.Timeouts.Idle),
+		durationBinding("startup-timeout", "deprecated and ignored", &c.Timeouts.Startup),
+		boolBinding("migrate", "apply the database schema migrations and exit", &c.Migrate),
+	}
+}
+
+// flagValue remembers the raw value of a flag so it can be applied after the
+// config file and environment have been loaded
+type flagValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *flagValue) String() string     { return v.value }
+func (v *flagValue) Set(s string) error { v.value = s; return nil }
+func (v *flagValue) IsBoolFlag() bool   { return v.isBool }
+
+type flagValues map[string]*flagValue
+
+func (c *Config) flagSet(name string) (*flag.FlagSet, *string, flagValues) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	configFile := fs.String("config", "", "path of a yaml or json config file (env "+EnvConfigFile+")")
+
+	values := flagValues{}
+	for _, b := range c.bindings() {
+		v := &flagValue{value: b.get(), isBool: b.bool}
+		fs.Var(v, b.flag, b.usage+" (env "+b.env()+")")
+		values[b.flag] = v
+	}
+	return fs, configFile, values
+}
+
+// applyFlags sets the fields whose flags were given on the command line
+func (c *Config) applyFlags(fs *flag.FlagSet, values flagValues) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, b := range c.bindings() {
+		if !set[b.flag] {
+			continue
+		}
+		if err := b.set(values[b.flag].value); err != nil {
+			return fmt.Errorf("invalid value for -%s: %v", b.flag, err)
+		}
+	}
+	return nil
+}
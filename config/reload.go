@@ -0,0 +1,130 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/omnom-nom/order/logging"
+)
+
+// Loader builds a fresh configuration, typically by calling Load with the program args
+type Loader func() (*Config, error)
+
+// ChangeFunc is called after the configuration has been replaced
+type ChangeFunc func(old, new *Config)
+
+// Store holds the current configuration and lets subsystems react to reloads.
+// Only the log levels, rate limits, gatekeeper settings and feature flags are
+// taken from a reloaded configuration, everything else needs a restart.
+type Store struct {
+	mu      sync.RWMutex
+	current *Config
+	loader  Loader
+	hooks   []ChangeFunc
+	logger  logging.Logger
+}
+
+// NewStore returns a store holding cfg, reloading from loader when asked to
+func NewStore(cfg *Config, loader Loader) *Store {
+	return &Store{current: cfg, loader: loader, logger: logging.Default().Module(logging.ModuleConfig)}
+}
+
+// SetLogger makes the store log reloads with logger
+func (s *Store) SetLogger(logger logging.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+func (s *Store) log() logging.Logger {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.logger
+}
+
+// Current returns the configuration in effect, it must not be modified
+func (s *Store) Current() *Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current
+}
+
+// OnChange registers fn to be called after every reload
+func (s *Store) OnChange(fn ChangeFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, fn)
+}
+
+// Reload loads a new configuration and applies its reloadable settings
+func (s *Store) Reload() error {
+	if s.loader == nil {
+		s.log().Warn("config reload requested but no loader is configured")
+		return nil
+	}
+
+	cfg, err := s.loader()
+	if err != nil {
+		s.log().Errorf("config reload failed, keeping current config: %v", err)
+		return err
+	}
+	return s.Set(cfg)
+}
+
+// Set validates cfg and applies its reloadable settings
+func (s *Store) Set(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.current
+	next := *old
+	next.LogLevel = cfg.LogLevel
+	next.LogLevels = cfg.LogLevels
+	next.RateLimit = cfg.RateLimit
+	next.Gatekeeper = cfg.Gatekeeper
+	next.Deprecations = cfg.Deprecations
+	next.Canary = cfg.Canary
+	next.Features = cfg.Features
+	next.Tenants = cfg.Tenants
+	next.Quotas.Default = cfg.Quotas.Default
+	next.Quotas.Consumers = cfg.Quotas.Consumers
+	next.Capacity.ReadUnitPrice = cfg.Capacity.ReadUnitPrice
+	next.Capacity.WriteUnitPrice = cfg.Capacity.WriteUnitPrice
+	s.current = &next
+	hooks := append([]ChangeFunc(nil), s.hooks...)
+	logger := s.logger
+	s.mu.Unlock()
+
+	if cfg.ListenAddress != old.ListenAddress || cfg.IPStack != old.IPStack || cfg.TLS != old.TLS || !reflect.DeepEqual(cfg.ProxyProtocol, old.ProxyProtocol) || cfg.Storage != old.Storage || cfg.Db != old.Db || cfg.Cache != old.Cache || cfg.Encryption != old.Encryption || !reflect.DeepEqual(cfg.Redaction, old.Redaction) || cfg.Timeouts != old.Timeouts {
+		logger.Warn("config reload: listen address, tls, proxy protocol, storage, db, cache, encryption, redaction and timeout changes require a restart")
+	}
+	logger.Info("config reloaded")
+
+	for _, hook := range hooks {
+		hook(old, &next)
+	}
+	return nil
+}
+
+// WatchSignals reloads the configuration on every SIGHUP until ctx is done
+func (s *Store) WatchSignals(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			s.log().Info("received SIGHUP, reloading config")
+			s.Reload()
+		}
+	}
+}
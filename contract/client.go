@@ -0,0 +1,249 @@
+package contract
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omnom-nom/order/capture"
+	"github.com/omnom-nom/order/orderclient"
+	"github.com/omnom-nom/order/proto/orderpb"
+	"github.com/omnom-nom/order/testserver"
+)
+
+// clientCall makes the call of orderclient sending the request of an example
+// and returns what it decoded from the response
+type clientCall func(ctx context.Context, c *orderclient.Client) (interface{}, error)
+
+// clientCalls are the calls of the examples by name
+var clientCalls = map[string]clientCall{
+	"get_order": func(ctx context.Context, c *orderclient.Client) (interface{}, error) {
+		return c.GetOrder(ctx, testserver.PendingOrderID)
+	},
+	"get_order_not_found": func(ctx context.Context, c *orderclient.Client) (interface{}, error) {
+		return c.GetOrder(ctx, "order-missing")
+	},
+	"list_orders": func(ctx context.Context, c *orderclient.Client) (interface{}, error) {
+		return c.ListOrders(ctx, &orderpb.ListOrdersRequest{CustomerId: testserver.FixtureCustomerID, Status: "paid"})
+	},
+	"create_order": func(ctx context.Context, c *orderclient.Client) (interface{}, error) {
+		return c.CreateOrder(ctx, &orderpb.CreateOrderRequest{
+			CustomerId: "customer-new",
+			Items:      []*orderpb.LineItem{{Sku: "sku-coffee", Name: "Coffee beans 1kg", Quantity: 1, UnitPrice: 18.5}},
+			ShippingAddress: &orderpb.Address{
+				Name:       "Grace Hopper",
+				Line1:      "1 Harbor Road",
+				City:       "Arlington",
+				PostalCode: "22201",
+				Country:    "US",
+			},
+		})
+	},
+	"cancel_order": func(ctx context.Context, c *orderclient.Client) (interface{}, error) {
+		return c.CancelOrder(ctx, testserver.PendingOrderID, &orderclient.CancelOrderRequest{
+			Reason: orderclient.CancelCustomerRequest,
+			Note:   "ordered twice",
+		})
+	},
+}
+
+// RunClient checks that orderclient sends every golden request as its
+// example does, and decodes the response of the example: the values it
+// decodes are those of the response, and an error status is returned as an
+// orderclient.Error with the status and message of the example.
+func RunClient(t *testing.T) {
+	examples, err := Examples()
+	if err != nil {
+		t.Fatalf("failed to read the examples: %v", err)
+	}
+	for _, example := range examples {
+		example := example
+		t.Run(example.Name, func(t *testing.T) {
+			call, ok := clientCalls[example.Name]
+			if !ok {
+				t.Fatalf("no client call sends the request of example %s", example.Name)
+			}
+
+			var mu sync.Mutex
+			var diffs []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				d := requestDiffs(&example.Request, r)
+				mu.Lock()
+				diffs = append(diffs, d...)
+				mu.Unlock()
+				for key, values := range example.Response.Header {
+					w.Header()[http.CanonicalHeaderKey(key)] = values
+				}
+				w.WriteHeader(example.Response.Status)
+				w.Write(example.Response.Body)
+			}))
+			defer server.Close()
+
+			client, err := orderclient.New(orderclient.WithBaseURL(server.URL))
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+			got, err := call(context.Background(), client)
+			mu.Lock()
+			for _, diff := range diffs {
+				t.Errorf("request: %s", diff)
+			}
+			mu.Unlock()
+
+			if example.Response.Status >= http.StatusBadRequest {
+				checkClientError(t, &example.Response, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("client call failed: %v", err)
+			}
+			decoded, err := marshalDecoded(got)
+			if err != nil {
+				t.Fatalf("failed to encode what the client decoded: %v", err)
+			}
+			for _, diff := range decodedDiffs(decoded, example.Response.Body) {
+				t.Errorf("response: %s", diff)
+			}
+		})
+	}
+}
+
+// requestDiffs returns the differences of the request r a client sent from
+// the request of an example
+func requestDiffs(want *capture.Request, r *http.Request) []string {
+	var diffs []string
+	if r.Method != want.Method {
+		diffs = append(diffs, fmt.Sprintf("method: want %s, got %s", want.Method, r.Method))
+	}
+	if r.URL.Path != want.Path {
+		diffs = append(diffs, fmt.Sprintf("path: want %s, got %s", want.Path, r.URL.Path))
+	}
+	wantQuery, err := url.ParseQuery(want.Query)
+	if err != nil {
+		diffs = append(diffs, fmt.Sprintf("query: invalid example query: %v", err))
+	} else if gotQuery := r.URL.Query(); !reflect.DeepEqual(wantQuery, gotQuery) && (len(wantQuery) > 0 || len(gotQuery) > 0) {
+		diffs = append(diffs, fmt.Sprintf("query: want %s, got %s", want.Query, r.URL.RawQuery))
+	}
+	for key := range want.Header {
+		if wantValue, gotValue := want.Header.Get(key), r.Header.Get(key); wantValue != gotValue {
+			diffs = append(diffs, fmt.Sprintf("header %s: want %q, got %q", key, wantValue, gotValue))
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return append(diffs, fmt.Sprintf("body: %v", err))
+	}
+	switch {
+	case len(want.Body) == 0 && len(body) > 0:
+		diffs = append(diffs, "body: want none, got one")
+	case len(want.Body) > 0:
+		diffs = append(diffs, capture.CompareJSON("body", want.Body, body, nil)...)
+	}
+	return diffs
+}
+
+// checkClientError checks that err is the orderclient.Error of the error
+// response want
+func checkClientError(t *testing.T, want *capture.Response, err error) {
+	t.Helper()
+	var clientErr *orderclient.Error
+	if !errors.As(err, &clientErr) {
+		t.Fatalf("client call returned %v, want an orderclient.Error with status %d", err, want.Status)
+	}
+	if clientErr.StatusCode != want.Status {
+		t.Errorf("error status: want %d, got %d", want.Status, clientErr.StatusCode)
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(want.Body, &body) == nil && body.Error != "" && clientErr.Message != body.Error {
+		t.Errorf("error message: want %q, got %q", body.Error, clientErr.Message)
+	}
+}
+
+// marshalDecoded returns the json of what a client call decoded, the fields
+// it left empty are left out
+func marshalDecoded(value interface{}) ([]byte, error) {
+	if msg, ok := value.(proto.Message); ok {
+		return protojson.Marshal(msg)
+	}
+	return json.Marshal(value)
+}
+
+// decodedDiffs returns the values the client decoded, in the json got, that
+// are not those of the response want. The fields of the response the client
+// does not decode are not differences.
+func decodedDiffs(got, want []byte) []string {
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		return []string{fmt.Sprintf("decoded value is not json: %v", err)}
+	}
+	if err := json.Unmarshal(want, &wantValue); err != nil {
+		return []string{fmt.Sprintf("invalid example body: %v", err)}
+	}
+	return subsetDiffs("body", gotValue, wantValue)
+}
+
+func subsetDiffs(path string, got, want interface{}) []string {
+	switch g := got.(type) {
+	case map[string]interface{}:
+		w, ok := want.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: decoded an object from %s", path, describe(want))}
+		}
+		keys := make([]string, 0, len(g))
+		for key := range g {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var diffs []string
+		for _, key := range keys {
+			wantField, ok := w[key]
+			if !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s: decoded %s, not in the response", path, key, describe(g[key])))
+				continue
+			}
+			diffs = append(diffs, subsetDiffs(path+"."+key, g[key], wantField)...)
+		}
+		return diffs
+	case []interface{}:
+		w, ok := want.([]interface{})
+		if !ok || len(w) != len(g) {
+			return []string{fmt.Sprintf("%s: decoded %d items from %s", path, len(g), describe(want))}
+		}
+		var diffs []string
+		for i := range g {
+			diffs = append(diffs, subsetDiffs(fmt.Sprintf("%s[%d]", path, i), g[i], w[i])...)
+		}
+		return diffs
+	case string:
+		// protojson writes the 64 bit integers as strings
+		if n, ok := want.(float64); ok && g == strconv.FormatFloat(n, 'f', -1, 64) {
+			return nil
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		return []string{fmt.Sprintf("%s: decoded %s from %s", path, describe(got), describe(want))}
+	}
+	return nil
+}
+
+// describe returns the json of a value
+func describe(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
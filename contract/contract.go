@@ -0,0 +1,61 @@
+// Package contract holds the golden examples of the requests orderclient
+// sends and the responses the order service gives them. The service and the
+// client are both checked against the same files, so a change to either side
+// that the other does not follow fails their tests:
+//
+//	func TestServerContract(t *testing.T) { contract.RunServer(t) }
+//	func TestClientContract(t *testing.T) { contract.RunClient(t) }
+//
+// The examples are exchanges in the format recorded by package capture and run
+// against the fixtures of package testserver. Adding one takes a file in
+// golden/ and the client call sending its request in clientCalls.
+package contract
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/omnom-nom/order/capture"
+)
+
+//go:embed golden/*.json
+var golden embed.FS
+
+// Example is a golden request and the response the service gives it
+type Example struct {
+	// Name is the name of the file of the example, without its extension
+	Name string
+	capture.Exchange
+}
+
+// Examples returns the golden examples sorted by name
+func Examples() ([]*Example, error) {
+	entries, err := golden.ReadDir("golden")
+	if err != nil {
+		return nil, err
+	}
+	examples := make([]*Example, 0, len(entries))
+	for _, entry := range entries {
+		data, err := golden.ReadFile(path.Join("golden", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		example := &Example{Name: strings.TrimSuffix(entry.Name(), ".json")}
+		if err := json.Unmarshal(data, &example.Exchange); err != nil {
+			return nil, fmt.Errorf("invalid example %s: %v", entry.Name(), err)
+		}
+		examples = append(examples, example)
+	}
+	return examples, nil
+}
+
+// target returns the path and query of the request of e
+func (e *Example) target() string {
+	if e.Request.Query == "" {
+		return e.Request.Path
+	}
+	return e.Request.Path + "?" + e.Request.Query
+}
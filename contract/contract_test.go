@@ -0,0 +1,11 @@
+package contract_test
+
+import (
+	"testing"
+
+	"github.com/omnom-nom/order/contract"
+)
+
+func TestServerContract(t *testing.T) { contract.RunServer(t) }
+
+func TestClientContract(t *testing.T) { contract.RunClient(t) }
@@ -0,0 +1,53 @@
+package contract
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/omnom-nom/order/capture"
+	"github.com/omnom-nom/order/testserver"
+)
+
+// RunServer checks that the service answers every golden request with the
+// response of its example, each on a new test server started with opts
+// holding the fixtures. The ids, times and versions, which differ between
+// runs, are not compared.
+func RunServer(t *testing.T, opts ...testserver.Option) {
+	examples, err := Examples()
+	if err != nil {
+		t.Fatalf("failed to read the examples: %v", err)
+	}
+	for _, example := range examples {
+		example := example
+		t.Run(example.Name, func(t *testing.T) {
+			srv := testserver.Start(t, opts...)
+
+			var body io.Reader
+			if len(example.Request.Body) > 0 {
+				body = bytes.NewReader(example.Request.Body)
+			}
+			req, err := http.NewRequest(example.Request.Method, srv.URL+example.target(), body)
+			if err != nil {
+				t.Fatalf("invalid request: %v", err)
+			}
+			for key, values := range example.Request.Header {
+				req.Header[http.CanonicalHeaderKey(key)] = values
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", req.Method, example.target(), err)
+			}
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read the response: %v", err)
+			}
+
+			for _, diff := range capture.Compare(&example.Response, resp.StatusCode, data, capture.DefaultIgnore) {
+				t.Errorf("%s %s: %s", req.Method, example.target(), diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// Package cron runs the background tasks of the service on schedules: cron
+// expressions or fixed periods, delayed by a random jitter. A singleton task
+// runs on one instance at a time, the one holding its lease in the database.
+package cron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/cluster"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+	"github.com/omnom-nom/order/schedule"
+)
+
+const (
+	// lockPrefix prefixes the lease names of the singleton tasks
+	lockPrefix = "cron/"
+	// releaseTimeout bounds the release of the lease of a task
+	releaseTimeout = 5 * time.Second
+)
+
+// Func does the work of a task and returns a result marshalled to JSON, kept
+// as the result of the last run
+type Func func(ctx context.Context) (interface{}, error)
+
+// Run is the outcome of a run of a task
+type Run struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Skipped is set when another instance held the lease of the task
+	Skipped bool        `json:"skipped,omitempty"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// Status is the state of a task on an instance
+type Status struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// Singleton is set for the tasks run on one instance at a time
+	Singleton bool `json:"singleton"`
+	Running   bool `json:"running"`
+	// NextRunAt is the time of the next run, jitter included
+	NextRunAt *time.Time `json:"nextRunAt,omitempty"`
+	// LastRun is the last run started on this instance
+	LastRun *Run `json:"lastRun,omitempty"`
+	// Runs and Failures count the runs of the task on this instance since it
+	// started, the skipped ones left out
+	Runs     int64 `json:"runs"`
+	Failures int64 `json:"failures"`
+}
+
+// task is a scheduled func, its state is guarded by the mutex of its runner
+type task struct {
+	name      string
+	spec      schedule.Spec
+	singleton bool
+	fn        Func
+
+	next     time.Time
+	running  bool
+	last     *Run
+	runs     int64
+	failures int64
+}
+
+// Runner runs tasks on their schedules. Without a lease store, as with a
+// single instance, the singleton tasks run like the others.
+type Runner struct {
+	store  cluster.LeaseStore
+	holder string
+	cfg    config.CronConfig
+	logger logging.Logger
+
+	mu    sync.Mutex
+	tasks []*task
+}
+
+// NewRunner returns a runner of tasks scheduled by cfg, taking the leases of
+// the singleton tasks in store as holder, and logging with logger, the
+// default logger when nil
+func NewRunner(store cluster.LeaseStore, holder string, cfg config.CronConfig, logger logging.Logger) *Runner {
+	if logger == nil {
+		logger = logging.Default().Module(logging.ModuleCron)
+	}
+	return &Runner{store: store, holder: holder, cfg: cfg, logger: logger}
+}
+
+// Add schedules fn as the task name, on the schedule of the configuration for
+// name or else spec. It has to be called before Run.
+func (r *Runner) Add(name string, spec schedule.Spec, singleton bool, fn Func) error {
+	if configured, ok := r.cfg.Tasks[name]; ok {
+		parsed, err := schedule.ParseSpec(configured)
+		if err != nil {
+			return fmt.Errorf("schedule of task %s: %v", name, err)
+		}
+		spec = parsed
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, t := range r.tasks {
+		if t.name == name {
+			return fmt.Errorf("task %s is already scheduled", name)
+		}
+	}
+	r.tasks = append(r.tasks, &task{name: name, spec: spec, singleton: singleton, fn: fn})
+	return nil
+}
+
+// Statuses returns the state of the tasks in the order they were added
+func (r *Runner) Statuses() []Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := make([]Status, 0, len(r.tasks))
+	for _, t := range r.tasks {
+		status := Status{
+			Name:      t.name,
+			Schedule:  t.spec.String(),
+			Singleton: t.singleton,
+			Running:   t.running,
+			Runs:      t.runs,
+			Failures:  t.failures,
+		}
+		if !t.next.IsZero() {
+			next := t.next
+			status.NextRunAt = &next
+		}
+		if t.last != nil {
+			last := *t.last
+			status.LastRun = &last
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Run runs the tasks on their schedules until ctx is done
+func (r *Runner) Run(ctx context.Context) {
+	r.mu.Lock()
+	tasks := append([]*task(nil), r.tasks...)
+	r.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		wg.Add(1)
+		go func(t *task) {
+			defer wg.Done()
+			r.loop(ctx, t)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// loop runs t at the times of its schedule until ctx is done
+func (r *Runner) loop(ctx context.Context, t *task) {
+	for {
+		now := time.Now()
+		next := t.spec.Next(now)
+		if next.IsZero() {
+			r.logger.Warnf("task %s has no next run on schedule %s", t.name, t.spec)
+			return
+		}
+		next = next.Add(r.jitter(next.Sub(now)))
+		r.mu.Lock()
+		t.next = next.UTC()
+		r.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		r.run(ctx, t)
+	}
+}
+
+// jitter returns a random delay up to the configured jitter, at most a tenth
+// of period
+func (r *Runner) jitter(period time.Duration) time.Duration {
+	max := r.cfg.Jitter.Duration
+	if max > period/10 {
+		max = period / 10
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// run runs t once, under its lease when it is a singleton
+func (r *Runner) run(ctx context.Context, t *task) {
+	run := &Run{StartedAt: time.Now().UTC()}
+	if t.singleton && r.store != nil {
+		lease, err := cluster.Acquire(ctx, r.store, lockPrefix+t.name, r.holder, "", r.cfg.LockTTL.Duration)
+		if errors.Is(err, cluster.ErrLeaseHeld) {
+			r.logger.Debugf("skipped task %s, another instance runs it", t.name)
+			run.Skipped = true
+			r.finish(t, run)
+			return
+		}
+		if err != nil {
+			r.logger.Errorf("failed to take the lease of task %s: %v", t.name, err)
+			run.Error = err.Error()
+			r.finish(t, run)
+			return
+		}
+		var release func()
+		ctx, release = r.hold(ctx, t, lease)
+		defer release()
+	}
+
+	r.mu.Lock()
+	t.running = true
+	r.mu.Unlock()
+	result, err := t.fn(ctx)
+	run.Result = result
+	if err != nil {
+		r.logger.Errorf("task %s failed: %v", t.name, err)
+		run.Error = err.Error()
+	}
+	r.finish(t, run)
+}
+
+// finish records run as the last run of t
+func (r *Runner) finish(t *task, run *Run) {
+	run.FinishedAt = time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.running = false
+	t.last = run
+	if run.Skipped {
+		return
+	}
+	t.runs++
+	if run.Error != "" {
+		t.failures++
+	}
+}
+
+// hold renews lease while the run of t goes on. It returns the context of the
+// run, cancelled when the lease is lost, and the func releasing the lease.
+func (r *Runner) hold(ctx context.Context, t *task, lease *cluster.Lease) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(r.cfg.LockTTL.Duration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			renewed, err := cluster.Acquire(ctx, r.store, lease.Name, r.holder, "", r.cfg.LockTTL.Duration)
+			if errors.Is(err, cluster.ErrLeaseHeld) {
+				r.logger.Warnf("lost the lease of task %s, stopping it", t.name)
+				cancel()
+				return
+			}
+			if err != nil {
+				// the lease is held until it expires, the next renewal may succeed
+				r.logger.Errorf("failed to renew the lease of task %s: %v", t.name, err)
+				continue
+			}
+			lease = renewed
+		}
+	}()
+
+	return ctx, func() {
+		close(done)
+		cancel()
+		<-stopped
+		// the lease is released even when the service is stopping
+		releaseCtx, stop := context.WithTimeout(context.Background(), releaseTimeout)
+		defer stop()
+		if err := cluster.Release(releaseCtx, r.store, lease); err != nil {
+			r.logger.Errorf("failed to release the lease of task %s: %v", t.name, err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package documents renders the documents handed to customers with their
+// orders, invoices and packing slips, as html and pdf from the templates of the
+// documents, with the branding of the tenant of the order.
+package documents
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// the documents of an order
+const (
+	Invoice     = "invoice"
+	PackingSlip = "packingSlip"
+)
+
+// Documents lists every document
+var Documents = []string{Invoice, PackingSlip}
+
+// the formats documents are rendered in
+const (
+	FormatHTML = "html"
+	FormatPDF  = "pdf"
+)
+
+// ErrUnknownFormat is returned when rendering a document in a format other than
+// html and pdf
+var ErrUnknownFormat = errors.New("unknown document format")
+
+// ContentType returns the media type of the documents rendered in format
+func ContentType(format string) string {
+	if format == FormatPDF {
+		return "application/pdf"
+	}
+	return "text/html; charset=utf-8"
+}
+
+// Item is a line item of the order of a document. The amounts are empty on
+// packing slips.
+type Item struct {
+	SKU       string
+	Name      string
+	Quantity  int
+	UnitPrice string
+	Total     string
+}
+
+// Shipment is a parcel of the order of a document
+type Shipment struct {
+	Carrier        string
+	TrackingNumber string
+}
+
+// Data is what the templates of a document render. The amounts are written
+// with their currency, such as 18.50 EUR, and those the order does not have,
+// such as a discount, are empty.
+type Data struct {
+	// Document is invoice or packingSlip
+	Document string
+	// Brand is the branding of the tenant of the order
+	Brand    config.Branding
+	OrderID  string
+	Status   string
+	PlacedAt time.Time
+	// IssuedAt is the time the document was rendered
+	IssuedAt   time.Time
+	CustomerID string
+	// PurchaseOrder is the number of the purchase order of the customer
+	PurchaseOrder string
+	// TermsDays are the net terms of the invoice of an order paid on account,
+	// 0 for the orders paid when placed
+	TermsDays int
+	DueAt     time.Time
+	// AmountDue is what the invoice of an order on account asks for, the
+	// total less what its gift cards and store credit paid
+	AmountDue string
+	// ShippingAddress is the lines of the address the order ships to
+	ShippingAddress []string
+	Items           []Item
+	Subtotal        string
+	Discount        string
+	Shipping        string
+	// TaxRate is the percentage of the tax, such as 8.25
+	TaxRate   float64
+	Tax       string
+	Total     string
+	Shipments []Shipment
+}
+
+// funcs are the functions of the templates
+var funcs = map[string]interface{}{
+	// lines splits a text of several lines, such as the address of the brand
+	"lines": func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSpace(s), "\n")
+	},
+	"date": func(t time.Time) string {
+		return t.Format("2006-01-02")
+	},
+}
+
+// Renderer renders the documents of orders
+type Renderer struct {
+	branding config.Branding
+	tenants  map[string]config.Branding
+	html     map[string]*htmltemplate.Template
+	pdf      map[string]*texttemplate.Template
+}
+
+// NewRenderer returns the renderer of the built-in templates, replaced by the
+// templates of cfg, with the branding of cfg
+func NewRenderer(cfg *config.DocumentsConfig) (*Renderer, error) {
+	for document := range cfg.Templates {
+		if !known(document) {
+			return nil, fmt.Errorf("template of unknown document %q", document)
+		}
+	}
+	r := &Renderer{
+		branding: cfg.Branding,
+		tenants:  cfg.Tenants,
+		html:     map[string]*htmltemplate.Template{},
+		pdf:      map[string]*texttemplate.Template{},
+	}
+	for _, document := range Documents {
+		source := defaultTemplates[document]
+		if override := cfg.Templates[document]; override.HTML != "" {
+			source.HTML = override.HTML
+		}
+		if override := cfg.Templates[document]; override.PDF != "" {
+			source.PDF = override.PDF
+		}
+		var err error
+		if r.html[document], err = htmltemplate.New(document).Funcs(funcs).Parse(source.HTML); err != nil {
+			return nil, fmt.Errorf("html template of %s: %v", document, err)
+		}
+		if r.pdf[document], err = texttemplate.New(document).Funcs(funcs).Parse(source.PDF); err != nil {
+			return nil, fmt.Errorf("pdf template of %s: %v", document, err)
+		}
+	}
+	return r, nil
+}
+
+// known reports whether document is one of Documents
+func known(document string) bool {
+	for _, d := range Documents {
+		if d == document {
+			return true
+		}
+	}
+	return false
+}
+
+// Branding returns the branding of tenant, that of the configuration for the
+// fields the tenant does not set
+func (r *Renderer) Branding(tenant string) config.Branding {
+	b := r.branding
+	t, ok := r.tenants[tenant]
+	if !ok || tenant == "" {
+		return b
+	}
+	for _, field := range []struct {
+		dst *string
+		src string
+	}{
+		{&b.Name, t.Name},
+		{&b.Address, t.Address},
+		{&b.Email, t.Email},
+		{&b.Website, t.Website},
+		{&b.TaxID, t.TaxID},
+		{&b.LogoURL, t.LogoURL},
+		{&b.Color, t.Color},
+		{&b.Footer, t.Footer},
+	} {
+		if field.src != "" {
+			*field.dst = field.src
+		}
+	}
+	return b
+}
+
+// Render renders data as its document in format, with the branding of tenant
+func (r *Renderer) Render(format, tenant string, data *Data) ([]byte, error) {
+	if !known(data.Document) {
+		return nil, fmt.Errorf("unknown document %q", data.Document)
+	}
+	data.Brand = r.Branding(tenant)
+	var buf bytes.Buffer
+	switch format {
+	case FormatHTML:
+		if err := r.html[data.Document].Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("html template of %s: %v", data.Document, err)
+		}
+		return buf.Bytes(), nil
+	case FormatPDF:
+		if err := r.pdf[data.Document].Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("pdf template of %s: %v", data.Document, err)
+		}
+		return writePDF(buf.String(), data.Brand)
+	}
+	return nil, ErrUnknownFormat
+}
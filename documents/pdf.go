@@ -0,0 +1,235 @@
+package documents
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// the page of the pdf documents, A4 in points
+const (
+	pageWidth    = 595.0
+	pageHeight   = 842.0
+	pageMargin   = 50.0
+	columnWidth  = 90.0
+	footerHeight = 30.0
+)
+
+// the fonts of the pdf documents, the standard fonts every reader has
+const (
+	fontRegular = "F1"
+	fontBold    = "F2"
+)
+
+// helveticaWidths are the widths of the printable ASCII characters of
+// Helvetica in thousandths of the font size, those of Helvetica-Bold are taken
+// to be 5% wider
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+// textWidth returns the width of s set in font at size
+func textWidth(s string, font string, size float64) float64 {
+	var w int
+	for _, c := range s {
+		if c >= 32 && c < 127 {
+			w += helveticaWidths[c-32]
+		} else {
+			w += 556
+		}
+	}
+	width := float64(w) * size / 1000
+	if font == fontBold {
+		width *= 1.05
+	}
+	return width
+}
+
+// winAnsi returns s in the WinAnsiEncoding of the standard fonts, with the
+// characters it does not have replaced by ?, escaped for a pdf string
+func winAnsi(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c >= 32 && c < 127:
+			b.WriteRune(c)
+		case c == '€':
+			b.WriteString(`\200`)
+		case c >= 0xa0 && c <= 0xff:
+			fmt.Fprintf(&b, `\%03o`, c)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// rgb returns the pdf color components of a #rrggbb color, black when it is
+// not one
+func rgb(color string) string {
+	v, err := strconv.ParseUint(strings.TrimPrefix(color, "#"), 16, 32)
+	if len(color) != 7 || err != nil {
+		return "0 0 0"
+	}
+	return fmt.Sprintf("%.3f %.3f %.3f", float64(v>>16&0xff)/255, float64(v>>8&0xff)/255, float64(v&0xff)/255)
+}
+
+// pdfLayout lays the lines of a document out on pages
+type pdfLayout struct {
+	brand  config.Branding
+	accent string
+	pages  []*bytes.Buffer
+	page   *bytes.Buffer
+	y      float64
+}
+
+// newPage starts a page, closing the current one with the footer
+func (l *pdfLayout) newPage() {
+	l.closePage()
+	l.page = &bytes.Buffer{}
+	l.pages = append(l.pages, l.page)
+	l.y = pageHeight - pageMargin
+}
+
+// closePage writes the footer of the brand at the bottom of the current page
+func (l *pdfLayout) closePage() {
+	if l.page == nil {
+		return
+	}
+	footer := l.brand.Footer
+	if footer != "" {
+		footer += "  -  "
+	}
+	footer += fmt.Sprintf("Page %d", len(l.pages))
+	l.text(pageMargin, pageMargin-footerHeight/2, fontRegular, 8, "0.4 0.4 0.4", footer)
+}
+
+// text writes s at x, y
+func (l *pdfLayout) text(x, y float64, font string, size float64, color, s string) {
+	fmt.Fprintf(l.page, "BT %s rg /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", color, font, size, x, y, winAnsi(s))
+}
+
+// advance moves down by height, on a new page when the current one is full
+func (l *pdfLayout) advance(height float64) {
+	if l.y-height < pageMargin+footerHeight {
+		l.newPage()
+	}
+	l.y -= height
+}
+
+// wrap splits s in lines no wider than width
+func wrap(s, font string, size, width float64) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if line != "" && textWidth(candidate, font, size) > width {
+			lines = append(lines, line)
+			candidate = word
+		}
+		line = candidate
+	}
+	return append(lines, line)
+}
+
+// line lays out a line of the template
+func (l *pdfLayout) line(s string) {
+	font, size, color := fontRegular, 10.0, "0 0 0"
+	switch {
+	case strings.TrimSpace(s) == "":
+		l.advance(6)
+		return
+	case s == "---":
+		l.advance(8)
+		fmt.Fprintf(l.page, "%s RG 0.5 w %.2f %.2f m %.2f %.2f l S\n", l.accent, pageMargin, l.y+4, pageWidth-pageMargin, l.y+4)
+		return
+	case strings.HasPrefix(s, "# "):
+		s, font, size, color = s[2:], fontBold, 20, l.accent
+	case strings.HasPrefix(s, "## "):
+		s, font, size = s[3:], fontBold, 11
+	}
+
+	cells := strings.Split(s, "\t")
+	// the first cell takes the width the columns of the others leave
+	width := pageWidth - 2*pageMargin - float64(len(cells)-1)*columnWidth
+	lines := wrap(cells[0], font, size, width)
+	for i, text := range lines {
+		l.advance(size * 1.4)
+		l.text(pageMargin, l.y, font, size, color, text)
+		if i > 0 {
+			continue
+		}
+		for j, cell := range cells[1:] {
+			if cell == "" {
+				continue
+			}
+			right := pageWidth - pageMargin - float64(len(cells)-2-j)*columnWidth
+			l.text(right-textWidth(cell, font, size), l.y, font, size, color, cell)
+		}
+	}
+}
+
+// writePDF returns the pdf document of the lines of text, with the accent
+// color and footer of brand
+func writePDF(text string, brand config.Branding) ([]byte, error) {
+	l := &pdfLayout{brand: brand, accent: rgb(brand.Color)}
+	l.newPage()
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		l.line(strings.TrimRight(line, " \r"))
+	}
+	l.closePage()
+
+	// objects 1 to 4 are the catalog, the page tree and the fonts, each page
+	// is then followed by its content stream
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(l.pages))
+	for i := range l.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(l.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range l.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %g %g] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, fontRegular, fontBold, 6+2*i))
+		var content bytes.Buffer
+		w := zlib.NewWriter(&content)
+		if _, err := w.Write(page.Bytes()); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes(), nil
+}
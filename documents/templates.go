@@ -0,0 +1,132 @@
+package documents
+
+import "github.com/omnom-nom/order/config"
+
+// htmlStyle is the style sheet of the built-in html templates
+const htmlStyle = `<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; color: #222; margin: 40px; }
+h1 { margin: 0 0 4px; }
+table { width: 100%; border-collapse: collapse; margin: 24px 0; }
+th, td { padding: 6px 4px; border-bottom: 1px solid #ddd; text-align: left; }
+.amount { text-align: right; }
+.muted { color: #666; }
+header { display: flex; justify-content: space-between; border-bottom: 3px solid; padding-bottom: 16px; }
+footer { margin-top: 40px; color: #666; font-size: 12px; }
+</style>`
+
+// htmlHeader is the seller heading the built-in html templates
+const htmlHeader = `<header style="border-color: {{.Brand.Color}}">
+<div>
+{{if .Brand.LogoURL}}<img src="{{.Brand.LogoURL}}" alt="{{.Brand.Name}}" height="48"><br>{{end}}
+<strong>{{.Brand.Name}}</strong><br>
+{{range lines .Brand.Address}}{{.}}<br>{{end}}
+{{if .Brand.Email}}{{.Brand.Email}}<br>{{end}}
+{{if .Brand.Website}}{{.Brand.Website}}{{end}}
+</div>
+<div class="amount">
+<h1 style="color: {{.Brand.Color}}">{{template "title" .}}</h1>
+Order {{.OrderID}}<br>
+Placed {{date .PlacedAt}}<br>
+<span class="muted">Issued {{date .IssuedAt}}</span>
+</div>
+</header>
+{{if .PurchaseOrder}}<p>Purchase order {{.PurchaseOrder}}</p>{{end}}
+{{if .ShippingAddress}}<p><strong>Ship to</strong><br>{{range .ShippingAddress}}{{.}}<br>{{end}}</p>{{end}}`
+
+// htmlFooter is the footer of the built-in html templates
+const htmlFooter = `{{if .Brand.Footer}}<footer>{{.Brand.Footer}}</footer>{{end}}`
+
+// defaultTemplates are the templates of the documents the configuration does
+// not replace.
+//
+// The pdf templates write the lines of the document: a line starting with "# "
+// is its title and one starting with "## " a heading, "---" draws a rule, and
+// the cells of a line separated by tabs are laid out as a table, the first one
+// on the left and the others right-aligned in columns. The footer of the brand
+// closes every page.
+var defaultTemplates = map[string]config.DocumentTemplate{
+	Invoice: {
+		HTML: `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Invoice {{.OrderID}}</title>` + htmlStyle + `</head>
+<body>
+{{define "title"}}Invoice{{end}}` + htmlHeader + `
+{{if .Brand.TaxID}}<p class="muted">Tax ID {{.Brand.TaxID}}</p>{{end}}
+{{if .TermsDays}}<p><strong>Payment terms</strong> Net {{.TermsDays}}, due {{date .DueAt}}</p>{{end}}
+<table>
+<tr><th>Item</th><th class="amount">Quantity</th><th class="amount">Unit price</th><th class="amount">Amount</th></tr>
+{{range .Items}}<tr><td>{{if .Name}}{{.Name}}{{else}}{{.SKU}}{{end}}<br><span class="muted">{{.SKU}}</span></td><td class="amount">{{.Quantity}}</td><td class="amount">{{.UnitPrice}}</td><td class="amount">{{.Total}}</td></tr>
+{{end}}
+<tr><td colspan="3" class="amount">Subtotal</td><td class="amount">{{.Subtotal}}</td></tr>
+{{if .Discount}}<tr><td colspan="3" class="amount">Discount</td><td class="amount">-{{.Discount}}</td></tr>{{end}}
+{{if .Shipping}}<tr><td colspan="3" class="amount">Shipping</td><td class="amount">{{.Shipping}}</td></tr>{{end}}
+{{if .Tax}}<tr><td colspan="3" class="amount">Tax ({{.TaxRate}}%)</td><td class="amount">{{.Tax}}</td></tr>{{end}}
+<tr><th colspan="3" class="amount">Total</th><th class="amount">{{.Total}}</th></tr>
+{{if .TermsDays}}<tr><th colspan="3" class="amount">Amount due {{date .DueAt}}</th><th class="amount">{{.AmountDue}}</th></tr>{{end}}
+</table>
+` + htmlFooter + `
+</body>
+</html>
+`,
+		PDF: `# Invoice
+{{.Brand.Name}}
+{{range lines .Brand.Address}}{{.}}
+{{end}}{{if .Brand.TaxID}}Tax ID {{.Brand.TaxID}}
+{{end}}
+Order {{.OrderID}}	Placed {{date .PlacedAt}}
+Issued {{date .IssuedAt}}
+{{if .PurchaseOrder}}Purchase order {{.PurchaseOrder}}
+{{end}}{{if .TermsDays}}Payment terms Net {{.TermsDays}}, due {{date .DueAt}}
+{{end}}{{if .ShippingAddress}}
+## Ship to
+{{range .ShippingAddress}}{{.}}
+{{end}}{{end}}
+---
+Item	Quantity	Unit price	Amount
+---
+{{range .Items}}{{if .Name}}{{.Name}}{{else}}{{.SKU}}{{end}}	{{.Quantity}}	{{.UnitPrice}}	{{.Total}}
+{{end}}---
+Subtotal			{{.Subtotal}}
+{{if .Discount}}Discount			-{{.Discount}}
+{{end}}{{if .Shipping}}Shipping			{{.Shipping}}
+{{end}}{{if .Tax}}Tax ({{.TaxRate}}%)			{{.Tax}}
+{{end}}## Total			{{.Total}}
+{{if .TermsDays}}## Amount due {{date .DueAt}}			{{.AmountDue}}
+{{end}}`,
+	},
+	PackingSlip: {
+		HTML: `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Packing slip {{.OrderID}}</title>` + htmlStyle + `</head>
+<body>
+{{define "title"}}Packing slip{{end}}` + htmlHeader + `
+<table>
+<tr><th>Item</th><th>SKU</th><th class="amount">Quantity</th></tr>
+{{range .Items}}<tr><td>{{.Name}}</td><td>{{.SKU}}</td><td class="amount">{{.Quantity}}</td></tr>
+{{end}}
+</table>
+{{if .Shipments}}<p><strong>Shipments</strong><br>{{range .Shipments}}{{.Carrier}} {{.TrackingNumber}}<br>{{end}}</p>{{end}}
+` + htmlFooter + `
+</body>
+</html>
+`,
+		PDF: `# Packing slip
+{{.Brand.Name}}
+{{range lines .Brand.Address}}{{.}}
+{{end}}
+Order {{.OrderID}}	Placed {{date .PlacedAt}}
+{{if .PurchaseOrder}}Purchase order {{.PurchaseOrder}}
+{{end}}{{if .ShippingAddress}}
+## Ship to
+{{range .ShippingAddress}}{{.}}
+{{end}}{{end}}
+---
+Item	SKU	Quantity
+---
+{{range .Items}}{{.Name}}	{{.SKU}}	{{.Quantity}}
+{{end}}{{if .Shipments}}
+## Shipments
+{{range .Shipments}}{{.Carrier}}	{{.TrackingNumber}}
+{{end}}{{end}}`,
+	},
+}
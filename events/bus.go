@@ -0,0 +1,249 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/omnom-nom/order/logging"
+)
+
+// Policy decides what Publish does when the buffer of a subscriber is full
+type Policy int
+
+const (
+	// Block makes Publish wait for room, or for its context to be done
+	Block Policy = iota
+	// DropNewest discards the event being published
+	DropNewest
+	// DropOldest discards the oldest buffered event to make room
+	DropOldest
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	}
+	return "unknown"
+}
+
+// Handler processes the events of a subscription, one at a time
+type Handler func(ctx context.Context, event *Event)
+
+// SubscribeOptions configures a subscription
+type SubscribeOptions struct {
+	// Name identifies the subscriber in logs
+	Name string
+	// Types filters the events delivered, all when empty
+	Types []Type
+	// Buffer is the number of events queued for the subscriber, at least 1
+	Buffer int
+	Policy Policy
+}
+
+// Subscription is the registration of a handler with a bus
+type Subscription struct {
+	bus     *Bus
+	opts    SubscribeOptions
+	handler Handler
+	queue   chan *Event
+	// mu guards queue against being closed while published to
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	delivered uint64
+	dropped   uint64
+}
+
+// Stats returns the number of events handled and dropped by the subscription
+func (s *Subscription) Stats() (delivered, dropped uint64) {
+	return atomic.LoadUint64(&s.delivered), atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops delivering events and waits until the buffered ones are handled
+func (s *Subscription) Unsubscribe() {
+	s.bus.remove(s)
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+func (s *Subscription) wants(event *Event) bool {
+	if len(s.opts.Types) == 0 {
+		return true
+	}
+	for _, t := range s.opts.Types {
+		if t == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// offer queues event following the policy of the subscription
+func (s *Subscription) offer(ctx context.Context, event *Event) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	select {
+	case s.queue <- event:
+		return
+	default:
+	}
+
+	switch s.opts.Policy {
+	case Block:
+		select {
+		case s.queue <- event:
+		case <-ctx.Done():
+			s.drop(event)
+		}
+	case DropNewest:
+		s.drop(event)
+	case DropOldest:
+		for {
+			select {
+			case old := <-s.queue:
+				s.drop(old)
+			default:
+			}
+			select {
+			case s.queue <- event:
+				return
+			default:
+			}
+		}
+	}
+}
+
+func (s *Subscription) drop(event *Event) {
+	atomic.AddUint64(&s.dropped, 1)
+	s.bus.logger.WithField("subscriber", s.opts.Name).Warnf("dropped %s event %s of order %s, the subscriber is behind", event.Type, event.ID, event.OrderID)
+	if onDrop := s.bus.dropHandler(); onDrop != nil {
+		onDrop(s.opts.Name, event)
+	}
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+	for event := range s.queue {
+		s.handle(event)
+	}
+}
+
+func (s *Subscription) handle(event *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.bus.logger.WithField("subscriber", s.opts.Name).Errorf("event handler panicked: %v", r)
+		}
+	}()
+	s.handler(s.bus.ctx, event)
+	atomic.AddUint64(&s.delivered, 1)
+}
+
+// Bus fans events out to subscribers. Every subscriber has its own buffer and
+// goroutine, so a slow subscriber only delays the others under the Block policy.
+type Bus struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	logger logging.Logger
+
+	mu     sync.RWMutex
+	subs   map[*Subscription]struct{}
+	onDrop func(subscriber string, event *Event)
+}
+
+// NewBus returns a bus without subscribers logging dropped events and
+// panicking handlers with logger, the default logger when nil
+func NewBus(logger logging.Logger) *Bus {
+	if logger == nil {
+		logger = logging.Default().Module(logging.ModuleEvents)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Bus{ctx: ctx, cancel: cancel, logger: logger, subs: map[*Subscription]struct{}{}}
+}
+
+// Subscribe registers handler for the events selected by opts
+func (b *Bus) Subscribe(opts SubscribeOptions, handler Handler) *Subscription {
+	if opts.Buffer < 1 {
+		opts.Buffer = 1
+	}
+	s := &Subscription{
+		bus:     b,
+		opts:    opts,
+		handler: handler,
+		queue:   make(chan *Event, opts.Buffer),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+
+	b.mu.Lock()
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// OnDrop sets a func called with every event a subscriber drops, e.g. to count them
+func (b *Bus) OnDrop(fn func(subscriber string, event *Event)) {
+	b.mu.Lock()
+	b.onDrop = fn
+	b.mu.Unlock()
+}
+
+func (b *Bus) dropHandler() func(string, *Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.onDrop
+}
+
+func (b *Bus) remove(s *Subscription) {
+	b.mu.Lock()
+	delete(b.subs, s)
+	b.mu.Unlock()
+}
+
+// Publish hands event to every interested subscriber. It only blocks for
+// subscribers with the Block policy whose buffer is full, at most until ctx is done.
+func (b *Bus) Publish(ctx context.Context, event *Event) {
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		if s.wants(event) {
+			s.offer(ctx, event)
+		}
+	}
+}
+
+// Close unsubscribes everyone, waiting for buffered events to be handled, and
+// then cancels the context given to handlers
+func (b *Bus) Close() {
+	b.mu.RLock()
+	subs := make([]*Subscription, 0, len(b.subs))
+	for s := range b.subs {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		s.Unsubscribe()
+	}
+	b.cancel()
+}
@@ -0,0 +1,65 @@
+// Package events defines the order lifecycle events and an in-process bus
+// fanning them out to subscribers.
+package events
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Type is the kind of an order event
+type Type string
+
+// order lifecycle event types
+const (
+	OrderCreated   Type = "OrderCreated"
+	OrderUpdated   Type = "OrderUpdated"
+	OrderCancelled Type = "OrderCancelled"
+	OrderDeleted   Type = "OrderDeleted"
+	// OrderEdited is recorded when the items, address or discounts of an order change
+	OrderEdited Type = "OrderEdited"
+	// OrderRestored is recorded when a deleted order is restored within its retention
+	OrderRestored Type = "OrderRestored"
+	// OrderArchived is recorded when an order is moved from the database to the archive
+	OrderArchived Type = "OrderArchived"
+	// OrderOverdue is recorded when an order keeps its status for longer than its SLA
+	OrderOverdue Type = "OrderOverdue"
+)
+
+// return lifecycle event types, their payload is the return
+const (
+	ReturnRequested Type = "ReturnRequested"
+	ReturnApproved  Type = "ReturnApproved"
+	ReturnRejected  Type = "ReturnRejected"
+	ReturnShipped   Type = "ReturnShipped"
+	ReturnReceived  Type = "ReturnReceived"
+	ReturnRefunded  Type = "ReturnRefunded"
+)
+
+// Types lists every event type
+var Types = []Type{
+	OrderCreated, OrderUpdated, OrderCancelled, OrderDeleted, OrderEdited, OrderRestored, OrderArchived, OrderOverdue,
+	ReturnRequested, ReturnApproved, ReturnRejected, ReturnShipped, ReturnReceived, ReturnRefunded,
+}
+
+// Known reports whether t is one of Types
+func (t Type) Known() bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is a change of an order, the payload is the order, or the return of the
+// order for return events, as json after the change
+type Event struct {
+	ID        string          `json:"id" dynamodbav:"eventId"`
+	OrderID   string          `json:"orderId" dynamodbav:"orderId"`
+	Type      Type            `json:"type" dynamodbav:"type"`
+	Payload   json.RawMessage `json:"payload" dynamodbav:"payload"`
+	CreatedAt time.Time       `json:"createdAt" dynamodbav:"createdAt"`
+	// TenantID is the tenant of the order, only its webhooks receive the event
+	TenantID string `json:"tenantId,omitempty" dynamodbav:"tenantId,omitempty"`
+}
@@ -0,0 +1,138 @@
+// Package fraud screens new orders for fraud, with the rules of the
+// configuration or with a service plugged in as a Checker.
+package fraud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// Verdict is the outcome of the screening of an order
+type Verdict string
+
+const (
+	// VerdictApprove lets the order through
+	VerdictApprove Verdict = "approve"
+	// VerdictReview holds the order until a reviewer releases or rejects it
+	VerdictReview Verdict = "review"
+	// VerdictReject refuses the order
+	VerdictReject Verdict = "reject"
+)
+
+// severity ranks the verdicts, the most severe verdict of the rules wins
+var severity = map[Verdict]int{
+	VerdictApprove: 0,
+	VerdictReview:  1,
+	VerdictReject:  2,
+}
+
+// Valid reports whether v is one of the verdicts
+func (v Verdict) Valid() bool {
+	_, ok := severity[v]
+	return ok
+}
+
+// Address is the part of the shipping address the screening looks at
+type Address struct {
+	Country    string
+	PostalCode string
+}
+
+// Request asks to screen a new order
+type Request struct {
+	OrderID    string
+	CustomerID string
+	Amount     float64
+	// ShippingAddress is nil for orders that do not ship
+	ShippingAddress *Address
+}
+
+// Decision is the verdict on an order and the reasons for it
+type Decision struct {
+	Verdict Verdict
+	Reasons []string
+}
+
+// add records reason, making the verdict verdict unless it is already more severe
+func (d *Decision) add(verdict Verdict, reason string) {
+	if severity[verdict] > severity[d.Verdict] {
+		d.Verdict = verdict
+	}
+	d.Reasons = append(d.Reasons, reason)
+}
+
+// Checker screens orders. The service calls it with the timeout of the
+// configuration while an order is created, or right after with the async mode.
+type Checker interface {
+	Check(ctx context.Context, req *Request) (*Decision, error)
+}
+
+// History tells the rules about the past of the customer of an order
+type History interface {
+	// RecentOrders counts the orders of the customer of req created since since,
+	// the order of req left out
+	RecentOrders(ctx context.Context, req *Request, since time.Time) (int, error)
+	// Countries returns the countries of the addresses the customer of req
+	// keeps, none when they are not known
+	Countries(ctx context.Context, req *Request) ([]string, error)
+}
+
+// Rules is the default Checker, applying the thresholds of its configuration
+type Rules struct {
+	cfg     config.FraudRulesConfig
+	history History
+	now     func() time.Time
+}
+
+// NewRules returns the rules of cfg, looking up the past of customers in history
+func NewRules(cfg *config.FraudRulesConfig, history History) *Rules {
+	return &Rules{cfg: *cfg, history: history, now: time.Now}
+}
+
+// Check rejects orders from RejectAmount on and holds those from ReviewAmount
+// on, those of customers that placed VelocityLimit orders within
+// VelocityWindow, and with AddressMismatch those shipping to a country none of
+// the addresses of their customer is in
+func (r *Rules) Check(ctx context.Context, req *Request) (*Decision, error) {
+	decision := &Decision{Verdict: VerdictApprove}
+	switch {
+	case r.cfg.RejectAmount > 0 && req.Amount >= r.cfg.RejectAmount:
+		decision.add(VerdictReject, fmt.Sprintf("amount %.2f is at least %.2f", req.Amount, r.cfg.RejectAmount))
+	case r.cfg.ReviewAmount > 0 && req.Amount >= r.cfg.ReviewAmount:
+		decision.add(VerdictReview, fmt.Sprintf("amount %.2f is at least %.2f", req.Amount, r.cfg.ReviewAmount))
+	}
+
+	if r.cfg.VelocityLimit > 0 {
+		recent, err := r.history.RecentOrders(ctx, req, r.now().Add(-r.cfg.VelocityWindow.Duration))
+		if err != nil {
+			return nil, fmt.Errorf("failed to count the recent orders of customer %s: %v", req.CustomerID, err)
+		}
+		if recent >= r.cfg.VelocityLimit {
+			decision.add(VerdictReview, fmt.Sprintf("customer placed %d orders within %s", recent, r.cfg.VelocityWindow.Duration))
+		}
+	}
+
+	if r.cfg.AddressMismatch && req.ShippingAddress != nil && req.ShippingAddress.Country != "" {
+		countries, err := r.history.Countries(ctx, req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the addresses of customer %s: %v", req.CustomerID, err)
+		}
+		if len(countries) > 0 && !containsFold(countries, req.ShippingAddress.Country) {
+			decision.add(VerdictReview, fmt.Sprintf("ships to %s, none of the addresses of the customer is there", req.ShippingAddress.Country))
+		}
+	}
+	return decision, nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+// Package httpclient builds the clients of the http calls the service makes to
+// other services. The clients share one pooled transport bounding the
+// connections to a host, and their calls are instrumented: they are counted and
+// timed by client, pass on the request id of their context and trace whether
+// they reused a pooled connection.
+package httpclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// RequestIDHeader carries the request id the calls are made for
+const RequestIDHeader = "X-Request-Id"
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "order",
+		Subsystem: "outbound",
+		Name:      "request_duration_seconds",
+		Help:      "Outbound http calls by client, method and status code, error without a response.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client", "method", "code"})
+	connections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "order",
+		Subsystem: "outbound",
+		Name:      "connections_total",
+		Help:      "Connections taken by outbound http calls by client and origin (new, reused).",
+	}, []string{"client", "origin"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, connections)
+}
+
+// ErrNonPublicAddress is returned by the calls of a public client to an
+// address that is not public
+var ErrNonPublicAddress = errors.New("address is not public")
+
+// nonPublicPrefixes are the ranges beyond the loopback, private, link-local
+// and multicast ones of the net package that no public host has
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// IsPublicAddress reports whether addr is a global unicast address of the
+// internet rather than of the loopback, a private network, a link, such as
+// the cloud metadata endpoint, or a reserved range
+func IsPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic is the Control of the dialer of the public clients, it refuses
+// to connect to an address that is not public, whatever the host name of the
+// url resolved to and wherever a redirect led
+func dialPublic(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !IsPublicAddress(addr) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+	}
+	return nil
+}
+
+// Factory builds the clients of the outbound calls
+type Factory struct {
+	transport *http.Transport
+	// public is the transport of the public clients
+	public    *http.Transport
+	requestID func(ctx context.Context) string
+}
+
+// New returns a factory of clients sharing a transport with the settings of
+// cfg. requestID returns the request id of the context of a call, passed on in
+// the RequestIDHeader; nil passes none.
+func New(cfg config.OutboundConfig, requestID func(ctx context.Context) string) (*Factory, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			// the error of url.Parse quotes the url, which may carry credentials
+			return nil, fmt.Errorf("invalid outbound proxy url: %v", errors.Unwrap(err))
+		}
+		proxy = http.ProxyURL(u)
+	}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   cfg.DialTimeout.Duration,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout.Duration,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout.Duration,
+		ExpectContinueTimeout: time.Second,
+	}
+	// the public clients connect to the hosts themselves, a proxy would be
+	// the address checked instead of the host
+	public := transport.Clone()
+	public.Proxy = nil
+	public.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout.Duration,
+		KeepAlive: 30 * time.Second,
+		Control:   dialPublic,
+	}).DialContext
+	return &Factory{transport: transport, public: public, requestID: requestID}, nil
+}
+
+// Client returns the client named name, the client label of its metrics, whose
+// calls time out after timeout, 0 for never
+func (f *Factory) Client(name string, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: f.Transport(name), Timeout: timeout}
+}
+
+// PublicClient is Client for the calls to urls given by the users of the
+// api, such as webhook endpoints. It only connects to public addresses,
+// failing with ErrNonPublicAddress otherwise, so a url cannot reach the
+// service network or the cloud metadata endpoint. Its calls do not go
+// through the proxy.
+func (f *Factory) PublicClient(name string, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &instrumentedTransport{name: name, next: f.public, requestID: f.requestID}, Timeout: timeout}
+}
+
+// Transport returns the round tripper of the client named name, for callers
+// sending requests without a client like reverse proxies
+func (f *Factory) Transport(name string) http.RoundTripper {
+	return &instrumentedTransport{name: name, next: f.transport, requestID: f.requestID}
+}
+
+// CloseIdleConnections closes the pooled connections no call is using
+func (f *Factory) CloseIdleConnections() {
+	f.transport.CloseIdleConnections()
+	f.public.CloseIdleConnections()
+}
+
+// instrumentedTransport measures the calls of a client sent with next
+type instrumentedTransport struct {
+	name      string
+	next      http.RoundTripper
+	requestID func(ctx context.Context) string
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if t.requestID != nil && req.Header.Get(RequestIDHeader) == "" {
+		if id := t.requestID(ctx); id != "" {
+			// a round tripper must not modify the request of its caller
+			req = req.Clone(ctx)
+			req.Header.Set(RequestIDHeader, id)
+		}
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			origin := "new"
+			if info.Reused {
+				origin = "reused"
+			}
+			connections.WithLabelValues(t.name, origin).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requestDuration.WithLabelValues(t.name, req.Method, code).Observe(time.Since(start).Seconds())
+	return resp, err
+}
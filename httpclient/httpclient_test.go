@@ -0,0 +1,48 @@
+package httpclient
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		if got := IsPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("IsPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestDialPublic(t *testing.T) {
+	if err := dialPublic("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("dialPublic(public address) = %v, want nil", err)
+	}
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "169.254.169.254:80", "localhost:80"} {
+		if err := dialPublic("tcp", address, nil); !errors.Is(err, ErrNonPublicAddress) {
+			t.Errorf("dialPublic(%s) = %v, want ErrNonPublicAddress", address, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+// Package i18n localizes the messages the service returns to people: it
+// negotiates the locale of a request from its Accept-Language header among the
+// locales of a message catalog and looks messages up by key in that locale.
+// The built in catalog has English, German, French and Spanish messages; a
+// directory of <locale>.json files adds locales and overrides messages.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// Fallback is the locale of the messages written in the code, which stand in
+// for the messages a locale lacks
+const Fallback = "en"
+
+//go:embed locales/*.json
+var builtin embed.FS
+
+// Catalog holds the messages of every locale by key. A nil Catalog localizes
+// nothing, every request gets the fallback.
+type Catalog struct {
+	defaultLocale string
+	messages      map[string]map[string]string
+}
+
+// New returns the catalog of cfg, nil when localization is disabled
+func New(cfg config.I18nConfig) (*Catalog, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	c := &Catalog{defaultLocale: normalize(cfg.DefaultLocale), messages: map[string]map[string]string{}}
+	if err := c.load(builtin, "locales"); err != nil {
+		return nil, err
+	}
+	if cfg.Catalog != "" {
+		if err := c.load(os.DirFS(cfg.Catalog), "."); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := c.messages[c.defaultLocale]; !ok && c.defaultLocale != Fallback {
+		return nil, fmt.Errorf("the i18n catalog has no messages of the default locale %q", cfg.DefaultLocale)
+	}
+	return c, nil
+}
+
+// load adds the messages of the <locale>.json files of dir in fsys
+func (c *Catalog) load(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return fmt.Errorf("failed to read i18n catalog %s: %v", file, err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return fmt.Errorf("failed to parse i18n catalog %s: %v", file, err)
+		}
+		locale := normalize(strings.TrimSuffix(path.Base(file), ".json"))
+		if c.messages[locale] == nil {
+			c.messages[locale] = map[string]string{}
+		}
+		for key, message := range messages {
+			c.messages[locale][key] = message
+		}
+	}
+	return nil
+}
+
+// normalize returns the form locales are compared in, such as pt-br for pt_BR
+func normalize(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+}
+
+// Locales returns the locales of the catalog, sorted
+func (c *Catalog) Locales() []string {
+	if c == nil {
+		return []string{Fallback}
+	}
+	locales := make([]string, 0, len(c.messages))
+	for locale := range c.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Negotiate returns the locale of the catalog best matching the header, an
+// Accept-Language like "de-CH, de;q=0.9, en;q=0.5", or the default locale when
+// none does. A language range matches its locale, or the locale of its
+// language for a range naming a region the catalog does not have.
+func (c *Catalog) Negotiate(header string) string {
+	if c == nil {
+		return Fallback
+	}
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var ranges []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := normalize(fields[0])
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, weighted{tag: tag, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	for _, r := range ranges {
+		if r.tag == "*" {
+			return c.defaultLocale
+		}
+		if _, ok := c.messages[r.tag]; ok {
+			return r.tag
+		}
+		if i := strings.Index(r.tag, "-"); i > 0 {
+			if _, ok := c.messages[r.tag[:i]]; ok {
+				return r.tag[:i]
+			}
+		}
+	}
+	return c.defaultLocale
+}
+
+// Message returns the message of key in locale, false when the locale lacks
+// it and the caller falls back to its own message
+func (c *Catalog) Message(locale, key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	message, ok := c.messages[locale][key]
+	return message, ok && message != ""
+}
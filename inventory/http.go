@@ -0,0 +1,79 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+// HTTPClient reserves stock with the inventory service:
+//
+//	PUT    {endpoint}/reservations/{id}   the reservation, 409 Conflict when out of stock
+//	DELETE {endpoint}/reservations/{id}
+type HTTPClient struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewHTTPClient returns a client of the inventory service at the endpoint of
+// cfg, calling it with a client of clients
+func NewHTTPClient(cfg *config.InventoryConfig, clients *httpclient.Factory) *HTTPClient {
+	return &HTTPClient{
+		client:   clients.Client("inventory", cfg.Timeout.Duration),
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+	}
+}
+
+func (c *HTTPClient) Reserve(ctx context.Context, r *Reservation) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPut, r.ID, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return ErrOutOfStock
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("inventory service responded %s to reservation %s", resp.Status, r.ID)
+	}
+	return nil
+}
+
+func (c *HTTPClient) Release(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, id, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("inventory service responded %s to the release of %s", resp.Status, id)
+	}
+	return nil
+}
+
+func (c *HTTPClient) do(ctx context.Context, method, id string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+"/reservations/"+url.PathEscape(id), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.client.Do(req)
+}
@@ -0,0 +1,50 @@
+// Package inventory reserves the stock of orders with the inventory service, or
+// with an in-process stub for development.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+// ErrOutOfStock is returned when an item of a reservation is not in stock
+var ErrOutOfStock = errors.New("out of stock")
+
+// Item is a quantity of a sku to reserve
+type Item struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// Reservation holds stock for the items of an order. Its id is chosen by the
+// caller, so a reservation whose outcome is unknown can still be released.
+type Reservation struct {
+	ID      string `json:"id"`
+	OrderID string `json:"orderId"`
+	Items   []Item `json:"items"`
+}
+
+// Client reserves and releases stock. Both calls are idempotent: reserving an id
+// that is reserved and releasing an id that is not are no-ops.
+type Client interface {
+	// Reserve holds the stock of all items of r, or of none of them, failing with
+	// ErrOutOfStock when an item is short
+	Reserve(ctx context.Context, r *Reservation) error
+	// Release returns the stock held by the reservation with id
+	Release(ctx context.Context, id string) error
+}
+
+// New returns the client selected in cfg, calling the inventory service with a client of clients
+func New(cfg *config.InventoryConfig, clients *httpclient.Factory) (Client, error) {
+	switch cfg.Client {
+	case config.InventoryClientHTTP:
+		return NewHTTPClient(cfg, clients), nil
+	case config.InventoryClientStub:
+		return NewStub(), nil
+	}
+	return nil, fmt.Errorf("unknown inventory client %q", cfg.Client)
+}
@@ -0,0 +1,63 @@
+package inventory
+
+import (
+	"context"
+	"sync"
+)
+
+// Stub keeps stock in memory, it is meant for tests and development. Skus without
+// stock set with SetStock are never short.
+type Stub struct {
+	mu           sync.Mutex
+	stock        map[string]int
+	reservations map[string][]Item
+}
+
+// NewStub returns a stub with unlimited stock
+func NewStub() *Stub {
+	return &Stub{stock: map[string]int{}, reservations: map[string][]Item{}}
+}
+
+// SetStock sets the quantity of sku available to reservations
+func (s *Stub) SetStock(sku string, quantity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stock[sku] = quantity
+}
+
+func (s *Stub) Reserve(ctx context.Context, r *Reservation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.reservations[r.ID]; ok {
+		return nil
+	}
+
+	wanted := map[string]int{}
+	for _, item := range r.Items {
+		wanted[item.SKU] += item.Quantity
+	}
+	for sku, quantity := range wanted {
+		if available, ok := s.stock[sku]; ok && available < quantity {
+			return ErrOutOfStock
+		}
+	}
+	for sku, quantity := range wanted {
+		if _, ok := s.stock[sku]; ok {
+			s.stock[sku] -= quantity
+		}
+	}
+	s.reservations[r.ID] = r.Items
+	return nil
+}
+
+func (s *Stub) Release(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range s.reservations[id] {
+		if _, ok := s.stock[item.SKU]; ok {
+			s.stock[item.SKU] += item.Quantity
+		}
+	}
+	delete(s.reservations, id)
+	return nil
+}
@@ -0,0 +1,137 @@
+// Package jobs runs long running work, such as imports and exports, in the
+// background and keeps its state, progress and result for clients to follow.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Retention is the time a job is kept after it was created or finished
+const Retention = 30 * 24 * time.Hour
+
+var (
+	// ErrNotFound is returned when no job has the requested id or it expired
+	ErrNotFound = errors.New("job not found")
+	// ErrConflict is returned when a job changed since it was read
+	ErrConflict = errors.New("job was changed concurrently")
+	// ErrFinished is returned when cancelling a job that already finished
+	ErrFinished = errors.New("job already finished")
+)
+
+// Type is the kind of work of a job
+type Type string
+
+// State is the state of a job
+type State string
+
+const (
+	// StateQueued marks a job waiting for a worker
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCancelled State = "cancelled"
+)
+
+// Finished reports whether s is a final state
+func (s State) Finished() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCancelled
+}
+
+// Progress is the part of its work a job has done, Total is 0 while unknown
+type Progress struct {
+	Done  int64 `json:"done" dynamodbav:"done"`
+	Total int64 `json:"total" dynamodbav:"total"`
+}
+
+// Job is a unit of background work
+type Job struct {
+	ID    string `json:"id" dynamodbav:"jobId"`
+	Type  Type   `json:"type" dynamodbav:"type"`
+	State State  `json:"state" dynamodbav:"state"`
+	// Priority orders the queued jobs, those of the highest priority are
+	// claimed first and those of the same priority oldest first
+	Priority int `json:"priority,omitempty" dynamodbav:"priority,omitempty"`
+	// Params are the input of the job, as JSON
+	Params   json.RawMessage `json:"params,omitempty" dynamodbav:"params,omitempty"`
+	Progress Progress        `json:"progress" dynamodbav:"progress"`
+	// Result is the output of the job as JSON, which failed and cancelled jobs
+	// may have too
+	Result json.RawMessage `json:"result,omitempty" dynamodbav:"result,omitempty"`
+	Error  string          `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	// CancelRequested asks the worker running the job to stop it
+	CancelRequested bool `json:"cancelRequested,omitempty" dynamodbav:"cancelRequested,omitempty"`
+	// Worker names the instance running the job, LeaseUntil is extended by its
+	// heartbeats and the job is failed once it passed
+	Worker     string     `json:"worker,omitempty" dynamodbav:"worker,omitempty"`
+	LeaseUntil *time.Time `json:"-" dynamodbav:"leaseUntil,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" dynamodbav:"updatedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty" dynamodbav:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty" dynamodbav:"finishedAt,omitempty"`
+	// ExpiresAt is the unix time the job expires at, DynamoDB deletes it after
+	ExpiresAt int64 `json:"expiresAt" dynamodbav:"expiresAt"`
+	// Version is incremented by every update and guards against lost updates
+	Version int64 `json:"version" dynamodbav:"version"`
+}
+
+// DecodeParams unmarshals the params of the job into v
+func (j *Job) DecodeParams(v interface{}) error {
+	if len(j.Params) == 0 {
+		return nil
+	}
+	return json.Unmarshal(j.Params, v)
+}
+
+// Copy returns a deep copy of j
+func (j *Job) Copy() *Job {
+	out := *j
+	out.Params = append(json.RawMessage(nil), j.Params...)
+	out.Result = append(json.RawMessage(nil), j.Result...)
+	for _, t := range []**time.Time{&out.LeaseUntil, &out.StartedAt, &out.FinishedAt} {
+		if *t != nil {
+			v := **t
+			*t = &v
+		}
+	}
+	return &out
+}
+
+// Store keeps jobs, it is implemented by the repositories of the api
+type Store interface {
+	// CreateJob stores a new job
+	CreateJob(ctx context.Context, job *Job) error
+	// GetJob returns the job with id, or ErrNotFound
+	GetJob(ctx context.Context, id string) (*Job, error)
+	// UpdateJob replaces a job if its stored version equals job.Version,
+	// incrementing job.Version. It fails with ErrNotFound or ErrConflict.
+	UpdateJob(ctx context.Context, job *Job) error
+	// ListJobs returns up to limit jobs in state, oldest first
+	ListJobs(ctx context.Context, state State, limit int) ([]*Job, error)
+}
+
+// SortQueued orders queued jobs the way they are claimed, the highest
+// priority first and the oldest first within a priority
+func SortQueued(list []*Job) {
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Priority != list[j].Priority {
+			return list[i].Priority > list[j].Priority
+		}
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+}
+
+// newID returns a random 128 bit hex id
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
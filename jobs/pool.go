@@ -0,0 +1,452 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+const (
+	// maxUpdateAttempts bounds the retries of an update racing other updates of a job
+	maxUpdateAttempts = 5
+	// reapBatchSize is the number of running jobs checked for an expired lease per poll
+	reapBatchSize = 100
+	// queueWindow is the number of the oldest queued jobs a poll picks the
+	// jobs of the highest priority among
+	queueWindow = 100
+	// storeTimeout bounds the store calls made outside of a request, such as
+	// saving the outcome of a job after it was cancelled
+	storeTimeout = 10 * time.Second
+)
+
+// errWorkerLost is the error of a job whose worker stopped heartbeating
+var errWorkerLost = errors.New("the worker running the job stopped")
+
+// Func does the work of a job. It reports its progress with report, stops early
+// when ctx is cancelled and returns a result marshalled to JSON, which may be
+// partial when it fails.
+type Func func(ctx context.Context, job *Job, report func(done, total int64)) (interface{}, error)
+
+// Pool runs jobs and keeps them in a store. Queued jobs are claimed by the pool
+// of whichever instance has a free worker; jobs whose input only one instance
+// holds, such as an upload, are started on it directly. A running job saves its
+// progress every heartbeat, which also picks up cancellation requests.
+type Pool struct {
+	store    Store
+	cfg      config.JobsConfig
+	worker   string
+	handlers map[Type]Func
+	slots    chan struct{}
+	logger   logging.Logger
+
+	mu sync.Mutex
+	// base is the parent context of the jobs, cancelled when the service stops
+	base    context.Context
+	running map[string]context.CancelFunc
+}
+
+// NewPool returns a pool of cfg.Workers workers keeping its jobs in store and
+// logging with logger, the default logger when nil
+func NewPool(store Store, cfg config.JobsConfig, logger logging.Logger) *Pool {
+	if logger == nil {
+		logger = logging.Default().Module(logging.ModuleJobs)
+	}
+	host, _ := os.Hostname()
+	return &Pool{
+		store:    store,
+		cfg:      cfg,
+		worker:   fmt.Sprintf("%s-%d", host, os.Getpid()),
+		handlers: map[Type]Func{},
+		slots:    make(chan struct{}, cfg.Workers),
+		logger:   logger,
+		base:     context.Background(),
+		running:  map[string]context.CancelFunc{},
+	}
+}
+
+// Handle makes the pool run the queued jobs of type t with fn, it must be
+// called before Run
+func (p *Pool) Handle(t Type, fn Func) {
+	p.handlers[t] = fn
+}
+
+// newJob returns a job of type t in state with params marshalled to JSON
+func newJob(t Type, state State, params interface{}) (*Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:        newID(),
+		Type:      t,
+		State:     state,
+		CreatedAt: now,
+		UpdatedAt: now,
+		ExpiresAt: now.Add(Retention).Unix(),
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		job.Params = data
+	}
+	return job, nil
+}
+
+// Enqueue stores a queued job of type t, which the first pool with a free
+// worker handling t runs
+func (p *Pool) Enqueue(ctx context.Context, t Type, params interface{}) (*Job, error) {
+	return p.EnqueuePriority(ctx, t, 0, params)
+}
+
+// EnqueuePriority stores a queued job of type t like Enqueue, claimed before
+// the queued jobs of a lower priority
+func (p *Pool) EnqueuePriority(ctx context.Context, t Type, priority int, params interface{}) (*Job, error) {
+	job, err := newJob(t, StateQueued, params)
+	if err != nil {
+		return nil, err
+	}
+	job.Priority = priority
+	if err := p.store.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	p.logger.WithFields(logging.Fields{"job": job.ID, "type": t, "priority": priority}).Info("queued job")
+	return job, nil
+}
+
+// Start stores a running job of type t and runs fn for it in the background on
+// this instance, it returns the job as stored
+func (p *Pool) Start(ctx context.Context, t Type, params interface{}, fn Func) (*Job, error) {
+	job, err := p.create(ctx, t, params)
+	if err != nil {
+		return nil, err
+	}
+	go p.run(p.baseContext(), job.Copy(), fn)
+	return job, nil
+}
+
+// Do stores a running job of type t, runs fn for it until it finishes or ctx is
+// done and returns the finished job
+func (p *Pool) Do(ctx context.Context, t Type, params interface{}, fn Func) (*Job, error) {
+	job, err := p.create(ctx, t, params)
+	if err != nil {
+		return nil, err
+	}
+	return p.run(ctx, job, fn), nil
+}
+
+// create stores a job of type t run by this instance
+func (p *Pool) create(ctx context.Context, t Type, params interface{}) (*Job, error) {
+	job, err := newJob(t, StateRunning, params)
+	if err != nil {
+		return nil, err
+	}
+	lease := job.CreatedAt.Add(p.cfg.Lease.Duration)
+	job.Worker = p.worker
+	job.StartedAt = &job.CreatedAt
+	job.LeaseUntil = &lease
+	if err := p.store.CreateJob(ctx, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (p *Pool) baseContext() context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.base
+}
+
+// Get returns the job with id, or ErrNotFound
+func (p *Pool) Get(ctx context.Context, id string) (*Job, error) {
+	return p.store.GetJob(ctx, id)
+}
+
+// Cancel cancels the job with id. A queued job is cancelled at once, a running
+// job is asked to stop and is cancelled by its worker, by the next heartbeat on
+// other instances. Cancelling a finished job fails with ErrFinished.
+func (p *Pool) Cancel(ctx context.Context, id string) (*Job, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		job, err := p.store.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.State.Finished() {
+			return nil, ErrFinished
+		}
+		now := time.Now().UTC()
+		job.UpdatedAt = now
+		if job.State == StateQueued {
+			job.State = StateCancelled
+			job.FinishedAt = &now
+			job.ExpiresAt = now.Add(Retention).Unix()
+		} else {
+			job.CancelRequested = true
+		}
+		err = p.store.UpdateJob(ctx, job)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		p.mu.Lock()
+		if cancel, ok := p.running[id]; ok {
+			cancel()
+		}
+		p.mu.Unlock()
+		p.logger.WithField("job", id).Info("cancelling job")
+		return job, nil
+	}
+	return nil, ErrConflict
+}
+
+// Run claims queued jobs every poll interval until ctx is done, which cancels
+// the jobs running on this instance
+func (p *Pool) Run(ctx context.Context) {
+	p.mu.Lock()
+	p.base = ctx
+	p.mu.Unlock()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.cfg.PollInterval.Duration):
+		}
+		p.RunOnce(ctx, time.Now())
+	}
+}
+
+// RunOnce fails the running jobs whose lease expired at now and claims as many
+// queued jobs as there are free workers, those of the highest priority among
+// the oldest queued jobs first
+func (p *Pool) RunOnce(ctx context.Context, now time.Time) {
+	p.reap(ctx, now)
+
+	free := cap(p.slots) - len(p.slots)
+	if free == 0 || len(p.handlers) == 0 {
+		return
+	}
+	queued, err := p.store.ListJobs(ctx, StateQueued, queueWindow)
+	if err != nil {
+		p.logger.Errorf("failed to list queued jobs: %v", err)
+		return
+	}
+	SortQueued(queued)
+	for _, job := range queued {
+		fn, ok := p.handlers[job.Type]
+		if !ok {
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return
+		}
+		if !p.claim(ctx, job) {
+			<-p.slots
+			continue
+		}
+		go func(job *Job) {
+			defer func() { <-p.slots }()
+			p.run(ctx, job, fn)
+		}(job)
+	}
+}
+
+// claim marks job running on this instance, it fails when another instance
+// claimed or cancelled it first
+func (p *Pool) claim(ctx context.Context, job *Job) bool {
+	now := time.Now().UTC()
+	lease := now.Add(p.cfg.Lease.Duration)
+	job.State = StateRunning
+	job.Worker = p.worker
+	job.StartedAt = &now
+	job.UpdatedAt = now
+	job.LeaseUntil = &lease
+	err := p.store.UpdateJob(ctx, job)
+	if err != nil && !errors.Is(err, ErrConflict) && !errors.Is(err, ErrNotFound) {
+		p.logger.WithField("job", job.ID).Errorf("failed to claim job: %v", err)
+	}
+	return err == nil
+}
+
+// reap fails the running jobs whose worker stopped heartbeating before now
+func (p *Pool) reap(ctx context.Context, now time.Time) {
+	running, err := p.store.ListJobs(ctx, StateRunning, reapBatchSize)
+	if err != nil {
+		p.logger.Errorf("failed to list running jobs: %v", err)
+		return
+	}
+	for _, job := range running {
+		if job.LeaseUntil == nil || job.LeaseUntil.After(now) {
+			continue
+		}
+		finished := now.UTC()
+		job.State = StateFailed
+		job.Error = errWorkerLost.Error()
+		job.UpdatedAt = finished
+		job.FinishedAt = &finished
+		job.ExpiresAt = finished.Add(Retention).Unix()
+		if err := p.store.UpdateJob(ctx, job); err == nil {
+			p.logger.WithFields(logging.Fields{"job": job.ID, "worker": job.Worker}).Warn("failed job of a stopped worker")
+		}
+	}
+}
+
+// run runs fn for the running job, saving its progress every heartbeat, and
+// returns the job as it finished
+func (p *Pool) run(parent context.Context, job *Job, fn Func) *Job {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	p.mu.Lock()
+	p.running[job.ID] = cancel
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.running, job.ID)
+		p.mu.Unlock()
+	}()
+
+	logger := p.logger.WithFields(logging.Fields{"job": job.ID, "type": job.Type})
+	logger.Info("running job")
+
+	var mu sync.Mutex
+	progress := job.Progress
+	report := func(done, total int64) {
+		mu.Lock()
+		progress = Progress{Done: done, Total: total}
+		mu.Unlock()
+	}
+	current := func() Progress {
+		mu.Lock()
+		defer mu.Unlock()
+		return progress
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		p.heartbeat(job.ID, cancel, current, stop, logger)
+	}()
+	result, err := call(ctx, job, fn, report)
+	close(stop)
+	<-stopped
+
+	return p.finish(job, current(), result, err, ctx.Err() != nil, logger)
+}
+
+// call runs fn, turning a panic into an error
+func call(ctx context.Context, job *Job, fn Func, report func(done, total int64)) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return fn(ctx, job, report)
+}
+
+// heartbeat saves the progress of the job with id and extends its lease until
+// stop is closed. It cancels the job when it was asked to stop or was failed
+// as abandoned in the meantime.
+func (p *Pool) heartbeat(id string, cancel context.CancelFunc, current func() Progress, stop <-chan struct{}, logger logging.Logger) {
+	ticker := time.NewTicker(p.cfg.Heartbeat.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, done := context.WithTimeout(context.Background(), storeTimeout)
+		job, err := p.store.GetJob(ctx, id)
+		if err != nil {
+			done()
+			logger.Warnf("failed to read job: %v", err)
+			continue
+		}
+		if job.State != StateRunning || job.Worker != p.worker {
+			done()
+			cancel()
+			continue
+		}
+		if job.CancelRequested {
+			cancel()
+		}
+		now := time.Now().UTC()
+		lease := now.Add(p.cfg.Lease.Duration)
+		job.Progress = current()
+		job.UpdatedAt = now
+		job.LeaseUntil = &lease
+		err = p.store.UpdateJob(ctx, job)
+		done()
+		if err != nil && !errors.Is(err, ErrConflict) {
+			logger.Warnf("failed to save the progress of the job: %v", err)
+		}
+	}
+}
+
+// finish saves the outcome of job. A job whose context was cancelled is
+// cancelled when that was requested and failed otherwise, as the service stopped.
+func (p *Pool) finish(job *Job, progress Progress, result interface{}, runErr error, interrupted bool, logger logging.Logger) *Job {
+	var data json.RawMessage
+	if result != nil {
+		var err error
+		if data, err = json.Marshal(result); err != nil && runErr == nil {
+			runErr = fmt.Errorf("failed to marshal the result: %v", err)
+		}
+	}
+
+	ctx, done := context.WithTimeout(context.Background(), storeTimeout)
+	defer done()
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		latest, err := p.store.GetJob(ctx, job.ID)
+		if err != nil {
+			logger.Errorf("failed to read job to save its outcome: %v", err)
+			break
+		}
+		if latest.State.Finished() {
+			// failed as abandoned while it ran
+			return latest
+		}
+		now := time.Now().UTC()
+		latest.Progress = progress
+		latest.Result = data
+		latest.UpdatedAt = now
+		latest.FinishedAt = &now
+		latest.LeaseUntil = nil
+		latest.ExpiresAt = now.Add(Retention).Unix()
+		switch {
+		case runErr == nil:
+			latest.State = StateSucceeded
+		case interrupted && latest.CancelRequested:
+			latest.State = StateCancelled
+		default:
+			latest.State = StateFailed
+			latest.Error = runErr.Error()
+		}
+		err = p.store.UpdateJob(ctx, latest)
+		if errors.Is(err, ErrConflict) {
+			continue
+		}
+		if err != nil {
+			logger.Errorf("failed to save the outcome of the job: %v", err)
+			break
+		}
+		logger.WithField("state", latest.State).Info("job finished")
+		return latest
+	}
+	job.State = StateFailed
+	if runErr != nil {
+		job.Error = runErr.Error()
+	}
+	return job
+}
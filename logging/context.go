@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"context"
+)
+
+// Keys of the fields identifying what an entry is about
+const (
+	RequestIDKey = "request_id"
+	TenantIDKey  = "tenant_id"
+	OrderIDKey   = "order_id"
+	ClientIPKey  = "client_ip"
+)
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying logger
+func NewContext(ctx context.Context, logger Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger of ctx, falling back to the default logger
+func FromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(contextKey{}).(Logger); ok && logger != nil {
+		return logger
+	}
+	return Default()
+}
+
+// ContextWithFields returns a copy of ctx whose logger adds fields to its entries
+func ContextWithFields(ctx context.Context, fields Fields) context.Context {
+	return NewContext(ctx, FromContext(ctx).WithFields(fields))
+}
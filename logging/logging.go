@@ -0,0 +1,258 @@
+// Package logging is the logger of the order service: structured entries
+// whose level is set per module, at runtime, and written by a pluggable
+// backend. The default backend writes JSON with log/slog; logrus, zap or any
+// other library plugs in by implementing Backend.
+package logging
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Modules of the service whose level can be set apart
+const (
+	ModuleAPIServer  = "apiserver"
+	ModuleRepository = "repository"
+	ModuleWebhooks   = "webhooks"
+	ModuleGRPC       = "grpc"
+	ModuleEvents     = "events"
+	ModuleKafka      = "kafka"
+	ModuleOutbox     = "outbox"
+	ModuleJobs       = "jobs"
+	ModuleCluster    = "cluster"
+	ModuleCommands   = "commands"
+	ModuleScheduler  = "scheduler"
+	ModuleTracking   = "tracking"
+	ModuleRetention  = "retention"
+	ModuleCron       = "cron"
+	ModuleSLA        = "sla"
+	ModuleSagas      = "sagas"
+	ModuleStats      = "stats"
+	ModuleMetrics    = "metrics"
+	ModuleConfig     = "config"
+	// ModuleNotifications logs the notifications of customers
+	ModuleNotifications = "notifications"
+)
+
+// ModuleKey is the field naming the module of an entry
+const ModuleKey = "module"
+
+// Level is the severity of an entry, in the order of the logrus levels
+type Level uint32
+
+const (
+	PanicLevel Level = iota
+	FatalLevel
+	ErrorLevel
+	WarnLevel
+	InfoLevel
+	DebugLevel
+	TraceLevel
+)
+
+var levelNames = []string{"panic", "fatal", "error", "warning", "info", "debug", "trace"}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return "unknown"
+}
+
+// ParseLevel returns the level named name, warn is accepted for warning
+func ParseLevel(name string) (Level, error) {
+	name = strings.ToLower(name)
+	if name == "warn" {
+		return WarnLevel, nil
+	}
+	for i, levelName := range levelNames {
+		if name == levelName {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("not a valid log level: %q", name)
+}
+
+// Fields are the structured fields of an entry
+type Fields map[string]interface{}
+
+// Logger writes the entries of a module with the fields added to it. Entries
+// below the level of the module are dropped before they are formatted.
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields Fields) Logger
+	WithError(err error) Logger
+	// Module returns the logger of module name with the fields of this one
+	Module(name string) Logger
+
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Backend writes the entries let through by the levels. fields must not be
+// modified, the module of the entry is the ModuleKey field.
+type Backend interface {
+	Write(level Level, msg string, fields Fields)
+}
+
+// Levels holds the level of every module, those without their own level
+// logging at the default level. It is safe for concurrent use and shared by
+// the loggers of a service, so that changing it changes them all.
+type Levels struct {
+	mu      sync.RWMutex
+	level   Level
+	modules map[string]Level
+}
+
+// NewLevels returns levels logging every module at level
+func NewLevels(level Level) *Levels {
+	return &Levels{level: level, modules: map[string]Level{}}
+}
+
+// Level returns the default level
+func (l *Levels) Level() Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.level
+}
+
+// Modules returns the modules with their own level
+func (l *Levels) Modules() map[string]Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	modules := make(map[string]Level, len(l.modules))
+	for module, level := range l.modules {
+		modules[module] = level
+	}
+	return modules
+}
+
+// ModuleLevel returns the level of module
+func (l *Levels) ModuleLevel(module string) Level {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if level, ok := l.modules[module]; ok {
+		return level
+	}
+	return l.level
+}
+
+// Set replaces the default level and the levels of the modules
+func (l *Levels) Set(level Level, modules map[string]Level) {
+	copied := make(map[string]Level, len(modules))
+	for module, moduleLevel := range modules {
+		copied[module] = moduleLevel
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level = level
+	l.modules = copied
+}
+
+// Enabled reports whether entries of module at level are written
+func (l *Levels) Enabled(module string, level Level) bool {
+	return level <= l.ModuleLevel(module)
+}
+
+type logger struct {
+	backend Backend
+	levels  *Levels
+	module  string
+	fields  Fields
+}
+
+// New returns a logger writing to backend the entries let through by levels
+func New(backend Backend, levels *Levels) Logger {
+	return &logger{backend: backend, levels: levels, fields: Fields{}}
+}
+
+var (
+	backendMu      sync.RWMutex
+	defaultBackend = NewSlog(defaultHandler())
+	defaultLogger  = New(DefaultBackend(), NewLevels(InfoLevel))
+)
+
+// SetBackend makes backend write the entries of the loggers created with
+// DefaultBackend, e.g. to log text or with zap. It is meant to be called in
+// main before the service is created.
+func SetBackend(backend Backend) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	defaultBackend = backend
+}
+
+// DefaultBackend returns the backend writing to the one set with SetBackend,
+// JSON to stderr with slog unless it was called
+func DefaultBackend() Backend {
+	return currentBackend{}
+}
+
+type currentBackend struct{}
+
+func (currentBackend) Write(level Level, msg string, fields Fields) {
+	backendMu.RLock()
+	backend := defaultBackend
+	backendMu.RUnlock()
+	backend.Write(level, msg, fields)
+}
+
+// Default returns the logger of the code given none, it logs at info level
+// with the default backend
+func Default() Logger {
+	return defaultLogger
+}
+
+func (l *logger) with(module string, fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &logger{backend: l.backend, levels: l.levels, module: module, fields: merged}
+}
+
+func (l *logger) WithField(key string, value interface{}) Logger {
+	return l.with(l.module, Fields{key: value})
+}
+
+func (l *logger) WithFields(fields Fields) Logger {
+	return l.with(l.module, fields)
+}
+
+func (l *logger) WithError(err error) Logger {
+	return l.with(l.module, Fields{"error": err})
+}
+
+func (l *logger) Module(name string) Logger {
+	return l.with(name, Fields{ModuleKey: name})
+}
+
+func (l *logger) log(level Level, args []interface{}) {
+	if l.levels.Enabled(l.module, level) {
+		l.backend.Write(level, fmt.Sprint(args...), l.fields)
+	}
+}
+
+func (l *logger) logf(level Level, format string, args []interface{}) {
+	if l.levels.Enabled(l.module, level) {
+		l.backend.Write(level, fmt.Sprintf(format, args...), l.fields)
+	}
+}
+
+func (l *logger) Debug(args ...interface{})                 { l.log(DebugLevel, args) }
+func (l *logger) Debugf(format string, args ...interface{}) { l.logf(DebugLevel, format, args) }
+func (l *logger) Info(args ...interface{})                  { l.log(InfoLevel, args) }
+func (l *logger) Infof(format string, args ...interface{})  { l.logf(InfoLevel, format, args) }
+func (l *logger) Warn(args ...interface{})                  { l.log(WarnLevel, args) }
+func (l *logger) Warnf(format string, args ...interface{})  { l.logf(WarnLevel, format, args) }
+func (l *logger) Error(args ...interface{})                 { l.log(ErrorLevel, args) }
+func (l *logger) Errorf(format string, args ...interface{}) { l.logf(ErrorLevel, format, args) }
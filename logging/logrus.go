@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"io/ioutil"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logrusBackend writes entries with a logrus logger
+type logrusBackend struct {
+	logger *log.Logger
+}
+
+// NewLogrus returns the backend writing entries with logger, a new logger
+// writing text to stderr when nil, but not the standard logger once it is
+// redirected. The levels of the loggers filter the entries, so the level of
+// logger is raised to trace.
+func NewLogrus(logger *log.Logger) Backend {
+	if logger == nil {
+		logger = log.New()
+	}
+	logger.SetLevel(log.TraceLevel)
+	return &logrusBackend{logger: logger}
+}
+
+func (b *logrusBackend) Write(level Level, msg string, fields Fields) {
+	entry := b.logger.WithFields(log.Fields(fields))
+	switch level {
+	case TraceLevel:
+		entry.Trace(msg)
+	case DebugLevel:
+		entry.Debug(msg)
+	case InfoLevel:
+		entry.Info(msg)
+	case WarnLevel:
+		entry.Warn(msg)
+	default:
+		// panic and fatal entries are not given the power to stop the process
+		entry.Error(msg)
+	}
+}
+
+// RedirectLogrus makes the entries of the standard logrus logger, such as
+// those of the libraries logging with it, go to logger instead of its output,
+// filtered by the levels of logger rather than its own
+func RedirectLogrus(logger Logger) {
+	std := log.StandardLogger()
+	std.SetOutput(ioutil.Discard)
+	std.SetFormatter(discardFormatter{})
+	std.SetLevel(log.TraceLevel)
+	std.Hooks = log.LevelHooks{}
+	std.AddHook(&logrusHook{logger: logger})
+}
+
+// discardFormatter skips formatting the entries of a logger writing them elsewhere
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// logrusHook writes the entries of a logrus logger with a Logger
+type logrusHook struct {
+	logger Logger
+}
+
+func (h *logrusHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logrusHook) Fire(entry *log.Entry) error {
+	logger := h.logger.WithFields(Fields(entry.Data))
+	switch entry.Level {
+	case log.TraceLevel, log.DebugLevel:
+		logger.Debug(entry.Message)
+	case log.InfoLevel:
+		logger.Info(entry.Message)
+	case log.WarnLevel:
+		logger.Warn(entry.Message)
+	default:
+		logger.Error(entry.Message)
+	}
+	return nil
+}
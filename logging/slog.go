@@ -0,0 +1,91 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// Output formats of NewHandler
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// slogTrace is the slog level of trace entries, slog has none
+const slogTrace = slog.LevelDebug - 4
+
+// slogBackend writes entries with a slog handler
+type slogBackend struct {
+	handler slog.Handler
+}
+
+// NewSlog returns the backend writing entries with handler. The levels of the
+// loggers filter the entries, so handler should let all of them through, as
+// those of NewHandler do.
+func NewSlog(handler slog.Handler) Backend {
+	return &slogBackend{handler: handler}
+}
+
+// NewHandler returns the slog handler writing entries to w in format, json or
+// text, whatever their level
+func NewHandler(w io.Writer, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{
+		Level: slogTrace,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 && a.Value.Any() == slogTrace {
+				a.Value = slog.StringValue("TRACE")
+			}
+			return a
+		},
+	}
+	switch format {
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	case FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// defaultHandler writes JSON to stderr
+func defaultHandler() slog.Handler {
+	handler, _ := NewHandler(os.Stderr, FormatJSON)
+	return handler
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case TraceLevel:
+		return slogTrace
+	case DebugLevel:
+		return slog.LevelDebug
+	case InfoLevel:
+		return slog.LevelInfo
+	case WarnLevel:
+		return slog.LevelWarn
+	}
+	return slog.LevelError
+}
+
+func (b *slogBackend) Write(level Level, msg string, fields Fields) {
+	ctx := context.Background()
+	if !b.handler.Enabled(ctx, slogLevel(level)) {
+		return
+	}
+	record := slog.NewRecord(time.Now(), slogLevel(level), msg, 0)
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	// sorted for the entries of a logger to read alike
+	sort.Strings(keys)
+	for _, key := range keys {
+		record.AddAttrs(slog.Any(key, fields[key]))
+	}
+	b.handler.Handle(ctx, record)
+}
@@ -1,20 +1,56 @@
 package main
 
 import (
-	"time"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
 )
 
 func main() {
 
-	err := api.Init()
+	load := func() (*config.Config, error) { return config.Load(os.Args[1:]) }
+
+	cfg, err := load()
+	if err != nil {
+		fatalf("failed to load config: %v", err)
+	}
+	handler, err := logging.NewHandler(os.Stderr, cfg.LogFormat)
 	if err != nil {
+		fatalf("%v", err)
+	}
+	logging.SetBackend(logging.NewSlog(handler))
+
+	if cfg.Migrate {
+		if err := api.MigrateStorage(context.Background(), cfg); err != nil {
+			fatalf("failed to migrate database: %v", err)
+		}
 		return
 	}
 
-	for {
-                time.Sleep(120 * time.Second)
-                continue
-        }
+	repo, err := api.NewRepository(context.Background(), cfg)
+	if err != nil {
+		fatalf("failed to create repository: %v", err)
+	}
+
+	svc, err := api.NewService(repo, config.NewStore(cfg, load))
+	if err != nil {
+		fatalf("failed to create service: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := svc.Run(ctx); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+func fatalf(format string, args ...interface{}) {
+	logging.Default().Errorf(format, args...)
+	os.Exit(1)
 }
@@ -0,0 +1,131 @@
+package metricsexport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxRecordMetrics is the number of metrics CloudWatch takes from one record
+const maxRecordMetrics = 100
+
+// CloudWatch writes the samples as records of the CloudWatch embedded metric
+// format, one JSON line per set of labels, which CloudWatch Logs turns into
+// metrics with the labels as dimensions
+type CloudWatch struct {
+	w         io.Writer
+	closer    io.Closer
+	namespace string
+}
+
+// NewCloudWatch returns the sink writing the samples in namespace to the
+// CloudWatch agent listening on the udp address, or to stdout, as read by
+// Lambda and the awslogs driver of ECS, when address is empty
+func NewCloudWatch(address, namespace string) (*CloudWatch, error) {
+	if address == "" {
+		return &CloudWatch{w: os.Stdout, namespace: namespace}, nil
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial cloudwatch agent at %s: %v", address, err)
+	}
+	return &CloudWatch{w: conn, closer: conn, namespace: namespace}, nil
+}
+
+// emfMetadata is the _aws member of a record telling CloudWatch its metrics
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// Send writes a record of the samples of every set of labels
+func (c *CloudWatch) Send(at time.Time, samples []Sample) error {
+	groups := map[string][]Sample{}
+	var keys []string
+	for _, sample := range samples {
+		key := seriesKey("", sample.Labels)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], sample)
+	}
+	for _, key := range keys {
+		group := groups[key]
+		for len(group) > 0 {
+			n := len(group)
+			if n > maxRecordMetrics {
+				n = maxRecordMetrics
+			}
+			if err := c.write(at, group[:n]); err != nil {
+				return err
+			}
+			group = group[n:]
+		}
+	}
+	return nil
+}
+
+// write writes the record of samples, which have the same labels
+func (c *CloudWatch) write(at time.Time, samples []Sample) error {
+	record := map[string]interface{}{}
+	dimensions := make([]string, 0, len(samples[0].Labels))
+	for _, label := range samples[0].Labels {
+		dimensions = append(dimensions, label.Name)
+		record[label.Name] = label.Value
+	}
+	metrics := make([]emfMetric, 0, len(samples))
+	for _, sample := range samples {
+		metrics = append(metrics, emfMetric{Name: sample.Name, Unit: unit(sample)})
+		record[sample.Name] = sample.Value
+	}
+	record["_aws"] = &emfMetadata{
+		Timestamp: at.UnixMilli(),
+		CloudWatchMetrics: []emfDirective{{
+			Namespace:  c.namespace,
+			Dimensions: [][]string{dimensions},
+			Metrics:    metrics,
+		}},
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(append(b, '\n'))
+	return err
+}
+
+// unit returns the CloudWatch unit of sample, from the suffix of its name
+func unit(sample Sample) string {
+	name := strings.TrimSuffix(sample.Name, "_sum")
+	switch {
+	case strings.HasSuffix(name, "_seconds"):
+		return "Seconds"
+	case strings.HasSuffix(name, "_bytes"):
+		return "Bytes"
+	case sample.Counter:
+		return "Count"
+	}
+	return "None"
+}
+
+func (c *CloudWatch) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
@@ -0,0 +1,194 @@
+// Package metricsexport pushes the prometheus metrics of the service to the
+// backends of the teams not scraping them: StatsD, or CloudWatch through the
+// embedded metric format. Counters are pushed as their increase since the
+// previous push, gauges as their value and histograms and summaries as the
+// increase of their count and sum.
+package metricsexport
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+var exportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "order",
+	Subsystem: "metrics_export",
+	Name:      "failures_total",
+	Help:      "Pushes of the metrics to the export sink that failed.",
+})
+
+func init() {
+	prometheus.MustRegister(exportFailures)
+}
+
+// Label is a label of a metric series
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is the value of a metric series at a push
+type Sample struct {
+	Name string
+	// Labels are sorted by name
+	Labels []Label
+	Value  float64
+	// Counter tells the increase of a counter since the previous push from
+	// the value of a gauge
+	Counter bool
+}
+
+// Sink is where the samples are pushed
+type Sink interface {
+	// Send pushes the samples taken at at
+	Send(at time.Time, samples []Sample) error
+	Close() error
+}
+
+// Exporter pushes the metrics of a prometheus gatherer to a sink
+type Exporter struct {
+	gatherer prometheus.Gatherer
+	sink     Sink
+	interval time.Duration
+	include  []string
+	logger   logging.Logger
+	// last is the value of every counter at the previous push, by series
+	last map[string]float64
+}
+
+// New returns the exporter of the metrics of gatherer to the sink of cfg
+func New(cfg config.MetricsExportConfig, gatherer prometheus.Gatherer, logger logging.Logger) (*Exporter, error) {
+	var sink Sink
+	var err error
+	switch cfg.Sink {
+	case config.MetricsSinkStatsD:
+		sink, err = NewStatsD(cfg.Address, cfg.Prefix)
+	case config.MetricsSinkCloudWatch:
+		sink, err = NewCloudWatch(cfg.Address, cfg.Namespace)
+	default:
+		return nil, fmt.Errorf("unknown metrics export sink %q", cfg.Sink)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		gatherer: gatherer,
+		sink:     sink,
+		interval: cfg.Interval.Duration,
+		include:  cfg.Include,
+		logger:   logger,
+		last:     map[string]float64{},
+	}, nil
+}
+
+// Run pushes the metrics every interval until ctx is done, then pushes them
+// a last time and closes the sink
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			e.push()
+			if err := e.sink.Close(); err != nil {
+				e.logger.Warnf("failed to close metrics export sink: %v", err)
+			}
+			return
+		case <-ticker.C:
+			e.push()
+		}
+	}
+}
+
+func (e *Exporter) push() {
+	if err := e.export(); err != nil {
+		exportFailures.Inc()
+		e.logger.Errorf("failed to push metrics: %v", err)
+	}
+}
+
+// export gathers the metrics and sends their samples to the sink
+func (e *Exporter) export() error {
+	families, err := e.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		return fmt.Errorf("failed to gather metrics: %v", err)
+	}
+	var samples []Sample
+	for _, family := range families {
+		name := family.GetName()
+		if !e.included(name) {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make([]Label, 0, len(m.GetLabel()))
+			for _, pair := range m.GetLabel() {
+				labels = append(labels, Label{Name: pair.GetName(), Value: pair.GetValue()})
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				samples = append(samples, e.counter(name, labels, m.GetCounter().GetValue()))
+			case dto.MetricType_GAUGE:
+				samples = append(samples, Sample{Name: name, Labels: labels, Value: m.GetGauge().GetValue()})
+			case dto.MetricType_UNTYPED:
+				samples = append(samples, Sample{Name: name, Labels: labels, Value: m.GetUntyped().GetValue()})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				samples = append(samples,
+					e.counter(name+"_count", labels, float64(h.GetSampleCount())),
+					e.counter(name+"_sum", labels, h.GetSampleSum()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				samples = append(samples,
+					e.counter(name+"_count", labels, float64(s.GetSampleCount())),
+					e.counter(name+"_sum", labels, s.GetSampleSum()))
+			}
+		}
+	}
+	if len(samples) == 0 {
+		return nil
+	}
+	return e.sink.Send(time.Now(), samples)
+}
+
+// included reports whether the metric called name is pushed
+func (e *Exporter) included(name string) bool {
+	if len(e.include) == 0 {
+		return true
+	}
+	for _, prefix := range e.include {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// counter returns the sample of the increase of the counter series since the
+// previous push, its whole value at the first
+func (e *Exporter) counter(name string, labels []Label, value float64) Sample {
+	key := seriesKey(name, labels)
+	delta := value - e.last[key]
+	e.last[key] = value
+	return Sample{Name: name, Labels: labels, Value: delta, Counter: true}
+}
+
+// seriesKey returns the key of the series of name with labels
+func seriesKey(name string, labels []Label) string {
+	var b strings.Builder
+	b.WriteString(name)
+	for _, label := range labels {
+		b.WriteByte(0xff)
+		b.WriteString(label.Name)
+		b.WriteByte('=')
+		b.WriteString(label.Value)
+	}
+	return b.String()
+}
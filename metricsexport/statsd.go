@@ -0,0 +1,95 @@
+package metricsexport
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxPacket is the size of the udp packets the lines are sent in, which fits
+// the mtu of most networks
+const maxPacket = 1432
+
+// tagEscaper replaces the characters the lines are made of in label values
+var tagEscaper = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_", "\n", "_")
+
+// StatsD sends the samples to a StatsD server over udp, their labels as
+// DogStatsD tags, which Telegraf and the Datadog agent read
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+}
+
+// NewStatsD returns the sink sending to the StatsD server at address the
+// samples named with prefix
+func NewStatsD(address, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial statsd at %s: %v", address, err)
+	}
+	return &StatsD{conn: conn, prefix: prefix}, nil
+}
+
+// Send sends the samples in as few packets as they fit, the counters that
+// did not increase are left out
+func (s *StatsD) Send(at time.Time, samples []Sample) error {
+	var packet bytes.Buffer
+	for _, sample := range samples {
+		if sample.Counter && sample.Value == 0 {
+			continue
+		}
+		line := s.line(sample)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacket {
+			if err := s.flush(&packet); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return s.flush(&packet)
+}
+
+func (s *StatsD) flush(packet *bytes.Buffer) error {
+	if packet.Len() == 0 {
+		return nil
+	}
+	_, err := s.conn.Write(packet.Bytes())
+	packet.Reset()
+	return err
+}
+
+// line returns the line of sample, e.g. order_events_published_total:3|c|#type:OrderCreated
+func (s *StatsD) line(sample Sample) string {
+	kind := "g"
+	if sample.Counter {
+		kind = "c"
+	}
+	var b strings.Builder
+	b.WriteString(s.prefix)
+	b.WriteString(sample.Name)
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(sample.Value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(kind)
+	for i, label := range sample.Labels {
+		if i == 0 {
+			b.WriteString("|#")
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(label.Name)
+		b.WriteByte(':')
+		b.WriteString(tagEscaper.Replace(label.Value))
+	}
+	return b.String()
+}
+
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
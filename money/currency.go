@@ -0,0 +1,57 @@
+package money
+
+import (
+	"fmt"
+	"strings"
+)
+
+// exponents is the number of digits of the minor units of the ISO 4217
+// currencies, init adds those of currencies to the ones with none or 3
+var exponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0,
+	"XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+// currencies is the ISO 4217 currencies in circulation with 2 digits of minor units
+var currencies = strings.Fields(`
+	AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BMD BND BOB BRL BSD
+	BTN BWP BYN BZD CAD CDF CHF CNY COP CRC CUP CVE CZK DKK DOP DZD EGP ERN ETB
+	EUR FJD FKP GBP GEL GHS GIP GMD GTQ GYD HKD HNL HTG HUF IDR ILS INR IRR JMD
+	KES KGS KHR KPW KYD KZT LAK LBP LKR LRD LSL MAD MDL MGA MKD MMK MNT MOP MRU
+	MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD PAB PEN PGK PHP PKR PLN QAR
+	RON RSD RUB SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SVC SYP SZL THB
+	TJS TMT TOP TRY TTD TWD TZS UAH USD UYU UZS VES WST XCD YER ZAR ZMW ZWL
+`)
+
+func init() {
+	for _, currency := range currencies {
+		exponents[currency] = 2
+	}
+}
+
+// ValidCurrency reports whether currency is the code of an ISO 4217 currency,
+// in upper case
+func ValidCurrency(currency string) bool {
+	_, ok := exponents[currency]
+	return ok
+}
+
+// ParseCurrency returns the ISO 4217 code of currency, given in any case
+func ParseCurrency(currency string) (string, error) {
+	code := strings.ToUpper(strings.TrimSpace(currency))
+	if !ValidCurrency(code) {
+		return "", fmt.Errorf("%q is not an ISO 4217 currency", currency)
+	}
+	return code, nil
+}
+
+// Exponent returns the number of digits of the minor units of currency, such
+// as 2 for the cents of EUR, 2 for a currency not in the table
+func Exponent(currency string) int {
+	if exp, ok := exponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
@@ -0,0 +1,47 @@
+package money
+
+import (
+	"context"
+	"fmt"
+)
+
+// Converter converts amounts between currencies, such as at the rates of an
+// exchange rate provider, to report the totals of orders of several
+// currencies in one
+type Converter interface {
+	// Convert returns amount in the currency to
+	Convert(ctx context.Context, amount Money, to string) (Money, error)
+}
+
+// Rates converts amounts at fixed rates to and from a base currency
+type Rates struct {
+	base  string
+	rates map[string]float64
+}
+
+// NewRates returns the converter at rates, the units of base one unit of
+// each currency is worth
+func NewRates(base string, rates map[string]float64) *Rates {
+	r := &Rates{base: base, rates: map[string]float64{base: 1}}
+	for currency, rate := range rates {
+		r.rates[currency] = rate
+	}
+	return r
+}
+
+// Convert converts amount through the base currency, rounding once to the
+// minor units of to
+func (r *Rates) Convert(ctx context.Context, amount Money, to string) (Money, error) {
+	if amount.Currency == to {
+		return amount, nil
+	}
+	from, ok := r.rates[amount.Currency]
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate of %s", amount.Currency)
+	}
+	into, ok := r.rates[to]
+	if !ok {
+		return Money{}, fmt.Errorf("no exchange rate of %s", to)
+	}
+	return FromDecimal(amount.Decimal()*from/into, to), nil
+}
@@ -0,0 +1,303 @@
+// Package money holds amounts of money as integral minor units of an ISO 4217
+// currency, such as the cents of EUR, so that totals and refunds do not drift
+// as floating point amounts do.
+//
+// Amounts are written to JSON and DynamoDB as decimal numbers of major units,
+// 18.5 for 1850 cents, as they were before they had a currency. The currency
+// is kept once by the type holding the amounts, such as the currency of an
+// order, which resolves the amounts it reads with In.
+package money
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// unresolvedExponent is the exponent of the amounts read without their
+// currency, thousandths hold the amounts of every currency of the table
+const unresolvedExponent = 3
+
+// Money is an amount of a currency. The zero Money is zero of no currency,
+// which adds to an amount of any currency.
+type Money struct {
+	// Amount is in minor units of Currency, in thousandths while Currency is empty
+	Amount int64
+	// Currency is the ISO 4217 code, empty for an amount read without it
+	Currency string
+}
+
+// New returns the amount of minor units of currency
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// FromDecimal returns the amount of major units of currency, rounded to its
+// minor units, such as 1850 cents for 18.5 EUR
+func FromDecimal(amount float64, currency string) Money {
+	return Money{Amount: int64(math.Round(amount * scale(exponent(currency)))), Currency: currency}
+}
+
+// Parse returns the amount of currency written as a decimal number of major
+// units, failing when it has more decimals than the currency has minor units
+func Parse(s, currency string) (Money, error) {
+	exp := exponent(currency)
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	digits := strings.TrimPrefix(s, "-")
+	// json numbers may come with an exponent, such as 1e3
+	if strings.ContainsAny(digits, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return Money{}, fmt.Errorf("invalid amount %q", s)
+		}
+		digits = strconv.FormatFloat(math.Abs(f), 'f', -1, 64)
+	}
+	whole, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		whole, frac = digits[:i], digits[i+1:]
+	}
+	if whole+frac == "" || !isDigits(whole) || !isDigits(frac) {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > exp {
+		if currency == "" {
+			return Money{}, fmt.Errorf("amount %s has more than %d decimals", s, exp)
+		}
+		return Money{}, fmt.Errorf("amount %s has more decimals than %s has minor units", s, currency)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	amount, err := strconv.ParseInt(whole+frac+strings.Repeat("0", exp-len(frac)), 10, 64)
+	if err != nil {
+		return Money{}, fmt.Errorf("invalid amount %q", s)
+	}
+	if negative {
+		amount = -amount
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// isDigits reports whether s has only the digits 0 to 9
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// exponent returns the number of minor units digits of currency
+func exponent(currency string) int {
+	if currency == "" {
+		return unresolvedExponent
+	}
+	return Exponent(currency)
+}
+
+func scale(exp int) float64 {
+	return math.Pow10(exp)
+}
+
+// Decimal returns the amount in major units, for the apis taking floating
+// point amounts such as the fraud service and the grpc api
+func (m Money) Decimal() float64 {
+	return float64(m.Amount) / scale(exponent(m.Currency))
+}
+
+// text returns the amount as a decimal number of major units, with all the
+// digits of the minor units
+func (m Money) text() string {
+	exp := exponent(m.Currency)
+	digits := strconv.FormatInt(m.Amount, 10)
+	sign := ""
+	if m.Amount < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	if exp == 0 {
+		return sign + digits
+	}
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String returns the amount and its currency, such as 18.50 EUR
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.number()
+	}
+	return m.text() + " " + m.Currency
+}
+
+// number returns the amount as the shortest decimal number of major units,
+// such as 18.5 for 1850 cents
+func (m Money) number() string {
+	s := m.text()
+	if strings.Contains(s, ".") {
+		s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+	}
+	return s
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsNegative reports whether the amount is below zero
+func (m Money) IsNegative() bool {
+	return m.Amount < 0
+}
+
+// In returns the amount in currency. An amount read without its currency is
+// taken to be of currency, which fails when it has more decimals than the
+// currency has minor units; an amount of another currency fails.
+func (m Money) In(currency string) (Money, error) {
+	switch {
+	case m.Currency == currency:
+		return m, nil
+	case m.Currency == "":
+		return Parse(m.number(), currency)
+	case m.Amount == 0:
+		return Money{Currency: currency}, nil
+	}
+	return Money{}, fmt.Errorf("amount %s is not in %s", m, currency)
+}
+
+// common returns a and b in the same currency, that of the one which has a
+// currency. It panics when they have different currencies, which the types
+// holding amounts rule out, as a sum of two currencies has no meaning.
+func common(a, b Money) (Money, Money) {
+	if a.Currency == b.Currency {
+		return a, b
+	}
+	if a.Currency == "" {
+		b, a = common(b, a)
+		return a, b
+	}
+	if b.Currency == "" {
+		// an amount read without its currency is in thousandths, rounded
+		// to the minor units of the currency it is added to
+		b = Money{Amount: rescale(b.Amount, unresolvedExponent, Exponent(a.Currency)), Currency: a.Currency}
+		return a, b
+	}
+	panic(fmt.Sprintf("money: %s and %s are of different currencies", a, b))
+}
+
+// rescale returns amount of exponent from in exponent to, rounded half away
+// from zero
+func rescale(amount int64, from, to int) int64 {
+	for ; from < to; from++ {
+		amount *= 10
+	}
+	for ; from > to; from-- {
+		if amount < 0 {
+			amount = (amount - 5) / 10
+		} else {
+			amount = (amount + 5) / 10
+		}
+	}
+	return amount
+}
+
+// Add returns m plus n, which has to be of the same currency
+func (m Money) Add(n Money) Money {
+	m, n = common(m, n)
+	return Money{Amount: m.Amount + n.Amount, Currency: m.Currency}
+}
+
+// Sub returns m minus n, which has to be of the same currency
+func (m Money) Sub(n Money) Money {
+	m, n = common(m, n)
+	return Money{Amount: m.Amount - n.Amount, Currency: m.Currency}
+}
+
+// Mul returns m times n, such as the price of a quantity
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// MulRate returns m times rate, such as a tax or discount rate, rounded to
+// the minor units of its currency
+func (m Money) MulRate(rate float64) Money {
+	return Money{Amount: int64(math.Round(float64(m.Amount) * rate)), Currency: m.Currency}
+}
+
+// WithoutCurrency returns the amount of no currency, in thousandths as the
+// amounts read without one, such as to add up the totals of several
+// currencies
+func (m Money) WithoutCurrency() Money {
+	if m.Currency == "" {
+		return m
+	}
+	return Money{Amount: rescale(m.Amount, exponent(m.Currency), unresolvedExponent)}
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or more than n, which
+// has to be of the same currency
+func (m Money) Cmp(n Money) int {
+	m, n = common(m, n)
+	switch {
+	case m.Amount < n.Amount:
+		return -1
+	case m.Amount > n.Amount:
+		return 1
+	}
+	return 0
+}
+
+// MarshalJSON encodes the amount as a decimal number of major units
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.number()), nil
+}
+
+// UnmarshalJSON decodes a decimal number of major units, which is of no
+// currency until the type holding it resolves it with In
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("amount must be a number: %v", err)
+	}
+	if n == "" {
+		*m = Money{}
+		return nil
+	}
+	v, err := Parse(string(n), "")
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+// MarshalDynamoDBAttributeValue stores the amount as a number of major units
+func (m Money) MarshalDynamoDBAttributeValue() (types.AttributeValue, error) {
+	return &types.AttributeValueMemberN{Value: m.number()}, nil
+}
+
+// UnmarshalDynamoDBAttributeValue reads a number of major units, which is of
+// no currency until the type holding it resolves it with In
+func (m *Money) UnmarshalDynamoDBAttributeValue(av types.AttributeValue) error {
+	switch v := av.(type) {
+	case *types.AttributeValueMemberN:
+		parsed, err := Parse(v.Value, "")
+		if err != nil {
+			return err
+		}
+		*m = parsed
+	case *types.AttributeValueMemberNULL:
+		*m = Money{}
+	default:
+		return fmt.Errorf("amount must be a number, not %T", av)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package money
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency string
+		want     Money
+	}{
+		{"18.5", "EUR", New(1850, "EUR")},
+		{"18.50", "EUR", New(1850, "EUR")},
+		{" 7 ", "USD", New(700, "USD")},
+		{"0.01", "USD", New(1, "USD")},
+		{".5", "USD", New(50, "USD")},
+		{"5.", "USD", New(500, "USD")},
+		{"-0.5", "USD", New(-50, "USD")},
+		{"1.2500", "USD", New(125, "USD")},
+		{"1e3", "USD", New(100000, "USD")},
+		{"1.5e-1", "USD", New(15, "USD")},
+		{"1500", "JPY", New(1500, "JPY")},
+		{"1.234", "BHD", New(1234, "BHD")},
+		{"1.234", "", New(1234, "")},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.s, tt.currency)
+		if err != nil {
+			t.Errorf("Parse(%q, %q): %v", tt.s, tt.currency, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Parse(%q, %q) = %+v, want %+v", tt.s, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		s        string
+		currency string
+	}{
+		{"", "USD"},
+		{"-", "USD"},
+		{".", "USD"},
+		{"--5", "USD"},
+		{"+5", "USD"},
+		{"1.+5", "USD"},
+		{"1.2.3", "USD"},
+		{"1,5", "USD"},
+		{"1_000", "USD"},
+		{"ten", "USD"},
+		{"9223372036854775807", "USD"},
+		// more decimals than the currency has minor units
+		{"1.005", "USD"},
+		{"1.5", "JPY"},
+		{"1.2345", ""},
+	}
+	for _, tt := range tests {
+		if got, err := Parse(tt.s, tt.currency); err == nil {
+			t.Errorf("Parse(%q, %q) = %+v, want an error", tt.s, tt.currency, got)
+		}
+	}
+}
+
+func TestParseFormatRoundTrip(t *testing.T) {
+	for _, m := range []Money{New(1850, "EUR"), New(-1, "USD"), New(0, "USD"), New(1500, "JPY"), New(1234, "BHD")} {
+		got, err := Parse(m.number(), m.Currency)
+		if err != nil {
+			t.Fatalf("Parse(%q, %q): %v", m.number(), m.Currency, err)
+		}
+		if got != m {
+			t.Errorf("Parse(%q, %q) = %+v, want %+v", m.number(), m.Currency, got, m)
+		}
+	}
+}
+
+func TestMulRate(t *testing.T) {
+	tests := []struct {
+		m    Money
+		rate float64
+		want Money
+	}{
+		{New(1999, "USD"), 0.08, New(160, "USD")},
+		{New(1000, "EUR"), 0.1, New(100, "EUR")},
+		{New(333, "JPY"), 0.5, New(167, "JPY")},
+		{New(-250, "USD"), 0.1, New(-25, "USD")},
+	}
+	for _, tt := range tests {
+		if got := tt.m.MulRate(tt.rate); got != tt.want {
+			t.Errorf("%s.MulRate(%v) = %s, want %s", tt.m, tt.rate, got, tt.want)
+		}
+	}
+}
+
+func TestWithoutCurrency(t *testing.T) {
+	sum := New(1850, "EUR").WithoutCurrency().Add(New(1500, "JPY").WithoutCurrency()).Add(New(1234, "BHD").WithoutCurrency())
+	if got, want := sum.number(), "1519.734"; got != want {
+		t.Errorf("sum of the amounts without their currency = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,163 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/retry"
+)
+
+// utf8 is the charset of the emails
+const utf8 = "UTF-8"
+
+// SESSender sends emails with Amazon SES
+type SESSender struct {
+	client *sesv2.Client
+	from   string
+}
+
+// NewSESSender returns a sender of emails from the address of cfg, calling SES
+// with awsConfig
+func NewSESSender(cfg *config.EmailConfig, awsConfig aws.Config) *SESSender {
+	client := sesv2.NewFromConfig(awsConfig, func(o *sesv2.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	return &SESSender{client: client, from: cfg.From}
+}
+
+func (s *SESSender) Send(ctx context.Context, msg *Message) error {
+	if msg.To == "" {
+		return retry.Permanent(ErrNoRecipient)
+	}
+	_, err := s.client.SendEmail(ctx, &sesv2.SendEmailInput{
+		FromEmailAddress: aws.String(s.from),
+		Destination:      &types.Destination{ToAddresses: []string{msg.To}},
+		Content: &types.EmailContent{
+			Simple: &types.Message{
+				Subject: &types.Content{Data: aws.String(msg.Subject), Charset: aws.String(utf8)},
+				Body:    &types.Body{Text: &types.Content{Data: aws.String(msg.Body), Charset: aws.String(utf8)}},
+			},
+		},
+	})
+	var rejected *types.MessageRejected
+	if errors.As(err, &rejected) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// SMTPSender sends emails through a mail server, upgrading the connection
+// with STARTTLS when the server offers it
+type SMTPSender struct {
+	address  string
+	host     string
+	username string
+	password string
+	from     string
+	timeout  time.Duration
+}
+
+// NewSMTPSender returns a sender of emails from the address of cfg through its
+// mail server, each one within timeout
+func NewSMTPSender(cfg *config.EmailConfig, timeout time.Duration) *SMTPSender {
+	return &SMTPSender{
+		address:  net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(cfg.SMTP.Port)),
+		host:     cfg.SMTP.Host,
+		username: cfg.SMTP.Username,
+		password: cfg.SMTP.Password,
+		from:     cfg.From,
+		timeout:  timeout,
+	}
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg *Message) error {
+	if msg.To == "" {
+		return retry.Permanent(ErrNoRecipient)
+	}
+	body, err := s.compose(msg)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return retry.Permanent(err)
+		}
+	}
+	if err := client.Mail(s.from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		// the server refuses the recipient
+		return retry.Permanent(err)
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// compose returns msg as a plain text email
+func (s *SMTPSender) compose(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode(utf8, msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=" + utf8 + "\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&buf)
+	if _, err := w.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+// Package notify sends the emails and text messages notifying customers of the
+// events of their orders, with SES or SMTP and with SNS or Twilio, and renders
+// them from the templates of the event types.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+// the channels notifications are sent through
+const (
+	ChannelEmail = "email"
+	ChannelSMS   = "sms"
+)
+
+// Channels lists every channel
+var Channels = []string{ChannelEmail, ChannelSMS}
+
+// ErrNoRecipient is returned for messages without an address or phone number
+var ErrNoRecipient = errors.New("notification has no recipient")
+
+// Message is a notification of a customer
+type Message struct {
+	Channel string
+	// To is the email address or the E.164 phone number of the customer
+	To string
+	// Subject is the subject of emails, text messages have none
+	Subject string
+	Body    string
+}
+
+// NotificationSender sends the messages of a channel. A failure the provider
+// will not accept on another attempt, such as an invalid recipient, is marked
+// with retry.Permanent.
+type NotificationSender interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// NewEmailSender returns the sender of the email provider of cfg, nil when it
+// has none. SES is called with awsConfig.
+func NewEmailSender(cfg *config.NotificationsConfig, awsConfig aws.Config) (NotificationSender, error) {
+	switch cfg.Email.Provider {
+	case "":
+		return nil, nil
+	case config.EmailProviderSES:
+		return NewSESSender(&cfg.Email, awsConfig), nil
+	case config.EmailProviderSMTP:
+		return NewSMTPSender(&cfg.Email, cfg.Timeout.Duration), nil
+	}
+	return nil, fmt.Errorf("unknown email provider %q", cfg.Email.Provider)
+}
+
+// NewSMSSender returns the sender of the sms provider of cfg, nil when it has
+// none. SNS is called with awsConfig and Twilio with a client of clients.
+func NewSMSSender(cfg *config.NotificationsConfig, awsConfig aws.Config, clients *httpclient.Factory) (NotificationSender, error) {
+	switch cfg.SMS.Provider {
+	case "":
+		return nil, nil
+	case config.SMSProviderSNS:
+		return NewSNSSender(&cfg.SMS, awsConfig), nil
+	case config.SMSProviderTwilio:
+		return NewTwilioSender(&cfg.SMS, clients.Client("twilio", cfg.Timeout.Duration)), nil
+	}
+	return nil, fmt.Errorf("unknown sms provider %q", cfg.SMS.Provider)
+}
@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/retry"
+)
+
+const twilioDefaultEndpoint = "https://api.twilio.com"
+
+// SNSSender sends text messages with Amazon SNS, as transactional messages
+type SNSSender struct {
+	client   *sns.Client
+	senderID string
+}
+
+// NewSNSSender returns a sender of text messages in the name of the sender id
+// of cfg, calling SNS with awsConfig
+func NewSNSSender(cfg *config.SMSConfig, awsConfig aws.Config) *SNSSender {
+	client := sns.NewFromConfig(awsConfig, func(o *sns.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	return &SNSSender{client: client, senderID: cfg.SenderID}
+}
+
+func (s *SNSSender) Send(ctx context.Context, msg *Message) error {
+	if msg.To == "" {
+		return retry.Permanent(ErrNoRecipient)
+	}
+	attributes := map[string]types.MessageAttributeValue{
+		"AWS.SNS.SMS.SMSType": {DataType: aws.String("String"), StringValue: aws.String("Transactional")},
+	}
+	if s.senderID != "" {
+		attributes["AWS.SNS.SMS.SenderID"] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(s.senderID)}
+	}
+	_, err := s.client.Publish(ctx, &sns.PublishInput{
+		PhoneNumber:       aws.String(msg.To),
+		Message:           aws.String(msg.Body),
+		MessageAttributes: attributes,
+	})
+	var invalid *types.InvalidParameterException
+	if errors.As(err, &invalid) {
+		return retry.Permanent(err)
+	}
+	return err
+}
+
+// TwilioSender sends text messages with the messages api of Twilio
+type TwilioSender struct {
+	client     *http.Client
+	endpoint   string
+	accountSID string
+	authToken  string
+	from       string
+}
+
+// NewTwilioSender returns a sender of text messages with the account of cfg,
+// calling Twilio with client
+func NewTwilioSender(cfg *config.SMSConfig, client *http.Client) *TwilioSender {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = twilioDefaultEndpoint
+	}
+	return &TwilioSender{
+		client:     client,
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		accountSID: cfg.Twilio.AccountSID,
+		authToken:  cfg.Twilio.AuthToken,
+		from:       cfg.Twilio.From,
+	}
+}
+
+// twilioError is the error body of the twilio api
+type twilioError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (t *TwilioSender) Send(ctx context.Context, msg *Message) error {
+	if msg.To == "" {
+		return retry.Permanent(ErrNoRecipient)
+	}
+	form := url.Values{"To": {msg.To}, "Body": {msg.Body}}
+	// a messaging service picks the number of each message itself
+	if strings.HasPrefix(t.from, "MG") {
+		form.Set("MessagingServiceSid", t.from)
+	} else {
+		form.Set("From", t.from)
+	}
+	u := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", t.endpoint, url.PathEscape(t.accountSID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.accountSID, t.authToken)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	var body twilioError
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	json.Unmarshal(data, &body)
+	err = fmt.Errorf("twilio responded %s: %d %s", resp.Status, body.Code, body.Message)
+	if retry.RetryableStatus(resp.StatusCode) {
+		return err
+	}
+	return retry.Permanent(err)
+}
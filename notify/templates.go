@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/events"
+)
+
+// Item is a line item of the notified order
+type Item struct {
+	SKU      string
+	Name     string
+	Quantity int
+}
+
+// Data is what the templates of a message render
+type Data struct {
+	// Event is the type of the notified event
+	Event events.Type
+	// Name is the name of the customer
+	Name    string
+	OrderID string
+	Status  string
+	// Total is the total of the order with its currency, such as 18.50 EUR
+	Total string
+	Items []Item
+	// Reason is the reason of a cancelled order or of a rejected return
+	Reason string
+	// ReturnID, ReturnStatus and Refunded are set for the events of returns
+	ReturnID     string
+	ReturnStatus string
+	Refunded     string
+	// TrackingToken looks the order up in the public tracking, it is empty
+	// when the tracking is not served
+	TrackingToken string
+}
+
+// defaultTemplates are the messages of the event types the configuration does
+// not replace
+var defaultTemplates = map[events.Type]config.NotificationTemplate{
+	events.OrderCreated: {
+		Subject: "Your order {{.OrderID}}",
+		Email: `Hello {{.Name}},
+
+thank you for your order {{.OrderID}} of {{.Total}}:
+{{range .Items}}
+  {{.Quantity}} x {{if .Name}}{{.Name}}{{else}}{{.SKU}}{{end}}{{end}}
+
+We will let you know when it ships.`,
+		SMS: "We received your order {{.OrderID}} of {{.Total}}.",
+	},
+	events.OrderEdited: {
+		Subject: "Your order {{.OrderID}} was changed",
+		Email: `Hello {{.Name}},
+
+your order {{.OrderID}} was changed, its total is now {{.Total}}:
+{{range .Items}}
+  {{.Quantity}} x {{if .Name}}{{.Name}}{{else}}{{.SKU}}{{end}}{{end}}`,
+	},
+	events.OrderCancelled: {
+		Subject: "Your order {{.OrderID}} was cancelled",
+		Email: `Hello {{.Name}},
+
+your order {{.OrderID}} was cancelled{{if .Reason}} ({{.Reason}}){{end}}. Any payment taken is refunded.`,
+		SMS: "Your order {{.OrderID}} was cancelled.",
+	},
+	events.ReturnApproved: {
+		Subject: "Your return {{.ReturnID}} was approved",
+		Email: `Hello {{.Name}},
+
+the return {{.ReturnID}} of your order {{.OrderID}} was approved, you can now send the items back.`,
+	},
+	events.ReturnRejected: {
+		Subject: "Your return {{.ReturnID}} was declined",
+		Email: `Hello {{.Name}},
+
+the return {{.ReturnID}} of your order {{.OrderID}} was declined{{if .Reason}}: {{.Reason}}{{end}}.`,
+	},
+	events.ReturnRefunded: {
+		Subject: "Your return {{.ReturnID}} was refunded",
+		Email: `Hello {{.Name}},
+
+we refunded {{.Refunded}} for the return {{.ReturnID}} of your order {{.OrderID}}.`,
+		SMS: "We refunded {{.Refunded}} for your return {{.ReturnID}}.",
+	},
+}
+
+// message is the parsed templates of the message of an event type, nil for
+// the parts it does not have
+type message struct {
+	subject *template.Template
+	email   *template.Template
+	sms     *template.Template
+}
+
+// Templates renders the messages of the event types
+type Templates struct {
+	messages map[events.Type]*message
+}
+
+// NewTemplates returns the built-in templates, replaced or completed with
+// those of the configuration by event type
+func NewTemplates(overrides map[string]config.NotificationTemplate) (*Templates, error) {
+	sources := map[events.Type]config.NotificationTemplate{}
+	for eventType, source := range defaultTemplates {
+		sources[eventType] = source
+	}
+	for name, source := range overrides {
+		eventType := events.Type(name)
+		if !eventType.Known() {
+			return nil, fmt.Errorf("notification template of unknown event type %q", name)
+		}
+		sources[eventType] = source
+	}
+
+	t := &Templates{messages: map[events.Type]*message{}}
+	for eventType, source := range sources {
+		if source.Email == "" && source.SMS == "" {
+			// the configuration turns the message of the event type off
+			continue
+		}
+		var m message
+		var err error
+		for _, part := range []struct {
+			name, text string
+			tmpl       **template.Template
+		}{
+			{"subject", source.Subject, &m.subject},
+			{"email", source.Email, &m.email},
+			{"sms", source.SMS, &m.sms},
+		} {
+			if part.text == "" {
+				continue
+			}
+			if *part.tmpl, err = template.New(part.name).Parse(part.text); err != nil {
+				return nil, fmt.Errorf("notification template of %s: %v", eventType, err)
+			}
+		}
+		t.messages[eventType] = &m
+	}
+	return t, nil
+}
+
+// Types returns the event types with a message, sorted
+func (t *Templates) Types() []events.Type {
+	types := make([]events.Type, 0, len(t.messages))
+	for eventType := range t.messages {
+		types = append(types, eventType)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// Render returns the message of data on channel addressed to to, nil when
+// the event type has no message on the channel
+func (t *Templates) Render(channel, to string, data *Data) (*Message, error) {
+	m, ok := t.messages[data.Event]
+	if !ok {
+		return nil, nil
+	}
+	body := m.email
+	if channel == ChannelSMS {
+		body = m.sms
+	}
+	if body == nil {
+		return nil, nil
+	}
+
+	msg := &Message{Channel: channel, To: to}
+	var err error
+	if msg.Body, err = execute(body, data); err != nil {
+		return nil, err
+	}
+	if channel == ChannelEmail && m.subject != nil {
+		subject, err := execute(m.subject, data)
+		if err != nil {
+			return nil, err
+		}
+		// a subject is one line, whatever the data
+		msg.Subject = strings.Join(strings.Fields(subject), " ")
+	}
+	return msg, nil
+}
+
+// execute renders tmpl with data
+func execute(tmpl *template.Template, data *Data) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("notification template %s: %v", tmpl.Name(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
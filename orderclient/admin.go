@@ -0,0 +1,224 @@
+package orderclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// DrainState tells whether an instance is draining, out of the rotation of the
+// load balancers as its health check fails
+type DrainState struct {
+	Draining bool       `json:"draining"`
+	Since    *time.Time `json:"since,omitempty"`
+}
+
+// GetConfig returns the running configuration of the instance answering, with
+// secrets redacted. Unlike the admin routes it needs no admin token.
+func (c *Client) GetConfig(ctx context.Context) (*config.Config, error) {
+	cfg := &config.Config{}
+	if err := c.call(ctx, http.MethodGet, ordersPath+"/config", nil, cfg, true); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// GetDrain returns whether the instance answering is draining
+func (c *Client) GetDrain(ctx context.Context) (*DrainState, error) {
+	return c.drain(ctx, http.MethodGet)
+}
+
+// StartDrain takes the instance answering out of rotation. With a base url
+// balanced over several instances the instance is the one the request reached.
+func (c *Client) StartDrain(ctx context.Context) (*DrainState, error) {
+	return c.drain(ctx, http.MethodPost)
+}
+
+// StopDrain puts the instance answering back in rotation
+func (c *Client) StopDrain(ctx context.Context) (*DrainState, error) {
+	return c.drain(ctx, http.MethodDelete)
+}
+
+func (c *Client) drain(ctx context.Context, method string) (*DrainState, error) {
+	state := &DrainState{}
+	if err := c.call(ctx, method, adminPath+"/drain", nil, state, true); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Maintenance tells whether an instance refuses writes for maintenance, with
+// the message of its refusals
+type Maintenance struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message,omitempty"`
+}
+
+// GetMaintenance returns the maintenance mode of the instance answering
+func (c *Client) GetMaintenance(ctx context.Context) (*Maintenance, error) {
+	m := &Maintenance{}
+	if err := c.call(ctx, http.MethodGet, adminPath+"/maintenance", nil, m, true); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetMaintenance puts the instance answering in or out of maintenance mode. It
+// lasts until the configuration of the instance is reloaded.
+func (c *Client) SetMaintenance(ctx context.Context, m *Maintenance) (*Maintenance, error) {
+	out := &Maintenance{}
+	if err := c.call(ctx, http.MethodPut, adminPath+"/maintenance", m, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// LogLevels are the log level of an instance and those of its modules with their own
+type LogLevels struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules,omitempty"`
+}
+
+// logLevelChange is the body changing a log level
+type logLevelChange struct {
+	Level  string `json:"level"`
+	Module string `json:"module,omitempty"`
+}
+
+// GetLogLevels returns the log levels of the instance answering
+func (c *Client) GetLogLevels(ctx context.Context) (*LogLevels, error) {
+	out := &LogLevels{}
+	if err := c.call(ctx, http.MethodGet, adminPath+"/loglevel", nil, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// GetLogLevel returns the log level of the instance answering
+func (c *Client) GetLogLevel(ctx context.Context) (string, error) {
+	levels, err := c.GetLogLevels(ctx)
+	if err != nil {
+		return "", err
+	}
+	return levels.Level, nil
+}
+
+// SetLogLevel changes the log level of the instance answering until its
+// configuration is reloaded
+func (c *Client) SetLogLevel(ctx context.Context, level string) (string, error) {
+	levels, err := c.SetModuleLogLevel(ctx, "", level)
+	if err != nil {
+		return "", err
+	}
+	return levels.Level, nil
+}
+
+// SetModuleLogLevel changes the log level of module, e.g. webhooks, on the
+// instance answering until its configuration is reloaded. An empty level makes
+// the module log at the level of the instance again.
+func (c *Client) SetModuleLogLevel(ctx context.Context, module, level string) (*LogLevels, error) {
+	out := &LogLevels{}
+	if err := c.call(ctx, http.MethodPut, adminPath+"/loglevel", &logLevelChange{Level: level, Module: module}, out, true); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Route is a route served by the order service
+type Route struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+// ListRoutes returns the routes of the instance answering sorted by path
+func (c *Client) ListRoutes(ctx context.Context) ([]Route, error) {
+	var routes []Route
+	if err := c.call(ctx, http.MethodGet, adminPath+"/routes", nil, &routes, true); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// SlowRequest is a request that took longer than the threshold of its route
+type SlowRequest struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	// ParamsHash tells apart the path variables and query of the requests of a route
+	ParamsHash       string  `json:"paramsHash,omitempty"`
+	Status           int     `json:"status"`
+	DurationMs       int64   `json:"durationMs"`
+	ThresholdMs      int64   `json:"thresholdMs"`
+	DbCalls          int     `json:"dbCalls"`
+	DbDurationMs     int64   `json:"dbDurationMs"`
+	ConsumedCapacity float64 `json:"consumedCapacity"`
+}
+
+// SlowRequests are the last slow requests of an instance, latest first
+type SlowRequests struct {
+	// Total is the number of slow requests found, kept or not
+	Total    int           `json:"total"`
+	Requests []SlowRequest `json:"requests"`
+}
+
+// ListSlowRequests returns the last slow requests of the instance answering
+func (c *Client) ListSlowRequests(ctx context.Context) (*SlowRequests, error) {
+	slow := &SlowRequests{}
+	if err := c.call(ctx, http.MethodGet, adminPath+"/slow-requests", nil, slow, true); err != nil {
+		return nil, err
+	}
+	return slow, nil
+}
+
+// ResetSlowRequests makes the instance answering forget its slow requests
+func (c *Client) ResetSlowRequests(ctx context.Context) error {
+	return c.call(ctx, http.MethodDelete, adminPath+"/slow-requests", nil, nil, true)
+}
+
+// CapacityUsage is the DynamoDB capacity consumed for a route, operation and
+// table, those it is not grouped by are empty
+type CapacityUsage struct {
+	Route      string  `json:"route,omitempty"`
+	Operation  string  `json:"operation,omitempty"`
+	Table      string  `json:"table,omitempty"`
+	ReadUnits  float64 `json:"readUnits"`
+	WriteUnits float64 `json:"writeUnits"`
+	Cost       float64 `json:"cost"`
+}
+
+// Capacity is the DynamoDB capacity consumed by an instance since it started
+// or was reset, with its estimated cost
+type Capacity struct {
+	Since          time.Time        `json:"since"`
+	ReadUnitPrice  float64          `json:"readUnitPrice"`
+	WriteUnitPrice float64          `json:"writeUnitPrice"`
+	ReadUnits      float64          `json:"readUnits"`
+	WriteUnits     float64          `json:"writeUnits"`
+	Cost           float64          `json:"cost"`
+	Usage          []*CapacityUsage `json:"usage"`
+}
+
+// GetCapacity returns the DynamoDB capacity consumed by the instance
+// answering, the costliest usage first. by groups it by route, operation or
+// table, or when empty by the three.
+func (c *Client) GetCapacity(ctx context.Context, by string) (*Capacity, error) {
+	path := adminPath + "/capacity"
+	if by != "" {
+		path += "?by=" + url.QueryEscape(by)
+	}
+	capacity := &Capacity{}
+	if err := c.call(ctx, http.MethodGet, path, nil, capacity, true); err != nil {
+		return nil, err
+	}
+	return capacity, nil
+}
+
+// ResetCapacity makes the instance answering forget the capacity it consumed
+func (c *Client) ResetCapacity(ctx context.Context) error {
+	return c.call(ctx, http.MethodDelete, adminPath+"/capacity", nil, nil, true)
+}
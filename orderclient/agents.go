@@ -0,0 +1,85 @@
+package orderclient
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// the steps of the fulfillment of an order an agent confirms
+const (
+	ConfirmationPick = "pick"
+	ConfirmationPack = "pack"
+	ConfirmationShip = "ship"
+)
+
+// ConfirmedItem is a quantity of a SKU picked or packed
+type ConfirmedItem struct {
+	SKU      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+// ConfirmationRequest is a pick, pack or shipment of an order confirmed by a
+// warehouse agent. ID is chosen by the agent and kept when it is sent again.
+type ConfirmationRequest struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	OrderID     string          `json:"orderId"`
+	WarehouseID string          `json:"warehouseId"`
+	Items       []ConfirmedItem `json:"items,omitempty"`
+	// Carrier and TrackingNumber name the parcel of a ship confirmation
+	Carrier        string `json:"carrier,omitempty"`
+	TrackingNumber string `json:"trackingNumber,omitempty"`
+	// OccurredAt is the time of the confirmation on the agent, such as while
+	// it was offline
+	OccurredAt time.Time `json:"occurredAt,omitempty"`
+}
+
+// Confirmation is a confirmation recorded in its order
+type Confirmation struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	WarehouseID string          `json:"warehouseId"`
+	HostID      string          `json:"hostId"`
+	Items       []ConfirmedItem `json:"items,omitempty"`
+	// ShipmentID is the shipment of a ship confirmation
+	ShipmentID string    `json:"shipmentId,omitempty"`
+	OccurredAt time.Time `json:"occurredAt"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// ConfirmationResult is the outcome of a confirmation of a batch: Status 201
+// when it was recorded, 200 when it was recorded before, else the error
+type ConfirmationResult struct {
+	ID           string        `json:"id"`
+	Status       int           `json:"status"`
+	Confirmation *Confirmation `json:"confirmation,omitempty"`
+	Error        string        `json:"error,omitempty"`
+	Code         string        `json:"code,omitempty"`
+}
+
+// ConfirmFulfillment records the confirmation of req in its order, signed with
+// the agent key of the client. Confirmations are recorded once by id, so they
+// are sent again after transient failures.
+func (c *Client) ConfirmFulfillment(ctx context.Context, req *ConfirmationRequest) (*Confirmation, error) {
+	confirmation := &Confirmation{}
+	if err := c.call(ctx, http.MethodPost, agentPath+"/confirmations", req, confirmation, true); err != nil {
+		return nil, err
+	}
+	return confirmation, nil
+}
+
+// BatchConfirmFulfillment records the confirmations an agent kept while
+// offline, up to 100, in order, and returns the outcome of each
+func (c *Client) BatchConfirmFulfillment(ctx context.Context, reqs []*ConfirmationRequest) ([]*ConfirmationResult, error) {
+	body := struct {
+		Confirmations []*ConfirmationRequest `json:"confirmations"`
+	}{Confirmations: reqs}
+	var resp struct {
+		Results []*ConfirmationResult `json:"results"`
+	}
+	if err := c.call(ctx, http.MethodPost, agentPath+"/confirmations/batch", &body, &resp, true); err != nil {
+		return nil, err
+	}
+	return resp.Results, nil
+}
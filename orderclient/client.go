@@ -0,0 +1,399 @@
+// Package orderclient is the Go client of the order REST api. Orders are the
+// orderpb messages the api and its OpenAPI document are generated from:
+//
+//	client, err := orderclient.New(orderclient.WithBaseURL("https://orders.example.com"), orderclient.WithToken(token))
+//	order, err := client.GetOrder(ctx, id)
+//
+// Reads, and cancellations which may be repeated, are tried again after
+// transient failures; creating an order is not.
+package orderclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/omnom-nom/order/retry"
+)
+
+const (
+	// DefaultBaseURL is the address of a server running with the default configuration
+	DefaultBaseURL = "http://localhost:8080"
+	// ordersPath prefixes the order routes
+	ordersPath = "/v1/order"
+	// adminPath prefixes the routes of the admin api
+	adminPath = "/v1/admin"
+	// hostsPath prefixes the routes of the host registry
+	hostsPath = "/v1/host"
+	// agentPath prefixes the routes of the warehouse agents
+	agentPath = "/v1/agent"
+	// hostHeader names the registered host a request is made from
+	hostHeader = "X-Host-Id"
+	// agentTimestampHeader and agentSignatureHeader sign the requests of the
+	// agents with the key of their host
+	agentTimestampHeader = "X-Agent-Timestamp"
+	agentSignatureHeader = "X-Agent-Signature"
+	// apiKeyHeader carries the api key the quotas of the requests are counted by
+	apiKeyHeader = "X-Api-Key"
+	// tenantHeader names the tenant of the requests
+	tenantHeader = "X-Tenant-Id"
+	// maxErrorBody bounds the part of an error response read for its message
+	maxErrorBody = 64 << 10
+)
+
+var (
+	// ErrNotFound matches the errors of requests for orders that do not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict matches the errors of changes conflicting with the state of the order
+	ErrConflict = errors.New("conflict")
+	// ErrInvalid matches the errors of requests the server refused as invalid
+	ErrInvalid = errors.New("invalid request")
+)
+
+// Error is a response of the server with an error status
+type Error struct {
+	StatusCode int
+	// Code is the machine readable code of the error, e.g. ORDER_NOT_FOUND,
+	// empty when the response has none
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("order api: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches the errors of the status codes of ErrNotFound, ErrConflict and ErrInvalid
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict || e.StatusCode == http.StatusPreconditionFailed
+	case ErrInvalid:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	}
+	return false
+}
+
+// Client calls the order api
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	token      string
+	adminToken string
+	userAgent  string
+	hostID     string
+	agentKey   string
+	apiKey     string
+	tenant     string
+	retry      retry.Policy
+}
+
+// Option sets an option of a Client
+type Option func(c *Client)
+
+// WithBaseURL makes the client call the server at baseURL, DefaultBaseURL by default
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithHTTPClient makes the client send its requests with client, whose
+// transport WithTLSConfig then leaves alone
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = client
+	}
+}
+
+// WithTLSConfig makes the client connect to the server with cfg, for private
+// certificate authorities and client certificates
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = cfg
+	}
+}
+
+// WithToken sends token as the bearer token of every request
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// WithAdminToken sends token as the bearer token of the admin api requests,
+// which send the token of WithToken otherwise
+func WithAdminToken(token string) Option {
+	return func(c *Client) {
+		c.adminToken = token
+	}
+}
+
+// WithUserAgent sends userAgent as the User-Agent of every request
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithHostID sends id as the registered host of every request, for the servers
+// refusing the requests of hosts that are not registered
+func WithHostID(id string) Option {
+	return func(c *Client) {
+		c.hostID = id
+	}
+}
+
+// WithAgentKey signs every request with key, the key the admin api issued the
+// host of WithHostID, which the host routes and the agent api require
+func WithAgentKey(key string) Option {
+	return func(c *Client) {
+		c.agentKey = key
+	}
+}
+
+// WithAPIKey sends key as the api key of every request, which authenticates
+// the tenant the requests are made for and the quotas of the server count
+// the requests by
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithTenant sends id as the tenant of every request, the server refuses
+// the requests whose api key does not authenticate it
+func WithTenant(id string) Option {
+	return func(c *Client) {
+		c.tenant = id
+	}
+}
+
+// WithTimeout bounds every attempt of a request by timeout, 30s by default and
+// 0 for no bound besides the context of the call
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRetries tries the requests that may be repeated up to maxAttempts times,
+// counting the first, with a backoff doubling from initialBackoff up to
+// maxBackoff. 3 attempts from 100ms up to 2s by default, 1 attempt disables
+// retries.
+func WithRetries(maxAttempts int, initialBackoff, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.retry.MaxAttempts = maxAttempts
+		c.retry.InitialBackoff = initialBackoff
+		c.retry.MaxBackoff = maxBackoff
+	}
+}
+
+// New returns a client with opts
+func New(opts ...Option) (*Client, error) {
+	c := &Client{
+		baseURL:   DefaultBaseURL,
+		timeout:   30 * time.Second,
+		userAgent: "orderclient",
+		retry: retry.Policy{
+			MaxAttempts:    3,
+			InitialBackoff: 100 * time.Millisecond,
+			MaxBackoff:     2 * time.Second,
+		},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	u, err := url.Parse(c.baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("base url %q must be an absolute url", c.baseURL)
+	}
+	if c.retry.MaxAttempts < 1 {
+		return nil, fmt.Errorf("max attempts must be at least 1")
+	}
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.tlsConfig
+		c.httpClient = &http.Client{Transport: transport}
+	}
+	c.retry.Retryable = retryable
+	return c, nil
+}
+
+// retryable reports whether a request failing with err may succeed when sent again
+func retryable(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return retry.RetryableStatus(apiErr.StatusCode)
+	}
+	return retry.Temporary(err)
+}
+
+// call sends a request with the json body in, decoding the response into out
+// when not nil. Requests that may be repeated are tried again after transient
+// failures.
+func (c *Client) call(ctx context.Context, method, path string, in, out interface{}, repeatable bool) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if msg, ok := in.(proto.Message); ok {
+			body, err = protojson.Marshal(msg)
+		} else {
+			body, err = json.Marshal(in)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+	}
+
+	attempt := func(ctx context.Context) error {
+		return c.send(ctx, method, path, body, out)
+	}
+	if !repeatable {
+		return attempt(ctx)
+	}
+	return c.retry.Do(ctx, attempt)
+}
+
+// send makes one attempt of a request
+func (c *Client) send(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if msg, ok := out.(proto.Message); ok {
+		// the hand written routes answer with more fields than the messages have
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, msg)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// do sends a request and returns its response, an Error for an error status
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// Do sends one attempt of a request for path, which may hold a query, with
+// the credentials of the client and the headers of header replacing its
+// own. Unlike the
+// other methods it returns the response whatever its status; the caller
+// closes its body.
+func (c *Client) Do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+	}
+	return c.httpClient.Do(req)
+}
+
+// newRequest returns a request for path with the headers of the client
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token := c.token
+	if c.adminToken != "" && strings.HasPrefix(path, adminPath+"/") {
+		token = c.adminToken
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.hostID != "" {
+		req.Header.Set(hostHeader, c.hostID)
+	}
+	if c.apiKey != "" {
+		req.Header.Set(apiKeyHeader, c.apiKey)
+	}
+	if c.tenant != "" {
+		req.Header.Set(tenantHeader, c.tenant)
+	}
+	if c.agentKey != "" {
+		signAgentRequest(req, c.agentKey, time.Now().Unix(), body)
+	}
+	return req, nil
+}
+
+// signAgentRequest signs req, with body, with the agent key of its host at the
+// unix time timestamp: the hex HMAC-SHA256 of
+// "<timestamp>.<method>.<request uri>.<body>"
+func signAgentRequest(req *http.Request, key string, timestamp int64, body []byte) {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%d.%s.%s.", timestamp, req.Method, req.URL.RequestURI())
+	mac.Write(body)
+	req.Header.Set(agentTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(agentSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// responseError returns the Error of resp, with the message of its
+// {"error": "..."} body or the body itself
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	message := strings.TrimSpace(string(data))
+	if err := json.Unmarshal(data, &body); err == nil && body.Error != "" {
+		message = body.Error
+	}
+	return &Error{StatusCode: resp.StatusCode, Code: body.Code, Message: message}
+}
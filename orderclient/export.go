@@ -0,0 +1,91 @@
+package orderclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Export formats
+const (
+	ExportCSV  = "csv"
+	ExportJSON = "json"
+)
+
+// ExportRequest selects the orders of an export
+type ExportRequest struct {
+	// Format is ExportCSV, the default, or ExportJSON for JSON lines
+	Format string
+	// Columns are the csv columns, the default columns when empty
+	Columns []string
+	// From and To bound the creation of the orders, From inclusive and To
+	// exclusive, unbounded when zero
+	From, To   time.Time
+	Status     string
+	CustomerID string
+}
+
+// Export is the stream of an export, its rows are read from it. Read returns
+// the error that ended the export early, reported by the server after the
+// rows, instead of io.EOF.
+type Export struct {
+	resp *http.Response
+	// Count is the number of orders exported, set once the export was read to its end
+	Count int
+}
+
+// ExportOrders starts the export of the orders of req, newest first. The
+// export is streamed and not bounded by the timeout of the client, but by ctx.
+func (c *Client) ExportOrders(ctx context.Context, req *ExportRequest) (*Export, error) {
+	query := url.Values{}
+	if req.Format != "" {
+		query.Set("format", req.Format)
+	}
+	if len(req.Columns) > 0 {
+		query.Set("columns", strings.Join(req.Columns, ","))
+	}
+	if !req.From.IsZero() {
+		query.Set("from", req.From.Format(time.RFC3339))
+	}
+	if !req.To.IsZero() {
+		query.Set("to", req.To.Format(time.RFC3339))
+	}
+	if req.Status != "" {
+		query.Set("status", req.Status)
+	}
+	if req.CustomerID != "" {
+		query.Set("customer", req.CustomerID)
+	}
+	path := ordersPath + "/export"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{resp: resp}, nil
+}
+
+func (e *Export) Read(p []byte) (int, error) {
+	n, err := e.resp.Body.Read(p)
+	if err == io.EOF {
+		// the trailer is set once the body was read to its end
+		e.Count, _ = strconv.Atoi(e.resp.Trailer.Get("X-Export-Count"))
+		if message := e.resp.Trailer.Get("X-Export-Error"); message != "" {
+			return n, fmt.Errorf("export ended early: %s", message)
+		}
+	}
+	return n, err
+}
+
+// Close releases the connection of the export, ending it when it was not read to its end
+func (e *Export) Close() error {
+	return e.resp.Body.Close()
+}
@@ -0,0 +1,79 @@
+package orderclient
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Host is a host registered with the order api, such as a warehouse agent
+type Host struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	// Live tells whether the last heartbeat of the host is recent enough
+	Live         bool      `json:"live"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	LastSeen     time.Time `json:"lastSeen"`
+	// Key is the agent key issued to the host, returned only by
+	// RotateHostKey. WithAgentKey signs the requests of the host with it.
+	Key string `json:"key,omitempty"`
+}
+
+// RegisterHostRequest describes the host registering, ID is required
+type RegisterHostRequest struct {
+	ID      string            `json:"id"`
+	Address string            `json:"address,omitempty"`
+	Version string            `json:"version,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// RegisterHost registers the host of req, or registers it again with its
+// address, version and labels. Registering counts as a heartbeat. The client
+// is made WithHostID and WithAgentKey of the host, which RotateHostKey
+// provisions beforehand.
+func (c *Client) RegisterHost(ctx context.Context, req *RegisterHostRequest) (*Host, error) {
+	host := &Host{}
+	if err := c.call(ctx, http.MethodPost, hostsPath+"/register", req, host, true); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// HeartbeatHost keeps the host with id live, the host of the client
+func (c *Client) HeartbeatHost(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodPost, hostsPath+"/"+url.PathEscape(id)+"/heartbeat", nil, nil, true)
+}
+
+// DeregisterHost removes the host with id, the host of the client, from the
+// registry
+func (c *Client) DeregisterHost(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, hostsPath+"/"+url.PathEscape(id), nil, nil, true)
+}
+
+// RotateHostKey issues a new agent key to the host with id, provisioning it
+// when it is not registered, and returns the host with it, an admin route
+func (c *Client) RotateHostKey(ctx context.Context, id string) (*Host, error) {
+	host := &Host{}
+	if err := c.call(ctx, http.MethodPost, adminPath+"/hosts/"+url.PathEscape(id)+"/key", nil, host, false); err != nil {
+		return nil, err
+	}
+	return host, nil
+}
+
+// ListHosts returns the registered hosts, only the live ones with onlyLive
+func (c *Client) ListHosts(ctx context.Context, onlyLive bool) ([]*Host, error) {
+	path := hostsPath + "/list"
+	if onlyLive {
+		path += "?live=true"
+	}
+	var resp struct {
+		Hosts []*Host `json:"hosts"`
+	}
+	if err := c.call(ctx, http.MethodGet, path, nil, &resp, true); err != nil {
+		return nil, err
+	}
+	return resp.Hosts, nil
+}
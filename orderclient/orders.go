@@ -0,0 +1,170 @@
+package orderclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/omnom-nom/order/proto/orderpb"
+)
+
+// CancelReason is the reason code of a cancellation
+type CancelReason string
+
+const (
+	CancelCustomerRequest CancelReason = "customer_request"
+	CancelPaymentFailed   CancelReason = "payment_failed"
+	CancelOutOfStock      CancelReason = "out_of_stock"
+	CancelFraudSuspected  CancelReason = "fraud_suspected"
+	CancelDuplicate       CancelReason = "duplicate"
+	CancelOther           CancelReason = "other"
+)
+
+// CancelOrderRequest is the reason of a cancellation
+type CancelOrderRequest struct {
+	Reason CancelReason `json:"reason"`
+	// Note explains the cancellation, at most 500 characters
+	Note string `json:"note,omitempty"`
+}
+
+// CreateOrder places the order of req. It is not tried again after a failure,
+// which may have placed the order.
+func (c *Client) CreateOrder(ctx context.Context, req *orderpb.CreateOrderRequest) (*orderpb.Order, error) {
+	order := &orderpb.Order{}
+	if err := c.call(ctx, http.MethodPost, ordersPath+"/create", req, order, false); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// GetOrder returns the order with id, an error matching ErrNotFound when there is none
+func (c *Client) GetOrder(ctx context.Context, id string) (*orderpb.Order, error) {
+	if id == "" {
+		return nil, fmt.Errorf("order id is required")
+	}
+	order := &orderpb.Order{}
+	if err := c.call(ctx, http.MethodGet, ordersPath+"/"+url.PathEscape(id), nil, order, true); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// ListOrders returns the page of orders selected by req and the token of the
+// next page, empty after the last page. Orders iterates over all pages.
+func (c *Client) ListOrders(ctx context.Context, req *orderpb.ListOrdersRequest) (*orderpb.ListOrdersResponse, error) {
+	query := url.Values{}
+	if req.GetCustomerId() != "" {
+		query.Set("customer_id", req.GetCustomerId())
+	}
+	if req.GetStatus() != "" {
+		query.Set("status", req.GetStatus())
+	}
+	if req.GetLimit() > 0 {
+		query.Set("limit", strconv.Itoa(int(req.GetLimit())))
+	}
+	if req.GetPageToken() != "" {
+		query.Set("page_token", req.GetPageToken())
+	}
+	path := ordersPath + "/list"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp := &orderpb.ListOrdersResponse{}
+	if err := c.call(ctx, http.MethodGet, path, nil, resp, true); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// CancelOrder cancels the order with id for the reason of req and returns it.
+// Cancelling a cancelled order again retries a failed refund, so a failed
+// cancellation is tried again.
+func (c *Client) CancelOrder(ctx context.Context, id string, req *CancelOrderRequest) (*orderpb.Order, error) {
+	if id == "" {
+		return nil, fmt.Errorf("order id is required")
+	}
+	order := &orderpb.Order{}
+	if err := c.call(ctx, http.MethodPost, ordersPath+"/"+url.PathEscape(id)+"/cancel", req, order, true); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// OrderIterator iterates over the orders of all the pages of a listing,
+// fetching a page when the previous one is used up:
+//
+//	it := client.Orders(ctx, &orderpb.ListOrdersRequest{CustomerId: id})
+//	for it.Next() {
+//		order := it.Order()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type OrderIterator struct {
+	ctx    context.Context
+	client *Client
+	req    *orderpb.ListOrdersRequest
+	page   []*orderpb.Order
+	order  *orderpb.Order
+	// done is set once the last page was fetched
+	done bool
+	err  error
+}
+
+// Orders returns an iterator over the orders selected by req, with pages of
+// req.Limit orders fetched with ctx
+func (c *Client) Orders(ctx context.Context, req *orderpb.ListOrdersRequest) *OrderIterator {
+	if req == nil {
+		req = &orderpb.ListOrdersRequest{}
+	}
+	return &OrderIterator{
+		ctx:    ctx,
+		client: c,
+		req: &orderpb.ListOrdersRequest{
+			CustomerId: req.GetCustomerId(),
+			Status:     req.GetStatus(),
+			Limit:      req.GetLimit(),
+			PageToken:  req.GetPageToken(),
+		},
+	}
+}
+
+// Next advances to the next order, it returns false after the last one or
+// when fetching a page failed
+func (it *OrderIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			it.order = nil
+			return false
+		}
+		resp, err := it.client.ListOrders(it.ctx, it.req)
+		if err != nil {
+			it.err = err
+			continue
+		}
+		it.page = resp.GetOrders()
+		it.req.PageToken = resp.GetNextPageToken()
+		it.done = it.req.PageToken == ""
+	}
+	it.order, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Order returns the current order
+func (it *OrderIterator) Order() *orderpb.Order {
+	return it.order
+}
+
+// PageToken returns the token listing the orders after the current page, to
+// resume the iteration later
+func (it *OrderIterator) PageToken() string {
+	return it.req.GetPageToken()
+}
+
+// Err returns the error that ended the iteration, nil when it ended after the last order
+func (it *OrderIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,36 @@
+package orderclient
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Usage is the consumption of the quotas of the consumer of the client
+type Usage struct {
+	// Consumer is the id the server counts the requests by
+	Consumer string         `json:"consumer"`
+	Usage    []*QuotaPeriod `json:"usage"`
+}
+
+// QuotaPeriod is the consumption of a quota in the current day or month
+type QuotaPeriod struct {
+	// Period is daily or monthly
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	Reset  time.Time `json:"reset"`
+	Used   int64     `json:"used"`
+	// Limit is 0 and Remaining nil without a limit
+	Limit     int64  `json:"limit,omitempty"`
+	Remaining *int64 `json:"remaining,omitempty"`
+}
+
+// Usage returns the requests counted against the quotas of the consumer of the
+// client, the request itself is not counted
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	usage := &Usage{}
+	if err := c.call(ctx, http.MethodGet, ordersPath+"/usage", nil, usage, true); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
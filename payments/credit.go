@@ -0,0 +1,366 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/money"
+)
+
+// MethodOnAccount is the payment method of the orders charged to the credit
+// line of their customer and invoiced with net terms
+const MethodOnAccount = "on_account"
+
+// ProviderAccount names the payments of the orders on account
+const ProviderAccount = "account"
+
+var (
+	// ErrNoCreditLine is returned for customers the credit service grants no
+	// credit line
+	ErrNoCreditLine = errors.New("customer has no credit line")
+	// ErrCreditLimitExceeded is returned when charging more than is left of a
+	// credit line
+	ErrCreditLimitExceeded = errors.New("credit limit exceeded")
+)
+
+// CreditLine is the credit the credit service grants a customer, its amounts
+// in its currency
+type CreditLine struct {
+	CustomerID string      `json:"customerId"`
+	Limit      money.Money `json:"limit"`
+	// Used is the part of Limit the open invoices of the customer take
+	Used     money.Money `json:"used"`
+	Currency string      `json:"currency"`
+	// TermsDays is the number of days after which the invoices of the customer
+	// are due, those of the configuration when 0
+	TermsDays int `json:"termsDays,omitempty"`
+	// PurchaseOrderRequired makes the orders of the customer name their
+	// purchase order
+	PurchaseOrderRequired bool `json:"purchaseOrderRequired,omitempty"`
+}
+
+// setCurrency takes the amounts of the line, read without a currency, to be in
+// currency
+func (l *CreditLine) setCurrency(currency string) error {
+	l.Currency = strings.ToUpper(currency)
+	var err error
+	if l.Limit, err = l.Limit.In(l.Currency); err != nil {
+		return err
+	}
+	l.Used, err = l.Used.In(l.Currency)
+	return err
+}
+
+// Available returns the part of the limit of the credit line left to charge
+func (l *CreditLine) Available() money.Money {
+	return l.Limit.Sub(l.Used)
+}
+
+// CreditService keeps the credit lines of wholesale customers. Charges, voids
+// and refunds take an idempotency key so retries never move credit twice.
+type CreditService interface {
+	// CreditLine returns the credit line of the customer, or ErrNoCreditLine
+	CreditLine(ctx context.Context, customerID string) (*CreditLine, error)
+	// Charge takes amount off the credit line of the customer and returns the
+	// id of the charge, failing with ErrCreditLimitExceeded when too little
+	// is left
+	Charge(ctx context.Context, customerID string, amount money.Money, idempotencyKey string) (string, error)
+	// Void releases a charge whose order was not placed or was cancelled
+	// before it was invoiced
+	Void(ctx context.Context, chargeID, idempotencyKey string) error
+	// Refund returns amount of a charge to the credit line
+	Refund(ctx context.Context, chargeID string, amount money.Money, idempotencyKey string) error
+}
+
+// NewCreditService returns the client selected in cfg, calling the credit
+// service with a client of clients
+func NewCreditService(cfg *config.CreditConfig, clients *httpclient.Factory) (CreditService, error) {
+	switch cfg.Client {
+	case config.CreditClientHTTP:
+		return NewHTTPCredit(cfg, clients), nil
+	case config.CreditClientStub:
+		return NewStubCredit(), nil
+	}
+	return nil, fmt.Errorf("unknown credit client %q", cfg.Client)
+}
+
+// stubCharge is a charge of the stub
+type stubCharge struct {
+	id       string
+	customer string
+	// amount is what is left of the charge after its refunds
+	amount money.Money
+}
+
+// StubCredit keeps credit lines in memory, it is meant for tests and
+// development. Customers only have a credit line once SetCreditLine is
+// called.
+type StubCredit struct {
+	mu      sync.Mutex
+	lines   map[string]*CreditLine
+	charges map[string]*stubCharge
+	// done holds the idempotency keys of the charges, voids and refunds made
+	done map[string]string
+}
+
+// NewStubCredit returns a stub without credit lines
+func NewStubCredit() *StubCredit {
+	return &StubCredit{lines: map[string]*CreditLine{}, charges: map[string]*stubCharge{}, done: map[string]string{}}
+}
+
+// SetCreditLine sets the credit line of its customer, taking its amounts to
+// be in its currency
+func (s *StubCredit) SetCreditLine(line CreditLine) error {
+	if err := line.setCurrency(line.Currency); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines[line.CustomerID] = &line
+	return nil
+}
+
+func (s *StubCredit) CreditLine(ctx context.Context, customerID string) (*CreditLine, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line, ok := s.lines[customerID]
+	if !ok {
+		return nil, ErrNoCreditLine
+	}
+	l := *line
+	return &l, nil
+}
+
+func (s *StubCredit) Charge(ctx context.Context, customerID string, amount money.Money, idempotencyKey string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := s.done[idempotencyKey]; ok {
+		return id, nil
+	}
+	line, ok := s.lines[customerID]
+	if !ok {
+		return "", ErrNoCreditLine
+	}
+	if line.Currency != amount.Currency {
+		return "", fmt.Errorf("credit line is in %s, not %s", line.Currency, amount.Currency)
+	}
+	if amount.Cmp(line.Available()) > 0 {
+		return "", ErrCreditLimitExceeded
+	}
+	line.Used = line.Used.Add(amount)
+	charge := &stubCharge{id: fmt.Sprintf("crc_%d", len(s.charges)+1), customer: customerID, amount: amount}
+	s.charges[charge.id] = charge
+	s.done[idempotencyKey] = charge.id
+	return charge.id, nil
+}
+
+// release returns amount of the charge with id to its credit line, all of it
+// when amount is nil, once for idempotencyKey
+func (s *StubCredit) release(chargeID string, amount *money.Money, idempotencyKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.done[idempotencyKey]; ok {
+		return nil
+	}
+	charge, ok := s.charges[chargeID]
+	if !ok {
+		return fmt.Errorf("unknown charge %q", chargeID)
+	}
+	released := charge.amount
+	if amount != nil {
+		if amount.Currency != charge.amount.Currency {
+			return fmt.Errorf("charge is in %s, not %s", charge.amount.Currency, amount.Currency)
+		}
+		if amount.Cmp(charge.amount) < 0 {
+			released = *amount
+		}
+	}
+	charge.amount = charge.amount.Sub(released)
+	if line, ok := s.lines[charge.customer]; ok {
+		line.Used = line.Used.Sub(released)
+	}
+	s.done[idempotencyKey] = chargeID
+	return nil
+}
+
+func (s *StubCredit) Void(ctx context.Context, chargeID, idempotencyKey string) error {
+	return s.release(chargeID, nil, idempotencyKey)
+}
+
+func (s *StubCredit) Refund(ctx context.Context, chargeID string, amount money.Money, idempotencyKey string) error {
+	return s.release(chargeID, &amount, idempotencyKey)
+}
+
+// HTTPCredit calls the credit service:
+//
+//	GET  {endpoint}/customers/{customerId}/credit-line   the credit line, 404 Not Found without one
+//	POST {endpoint}/customers/{customerId}/charges       {"amount", "currency"}, 409 Conflict over the limit
+//	POST {endpoint}/charges/{chargeId}/void
+//	POST {endpoint}/charges/{chargeId}/refunds           {"amount"}
+//
+// Every post carries its key in the Idempotency-Key header, charges answer
+// {"id": "..."}.
+type HTTPCredit struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewHTTPCredit returns a client of the credit service at the endpoint of cfg,
+// calling it with a client of clients
+func NewHTTPCredit(cfg *config.CreditConfig, clients *httpclient.Factory) *HTTPCredit {
+	return &HTTPCredit{
+		client:   clients.Client("credit", cfg.Timeout.Duration),
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+	}
+}
+
+// chargeRequest is the body of charges and refunds
+type chargeRequest struct {
+	Amount   money.Money `json:"amount"`
+	Currency string      `json:"currency,omitempty"`
+}
+
+func (c *HTTPCredit) CreditLine(ctx context.Context, customerID string) (*CreditLine, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/customers/"+url.PathEscape(customerID)+"/credit-line", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNoCreditLine
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("credit service responded %s to a credit line", resp.Status)
+	}
+	var line CreditLine
+	if err := json.NewDecoder(resp.Body).Decode(&line); err != nil {
+		return nil, fmt.Errorf("invalid credit line: %v", err)
+	}
+	if err := line.setCurrency(line.Currency); err != nil {
+		return nil, fmt.Errorf("invalid credit line: %v", err)
+	}
+	return &line, nil
+}
+
+func (c *HTTPCredit) Charge(ctx context.Context, customerID string, amount money.Money, idempotencyKey string) (string, error) {
+	body, err := json.Marshal(&chargeRequest{Amount: amount, Currency: amount.Currency})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/customers/"+url.PathEscape(customerID)+"/charges", body, idempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", ErrNoCreditLine
+	case resp.StatusCode == http.StatusConflict:
+		return "", ErrCreditLimitExceeded
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("credit service responded %s to a charge", resp.Status)
+	}
+	var charge transactionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&charge); err != nil {
+		return "", fmt.Errorf("invalid credit charge: %v", err)
+	}
+	return charge.ID, nil
+}
+
+func (c *HTTPCredit) Void(ctx context.Context, chargeID, idempotencyKey string) error {
+	return c.post(ctx, "/charges/"+url.PathEscape(chargeID)+"/void", nil, idempotencyKey)
+}
+
+func (c *HTTPCredit) Refund(ctx context.Context, chargeID string, amount money.Money, idempotencyKey string) error {
+	body, err := json.Marshal(&chargeRequest{Amount: amount})
+	if err != nil {
+		return err
+	}
+	return c.post(ctx, "/charges/"+url.PathEscape(chargeID)+"/refunds", body, idempotencyKey)
+}
+
+// post posts body to path, expecting a success without an answer
+func (c *HTTPCredit) post(ctx context.Context, path string, body []byte, idempotencyKey string) error {
+	resp, err := c.do(ctx, http.MethodPost, path, body, idempotencyKey)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("credit service responded %s to %s", resp.Status, path)
+	}
+	return nil
+}
+
+func (c *HTTPCredit) do(ctx context.Context, method, path string, body []byte, idempotencyKey string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return c.client.Do(req)
+}
+
+// AccountProvider takes the payments of the orders on account as charges of
+// the credit lines of their customers. An authorized payment holds its amount
+// of the credit line, capturing it leaves the charge to be invoiced.
+type AccountProvider struct {
+	credit CreditService
+}
+
+// NewAccountProvider returns the provider charging the credit lines of credit
+func NewAccountProvider(credit CreditService) *AccountProvider {
+	return &AccountProvider{credit: credit}
+}
+
+func (a *AccountProvider) Name() string {
+	return ProviderAccount
+}
+
+func (a *AccountProvider) Authorize(ctx context.Context, req *AuthorizeRequest) (*Result, error) {
+	id, err := a.credit.Charge(ctx, req.CustomerID, req.Amount, req.IdempotencyKey)
+	if errors.Is(err, ErrCreditLimitExceeded) || errors.Is(err, ErrNoCreditLine) {
+		return &Result{Status: StatusFailed, Amount: req.Amount, FailureReason: err.Error()}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Result{PaymentID: id, Status: StatusAuthorized, Amount: req.Amount}, nil
+}
+
+func (a *AccountProvider) Capture(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	return &Result{PaymentID: paymentID, Status: StatusCaptured, Amount: amount}, nil
+}
+
+func (a *AccountProvider) Refund(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	if err := a.credit.Refund(ctx, paymentID, amount, idempotencyKey); err != nil {
+		return nil, err
+	}
+	return &Result{PaymentID: paymentID, Status: StatusRefunded, Amount: amount}, nil
+}
+
+func (a *AccountProvider) Void(ctx context.Context, paymentID string, idempotencyKey string) (*Result, error) {
+	if err := a.credit.Void(ctx, paymentID, idempotencyKey); err != nil {
+		return nil, err
+	}
+	return &Result{PaymentID: paymentID, Status: StatusVoided}, nil
+}
+
+// ParseWebhook returns nil, the credit service sends no notifications
+func (a *AccountProvider) ParseWebhook(header http.Header, body []byte) (*Result, error) {
+	return nil, nil
+}
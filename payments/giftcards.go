@@ -0,0 +1,283 @@
+package payments
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/money"
+)
+
+// the tenders an order is paid with: a card payment with the provider or a
+// charge to the credit line of its customer, and the balances of gift cards
+// and of the store credit of its customer
+const (
+	TenderCard        = "card"
+	TenderAccount     = "account"
+	TenderGiftCard    = "giftCard"
+	TenderStoreCredit = "storeCredit"
+)
+
+var (
+	// ErrGiftCardNotFound is returned for gift cards and store credit accounts
+	// the gift card service does not know
+	ErrGiftCardNotFound = errors.New("gift card not found")
+	// ErrInsufficientBalance is returned when redeeming more than the balance
+	// of an account
+	ErrInsufficientBalance = errors.New("insufficient gift card balance")
+)
+
+// StoreCreditAccount returns the account of the store credit of a customer,
+// gift card accounts are named by the code of their card
+func StoreCreditAccount(customerID string) string {
+	return "customer:" + customerID
+}
+
+// Balance is the value left on an account of the gift card service
+type Balance struct {
+	Account  string      `json:"account"`
+	Amount   money.Money `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// GiftCardService keeps the balances of gift cards and of the store credit of
+// customers. Redemptions and credits take an idempotency key so retries never
+// move value twice.
+type GiftCardService interface {
+	// Balance returns the balance of account, or ErrGiftCardNotFound
+	Balance(ctx context.Context, account string) (*Balance, error)
+	// Redeem takes amount off the balance of account and returns the id of the
+	// transaction, failing with ErrInsufficientBalance when the balance is
+	// short
+	Redeem(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error)
+	// Reverse undoes the redemption made with idempotencyKey, it is a no-op
+	// when there was none
+	Reverse(ctx context.Context, account, idempotencyKey string) error
+	// Credit adds amount to the balance of account, such as a refund, and
+	// returns the id of the transaction
+	Credit(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error)
+}
+
+// NewGiftCardService returns the client selected in cfg, calling the gift card
+// service with a client of clients
+func NewGiftCardService(cfg *config.GiftCardsConfig, clients *httpclient.Factory) (GiftCardService, error) {
+	switch cfg.Client {
+	case config.GiftCardClientHTTP:
+		return NewHTTPGiftCards(cfg, clients), nil
+	case config.GiftCardClientStub:
+		return NewStubGiftCards(), nil
+	}
+	return nil, fmt.Errorf("unknown gift card client %q", cfg.Client)
+}
+
+// stubTransaction is a redemption or credit of the stub
+type stubTransaction struct {
+	id      string
+	account string
+	amount  money.Money
+}
+
+// StubGiftCards keeps balances in memory, it is meant for tests and
+// development. Accounts only exist once SetBalance is called.
+type StubGiftCards struct {
+	mu           sync.Mutex
+	balances     map[string]*Balance
+	transactions map[string]*stubTransaction
+}
+
+// NewStubGiftCards returns a stub without accounts
+func NewStubGiftCards() *StubGiftCards {
+	return &StubGiftCards{balances: map[string]*Balance{}, transactions: map[string]*stubTransaction{}}
+}
+
+// SetBalance sets the balance of account to amount
+func (s *StubGiftCards) SetBalance(account string, amount money.Money) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.balances[account] = &Balance{Account: account, Amount: amount, Currency: amount.Currency}
+}
+
+func (s *StubGiftCards) Balance(ctx context.Context, account string) (*Balance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balance, ok := s.balances[account]
+	if !ok {
+		return nil, ErrGiftCardNotFound
+	}
+	b := *balance
+	return &b, nil
+}
+
+// move adds amount, negative for a redemption, to the balance of account
+func (s *StubGiftCards) move(account string, amount money.Money, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.transactions[key]; ok {
+		return t.id, nil
+	}
+	balance, ok := s.balances[account]
+	if !ok {
+		return "", ErrGiftCardNotFound
+	}
+	if balance.Currency != amount.Currency {
+		return "", fmt.Errorf("gift card is in %s, not %s", balance.Currency, amount.Currency)
+	}
+	if balance.Amount.Add(amount).IsNegative() {
+		return "", ErrInsufficientBalance
+	}
+	balance.Amount = balance.Amount.Add(amount)
+	t := &stubTransaction{id: fmt.Sprintf("gct_%d", len(s.transactions)+1), account: account, amount: amount}
+	s.transactions[key] = t
+	return t.id, nil
+}
+
+func (s *StubGiftCards) Redeem(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error) {
+	return s.move(account, amount.Mul(-1), idempotencyKey)
+}
+
+func (s *StubGiftCards) Reverse(ctx context.Context, account, idempotencyKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.transactions[idempotencyKey]
+	if !ok || !t.amount.IsNegative() {
+		return nil
+	}
+	if balance, ok := s.balances[t.account]; ok {
+		balance.Amount = balance.Amount.Sub(t.amount)
+	}
+	// a reversed redemption is not taken again when retried
+	t.amount = money.New(0, t.amount.Currency)
+	return nil
+}
+
+func (s *StubGiftCards) Credit(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error) {
+	return s.move(account, amount, idempotencyKey)
+}
+
+// HTTPGiftCards calls the gift card service:
+//
+//	GET    {endpoint}/accounts/{account}                        the balance, 404 Not Found when unknown
+//	POST   {endpoint}/accounts/{account}/redemptions           {"amount", "currency"}, 409 Conflict when the balance is short
+//	DELETE {endpoint}/accounts/{account}/redemptions/{key}     reverses the redemption with the idempotency key
+//	POST   {endpoint}/accounts/{account}/credits               {"amount", "currency"}
+//
+// Redemptions and credits carry their key in the Idempotency-Key header and
+// answer {"id": "..."}.
+type HTTPGiftCards struct {
+	client   *http.Client
+	endpoint string
+}
+
+// NewHTTPGiftCards returns a client of the gift card service at the endpoint of
+// cfg, calling it with a client of clients
+func NewHTTPGiftCards(cfg *config.GiftCardsConfig, clients *httpclient.Factory) *HTTPGiftCards {
+	return &HTTPGiftCards{
+		client:   clients.Client("giftcards", cfg.Timeout.Duration),
+		endpoint: strings.TrimSuffix(cfg.Endpoint, "/"),
+	}
+}
+
+// transactionRequest is the body of redemptions and credits
+type transactionRequest struct {
+	Amount   money.Money `json:"amount"`
+	Currency string      `json:"currency"`
+}
+
+// transactionResponse is the answer to redemptions and credits
+type transactionResponse struct {
+	ID string `json:"id"`
+}
+
+func (g *HTTPGiftCards) Balance(ctx context.Context, account string) (*Balance, error) {
+	resp, err := g.do(ctx, http.MethodGet, "/accounts/"+url.PathEscape(account), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrGiftCardNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("gift card service responded %s to a balance", resp.Status)
+	}
+	var balance Balance
+	if err := json.NewDecoder(resp.Body).Decode(&balance); err != nil {
+		return nil, fmt.Errorf("invalid gift card balance: %v", err)
+	}
+	balance.Currency = strings.ToUpper(balance.Currency)
+	if balance.Amount, err = balance.Amount.In(balance.Currency); err != nil {
+		return nil, fmt.Errorf("invalid gift card balance: %v", err)
+	}
+	return &balance, nil
+}
+
+func (g *HTTPGiftCards) Redeem(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error) {
+	return g.transaction(ctx, account, "redemptions", amount, idempotencyKey)
+}
+
+func (g *HTTPGiftCards) Reverse(ctx context.Context, account, idempotencyKey string) error {
+	resp, err := g.do(ctx, http.MethodDelete, "/accounts/"+url.PathEscape(account)+"/redemptions/"+url.PathEscape(idempotencyKey), nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("gift card service responded %s to the reversal of %s", resp.Status, idempotencyKey)
+	}
+	return nil
+}
+
+func (g *HTTPGiftCards) Credit(ctx context.Context, account string, amount money.Money, idempotencyKey string) (string, error) {
+	return g.transaction(ctx, account, "credits", amount, idempotencyKey)
+}
+
+// transaction posts a redemption or credit of amount to account
+func (g *HTTPGiftCards) transaction(ctx context.Context, account, kind string, amount money.Money, idempotencyKey string) (string, error) {
+	body, err := json.Marshal(&transactionRequest{Amount: amount, Currency: amount.Currency})
+	if err != nil {
+		return "", err
+	}
+	resp, err := g.do(ctx, http.MethodPost, "/accounts/"+url.PathEscape(account)+"/"+kind, body, idempotencyKey)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", ErrGiftCardNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return "", ErrInsufficientBalance
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("gift card service responded %s to %s", resp.Status, kind)
+	}
+	var t transactionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("invalid gift card transaction: %v", err)
+	}
+	return t.ID, nil
+}
+
+func (g *HTTPGiftCards) do(ctx context.Context, method, path string, body []byte, idempotencyKey string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, g.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	return g.client.Do(req)
+}
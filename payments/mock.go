@@ -0,0 +1,162 @@
+package payments
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/omnom-nom/order/money"
+)
+
+// MockDeclinedMethod is the payment method the mock provider declines
+const MockDeclinedMethod = "pm_card_declined"
+
+// MockAsyncMethod is the payment method the mock provider authorizes asynchronously,
+// the result is expected on the webhook
+const MockAsyncMethod = "pm_async"
+
+// MockProvider keeps payments in memory, it is meant for tests and development.
+// Every payment method is authorized except MockDeclinedMethod and MockAsyncMethod.
+type MockProvider struct {
+	mu       sync.Mutex
+	payments map[string]*mockPayment
+	// results remembers the result of every idempotency key
+	results map[string]*Result
+}
+
+type mockPayment struct {
+	amount   money.Money
+	captured money.Money
+	refunded money.Money
+	status   Status
+}
+
+// NewMockProvider returns a mock provider without payments
+func NewMockProvider() *MockProvider {
+	return &MockProvider{payments: map[string]*mockPayment{}, results: map[string]*Result{}}
+}
+
+func (m *MockProvider) Name() string {
+	return ProviderMock
+}
+
+// once returns the result of the first call with key, running op for it
+func (m *MockProvider) once(key string, op func() *Result) *Result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if result, ok := m.results[key]; ok && key != "" {
+		return result
+	}
+	result := op()
+	if key != "" {
+		m.results[key] = result
+	}
+	return result
+}
+
+func (m *MockProvider) Authorize(ctx context.Context, req *AuthorizeRequest) (*Result, error) {
+	return m.once(req.IdempotencyKey, func() *Result {
+		id := mockID("pay")
+		payment := &mockPayment{amount: req.Amount, refunded: money.New(0, req.Amount.Currency), status: StatusAuthorized}
+		switch req.PaymentMethod {
+		case MockDeclinedMethod:
+			payment.status = StatusFailed
+		case MockAsyncMethod:
+			payment.status = StatusPending
+		}
+		m.payments[id] = payment
+
+		result := &Result{PaymentID: id, OrderID: req.OrderID, Status: payment.status, Amount: req.Amount}
+		if payment.status == StatusFailed {
+			result.FailureReason = "card declined"
+		}
+		return result
+	}), nil
+}
+
+func (m *MockProvider) Capture(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	return m.update(paymentID, idempotencyKey, func(p *mockPayment) *Result {
+		if p.status != StatusAuthorized || amount.Currency != p.amount.Currency || amount.Cmp(p.amount) > 0 {
+			return &Result{PaymentID: paymentID, Status: StatusFailed, FailureReason: "payment is not authorized for the amount"}
+		}
+		p.captured = amount
+		p.status = StatusCaptured
+		return &Result{PaymentID: paymentID, Status: StatusCaptured, Amount: amount}
+	})
+}
+
+func (m *MockProvider) Refund(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	return m.update(paymentID, idempotencyKey, func(p *mockPayment) *Result {
+		if (p.status != StatusCaptured && p.status != StatusRefunded) || amount.Currency != p.captured.Currency || p.refunded.Add(amount).Cmp(p.captured) > 0 {
+			return &Result{PaymentID: paymentID, Status: StatusFailed, FailureReason: "refund exceeds the captured amount"}
+		}
+		p.refunded = p.refunded.Add(amount)
+		return &Result{PaymentID: paymentID, Status: StatusRefunded, Amount: amount}
+	})
+}
+
+func (m *MockProvider) Void(ctx context.Context, paymentID string, idempotencyKey string) (*Result, error) {
+	return m.update(paymentID, idempotencyKey, func(p *mockPayment) *Result {
+		if p.status != StatusAuthorized && p.status != StatusPending {
+			return &Result{PaymentID: paymentID, Status: StatusFailed, FailureReason: "payment was captured"}
+		}
+		p.status = StatusVoided
+		return &Result{PaymentID: paymentID, Status: StatusVoided}
+	})
+}
+
+// update runs op on the payment with id once per idempotency key
+func (m *MockProvider) update(id, idempotencyKey string, op func(*mockPayment) *Result) (*Result, error) {
+	var err error
+	result := m.once(idempotencyKey, func() *Result {
+		payment, ok := m.payments[id]
+		if !ok {
+			err = fmt.Errorf("unknown payment %s", id)
+			return nil
+		}
+		return op(payment)
+	})
+	if result == nil && err == nil {
+		err = fmt.Errorf("unknown payment %s", id)
+	}
+	return result, err
+}
+
+// mockWebhook is the body of a notification of the mock provider
+type mockWebhook struct {
+	PaymentID string      `json:"paymentId"`
+	OrderID   string      `json:"orderId"`
+	Status    Status      `json:"status"`
+	Amount    money.Money `json:"amount"`
+}
+
+// ParseWebhook accepts an unsigned json notification of a payment result, e.g.
+// {"paymentId": "...", "orderId": "...", "status": "authorized"}
+func (m *MockProvider) ParseWebhook(header http.Header, body []byte) (*Result, error) {
+	var n mockWebhook
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if payment, ok := m.payments[n.PaymentID]; ok {
+		if payment.status == StatusPending {
+			payment.status = n.Status
+		}
+		// the amount of the notification is in the currency of the payment
+		if amount, err := n.Amount.In(payment.amount.Currency); err == nil {
+			n.Amount = amount
+		}
+	}
+	m.mu.Unlock()
+	return &Result{PaymentID: n.PaymentID, OrderID: n.OrderID, Status: n.Status, Amount: n.Amount}, nil
+}
+
+func mockID(prefix string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return prefix + "_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,150 @@
+// Package payments defines the interface of payment providers and its
+// implementations for Stripe and for development, that of the gift card
+// service keeping the balances of gift cards and store credit, and that of the
+// credit service granting wholesale customers their credit lines.
+package payments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/money"
+)
+
+// provider names
+const (
+	ProviderStripe = config.PaymentProviderStripe
+	ProviderMock   = config.PaymentProviderMock
+)
+
+// ErrInvalidSignature is returned for webhook notifications that fail authentication
+var ErrInvalidSignature = errors.New("invalid payment webhook signature")
+
+// Status is the state of a payment
+type Status string
+
+const (
+	// StatusPending marks a payment whose result the provider reports asynchronously
+	StatusPending    Status = "pending"
+	StatusAuthorized Status = "authorized"
+	StatusCaptured   Status = "captured"
+	// StatusRefunded marks a payment refunded in full, Refunded holds partial refunds
+	StatusRefunded Status = "refunded"
+	StatusVoided   Status = "voided"
+	StatusFailed   Status = "failed"
+)
+
+// Payment is the payment of an order as kept with the order, its amounts in
+// its currency
+type Payment struct {
+	Provider      string      `json:"provider" dynamodbav:"provider"`
+	ID            string      `json:"id" dynamodbav:"paymentId"`
+	Status        Status      `json:"status" dynamodbav:"status"`
+	Amount        money.Money `json:"amount" dynamodbav:"amount"`
+	Refunded      money.Money `json:"refunded" dynamodbav:"refunded"`
+	Currency      string      `json:"currency" dynamodbav:"currency"`
+	FailureReason string      `json:"failureReason,omitempty" dynamodbav:"failureReason,omitempty"`
+	UpdatedAt     time.Time   `json:"updatedAt" dynamodbav:"updatedAt"`
+}
+
+// SetCurrency takes the amounts of the payment read without a currency to be
+// in its currency, currency when it has none
+func (p *Payment) SetCurrency(currency string) error {
+	if p.Currency == "" {
+		p.Currency = currency
+	}
+	var err error
+	if p.Amount, err = p.Amount.In(p.Currency); err != nil {
+		return err
+	}
+	p.Refunded, err = p.Refunded.In(p.Currency)
+	return err
+}
+
+// progress orders the statuses of a payment, notifications may arrive late and
+// never move a payment back
+var progress = map[Status]int{
+	StatusPending:    0,
+	StatusAuthorized: 1,
+	StatusCaptured:   2,
+	StatusFailed:     2,
+	StatusVoided:     3,
+	StatusRefunded:   3,
+}
+
+// Apply records the outcome of an operation or notification on the payment
+func (p *Payment) Apply(result *Result) {
+	if result.PaymentID != "" {
+		p.ID = result.PaymentID
+	}
+	switch {
+	case result.Status == StatusRefunded:
+		p.Refunded = p.Refunded.Add(result.Amount)
+		if p.Refunded.Cmp(p.Amount) >= 0 {
+			p.Status = StatusRefunded
+		}
+	case p.Status == "" || progress[result.Status] > progress[p.Status]:
+		p.Status = result.Status
+	}
+	p.FailureReason = result.FailureReason
+	p.UpdatedAt = time.Now().UTC()
+}
+
+// AuthorizeRequest asks for the authorization of the payment of an order
+type AuthorizeRequest struct {
+	OrderID string
+	// CustomerID is the customer the order is placed for, whose credit line
+	// pays the orders on account
+	CustomerID string
+	Amount     money.Money
+	// PaymentMethod is the token of the payment method of the customer at the provider
+	PaymentMethod string
+	// IdempotencyKey makes a repeated request return the result of the first one
+	IdempotencyKey string
+}
+
+// Result is the outcome of an operation, or of a payment reported by a webhook
+type Result struct {
+	PaymentID string
+	// OrderID is set on the results of webhooks
+	OrderID string
+	Status  Status
+	// Amount is the amount the result applies to, e.g. the amount refunded
+	Amount        money.Money
+	FailureReason string
+}
+
+// PaymentProvider authorizes, captures, refunds and voids payments. Every operation
+// takes an idempotency key so retries never charge or refund twice. A declined
+// operation returns a result with StatusFailed, errors are left for failures to
+// reach the provider.
+type PaymentProvider interface {
+	// Name identifies the provider in the payments it creates
+	Name() string
+	Authorize(ctx context.Context, req *AuthorizeRequest) (*Result, error)
+	// Capture collects amount of an authorized payment
+	Capture(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error)
+	// Refund returns amount of a captured payment
+	Refund(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error)
+	// Void releases an authorized payment that was not captured
+	Void(ctx context.Context, paymentID string, idempotencyKey string) (*Result, error)
+	// ParseWebhook authenticates a notification of the provider and returns the
+	// payment result it reports, or nil for notifications about something else
+	ParseWebhook(header http.Header, body []byte) (*Result, error)
+}
+
+// New returns the provider selected in cfg, calling it with a client of clients
+func New(cfg *config.PaymentsConfig, clients *httpclient.Factory) (PaymentProvider, error) {
+	switch cfg.Provider {
+	case ProviderStripe:
+		return NewStripeProvider(&cfg.Stripe, clients), nil
+	case ProviderMock:
+		return NewMockProvider(), nil
+	}
+	return nil, fmt.Errorf("unknown payment provider %q", cfg.Provider)
+}
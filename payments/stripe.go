@@ -0,0 +1,351 @@
+package payments
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+	"github.com/omnom-nom/order/money"
+	"github.com/omnom-nom/order/retry"
+)
+
+const (
+	// StripeSignatureHeader carries the signature of stripe webhook notifications
+	StripeSignatureHeader = "Stripe-Signature"
+	// stripeSignatureTolerance is the age after which a notification is rejected as a replay
+	stripeSignatureTolerance = 5 * time.Minute
+	stripeDefaultEndpoint    = "https://api.stripe.com"
+	// stripeShouldRetryHeader is stripe's advice whether a failed request may be sent again
+	stripeShouldRetryHeader = "Stripe-Should-Retry"
+)
+
+// StripeProvider takes payments with stripe payment intents. Payments are authorized
+// with manual capture, so Capture collects them and Void cancels them.
+type StripeProvider struct {
+	client        *http.Client
+	retry         retry.Policy
+	endpoint      string
+	secretKey     string
+	webhookSecret string
+}
+
+// NewStripeProvider returns a provider using the api key and webhook secret of
+// cfg, calling stripe with a client of clients
+func NewStripeProvider(cfg *config.StripeConfig, clients *httpclient.Factory) *StripeProvider {
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = stripeDefaultEndpoint
+	}
+	return &StripeProvider{
+		client:        clients.Client("stripe", cfg.Timeout.Duration),
+		retry:         retry.New(cfg.Retry, stripeRetryable),
+		endpoint:      strings.TrimSuffix(endpoint, "/"),
+		secretKey:     cfg.SecretKey,
+		webhookSecret: cfg.WebhookSecret,
+	}
+}
+
+func (s *StripeProvider) Name() string {
+	return ProviderStripe
+}
+
+// stripeIntent is the part of a stripe payment intent read by the provider
+type stripeIntent struct {
+	ID               string            `json:"id"`
+	Status           string            `json:"status"`
+	Amount           int64             `json:"amount"`
+	AmountReceived   int64             `json:"amount_received"`
+	Currency         string            `json:"currency"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+func (i *stripeIntent) result() *Result {
+	result := &Result{PaymentID: i.ID, OrderID: i.Metadata["order_id"], Amount: fromMinor(i.Amount, i.Currency)}
+	switch i.Status {
+	case "requires_capture":
+		result.Status = StatusAuthorized
+	case "succeeded":
+		result.Status = StatusCaptured
+		result.Amount = fromMinor(i.AmountReceived, i.Currency)
+	case "canceled":
+		result.Status = StatusVoided
+	case "requires_payment_method":
+		result.Status = StatusFailed
+	default:
+		// processing, requires_action and requires_confirmation finish asynchronously
+		result.Status = StatusPending
+	}
+	if i.LastPaymentError != nil {
+		result.FailureReason = i.LastPaymentError.Message
+	}
+	return result
+}
+
+// stripeRefund is the part of a stripe refund read by the provider
+type stripeRefund struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	Amount        int64  `json:"amount"`
+	Currency      string `json:"currency"`
+	PaymentIntent string `json:"payment_intent"`
+	FailureReason string `json:"failure_reason"`
+}
+
+func (r *stripeRefund) result() *Result {
+	// pending refunds are accepted and settle without further action
+	result := &Result{PaymentID: r.PaymentIntent, Status: StatusRefunded, Amount: fromMinor(r.Amount, r.Currency)}
+	switch r.Status {
+	case "failed", "canceled":
+		result.Status = StatusFailed
+		result.FailureReason = r.FailureReason
+	}
+	return result
+}
+
+// stripeError is the error body of the stripe api
+type stripeError struct {
+	Error struct {
+		Type          string        `json:"type"`
+		Message       string        `json:"message"`
+		PaymentIntent *stripeIntent `json:"payment_intent"`
+	} `json:"error"`
+}
+
+// stripeStatusError is an error response of the stripe api other than a declined card
+type stripeStatusError struct {
+	code    int
+	status  string
+	message string
+	// shouldRetry is the Stripe-Should-Retry header, nil without it
+	shouldRetry *bool
+}
+
+func (e *stripeStatusError) Error() string {
+	if e.message == "" {
+		return "stripe responded " + e.status
+	}
+	return fmt.Sprintf("stripe responded %s: %s", e.status, e.message)
+}
+
+// stripeRetryable reports whether a call failing with err is sent again,
+// following the advice of stripe when it gives one
+func stripeRetryable(err error) bool {
+	var statusErr *stripeStatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.shouldRetry != nil {
+			return *statusErr.shouldRetry
+		}
+		return retry.RetryableStatus(statusErr.code)
+	}
+	return retry.Temporary(err)
+}
+
+// post calls the stripe api and decodes the response into out. A declined card is
+// reported as a failed result, other errors of the api as errors. Calls with an
+// idempotency key are sent again after transient failures, which stripe
+// executes only once.
+func (s *StripeProvider) post(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) (*Result, error) {
+	policy := s.retry
+	if idempotencyKey == "" {
+		policy.MaxAttempts = 1
+	}
+	var result *Result
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = s.postOnce(ctx, path, form, idempotencyKey, out)
+		return err
+	})
+	return result, err
+}
+
+// postOnce makes one attempt of post
+func (s *StripeProvider) postOnce(ctx context.Context, path string, form url.Values, idempotencyKey string, out interface{}) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil, json.NewDecoder(resp.Body).Decode(out)
+	}
+	statusErr := &stripeStatusError{code: resp.StatusCode, status: resp.Status}
+	if advice, err := strconv.ParseBool(resp.Header.Get(stripeShouldRetryHeader)); err == nil {
+		statusErr.shouldRetry = &advice
+	}
+	var e stripeError
+	if err := json.NewDecoder(resp.Body).Decode(&e); err != nil {
+		return nil, statusErr
+	}
+	if e.Error.Type == "card_error" {
+		result := &Result{Status: StatusFailed, FailureReason: e.Error.Message}
+		if e.Error.PaymentIntent != nil {
+			result.PaymentID = e.Error.PaymentIntent.ID
+		}
+		return result, nil
+	}
+	statusErr.message = e.Error.Message
+	return nil, statusErr
+}
+
+func (s *StripeProvider) Authorize(ctx context.Context, req *AuthorizeRequest) (*Result, error) {
+	amount, err := toMinor(req.Amount)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"amount":               {amount},
+		"currency":             {strings.ToLower(req.Amount.Currency)},
+		"payment_method":       {req.PaymentMethod},
+		"capture_method":       {"manual"},
+		"confirm":              {"true"},
+		"metadata[order_id]":   {req.OrderID},
+		"payment_method_types": {"card"},
+	}
+	var intent stripeIntent
+	if result, err := s.post(ctx, "/v1/payment_intents", form, req.IdempotencyKey, &intent); result != nil || err != nil {
+		return result, err
+	}
+	return intent.result(), nil
+}
+
+func (s *StripeProvider) Capture(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	minor, err := toMinor(amount)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"amount_to_capture": {minor}}
+	var intent stripeIntent
+	if result, err := s.post(ctx, "/v1/payment_intents/"+url.PathEscape(paymentID)+"/capture", form, idempotencyKey, &intent); result != nil || err != nil {
+		return result, err
+	}
+	return intent.result(), nil
+}
+
+func (s *StripeProvider) Refund(ctx context.Context, paymentID string, amount money.Money, idempotencyKey string) (*Result, error) {
+	minor, err := toMinor(amount)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"payment_intent": {paymentID},
+		"amount":         {minor},
+	}
+	var refund stripeRefund
+	if result, err := s.post(ctx, "/v1/refunds", form, idempotencyKey, &refund); result != nil || err != nil {
+		return result, err
+	}
+	return refund.result(), nil
+}
+
+func (s *StripeProvider) Void(ctx context.Context, paymentID string, idempotencyKey string) (*Result, error) {
+	var intent stripeIntent
+	if result, err := s.post(ctx, "/v1/payment_intents/"+url.PathEscape(paymentID)+"/cancel", url.Values{}, idempotencyKey, &intent); result != nil || err != nil {
+		return result, err
+	}
+	return intent.result(), nil
+}
+
+// stripeEvent is a stripe webhook notification
+type stripeEvent struct {
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// ParseWebhook verifies the Stripe-Signature of a notification and returns the
+// result of payment intent events. Refunds are applied when they are requested, so
+// their events are ignored.
+func (s *StripeProvider) ParseWebhook(header http.Header, body []byte) (*Result, error) {
+	if err := s.verify(header.Get(StripeSignatureHeader), body, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var event stripeEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(event.Type, "payment_intent.") {
+		return nil, nil
+	}
+	var intent stripeIntent
+	if err := json.Unmarshal(event.Data.Object, &intent); err != nil {
+		return nil, err
+	}
+	return intent.result(), nil
+}
+
+// verify checks a Stripe-Signature header of the form t=<unix time>,v1=<hex hmac>
+func (s *StripeProvider) verify(signature string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(signature, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+// toMinor returns amount in the minor units of its currency stripe expects,
+// such as cents, or yen as JPY has none
+func toMinor(amount money.Money) (string, error) {
+	if amount.Currency == "" {
+		return "", fmt.Errorf("amount %s has no currency", amount)
+	}
+	return strconv.FormatInt(amount.Amount, 10), nil
+}
+
+// fromMinor returns the amount of minor units of the lower case currency of stripe
+func fromMinor(amount int64, currency string) money.Money {
+	return money.New(amount, strings.ToUpper(currency))
+}
@@ -0,0 +1,167 @@
+// Package pricing computes the price of orders: line totals, discount codes,
+// shipping and taxes.
+package pricing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/money"
+)
+
+var (
+	// ErrUnknownDiscount is returned for discount codes that are not configured
+	ErrUnknownDiscount = errors.New("unknown discount code")
+	// ErrDiscountNotApplicable is returned for discount codes the order does not qualify for
+	ErrDiscountNotApplicable = errors.New("discount code does not apply")
+)
+
+// Line is a line item to price
+type Line struct {
+	SKU       string
+	Quantity  int
+	UnitPrice money.Money
+}
+
+// Address is the part of the shipping address taxes depend on
+type Address struct {
+	Country    string
+	State      string
+	PostalCode string
+}
+
+// Request asks for the price of line items shipped to an address, the address
+// may be nil. The unit prices of the lines are in Currency.
+type Request struct {
+	Currency      string
+	Lines         []Line
+	Address       *Address
+	DiscountCodes []string
+}
+
+// LineTotal is the price of a line item
+type LineTotal struct {
+	SKU       string      `json:"sku" dynamodbav:"sku"`
+	Quantity  int         `json:"quantity" dynamodbav:"quantity"`
+	UnitPrice money.Money `json:"unitPrice" dynamodbav:"unitPrice"`
+	Total     money.Money `json:"total" dynamodbav:"total"`
+}
+
+// AppliedDiscount is the amount a discount code took off the subtotal
+type AppliedDiscount struct {
+	Code   string      `json:"code" dynamodbav:"code"`
+	Amount money.Money `json:"amount" dynamodbav:"amount"`
+}
+
+// Breakdown is a computed price. Total is the discounted subtotal plus shipping and tax.
+type Breakdown struct {
+	Lines     []LineTotal       `json:"lines" dynamodbav:"lines"`
+	Subtotal  money.Money       `json:"subtotal" dynamodbav:"subtotal"`
+	Discounts []AppliedDiscount `json:"discounts,omitempty" dynamodbav:"discounts,omitempty"`
+	Discount  money.Money       `json:"discount" dynamodbav:"discount"`
+	Shipping  money.Money       `json:"shipping" dynamodbav:"shipping"`
+	TaxRate   float64           `json:"taxRate" dynamodbav:"taxRate"`
+	Tax       money.Money       `json:"tax" dynamodbav:"tax"`
+	Total     money.Money       `json:"total" dynamodbav:"total"`
+}
+
+// SetCurrency takes the amounts of the breakdown, read without a currency, to
+// be in currency
+func (b *Breakdown) SetCurrency(currency string) error {
+	amounts := []*money.Money{&b.Subtotal, &b.Discount, &b.Shipping, &b.Tax, &b.Total}
+	for i := range b.Lines {
+		amounts = append(amounts, &b.Lines[i].UnitPrice, &b.Lines[i].Total)
+	}
+	for i := range b.Discounts {
+		amounts = append(amounts, &b.Discounts[i].Amount)
+	}
+	for _, amount := range amounts {
+		var err error
+		if *amount, err = amount.In(currency); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Engine prices orders with the shipping and discounts of its configuration and
+// the taxes of its tax provider
+type Engine struct {
+	cfg config.PricingConfig
+	tax TaxProvider
+}
+
+// NewEngine returns an engine taxing orders at the flat rate of cfg
+func NewEngine(cfg *config.PricingConfig) *Engine {
+	return &Engine{cfg: *cfg, tax: FlatRate{Rate: cfg.TaxRate}}
+}
+
+// WithTaxProvider makes the engine tax orders with provider
+func (e *Engine) WithTaxProvider(provider TaxProvider) *Engine {
+	e.tax = provider
+	return e
+}
+
+// Quote computes the price of req. Amounts are in the currency of req, rounded
+// to its minor units.
+func (e *Engine) Quote(ctx context.Context, req *Request) (*Breakdown, error) {
+	zero := money.New(0, req.Currency)
+	b := &Breakdown{Subtotal: zero, Discount: zero}
+	for _, line := range req.Lines {
+		if line.UnitPrice.Currency != req.Currency {
+			return nil, fmt.Errorf("price of %q is not in %s", line.SKU, req.Currency)
+		}
+		total := line.UnitPrice.Mul(int64(line.Quantity))
+		b.Lines = append(b.Lines, LineTotal{SKU: line.SKU, Quantity: line.Quantity, UnitPrice: line.UnitPrice, Total: total})
+		b.Subtotal = b.Subtotal.Add(total)
+	}
+
+	if err := e.discount(b, req.Currency, req.DiscountCodes); err != nil {
+		return nil, err
+	}
+	discounted := b.Subtotal.Sub(b.Discount)
+
+	b.Shipping = money.FromDecimal(e.cfg.Shipping, req.Currency)
+	if e.cfg.FreeShippingOver > 0 && discounted.Cmp(money.FromDecimal(e.cfg.FreeShippingOver, req.Currency)) >= 0 {
+		b.Shipping = zero
+	}
+
+	tax, err := e.tax.Tax(ctx, &TaxRequest{Address: req.Address, Lines: b.Lines, Discount: b.Discount, Shipping: b.Shipping})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute tax: %v", err)
+	}
+	if b.Tax, err = tax.Amount.In(req.Currency); err != nil {
+		return nil, fmt.Errorf("failed to compute tax: %v", err)
+	}
+	b.TaxRate = tax.Rate
+	b.Total = discounted.Add(b.Shipping).Add(b.Tax)
+	return b, nil
+}
+
+// discount applies codes in order, none of them takes more than what is left of the subtotal
+func (e *Engine) discount(b *Breakdown, currency string, codes []string) error {
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if seen[code] {
+			continue
+		}
+		seen[code] = true
+
+		d, ok := e.cfg.Discounts[code]
+		if !ok {
+			return fmt.Errorf("%w %q", ErrUnknownDiscount, code)
+		}
+		if minimum := money.FromDecimal(d.MinSubtotal, currency); b.Subtotal.Cmp(minimum) < 0 {
+			return fmt.Errorf("%w: %q needs a subtotal of %s", ErrDiscountNotApplicable, code, minimum)
+		}
+		amount := b.Subtotal.MulRate(d.Rate).Add(money.FromDecimal(d.Amount, currency))
+		if left := b.Subtotal.Sub(b.Discount); amount.Cmp(left) > 0 {
+			amount = left
+		}
+		b.Discounts = append(b.Discounts, AppliedDiscount{Code: code, Amount: amount})
+		b.Discount = b.Discount.Add(amount)
+	}
+	return nil
+}
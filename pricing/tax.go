@@ -0,0 +1,47 @@
+package pricing
+
+import (
+	"context"
+
+	"github.com/omnom-nom/order/money"
+)
+
+// TaxRequest asks for the tax of priced line items
+type TaxRequest struct {
+	Address *Address
+	Lines   []LineTotal
+	// Discount is taken off the line totals before they are taxed
+	Discount money.Money
+	Shipping money.Money
+}
+
+// Taxable returns the discounted subtotal plus shipping
+func (r *TaxRequest) Taxable() money.Money {
+	taxable := r.Shipping.Sub(r.Discount)
+	for _, line := range r.Lines {
+		taxable = taxable.Add(line.Total)
+	}
+	return taxable
+}
+
+// Tax is the tax computed by a tax provider
+type Tax struct {
+	// Rate is the effective rate of Amount
+	Rate float64
+	// Amount is in the currency of the taxed line items
+	Amount money.Money
+}
+
+// TaxProvider computes the tax of an order, e.g. by the rates of its address
+type TaxProvider interface {
+	Tax(ctx context.Context, req *TaxRequest) (*Tax, error)
+}
+
+// FlatRate taxes everything at one rate, it is the default tax provider
+type FlatRate struct {
+	Rate float64
+}
+
+func (f FlatRate) Tax(ctx context.Context, req *TaxRequest) (*Tax, error) {
+	return &Tax{Rate: f.Rate, Amount: req.Taxable().MulRate(f.Rate)}, nil
+}
@@ -0,0 +1,19 @@
+// Package proto holds the protobuf definitions of the order service and the
+// OpenAPI document generated from them. The go code in orderpb is generated with
+// protoc-gen-go, protoc-gen-go-grpc and protoc-gen-grpc-gateway, the OpenAPI
+// document with protoc-gen-openapiv2:
+//
+//	go generate ./proto
+package proto
+
+import (
+	// embed provides the OpenAPI document
+	_ "embed"
+)
+
+//go:generate protoc -I . -I third_party --go_out=orderpb --go_opt=paths=source_relative --go-grpc_out=orderpb --go-grpc_opt=paths=source_relative --grpc-gateway_out=orderpb --grpc-gateway_opt=paths=source_relative --openapiv2_out=. order.proto
+
+// OpenAPI is the OpenAPI v2 document of the REST routes generated from order.proto
+//
+//go:embed order.swagger.json
+var OpenAPI []byte
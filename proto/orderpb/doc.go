@@ -0,0 +1,2 @@
+// Package orderpb holds the go code generated from proto/order.proto by go generate ./proto
+package orderpb
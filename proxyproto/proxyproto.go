@@ -0,0 +1,231 @@
+// Package proxyproto reads the PROXY protocol header, version 1 or 2, a load
+// balancer forwarding tcp connections sends first, so the address of the
+// client it gives replaces the one of the load balancer.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHeader is returned by the connections of a trusted proxy that did not
+// start with a PROXY protocol header
+var ErrNoHeader = errors.New("proxyproto: connection does not start with a proxy protocol header")
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest header of version 1, its line ending included
+const v1MaxLength = 107
+
+// Listener reads the header of the connections it accepts from the trusted
+// proxies. The others are served as they are, a header they send is not read.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+}
+
+// NewListener returns a listener reading the header of the connections of l
+// from an address in trusted, of none when trusted is empty. The header has to
+// arrive within timeout, unless it is 0.
+func NewListener(l net.Listener, trusted []*net.IPNet, timeout time.Duration) *Listener {
+	return &Listener{Listener: l, trusted: trusted, timeout: timeout}
+}
+
+// Accept returns the next connection. Its header is read on its first Read or
+// RemoteAddr, so a slow proxy does not hold up the others.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.timeout}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range l.trusted {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection of a trusted proxy
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	source net.Addr
+	err    error
+}
+
+// readHeader reads the header of c once
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.source, c.err = ReadHeader(c.reader)
+	})
+}
+
+// Read reads the data following the header
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the address of the client given by the header, that of
+// the proxy when the header gives none or could not be read
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ProxyAddr returns the address of the proxy
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// ReadHeader reads a header of version 1 or 2 from r and returns the address
+// of the client it gives, nil for a header of the proxy itself, such as a
+// health check, or of an unknown protocol
+func ReadHeader(r *bufio.Reader) (net.Addr, error) {
+	// only as much as the prefix of version 1 is read ahead of its line, a
+	// short header does not wait for data the client sends after it
+	start, err := r.Peek(len(v1Prefix))
+	if err == io.EOF && len(start) == 0 {
+		return nil, err
+	}
+	if err != nil {
+		return nil, ErrNoHeader
+	}
+	if bytes.Equal(start, v1Prefix) {
+		return readV1(r)
+	}
+	if !bytes.HasPrefix(v2Signature, start) {
+		return nil, ErrNoHeader
+	}
+	if start, err = r.Peek(len(v2Signature)); err != nil || !bytes.Equal(start, v2Signature) {
+		return nil, ErrNoHeader
+	}
+	return readV2(r)
+}
+
+// readV1 reads a text header up to its CRLF, such as
+// PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxyproto: invalid v1 header: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == v1MaxLength {
+			return nil, errors.New("proxyproto: v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyproto: v1 header does not end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("proxyproto: invalid v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid source %s:%s", fields[2], fields[4])
+	}
+	switch fields[1] {
+	case "TCP4":
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("proxyproto: %s is not an ipv4 address", fields[2])
+		}
+	case "TCP6":
+		if ip.To4() != nil {
+			return nil, fmt.Errorf("proxyproto: %s is not an ipv6 address", fields[2])
+		}
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown v1 protocol %q", fields[1])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header: the signature, the version and command, the
+// family and protocol, the length of the addresses and the addresses, whose
+// extensions are skipped
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(v2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v2 header: %v", err)
+	}
+	versionCommand, family := header[12], header[13]
+	length := int(binary.BigEndian.Uint16(header[14:]))
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("proxyproto: unknown version %d", versionCommand>>4)
+	}
+	addresses := make([]byte, length)
+	if _, err := io.ReadFull(r, addresses); err != nil {
+		return nil, fmt.Errorf("proxyproto: invalid v2 addresses: %v", err)
+	}
+
+	switch versionCommand & 0x0f {
+	case 0x0:
+		// LOCAL, the proxy connected for itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("proxyproto: unknown command %d", versionCommand&0x0f)
+	}
+	switch family {
+	case 0x11: // tcp over ipv4
+		if length < 12 {
+			return nil, errors.New("proxyproto: v2 ipv4 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:4]), Port: int(binary.BigEndian.Uint16(addresses[8:]))}, nil
+	case 0x21: // tcp over ipv6
+		if length < 36 {
+			return nil, errors.New("proxyproto: v2 ipv6 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(addresses[0:16]), Port: int(binary.BigEndian.Uint16(addresses[32:]))}, nil
+	}
+	// udp and unix sockets are not client addresses of an http server
+	return nil, nil
+}
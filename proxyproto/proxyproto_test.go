@@ -0,0 +1,186 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// v2Header returns a header of version 2 with command, family and addresses
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n"), "192.0.2.10:56324"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN 192.0.2.10 198.51.100.1 56324 443\r\n"), ""},
+		{"v2 tcp4", v2Header(0x1, 0x11, ipv4), "192.0.2.10:56324"},
+		{"v2 tcp6", v2Header(0x1, 0x21, ipv6), "[2001:db8::1]:56324"},
+		{"v2 tcp4 with extensions", v2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "192.0.2.10:56324"},
+		{"v2 local", v2Header(0x0, 0x00, nil), ""},
+		{"v2 udp", v2Header(0x1, 0x12, ipv4), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(tt.header), strings.NewReader("GET / HTTP/1.1\r\n")))
+			addr, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("ReadHeader: %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("ReadHeader returned %q, want %q", got, tt.want)
+			}
+			// the data following the header is left to read
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("the header was followed by %q, want the request", rest)
+			}
+		})
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")},
+		{"short", []byte("GET\r\n")},
+		{"v2 truncated signature", v2Signature[:8]},
+		{"v1 without crlf", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\n")},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", v1MaxLength) + "\r\n")},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324\r\n")},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2.300 198.51.100.1 56324 443\r\n")},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 65536 443\r\n")},
+		{"v1 ipv6 as tcp4", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n")},
+		{"v1 ipv4 as tcp6", []byte("PROXY TCP6 192.0.2.10 198.51.100.1 56324 443\r\n")},
+		{"v1 unknown protocol", []byte("PROXY UDP4 192.0.2.10 198.51.100.1 56324 443\r\n")},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.10")},
+		{"v2 version 1", append(append([]byte{}, v2Signature...), 0x11, 0x11, 0, 0)},
+		{"v2 unknown command", v2Header(0x2, 0x11, make([]byte, 12))},
+		{"v2 short ipv4", v2Header(0x1, 0x11, make([]byte, 8))},
+		{"v2 short ipv6", v2Header(0x1, 0x21, make([]byte, 12))},
+		{"v2 truncated addresses", v2Header(0x1, 0x11, make([]byte, 12))[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if addr, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.header))); err == nil {
+				t.Errorf("ReadHeader returned %v, want an error", addr)
+			}
+		})
+	}
+
+	if _, err := ReadHeader(bufio.NewReader(strings.NewReader(""))); err != io.EOF {
+		t.Errorf("ReadHeader of a closed connection returned %v, want %v", err, io.EOF)
+	}
+	if _, err := ReadHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); !errors.Is(err, ErrNoHeader) {
+		t.Errorf("ReadHeader without a header returned %v, want %v", err, ErrNoHeader)
+	}
+}
+
+func TestReadHeaderDoesNotReadAhead(t *testing.T) {
+	// the client waits for the response before sending anything else
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ReadHeader(bufio.NewReader(server))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadHeader of a short header waited for more data")
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{"trusted", "127.0.0.0/8", "192.0.2.10:56324"},
+		{"no one trusted", "", ""},
+		{"not trusted", "10.0.0.0/8", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Skipf("can not listen on the loopback: %v", err)
+			}
+			var trusted []*net.IPNet
+			if tt.trusted != "" {
+				_, network, _ := net.ParseCIDR(tt.trusted)
+				trusted = append(trusted, network)
+			}
+			listener := NewListener(l, trusted, 0)
+			defer listener.Close()
+
+			const header = "PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n"
+			go func() {
+				client, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				defer client.Close()
+				client.Write([]byte(header + "hello"))
+			}()
+
+			conn, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			defer conn.Close()
+			data, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("Read: %v", err)
+			}
+			if tt.want == "" {
+				// the header of an untrusted client is data
+				if string(data) != header+"hello" || !strings.HasPrefix(conn.RemoteAddr().String(), "127.0.0.1:") {
+					t.Errorf("untrusted connection from %s read %q", conn.RemoteAddr(), data)
+				}
+				return
+			}
+			if string(data) != "hello" {
+				t.Errorf("read %q, want the data after the header", data)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.want {
+				t.Errorf("RemoteAddr() = %s, want %s", got, tt.want)
+			}
+			if proxy := conn.(*Conn).ProxyAddr().String(); !strings.HasPrefix(proxy, "127.0.0.1:") {
+				t.Errorf("ProxyAddr() = %s, want the loopback", proxy)
+			}
+		})
+	}
+}
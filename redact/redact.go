@@ -0,0 +1,230 @@
+// Package redact scrubs personal data, such as emails, addresses and client
+// addresses, from what the service writes out: log entries, audit records,
+// error messages and exports. Every field redacted has a policy, masking,
+// hashing or dropping its value.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/logging"
+)
+
+// Dropped replaces the values of the dropped fields found in text
+const Dropped = "[redacted]"
+
+// patterns find the values of fields in text, such as the email a validation
+// error quotes, by normalized field name
+var patterns = map[string]*regexp.Regexp{
+	"email":    regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	"clientip": regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b|\b(?:[0-9A-Fa-f]{1,4}:){2,7}[0-9A-Fa-f]{1,4}\b`),
+}
+
+// Redactor applies the policies of the configured fields. A nil Redactor
+// leaves everything as it is.
+type Redactor struct {
+	policies map[string]string
+	hashKey  []byte
+}
+
+// New returns the redactor of cfg, nil when redaction is disabled
+func New(cfg config.RedactionConfig) *Redactor {
+	if !cfg.Enabled || len(cfg.Fields) == 0 {
+		return nil
+	}
+	r := &Redactor{policies: make(map[string]string, len(cfg.Fields)), hashKey: []byte(cfg.HashKey)}
+	for field, policy := range cfg.Fields {
+		r.policies[normalize(field)] = policy
+	}
+	return r
+}
+
+// normalize returns the name a field is matched by: lower case, without
+// dashes and underscores, so client_ip is clientIp
+func normalize(field string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(field))
+}
+
+// policy returns the policy of field, "" when it is not redacted
+func (r *Redactor) policy(field string) string {
+	if r == nil {
+		return ""
+	}
+	return r.policies[normalize(field)]
+}
+
+// Redacts reports whether field is redacted
+func (r *Redactor) Redacts(field string) bool {
+	return r.policy(field) != ""
+}
+
+// Drops reports whether field is left out
+func (r *Redactor) Drops(field string) bool {
+	return r.policy(field) == config.RedactDrop
+}
+
+// String returns value of field redacted, false when it is dropped
+func (r *Redactor) String(field, value string) (string, bool) {
+	switch r.policy(field) {
+	case config.RedactMask:
+		return mask(value), true
+	case config.RedactHash:
+		return r.hash(value), true
+	case config.RedactDrop:
+		return "", false
+	}
+	return value, true
+}
+
+// Value returns value of field redacted, false when it is dropped. The values
+// that are not strings are redacted in their printed form, nil stays nil.
+func (r *Redactor) Value(field string, value interface{}) (interface{}, bool) {
+	if value == nil || !r.Redacts(field) {
+		return value, !r.Drops(field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		s = fmt.Sprint(value)
+	}
+	return r.String(field, s)
+}
+
+// mask replaces all but the last quarter of value, at most four characters,
+// with stars
+func mask(value string) string {
+	runes := []rune(value)
+	keep := len(runes) / 4
+	if keep > 4 {
+		keep = 4
+	}
+	return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+}
+
+// hash returns the keyed hash of value, truncated to 128 bits
+func (r *Redactor) hash(value string) string {
+	mac := hmac.New(sha256.New, r.hashKey)
+	mac.Write([]byte(value))
+	return "hash:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Text returns s with the values of the redacted fields that have a known
+// shape, emails and ip addresses, redacted, for messages quoting them
+func (r *Redactor) Text(s string) string {
+	if r == nil {
+		return s
+	}
+	for field, pattern := range patterns {
+		if r.policies[field] == "" {
+			continue
+		}
+		s = pattern.ReplaceAllStringFunc(s, func(value string) string {
+			if redacted, ok := r.String(field, value); ok {
+				return redacted
+			}
+			return Dropped
+		})
+	}
+	return s
+}
+
+// JSON returns the json value of field redacted: as a whole when field is
+// redacted, else the redacted fields of its objects at any depth. It returns
+// nil when field is dropped, and raw when it is not valid json.
+func (r *Redactor) JSON(field string, raw json.RawMessage) json.RawMessage {
+	if r == nil || len(raw) == 0 {
+		return raw
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return raw
+	}
+	value, ok := r.Value(field, value)
+	if !ok {
+		return nil
+	}
+	if !r.Redacts(field) {
+		value = r.walk(value)
+	}
+	out, err := json.Marshal(value)
+	if err != nil {
+		return raw
+	}
+	return out
+}
+
+// walk redacts the fields of the objects of value
+func (r *Redactor) walk(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if !r.Redacts(key) {
+				v[key] = r.walk(field)
+				continue
+			}
+			if redacted, ok := r.Value(key, field); ok {
+				v[key] = redacted
+			} else {
+				delete(v, key)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = r.walk(item)
+		}
+	case string:
+		return r.Text(v)
+	}
+	return value
+}
+
+// Fields returns a copy of fields with the redacted ones redacted and the
+// others scrubbed of the values of known shape
+func (r *Redactor) Fields(fields logging.Fields) logging.Fields {
+	if r == nil {
+		return fields
+	}
+	out := make(logging.Fields, len(fields))
+	for key, value := range fields {
+		if r.Redacts(key) {
+			if redacted, ok := r.Value(key, value); ok {
+				out[key] = redacted
+			}
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			out[key] = r.Text(v)
+		case error:
+			out[key] = r.Text(v.Error())
+		default:
+			out[key] = value
+		}
+	}
+	return out
+}
+
+// backend redacts the entries it writes
+type backend struct {
+	backend  logging.Backend
+	redactor *Redactor
+}
+
+// NewBackend returns a backend writing the entries redacted by r to b, b
+// itself when r is nil. The access log and every other entry go through it.
+func NewBackend(b logging.Backend, r *Redactor) logging.Backend {
+	if r == nil {
+		return b
+	}
+	return &backend{backend: b, redactor: r}
+}
+
+func (b *backend) Write(level logging.Level, msg string, fields logging.Fields) {
+	b.backend.Write(level, b.redactor.Text(msg), b.redactor.Fields(fields))
+}
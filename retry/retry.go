@@ -0,0 +1,124 @@
+// Package retry calls operations again after transient failures, waiting an
+// exponentially growing, randomized backoff between the attempts.
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+)
+
+// Policy decides how often and after which wait a failed operation is tried again
+type Policy struct {
+	// MaxAttempts is the number of attempts including the first, below 1 it is 1
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Retryable reports whether an attempt failing with err is tried again, nil
+	// tries every error again
+	Retryable func(err error) bool
+}
+
+// New returns the policy of cfg trying again the errors retryable reports
+func New(cfg config.RetryConfig, retryable func(err error) bool) Policy {
+	return Policy{
+		MaxAttempts:    cfg.MaxAttempts,
+		InitialBackoff: cfg.InitialBackoff.Duration,
+		MaxBackoff:     cfg.MaxBackoff.Duration,
+		Retryable:      retryable,
+	}
+}
+
+// permanentError marks an error that is not tried again
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth another attempt whatever the policy, Do
+// returns err itself
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Do calls fn until it succeeds, fails with an error that is permanent or not
+// retryable, the attempts are used up or ctx is done, and returns the error of
+// its last attempt
+func (p Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return permanent.err
+		}
+		if attempt >= p.MaxAttempts || ctx.Err() != nil || (p.Retryable != nil && !p.Retryable(err)) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(p.Backoff(attempt)):
+		}
+	}
+}
+
+// Backoff returns the wait after the given number of failed attempts: the
+// initial backoff doubled per attempt up to the max backoff, half of it
+// randomized so clients failing together do not retry together
+func (p Policy) Backoff(attempts int) time.Duration {
+	wait := p.InitialBackoff
+	for i := 1; i < attempts && wait < p.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// Temporary reports whether err is a transient network failure: a timeout,
+// a refused or reset connection or a connection closed mid response. Do stops
+// anyway once the context of the caller is done.
+func Temporary(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// RetryableStatus reports whether a request answered with the http status code
+// may succeed when sent again
+func RetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests ||
+		code == http.StatusBadGateway || code == http.StatusServiceUnavailable ||
+		code == http.StatusGatewayTimeout || code == http.StatusInternalServerError
+}
@@ -0,0 +1,255 @@
+// Package routing assigns the line items of orders to the warehouses that
+// ship them, with one of the strategies of the configuration or with one
+// plugged in as a Strategy.
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrUnroutable is returned when the warehouses do not hold enough stock of an
+// item of the order
+var ErrUnroutable = errors.New("no warehouse holds the items")
+
+const (
+	// StrategyNearest ships each item from the warehouses closest to the
+	// destination that hold it
+	StrategyNearest = "nearest"
+	// StrategyStock ships each item from the warehouses holding the most of it,
+	// keeping an order in as few warehouses as their stock allows
+	StrategyStock = "stock"
+	// StrategyCost ships each item from the warehouses it costs the least to
+	// ship it from
+	StrategyCost = "cost"
+)
+
+// Strategies are the names of the strategies New returns
+var Strategies = []string{StrategyNearest, StrategyStock, StrategyCost}
+
+// Item is a line item to route
+type Item struct {
+	SKU      string
+	Quantity int
+}
+
+// Destination is the part of the shipping address the strategies look at
+type Destination struct {
+	Country    string
+	PostalCode string
+}
+
+// Warehouse is a warehouse items can ship from
+type Warehouse struct {
+	ID         string
+	Country    string
+	PostalCode string
+	// Stock is the quantity the warehouse holds by SKU
+	Stock map[string]int
+	// ShipmentCost is the cost of a parcel leaving the warehouse and UnitCost
+	// that of picking one unit, in any one currency as they are only compared
+	ShipmentCost float64
+	UnitCost     float64
+}
+
+// Request asks to route the items of an order
+type Request struct {
+	OrderID string
+	// Priority is standard, expedited or rush
+	Priority string
+	Items    []Item
+	// Destination is nil for orders that do not ship
+	Destination *Destination
+	Warehouses  []*Warehouse
+}
+
+// Allocation is a quantity of a SKU a warehouse ships
+type Allocation struct {
+	WarehouseID string
+	SKU         string
+	Quantity    int
+}
+
+// Strategy assigns the items of orders to warehouses. The service routes an
+// order once it is confirmed, and again when its items change.
+type Strategy interface {
+	Route(ctx context.Context, req *Request) ([]Allocation, error)
+}
+
+// New returns the built-in strategy with name, one of Strategies
+func New(name string) (Strategy, error) {
+	switch name {
+	case StrategyNearest:
+		return ranked(byDistance), nil
+	case StrategyStock:
+		return ranked(byStock), nil
+	case StrategyCost:
+		return ranked(byCost), nil
+	}
+	return nil, fmt.Errorf("unknown routing strategy %q", name)
+}
+
+// Valid reports whether name is one of Strategies
+func Valid(name string) bool {
+	for _, s := range Strategies {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// candidate is a warehouse able to ship some of an item
+type candidate struct {
+	warehouse *Warehouse
+	// available is the stock of the item left after the items routed before
+	available int
+	// used is set once the warehouse ships an item of the order
+	used bool
+}
+
+// rank reports whether a ships the quantity of item before b
+type rank func(req *Request, item Item, a, b *candidate) bool
+
+// ranked is a strategy filling every item from the warehouses in the order of
+// its rank, splitting it when the first one holds too little
+type ranked rank
+
+func (r ranked) Route(ctx context.Context, req *Request) ([]Allocation, error) {
+	available := map[string]map[string]int{}
+	for _, w := range req.Warehouses {
+		available[w.ID] = map[string]int{}
+		for sku, quantity := range w.Stock {
+			available[w.ID][sku] = quantity
+		}
+	}
+	used := map[string]bool{}
+
+	var allocations []Allocation
+	for _, item := range req.Items {
+		var candidates []*candidate
+		for _, w := range req.Warehouses {
+			if n := available[w.ID][item.SKU]; n > 0 {
+				candidates = append(candidates, &candidate{warehouse: w, available: n, used: used[w.ID]})
+			}
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if r(req, item, candidates[i], candidates[j]) {
+				return true
+			}
+			if r(req, item, candidates[j], candidates[i]) {
+				return false
+			}
+			return candidates[i].warehouse.ID < candidates[j].warehouse.ID
+		})
+
+		remaining := item.Quantity
+		for _, c := range candidates {
+			if remaining == 0 {
+				break
+			}
+			quantity := remaining
+			if quantity > c.available {
+				quantity = c.available
+			}
+			allocations = append(allocations, Allocation{WarehouseID: c.warehouse.ID, SKU: item.SKU, Quantity: quantity})
+			available[c.warehouse.ID][item.SKU] -= quantity
+			used[c.warehouse.ID] = true
+			remaining -= quantity
+		}
+		if remaining > 0 {
+			return nil, fmt.Errorf("%w: %d of %s are missing", ErrUnroutable, remaining, item.SKU)
+		}
+	}
+	return merge(allocations), nil
+}
+
+// merge adds up the allocations of the same SKU from the same warehouse, as
+// an order may list a SKU more than once
+func merge(allocations []Allocation) []Allocation {
+	var out []Allocation
+	index := map[[2]string]int{}
+	for _, a := range allocations {
+		key := [2]string{a.WarehouseID, a.SKU}
+		if i, ok := index[key]; ok {
+			out[i].Quantity += a.Quantity
+			continue
+		}
+		index[key] = len(out)
+		out = append(out, a)
+	}
+	return out
+}
+
+// fills reports whether c holds the whole quantity of item
+func (c *candidate) fills(item Item) bool {
+	return c.available >= item.Quantity
+}
+
+// byDistance ranks the warehouses closest to the destination first, then
+// those holding the whole item, then those already shipping the order.
+// Without geocoding, a warehouse is closer the more of the destination it
+// shares: its country, then the leading characters of its postal code.
+func byDistance(req *Request, item Item, a, b *candidate) bool {
+	if da, db := distance(req.Destination, a.warehouse), distance(req.Destination, b.warehouse); da != db {
+		return da < db
+	}
+	if a.fills(item) != b.fills(item) {
+		return a.fills(item)
+	}
+	return a.used && !b.used
+}
+
+// maxDistance is the distance of a warehouse in another country
+const maxDistance = 1 << 16
+
+// distance is 0 for a warehouse at the postal code of the destination and
+// grows as the postal codes share fewer leading characters
+func distance(d *Destination, w *Warehouse) int {
+	if d == nil {
+		return 0
+	}
+	if !strings.EqualFold(w.Country, d.Country) {
+		return maxDistance
+	}
+	shared := 0
+	for shared < len(d.PostalCode) && shared < len(w.PostalCode) && d.PostalCode[shared] == w.PostalCode[shared] {
+		shared++
+	}
+	return len(d.PostalCode) - shared
+}
+
+// byStock ranks the warehouses holding the whole item first, preferring those
+// already shipping the order, then the warehouses holding the most of it
+func byStock(req *Request, item Item, a, b *candidate) bool {
+	if a.fills(item) != b.fills(item) {
+		return a.fills(item)
+	}
+	if a.fills(item) && a.used != b.used {
+		return a.used
+	}
+	return a.available > b.available
+}
+
+// byCost ranks the warehouses by the cost of each unit of the item they ship,
+// the cost of a parcel counting only for the warehouses not yet shipping the
+// order
+func byCost(req *Request, item Item, a, b *candidate) bool {
+	return a.unitCost(item) < b.unitCost(item)
+}
+
+// unitCost is the cost of each unit of item c ships
+func (c *candidate) unitCost(item Item) float64 {
+	quantity := item.Quantity
+	if quantity > c.available {
+		quantity = c.available
+	}
+	cost := c.warehouse.UnitCost * float64(quantity)
+	if !c.used {
+		cost += c.warehouse.ShipmentCost
+	}
+	return cost / float64(quantity)
+}
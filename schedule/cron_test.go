@@ -0,0 +1,111 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-x * * * *",
+		"@sometimes",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// a monday
+	from := time.Date(2024, time.January, 15, 9, 30, 20, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2024, 1, 15, 9, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2024, 1, 15, 9, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", from, time.Date(2024, 1, 15, 9, 45, 0, 0, time.UTC)},
+		{"30 9 * * *", from, time.Date(2024, 1, 16, 9, 30, 0, 0, time.UTC)},
+		{"0 8-10 * * *", from, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"0 0,12 * * *", from, time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)},
+		{"@hourly", from, time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)},
+		{"@daily", from, time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", from, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", from, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", from, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// sunday is 0 or 7
+		{"0 0 * * 7", from, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 1-5", time.Date(2024, 1, 19, 12, 0, 0, 0, time.UTC), time.Date(2024, 1, 22, 0, 0, 0, 0, time.UTC)},
+		// a day of month or a day of week, whichever comes first
+		{"0 0 20 * 3", from, time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 16 * 5", from, time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		// a day of month and every day of the week
+		{"0 0 31 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// never fires
+		{"0 0 30 2 *", from, time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := Parse(tt.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.expr, err)
+		}
+		if got := c.Next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("%q.Next(%s) = %s, want %s", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	c, err := Parse("30 2 * * *")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	// 2:30 does not exist on 10 March 2024, the clocks go from 2:00 to 3:00
+	got := c.Next(time.Date(2024, 3, 10, 1, 0, 0, 0, loc))
+	want := time.Date(2024, 3, 11, 2, 30, 0, 0, loc)
+	if !got.Equal(want) {
+		t.Errorf("Next over the spring gap = %s, want %s", got, want)
+	}
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec(" @every 90s ")
+	if err != nil {
+		t.Fatalf("ParseSpec: %v", err)
+	}
+	from := time.Date(2024, 1, 15, 9, 30, 20, 0, time.UTC)
+	if got := spec.Next(from); !got.Equal(from.Add(90 * time.Second)) {
+		t.Errorf("@every 90s Next = %s, want %s", got, from.Add(90*time.Second))
+	}
+	if spec.String() != "@every 1m30s" {
+		t.Errorf("String() = %q, want @every 1m30s", spec.String())
+	}
+	if _, err := ParseSpec("*/5 * * * *"); err != nil {
+		t.Errorf("ParseSpec of a cron expression: %v", err)
+	}
+	for _, invalid := range []string{"@every", "@every 0s", "@every -1m", "@every soon"} {
+		if _, err := ParseSpec(invalid); err == nil {
+			t.Errorf("ParseSpec(%q) succeeded, want an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// everyPrefix starts the specs of the fixed periods, like @every 30s
+const everyPrefix = "@every "
+
+// Spec tells the times something runs at
+type Spec interface {
+	// Next returns the first time after t, or the zero time when there is none
+	Next(t time.Time) time.Time
+	String() string
+}
+
+// Every is a fixed period between the runs, which unlike a cron expression may
+// be shorter than a minute
+type Every time.Duration
+
+// Next returns t plus the period
+func (e Every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (e Every) String() string {
+	return everyPrefix + time.Duration(e).String()
+}
+
+// ParseSpec parses spec, a cron expression as taken by Parse or "@every "
+// followed by a positive duration
+func ParseSpec(spec string) (Spec, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.HasPrefix(spec, everyPrefix) {
+		return Parse(spec)
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, everyPrefix)))
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q: %v", spec, err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("schedule %q must have a positive period", spec)
+	}
+	return Every(d), nil
+}
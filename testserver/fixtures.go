@@ -0,0 +1,75 @@
+package testserver
+
+import (
+	"time"
+
+	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/money"
+)
+
+// The ids of the canned fixtures, one order in every status
+const (
+	FixtureCustomerID = "customer-fixture"
+
+	PendingOrderID   = "order-pending"
+	PaidOrderID      = "order-paid"
+	ShippedOrderID   = "order-shipped"
+	DeliveredOrderID = "order-delivered"
+	CancelledOrderID = "order-cancelled"
+)
+
+// fixtureTime is the creation time of the fixtures, fixed so that the
+// responses of the server do not change between runs
+var fixtureTime = time.Date(2024, time.January, 15, 9, 30, 0, 0, time.UTC)
+
+// Fixtures returns the canned orders a server starts with: one order of
+// FixtureCustomerID in every status, newest first. Each call returns new
+// copies to change at will.
+func Fixtures() []*api.Order {
+	address := api.Address{
+		Name:       "Ada Lovelace",
+		Line1:      "12 Test Street",
+		City:       "Springfield",
+		PostalCode: "12345",
+		Country:    "US",
+	}
+	statuses := []struct {
+		id     string
+		status api.Status
+	}{
+		{CancelledOrderID, api.StatusCancelled},
+		{DeliveredOrderID, api.StatusDelivered},
+		{ShippedOrderID, api.StatusShipped},
+		{PaidOrderID, api.StatusPaid},
+		{PendingOrderID, api.StatusPending},
+	}
+
+	var orders []*api.Order
+	for i, s := range statuses {
+		shipTo := address
+		created := fixtureTime.Add(-time.Duration(i) * time.Hour)
+		order := &api.Order{
+			ID:         s.id,
+			CustomerID: FixtureCustomerID,
+			Status:     s.status,
+			Items: []api.LineItem{
+				{SKU: "sku-coffee", Name: "Coffee beans 1kg", Quantity: 2, UnitPrice: money.New(1850, "USD")},
+				{SKU: "sku-filter", Name: "Paper filters", Quantity: 1, UnitPrice: money.New(425, "USD")},
+			},
+			ShippingAddress: &shipTo,
+			Currency:        "USD",
+			Total:           money.New(4125, "USD"),
+			CreatedAt:       created,
+			UpdatedAt:       created,
+		}
+		if s.status == api.StatusCancelled {
+			order.Cancellation = &api.Cancellation{
+				Reason:      api.CancelCustomerRequest,
+				CancelledAt: created,
+				Refund:      api.RefundNone,
+			}
+		}
+		orders = append(orders, order)
+	}
+	return orders
+}
@@ -0,0 +1,332 @@
+// Package testserver runs the order api for the integration tests of the
+// services calling it, without AWS. The server serves every route of the
+// order service from an in-memory repository holding canned fixtures, and the
+// responses and latency of its routes can be programmed:
+//
+//	srv := testserver.Start(t)
+//	client, _ := orderclient.New(orderclient.WithBaseURL(srv.URL))
+//	srv.On("CreateOrder").Fail(http.StatusServiceUnavailable, "try again").Times(1)
+//	srv.On("GetOrder").Delay(2 * time.Second)
+package testserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omnom-nom/order/api"
+	"github.com/omnom-nom/order/api/apitest"
+	"github.com/omnom-nom/order/config"
+)
+
+// Server serves the order api on a local address until it is closed
+type Server struct {
+	// URL is the base url of the server, e.g. http://127.0.0.1:41233
+	URL string
+
+	repo   api.Repository
+	server *httptest.Server
+
+	mu      sync.Mutex
+	stubs   []*Stub
+	latency time.Duration
+}
+
+type options struct {
+	cfg      *config.Config
+	fixtures []*api.Order
+	latency  time.Duration
+}
+
+// Option configures a Server
+type Option func(o *options)
+
+// WithConfig changes the configuration the server runs with, which starts
+// from apitest.Config with returns, customers, hosts, drafts, schedules and
+// webhooks enabled
+func WithConfig(change func(cfg *config.Config)) Option {
+	return func(o *options) {
+		change(o.cfg)
+	}
+}
+
+// WithFixtures replaces the canned fixtures the repository starts with by
+// orders, none without them
+func WithFixtures(orders ...*api.Order) Option {
+	return func(o *options) {
+		o.fixtures = orders
+	}
+}
+
+// WithLatency delays every response of the server by latency
+func WithLatency(latency time.Duration) Option {
+	return func(o *options) {
+		o.latency = latency
+	}
+}
+
+// New starts a server holding the canned fixtures unless the options tell
+// otherwise. The caller closes it.
+func New(opts ...Option) (*Server, error) {
+	cfg := apitest.Config()
+	cfg.Returns.Enabled = true
+	cfg.Customers.Enabled = true
+	cfg.Hosts.Enabled = true
+	cfg.Drafts.Enabled = true
+	cfg.Schedules.Enabled = true
+	cfg.Webhooks.Enabled = true
+	o := &options{cfg: cfg, fixtures: Fixtures()}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	repo, err := newRepository(o.cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, order := range o.fixtures {
+		if err := repo.CreateOrder(context.Background(), order); err != nil {
+			return nil, fmt.Errorf("failed to create fixture %s: %v", order.ID, err)
+		}
+	}
+	svc, err := api.NewService(repo, config.NewStore(o.cfg, nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %v", err)
+	}
+	handler, err := svc.Handler()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create handler: %v", err)
+	}
+
+	s := &Server{repo: svc.Repository(), latency: o.latency}
+	s.server = httptest.NewServer(s.wrap(handler))
+	s.URL = s.server.URL
+	return s, nil
+}
+
+// Start starts a server as New does, closed when the test ends
+func Start(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatalf("failed to start order test server: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// newRepository returns the in-memory repository keeping the returns,
+// customers, hosts, drafts, schedules and webhooks enabled in cfg
+func newRepository(cfg *config.Config) (api.Repository, error) {
+	repo := api.NewMemoryRepository()
+	stores := []struct {
+		enabled bool
+		enable  func(api.Repository, string) error
+		table   string
+	}{
+		{cfg.Returns.Enabled, api.EnableReturns, cfg.Db.ReturnsTable},
+		{cfg.Customers.Enabled, api.EnableCustomers, cfg.Db.CustomersTable},
+		{cfg.Hosts.Enabled, api.EnableHosts, cfg.Db.HostsTable},
+		{cfg.Drafts.Enabled, api.EnableDrafts, cfg.Db.DraftsTable},
+		{cfg.Schedules.Enabled, api.EnableSchedules, cfg.Db.SchedulesTable},
+		{cfg.Webhooks.Enabled, api.EnableWebhooks, cfg.Db.WebhooksTable},
+	}
+	for _, store := range stores {
+		if !store.enabled {
+			continue
+		}
+		if err := store.enable(repo, store.table); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// Close stops the server, waiting for the requests it serves
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Repository returns the repository the server serves, to add orders to it
+// or check those the calls left
+func (s *Server) Repository() api.Repository {
+	return s.repo
+}
+
+// Client returns an http client for the server
+func (s *Server) Client() *http.Client {
+	return s.server.Client()
+}
+
+// SetLatency delays every response of the server by latency, 0 answers at once
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// On programs the responses of the route named route, as listed by
+// GET /v1/admin/routes, e.g. GetOrder. The stubs of a route are used in the
+// order they were added, until they are used up.
+func (s *Server) On(route string) *Stub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stub := &Stub{server: s, route: route}
+	s.stubs = append(s.stubs, stub)
+	return stub
+}
+
+// Reset removes the stubs and the latency, the repository is kept
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stubs = nil
+	s.latency = 0
+}
+
+// wrap answers the requests matching a stub as it tells, and the others with
+// handler
+func (s *Server) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := api.RouteName(r)
+		latency, stub := s.take(route)
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if stub == nil || !stub.responds() {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		stub.serve(w, r)
+	})
+}
+
+// take uses the first stub of route left, nil when there is none, and
+// returns the latency of the server with the delay of the stub
+func (s *Server) take(route string) (time.Duration, *Stub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, stub := range s.stubs {
+		if stub.route != route {
+			continue
+		}
+		stub.calls++
+		if stub.times > 0 && stub.calls >= stub.times {
+			s.stubs = append(s.stubs[:i:i], s.stubs[i+1:]...)
+		}
+		return s.latency + stub.delay, stub
+	}
+	return s.latency, nil
+}
+
+// Stub is a programmed response of a route. A stub that only delays hands
+// the request to the route once the delay is over.
+type Stub struct {
+	server *Server
+	route  string
+
+	status  int
+	body    interface{}
+	header  http.Header
+	handler http.HandlerFunc
+	delay   time.Duration
+	times   int
+	calls   int
+}
+
+// Respond answers with status and body encoded as json, body may be nil
+func (st *Stub) Respond(status int, body interface{}) *Stub {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	st.status, st.body, st.handler = status, body, nil
+	return st
+}
+
+// Fail answers with status and an error message as the service does
+func (st *Stub) Fail(status int, message string) *Stub {
+	return st.Respond(status, map[string]string{"error": message})
+}
+
+// Header adds a header to the responses of Respond and Fail
+func (st *Stub) Header(key, value string) *Stub {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	if st.header == nil {
+		st.header = http.Header{}
+	}
+	st.header.Add(key, value)
+	return st
+}
+
+// Handle answers with handler
+func (st *Stub) Handle(handler http.HandlerFunc) *Stub {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	st.handler, st.status, st.body = handler, 0, nil
+	return st
+}
+
+// Delay waits for delay, on top of the latency of the server, before
+// answering
+func (st *Stub) Delay(delay time.Duration) *Stub {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	st.delay = delay
+	return st
+}
+
+// Times uses the stub for the next n requests of its route only, by default
+// it is used for all of them
+func (st *Stub) Times(n int) *Stub {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	st.times = n
+	return st
+}
+
+// Calls returns the number of requests the stub was used for
+func (st *Stub) Calls() int {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	return st.calls
+}
+
+// responds reports whether the stub answers instead of the route
+func (st *Stub) responds() bool {
+	st.server.mu.Lock()
+	defer st.server.mu.Unlock()
+	return st.handler != nil || st.status != 0
+}
+
+func (st *Stub) serve(w http.ResponseWriter, r *http.Request) {
+	st.server.mu.Lock()
+	status, body, handler := st.status, st.body, st.handler
+	for key, values := range st.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	st.server.mu.Unlock()
+
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
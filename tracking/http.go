@@ -0,0 +1,124 @@
+package tracking
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnom-nom/order/config"
+	"github.com/omnom-nom/order/httpclient"
+)
+
+const (
+	// SignatureHeader carries the hex HMAC-SHA256 of the timestamp, a dot and
+	// the body of webhook notifications
+	SignatureHeader = "X-Tracking-Signature"
+	// TimestampHeader carries the unix time a webhook notification was signed at
+	TimestampHeader = "X-Tracking-Timestamp"
+	defaultTimeout  = 10 * time.Second
+	// signatureTolerance is the age after which a notification is rejected as a replay
+	signatureTolerance = 5 * time.Minute
+)
+
+// HTTPCarrier reads tracking from a carrier, or a tracking aggregator, speaking json:
+//
+//	GET {endpoint}/{trackingNumber}   returns the latest Update
+//
+// and notifying {"updates": [...]} signed with the webhook secret, along with
+// the time it was sent at.
+type HTTPCarrier struct {
+	client        *http.Client
+	endpoint      string
+	webhookSecret string
+}
+
+// NewHTTPCarrier returns a carrier at the endpoint of cfg, called with the
+// client named name of clients
+func NewHTTPCarrier(name string, cfg *config.CarrierConfig, clients *httpclient.Factory) *HTTPCarrier {
+	timeout := cfg.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &HTTPCarrier{
+		client:        clients.Client("carrier-"+name, timeout),
+		endpoint:      strings.TrimSuffix(cfg.Endpoint, "/"),
+		webhookSecret: cfg.WebhookSecret,
+	}
+}
+
+func (c *HTTPCarrier) Track(ctx context.Context, trackingNumber string) (*Update, error) {
+	if c.endpoint == "" {
+		return nil, fmt.Errorf("carrier has no tracking endpoint")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/"+url.PathEscape(trackingNumber), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("carrier responded %s to tracking %s", resp.Status, trackingNumber)
+	}
+	var update Update
+	if err := json.NewDecoder(resp.Body).Decode(&update); err != nil {
+		return nil, err
+	}
+	if update.TrackingNumber == "" {
+		update.TrackingNumber = trackingNumber
+	}
+	return &update, nil
+}
+
+// httpNotification is the body of a webhook notification
+type httpNotification struct {
+	Updates []*Update `json:"updates"`
+}
+
+// ParseWebhook verifies the signature of a notification and returns its
+// updates. The notifications of a carrier without a webhook secret are refused.
+func (c *HTTPCarrier) ParseWebhook(header http.Header, body []byte) ([]*Update, error) {
+	if err := c.verify(header.Get(TimestampHeader), header.Get(SignatureHeader), body, time.Now()); err != nil {
+		return nil, err
+	}
+
+	var n httpNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, err
+	}
+	return n.Updates, nil
+}
+
+// verify checks the signature of a notification signed at timestamp, which
+// has to be within the tolerance of now
+func (c *HTTPCarrier) verify(timestamp, signature string, body []byte, now time.Time) error {
+	if c.webhookSecret == "" {
+		return ErrInvalidSignature
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return ErrInvalidSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(c.webhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package tracking
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHTTPCarrierVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"updates":[]}`)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-signatureTolerance-time.Second).Unix(), 10)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		valid     bool
+	}{
+		{name: "valid", secret: "whsec", timestamp: timestamp, signature: sign("whsec", timestamp, body), body: body, valid: true},
+		{name: "tampered body", secret: "whsec", timestamp: timestamp, signature: sign("whsec", timestamp, body), body: []byte(`{"updates":null}`)},
+		{name: "another secret", secret: "whsec", timestamp: timestamp, signature: sign("other", timestamp, body), body: body},
+		{name: "stale", secret: "whsec", timestamp: stale, signature: sign("whsec", stale, body), body: body},
+		{name: "signature of another time", secret: "whsec", timestamp: timestamp, signature: sign("whsec", stale, body), body: body},
+		{name: "no timestamp", secret: "whsec", signature: sign("whsec", "", body), body: body},
+		{name: "no secret", timestamp: timestamp, signature: sign("", timestamp, body), body: body},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &HTTPCarrier{webhookSecret: tt.secret}
+			err := c.verify(tt.timestamp, tt.signature, tt.body, now)
+			if tt.valid && err != nil {
+				t.Fatalf("verify() = %v, want nil", err)
+			}
+			if !tt.valid && err != ErrInvalidSignature {
+				t.Fatalf("verify() = %v, want %v", err, ErrInvalidSignature)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Package tracking reads the tracking of shipments from carriers, by polling them
+// or from their webhook notifications.
+package tracking
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// ErrInvalidSignature is returned for webhook notifications that fail authentication
+var ErrInvalidSignature = errors.New("invalid tracking webhook signature")
+
+// Status is the state of a shipment
+type Status string
+
+const (
+	StatusLabelCreated   Status = "label_created"
+	StatusInTransit      Status = "in_transit"
+	StatusOutForDelivery Status = "out_for_delivery"
+	StatusDelivered      Status = "delivered"
+	// StatusException marks a shipment that is delayed, damaged or returned to sender
+	StatusException Status = "exception"
+)
+
+var statuses = map[Status]bool{
+	StatusLabelCreated:   true,
+	StatusInTransit:      true,
+	StatusOutForDelivery: true,
+	StatusDelivered:      true,
+	StatusException:      true,
+}
+
+// Known reports whether s is one of the statuses above
+func (s Status) Known() bool {
+	return statuses[s]
+}
+
+// Moving reports whether a shipment in status s has left the warehouse
+func (s Status) Moving() bool {
+	return s == StatusInTransit || s == StatusOutForDelivery || s == StatusDelivered
+}
+
+// Update is a tracking event of a shipment reported by a carrier
+type Update struct {
+	TrackingNumber string `json:"trackingNumber"`
+	// Reference is the order id given to the carrier with the shipment, carriers
+	// echo it in webhook notifications
+	Reference   string    `json:"reference,omitempty"`
+	Status      Status    `json:"status"`
+	Location    string    `json:"location,omitempty"`
+	Description string    `json:"description,omitempty"`
+	OccurredAt  time.Time `json:"occurredAt"`
+}
+
+// Carrier reads the tracking of the shipments of one carrier
+type Carrier interface {
+	// Track returns the latest update of the shipment with trackingNumber
+	Track(ctx context.Context, trackingNumber string) (*Update, error)
+	// ParseWebhook authenticates a notification of the carrier and returns the
+	// updates it reports
+	ParseWebhook(header http.Header, body []byte) ([]*Update, error)
+}